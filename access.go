@@ -0,0 +1,213 @@
+package session
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// access errors
+var (
+	accessDeniedErr = NewSMTPError(554, [3]int{5, 7, 1}, "Access denied")
+	senderDeniedErr = NewSMTPError(550, [3]int{5, 7, 1}, "Sender address rejected: Access denied")
+)
+
+// AccessList is a list of networks, domains and email addresses.
+// a domain match its subdomains too
+type AccessList struct {
+	nets    []*net.IPNet
+	domains map[string]bool
+	addrs   map[string]bool
+}
+
+// ParseAccessList parse entries of IP address, CIDR network, domain
+// or email address. empty entries and entries starting with "#"
+// are ignored
+func ParseAccessList(entries []string) (*AccessList, error) {
+	l := &AccessList{domains: make(map[string]bool), addrs: make(map[string]bool)}
+	for _, e := range entries {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" || strings.HasPrefix(e, "#") {
+			continue
+		}
+		switch {
+		case strings.Contains(e, "/"):
+			_, n, err := net.ParseCIDR(e)
+			if err != nil {
+				return nil, fmt.Errorf("access list: invalid network %q", e)
+			}
+			l.nets = append(l.nets, n)
+		case net.ParseIP(e) != nil:
+			ip := net.ParseIP(e)
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			l.nets = append(l.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		case strings.Contains(e, "@"):
+			l.addrs[e] = true
+		default:
+			l.domains[strings.TrimSuffix(e, ".")] = true
+		}
+	}
+	return l, nil
+}
+
+// ReadAccessList parse one entry per line, text after "#" is comment
+func ReadAccessList(r io.Reader) (*AccessList, error) {
+	var entries []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		entries = append(entries, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return ParseAccessList(entries)
+}
+
+// Len return the number of entries
+func (l *AccessList) Len() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.nets) + len(l.domains) + len(l.addrs)
+}
+
+// MatchIP report whether ip is in the list
+func (l *AccessList) MatchIP(ip net.IP) bool {
+	if l == nil || ip == nil {
+		return false
+	}
+	for _, n := range l.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchSender report whether the address or its domain is in the list
+func (l *AccessList) MatchSender(addr string) bool {
+	if l == nil || addr == "" {
+		return false
+	}
+	if l.addrs[strings.ToLower(addr)] {
+		return true
+	}
+	domain := domainOf(addr)
+	for domain != "" {
+		if l.domains[domain] {
+			return true
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return false
+}
+
+// Access reject blocklisted clients at connection time and
+// blocklisted senders at MAIL command. allowlist entries win over
+// blocklist entries and allowlisted clients skip DNSBL checks.
+// lists of feeds are swapped atomically by FeedFetcher
+type Access struct {
+	Block *AccessList
+	Allow *AccessList
+
+	mu    sync.Mutex
+	feeds atomic.Value // map[string]accessFeed
+}
+
+// accessFeed is the current list of a feed
+type accessFeed struct {
+	allow bool
+	list  *AccessList
+}
+
+// SetFeed replace the list of the named feed, allow report whether
+// the feed is an allowlist
+func (a *Access) SetFeed(name string, allow bool, l *AccessList) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	old, _ := a.feeds.Load().(map[string]accessFeed)
+	feeds := make(map[string]accessFeed, len(old)+1)
+	for k, v := range old {
+		feeds[k] = v
+	}
+	feeds[name] = accessFeed{allow, l}
+	a.feeds.Store(feeds)
+}
+
+// Feed return the current list of the named feed
+func (a *Access) Feed(name string) *AccessList {
+	feeds, _ := a.feeds.Load().(map[string]accessFeed)
+	return feeds[name].list
+}
+
+// match report whether any allow or block list match
+func (a *Access) match(allow bool, fn func(l *AccessList) bool) bool {
+	static := a.Block
+	if allow {
+		static = a.Allow
+	}
+	if fn(static) {
+		return true
+	}
+	feeds, _ := a.feeds.Load().(map[string]accessFeed)
+	for _, f := range feeds {
+		if f.allow == allow && fn(f.list) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedIP report whether ip is allowlisted
+func (a *Access) AllowedIP(ip net.IP) bool {
+	return a != nil && a.match(true, func(l *AccessList) bool { return l.MatchIP(ip) })
+}
+
+// BlockedIP report whether ip is blocklisted and not allowlisted
+func (a *Access) BlockedIP(ip net.IP) bool {
+	return a != nil && !a.AllowedIP(ip) && a.match(false, func(l *AccessList) bool { return l.MatchIP(ip) })
+}
+
+// BlockedSender report whether addr is blocklisted and not allowlisted
+func (a *Access) BlockedSender(addr string) bool {
+	if a == nil {
+		return false
+	}
+	if a.match(true, func(l *AccessList) bool { return l.MatchSender(addr) }) {
+		return false
+	}
+	return a.match(false, func(l *AccessList) bool { return l.MatchSender(addr) })
+}
+
+// checkAccessIP reject blocklisted client
+func (s *Session) checkAccessIP() error {
+	if s.Config.Access.BlockedIP(s.RemoteIP()) {
+		return accessDeniedErr
+	}
+	return nil
+}
+
+// checkAccessSender reject blocklisted sender, null sender is
+// never rejected
+func (s *Session) checkAccessSender(addr string) error {
+	if s.Config.Access.BlockedSender(addr) {
+		return senderDeniedErr
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package session
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestAccessList make sure that networks, domains and addresses match
+func TestAccessList(t *testing.T) {
+	l, err := ReadAccessList(strings.NewReader("# comment\n192.0.2.0/24\n2001:db8::1\nspam.com # inline\nbad@example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Len() != 4 {
+		t.Errorf("got %d entries, expected 4", l.Len())
+	}
+
+	ips := []struct {
+		ip      string
+		matched bool
+	}{
+		{"192.0.2.55", true},
+		{"198.51.100.1", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+	}
+	for _, input := range ips {
+		if got := l.MatchIP(net.ParseIP(input.ip)); got != input.matched {
+			t.Errorf("%q: got %t, expected %t", input.ip, got, input.matched)
+		}
+	}
+
+	senders := []struct {
+		addr    string
+		matched bool
+	}{
+		{"any@spam.com", true},
+		{"any@mail.spam.com", true},
+		{"any@notspam.com", false},
+		{"Bad@Example.com", true},
+		{"good@example.com", false},
+		{"", false},
+	}
+	for _, input := range senders {
+		if got := l.MatchSender(input.addr); got != input.matched {
+			t.Errorf("%q: got %t, expected %t", input.addr, got, input.matched)
+		}
+	}
+
+	if _, err := ParseAccessList([]string{"192.0.2.0/99"}); err == nil {
+		t.Errorf("invalid network should fail")
+	}
+}
+
+// TestSessionAccess make sure that blocklisted clients and senders
+// are rejected unless allowlisted
+func TestSessionAccess(t *testing.T) {
+	block, _ := ParseAccessList([]string{"127.0.0.0/8", "spam.com"})
+	allow, _ := ParseAccessList([]string{"127.0.0.1"})
+	access := &Access{Block: block}
+	access.SetFeed("allow", true, allow)
+
+	cases := []struct {
+		remote   string
+		sender   string
+		expected string
+	}{
+		{"127.0.0.2:2525", "some@example.com", "554 5.7.1 Access denied\r\n"},
+		{"127.0.0.1:2525", "some@example.com", "250 2.0.0 OK\r\n"},
+		{"127.0.0.1:2525", "some@spam.com", "550 5.7.1 Sender address rejected: Access denied\r\n"},
+	}
+
+	for _, input := range cases {
+		config := &Config{Access: access}
+		out := runSessionFrom(t, config, input.remote, "HELO client.com\r\nMAIL FROM:<"+input.sender+">\r\nQUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("%s %s: got %q, expected %q", input.remote, input.sender, out, input.expected)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maximum activity kept by UserStore
+const maxActivity = 1000
+
+// account errors
+var (
+	ErrUserExists  = errors.New("session: user already exists")
+	ErrUnknownUser = errors.New("session: unknown user")
+	ErrInvalidUser = errors.New("session: invalid user name or tenant")
+)
+
+// Activity is an event of an account like "auth" or "disabled"
+type Activity struct {
+	Time  time.Time `json:"time"`
+	User  string    `json:"user"`
+	Event string    `json:"event"`
+}
+
+// AccountStore manage accounts of a user store, it is used by the
+// accounts endpoints of Admin
+type AccountStore interface {
+	Users() []*User
+	User(name string) (*User, bool)
+	CreateUser(u *User, password string) error
+	SetPassword(name, password string) error
+	SetDisabled(name string, disabled bool) error
+	SetQuota(name string, quota Quota) error
+	// CreateToken add an app token and return its credential
+	CreateToken(name, device string) (AppToken, string, error)
+	RevokeToken(name, id string) error
+	// Activity return recent events of user, newest first.
+	// empty user return events of every user
+	Activity(user string, limit int) []Activity
+}
+
+// record add an event into the activity of the store
+func (us *UserStore) record(user, event string) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.activity = append(us.activity, Activity{Time: time.Now(), User: user, Event: event})
+	if len(us.activity) > maxActivity {
+		us.activity = us.activity[len(us.activity)-maxActivity:]
+	}
+}
+
+// Activity return recent events of user, newest first
+func (us *UserStore) Activity(user string, limit int) []Activity {
+	user = strings.ToLower(user)
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	var events []Activity
+	for i := len(us.activity) - 1; i >= 0 && (limit <= 0 || len(events) < limit); i-- {
+		if user == "" || us.activity[i].User == user {
+			events = append(events, us.activity[i])
+		}
+	}
+	return events
+}
+
+// Users return every account ordered by name
+func (us *UserStore) Users() []*User {
+	us.refresh()
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	users := make([]*User, 0, len(us.users))
+	for _, u := range us.users {
+		copied := *u
+		users = append(users, &copied)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// CreateUser add an account with password
+func (us *UserStore) CreateUser(u *User, password string) error {
+	if u.Name == "" || strings.ContainsAny(u.Name, ":# \t\r\n") || strings.ContainsAny(u.Tenant, ":,= \t\r\n") {
+		return ErrInvalidUser
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	created := *u
+	created.Name, created.Hash = strings.ToLower(u.Name), hash
+	return us.update(created.Name, "created", func(users map[string]*User) error {
+		if _, ok := users[created.Name]; ok {
+			return ErrUserExists
+		}
+		users[created.Name] = &created
+		return nil
+	})
+}
+
+// SetPassword replace the password of user
+func (us *UserStore) SetPassword(name, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return us.modify(name, "password", func(u *User) error {
+		u.Hash = hash
+		return nil
+	})
+}
+
+// SetDisabled disable or enable user
+func (us *UserStore) SetDisabled(name string, disabled bool) error {
+	event := "enabled"
+	if disabled {
+		event = "disabled"
+	}
+	return us.modify(name, event, func(u *User) error {
+		u.Disabled = disabled
+		return nil
+	})
+}
+
+// SetQuota replace the quota of user
+func (us *UserStore) SetQuota(name string, quota Quota) error {
+	return us.modify(name, "quota", func(u *User) error {
+		u.Quota = quota
+		return nil
+	})
+}
+
+// modify change the account of name
+func (us *UserStore) modify(name, event string, fn func(u *User) error) error {
+	name = strings.ToLower(name)
+	return us.update(name, event, func(users map[string]*User) error {
+		u, ok := users[name]
+		if !ok {
+			return ErrUnknownUser
+		}
+		copied := *u
+		if err := fn(&copied); err != nil {
+			return err
+		}
+		users[name] = &copied
+		return nil
+	})
+}
+
+// update apply fn on a copy of the accounts and write them into the
+// file. comments of the file are not kept
+func (us *UserStore) update(name, event string, fn func(users map[string]*User) error) error {
+	us.refresh()
+	us.mu.Lock()
+	users := make(map[string]*User, len(us.users)+1)
+	for k, u := range us.users {
+		users[k] = u
+	}
+	if err := fn(users); err != nil {
+		us.mu.Unlock()
+		return err
+	}
+
+	names := make([]string, 0, len(users))
+	for k := range users {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, k := range names {
+		b.WriteString(users[k].String() + "\n")
+	}
+	err := writeFile(us.Path, []byte(b.String()))
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = os.Stat(us.Path); err == nil {
+			us.users, us.modTime = users, fi.ModTime()
+		}
+	}
+	us.mu.Unlock()
+
+	if err == nil {
+		us.record(name, event)
+	}
+	return err
+}
+
+// account is an user in replies of the admin API
+type account struct {
+	Name     string `json:"name"`
+	Password string `json:"password,omitempty"`
+	Tenant   string `json:"tenant,omitempty"`
+	Quota    Quota  `json:"quota"`
+	Disabled bool   `json:"disabled"`
+}
+
+func newAccount(u *User) account {
+	return account{Name: u.Name, Tenant: u.Tenant, Quota: u.Quota, Disabled: u.Disabled}
+}
+
+// newPassword return a random password for rotation
+func newPassword() string {
+	return rand.Text()
+}
+
+// serveAccounts handle the accounts endpoints of Admin.
+//
+//	GET  /accounts                  list accounts
+//	POST /accounts                  create account from JSON
+//	GET  /accounts/{name}
+//	PUT  /accounts/{name}/password  JSON {"password": ...}, empty
+//	                                password is generated and returned
+//	PUT  /accounts/{name}/disabled  body is "true" or "false"
+//	PUT  /accounts/{name}/quota     JSON {"bytes": ..., "messages": ...}
+//	GET  /accounts/{name}/tokens    app tokens without secrets
+//	POST /accounts/{name}/tokens    JSON {"device": ...}, the
+//	                                credential is only returned once
+//	DELETE /accounts/{name}/tokens/{id}
+//	GET  /accounts/{name}/activity  recent events, ?limit=n
+//	GET  /activity                  recent events of every account
+func (a *Admin) serveAccounts(w http.ResponseWriter, r *http.Request, path string) {
+	store := a.Accounts
+	if path == "/activity" && r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, store.Activity("", queryLimit(r)))
+		return
+	}
+	if path == "/accounts" {
+		switch r.Method {
+		case http.MethodGet:
+			var list []account
+			for _, u := range store.Users() {
+				list = append(list, newAccount(u))
+			}
+			writeJSON(w, http.StatusOK, list)
+		case http.MethodPost:
+			var req account
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+				http.Error(w, "invalid account", http.StatusBadRequest)
+				return
+			}
+			u := &User{Name: req.Name, Tenant: req.Tenant, Quota: req.Quota, Disabled: req.Disabled}
+			if err := store.CreateUser(u, req.Password); err != nil {
+				accountError(w, err)
+				return
+			}
+			created, _ := store.User(req.Name)
+			writeJSON(w, http.StatusCreated, newAccount(created))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	name, field, _ := strings.Cut(strings.TrimPrefix(path, "/accounts/"), "/")
+	u, ok := store.User(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case field == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, newAccount(u))
+	case field == "tokens" && r.Method == http.MethodGet:
+		tokens := u.Tokens
+		if tokens == nil {
+			tokens = []AppToken{}
+		}
+		writeJSON(w, http.StatusOK, tokens)
+	case field == "tokens" && r.Method == http.MethodPost:
+		var req struct {
+			Device string `json:"device"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid device", http.StatusBadRequest)
+			return
+		}
+		t, credential, err := store.CreateToken(u.Name, req.Device)
+		if err != nil {
+			accountError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, struct {
+			AppToken
+			Token string `json:"token"`
+		}{t, credential})
+	case strings.HasPrefix(field, "tokens/") && r.Method == http.MethodDelete:
+		if err := store.RevokeToken(u.Name, strings.TrimPrefix(field, "tokens/")); err != nil {
+			accountError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case field == "activity" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, store.Activity(u.Name, queryLimit(r)))
+	case field == "password" && r.Method == http.MethodPut:
+		var req account
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid password", http.StatusBadRequest)
+			return
+		}
+		generated := req.Password == ""
+		if generated {
+			req.Password = newPassword()
+		}
+		if err := store.SetPassword(u.Name, req.Password); err != nil {
+			accountError(w, err)
+			return
+		}
+		if !generated {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, http.StatusOK, account{Name: u.Name, Password: req.Password})
+	case field == "disabled" && r.Method == http.MethodPut:
+		body, err := readBody(r)
+		disabled, perr := strconv.ParseBool(body)
+		if err != nil || perr != nil {
+			http.Error(w, "body must be true or false", http.StatusBadRequest)
+			return
+		}
+		if err := store.SetDisabled(u.Name, disabled); err != nil {
+			accountError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case field == "quota" && r.Method == http.MethodPut:
+		var q Quota
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil || q.Bytes < 0 || q.Messages < 0 {
+			http.Error(w, "invalid quota", http.StatusBadRequest)
+			return
+		}
+		if err := store.SetQuota(u.Name, q); err != nil {
+			accountError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// accountError reply err of AccountStore
+func accountError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrUserExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case ErrInvalidUser, ErrInvalidDevice:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case ErrUnknownUser, ErrUnknownToken:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// queryLimit return limit query parameter, default to 100
+func queryLimit(r *http.Request) int {
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		return n
+	}
+	return 100
+}
+
+// writeJSON reply v as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,86 @@
+package session
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestAdminAccounts make sure that accounts of the user store can be
+// created, rotated, disabled and limited through the admin API
+func TestAdminAccounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("user:"+testHash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	us, err := OpenUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := &Admin{Accounts: us}
+
+	cases := []struct {
+		method, path, body string
+		expected           int
+	}{
+		{http.MethodPost, "/accounts", `{"name":"New@example.com","password":"pw1","tenant":"acme"}`, http.StatusCreated},
+		{http.MethodPost, "/accounts", `{"name":"new@example.com","password":"pw1"}`, http.StatusConflict},
+		{http.MethodPost, "/accounts", `{"name":"bad:name","password":"pw1"}`, http.StatusBadRequest},
+		{http.MethodPost, "/accounts", `{"name":"nopassword"}`, http.StatusBadRequest},
+		{http.MethodPut, "/accounts/new@example.com/quota", `{"bytes":1024,"messages":10}`, http.StatusNoContent},
+		{http.MethodPut, "/accounts/new@example.com/quota", `{"bytes":-1}`, http.StatusBadRequest},
+		{http.MethodPut, "/accounts/user/disabled", "true", http.StatusNoContent},
+		{http.MethodPut, "/accounts/user/disabled", "maybe", http.StatusBadRequest},
+		{http.MethodPut, "/accounts/user/password", `{"password":"pw2"}`, http.StatusNoContent},
+		{http.MethodPut, "/accounts/nobody/password", `{"password":"pw2"}`, http.StatusNotFound},
+		{http.MethodGet, "/accounts/new@example.com", "", http.StatusOK},
+		{http.MethodDelete, "/accounts", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/log", "", http.StatusNotFound},
+	}
+
+	for _, input := range cases {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(input.method, input.path, strings.NewReader(input.body)))
+		if rec.Code != input.expected {
+			t.Errorf("%s %s: got status %d, expected %d: %s", input.method, input.path, rec.Code, input.expected, rec.Body)
+		}
+	}
+
+	// the file is written and read back
+	reopened, err := OpenUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q, _ := reopened.Quota("new@example.com"); q != (Quota{Bytes: 1024, Messages: 10}) {
+		t.Errorf("got quota %+v, expected 1024 bytes and 10 messages", q)
+	}
+	if _, err := reopened.Authenticate("user", "pw2"); err != ErrAuthFailed {
+		t.Errorf("got %v, expected disabled user", err)
+	}
+	if p, err := reopened.Authenticate("new@example.com", "pw1"); err != nil || p.Tenant != "acme" {
+		t.Errorf("got %+v, %v, expected new user of acme", p, err)
+	}
+
+	// rotate with generated password
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/accounts/new@example.com/password", strings.NewReader(`{}`)))
+	var rotated account
+	if err := json.NewDecoder(rec.Body).Decode(&rotated); err != nil || rotated.Password == "" {
+		t.Fatalf("got %d %+v, %v, expected generated password", rec.Code, rotated, err)
+	}
+	if _, err := us.Authenticate("new@example.com", rotated.Password); err != nil {
+		t.Errorf("got %v, expected rotated password to be valid", err)
+	}
+
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/accounts/new@example.com/activity?limit=2", nil))
+	var events []Activity
+	json.NewDecoder(rec.Body).Decode(&events)
+	if len(events) != 2 || events[0].Event != "auth" || events[1].Event != "password" {
+		t.Errorf("got %+v, expected auth and password events", events)
+	}
+}
@@ -0,0 +1,82 @@
+package session
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// acmeALPNProto is the ALPN protocol of the TLS-ALPN-01 challenge
+// (RFC 8737)
+const acmeALPNProto = "acme-tls/1"
+
+// errACMEChallengeOnly is returned to handshakes of ServeACMEChallenges
+// that are not challenges
+var errACMEChallengeOnly = errors.New("session: only ACME challenges are served")
+
+// CertManager get certificates issued on demand, like *autocert.Manager
+// of golang.org/x/crypto/acme/autocert. the certificates are stored
+// in the cache of the manager, e.g. autocert.DirCache or a shared
+// cache when several servers serve the same names
+type CertManager interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// ACMETLSConfig return the TLS config of STARTTLS and implicit TLS
+// getting certificates from m. SMTP clients often don't send SNI,
+// hostname is asked to m then. e.g.
+//
+//	m := &autocert.Manager{
+//		Prompt:     autocert.AcceptTOS,
+//		HostPolicy: autocert.HostWhitelist("mx.example.com"),
+//		Cache:      autocert.DirCache("/var/lib/session/certs"),
+//	}
+//	config.TLSConfig = session.ACMETLSConfig(m, "mx.example.com")
+//	go session.ServeACMEChallenges(tlsALPNListener, m)
+func ACMETLSConfig(m CertManager, hostname string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName == "" || net.ParseIP(hello.ServerName) != nil {
+				copied := *hello
+				copied.ServerName = strings.TrimSuffix(hostname, ".")
+				hello = &copied
+			}
+			return m.GetCertificate(hello)
+		},
+	}
+}
+
+// ServeACMEChallenges answer the TLS-ALPN-01 challenges of m on l,
+// which must receive the connections of port 443. the challenge is
+// done by the handshake, the connections are closed after it.
+// ServeACMEChallenges return when l is closed
+func ServeACMEChallenges(l net.Listener, m CertManager) error {
+	config := &tls.Config{
+		// other handshakes must not make m issue certificates
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if !slices.Contains(hello.SupportedProtos, acmeALPNProto) {
+				return nil, errACMEChallengeOnly
+			}
+			return m.GetCertificate(hello)
+		},
+		NextProtos: []string{acmeALPNProto},
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+			tls.Server(conn, config).Handshake()
+		}()
+	}
+}
@@ -0,0 +1,90 @@
+package session
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+)
+
+// fakeCertManager return the test certificate and record the asked
+// server names
+type fakeCertManager struct {
+	cert  *tls.Certificate
+	mu    sync.Mutex
+	names []string
+}
+
+func (m *fakeCertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.names = append(m.names, hello.ServerName)
+	return m.cert, nil
+}
+
+// TestACMETLSConfig make sure that the hostname is asked when the
+// client send no SNI or an IP address
+func TestACMETLSConfig(t *testing.T) {
+	cases := []struct {
+		serverName string
+		expected   string
+	}{
+		{"", "mx.example.com"},
+		{"127.0.0.1", "mx.example.com"},
+		{"mail.example.org", "mail.example.org"},
+	}
+
+	for _, input := range cases {
+		m := &fakeCertManager{cert: &testTLSConfig(t).Certificates[0]}
+		config := ACMETLSConfig(m, "mx.example.com.")
+		cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: input.serverName})
+		if err != nil || cert != m.cert {
+			t.Errorf("%q: got %v, %v", input.serverName, cert, err)
+		}
+		if len(m.names) != 1 || m.names[0] != input.expected {
+			t.Errorf("%q: got names %v, expected %s", input.serverName, m.names, input.expected)
+		}
+	}
+}
+
+// TestServeACMEChallenges make sure that only TLS-ALPN-01 handshakes
+// get certificates
+func TestServeACMEChallenges(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeCertManager{cert: &testTLSConfig(t).Certificates[0]}
+	done := make(chan error, 1)
+	go func() { done <- ServeACMEChallenges(l, m) }()
+
+	cases := []struct {
+		protos []string
+		ok     bool
+	}{
+		{[]string{acmeALPNProto}, true},
+		{nil, false},
+		{[]string{"h2"}, false},
+	}
+	for _, input := range cases {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			ServerName:         "mx.example.com",
+			NextProtos:         input.protos,
+			InsecureSkipVerify: true,
+		})
+		if (err == nil) != input.ok {
+			t.Errorf("%v: got error %v", input.protos, err)
+		}
+		if err == nil {
+			if p := conn.ConnectionState().NegotiatedProtocol; p != acmeALPNProto {
+				t.Errorf("%v: got protocol %q", input.protos, p)
+			}
+			conn.Close()
+		}
+	}
+
+	l.Close()
+	if err := <-done; err != nil {
+		t.Errorf("got %v, expected nil", err)
+	}
+}
@@ -0,0 +1,134 @@
+package session
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Admin is HTTP handler of the runtime administration API.
+//
+//	GET  /log                 current level, sampling and captured IPs
+//	PUT  /log/level           body is level name like "debug"
+//	PUT  /log/sampling        body is rate between 0 and 1
+//	PUT  /log/transcript/{ip} enable transcript capture of ip
+//	DELETE /log/transcript/{ip}
+//	GET  /capabilities        capability report of clients
+//
+// and the accounts endpoints when Accounts is set, see serveAccounts,
+// and the sessions endpoints when Server is set, see serveSessions
+type Admin struct {
+	Logger       *Logger
+	Accounts     AccountStore
+	Capabilities *CapabilityReport
+	Server       *Server
+}
+
+// capabilityStatus is the reply of GET /capabilities
+type capabilityStatus struct {
+	Total      ClientCapabilities   `json:"total"`
+	WithoutTLS []string             `json:"without_tls"`
+	Clients    []ClientCapabilities `json:"clients"`
+}
+
+// logStatus is the reply of GET /log
+type logStatus struct {
+	Level       string   `json:"level"`
+	Sampling    float64  `json:"sampling"`
+	Transcripts []string `json:"transcripts"`
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if a.Accounts != nil && (path == "/activity" || path == "/accounts" || strings.HasPrefix(path, "/accounts/")) {
+		a.serveAccounts(w, r, path)
+		return
+	}
+	if a.Capabilities != nil && path == "/capabilities" && r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, capabilityStatus{
+			Total:      a.Capabilities.Total(),
+			WithoutTLS: a.Capabilities.WithoutTLS(),
+			Clients:    a.Capabilities.Clients(),
+		})
+		return
+	}
+	if a.Server != nil && (path == "/pause" || path == "/sessions" || strings.HasPrefix(path, "/sessions/")) {
+		a.serveSessions(w, r, path)
+		return
+	}
+	if a.Logger == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case path == "/log" && r.Method == http.MethodGet:
+		ips := a.Logger.Captured()
+		sort.Strings(ips)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(logStatus{
+			Level:       a.Logger.Level().String(),
+			Sampling:    a.Logger.Sampling(),
+			Transcripts: ips,
+		})
+	case path == "/log/level" && r.Method == http.MethodPut:
+		body, err := readBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level, err := ParseLevel(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.Logger.SetLevel(level)
+		w.WriteHeader(http.StatusNoContent)
+	case path == "/log/sampling" && r.Method == http.MethodPut:
+		body, err := readBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rate, err := strconv.ParseFloat(body, 64)
+		if err == nil {
+			err = a.Logger.SetSampling(rate)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(path, "/log/transcript/"):
+		ip := net.ParseIP(strings.TrimPrefix(path, "/log/transcript/"))
+		if ip == nil {
+			http.Error(w, "invalid IP address", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			a.Logger.Capture(ip.String(), true)
+		case http.MethodDelete:
+			a.Logger.Capture(ip.String(), false)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// readBody read small request body as trimmed string
+func readBody(r *http.Request) (string, error) {
+	b, err := io.ReadAll(io.LimitReader(r.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
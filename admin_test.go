@@ -0,0 +1,46 @@
+package session
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestAdminLog make sure that logger settings can be changed
+// through the admin API
+func TestAdminLog(t *testing.T) {
+	lg := NewLogger(io.Discard)
+	admin := &Admin{Logger: lg}
+
+	cases := []struct {
+		method, path, body string
+		expected           int
+	}{
+		{http.MethodPut, "/log/level", "debug", http.StatusNoContent},
+		{http.MethodPut, "/log/level", "loud", http.StatusBadRequest},
+		{http.MethodPut, "/log/sampling", "0.25", http.StatusNoContent},
+		{http.MethodPut, "/log/sampling", "5", http.StatusBadRequest},
+		{http.MethodPut, "/log/transcript/192.0.2.1", "", http.StatusNoContent},
+		{http.MethodPut, "/log/transcript/2001:db8::1", "", http.StatusNoContent},
+		{http.MethodDelete, "/log/transcript/2001:db8::1", "", http.StatusNoContent},
+		{http.MethodPut, "/log/transcript/host", "", http.StatusBadRequest},
+		{http.MethodGet, "/unknown", "", http.StatusNotFound},
+	}
+
+	for _, input := range cases {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(input.method, input.path, strings.NewReader(input.body)))
+		if rec.Code != input.expected {
+			t.Errorf("%s %s: got status %d, expected %d", input.method, input.path, rec.Code, input.expected)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/log", nil))
+	expected := `{"level":"debug","sampling":0.25,"transcripts":["192.0.2.1"]}`
+	if got := strings.TrimSpace(rec.Body.String()); got != expected {
+		t.Errorf("got: %s, expected: %s", got, expected)
+	}
+}
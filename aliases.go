@@ -0,0 +1,185 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// maxAliasDepth limit nested alias expansion
+const maxAliasDepth = 8
+
+// aliasLoopErr is sent when alias expansion doesn't terminate
+var aliasLoopErr = NewSMTPError(550, [3]int{5, 4, 6}, "Routing loop detected")
+
+// AliasLookup map an alias or virtual address to its destinations,
+// e.g. from a file, SQL table or LDAP directory. it return no
+// destination for an address that is not an alias
+type AliasLookup interface {
+	LookupAlias(ctx context.Context, addr string) ([]string, error)
+}
+
+// AliasLookupFunc is an adapter to allow the use of ordinary
+// functions as AliasLookup
+type AliasLookupFunc func(ctx context.Context, addr string) ([]string, error)
+
+// LookupAlias call f(ctx, addr)
+func (f AliasLookupFunc) LookupAlias(ctx context.Context, addr string) ([]string, error) {
+	return f(ctx, addr)
+}
+
+// aliasRegexp is a regular expression entry of AliasMap
+type aliasRegexp struct {
+	re    *regexp.Regexp
+	dests []string
+}
+
+// AliasMap is an AliasLookup of exact addresses, domain wildcards
+// and regular expressions. exact addresses win over regular
+// expressions, which win over domain wildcards
+type AliasMap struct {
+	addrs   map[string][]string
+	domains map[string][]string
+	regexps []aliasRegexp
+}
+
+// ParseAliasMap parse entries "alias: dest, dest". alias is an
+// address, "@domain" for any address of domain or "/regexp/".
+// destination "@domain" keep the local part of the address and
+// regexp destinations may refer to submatches like "$1"
+func ParseAliasMap(entries []string) (*AliasMap, error) {
+	m := &AliasMap{addrs: make(map[string][]string), domains: make(map[string][]string)}
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" || strings.HasPrefix(e, "#") {
+			continue
+		}
+		i := strings.LastIndex(e, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("aliases: invalid entry %q", e)
+		}
+		alias := strings.TrimSpace(e[:i])
+		var dests []string
+		for _, d := range strings.Split(e[i+1:], ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				dests = append(dests, d)
+			}
+		}
+		if alias == "" || len(dests) == 0 {
+			return nil, fmt.Errorf("aliases: invalid entry %q", e)
+		}
+		switch {
+		case len(alias) > 1 && strings.HasPrefix(alias, "/") && strings.HasSuffix(alias, "/"):
+			re, err := regexp.Compile("(?i)" + alias[1:len(alias)-1])
+			if err != nil {
+				return nil, fmt.Errorf("aliases: %v", err)
+			}
+			m.regexps = append(m.regexps, aliasRegexp{re, dests})
+		case strings.HasPrefix(alias, "@"):
+			m.domains[strings.ToLower(alias[1:])] = dests
+		default:
+			m.addrs[strings.ToLower(alias)] = dests
+		}
+	}
+	return m, nil
+}
+
+// ReadAliasMap parse one entry per line, lines starting with "#"
+// are comment
+func ReadAliasMap(r io.Reader) (*AliasMap, error) {
+	var entries []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		entries = append(entries, sc.Text())
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return ParseAliasMap(entries)
+}
+
+// LookupAlias return the destinations of addr
+func (m *AliasMap) LookupAlias(ctx context.Context, addr string) ([]string, error) {
+	addr = strings.ToLower(addr)
+	if dests, ok := m.addrs[addr]; ok {
+		return dests, nil
+	}
+	for _, r := range m.regexps {
+		match := r.re.FindStringSubmatchIndex(addr)
+		if match == nil {
+			continue
+		}
+		dests := make([]string, len(r.dests))
+		for i, d := range r.dests {
+			dests[i] = string(r.re.ExpandString(nil, d, addr, match))
+		}
+		return dests, nil
+	}
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return nil, nil
+	}
+	local := addr[:i]
+	dests := m.domains[addr[i+1:]]
+	if dests == nil {
+		return nil, nil
+	}
+	expanded := make([]string, len(dests))
+	for i, d := range dests {
+		if strings.HasPrefix(d, "@") {
+			d = local + d
+		}
+		expanded[i] = d
+	}
+	return expanded, nil
+}
+
+// expandAlias return the canonical destinations of rcpt, nil when
+// rcpt is not an alias. aliases of destinations are expanded too
+func (s *Session) expandAlias(ctx context.Context, rcpt string) ([]string, error) {
+	if s.Config.Aliases == nil {
+		return nil, nil
+	}
+	var result []string
+	seen := make(map[string]bool)
+	var expand func(addr string, depth int) (bool, error)
+	expand = func(addr string, depth int) (bool, error) {
+		if depth > maxAliasDepth {
+			return false, aliasLoopErr
+		}
+		dests, err := s.Config.Aliases.LookupAlias(ctx, addr)
+		if err != nil {
+			s.logf(LevelWarn, "alias lookup of <%s>: %v", addr, err)
+			return false, replyErr(err)
+		}
+		if len(dests) == 0 {
+			return false, nil
+		}
+		for _, d := range dests {
+			// an alias may include itself to keep a copy
+			if strings.EqualFold(d, addr) {
+				if !seen[strings.ToLower(d)] {
+					seen[strings.ToLower(d)] = true
+					result = append(result, d)
+				}
+				continue
+			}
+			aliased, err := expand(d, depth+1)
+			if err != nil {
+				return false, err
+			}
+			if !aliased && !seen[strings.ToLower(d)] {
+				seen[strings.ToLower(d)] = true
+				result = append(result, d)
+			}
+		}
+		return true, nil
+	}
+	if _, err := expand(rcpt, 0); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,112 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestAliasMap make sure that exact, regexp and domain entries are
+// looked up in order
+func TestAliasMap(t *testing.T) {
+	m, err := ReadAliasMap(strings.NewReader(`# aliases
+postmaster@example.com: root@example.com
+sales@example.com: alice@example.com, bob@example.com
+/^support-(\w+)@example\.com$/: $1@support.example.com
+@old.example.com: @example.com
+@catchall.example.com: inbox@example.com
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		addr     string
+		expected []string
+	}{
+		{"Postmaster@EXAMPLE.com", []string{"root@example.com"}},
+		{"sales@example.com", []string{"alice@example.com", "bob@example.com"}},
+		{"support-eu@example.com", []string{"eu@support.example.com"}},
+		{"carol@old.example.com", []string{"carol@example.com"}},
+		{"anyone@catchall.example.com", []string{"inbox@example.com"}},
+		{"carol@example.com", nil},
+	}
+
+	for _, input := range cases {
+		got, err := m.LookupAlias(context.Background(), input.addr)
+		if err != nil || !reflect.DeepEqual(got, input.expected) {
+			t.Errorf("%s: got %v %v, expected %v", input.addr, got, err, input.expected)
+		}
+	}
+
+	for _, entry := range []string{"no-destination:", "novalue", "/(/: a@example.com"} {
+		if _, err := ParseAliasMap([]string{entry}); err == nil {
+			t.Errorf("%q: got no error, expected invalid entry", entry)
+		}
+	}
+}
+
+// TestSessionAliases make sure that recipients are expanded at RCPT
+// and only recipients that are not aliases are checked
+func TestSessionAliases(t *testing.T) {
+	m, err := ParseAliasMap([]string{
+		"team@example.com: alice@example.com, sales@example.com",
+		"sales@example.com: bob@example.com, alice@example.com",
+		"keep@example.com: keep@example.com, archive@example.com",
+		"loop1@example.com: loop2@example.com",
+		"loop2@example.com: loop1@example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := AliasLookupFunc(func(ctx context.Context, addr string) ([]string, error) {
+		return nil, errors.New("directory down")
+	})
+
+	cases := []struct {
+		aliases  AliasLookup
+		rcpt     string
+		reply    string
+		expected []string
+	}{
+		{m, "team@example.com", "250 2.1.5 OK", []string{"alice@example.com", "bob@example.com"}},
+		{m, "keep@example.com", "250 2.1.5 OK", []string{"keep@example.com", "archive@example.com"}},
+		{m, "carol@example.com", "250 2.1.5 OK", []string{"carol@example.com"}},
+		{m, "unknown@example.com", "550 5.1.1", nil},
+		{m, "loop1@example.com", "550 5.4.6 Routing loop detected", nil},
+		{broken, "team@example.com", "451 4.3.0", nil},
+	}
+
+	for _, input := range cases {
+		var delivered []string
+		var dsn map[string]*DSNRecipient
+		config := &Config{
+			Aliases: input.aliases,
+			RcptChecker: RcptCheckerFunc(func(ctx context.Context, envl *Envelope, rcpt string) error {
+				if strings.HasPrefix(rcpt, "unknown") {
+					return ErrRcptUnknown
+				}
+				return nil
+			}),
+			Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+				delivered, dsn = envl.RecipientAddress, envl.DSNRcpt
+				return nil
+			}),
+		}
+		out := runSession(t, config, "EHLO client.com\r\nMAIL FROM:<a@client.com>\r\nRCPT TO:<"+input.rcpt+"> NOTIFY=NEVER\r\n"+
+			"DATA\r\nSubject: a\r\n\r\n.\r\nQUIT\r\n")
+		if !strings.Contains(out, input.reply) {
+			t.Errorf("%s: got %q, expected %q", input.rcpt, out, input.reply)
+		}
+		if !reflect.DeepEqual(delivered, input.expected) {
+			t.Errorf("%s: got recipients %v, expected %v", input.rcpt, delivered, input.expected)
+		}
+		for _, rcpt := range input.expected {
+			if dsn[rcpt] == nil {
+				t.Errorf("%s: missing DSN parameters of %s", input.rcpt, rcpt)
+			}
+		}
+	}
+}
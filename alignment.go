@@ -0,0 +1,132 @@
+package session
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// alignment result
+const (
+	AlignmentPass = "pass"
+	AlignmentFail = "fail"
+	AlignmentNone = "none"
+)
+
+// AlignmentResult represents result of comparing the envelope sender
+// domain with the From: header domain
+type AlignmentResult struct {
+	Result         string
+	EnvelopeDomain string
+	HeaderDomain   string
+}
+
+// String return the result formatted as header value
+func (a *AlignmentResult) String() string {
+	return fmt.Sprintf("%s (envelope=%s; header=%s)", a.Result, a.EnvelopeDomain, a.HeaderDomain)
+}
+
+// domainOf return lower cased domain part of email address
+func domainOf(addr string) string {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(addr[i+1:], "."))
+}
+
+// OrganizationalDomain return the registered domain of a domain name
+// by the public suffix list, e.g. "mail.example.co.uk" =>
+// "example.co.uk". a public suffix is its own organizational domain
+func OrganizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	labels := strings.Split(domain, ".")
+	n := publicSuffixLabels(strings.Split(ToUnicode(domain), ".")) + 1
+	if len(labels) <= n {
+		return domain
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// domainsAligned check whether two domains aligned. in strict mode
+// domains should be equal, otherwise same organizational domain is enough
+func domainsAligned(a, b string, strict bool) bool {
+	if strict {
+		return a == b
+	}
+	return OrganizationalDomain(a) == OrganizationalDomain(b)
+}
+
+// headerFromDomains extract domains of every address in From: header,
+// a message with more than one From: field is an error
+func headerFromDomains(data []byte) ([]string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Header["From"]) > 1 {
+		return nil, errors.New("more than one From: field")
+	}
+	addrs, err := msg.Header.AddressList("From")
+	if err != nil {
+		return nil, err
+	}
+
+	domains := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		domains = append(domains, domainOf(addr.Address))
+	}
+	return domains, nil
+}
+
+// CheckAlignment compare domain of envelope sender with domain of
+// From: header in message data. every From: address should aligned
+func CheckAlignment(mailFrom string, data []byte, strict bool) *AlignmentResult {
+	res := &AlignmentResult{
+		Result:         AlignmentNone,
+		EnvelopeDomain: domainOf(mailFrom),
+	}
+
+	domains, err := headerFromDomains(data)
+	if err != nil || len(domains) == 0 || res.EnvelopeDomain == "" {
+		return res
+	}
+	res.HeaderDomain = strings.Join(domains, ",")
+
+	res.Result = AlignmentPass
+	for _, d := range domains {
+		if !domainsAligned(res.EnvelopeDomain, d, strict) {
+			res.Result = AlignmentFail
+			break
+		}
+	}
+	return res
+}
+
+// prependHeader add header field on top of message data
+func prependHeader(data []byte, name, value string) []byte {
+	field := name + ": " + foldedValue(value) + "\r\n"
+	return append([]byte(field), data...)
+}
+
+// foldedValue replace CR and LF that are not part of folding
+// (<CRLF> followed by WSP) with space, so value can't inject
+// header fields or end the header section
+func foldedValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '\r' && i+2 < len(value) && value[i+1] == '\n' && (value[i+2] == ' ' || value[i+2] == '\t') {
+			b.WriteString("\r\n")
+			i++
+			continue
+		}
+		if c == '\r' || c == '\n' {
+			c = ' '
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
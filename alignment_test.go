@@ -0,0 +1,60 @@
+package session
+
+import (
+	"testing"
+)
+
+// TestOrganizationalDomain make sure that registered domain
+// extracted correctly from sub domains
+func TestOrganizationalDomain(t *testing.T) {
+	cases := []struct {
+		domain, expected string
+	}{
+		{"example.com", "example.com"},
+		{"mail.example.com", "example.com"},
+		{"a.b.mail.Example.COM.", "example.com"},
+		{"example.co.uk", "example.co.uk"},
+		{"mail.example.co.uk", "example.co.uk"},
+		{"localhost", "localhost"},
+		{"co.uk", "co.uk"},
+		{"mail.example.com.au", "example.com.au"},
+		{"a.b.example.pvt.k12.ma.us", "example.pvt.k12.ma.us"},
+		{"a.b.c.kobe.jp", "b.c.kobe.jp"},
+		{"www.city.kobe.jp", "city.kobe.jp"},
+		{"user.github.io", "user.github.io"},
+		{"mail.example.xn--p1ai", "example.xn--p1ai"},
+	}
+
+	for _, input := range cases {
+		got := OrganizationalDomain(input.domain)
+		if got != input.expected {
+			t.Errorf("%q: got %q, expected %q", input.domain, got, input.expected)
+		}
+	}
+}
+
+// TestCheckAlignment compare envelope sender and From: header domain
+func TestCheckAlignment(t *testing.T) {
+	cases := []struct {
+		mailFrom string
+		data     string
+		strict   bool
+		result   string
+	}{
+		{"some@example.com", "From: Some <some@example.com>\r\n\r\nbody\r\n", false, AlignmentPass},
+		{"bounce@mail.example.com", "From: some@example.com\r\n\r\nbody\r\n", false, AlignmentPass},
+		{"bounce@mail.example.com", "From: some@example.com\r\n\r\nbody\r\n", true, AlignmentFail},
+		{"some@example.com", "From: \"some@example.com\" <spoof@evil.com>\r\n\r\nbody\r\n", false, AlignmentFail},
+		{"some@example.com", "From: a@example.com, b@evil.com\r\n\r\nbody\r\n", false, AlignmentFail},
+		{"some@example.com", "Subject: no from\r\n\r\nbody\r\n", false, AlignmentNone},
+		{"some@example.com", "From: some@example.com\r\nFrom: spoof@evil.com\r\n\r\nbody\r\n", false, AlignmentNone},
+		{"", "From: some@example.com\r\n\r\nbody\r\n", false, AlignmentNone},
+	}
+
+	for _, input := range cases {
+		got := CheckAlignment(input.mailFrom, []byte(input.data), input.strict)
+		if got.Result != input.result {
+			t.Errorf("%q %q: got %q, expected %q", input.mailFrom, input.data, got.Result, input.result)
+		}
+	}
+}
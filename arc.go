@@ -0,0 +1,434 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ARC chain validation results (RFC 8617 section 4.4)
+const (
+	ARCNone = "none"
+	ARCPass = "pass"
+	ARCFail = "fail"
+)
+
+// maximum ARC instance (RFC 8617 section 4.2.1)
+const maxARCInstances = 50
+
+// header fields of ARC sets
+const (
+	arcAuthResults = "ARC-Authentication-Results"
+	arcMessageSig  = "ARC-Message-Signature"
+	arcSeal        = "ARC-Seal"
+)
+
+// defaultARCHeaders are the header fields signed by
+// ARC-Message-Signature when they are present
+var defaultARCHeaders = []string{
+	"From", "To", "Cc", "Subject", "Date", "Message-ID", "Reply-To",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "DKIM-Signature",
+}
+
+// ARCResult is the validation result of ARC chain of a message
+type ARCResult struct {
+	Result string
+	// Instances is the number of ARC sets in the chain
+	Instances int
+	// Domain is the sealer of the last ARC set
+	Domain string
+	// Reason explain result other than pass
+	Reason string
+}
+
+// String return the result formatted for Authentication-Results
+func (r *ARCResult) String() string {
+	s := "arc=" + r.Result
+	if r.Reason != "" {
+		s += " (" + r.Reason + ")"
+	}
+	if r.Domain != "" {
+		s += " header.d=" + r.Domain
+	}
+	return s
+}
+
+// arcSet is the header fields of an ARC instance
+type arcSet struct {
+	aar, ams, as *headerField
+}
+
+// arcInstance return the i= tag of ARC header field. the value of
+// ARC-Authentication-Results is not a tag-list, so only i= is parsed
+func arcInstance(f headerField) (int, error) {
+	for _, part := range strings.Split(f.value(), ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok || strings.TrimSpace(name) != "i" {
+			continue
+		}
+		i, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || i < 1 || i > maxARCInstances {
+			break
+		}
+		return i, nil
+	}
+	return 0, errors.New("invalid instance")
+}
+
+// arcChain collect the ARC sets of fields, every instance from 1 to
+// the highest one MUST be complete and unique
+func arcChain(fields []headerField) ([]arcSet, error) {
+	sets := make(map[int]*arcSet)
+	n := 0
+	for k := range fields {
+		f := &fields[k]
+		var slot func(s *arcSet) **headerField
+		switch {
+		case strings.EqualFold(f.name, arcAuthResults):
+			slot = func(s *arcSet) **headerField { return &s.aar }
+		case strings.EqualFold(f.name, arcMessageSig):
+			slot = func(s *arcSet) **headerField { return &s.ams }
+		case strings.EqualFold(f.name, arcSeal):
+			slot = func(s *arcSet) **headerField { return &s.as }
+		default:
+			continue
+		}
+		i, err := arcInstance(*f)
+		if err != nil {
+			return nil, err
+		}
+		if sets[i] == nil {
+			sets[i] = &arcSet{}
+		}
+		if p := slot(sets[i]); *p == nil {
+			*p = f
+		} else {
+			return nil, fmt.Errorf("duplicate %s i=%d", f.name, i)
+		}
+		if i > n {
+			n = i
+		}
+	}
+
+	chain := make([]arcSet, n)
+	for i := 1; i <= n; i++ {
+		s := sets[i]
+		if s == nil || s.aar == nil || s.ams == nil || s.as == nil {
+			return nil, fmt.Errorf("incomplete set i=%d", i)
+		}
+		chain[i-1] = *s
+	}
+	return chain, nil
+}
+
+// verifyKeySignature verify signature of hash with public key
+func verifyKeySignature(pub crypto.PublicKey, hash, signature []byte) error {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		// RFC 8301 section 3.2
+		if key.N.BitLen() < 1024 {
+			return errors.New("RSA key too short")
+		}
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash, signature)
+	case ed25519.PublicKey:
+		if ed25519.Verify(key, hash, signature) {
+			return nil
+		}
+	}
+	return errors.New("invalid signature")
+}
+
+// arcKey return the public key of signature tags
+func arcKey(ctx context.Context, resolver Resolver, tags map[string]string) (crypto.PublicKey, []byte, error) {
+	algo := tags["a"]
+	if algo != "rsa-sha256" && algo != "ed25519-sha256" {
+		return nil, nil, errors.New("unsupported algorithm")
+	}
+	signature, err := base64.StdEncoding.DecodeString(removeWSP(tags["b"]))
+	if err != nil {
+		return nil, nil, errors.New("malformed signature")
+	}
+	pub, err := dkimKey(ctx, resolver, tags["s"], tags["d"], algo)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pub, signature, nil
+}
+
+// verifyAMS verify ARC-Message-Signature like DKIM-Signature
+func verifyAMS(ctx context.Context, resolver Resolver, fields []headerField, body []byte, ams headerField) error {
+	tags, err := parseTags(ams.value())
+	if err != nil {
+		return err
+	}
+	relaxedHeader, relaxedBody, err := dkimCanonicalization(tags["c"])
+	if err != nil {
+		return err
+	}
+	bodyHash := sha256.Sum256(canonicalBody(body, relaxedBody))
+	expected, err := base64.StdEncoding.DecodeString(removeWSP(tags["bh"]))
+	if err != nil || !bytes.Equal(expected, bodyHash[:]) {
+		return errors.New("body hash did not verify")
+	}
+	pub, signature, err := arcKey(ctx, resolver, tags)
+	if err != nil {
+		return err
+	}
+	names := strings.Split(removeWSP(tags["h"]), ":")
+	for _, n := range names {
+		if strings.EqualFold(n, arcSeal) {
+			return errors.New("ARC-Seal signed by message signature")
+		}
+	}
+	hash := dkimHeaderHash(fields, ams, names, relaxedHeader)
+	return verifyKeySignature(pub, hash, signature)
+}
+
+// arcSealHash compute hash of ARC-Seal of the last set in chain:
+// every set in order with the b= value of the last seal emptied
+func arcSealHash(chain []arcSet) []byte {
+	h := sha256.New()
+	for i, s := range chain {
+		h.Write([]byte(canonicalHeader(*s.aar, true)))
+		h.Write([]byte(canonicalHeader(*s.ams, true)))
+		if i < len(chain)-1 {
+			h.Write([]byte(canonicalHeader(*s.as, true)))
+		}
+	}
+	last := *chain[len(chain)-1].as
+	stripped := headerField{name: last.name, raw: stripSignature(last.raw)}
+	h.Write([]byte(strings.TrimRight(canonicalHeader(stripped, true), "\r\n")))
+	return h.Sum(nil)
+}
+
+// verifySeal verify the ARC-Seal of the last set in chain
+func verifySeal(ctx context.Context, resolver Resolver, chain []arcSet) error {
+	tags, err := parseTags(chain[len(chain)-1].as.value())
+	if err != nil {
+		return err
+	}
+	// the seal of the first set start the chain
+	cv := tags["cv"]
+	if (len(chain) == 1 && cv != ARCNone) || (len(chain) > 1 && cv != ARCPass) {
+		return fmt.Errorf("invalid cv=%s", cv)
+	}
+	pub, signature, err := arcKey(ctx, resolver, tags)
+	if err != nil {
+		return err
+	}
+	return verifyKeySignature(pub, arcSealHash(chain), signature)
+}
+
+// VerifyARC validate the ARC chain of message data (RFC 8617
+// section 5.2), the message signature of the last set and the
+// seal of every set are verified
+func VerifyARC(ctx context.Context, resolver Resolver, data []byte) *ARCResult {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultDKIMTimeout)
+		defer cancel()
+	}
+
+	fields, body := splitMessage(data)
+	chain, err := arcChain(fields)
+	if err != nil {
+		return &ARCResult{Result: ARCFail, Reason: err.Error()}
+	}
+	res := &ARCResult{Result: ARCNone, Instances: len(chain)}
+	if len(chain) == 0 {
+		return res
+	}
+	res.Result = ARCFail
+	last := chain[len(chain)-1]
+	if tags, err := parseTags(last.as.value()); err == nil {
+		res.Domain = tags["d"]
+		if tags["cv"] == ARCFail {
+			res.Reason = "chain sealed as failed"
+			return res
+		}
+	}
+	if err := verifyAMS(ctx, resolver, fields, body, *last.ams); err != nil {
+		res.Reason = fmt.Sprintf("i=%d message signature: %v", len(chain), err)
+		return res
+	}
+	for i := len(chain); i >= 1; i-- {
+		if err := verifySeal(ctx, resolver, chain[:i]); err != nil {
+			res.Reason = fmt.Sprintf("i=%d seal: %v", i, err)
+			return res
+		}
+	}
+	res.Result = ARCPass
+	return res
+}
+
+// ARCSealer add an ARC set to messages forwarded by the server, so
+// the authentication results at this hop survive the changes of
+// forwarding for the DMARC evaluation of the next hop
+type ARCSealer struct {
+	// Domain and Selector locate the public key of Key in DNS at
+	// Selector._domainkey.Domain
+	Domain   string
+	Selector string
+	// Key is *rsa.PrivateKey or ed25519.PrivateKey
+	Key crypto.Signer
+	// Headers signed by ARC-Message-Signature when present,
+	// default to From, To, Subject, Date and the like
+	Headers []string
+}
+
+// algorithm return the a= tag of Key
+func (a *ARCSealer) algorithm() (string, error) {
+	switch a.Key.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	}
+	return "", errors.New("arc: unsupported key type")
+}
+
+// sign sign hash with Key
+func (a *ARCSealer) sign(hash []byte) (string, error) {
+	opts := crypto.SignerOpts(crypto.SHA256)
+	if _, ok := a.Key.Public().(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	}
+	sig, err := a.Key.Sign(rand.Reader, hash, opts)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// Seal add the next ARC set to data. results is the value of
+// Authentication-Results of this hop, chain is the validation result
+// of the chain of data. failed chains are not sealed
+func (a *ARCSealer) Seal(data []byte, results string, chain *ARCResult) ([]byte, error) {
+	if chain == nil || chain.Result == ARCFail || chain.Instances >= maxARCInstances {
+		return data, nil
+	}
+	algo, err := a.algorithm()
+	if err != nil {
+		return nil, err
+	}
+	n := chain.Instances + 1
+	cv := ARCNone
+	if chain.Result == ARCPass {
+		cv = ARCPass
+	}
+	t := time.Now().Unix()
+
+	aar := headerField{name: arcAuthResults, raw: fmt.Sprintf("%s: i=%d; %s\r\n", arcAuthResults, n, foldedValue(results))}
+
+	fields, body := splitMessage(data)
+	headers := a.Headers
+	if headers == nil {
+		headers = defaultARCHeaders
+	}
+	var names []string
+	for _, name := range headers {
+		for _, f := range fields {
+			if strings.EqualFold(f.name, name) {
+				names = append(names, strings.ToLower(name))
+			}
+		}
+	}
+	bodyHash := sha256.Sum256(canonicalBody(body, true))
+	ams := headerField{name: arcMessageSig, raw: fmt.Sprintf("%s: i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d;\r\n\th=%s;\r\n\tbh=%s;\r\n\tb=",
+		arcMessageSig, n, algo, a.Domain, a.Selector, t, strings.Join(names, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))}
+	sig, err := a.sign(dkimHeaderHash(fields, ams, names, true))
+	if err != nil {
+		return nil, err
+	}
+	ams.raw += sig + "\r\n"
+
+	chainSets, err := arcChain(fields)
+	if err != nil {
+		return nil, err
+	}
+	as := headerField{name: arcSeal, raw: fmt.Sprintf("%s: i=%d; a=%s; t=%d; cv=%s; d=%s; s=%s;\r\n\tb=",
+		arcSeal, n, algo, t, cv, a.Domain, a.Selector)}
+	sig, err = a.sign(arcSealHash(append(chainSets, arcSet{aar: &aar, ams: &ams, as: &as})))
+	if err != nil {
+		return nil, err
+	}
+	as.raw += sig + "\r\n"
+
+	out := make([]byte, 0, len(as.raw)+len(ams.raw)+len(aar.raw)+len(data))
+	out = append(out, as.raw...)
+	out = append(out, ams.raw...)
+	out = append(out, aar.raw...)
+	return append(out, data...), nil
+}
+
+// ARC verify ARC chains of received messages and seal the messages
+// that are forwarded
+type ARC struct {
+	// Sealer seal forwarded messages, without sealer chains are
+	// only verified
+	Sealer *ARCSealer
+	// Forwarded report whether the message is forwarded, default
+	// to messages with a recipient outside Config.LocalDomains
+	Forwarded func(envl *Envelope) bool
+}
+
+// forwarded report whether envl is forwarded by the server
+func (s *Session) forwarded(envl *Envelope) bool {
+	if f := s.Config.ARC.Forwarded; f != nil {
+		return f(envl)
+	}
+	if len(s.Config.LocalDomains) == 0 {
+		return false
+	}
+	for _, rcpt := range envl.RecipientAddress {
+		if !s.Config.isLocalDomain(domainOf(rcpt)) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyARC validate the ARC chain of received message data
+func (s *Session) verifyARC(envl *Envelope, data []byte) {
+	if s.Config.ARC == nil {
+		return
+	}
+	ctx, span := s.span(envl.Context(), "smtp.arc")
+	envl.ARC = VerifyARC(ctx, s.Config.resolver(), data)
+	span.SetAttribute("arc.result", envl.ARC.Result)
+	span.End()
+}
+
+// sealARC seal forwarded message data, the message is delivered
+// unsealed when sealing fail
+func (s *Session) sealARC(envl *Envelope, data []byte) []byte {
+	a := s.Config.ARC
+	if a == nil || a.Sealer == nil || !s.forwarded(envl) {
+		return data
+	}
+	chain := envl.ARC
+	if chain == nil {
+		chain = &ARCResult{Result: ARCNone}
+	}
+	sealed, err := a.Sealer.Seal(data, AuthResults(s.Hostname(), envl), chain)
+	if err != nil {
+		s.logf(LevelWarn, "ARC seal: %v", err)
+		return data
+	}
+	return sealed
+}
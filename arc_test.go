@@ -0,0 +1,108 @@
+package session
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// TestARCSeal make sure that sealed chains verify hop after hop and
+// changes after sealing break the chain
+func TestARCSeal(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	r := &fakeResolver{txts: map[string][]string{
+		"rsa._domainkey.forwarder.org": {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+		"ed._domainkey.list.example":   {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+	}}
+	first := &ARCSealer{Domain: "forwarder.org", Selector: "rsa", Key: rsaKey}
+	second := &ARCSealer{Domain: "list.example", Selector: "ed", Key: edKey}
+
+	res := VerifyARC(context.Background(), r, []byte(dkimTestMessage))
+	if res.Result != ARCNone {
+		t.Fatalf("unsealed: got %+v, expected none", res)
+	}
+	data, err := first.Seal([]byte(dkimTestMessage), "forwarder.org; spf=pass smtp.mailfrom=example.com", res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = VerifyARC(context.Background(), r, data)
+	if res.Result != ARCPass || res.Instances != 1 || res.Domain != "forwarder.org" {
+		t.Fatalf("first hop: got %+v, expected pass", res)
+	}
+
+	// the list change the subject and seal the chain again
+	data = []byte(strings.Replace(string(data), "Subject:   Hello", "Subject: [list] Hello", 1))
+	data, err = second.Seal(data, "list.example;\r\n\tarc=pass", res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = VerifyARC(context.Background(), r, data)
+	if res.Result != ARCPass || res.Instances != 2 || res.Domain != "list.example" {
+		t.Fatalf("second hop: got %+v, expected pass", res)
+	}
+
+	cases := []struct {
+		name string
+		data string
+	}{
+		{"body changed", strings.Replace(string(data), "Hi  there", "Ho  there", 1)},
+		{"seal removed", strings.Replace(string(data), "ARC-Seal: i=1", "X-Seal: i=1", 1)},
+		{"results changed", strings.Replace(string(data), "spf=pass", "spf=fail", 1)},
+	}
+	for _, input := range cases {
+		if res := VerifyARC(context.Background(), r, []byte(input.data)); res.Result != ARCFail {
+			t.Errorf("%s: got %+v, expected fail", input.name, res)
+		}
+	}
+}
+
+// TestSessionARC make sure that only forwarded messages are sealed
+// with the authentication results of the session
+func TestSessionARC(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	var data []byte
+	config := &Config{
+		LocalDomains: []string{"domain.com"},
+		ARC:          &ARC{Sealer: &ARCSealer{Domain: "domain.com", Selector: "arc", Key: key}},
+		Resolver:     &fakeResolver{},
+		Backend: BackendFunc(func(envl *Envelope, d []byte) error {
+			data = d
+			return nil
+		}),
+	}
+	relay, _ := ParseAccessList([]string{"192.0.2.0/24"})
+	config.RelayNetworks = relay
+
+	cases := []struct {
+		rcpt   string
+		sealed bool
+	}{
+		{"some@domain.com", false},
+		{"some@elsewhere.org", true},
+	}
+	for _, input := range cases {
+		data = nil
+		runSessionFrom(t, config, "192.0.2.1:1025", "HELO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<"+input.rcpt+">\r\nDATA\r\n"+dkimTestMessage+".\r\nQUIT\r\n")
+		sealed := strings.HasPrefix(string(data), "ARC-Seal: i=1; a=ed25519-sha256; ")
+		if sealed != input.sealed || (sealed && !strings.Contains(string(data), "ARC-Authentication-Results: i=1; localhost; none\r\n")) {
+			t.Errorf("%s: got %q, expected sealed %t", input.rcpt, data, input.sealed)
+		}
+	}
+	// forwarded messages are sealed for StreamBackend too
+	b := &streamRecorder{}
+	config.Backend = b
+	runSessionFrom(t, config, "192.0.2.1:1025", "HELO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<some@elsewhere.org>\r\nDATA\r\n"+dkimTestMessage+".\r\nQUIT\r\n")
+	if !strings.HasPrefix(b.data, "ARC-Seal: i=1; ") {
+		t.Errorf("stream: got %q, expected sealed", b.data)
+	}
+}
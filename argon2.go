@@ -0,0 +1,53 @@
+package session
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2id parameters of HashPassword, the OWASP recommendation of
+// 19 MiB of memory and 2 passes
+const (
+	argon2Prefix  = "$argon2id$"
+	argon2Time    = 2
+	argon2Memory  = 19 * 1024
+	argon2Threads = 1
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// hashArgon2 hash password with argon2id in the PHC string format
+func hashArgon2(password string, salt []byte, time, memory uint32, threads uint8) string {
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, argon2KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version, memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func verifyArgon2(hash, password string) (bool, error) {
+	parts := strings.Split(strings.TrimPrefix(hash, argon2Prefix), "$")
+	if len(parts) != 4 || parts[0] != fmt.Sprintf("v=%d", argon2.Version) {
+		return false, ErrPasswordScheme
+	}
+	var time, memory uint32
+	var threads uint8
+	if n, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &memory, &time, &threads); n != 3 || err != nil {
+		return false, ErrPasswordScheme
+	}
+	if time == 0 || threads == 0 || memory < 8*uint32(threads) {
+		return false, ErrPasswordScheme
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil || len(salt) < 8 {
+		return false, ErrPasswordScheme
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(expected) < 4 {
+		return false, ErrPasswordScheme
+	}
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(expected)))
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
@@ -0,0 +1,139 @@
+package session
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// atrn replies (RFC 2645)
+var (
+	atrnAuthErr   = NewSMTPError(530, [3]int{5, 7, 0}, "Authentication required")
+	atrnDomainErr = NewSMTPError(550, [3]int{5, 7, 1}, "Not authorized to dequeue domain")
+	atrnNoMailErr = NewSMTPError(453, [3]int{4, 0, 0}, "You have no mail")
+	atrnQueueErr  = NewSMTPError(451, [3]int{4, 3, 0}, "Unable to process ATRN request now")
+)
+
+// REPLY_ATRN is sent before the connection is reversed
+const REPLY_ATRN = "250 2.0.0 OK now reversing the connection"
+
+// ATRN is On-Demand Mail Relay (RFC 2645). an authenticated customer
+// send ATRN with the domains to dequeue, then the roles of the
+// connection are reversed and the queued messages of the domains are
+// delivered to the customer over the same connection
+type ATRN struct {
+	Queue *Queue
+	// Domains map users to the domains they may dequeue, ATRN
+	// without argument dequeue every domain of the user
+	Domains map[string][]string
+	// Timeout of the reversed session, default to 5 minutes
+	Timeout time.Duration
+}
+
+func init() {
+	RegisterCommand(Command{
+		Verb:     "ATRN",
+		States:   []State{StateHelloed},
+		Validate: validATRN,
+		Handle:   (*Session).cmdATRN,
+	})
+}
+
+// atrnDomains return the requested domains the user may dequeue
+func (a *ATRN) atrnDomains(user, arg string) ([]string, error) {
+	allowed := a.Domains[user]
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		if len(allowed) == 0 {
+			return nil, atrnNoMailErr
+		}
+		return allowed, nil
+	}
+	var domains []string
+	for _, d := range strings.Split(arg, ",") {
+		d = strings.TrimSuffix(strings.TrimSpace(d), ".")
+		if !containsFold(allowed, d) {
+			return nil, atrnDomainErr
+		}
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
+
+// validATRN check that ATRN is enabled and the client is authenticated
+func validATRN(s *Session, req *CommandRequest) error {
+	if s.Config.ATRN == nil {
+		return notImplementedErr
+	}
+	if s.Principal == nil {
+		return atrnAuthErr
+	}
+	return nil
+}
+
+// atrnConn is the connection of the reversed session, reading
+// through the session reader so buffered input is not lost
+type atrnConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *atrnConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// cmdATRN reverse the connection and deliver the queued messages,
+// the session end when they are delivered
+func (s *Session) cmdATRN(req *CommandRequest) error {
+	a := s.Config.ATRN
+	domains, err := a.atrnDomains(s.Principal.Username, req.Arg)
+	if err != nil {
+		return s.Reply.TransmitErr(err)
+	}
+
+	timeout := durationOr(a.Timeout, defaultClientTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var c *smtp.Client
+	n, err := a.Queue.DeliverDomains(ctx, domains, func() (Transport, error) {
+		if err := s.Reply.Transmit(REPLY_ATRN); err != nil {
+			return nil, err
+		}
+		s.setState(StateQuit)
+		s.Conn.SetDeadline(time.Now().Add(timeout))
+		var err error
+		if c, err = smtp.NewClient(&atrnConn{s.Conn, s.Reader}, domains[0]); err != nil {
+			return nil, err
+		}
+		if err := c.Hello(s.Hostname()); err != nil {
+			return nil, err
+		}
+		return TransportFunc(func(ctx context.Context, envl *Envelope, data []byte) []*DeliveryResult {
+			if err := c.Reset(); err != nil {
+				return failAll(envl.RecipientAddress, clientErr(err))
+			}
+			results, err := transaction(c, envl, envl.RecipientAddress, data)
+			if err != nil {
+				return failAll(envl.RecipientAddress, err)
+			}
+			return results
+		}), nil
+	})
+	switch {
+	case err != nil && n == 0 && s.State() != StateQuit:
+		s.logf(LevelWarn, "ATRN %v: %v", domains, err)
+		return s.Reply.TransmitErr(atrnQueueErr)
+	case err != nil:
+		s.logf(LevelWarn, "ATRN %v: reversed session: %v", domains, err)
+		return nil
+	case n == 0:
+		return s.Reply.TransmitErr(atrnNoMailErr)
+	}
+	c.Quit()
+	s.logf(LevelInfo, "ATRN %v: delivered %d messages", domains, n)
+	return nil
+}
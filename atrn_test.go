@@ -0,0 +1,114 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestATRNDomains make sure that customers only dequeue their domains
+func TestATRNDomains(t *testing.T) {
+	a := &ATRN{Domains: map[string][]string{"user": {"example.com", "example.net"}}}
+	cases := []struct {
+		user, arg string
+		expected  string
+		err       error
+	}{
+		{"user", "", "example.com,example.net", nil},
+		{"user", "Example.com.", "Example.com", nil},
+		{"user", "example.com,example.org", "", atrnDomainErr},
+		{"other", "", "", atrnNoMailErr},
+	}
+
+	for _, input := range cases {
+		domains, err := a.atrnDomains(input.user, input.arg)
+		if strings.Join(domains, ",") != input.expected || err != input.err {
+			t.Errorf("%s %q: got %v %v, expected %q %v", input.user, input.arg, domains, err, input.expected, input.err)
+		}
+	}
+}
+
+// TestSessionATRN make sure that queued messages of the customer are
+// delivered over the reversed connection
+func TestSessionATRN(t *testing.T) {
+	q := &Queue{Spool: &Spool{Dir: t.TempDir()}, Transport: TransportFunc(func(ctx context.Context, envl *Envelope, data []byte) []*DeliveryResult {
+		return failAll(envl.RecipientAddress, NewSMTPError(421, [3]int{4, 4, 2}, "not connected"))
+	}), MinRetry: time.Hour}
+	for _, rcpt := range []string{"a@example.com", "b@example.org"} {
+		q.Spool.Deliver(&Envelope{OriginatorAddress: "some@example.net", RecipientAddress: []string{rcpt}}, []byte("Subject: hi\r\n\r\nbody\r\n"))
+	}
+	q.RunOnce(context.Background())
+
+	config := &Config{
+		Authenticator:      testAuthenticator,
+		AuthAllowPlaintext: true,
+		ATRN:               &ATRN{Queue: q, Domains: map[string][]string{"user": {"example.com"}}},
+	}
+	server, client := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	s := New(server, &wg, nil)
+	s.Config = config
+	go s.Serve()
+
+	// fail instead of hanging when the conversation is out of sync
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(client)
+	expect := func(prefixes ...string) string {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("expected %q: %v", prefixes, err)
+			}
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(line, prefix) {
+					return line
+				}
+			}
+		}
+	}
+	expect("220 ")
+	fmt.Fprint(client, "EHLO customer.example.com\r\n")
+	expect("250-ATRN", "250 ATRN")
+	fmt.Fprint(client, "ATRN\r\n")
+	expect("530 5.7.0")
+	fmt.Fprint(client, "AUTH PLAIN "+plainResponse("user", "secret")+"\r\n")
+	expect("235 ")
+	fmt.Fprint(client, "ATRN example.org\r\n")
+	expect("550 5.7.1")
+	fmt.Fprint(client, "ATRN example.com\r\n")
+	expect("250 2.0.0 OK now reversing the connection")
+
+	// act as the SMTP server of the customer
+	fmt.Fprint(client, "220 customer.example.com ESMTP\r\n")
+	expect("EHLO ")
+	fmt.Fprint(client, "250 customer.example.com\r\n")
+	expect("RSET")
+	fmt.Fprint(client, "250 OK\r\n")
+	expect("MAIL FROM:<some@example.net>")
+	fmt.Fprint(client, "250 OK\r\n")
+	expect("RCPT TO:<a@example.com>")
+	fmt.Fprint(client, "250 OK\r\n")
+	expect("DATA")
+	fmt.Fprint(client, "354 go ahead\r\n")
+	expect(".\r\n")
+	fmt.Fprint(client, "250 OK\r\n")
+	expect("QUIT")
+	fmt.Fprint(client, "221 bye\r\n")
+	wg.Wait()
+	client.Close()
+
+	ids, _ := q.Spool.List()
+	if len(ids) != 1 {
+		t.Fatalf("got %d queued messages, expected 1", len(ids))
+	}
+	envl, _, _ := q.Spool.Read(ids[0])
+	if envl.RecipientAddress[0] != "b@example.org" {
+		t.Errorf("got queued %v, expected b@example.org", envl.RecipientAddress)
+	}
+}
@@ -0,0 +1,148 @@
+package session
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// define auth replies
+const (
+	REPLY_235 = "235 2.7.0 Authentication successful"
+	REPLY_334 = "334 "
+)
+
+// auth error replies
+var (
+	authInvalidErr   = NewSMTPError(535, [3]int{5, 7, 8}, "Authentication credentials invalid")
+	authMechErr      = NewSMTPError(504, [3]int{5, 5, 4}, "Unrecognized authentication type")
+	authCancelledErr = NewSMTPError(501, [3]int{5, 0, 0}, "Authentication cancelled")
+	authAlreadyErr   = NewSMTPError(503, [3]int{5, 5, 1}, "Already authenticated")
+
+	// ErrAuthFailed should be returned by Authenticator when
+	// credentials are invalid
+	ErrAuthFailed = errors.New("session: authentication failed")
+)
+
+// Principal represents an authenticated SMTP client
+type Principal struct {
+	Username string
+	// Tenant is the organization the user belongs to,
+	// used by per-tenant policies
+	Tenant string
+	// Token is the ID of app token used instead of the password
+	Token string
+}
+
+// Credential return the username, with the app token ID when the
+// client authenticated with a token like "user/3fa2c1d0"
+func (p *Principal) Credential() string {
+	if p.Token == "" {
+		return p.Username
+	}
+	return p.Username + "/" + p.Token
+}
+
+// Authenticator verify credentials sent with AUTH command
+type Authenticator interface {
+	// Authenticate return the principal of valid credentials. any
+	// error other than *SMTPError is replied as invalid credentials
+	Authenticate(username, password string) (*Principal, error)
+}
+
+// AuthenticatorFunc is an adapter to allow the use of ordinary
+// functions as Authenticator
+type AuthenticatorFunc func(username, password string) (*Principal, error)
+
+// Authenticate call f(username, password)
+func (f AuthenticatorFunc) Authenticate(username, password string) (*Principal, error) {
+	return f(username, password)
+}
+
+// decodePlain decode initial response of PLAIN mechanism (RFC 4616)
+// which is "authzid NUL authcid NUL passwd" encoded in base64
+func decodePlain(resp string) (username, password string, err error) {
+	b, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		return "", "", invalidCommandArgErr
+	}
+	parts := bytes.Split(b, []byte{0})
+	if len(parts) != 3 {
+		return "", "", invalidCommandArgErr
+	}
+	return string(parts[1]), string(parts[2]), nil
+}
+
+// readAuthResponse send a 334 challenge and read the client response
+func (s *Session) readAuthResponse(challenge string) (string, error) {
+	err := s.Reply.Transmit(REPLY_334 + challenge)
+	if err != nil {
+		return "", err
+	}
+	line, err := s.readLine(maxAuthLine)
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSpace(line)
+	if line == "*" {
+		return "", authCancelledErr
+	}
+	return line, nil
+}
+
+// Auth process AUTH command and set the session principal
+// when authentication succeed
+func (s *Session) Auth(c command) error {
+	if s.Principal != nil {
+		return authAlreadyErr
+	}
+
+	args := strings.Fields(c.Arg())
+	if len(args) == 0 || len(args) > 2 {
+		return invalidCommandArgErr
+	}
+	mech := strings.ToUpper(args[0])
+	switch {
+	case mech == "PLAIN" && s.authAllowed():
+	case mech == "EXTERNAL" && s.externalAllowed():
+	default:
+		return authMechErr
+	}
+
+	resp := ""
+	if len(args) == 2 {
+		resp = args[1]
+	} else {
+		r, err := s.readAuthResponse("")
+		if err != nil {
+			return err
+		}
+		resp = r
+	}
+	if mech == "EXTERNAL" {
+		return s.authExternal(resp)
+	}
+
+	username, password, err := decodePlain(resp)
+	if err != nil {
+		return err
+	}
+
+	p, err := s.Config.Authenticator.Authenticate(username, password)
+	if err != nil {
+		s.jitter()
+		if e, ok := err.(*SMTPError); ok {
+			return e
+		}
+		s.logf(LevelInfo, "authentication failed for %s", username)
+		return authInvalidErr
+	}
+	if err := s.checkToken(p); err != nil {
+		s.jitter()
+		return err
+	}
+	s.Principal = p
+	s.logf(LevelInfo, "authenticated as %s", p.Credential())
+	return nil
+}
@@ -0,0 +1,69 @@
+package session
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func plainResponse(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password))
+}
+
+var testAuthenticator = AuthenticatorFunc(func(username, password string) (*Principal, error) {
+	if username == "user" && password == "secret" {
+		return &Principal{Username: username, Tenant: "tenant"}, nil
+	}
+	return nil, ErrAuthFailed
+})
+
+// TestSessionAuthPlain test AUTH PLAIN with initial response and
+// with challenge
+func TestSessionAuthPlain(t *testing.T) {
+	cases := []struct {
+		input, expected string
+	}{
+		{"AUTH PLAIN " + plainResponse("user", "secret") + "\r\n", "235 2.7.0"},
+		{"AUTH PLAIN\r\n" + plainResponse("user", "secret") + "\r\n", "334 \r\n235 2.7.0"},
+		{"AUTH PLAIN " + plainResponse("user", "wrong") + "\r\n", "535 5.7.8"},
+		{"AUTH PLAIN\r\n*\r\n", "334 \r\n501 5.0.0"},
+		{"AUTH PLAIN not-base64\r\n", "501 5.5.4"},
+		{"AUTH LOGIN\r\n", "504 5.5.4"},
+	}
+
+	config := &Config{Authenticator: testAuthenticator, AuthAllowPlaintext: true}
+	for _, input := range cases {
+		out := runSession(t, config, "EHLO client.com\r\n"+input.input+"QUIT\r\n")
+		if !strings.Contains(out, "250 AUTH PLAIN\r\n") {
+			t.Errorf("AUTH PLAIN not advertised: %q", out)
+		}
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("%q: got %q, expected %q", input.input, out, input.expected)
+		}
+	}
+}
+
+// TestSessionAuthSequence make sure that AUTH rejected before EHLO,
+// after authenticated, when Authenticator is not configured and
+// without TLS unless AuthAllowPlaintext
+func TestSessionAuthSequence(t *testing.T) {
+	cases := []struct {
+		config          *Config
+		input, expected string
+	}{
+		{&Config{Authenticator: testAuthenticator, AuthAllowPlaintext: true}, "AUTH PLAIN\r\n", "503 5.5.1 HELO/EHLO first"},
+		{&Config{}, "EHLO client.com\r\nAUTH PLAIN\r\n", "503 5.5.1 Bad sequence"},
+		{&Config{Authenticator: testAuthenticator, AuthAllowPlaintext: true},
+			"EHLO client.com\r\nAUTH PLAIN " + plainResponse("user", "secret") + "\r\n" +
+				"AUTH PLAIN " + plainResponse("user", "secret") + "\r\n", "503 5.5.1 Already authenticated"},
+		{&Config{Authenticator: testAuthenticator},
+			"EHLO client.com\r\nAUTH PLAIN " + plainResponse("user", "secret") + "\r\n", "250 HELP\r\n538 5.7.11 Encryption required"},
+	}
+
+	for _, input := range cases {
+		out := runSession(t, input.config, input.input+"QUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("%q: got %q, expected %q", input.input, out, input.expected)
+		}
+	}
+}
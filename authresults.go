@@ -0,0 +1,61 @@
+package session
+
+import (
+	"bytes"
+	"strings"
+)
+
+// AuthResults format authentication results recorded on the envelope
+// as Authentication-Results header value (RFC 8601)
+func AuthResults(hostname string, envl *Envelope) string {
+	var results []string
+	if envl.SPF != "" {
+		results = append(results, "spf="+envl.SPF+" smtp.mailfrom="+envl.OriginatorAddress)
+	}
+	for _, r := range envl.DKIM {
+		res := "dkim=" + r.Result
+		if r.Reason != "" {
+			res += " (" + r.Reason + ")"
+		}
+		res += " header.d=" + r.Domain + " header.s=" + r.Selector
+		results = append(results, res)
+	}
+
+	if envl.ARC != nil && envl.ARC.Result != ARCNone {
+		results = append(results, envl.ARC.String())
+	}
+	if envl.DMARC != nil && envl.DMARC.Result != DMARCNone {
+		results = append(results, envl.DMARC.String())
+	}
+
+	if len(results) == 0 {
+		return hostname + "; none"
+	}
+	return hostname + ";\r\n\t" + strings.Join(results, ";\r\n\t")
+}
+
+// removeAuthResults remove Authentication-Results fields that claim to
+// be from hostname, so SMTP sender can't forge our results
+func removeAuthResults(data []byte, hostname string) []byte {
+	fields, body := splitMessage(data)
+
+	var out bytes.Buffer
+	out.Grow(len(data))
+	removed := false
+	for _, f := range fields {
+		if strings.EqualFold(f.name, "Authentication-Results") {
+			id := strings.TrimSpace(strings.SplitN(f.value(), ";", 2)[0])
+			if strings.EqualFold(id, hostname) {
+				removed = true
+				continue
+			}
+		}
+		out.WriteString(f.raw)
+	}
+	if !removed {
+		return data
+	}
+	out.WriteString("\r\n")
+	out.Write(body)
+	return out.Bytes()
+}
@@ -0,0 +1,121 @@
+package session
+
+import "context"
+
+// Backend receives messages accepted by a session
+type Backend interface {
+	// Deliver is called after DATA completed. returning *SMTPError
+	// reject the message with that reply
+	Deliver(envl *Envelope, data []byte) error
+}
+
+// BackendFunc is an adapter to allow the use of ordinary
+// functions as Backend
+type BackendFunc func(envl *Envelope, data []byte) error
+
+// Deliver call f(envl, data)
+func (f BackendFunc) Deliver(envl *Envelope, data []byte) error {
+	return f(envl, data)
+}
+
+// RcptChecker accept or reject each recipient at RCPT time, e.g.
+// unknown mailboxes. a Backend implementing it is used when
+// Config.RcptChecker is nil
+type RcptChecker interface {
+	// CheckRcpt return nil to accept rcpt. returning *SMTPError like
+	// ErrRcptUnknown reject it with that reply, other errors are
+	// replied as local error
+	CheckRcpt(ctx context.Context, envl *Envelope, rcpt string) error
+}
+
+// RcptCheckerFunc is an adapter to allow the use of ordinary
+// functions as RcptChecker
+type RcptCheckerFunc func(ctx context.Context, envl *Envelope, rcpt string) error
+
+// CheckRcpt call f(ctx, envl, rcpt)
+func (f RcptCheckerFunc) CheckRcpt(ctx context.Context, envl *Envelope, rcpt string) error {
+	return f(ctx, envl, rcpt)
+}
+
+// recipient replies for RcptChecker
+var (
+	ErrRcptUnknown   = NewSMTPError(550, [3]int{5, 1, 1}, "Recipient address rejected: User unknown")
+	ErrRcptOverQuota = NewSMTPError(452, [3]int{4, 2, 2}, "Recipient mailbox full")
+	ErrRcptTryLater  = NewSMTPError(451, [3]int{4, 3, 0}, "Recipient temporarily unavailable, try again later")
+)
+
+// rcptChecker return Config.RcptChecker or the backend when it
+// implement RcptChecker
+func (c *Config) rcptChecker() RcptChecker {
+	if c.RcptChecker != nil {
+		return c.RcptChecker
+	}
+	rc, _ := c.Backend.(RcptChecker)
+	return rc
+}
+
+// checkRcpt ask the RcptChecker whether rcpt is accepted
+func (s *Session) checkRcpt(ctx context.Context, envl *Envelope, rcpt string) error {
+	rc := s.Config.rcptChecker()
+	if rc == nil {
+		return nil
+	}
+	err := rc.CheckRcpt(ctx, envl, rcpt)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*SMTPError); !ok {
+		s.logf(LevelWarn, "recipient check of <%s>: %v", rcpt, err)
+	}
+	return replyErr(err)
+}
+
+// Aborter release resources reserved for a mail transaction, e.g.
+// quota holds or temporary files, when the transaction is abandoned
+// by RSET, HELO, EHLO or a lost connection. a Backend implementing it
+// is used when Config.Aborter is nil
+type Aborter interface {
+	// Abort is called once with the envelope of the abandoned
+	// transaction, Deliver is not called for it
+	Abort(envl *Envelope)
+}
+
+// AborterFunc is an adapter to allow the use of ordinary
+// functions as Aborter
+type AborterFunc func(envl *Envelope)
+
+// Abort call f(envl)
+func (f AborterFunc) Abort(envl *Envelope) {
+	f(envl)
+}
+
+// aborter return Config.Aborter or the backend when it implement
+// Aborter
+func (c *Config) aborter() Aborter {
+	if c.Aborter != nil {
+		return c.Aborter
+	}
+	a, _ := c.Backend.(Aborter)
+	return a
+}
+
+// abort notify the Aborter of the transaction in progress
+func (s *Session) abort() {
+	if !s.State().inTransaction() || s.envl == nil {
+		return
+	}
+	if a := s.Config.aborter(); a != nil {
+		a.Abort(s.envl)
+	}
+}
+
+// localErr is sent when backend fail without SMTPError
+var localErr = NewSMTPError(451, [3]int{4, 3, 0}, "Local error in processing")
+
+// replyErr convert err into an error that can be sent to SMTP sender
+func replyErr(err error) *SMTPError {
+	if e, ok := err.(*SMTPError); ok {
+		return e
+	}
+	return localErr
+}
@@ -0,0 +1,125 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// rcptBackend is a Backend that also check recipients
+type rcptBackend struct {
+	BackendFunc
+	RcptCheckerFunc
+}
+
+// TestRcptChecker make sure that each recipient get the reply of the
+// checker and only accepted recipients are added to the envelope
+func TestRcptChecker(t *testing.T) {
+	check := func(ctx context.Context, envl *Envelope, rcpt string) error {
+		switch strings.SplitN(rcpt, "@", 2)[0] {
+		case "unknown":
+			return ErrRcptUnknown
+		case "full":
+			return ErrRcptOverQuota
+		case "later":
+			return ErrRcptTryLater
+		case "broken":
+			return errors.New("database down")
+		}
+		return nil
+	}
+
+	rcpts := []string{"a@example.com", "unknown@example.com", "full@example.com", "later@example.com", "broken@example.com", "b@example.com"}
+	expected := []string{
+		"250 2.1.5 OK",
+		"550 5.1.1 Recipient address rejected: User unknown",
+		"452 4.2.2 Recipient mailbox full",
+		"451 4.3.0 Recipient temporarily unavailable, try again later",
+		"451 4.3.0 Local error in processing",
+		"250 2.1.5 OK",
+	}
+
+	cases := []struct {
+		name    string
+		config  func(deliver BackendFunc) *Config
+		checked bool
+	}{
+		{"config", func(deliver BackendFunc) *Config {
+			return &Config{Backend: deliver, RcptChecker: RcptCheckerFunc(check)}
+		}, true},
+		{"backend", func(deliver BackendFunc) *Config {
+			return &Config{Backend: rcptBackend{deliver, check}}
+		}, true},
+		{"none", func(deliver BackendFunc) *Config {
+			return &Config{Backend: deliver}
+		}, false},
+	}
+
+	for _, input := range cases {
+		var delivered []string
+		config := input.config(func(envl *Envelope, data []byte) error {
+			delivered = envl.RecipientAddress
+			return nil
+		})
+		session := "EHLO client.com\r\nMAIL FROM:<sender@example.com>\r\n"
+		for _, rcpt := range rcpts {
+			session += "RCPT TO:<" + rcpt + ">\r\n"
+		}
+		out := runSession(t, config, session+"DATA\r\nSubject: a\r\n\r\n.\r\nQUIT\r\n")
+
+		want := rcpts
+		if input.checked {
+			want = []string{"a@example.com", "b@example.com"}
+			for _, reply := range expected {
+				if !strings.Contains(out, reply+"\r\n") {
+					t.Errorf("%s: got %q, expected %q", input.name, out, reply)
+				}
+			}
+		}
+		if !reflect.DeepEqual(delivered, want) {
+			t.Errorf("%s: got recipients %v, expected %v", input.name, delivered, want)
+		}
+	}
+}
+
+// abortBackend is a Backend that also release abandoned transactions
+type abortBackend struct {
+	BackendFunc
+	AborterFunc
+}
+
+// TestAborter make sure that transactions abandoned by RSET, HELO and
+// EHLO are aborted once and delivered transactions are not, see
+// TestSessionDisconnect for lost connections
+func TestAborter(t *testing.T) {
+	const tx = "HELO client.com\r\nMAIL FROM:<from@example.com>\r\nRCPT TO:<to@example.com>\r\n"
+	cases := []struct {
+		input    string
+		expected []string
+	}{
+		{tx + "RSET\r\nQUIT\r\n", []string{"from@example.com"}},
+		{"HELO client.com\r\nMAIL FROM:<from@example.com>\r\nEHLO client.com\r\nQUIT\r\n", []string{"from@example.com"}},
+		{tx + "RSET\r\nRSET\r\nMAIL FROM:<other@example.com>\r\nHELO client.com\r\nQUIT\r\n", []string{"from@example.com", "other@example.com"}},
+		{"HELO client.com\r\nRSET\r\nMAIL FROM:<bad\r\nRSET\r\nQUIT\r\n", nil},
+		{tx + "DATA\r\nSubject: a\r\n\r\nbody\r\n.\r\nRSET\r\nQUIT\r\n", nil},
+	}
+
+	deliver := BackendFunc(func(envl *Envelope, data []byte) error { return nil })
+	for _, config := range []func(abort AborterFunc) *Config{
+		func(abort AborterFunc) *Config { return &Config{Backend: deliver, Aborter: abort} },
+		func(abort AborterFunc) *Config { return &Config{Backend: abortBackend{deliver, abort}} },
+	} {
+		for _, input := range cases {
+			var aborted []string
+			abort := func(envl *Envelope) {
+				aborted = append(aborted, envl.OriginatorAddress)
+			}
+			runSession(t, config(abort), input.input)
+			if !reflect.DeepEqual(aborted, input.expected) {
+				t.Errorf("%q: got aborted %q, expected %q", input.input, aborted, input.expected)
+			}
+		}
+	}
+}
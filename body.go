@@ -0,0 +1,178 @@
+package session
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// body types of BODY parameter (RFC 6152, RFC 3030)
+const (
+	Body7Bit       = "7BIT"
+	Body8BitMIME   = "8BITMIME"
+	BodyBinaryMIME = "BINARYMIME"
+)
+
+var (
+	notImplementedErr = NewSMTPError(502, [3]int{5, 5, 1}, "Command not implemented")
+	bodyParamErr      = NewSMTPError(501, [3]int{5, 5, 4}, "Unsupported BODY type")
+	binaryDataErr     = NewSMTPError(503, [3]int{5, 5, 1}, "BINARYMIME requires BDAT")
+	dataAfterBdatErr  = NewSMTPError(503, [3]int{5, 5, 1}, "DATA not allowed after BDAT")
+	eightBitErr       = NewSMTPError(554, [3]int{5, 6, 1}, "Message contains 8-bit data without BODY=8BITMIME")
+	bareEOLErr        = NewSMTPError(554, [3]int{5, 6, 11}, "Message contains bare CR or LF")
+)
+
+// BareEOL is the handling of bare CR and LF in message data. either
+// way the end of data indicator is only recognized after <CRLF>, so
+// "<LF>.<CRLF>" can't be used to smuggle commands
+type BareEOL int
+
+const (
+	// BareEOLNormalize convert bare CR and LF into <CRLF>
+	BareEOLNormalize BareEOL = iota
+	// BareEOLReject reject the message
+	BareEOLReject
+)
+
+// normalizeEOL replace bare CR in line content with <CRLF>
+func normalizeEOL(line []byte) []byte {
+	return bytes.Replace(line, []byte("\r"), []byte("\r\n"), -1)
+}
+
+// bodyType validate value of BODY parameter, absent parameter
+// is 7BIT. BINARYMIME is accepted only when chunking is enabled
+func (s *Session) bodyType(value string) (string, error) {
+	switch body := strings.ToUpper(value); body {
+	case "":
+		return Body7Bit, nil
+	case Body7Bit, Body8BitMIME:
+		return body, nil
+	case BodyBinaryMIME:
+		if s.Config.Chunking {
+			return body, nil
+		}
+	}
+	return "", bodyParamErr
+}
+
+// checkDataBody check that DATA command can transfer the body
+func (s *Session) checkDataBody(envl *Envelope, chunked bool) error {
+	if chunked {
+		return dataAfterBdatErr
+	}
+	if envl.Body == BodyBinaryMIME {
+		return binaryDataErr
+	}
+	return nil
+}
+
+// has8Bit report whether data contains bytes over 127
+func has8Bit(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// check7Bit enforce 7-bit message in strict mode when the client
+// didn't declare 8-bit body or SMTPUTF8
+func (s *Session) check7Bit(envl *Envelope, data []byte) error {
+	if !s.Config.Strict7Bit || envl.SMTPUTF8 || (envl.Body != "" && envl.Body != Body7Bit) {
+		return nil
+	}
+	if has8Bit(data) {
+		return eightBitErr
+	}
+	return nil
+}
+
+// parseBdat parse arguments of BDAT command "<size> [LAST]"
+func parseBdat(c command) (size int64, last bool, err error) {
+	args := strings.Fields(c.Arg())
+	if len(args) == 0 || len(args) > 2 {
+		return 0, false, invalidCommandArgErr
+	}
+	size, err = strconv.ParseInt(args[0], 10, 64)
+	if err != nil || size < 0 {
+		return 0, false, invalidCommandArgErr
+	}
+	if len(args) == 2 {
+		if !strings.EqualFold(args[1], "LAST") {
+			return 0, false, invalidCommandArgErr
+		}
+		last = true
+	}
+	return size, last, nil
+}
+
+// readChunk read the chunk of BDAT command into buf. a chunk that
+// would make the message exceed the size limit is discarded before
+// it is buffered
+func (s *Session) readChunk(c command, buf *bytes.Buffer) (last bool, err error) {
+	size, last, err := parseBdat(c)
+	if err != nil {
+		return false, err
+	}
+	if max, tooLarge := s.messageLimit(); max > 0 && size > int64(max-buf.Len()) {
+		if _, err := io.CopyN(io.Discard, s.Reader, size); err != nil {
+			return false, err
+		}
+		return false, tooLarge
+	}
+	if _, err := io.CopyN(buf, s.Reader, size); err != nil {
+		return false, err
+	}
+	return last, nil
+}
+
+// discardChunk read and drop the chunk of rejected BDAT command
+func (s *Session) discardChunk(c command) {
+	if size, _, err := parseBdat(c); err == nil {
+		io.CopyN(io.Discard, s.Reader, size)
+	}
+}
+
+// receive process complete message data of DATA or BDAT and deliver
+// it, the returned error is replied to the client
+func (s *Session) receive(envl *Envelope, data []byte) error {
+	s.observeMessage(len(data))
+	err := s.check7Bit(envl, data)
+	if err == nil {
+		err = s.checkHeaderFrom(data)
+	}
+	if err == nil {
+		data, err = s.headerMetadata(envl, data)
+	}
+	if err == nil {
+		data = s.ProcessMessage(envl, data)
+		ctx, done := s.stageContext(StageData)
+		if err = s.enforceDMARC(envl); err == nil {
+			data, err = s.filter(ctx, envl, data)
+		}
+		if err == nil {
+			err = s.checkPolicy(ctx, StageData, envl, "")
+		}
+		done()
+		if err == nil {
+			err = s.Deliver(envl, s.sealARC(envl, data))
+		}
+	}
+
+	s.finishMessage(envl, err)
+	return err
+}
+
+// finishMessage count and log the result of received message
+func (s *Session) finishMessage(envl *Envelope, err error) {
+	s.traceError(err)
+	s.countMessage(envl, err)
+	s.recordMessage(envl, err)
+	if err != nil {
+		s.logf(LevelInfo, "message %s from <%s> rejected: %v", envl.ID, envl.OriginatorAddress, err)
+	} else {
+		s.logf(LevelInfo, "message %s from <%s> accepted for %d recipients", envl.ID, envl.OriginatorAddress, len(envl.RecipientAddress))
+	}
+}
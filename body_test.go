@@ -0,0 +1,163 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseBdat(t *testing.T) {
+	cases := []struct {
+		line string
+		size int64
+		last bool
+		err  error
+	}{
+		{"BDAT 100\r\n", 100, false, nil},
+		{"BDAT 0 LAST\r\n", 0, true, nil},
+		{"BDAT 12 last\r\n", 12, true, nil},
+		{"BDAT\r\n", 0, false, invalidCommandArgErr},
+		{"BDAT -1\r\n", 0, false, invalidCommandArgErr},
+		{"BDAT 10 FIRST\r\n", 0, false, invalidCommandArgErr},
+	}
+
+	for _, input := range cases {
+		size, last, err := parseBdat(parseCommand(input.line))
+		if size != input.size || last != input.last || err != input.err {
+			t.Errorf("%q: got %d, %v, %v, expected %d, %v, %v", input.line, size, last, err, input.size, input.last, input.err)
+		}
+	}
+}
+
+// TestSessionBodyType make sure that BODY parameter is validated
+// and 7-bit rules are enforced in strict mode
+func TestSessionBodyType(t *testing.T) {
+	cases := []struct {
+		config   *Config
+		input    string
+		expected string
+		body     string
+	}{
+		{&Config{}, "EHLO client.com\r\n", "250-8BITMIME\r\n", ""},
+		{&Config{}, "MAIL FROM:<some@example.com> BODY=BINARYMIME\r\n", "501 5.5.4 Unsupported BODY type", ""},
+		{&Config{}, "MAIL FROM:<some@example.com> BODY=8BITMIME\r\nRCPT TO:<some@domain.com>\r\nDATA\r\nSubject: caf\xc3\xa9\r\n\r\n.\r\n", "250 2.0.0 OK: queued as ", Body8BitMIME},
+		{&Config{Strict7Bit: true}, "MAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\nSubject: caf\xc3\xa9\r\n\r\n.\r\n", "554 5.6.1", ""},
+		{&Config{Strict7Bit: true}, "MAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\nSubject: cafe\r\n\r\n.\r\n", "250 2.0.0 OK: queued as ", Body7Bit},
+		{&Config{Chunking: true}, "EHLO client.com\r\n", "250-CHUNKING\r\n250-BINARYMIME\r\n", ""},
+		{&Config{Chunking: true}, "MAIL FROM:<some@example.com> BODY=BINARYMIME\r\nRCPT TO:<some@domain.com>\r\nDATA\r\n", "503 5.5.1 BINARYMIME requires BDAT", ""},
+	}
+
+	for _, input := range cases {
+		var body string
+		input.config.Backend = BackendFunc(func(envl *Envelope, data []byte) error {
+			body = envl.Body
+			return nil
+		})
+		out := runSession(t, input.config, "EHLO client.com\r\n"+input.input+"QUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("got: %q, expected %q", out, input.expected)
+		}
+		if body != input.body {
+			t.Errorf("got body type %q, expected %q", body, input.body)
+		}
+	}
+}
+
+// TestSessionBdat make sure that message data is received in chunks
+func TestSessionBdat(t *testing.T) {
+	cases := []struct {
+		config   *Config
+		input    string
+		expected string
+		data     string
+	}{
+		{
+			&Config{},
+			"BDAT 4 LAST\r\ntest",
+			"502 5.5.1 Command not implemented\r\n221",
+			"",
+		},
+		{
+			&Config{Chunking: true},
+			"MAIL FROM:<some@example.com> BODY=BINARYMIME\r\nRCPT TO:<some@domain.com>\r\nBDAT 11\r\nSubject: \x00\x01BDAT 8 LAST\r\n\r\n\r\nbin\x00",
+			"250 2.0.0 11 octets received\r\n250 2.0.0 OK: queued as ",
+			"Subject: \x00\x01\r\n\r\nbin\x00",
+		},
+		{
+			&Config{Chunking: true},
+			"BDAT 5 LAST\r\nhello",
+			"503 5.5.1 Bad sequence of commands\r\n221",
+			"",
+		},
+		{
+			&Config{Chunking: true},
+			"MAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nBDAT 2\r\nhiDATA\r\n",
+			"503 5.5.1 DATA not allowed after BDAT\r\n221",
+			"",
+		},
+		{
+			&Config{Chunking: true, Overloaded: func() bool { return true }, PriorityMaxSize: 8},
+			"MAIL FROM:<some@example.com>\r\nRCPT TO:<postmaster@domain.com>\r\nBDAT 5\r\nhelloBDAT 5 LAST\r\nworldBDAT 3 LAST\r\nabc",
+			"250 2.0.0 5 octets received\r\n552 5.3.4 Message too big for system under load\r\n503 5.5.1 Bad sequence of commands\r\n221",
+			"",
+		},
+		{
+			&Config{Chunking: true, Overloaded: func() bool { return true }, PriorityMaxSize: 8},
+			"MAIL FROM:<some@example.com>\r\nRCPT TO:<postmaster@domain.com>\r\nBDAT 5\r\nhelloBDAT 3 LAST\r\nabc",
+			"250 2.0.0 5 octets received\r\n250 2.0.0 OK: queued as ",
+			"helloabc",
+		},
+		{
+			&Config{Chunking: true, MaxMessageSize: 8},
+			"MAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nBDAT 5\r\nhelloBDAT 5 LAST\r\nworldBDAT 3 LAST\r\nabc",
+			"250 2.0.0 5 octets received\r\n552 5.3.4 Message size exceeds fixed maximum message size\r\n503 5.5.1 Bad sequence of commands\r\n221",
+			"",
+		},
+	}
+
+	for _, input := range cases {
+		var data string
+		input.config.Backend = BackendFunc(func(envl *Envelope, d []byte) error {
+			data = string(d)
+			return nil
+		})
+		out := runSession(t, input.config, "EHLO client.com\r\n"+input.input+"QUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("got: %q, expected %q", out, input.expected)
+		}
+		if data != input.data {
+			t.Errorf("got data %q, expected %q", data, input.data)
+		}
+	}
+}
+
+// TestSessionBareEOL make sure that bare CR and LF are normalized or
+// rejected, dots are unstuffed and "<LF>.<CRLF>" doesn't end data
+func TestSessionBareEOL(t *testing.T) {
+	cases := []struct {
+		bareEOL  BareEOL
+		data     string
+		expected string
+		received string
+	}{
+		{BareEOLNormalize, "Subject: a\r\n\r\n..dot\r\n.\r\n", "250 2.0.0 OK: queued as ", "Subject: a\r\n\r\n.dot\r\n"},
+		{BareEOLNormalize, "Subject: a\n\nbare\rcr\r\n.\r\n", "250 2.0.0 OK: queued as ", "Subject: a\r\n\r\nbare\r\ncr\r\n"},
+		{BareEOLNormalize, "Subject: a\r\n\r\nbody\n.\r\nMAIL FROM:<evil@example.com>\r\n.\r\n", "250 2.0.0 OK: queued as ", "Subject: a\r\n\r\nbody\r\n\r\nMAIL FROM:<evil@example.com>\r\n"},
+		{BareEOLReject, "Subject: a\r\n\r\nbody\n.\r\nMAIL FROM:<evil@example.com>\r\n.\r\n", "554 5.6.11 Message contains bare CR or LF\r\n221", ""},
+		{BareEOLReject, "Subject: a\r\n\r\nbody\r\n.\r\n", "250 2.0.0 OK: queued as ", "Subject: a\r\n\r\nbody\r\n"},
+	}
+
+	for _, input := range cases {
+		var received string
+		config := &Config{BareEOL: input.bareEOL, Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			received = string(data)
+			return nil
+		})}
+		out := runSession(t, config, "HELO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\n"+input.data+"QUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("%q: got %q, expected %q", input.data, out, input.expected)
+		}
+		if received != input.received {
+			t.Errorf("%q: received %q, expected %q", input.data, received, input.received)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// reference count file extension of stored body
+const bodyRefExt = ".ref"
+
+// ErrBodyNotFound is returned when a body doesn't exist in BodyStore
+var ErrBodyNotFound = errors.New("session: body not found")
+
+// BodyStore store message bodies content-addressed by SHA-256 with
+// reference counting, identical bodies are stored once
+type BodyStore struct {
+	Dir string
+
+	mu sync.Mutex
+}
+
+func (bs *BodyStore) path(sum string) string {
+	return filepath.Join(bs.Dir, sum)
+}
+
+// refs read reference count of sum. bs.mu MUST be held
+func (bs *BodyStore) refs(sum string) (int, error) {
+	b, err := os.ReadFile(bs.path(sum) + bodyRefExt)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// setRefs write reference count of sum. bs.mu MUST be held
+func (bs *BodyStore) setRefs(sum string, n int) error {
+	return writeFile(bs.path(sum)+bodyRefExt, []byte(strconv.Itoa(n)))
+}
+
+// Put store data and return its SHA-256 as hex string. storing
+// the same data again only increase the reference count
+func (bs *BodyStore) Put(data []byte) (string, error) {
+	h := sha256.Sum256(data)
+	sum := hex.EncodeToString(h[:])
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	n, err := bs.refs(sum)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(bs.path(sum)); os.IsNotExist(err) {
+		if err := writeFile(bs.path(sum), data); err != nil {
+			return "", err
+		}
+	}
+	if err := bs.setRefs(sum, n+1); err != nil {
+		return "", err
+	}
+	return sum, nil
+}
+
+// Get return the stored body of sum
+func (bs *BodyStore) Get(sum string) ([]byte, error) {
+	data, err := os.ReadFile(bs.path(sum))
+	if os.IsNotExist(err) {
+		return nil, ErrBodyNotFound
+	}
+	return data, err
+}
+
+// Verify read the stored body back and compare its checksum
+// with the address
+func (bs *BodyStore) Verify(sum string) (bool, error) {
+	b, err := hex.DecodeString(sum)
+	if err != nil || len(b) != sha256.Size {
+		return false, ErrBodyNotFound
+	}
+	var h [sha256.Size]byte
+	copy(h[:], b)
+	return verifyFile(bs.path(sum), h)
+}
+
+// Refs return the reference count of sum
+func (bs *BodyStore) Refs(sum string) (int, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.refs(sum)
+}
+
+// Release decrease the reference count of sum, the body is
+// removed when no reference left
+func (bs *BodyStore) Release(sum string) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	n, err := bs.refs(sum)
+	if err != nil {
+		return err
+	}
+	if n <= 1 {
+		os.Remove(bs.path(sum) + bodyRefExt)
+		err := os.Remove(bs.path(sum))
+		if os.IsNotExist(err) {
+			return ErrBodyNotFound
+		}
+		return err
+	}
+	return bs.setRefs(sum, n-1)
+}
@@ -0,0 +1,95 @@
+package session
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// RecipientErrors is returned by Backend.Deliver when the message
+// was delivered to some recipients only, keyed by the failed
+// recipients. DATA has a single reply, so the message is accepted
+// and the failures are reported to the sender by Config.Bouncer.
+// when every recipient failed the message is rejected instead
+type RecipientErrors map[string]error
+
+// Error return the failures ordered by recipient
+func (e RecipientErrors) Error() string {
+	rcpts := make([]string, 0, len(e))
+	for rcpt := range e {
+		rcpts = append(rcpts, rcpt)
+	}
+	sort.Strings(rcpts)
+	parts := make([]string, len(rcpts))
+	for i, rcpt := range rcpts {
+		parts[i] = "<" + rcpt + ">: " + strings.Replace(e[rcpt].Error(), "\r\n", " ", -1)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Bouncer send non-delivery reports (RFC 3464) of messages that fail
+// after they were accepted
+type Bouncer struct {
+	// Hostname is the reporting MTA, default to "localhost"
+	Hostname string
+	// Backend deliver the reports, e.g. Queue
+	Backend Backend
+}
+
+// Bounce send the non-delivery report of the failed results to the
+// reverse path of envl. messages from the null sender never bounce
+// to avoid loops, nor do recipients that asked for NOTIFY=NEVER
+func (b *Bouncer) Bounce(envl *Envelope, results []*DeliveryResult, arrival time.Time, data []byte) error {
+	if envl.OriginatorAddress == "" {
+		return nil
+	}
+	var failed []*DeliveryResult
+	for _, r := range results {
+		if r.Err != nil && envl.DSNRcpt[r.Recipient].notify(NotifyFailure) {
+			failed = append(failed, r)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+
+	hostname := b.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	ndr := BuildDSN(hostname, envl, ActionFailed, failed, arrival, data)
+	return b.Backend.Deliver(&Envelope{ID: newID(), RecipientAddress: []string{envl.OriginatorAddress}}, ndr)
+}
+
+// bounce accept the message for the recipients delivered by the
+// backend and report the failed ones to the sender. the first error
+// is returned when every recipient failed
+func (s *Session) bounce(envl *Envelope, errs RecipientErrors, arrival time.Time, data []byte) ([]string, error) {
+	var delivered []string
+	var failed []*DeliveryResult
+	for _, rcpt := range envl.RecipientAddress {
+		if err, ok := errs[rcpt]; ok {
+			failed = append(failed, &DeliveryResult{Recipient: rcpt, Err: err})
+		} else {
+			delivered = append(delivered, rcpt)
+		}
+	}
+	if len(delivered) == 0 {
+		return nil, failed[0].Err
+	}
+
+	b := s.Config.Bouncer
+	if b == nil {
+		s.logf(LevelWarn, "message %s not delivered to %d recipients without bouncer: %v", envl.ID, len(failed), errs)
+		return delivered, nil
+	}
+	if err := b.Bounce(envl, failed, arrival, data); err != nil {
+		s.logf(LevelWarn, "message %s: bounce: %v", envl.ID, err)
+	}
+	rcpts := make([]string, len(failed))
+	for i, r := range failed {
+		rcpts[i] = r.Recipient
+	}
+	s.track(TrackBounced, envl, messageID(data), rcpts, errs.Error())
+	return delivered, nil
+}
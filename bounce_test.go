@@ -0,0 +1,122 @@
+package session
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBouncerBounce make sure that reports are sent to the reverse
+// path except to the null sender and NOTIFY=NEVER recipients
+func TestBouncerBounce(t *testing.T) {
+	failure := NewSMTPError(550, [3]int{5, 1, 1}, "mailbox unavailable")
+	cases := []struct {
+		sender string
+		notify []string
+		bounce bool
+	}{
+		{"sender@example.org", nil, true},
+		{"sender@example.org", []string{NotifyFailure}, true},
+		{"sender@example.org", []string{NotifyNever}, false},
+		{"", nil, false},
+	}
+
+	for _, input := range cases {
+		var got *Envelope
+		var ndr []byte
+		b := &Bouncer{Hostname: "mx.example.com", Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			got, ndr = envl, data
+			return nil
+		})}
+		envl := &Envelope{OriginatorAddress: input.sender, RecipientAddress: []string{"rcpt@example.com"}}
+		if input.notify != nil {
+			envl.DSNRcpt = map[string]*DSNRecipient{"rcpt@example.com": {Notify: input.notify}}
+		}
+		results := []*DeliveryResult{{Recipient: "rcpt@example.com", Err: failure}}
+		if err := b.Bounce(envl, results, time.Now(), []byte("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		if (got != nil) != input.bounce {
+			t.Errorf("%q %v: got bounce %t, expected %t", input.sender, input.notify, got != nil, input.bounce)
+			continue
+		}
+		if got == nil {
+			continue
+		}
+		if got.OriginatorAddress != "" || len(got.RecipientAddress) != 1 || got.RecipientAddress[0] != input.sender {
+			t.Errorf("got envelope %q => %v, expected <> => %q", got.OriginatorAddress, got.RecipientAddress, input.sender)
+		}
+		report := string(ndr)
+		for _, want := range []string{"multipart/report; report-type=delivery-status", "Action: failed", "Status: 5.1.1", "Subject: hi"} {
+			if !strings.Contains(report, want) {
+				t.Errorf("report does not contain %q:\n%s", want, report)
+			}
+		}
+	}
+}
+
+// TestSessionBounce make sure that recipients rejected by the backend
+// are bounced and the message is accepted for the rest
+func TestSessionBounce(t *testing.T) {
+	var bounces []*Envelope
+	config := &Config{
+		Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			errs := make(RecipientErrors)
+			for _, rcpt := range envl.RecipientAddress {
+				if strings.HasPrefix(rcpt, "full") {
+					errs[rcpt] = NewSMTPError(552, [3]int{5, 2, 2}, "mailbox full")
+				}
+			}
+			if len(errs) > 0 {
+				return errs
+			}
+			return nil
+		}),
+		Bouncer: &Bouncer{Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			bounces = append(bounces, envl)
+			return nil
+		})},
+	}
+
+	cases := []struct {
+		rcpts   []string
+		reply   string
+		bounces int
+	}{
+		{[]string{"a@example.com", "b@example.com"}, "250 2.0.0 OK", 0},
+		{[]string{"a@example.com", "full@example.com"}, "250 2.0.0 OK", 1},
+		{[]string{"full@example.com", "full2@example.com"}, "552 5.2.2 mailbox full", 0},
+	}
+
+	for _, input := range cases {
+		bounces = nil
+		cmds := "EHLO client\r\nMAIL FROM:<sender@example.org>\r\n"
+		for _, rcpt := range input.rcpts {
+			cmds += "RCPT TO:<" + rcpt + ">\r\n"
+		}
+		out := runSession(t, config, cmds+"DATA\r\nSubject: hi\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+		if !strings.Contains(out, "354 ") || !strings.Contains(out[strings.Index(out, "354 "):], input.reply) {
+			t.Errorf("%v: got %q, expected reply %q", input.rcpts, out, input.reply)
+		}
+		if len(bounces) != input.bounces {
+			t.Errorf("%v: got %d bounces, expected %d", input.rcpts, len(bounces), input.bounces)
+		}
+	}
+	// the bounce need the whole message, StreamBackend receive it
+	// buffered
+	b := &streamRecorder{}
+	config.Backend = b
+	runSession(t, config, "EHLO client\r\nMAIL FROM:<sender@example.org>\r\nRCPT TO:<a@example.com>\r\nDATA\r\nSubject: hi\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+	if b.streamed != 0 || b.buffered != 1 {
+		t.Errorf("stream: got %d streamed %d buffered, expected buffered", b.streamed, b.buffered)
+	}
+}
+
+// TestRecipientErrors make sure that the error list every recipient
+func TestRecipientErrors(t *testing.T) {
+	errs := RecipientErrors{"b@example.com": errors.New("no"), "a@example.com": errors.New("full")}
+	if got, want := errs.Error(), "<a@example.com>: full; <b@example.com>: no"; got != want {
+		t.Errorf("got %q, expected %q", got, want)
+	}
+}
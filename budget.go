@@ -0,0 +1,45 @@
+package session
+
+import (
+	"context"
+	"time"
+)
+
+// budgetErr is sent when external checks of a command didn't finish
+// within the budget of the stage
+var budgetErr = NewSMTPError(451, [3]int{4, 4, 3}, "Checks timed out, try again later")
+
+// stageContext return context with the deadline budget of the stage.
+// done MUST be called when the command is handled, it record the
+// latency of the stage into Metrics
+func (s *Session) stageContext(stage Stage) (ctx context.Context, done func()) {
+	start := time.Now()
+	ctx, cancel := s.traceContext(), context.CancelFunc(func() {})
+	if budget := s.Config.Budgets[stage]; budget > 0 {
+		ctx, cancel = context.WithTimeout(ctx, budget)
+	}
+
+	return ctx, func() {
+		exceeded := ctx.Err() == context.DeadlineExceeded
+		cancel()
+		if m := s.Config.Metrics; m != nil {
+			labels := []label{{"stage", string(stage)}}
+			m.add("smtp_stage_commands_total", 1, labels, nil)
+			m.add("smtp_stage_duration_milliseconds_total", uint64(time.Since(start)/time.Millisecond), labels, nil)
+			if exceeded {
+				m.add("smtp_stage_budget_exceeded_total", 1, labels, nil)
+			}
+		}
+	}
+}
+
+// share return context for one of n remaining callouts, the
+// remaining budget of ctx is divided equally so a slow callout
+// can't starve the rest
+func share(ctx context.Context, n int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || n <= 1 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(n))
+}
@@ -0,0 +1,102 @@
+package session
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShare(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	cases := []struct {
+		n   int
+		max time.Duration
+	}{
+		{1, time.Second},
+		{2, 500 * time.Millisecond},
+		{4, 250 * time.Millisecond},
+	}
+
+	for _, input := range cases {
+		sctx, cancel := share(ctx, input.n)
+		deadline, _ := sctx.Deadline()
+		if d := time.Until(deadline); d > input.max {
+			t.Errorf("share(%d) got %v, expected at most %v", input.n, d, input.max)
+		}
+		cancel()
+	}
+
+	sctx, cancel := share(context.Background(), 2)
+	defer cancel()
+	if _, ok := sctx.Deadline(); ok {
+		t.Errorf("expected no deadline without budget")
+	}
+}
+
+// TestSessionBudget make sure that the budget of the stage is shared
+// between policies, and policies after exhausted budget are skipped
+func TestSessionBudget(t *testing.T) {
+	var called []string
+	policy := func(name string, delay time.Duration, obey bool) Policy {
+		return PolicyFunc(func(ctx context.Context, req *PolicyRequest) error {
+			if req.Stage != StageRcpt {
+				return nil
+			}
+			called = append(called, name)
+			if obey {
+				select {
+				case <-ctx.Done():
+				case <-time.After(delay):
+				}
+			} else {
+				time.Sleep(delay)
+			}
+			return nil
+		})
+	}
+
+	cases := []struct {
+		policies []Policy
+		expected string
+		called   string
+		exceeded bool
+	}{
+		// slow policy give up on its share, the next still run
+		{[]Policy{policy("slow", time.Second, true), policy("fast", 0, true)}, "250 2.1.5", "slow,fast", false},
+		// stubborn policy exhaust the budget, the next is skipped
+		{[]Policy{policy("stubborn", 100*time.Millisecond, false), policy("fast", 0, true)}, "451 4.4.3 Checks timed out", "stubborn", true},
+	}
+
+	for _, input := range cases {
+		called = nil
+		m := &Metrics{}
+		config := &Config{
+			Budgets:  map[Stage]time.Duration{StageRcpt: 50 * time.Millisecond},
+			Policies: input.policies,
+			Metrics:  m,
+		}
+
+		start := time.Now()
+		out := runSession(t, config, "EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nQUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("got: %q, expected %q", out, input.expected)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("session took %v, expected RCPT bounded by budget", elapsed)
+		}
+		if strings.Join(called, ",") != input.called {
+			t.Errorf("got called %v, expected %s", called, input.called)
+		}
+
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, nil)
+		exceeded := strings.Contains(rec.Body.String(), `smtp_stage_budget_exceeded_total{stage="rcpt"} 1`)
+		if exceeded != input.exceeded {
+			t.Errorf("got: %q, expected exceeded budget counted %v", rec.Body.String(), input.exceeded)
+		}
+	}
+}
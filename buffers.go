@@ -0,0 +1,80 @@
+package session
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// defaultBufferSize is the size of connection buffers when
+// Config.BufferSize is not set
+const defaultBufferSize = 4096
+
+// bufferPool reuse the read and write buffers of connections of one
+// size, so servers with many short connections don't allocate them
+// for every connection
+type bufferPool struct {
+	size    int
+	readers sync.Pool
+	writers sync.Pool
+}
+
+// bufferPools is the pool of each buffer size in use
+var (
+	bufferPoolsMu sync.Mutex
+	bufferPools   = make(map[int]*bufferPool)
+)
+
+// buffers return the pool of buffers of size, the default size when
+// size <= 0
+func buffers(size int) *bufferPool {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	bufferPoolsMu.Lock()
+	defer bufferPoolsMu.Unlock()
+	p, ok := bufferPools[size]
+	if !ok {
+		p = &bufferPool{size: size}
+		bufferPools[size] = p
+	}
+	return p
+}
+
+// reader return a buffered reader of r
+func (p *bufferPool) reader(r io.Reader) *bufio.Reader {
+	if br, ok := p.readers.Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, p.size)
+}
+
+// writer return a buffered writer of w
+func (p *bufferPool) writer(w io.Writer) *bufio.Writer {
+	if bw, ok := p.writers.Get().(*bufio.Writer); ok {
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriterSize(w, p.size)
+}
+
+// put return the buffers into the pool, they must not be used after
+func (p *bufferPool) put(r *bufio.Reader, w *bufio.Writer) {
+	// don't keep the connection reachable from the pool
+	r.Reset(nil)
+	w.Reset(nil)
+	p.readers.Put(r)
+	p.writers.Put(w)
+}
+
+// releaseBuffers return the buffers of the closed session into its
+// pool
+func (s *Session) releaseBuffers() {
+	if s.buffers == nil || s.bufR == nil {
+		return
+	}
+	s.buffers.put(s.bufR, s.bufW)
+	s.bufR, s.bufW = nil, nil
+	s.Reader, s.Writer, s.Reply.w = nil, nil, nil
+}
@@ -0,0 +1,60 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestSessionBuffers make sure that sessions take buffers of the
+// configured size, Session and Reply share the writer and the
+// buffers are released when the session is closed
+func TestSessionBuffers(t *testing.T) {
+	cases := []struct {
+		size     int
+		expected int
+	}{
+		{0, defaultBufferSize},
+		{-1, defaultBufferSize},
+		{64, 64},
+	}
+
+	for _, input := range cases {
+		server, client := net.Pipe()
+		client.Close()
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		s := newSession(server, wg, nil, input.size)
+		if s.Reader.Size() != input.expected || s.Writer.Size() != input.expected {
+			t.Errorf("%d: got sizes %d and %d, expected %d", input.size, s.Reader.Size(), s.Writer.Size(), input.expected)
+		}
+		if s.Writer != s.Reply.w {
+			t.Errorf("%d: Session and Reply have different writers", input.size)
+		}
+		s.Close()
+		if s.Reader != nil || s.Reply.w != nil {
+			t.Errorf("%d: buffers not released", input.size)
+		}
+		s.releaseBuffers()
+	}
+}
+
+// TestSmallBuffers make sure that lines longer than the buffers are
+// read
+func TestSmallBuffers(t *testing.T) {
+	srv := NewServer(&Config{BufferSize: 16})
+	server, client := net.Pipe()
+	go srv.ServeSMTP(context.Background(), server)
+
+	rcpt := strings.Repeat("a", 200) + "@example.com"
+	go fmt.Fprint(client, "EHLO client.com\r\nMAIL FROM:<a@client.com>\r\nRCPT TO:<"+rcpt+">\r\n"+
+		"DATA\r\nSubject: "+strings.Repeat("b", 300)+"\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+	out, _ := io.ReadAll(client)
+	if !strings.Contains(string(out), "250 2.0.0 OK: queued as ") {
+		t.Errorf("got %q", out)
+	}
+}
@@ -0,0 +1,178 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// default poll interval of BundleLoader
+const defaultBundleInterval = 30 * time.Second
+
+// bundleContext separate bundle signatures from other uses of the key
+const bundleContext = "session-bundle-v1\x00"
+
+// bundle errors
+var (
+	ErrBundleSignature = errors.New("session: invalid bundle signature")
+	ErrBundleRollback  = errors.New("session: bundle older than the applied one")
+)
+
+// Bundle is a configuration payload signed with an operator key
+// (Ed25519). the creation time is signed too, so an older bundle
+// can't be replayed over a newer one
+type Bundle struct {
+	Payload   []byte    `json:"payload"`
+	Created   time.Time `json:"created"`
+	KeyID     string    `json:"key_id"`
+	Signature []byte    `json:"signature"`
+}
+
+// BundleKeyID return the identifier of public key
+func BundleKeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// signedData return the data covered by the signature
+func (b *Bundle) signedData() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(bundleContext)
+	buf.WriteString(b.Created.UTC().Format(time.RFC3339Nano))
+	buf.WriteByte('\n')
+	buf.Write(b.Payload)
+	return buf.Bytes()
+}
+
+// SignBundle sign payload with key and return the encoded bundle
+func SignBundle(key ed25519.PrivateKey, payload []byte, created time.Time) ([]byte, error) {
+	b := &Bundle{
+		Payload: payload,
+		Created: created.UTC(),
+		KeyID:   BundleKeyID(key.Public().(ed25519.PublicKey)),
+	}
+	b.Signature = ed25519.Sign(key, b.signedData())
+	return json.MarshalIndent(b, "", "  ")
+}
+
+// OpenBundle decode the bundle and verify its signature with one
+// of the trusted keys
+func OpenBundle(data []byte, keys []ed25519.PublicKey) (*Bundle, error) {
+	b := &Bundle{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("session: invalid bundle: %v", err)
+	}
+	for _, key := range keys {
+		if BundleKeyID(key) == b.KeyID && ed25519.Verify(key, b.signedData(), b.Signature) {
+			return b, nil
+		}
+	}
+	return nil, ErrBundleSignature
+}
+
+// ParseBundlePublicKey parse PEM encoded Ed25519 public key
+func ParseBundlePublicKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("session: no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("session: bundle key is not Ed25519")
+	}
+	return pub, nil
+}
+
+// ParseBundlePrivateKey parse PEM encoded Ed25519 private key (PKCS #8)
+func ParseBundlePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("session: no PEM block found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("session: bundle key is not Ed25519")
+	}
+	return priv, nil
+}
+
+// BundleLoader read a signed bundle from Path and pass its verified
+// payload to Apply. bundles with invalid signature or older than
+// the applied one are never applied, the current config is kept
+type BundleLoader struct {
+	Path  string
+	Keys  []ed25519.PublicKey
+	Apply func(b *Bundle) error
+	// Interval between checks of Watch, default to 30 seconds
+	Interval time.Duration
+	// Logger receive the errors of Watch, default to the standard
+	// logger
+	Logger *Logger
+
+	mu      sync.Mutex
+	sum     [sha256.Size]byte
+	applied time.Time
+}
+
+// Load verify and apply the bundle when the file changed
+func (l *BundleLoader) Load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	data, err := os.ReadFile(l.Path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if sum == l.sum {
+		return nil
+	}
+
+	b, err := OpenBundle(data, l.Keys)
+	if err != nil {
+		return err
+	}
+	if b.Created.Before(l.applied) {
+		return ErrBundleRollback
+	}
+	if err := l.Apply(b); err != nil {
+		return err
+	}
+	l.sum, l.applied = sum, b.Created
+	return nil
+}
+
+// Watch check the file every Interval and apply new bundles
+// until ctx is done
+func (l *BundleLoader) Watch(ctx context.Context) {
+	t := time.NewTicker(durationOr(l.Interval, defaultBundleInterval))
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := l.Load(); err != nil {
+			logf(l.Logger, LevelWarn, "bundle: %v", err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package session
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestOpenBundle make sure that only bundles signed by trusted keys
+// are opened
+func TestOpenBundle(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	data, err := SignBundle(priv, []byte("hostname: mx.example.org\n"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), data...)
+	for i := range tampered {
+		// payload is base64 "aG9zdG5hbWU6..."
+		if tampered[i] == 'a' && tampered[i+1] == 'G' {
+			tampered[i] = 'b'
+			break
+		}
+	}
+
+	cases := []struct {
+		data  []byte
+		keys  []ed25519.PublicKey
+		valid bool
+	}{
+		{data, []ed25519.PublicKey{pub}, true},
+		{data, []ed25519.PublicKey{other, pub}, true},
+		{data, []ed25519.PublicKey{other}, false},
+		{tampered, []ed25519.PublicKey{pub}, false},
+		{[]byte("not a bundle"), []ed25519.PublicKey{pub}, false},
+	}
+
+	for i, input := range cases {
+		b, err := OpenBundle(input.data, input.keys)
+		if (err == nil) != input.valid {
+			t.Errorf("%d: got error %v, expected valid=%t", i, err, input.valid)
+		}
+		if err == nil && string(b.Payload) != "hostname: mx.example.org\n" {
+			t.Errorf("%d: got payload %q", i, b.Payload)
+		}
+	}
+}
+
+// TestBundleLoader make sure that changed bundles are applied and
+// invalid or rolled back bundles are not
+func TestBundleLoader(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, untrusted, _ := ed25519.GenerateKey(rand.Reader)
+	path := filepath.Join(t.TempDir(), "config.bundle")
+
+	var applied []string
+	l := &BundleLoader{Path: path, Keys: []ed25519.PublicKey{pub}, Apply: func(b *Bundle) error {
+		applied = append(applied, string(b.Payload))
+		return nil
+	}}
+
+	now := time.Now()
+	cases := []struct {
+		key     ed25519.PrivateKey
+		payload string
+		created time.Time
+		err     error
+	}{
+		{priv, "v1", now, nil},
+		{priv, "v2", now.Add(time.Minute), nil},
+		{untrusted, "evil", now.Add(time.Hour), ErrBundleSignature},
+		{priv, "v1", now, ErrBundleRollback},
+	}
+
+	for _, input := range cases {
+		data, _ := SignBundle(input.key, []byte(input.payload), input.created)
+		os.WriteFile(path, data, 0644)
+		if err := l.Load(); err != input.err {
+			t.Errorf("%s: got error %v, expected %v", input.payload, err, input.err)
+		}
+	}
+
+	// unchanged file is not applied again
+	data, _ := SignBundle(priv, []byte("v3"), now.Add(2*time.Minute))
+	os.WriteFile(path, data, 0644)
+	l.Load()
+	l.Load()
+
+	if got := len(applied); got != 3 || applied[0] != "v1" || applied[1] != "v2" || applied[2] != "v3" {
+		t.Errorf("got applied %v, expected [v1 v2 v3]", applied)
+	}
+}
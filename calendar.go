@@ -0,0 +1,67 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/pyk/session/mime"
+)
+
+// Invitation represents a calendar (iTIP/iMIP) part of a message
+type Invitation struct {
+	// Method is the iTIP method like REQUEST, REPLY or CANCEL
+	Method string
+	Data   []byte
+}
+
+// CalendarHandler process calendar invitations separately
+// from the normal delivery
+type CalendarHandler interface {
+	// HandleCalendar is called when message contain calendar parts.
+	// the message is delivered to Backend only if deliver is true
+	HandleCalendar(envl *Envelope, invitations []*Invitation, data []byte) (deliver bool, err error)
+}
+
+// FindInvitations walk MIME parts of message data and return every
+// text/calendar part that have METHOD
+func FindInvitations(data []byte) []*Invitation {
+	mr, err := mime.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	var invitations []*Invitation
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			return invitations
+		}
+		if p.MediaType != "text/calendar" {
+			continue
+		}
+		content, err := io.ReadAll(p)
+		if err != nil {
+			continue
+		}
+		method := strings.ToUpper(p.Params["method"])
+		if method == "" {
+			method = calendarMethod(content)
+		}
+		if method != "" {
+			invitations = append(invitations, &Invitation{Method: method, Data: content})
+		}
+	}
+}
+
+// calendarMethod find METHOD property of iCalendar object
+func calendarMethod(content []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 7 && strings.EqualFold(line[:7], "METHOD:") {
+			return strings.ToUpper(line[7:])
+		}
+	}
+	return ""
+}
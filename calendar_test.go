@@ -0,0 +1,87 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+const invitationMessage = "From: organizer@example.com\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"You are invited\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/calendar; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"QkVHSU46VkNBTEVOREFSDQpNRVRIT0Q6UkVRVUVTVA0KRU5EOlZDQUxFTkRBUg0K\r\n" +
+	"--b1--\r\n"
+
+// TestFindInvitations make sure that calendar parts with METHOD detected
+func TestFindInvitations(t *testing.T) {
+	cases := []struct {
+		data   string
+		method string
+	}{
+		{invitationMessage, "REQUEST"},
+		{"Content-Type: text/calendar; method=cancel\r\n\r\nBEGIN:VCALENDAR\r\n", "CANCEL"},
+		{"Content-Type: text/calendar\r\n\r\nBEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n", ""},
+		{"Content-Type: text/plain\r\n\r\nMETHOD:REQUEST\r\n", ""},
+	}
+
+	for _, input := range cases {
+		invitations := FindInvitations([]byte(input.data))
+		method := ""
+		if len(invitations) > 0 {
+			method = invitations[0].Method
+		}
+		if method != input.method {
+			t.Errorf("%q: got %q, expected %q", input.data, method, input.method)
+		}
+	}
+}
+
+type calendarRecorder struct {
+	invitations []*Invitation
+	delivered   int
+}
+
+func (c *calendarRecorder) HandleCalendar(envl *Envelope, invitations []*Invitation, data []byte) (bool, error) {
+	c.invitations = invitations
+	return false, nil
+}
+
+// TestCalendarRouting make sure that invitations routed to calendar
+// handler instead of backend
+func TestCalendarRouting(t *testing.T) {
+	rec := &calendarRecorder{}
+	config := &Config{
+		CalendarHandler: rec,
+		Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			rec.delivered++
+			return nil
+		}),
+	}
+
+	input := "EHLO client.com\r\n" +
+		"MAIL FROM:<organizer@example.com>\r\n" +
+		"RCPT TO:<some@domain.com>\r\n" +
+		"DATA\r\n" + invitationMessage + ".\r\n" +
+		"MAIL FROM:<some@example.com>\r\n" +
+		"RCPT TO:<some@domain.com>\r\n" +
+		"DATA\r\nSubject: plain\r\n\r\nhello\r\n.\r\n" +
+		"QUIT\r\n"
+	out := runSession(t, config, input)
+
+	if len(rec.invitations) != 1 || rec.invitations[0].Method != "REQUEST" {
+		t.Errorf("got invitations %v, expected one REQUEST", rec.invitations)
+	}
+	if rec.delivered != 1 {
+		t.Errorf("got %d delivered messages, expected 1", rec.delivered)
+	}
+	if !strings.HasSuffix(out, "221 2.0.0 localhost OK bye\r\n") {
+		t.Errorf("unexpected session replies: %q", out)
+	}
+}
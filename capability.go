@@ -0,0 +1,199 @@
+package session
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientCapabilities count the sessions of a client that negotiated or
+// used each protocol extension, and messages with declared SIZE
+type ClientCapabilities struct {
+	Client   string    `json:"client,omitempty"`
+	Helo     string    `json:"helo,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+	Sessions int       `json:"sessions"`
+	EHLO     int       `json:"ehlo"`
+	// TLS count encrypted sessions, StartTLS the ones upgraded
+	// with STARTTLS
+	TLS          int `json:"tls"`
+	StartTLS     int `json:"starttls"`
+	Auth         int `json:"auth"`
+	Pipelining   int `json:"pipelining"`
+	Chunking     int `json:"chunking"`
+	EightBitMIME int `json:"8bitmime"`
+	SMTPUTF8     int `json:"smtputf8"`
+	DSN          int `json:"dsn"`
+	Messages     int `json:"messages"`
+	// SizeDeclared count messages with SIZE parameter of MAIL,
+	// SizeExceeded the ones larger than declared
+	SizeDeclared int `json:"size_declared"`
+	SizeExceeded int `json:"size_exceeded"`
+}
+
+// add merge counters of o
+func (c *ClientCapabilities) add(o *ClientCapabilities) {
+	if o.LastSeen.After(c.LastSeen) {
+		c.LastSeen = o.LastSeen
+		if o.Helo != "" {
+			c.Helo = o.Helo
+		}
+	}
+	c.Sessions += o.Sessions
+	c.EHLO += o.EHLO
+	c.TLS += o.TLS
+	c.StartTLS += o.StartTLS
+	c.Auth += o.Auth
+	c.Pipelining += o.Pipelining
+	c.Chunking += o.Chunking
+	c.EightBitMIME += o.EightBitMIME
+	c.SMTPUTF8 += o.SMTPUTF8
+	c.DSN += o.DSN
+	c.Messages += o.Messages
+	c.SizeDeclared += o.SizeDeclared
+	c.SizeExceeded += o.SizeExceeded
+}
+
+// CapabilityReport aggregate the capabilities of clients by IP
+// address, e.g. to find clients that would break when TLS is
+// required. the zero value is ready to use
+type CapabilityReport struct {
+	mu      sync.Mutex
+	clients map[string]*ClientCapabilities
+}
+
+// Record merge capabilities of a finished session of client
+func (r *CapabilityReport) Record(caps *ClientCapabilities) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.clients == nil {
+		r.clients = make(map[string]*ClientCapabilities)
+	}
+	c := r.clients[caps.Client]
+	if c == nil {
+		c = &ClientCapabilities{Client: caps.Client}
+		r.clients[caps.Client] = c
+	}
+	c.add(caps)
+}
+
+// Clients return capabilities of every client ordered by address
+func (r *CapabilityReport) Clients() []ClientCapabilities {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients := make([]ClientCapabilities, 0, len(r.clients))
+	for _, c := range r.clients {
+		clients = append(clients, *c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Client < clients[j].Client })
+	return clients
+}
+
+// Total return capabilities of all clients together
+func (r *CapabilityReport) Total() ClientCapabilities {
+	var total ClientCapabilities
+	for _, c := range r.Clients() {
+		total.add(&c)
+	}
+	total.Helo = ""
+	return total
+}
+
+// WithoutTLS return addresses of clients that never used TLS
+func (r *CapabilityReport) WithoutTLS() []string {
+	var clients []string
+	for _, c := range r.Clients() {
+		if c.TLS == 0 {
+			clients = append(clients, c.Client)
+		}
+	}
+	return clients
+}
+
+// Reset remove every client
+func (r *CapabilityReport) Reset() {
+	r.mu.Lock()
+	r.clients = nil
+	r.mu.Unlock()
+}
+
+// capabilityUsage is the capabilities used in a session
+type capabilityUsage struct {
+	ClientCapabilities
+	// size is the SIZE parameter of current transaction, sized
+	// report whether it was sent
+	size  int64
+	sized bool
+}
+
+// observeCommand record extensions used by valid command c,
+// pipelined is set when more commands were sent before the reply
+func (s *Session) observeCommand(c command, pipelined bool) {
+	caps := &s.caps.ClientCapabilities
+	if pipelined {
+		caps.Pipelining = 1
+	}
+	switch c.Verb() {
+	case "EHLO":
+		caps.EHLO = 1
+	case "BDAT":
+		caps.Chunking = 1
+	case "MAIL FROM:":
+		params := c.Params()
+		if body := strings.ToUpper(params["BODY"]); body == "8BITMIME" || body == "BINARYMIME" {
+			caps.EightBitMIME = 1
+		}
+		if _, ok := params["SMTPUTF8"]; ok {
+			caps.SMTPUTF8 = 1
+		}
+		if params["RET"] != "" || params["ENVID"] != "" {
+			caps.DSN = 1
+		}
+		size, err := strconv.ParseInt(params["SIZE"], 10, 64)
+		s.caps.size, s.caps.sized = size, err == nil
+	case "RCPT TO:":
+		params := c.Params()
+		if params["NOTIFY"] != "" || params["ORCPT"] != "" {
+			caps.DSN = 1
+		}
+	}
+}
+
+// observeMessage record the size of received message against the
+// declared SIZE
+func (s *Session) observeMessage(size int) {
+	s.caps.Messages++
+	if s.caps.sized {
+		s.caps.SizeDeclared++
+		if int64(size) > s.caps.size {
+			s.caps.SizeExceeded++
+		}
+	}
+	s.caps.sized = false
+}
+
+// reportCapabilities record the session into Config.Capabilities
+func (s *Session) reportCapabilities() {
+	if s.Config.Capabilities == nil {
+		return
+	}
+	caps := s.caps.ClientCapabilities
+	if ip := s.RemoteIP(); ip != nil {
+		caps.Client = ip.String()
+	}
+	caps.Helo = s.HeloName
+	caps.LastSeen = time.Now()
+	caps.Sessions = 1
+	if s.TLS() {
+		caps.TLS = 1
+		if s.implicitTLS == nil && s.TLSState() != nil {
+			caps.StartTLS = 1
+		}
+	}
+	if s.Principal != nil {
+		caps.Auth = 1
+	}
+	s.Config.Capabilities.Record(&caps)
+}
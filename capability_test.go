@@ -0,0 +1,72 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestCapabilityReport make sure that extensions used by clients are
+// aggregated per address
+func TestCapabilityReport(t *testing.T) {
+	report := &CapabilityReport{}
+	config := &Config{Capabilities: report}
+	data := "DATA\r\nSubject: a\r\n\r\nsome body\r\n.\r\n"
+
+	runSessionFrom(t, config, "192.0.2.1:25", "EHLO client.com\r\nMAIL FROM:<a@example.com> SIZE=10 BODY=8bitmime\r\n"+
+		"RCPT TO:<b@example.com> NOTIFY=NEVER\r\n"+data+
+		"MAIL FROM:<a@example.com> SIZE=1000\r\nRCPT TO:<b@example.com>\r\n"+data+"QUIT\r\n")
+	runSessionFrom(t, config, "192.0.2.1:25", "HELO legacy.com\r\nQUIT\r\n")
+
+	// interactive client doesn't pipeline commands
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(config)
+	go srv.Serve(l)
+	c := dialTestClient(t, l.Addr().String())
+	c.cmd(t, "EHLO client.com", "250 ")
+	c.cmd(t, "MAIL FROM:<a@example.com> SMTPUTF8", "250 ")
+	c.cmd(t, "QUIT", "221 ")
+	c.conn.Close()
+	srv.Shutdown(context.Background())
+	l.Close()
+
+	expected := []ClientCapabilities{
+		{Client: "127.0.0.1", Helo: "client.com", Sessions: 1, EHLO: 1, SMTPUTF8: 1},
+		{Client: "192.0.2.1", Helo: "legacy.com", Sessions: 2, EHLO: 1, Pipelining: 2, EightBitMIME: 1, DSN: 1,
+			Messages: 2, SizeDeclared: 2, SizeExceeded: 1},
+	}
+	got := report.Clients()
+	for i := range got {
+		got[i].LastSeen = time.Time{}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %+v, expected %+v", got, expected)
+	}
+	if without := report.WithoutTLS(); len(without) != 2 {
+		t.Errorf("got %v, expected both clients without TLS", without)
+	}
+
+	// admin API
+	rec := httptest.NewRecorder()
+	(&Admin{Capabilities: report}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/capabilities", nil))
+	var status capabilityStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || status.Total.Sessions != 3 || status.Total.Messages != 2 || len(status.Clients) != 2 {
+		t.Errorf("got %d %+v, expected report of 3 sessions", rec.Code, status)
+	}
+
+	report.Reset()
+	if got := report.Clients(); len(got) != 0 {
+		t.Errorf("got %+v after reset, expected none", got)
+	}
+}
@@ -0,0 +1,89 @@
+package session
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+)
+
+// CertAuthorizer map the verified client certificate of a TLS session
+// to a principal, the client is then authenticated without AUTH
+type CertAuthorizer interface {
+	// AuthorizeCert return the principal of cert, or an error when
+	// the certificate identity is not known
+	AuthorizeCert(cert *x509.Certificate) (*Principal, error)
+}
+
+// CertAuthorizerFunc is an adapter to allow the use of ordinary
+// functions as CertAuthorizer
+type CertAuthorizerFunc func(cert *x509.Certificate) (*Principal, error)
+
+// AuthorizeCert call f(cert)
+func (f CertAuthorizerFunc) AuthorizeCert(cert *x509.Certificate) (*Principal, error) {
+	return f(cert)
+}
+
+// authorizeCert authenticate the session with the verified client
+// certificate of TLS state. the client may still use AUTH when the
+// certificate is missing or not authorized. with AuthExternal the
+// client authenticate with AUTH EXTERNAL instead
+func (s *Session) authorizeCert(state *tls.ConnectionState) {
+	if s.Config.CertAuthorizer == nil || s.Config.AuthExternal || s.Principal != nil || len(state.VerifiedChains) == 0 {
+		return
+	}
+	cert := state.VerifiedChains[0][0]
+	p, err := s.Config.CertAuthorizer.AuthorizeCert(cert)
+	if err != nil || p == nil {
+		s.logf(LevelInfo, "certificate %q not authorized: %v", cert.Subject.CommonName, err)
+		return
+	}
+	s.Principal = p
+	s.logf(LevelInfo, "authenticated as %s by certificate %q", p.Credential(), cert.Subject.CommonName)
+}
+
+// verifiedCert return the verified client certificate of the TLS
+// session, nil when there is none
+func (s *Session) verifiedCert() *x509.Certificate {
+	state := s.TLSState()
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// externalAllowed report whether AUTH EXTERNAL is advertised, only
+// when the client presented a verified certificate
+func (s *Session) externalAllowed() bool {
+	return s.Config.CertAuthorizer != nil && s.Config.AuthExternal && s.verifiedCert() != nil
+}
+
+// authExternal authenticate the client as the principal of its
+// certificate (RFC 4422 appendix A). resp is the authorization
+// identity in base64, "=" or "" when it is derived from the
+// certificate, otherwise it must be the username of the principal
+func (s *Session) authExternal(resp string) error {
+	authzid := ""
+	if resp != "=" && resp != "" {
+		b, err := base64.StdEncoding.DecodeString(resp)
+		if err != nil {
+			return invalidCommandArgErr
+		}
+		authzid = string(b)
+	}
+
+	cert := s.verifiedCert()
+	p, err := s.Config.CertAuthorizer.AuthorizeCert(cert)
+	if err != nil || p == nil {
+		s.jitter()
+		s.logf(LevelInfo, "AUTH EXTERNAL: certificate %q not authorized: %v", cert.Subject.CommonName, err)
+		return authInvalidErr
+	}
+	if authzid != "" && authzid != p.Username {
+		s.jitter()
+		s.logf(LevelInfo, "AUTH EXTERNAL: certificate %q not authorized for %s", cert.Subject.CommonName, authzid)
+		return authInvalidErr
+	}
+	s.Principal = p
+	s.logf(LevelInfo, "authenticated as %s by AUTH EXTERNAL with certificate %q", p.Credential(), cert.Subject.CommonName)
+	return nil
+}
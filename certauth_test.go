@@ -0,0 +1,228 @@
+package session
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClientCert return a client certificate of cn signed by ca
+func testClientCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// testCA return a self-signed CA certificate and its key
+func testCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, key
+}
+
+// TestCertAuthorizer make sure that a verified and authorized client
+// certificate authenticate the submission session without AUTH
+func TestCertAuthorizer(t *testing.T) {
+	ca, caKey := testCA(t)
+	otherCA, otherKey := testCA(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	tlsConfig := testTLSConfig(t)
+	tlsConfig.ClientCAs = pool
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	srv := NewServer(&Config{
+		Mode:          ModeMSA,
+		TLSConfig:     tlsConfig,
+		Authenticator: testAuthenticator,
+		CertAuthorizer: CertAuthorizerFunc(func(cert *x509.Certificate) (*Principal, error) {
+			if cert.Subject.CommonName != "device.example.com" {
+				return nil, errors.New("unknown device")
+			}
+			return &Principal{Username: "device"}, nil
+		}),
+	})
+	go srv.ServeTLS(l, "", "")
+
+	auth := "AUTH PLAIN " + plainResponse("user", "secret")
+
+	cases := []struct {
+		cert     []tls.Certificate
+		commands [][2]string
+	}{
+		{[]tls.Certificate{testClientCert(t, ca, caKey, "device.example.com")}, [][2]string{
+			{auth, "503 5.5.1 Already authenticated"},
+			{"MAIL FROM:<device@example.com>", "250 2.0.0 OK"},
+		}},
+		{[]tls.Certificate{testClientCert(t, ca, caKey, "other.example.com")}, [][2]string{
+			{"MAIL FROM:<device@example.com>", "530 5.7.0 Authentication required"},
+			{auth, "235 2.7.0"},
+		}},
+		{nil, [][2]string{
+			{"MAIL FROM:<device@example.com>", "530 5.7.0 Authentication required"},
+			{auth, "235 2.7.0"},
+		}},
+	}
+
+	for _, input := range cases {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: input.cert})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &testClient{conn: conn, reader: bufio.NewReader(conn)}
+		c.expect(t, "220 ")
+		c.cmd(t, "HELO client.com", "250 ")
+		for _, command := range input.commands {
+			c.cmd(t, command[0], command[1])
+		}
+		conn.Close()
+	}
+
+	// certificate of unknown CA fail the handshake
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{testClientCert(t, otherCA, otherKey, "device.example.com")},
+	})
+	if err == nil {
+		_, err = bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+	}
+	if err == nil {
+		t.Errorf("got no error, expected handshake failure with unknown CA")
+	}
+}
+
+// TestAuthExternal make sure that AUTH EXTERNAL is advertised with
+// a verified client certificate and authenticate its principal
+func TestAuthExternal(t *testing.T) {
+	ca, caKey := testCA(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	tlsConfig := testTLSConfig(t)
+	tlsConfig.ClientCAs = pool
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	srv := NewServer(&Config{
+		Mode:          ModeMSA,
+		TLSConfig:     tlsConfig,
+		Authenticator: testAuthenticator,
+		AuthExternal:  true,
+		CertAuthorizer: CertAuthorizerFunc(func(cert *x509.Certificate) (*Principal, error) {
+			if cert.Subject.CommonName != "device.example.com" {
+				return nil, errors.New("unknown device")
+			}
+			return &Principal{Username: "device"}, nil
+		}),
+	})
+	go srv.ServeTLS(l, "", "")
+
+	device := []tls.Certificate{testClientCert(t, ca, caKey, "device.example.com")}
+	other := []tls.Certificate{testClientCert(t, ca, caKey, "other.example.com")}
+	cases := []struct {
+		cert     []tls.Certificate
+		auth     string
+		commands [][2]string
+	}{
+		{device, "250 AUTH PLAIN EXTERNAL\r\n", [][2]string{
+			{"MAIL FROM:<device@example.com>", "530 5.7.0 Authentication required"},
+			{"AUTH EXTERNAL =", "235 2.7.0"},
+			{"AUTH EXTERNAL =", "503 5.5.1 Already authenticated"},
+			{"MAIL FROM:<device@example.com>", "250 2.0.0 OK"},
+		}},
+		{device, "250 AUTH PLAIN EXTERNAL\r\n", [][2]string{
+			{"AUTH EXTERNAL", "334 "},
+			{"", "235 2.7.0"},
+		}},
+		{device, "250 AUTH PLAIN EXTERNAL\r\n", [][2]string{
+			{"AUTH EXTERNAL ZGV2aWNl", "235 2.7.0"},
+		}},
+		{device, "250 AUTH PLAIN EXTERNAL\r\n", [][2]string{
+			{"AUTH EXTERNAL dXNlcg==", "535 5.7.8"},
+			{"AUTH EXTERNAL !", "501 5.5.4"},
+			{"AUTH EXTERNAL", "334 "},
+			{"*", "501 5.0.0 Authentication cancelled"},
+		}},
+		{other, "250 AUTH PLAIN EXTERNAL\r\n", [][2]string{
+			{"AUTH EXTERNAL =", "535 5.7.8"},
+			{"AUTH PLAIN " + plainResponse("user", "secret"), "235 2.7.0"},
+		}},
+		{nil, "250 AUTH PLAIN\r\n", [][2]string{
+			{"AUTH EXTERNAL =", "504 5.5.4 Unrecognized authentication type"},
+		}},
+	}
+
+	for _, input := range cases {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: input.cert})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &testClient{conn: conn, reader: bufio.NewReader(conn)}
+		c.expect(t, "220 ")
+		fmt.Fprint(conn, "EHLO client.com\r\n")
+		var ehlo string
+		for line := ""; !strings.HasPrefix(line, "250 "); ehlo += line {
+			if line, err = c.reader.ReadString('\n'); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !strings.Contains(ehlo, input.auth) {
+			t.Errorf("got EHLO reply %q, expected %q", ehlo, input.auth)
+		}
+		for _, command := range input.commands {
+			c.cmd(t, command[0], command[1])
+		}
+		conn.Close()
+	}
+}
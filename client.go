@@ -0,0 +1,609 @@
+package session
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// default timeouts of Client
+const (
+	// defaultClientTimeout is the timeout of a single outbound
+	// SMTP transaction
+	defaultClientTimeout = 5 * time.Minute
+	// defaultConnectTimeout is the timeout of a single address
+	defaultConnectTimeout = 30 * time.Second
+	// defaultFallbackDelay is how long the preferred address family
+	// is tried alone (RFC 8305)
+	defaultFallbackDelay = 300 * time.Millisecond
+)
+
+// address families of Client.Prefer
+const (
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+)
+
+var (
+	// nullMXErr is the result of domains that don't accept mail (RFC 7505)
+	nullMXErr = NewSMTPError(556, [3]int{5, 1, 10}, "Recipient domain does not accept mail")
+	// errNoTLS is returned when RequireTLS is set and the server
+	// doesn't offer STARTTLS
+	errNoTLS = errors.New("client: STARTTLS not offered")
+	// stsErr is the result of mail exchangers failing the MTA-STS
+	// policy of the recipient domain
+	stsErr = NewSMTPError(451, [3]int{4, 7, 5}, "MTA-STS policy of recipient domain not satisfied")
+	// daneErr is the result of mail exchangers failing their TLSA
+	// records
+	daneErr = NewSMTPError(451, [3]int{4, 7, 5}, "DANE authentication of mail exchanger failed")
+)
+
+// policy types of TLSFailure (RFC 8460 section 4.3)
+const (
+	TLSPolicySTS  = "sts"
+	TLSPolicyTLSA = "tlsa"
+)
+
+// TLSFailure is a failure of the TLS policy of a recipient domain
+type TLSFailure struct {
+	Domain string
+	// Host is the mail exchanger, empty when the policy itself
+	// couldn't be retrieved
+	Host   string
+	Policy string
+	Err    error
+}
+
+// Client is a Transport that relay messages to the mail exchangers
+// of each recipient domain
+type Client struct {
+	// Hostname is sent in EHLO, default to "localhost"
+	Hostname string
+
+	// Resolver is used to look up MX records,
+	// default to net.DefaultResolver
+	Resolver Resolver
+
+	// Port of the mail exchangers, default to "25"
+	Port string
+
+	// TLSConfig is used for STARTTLS, ServerName is set to the
+	// name of the mail exchanger when empty
+	TLSConfig *tls.Config
+	// RequireTLS refuse to deliver over connection without STARTTLS
+	RequireTLS bool
+	// MTASTS apply the MTA-STS policies of recipient domains
+	MTASTS *MTASTS
+	// DANE look up the TLSA records of mail exchangers, which then
+	// require STARTTLS with a matching certificate (RFC 7672). DANE
+	// take precedence over MTA-STS
+	DANE TLSAResolver
+	// TLSReport is called with each failure of MTA-STS and DANE,
+	// to be aggregated in TLS reports (RFC 8460)
+	TLSReport func(TLSFailure)
+
+	// Timeout of each transaction, default to 5 minutes
+	Timeout time.Duration
+	// DomainTimeouts override Timeout by recipient domain
+	DomainTimeouts map[string]time.Duration
+
+	// SourceIPv4 and SourceIPv6 are the local addresses of outbound
+	// connections, they must match the SPF record and PTR name
+	// announced for the sending host
+	SourceIPv4 net.IP
+	SourceIPv6 net.IP
+	// Prefer is the address family tried first, PreferIPv4 or
+	// PreferIPv6 (default). the other family is tried after
+	// FallbackDelay, default to 300ms, or when the preferred fail
+	Prefer        string
+	FallbackDelay time.Duration
+	// ConnectTimeout of each address, default to 30 seconds
+	ConnectTimeout time.Duration
+
+	// Dial is used to connect instead of the addresses of the
+	// mail exchanger, source IPs and family preference are not
+	// applied
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Send deliver the message to every recipient and report the result
+// of each of them. recipients are grouped by domain and delivered in
+// a single transaction per domain
+func (cl *Client) Send(ctx context.Context, envl *Envelope, data []byte) []*DeliveryResult {
+	var domains []string
+	byDomain := make(map[string][]string)
+	for _, rcpt := range envl.RecipientAddress {
+		d := strings.ToLower(domainOf(rcpt))
+		if _, ok := byDomain[d]; !ok {
+			domains = append(domains, d)
+		}
+		byDomain[d] = append(byDomain[d], rcpt)
+	}
+
+	var results []*DeliveryResult
+	for _, d := range domains {
+		results = append(results, cl.sendDomain(ctx, envl, d, byDomain[d], data)...)
+	}
+	return results
+}
+
+// failAll return the same result for every recipient
+func failAll(rcpts []string, err error) []*DeliveryResult {
+	results := make([]*DeliveryResult, len(rcpts))
+	for i, rcpt := range rcpts {
+		results[i] = &DeliveryResult{Recipient: rcpt, Err: err}
+	}
+	return results
+}
+
+// resolver return Resolver or net.DefaultResolver
+func (cl *Client) resolver() Resolver {
+	if cl.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return cl.Resolver
+}
+
+// port return Port or "25"
+func (cl *Client) port() string {
+	if cl.Port == "" {
+		return "25"
+	}
+	return cl.Port
+}
+
+// timeout return the transaction timeout of recipient domain
+func (cl *Client) timeout(domain string) time.Duration {
+	if d, ok := cl.DomainTimeouts[domain]; ok && d > 0 {
+		return d
+	}
+	return durationOr(cl.Timeout, defaultClientTimeout)
+}
+
+// families split addresses into the preferred and the other family
+func (cl *Client) families(addrs []string) (primary, fallback []string) {
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			continue
+		}
+		if (ip.To4() != nil) == (cl.Prefer == PreferIPv4) {
+			primary = append(primary, a)
+		} else {
+			fallback = append(fallback, a)
+		}
+	}
+	return primary, fallback
+}
+
+// dialSerial try addresses one by one from the source IP of their family
+func (cl *Client) dialSerial(ctx context.Context, addrs []string, port string) (net.Conn, error) {
+	var err error
+	for _, a := range addrs {
+		d := &net.Dialer{Timeout: durationOr(cl.ConnectTimeout, defaultConnectTimeout)}
+		source := cl.SourceIPv6
+		if net.ParseIP(a).To4() != nil {
+			source = cl.SourceIPv4
+		}
+		if source != nil {
+			d.LocalAddr = &net.TCPAddr{IP: source}
+		}
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, "tcp", net.JoinHostPort(a, port)); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// dialHost connect to host, the preferred family first and the other
+// one in parallel after FallbackDelay or when the preferred fail
+// (Happy Eyeballs, RFC 8305)
+func (cl *Client) dialHost(ctx context.Context, host, port string) (net.Conn, error) {
+	if cl.Dial != nil {
+		return cl.Dial(ctx, "tcp", net.JoinHostPort(host, port))
+	}
+	addrs, err := cl.resolver().LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	primary, fallback := cl.families(addrs)
+	if len(primary) == 0 || len(fallback) == 0 {
+		return cl.dialSerial(ctx, append(primary, fallback...), port)
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, 2)
+	race := func(addrs []string) {
+		conn, err := cl.dialSerial(ctx, addrs, port)
+		results <- dialResult{conn, err}
+	}
+	go race(primary)
+	timer := time.NewTimer(durationOr(cl.FallbackDelay, defaultFallbackDelay))
+	defer timer.Stop()
+
+	started, pending := false, 1
+	var firstErr error
+	for pending > 0 || !started {
+		select {
+		case <-timer.C:
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// the loser is closed when it connect later
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+		}
+		if !started {
+			started = true
+			pending++
+			go race(fallback)
+		}
+	}
+	return nil, firstErr
+}
+
+// tlsPolicy is the TLS requirement of a mail exchanger
+type tlsPolicy struct {
+	domain string
+	// sts is the MTA-STS policy in enforce or testing mode
+	sts  *STSPolicy
+	tlsa []TLSA
+}
+
+// report pass failure to TLSReport
+func (cl *Client) report(domain, host, policy string, err error) {
+	if cl.TLSReport != nil {
+		cl.TLSReport(TLSFailure{Domain: domain, Host: host, Policy: policy, Err: err})
+	}
+}
+
+// stsPolicy return the enforced or tested MTA-STS policy of domain
+func (cl *Client) stsPolicy(ctx context.Context, domain string) *STSPolicy {
+	if cl.MTASTS == nil {
+		return nil
+	}
+	p, err := cl.MTASTS.Policy(ctx, domain)
+	if err != nil {
+		cl.report(domain, "", TLSPolicySTS, err)
+	}
+	if p == nil || p.Mode == STSNone {
+		return nil
+	}
+	return p
+}
+
+// exchangers return mail exchangers of domain ordered by preference.
+// domain without MX record is its own exchanger (RFC 5321 section 5.1)
+func (cl *Client) exchangers(ctx context.Context, domain string) ([]string, error) {
+	mxs, err := cl.resolver().LookupMX(ctx, domain)
+	if err != nil {
+		if de, ok := err.(*net.DNSError); ok && de.IsNotFound {
+			return []string{domain}, nil
+		}
+		return nil, err
+	}
+	if len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, nullMXErr
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	hosts := make([]string, len(mxs))
+	for i, mx := range mxs {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return hosts, nil
+}
+
+// sendDomain deliver to recipients of a single domain, trying each
+// mail exchanger until one of them accept the transaction
+func (cl *Client) sendDomain(ctx context.Context, envl *Envelope, domain string, rcpts []string, data []byte) []*DeliveryResult {
+	hosts, err := cl.exchangers(ctx, ToASCII(domain))
+	if err != nil {
+		return failAll(rcpts, err)
+	}
+
+	sts := cl.stsPolicy(ctx, domain)
+	for _, host := range hosts {
+		policy := tlsPolicy{domain: domain, sts: sts}
+		if sts != nil && !sts.Match(host) {
+			cl.report(domain, host, TLSPolicySTS, errors.New("mta-sts: mail exchanger not listed in policy"))
+			if sts.Mode == STSEnforce {
+				err = stsErr
+				continue
+			}
+		}
+		if cl.DANE != nil {
+			var terr error
+			if policy.tlsa, terr = tlsaRecords(ctx, cl.DANE, host, cl.port()); terr != nil {
+				// TLSA records can't be known, so neither can the
+				// security of the host (RFC 7672 section 2.2)
+				cl.report(domain, host, TLSPolicyTLSA, terr)
+				err = daneErr
+				continue
+			}
+		}
+
+		var results []*DeliveryResult
+		results, err = cl.sendHost(ctx, host, cl.timeout(domain), policy, envl, rcpts, data)
+		if err == nil {
+			return results
+		}
+	}
+	return failAll(rcpts, err)
+}
+
+// sendHost run a single transaction with host. the returned error
+// is a temporary failure of the whole transaction, the next mail
+// exchanger should be tried
+func (cl *Client) sendHost(ctx context.Context, host string, timeout time.Duration, policy tlsPolicy, envl *Envelope, rcpts []string, data []byte) ([]*DeliveryResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := cl.dialHost(ctx, host, cl.port())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return nil, clientErr(err)
+	}
+	defer c.Close()
+
+	hostname := cl.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	if err := c.Hello(hostname); err != nil {
+		return nil, clientErr(err)
+	}
+
+	config := &tls.Config{}
+	if cl.TLSConfig != nil {
+		config = cl.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	// the error of failed policy, nil when TLS is opportunistic
+	var policyType string
+	var policyErr error
+	switch {
+	case len(policy.tlsa) > 0:
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyTLSA(policy.tlsa, cs, host)
+		}
+		policyType, policyErr = TLSPolicyTLSA, daneErr
+	case policy.sts != nil:
+		policyType = TLSPolicySTS
+		if policy.sts.Mode == STSEnforce {
+			policyErr = stsErr
+		}
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(config); err != nil {
+			if policyType != "" {
+				cl.report(policy.domain, host, policyType, err)
+			}
+			if policyErr != nil {
+				return nil, policyErr
+			}
+			return nil, clientErr(err)
+		}
+	} else {
+		if policyType != "" {
+			cl.report(policy.domain, host, policyType, errNoTLS)
+		}
+		if policyErr != nil {
+			return nil, policyErr
+		}
+		if cl.RequireTLS {
+			return nil, errNoTLS
+		}
+	}
+
+	results, err := transaction(c, envl, rcpts, data)
+	if err == nil {
+		c.Quit()
+	}
+	return results, err
+}
+
+// transaction run a mail transaction on the greeted client c. the
+// returned error is a temporary failure of the whole transaction
+func transaction(c *smtp.Client, envl *Envelope, rcpts []string, data []byte) ([]*DeliveryResult, error) {
+	// downgrade to ASCII domains when the server doesn't support
+	// SMTPUTF8, UTF-8 local part can't be delivered (RFC 6531)
+	utf8, _ := c.Extension("SMTPUTF8")
+	from := envl.OriginatorAddress
+	if !utf8 {
+		var ok bool
+		if from, ok = asciiAddress(from); !ok {
+			return failAll(rcpts, utf8RequiredErr), nil
+		}
+	}
+	results := make([]*DeliveryResult, len(rcpts))
+	addrs := make([]string, len(rcpts))
+	for i, rcpt := range rcpts {
+		results[i] = &DeliveryResult{Recipient: rcpt}
+		addrs[i] = rcpt
+		if !utf8 {
+			var ok bool
+			if addrs[i], ok = asciiAddress(rcpt); !ok {
+				results[i].Err = utf8RequiredErr
+			}
+		}
+	}
+
+	if err := textCmd(c, 25, "MAIL FROM:<%s>%s", from, mailParams(c, envl)); err != nil {
+		err = clientErr(err)
+		if isPermanent(err) {
+			return failAll(rcpts, err), nil
+		}
+		return nil, err
+	}
+
+	var accepted []*DeliveryResult
+	for i, r := range results {
+		if r.Err != nil {
+			continue
+		}
+		if err := textCmd(c, 25, "RCPT TO:<%s>%s", addrs[i], rcptParams(c, envl, r.Recipient)); err != nil {
+			r.Err = clientErr(err)
+		} else {
+			accepted = append(accepted, r)
+		}
+	}
+	if len(accepted) == 0 {
+		return results, nil
+	}
+
+	w, err := c.Data()
+	if err == nil {
+		_, err = w.Write(data)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		err = clientErr(err)
+		for _, r := range accepted {
+			r.Err = err
+		}
+	}
+	return results, nil
+}
+
+// textCmd send a command and read its reply, it is used instead of
+// smtp.Client methods to pass ESMTP parameters
+func textCmd(c *smtp.Client, expectCode int, format string, args ...interface{}) error {
+	id, err := c.Text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(expectCode)
+	return err
+}
+
+// mailParams return ESMTP parameters of MAIL command supported
+// by the server
+func mailParams(c *smtp.Client, envl *Envelope) string {
+	var params []string
+	if ok, _ := c.Extension("8BITMIME"); ok && envl.Body == Body8BitMIME {
+		params = append(params, "BODY=8BITMIME")
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok && envl.SMTPUTF8 {
+		params = append(params, "SMTPUTF8")
+	}
+	if ok, _ := c.Extension("DSN"); ok {
+		if envl.DSNRet != "" {
+			params = append(params, "RET="+envl.DSNRet)
+		}
+		if envl.DSNEnvID != "" {
+			params = append(params, "ENVID="+encodeXtext(envl.DSNEnvID))
+		}
+	}
+	if len(params) == 0 {
+		return ""
+	}
+	return " " + strings.Join(params, " ")
+}
+
+// rcptParams return DSN parameters of RCPT command when the
+// server support DSN
+func rcptParams(c *smtp.Client, envl *Envelope, rcpt string) string {
+	dsn := envl.DSNRcpt[rcpt]
+	if ok, _ := c.Extension("DSN"); !ok || dsn == nil {
+		return ""
+	}
+	var params []string
+	if len(dsn.Notify) > 0 {
+		params = append(params, "NOTIFY="+strings.Join(dsn.Notify, ","))
+	}
+	if dsn.ORCPT != "" {
+		params = append(params, "ORCPT="+encodeXtext(dsn.ORCPT))
+	}
+	if len(params) == 0 {
+		return ""
+	}
+	return " " + strings.Join(params, " ")
+}
+
+// isPermanent report whether err is 5yz reply
+func isPermanent(err error) bool {
+	e, ok := err.(*SMTPError)
+	return ok && e.Code >= 500
+}
+
+// parseEnhanced parse enhanced status code like "5.1.1"
+func parseEnhanced(s string) ([3]int, bool) {
+	var enhanced [3]int
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return enhanced, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return [3]int{}, false
+		}
+		enhanced[i] = n
+	}
+	return enhanced, true
+}
+
+// clientErr convert reply of remote server into SMTPError,
+// other errors are returned as is
+func clientErr(err error) error {
+	te, ok := err.(*textproto.Error)
+	if !ok {
+		return err
+	}
+
+	lines := strings.Split(te.Msg, "\n")
+	prefix, _, _ := strings.Cut(lines[0], " ")
+	enhanced, ok := parseEnhanced(prefix)
+	if ok {
+		for i, l := range lines {
+			lines[i] = strings.TrimPrefix(l, prefix+" ")
+		}
+	}
+	return NewSMTPError(te.Code, enhanced, lines...)
+}
@@ -0,0 +1,248 @@
+package session
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientErr(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected string
+	}{
+		{&textproto.Error{Code: 550, Msg: "5.1.1 Unknown user"}, "550 5.1.1 Unknown user"},
+		{&textproto.Error{Code: 451, Msg: "4.3.0 Try again\n4.3.0 later"}, "451-4.3.0 Try again\r\n451 4.3.0 later"},
+		{&textproto.Error{Code: 554, Msg: "Rejected"}, "554 Rejected"},
+		{errors.New("connection refused"), "connection refused"},
+	}
+
+	for _, input := range cases {
+		got := clientErr(input.err).Error()
+		if got != input.expected {
+			t.Errorf("got: %q, expected: %q", got, input.expected)
+		}
+	}
+}
+
+// TestClientSend make sure that recipients are delivered through
+// the available mail exchanger and each of them get its own result
+func TestClientSend(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []string
+	var rejectData bool
+	srv := NewServer(&Config{
+		Overloaded: func() bool { return true },
+		Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			if rejectData {
+				return NewSMTPError(554, [3]int{5, 6, 0}, "Content rejected")
+			}
+			received = append(received, envl.RecipientAddress...)
+			return nil
+		}),
+	})
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+
+	resolver := &fakeResolver{mxs: map[string][]*net.MX{
+		"domain.com": {{Host: "mx2.domain.com.", Pref: 20}, {Host: "mx1.domain.com.", Pref: 10}},
+		"null.com":   {{Host: ".", Pref: 0}},
+	}}
+	var dialed []string
+	cl := &Client{
+		Hostname: "relay.example.com",
+		Resolver: resolver,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			if strings.HasPrefix(addr, "mx1.") {
+				return nil, errors.New("connection refused")
+			}
+			return net.Dial(network, l.Addr().String())
+		},
+	}
+
+	envl := &Envelope{
+		OriginatorAddress: "some@example.com",
+		RecipientAddress:  []string{"abuse@domain.com", "some@domain.com", "some@null.com"},
+	}
+	results := cl.Send(context.Background(), envl, []byte("Subject: test\r\n\r\nbody\r\n"))
+
+	expected := map[string]string{
+		"abuse@domain.com": "",
+		"some@domain.com":  "452 4.3.1",
+		"some@null.com":    "556 5.1.10",
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("got %d results, expected %d", len(results), len(expected))
+	}
+	for _, r := range results {
+		e := expected[r.Recipient]
+		if (r.Err == nil) != (e == "") || (r.Err != nil && !strings.HasPrefix(r.Err.Error(), e)) {
+			t.Errorf("got %s: %v, expected %q", r.Recipient, r.Err, e)
+		}
+	}
+	if strings.Join(dialed, ",") != "mx1.domain.com:25,mx2.domain.com:25" {
+		t.Errorf("got dialed %v, expected mx1 before mx2", dialed)
+	}
+	if strings.Join(received, ",") != "abuse@domain.com" {
+		t.Errorf("got received %v, expected abuse@domain.com", received)
+	}
+
+	rejectData = true
+	results = cl.Send(context.Background(), &Envelope{
+		OriginatorAddress: "some@example.com",
+		RecipientAddress:  []string{"postmaster@domain.com"},
+	}, []byte("Subject: test\r\n\r\nbody\r\n"))
+	if len(results) != 1 || !results[0].Permanent() {
+		t.Errorf("got %v, expected permanent failure after DATA", results[0].Err)
+	}
+}
+
+// TestClientDialHost make sure that the other address family is tried
+// when the preferred one fail and that the source IP is bound
+func TestClientDialHost(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	remotes := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			remotes <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	resolver := &fakeResolver{hosts: map[string][]string{
+		"mx.domain.com": {"::1", "127.0.0.1"},
+		"v6.domain.com": {"::1"},
+	}}
+	for _, prefer := range []string{PreferIPv6, PreferIPv4} {
+		cl := &Client{
+			Resolver:      resolver,
+			Prefer:        prefer,
+			SourceIPv4:    net.ParseIP("127.0.0.1"),
+			FallbackDelay: time.Minute,
+		}
+		conn, err := cl.dialHost(context.Background(), "mx.domain.com", port)
+		if err != nil {
+			t.Fatalf("prefer %s: %v", prefer, err)
+		}
+		conn.Close()
+		if got := <-remotes; got != "127.0.0.1" {
+			t.Errorf("prefer %s: got source %s, expected 127.0.0.1", prefer, got)
+		}
+	}
+
+	cl := &Client{Resolver: resolver, Prefer: PreferIPv4}
+	if _, err := cl.dialHost(context.Background(), "v6.domain.com", port); err == nil {
+		t.Error("expected error without listener on ::1")
+	}
+}
+
+// TestClientTimeout make sure that domain timeouts override Timeout
+func TestClientTimeout(t *testing.T) {
+	cl := &Client{
+		Timeout:        time.Minute,
+		DomainTimeouts: map[string]time.Duration{"slow.com": 20 * time.Minute},
+	}
+	if got := cl.timeout("slow.com"); got != 20*time.Minute {
+		t.Errorf("got %v, expected 20m for slow.com", got)
+	}
+	if got := cl.timeout("domain.com"); got != time.Minute {
+		t.Errorf("got %v, expected 1m for domain.com", got)
+	}
+	if got := (&Client{}).timeout("domain.com"); got != defaultClientTimeout {
+		t.Errorf("got %v, expected default", got)
+	}
+}
+
+// TestClientTLSPolicy make sure that MTA-STS restrict mail exchangers
+// and DANE require STARTTLS with a matching certificate
+func TestClientTLSPolicy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := testTLSConfig(t)
+	srv := NewServer(&Config{
+		TLSConfig: tlsConfig,
+		Backend:   BackendFunc(func(envl *Envelope, data []byte) error { return nil }),
+	})
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+	leaf, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+
+	var failures []TLSFailure
+	cl := &Client{
+		Resolver: &fakeResolver{mxs: map[string][]*net.MX{
+			"domain.com": {{Host: "mx.domain.com.", Pref: 10}},
+		}},
+		MTASTS: &MTASTS{},
+		DANE: fakeTLSAResolver{
+			"_25._tcp.mx.domain.com": {{TLSADANEEE, 1, 1, sum[:]}},
+		},
+		TLSReport: func(f TLSFailure) { failures = append(failures, f) },
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, l.Addr().String())
+		},
+	}
+	send := func() error {
+		results := cl.Send(context.Background(), &Envelope{
+			OriginatorAddress: "some@example.com",
+			RecipientAddress:  []string{"some@domain.com"},
+		}, []byte("Subject: test\r\n\r\nbody\r\n"))
+		return results[0].Err
+	}
+
+	// the self-signed certificate is authenticated by DANE-EE
+	if err := send(); err != nil {
+		t.Errorf("got %v, expected delivery", err)
+	}
+	cl.DANE = fakeTLSAResolver{"_25._tcp.mx.domain.com": {{TLSADANEEE, 1, 1, make([]byte, 32)}}}
+	if err := send(); err != daneErr {
+		t.Errorf("got %v, expected DANE failure", err)
+	}
+	if len(failures) != 1 || failures[0].Policy != TLSPolicyTLSA || failures[0].Host != "mx.domain.com" {
+		t.Errorf("got failures %+v, expected tlsa of mx.domain.com", failures)
+	}
+
+	// mail exchangers not listed by an enforced policy are skipped
+	cl.DANE = nil
+	cl.MTASTS.init()
+	cl.MTASTS.cache["domain.com"] = &STSPolicy{
+		Mode:    STSEnforce,
+		MX:      []string{"mx2.domain.com"},
+		expires: time.Now().Add(time.Hour),
+	}
+	failures = nil
+	if err := send(); err != stsErr {
+		t.Errorf("got %v, expected MTA-STS failure", err)
+	}
+	if len(failures) != 1 || failures[0].Policy != TLSPolicySTS {
+		t.Errorf("got failures %+v, expected sts", failures)
+	}
+	cl.MTASTS.cache["domain.com"].Mode = STSTesting
+	if err := send(); err == nil || err == stsErr {
+		t.Errorf("got %v, expected certificate error in testing mode", err)
+	}
+}
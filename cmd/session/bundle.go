@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pyk/session"
+)
+
+// bundle run subcommands of signed configuration bundles
+func bundle(cmd string, args []string) error {
+	fs := flag.NewFlagSet("bundle "+cmd, flag.ExitOnError)
+	keyPath := fs.String("key", "operator.key", "private key file")
+	pubPath := fs.String("pub", "operator.pub", "public key file")
+	in := fs.String("in", "", "input file")
+	out := fs.String("out", "", "output file, default to stdout")
+	fs.Parse(args)
+
+	switch cmd {
+	case "keygen":
+		return keygen(*keyPath, *pubPath)
+	case "sign":
+		return sign(*keyPath, *in, *out)
+	case "verify":
+		return verify(*pubPath, *in)
+	}
+	return fmt.Errorf("unknown bundle command %q", cmd)
+}
+
+// keygen write a new Ed25519 key pair as PEM files
+func keygen(keyPath, pubPath string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	der, err = x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	fmt.Println("key id", session.BundleKeyID(pub))
+	return nil
+}
+
+// sign write the signed bundle of the input file
+func sign(keyPath, in, out string) error {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	key, err := session.ParseBundlePrivateKey(data)
+	if err != nil {
+		return err
+	}
+	payload, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	b, err := session.SignBundle(key, payload, time.Now())
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(out, b, 0644)
+}
+
+// verify check the signature of the bundle
+func verify(pubPath, in string) error {
+	data, err := os.ReadFile(pubPath)
+	if err != nil {
+		return err
+	}
+	pub, err := session.ParseBundlePublicKey(data)
+	if err != nil {
+		return err
+	}
+	data, err = os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	b, err := session.OpenBundle(data, []ed25519.PublicKey{pub})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("valid bundle signed by %s at %s\n", b.KeyID, b.Created.Format(time.RFC3339))
+	return nil
+}
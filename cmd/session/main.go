@@ -0,0 +1,47 @@
+// Command session is the command line tool of the session package.
+//
+// Usage:
+//
+//	session serve -config /etc/session/session.conf
+//	session bundle keygen -key operator.key -pub operator.pub
+//	session bundle sign -key operator.key -in config -out config.bundle
+//	session bundle verify -pub operator.pub -in config.bundle
+//	session replay -dir recordings -baseline host:25 -candidate host:2525
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: session serve [flags]")
+	fmt.Fprintln(os.Stderr, "       session bundle keygen|sign|verify [flags]")
+	fmt.Fprintln(os.Stderr, "       session replay [flags]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "serve":
+		err = serve(os.Args[2:])
+	case "bundle":
+		if len(os.Args) < 3 {
+			usage()
+		}
+		err = bundle(os.Args[2], os.Args[3:])
+	case "replay":
+		err = replay(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "session:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/pyk/session"
+)
+
+// replay feed recorded sessions to two running servers and print
+// the replies that differ
+func replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory of recordings")
+	baseline := fs.String("baseline", "", "address of the current server")
+	candidate := fs.String("candidate", "", "address of the new build")
+	fs.Parse(args)
+	if *dir == "" || *baseline == "" || *candidate == "" {
+		return errors.New("replay: -dir, -baseline and -candidate are required")
+	}
+
+	recs, err := session.ReadRecordings(*dir)
+	if err != nil {
+		return err
+	}
+	r := &session.Replayer{
+		Baseline:  &session.AddrTarget{Addr: *baseline},
+		Candidate: &session.AddrTarget{Addr: *candidate},
+	}
+	diffs, err := r.Replay(context.Background(), recs)
+	if err != nil {
+		return err
+	}
+	for _, d := range diffs {
+		fmt.Printf("%s reply %d: %q => %q\n", d.ID, d.Index, d.Baseline, d.Candidate)
+	}
+	fmt.Printf("%d sessions replayed, %d replies differ\n", len(recs), len(diffs))
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pyk/session"
+)
+
+// serve run the server of the configuration file until SIGINT or
+// SIGTERM, which shut it down gracefully. SIGHUP and changes of the
+// file reload it
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	path := fs.String("config", "/etc/session/session.conf", "configuration file")
+	check := fs.Bool("check", false, "check the configuration file and exit")
+	level := fs.String("log-level", "info", "log level: debug, info, warn or error")
+	logPath := fs.String("log", "", "log file, default to stderr")
+	grace := fs.Duration("grace", 30*time.Second, "timeout of graceful shutdown")
+	fs.Parse(args)
+
+	w := os.Stderr
+	if *logPath != "" {
+		f, err := os.OpenFile(*logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+		log.SetOutput(f)
+	}
+	logger := session.NewLogger(w)
+	lv, err := session.ParseLevel(*level)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(lv)
+
+	l, err := session.OpenConfig(*path, &session.Config{Logger: logger})
+	if err != nil {
+		return err
+	}
+	if *check {
+		fmt.Println(*path, "ok")
+		return nil
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go l.Watch(ctx)
+	errc := make(chan error, 1)
+	go func() { errc <- l.ListenAndServe() }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	// a second signal kill the process without waiting
+	stop()
+	log.Println("serve: shutting down")
+	sctx, cancel := context.WithTimeout(context.Background(), *grace)
+	defer cancel()
+	err = l.Server.Shutdown(sctx)
+	if serr := <-errc; !errors.Is(serr, session.ErrServerClosed) && err == nil {
+		err = serr
+	}
+	return err
+}
@@ -0,0 +1,331 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// CommandRequest is a command line received from the client
+type CommandRequest struct {
+	// Verb is the upper cased verb like "XCLIENT" or "MAIL FROM:"
+	Verb string
+	// Arg is the rest of the line without <CRLF>
+	Arg string
+
+	line command
+}
+
+// CommandHandler run a command and send its reply. the returned
+// error is an I/O error and close the session, command failures
+// are replies
+type CommandHandler func(s *Session, req *CommandRequest) error
+
+// Command is a verb in the command registry
+type Command struct {
+	Verb string
+	// States is where the command is allowed, nil allow the
+	// command in every state. ignored for built-in verbs which
+	// follow the transition table
+	States []State
+	// Validate check the arguments before Handle is called, the
+	// error is sent as reply. optional
+	Validate func(s *Session, req *CommandRequest) error
+	Handle   CommandHandler
+}
+
+var (
+	commandsMu sync.RWMutex
+	commands   = make(map[string]*Command)
+)
+
+// RegisterCommand add a custom verb like XCLIENT or XDEBUG into the
+// command registry, it panics when the verb is already registered
+func RegisterCommand(cmd Command) {
+	if cmd.Verb == "" || cmd.Handle == nil {
+		panic("session: RegisterCommand without verb or handler")
+	}
+
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	if _, dup := commands[cmd.Verb]; dup {
+		panic("session: RegisterCommand called twice for " + cmd.Verb)
+	}
+	commands[cmd.Verb] = &cmd
+}
+
+// Commands return the registered verbs
+func Commands() []string {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+	verbs := make([]string, 0, len(commands))
+	for verb := range commands {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+	return verbs
+}
+
+// lookupCommand return the registered command of verb
+func lookupCommand(verb string) *Command {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+	return commands[verb]
+}
+
+// newCommandRequest return the request of command line
+func newCommandRequest(c command) *CommandRequest {
+	return &CommandRequest{Verb: c.Verb(), Arg: c.Arg(), line: c}
+}
+
+// allowed check whether the command is allowed in the current state
+func (s *Session) allowed(verb string, cmd *Command) error {
+	st := s.State()
+	if knownVerbs[verb] || cmd == nil || cmd.States == nil {
+		_, err := st.next(verb)
+		return err
+	}
+	for _, allowed := range cmd.States {
+		if allowed == st {
+			return nil
+		}
+	}
+	if st == StateGreeting {
+		return ehloFirstErr
+	}
+	return badSeqErr
+}
+
+// Envelope return the envelope of current mail transaction
+func (s *Session) Envelope() *Envelope {
+	return s.envl
+}
+
+// reset abort the mail transaction and start a new one
+func (s *Session) reset() {
+	if s.envl != nil {
+		s.endTransaction()
+	}
+	s.envl, s.chunks, s.xforward = NewEnvelope(), nil, nil
+}
+
+// validator adapt a syntax check of command into Validate
+func validator(valid func(c command) (bool, error)) func(s *Session, req *CommandRequest) error {
+	return func(s *Session, req *CommandRequest) error {
+		_, err := valid(req.line)
+		return err
+	}
+}
+
+func init() {
+	for _, cmd := range []Command{
+		{Verb: "HELO", Validate: validator(command.ValidHello), Handle: (*Session).cmdHelo},
+		{Verb: "EHLO", Validate: validator(command.ValidHello), Handle: (*Session).cmdEhlo},
+		{Verb: "MAIL FROM:", Validate: validator(command.ValidMail), Handle: (*Session).cmdMail},
+		{Verb: "RCPT TO:", Validate: validator(command.ValidRcpt), Handle: (*Session).cmdRcpt},
+		{Verb: "DATA", Validate: validator(command.ValidData), Handle: (*Session).cmdData},
+		{Verb: "BDAT", Handle: (*Session).cmdBdat},
+		{Verb: "AUTH", Validate: validAuth, Handle: (*Session).cmdAuth},
+		{Verb: "RSET", Handle: (*Session).cmdRset},
+		{Verb: "QUIT", Validate: validator(command.ValidQuit), Handle: (*Session).cmdQuit},
+		{Verb: "NOOP", Handle: (*Session).cmdIgnore},
+		{Verb: "EXPN", Handle: (*Session).cmdIgnore},
+		{Verb: "\r\n", Handle: (*Session).cmdIgnore},
+		{Verb: "HELP", Handle: (*Session).cmdHelp},
+		{Verb: "VRFY", Handle: (*Session).cmdVrfy},
+	} {
+		RegisterCommand(cmd)
+	}
+}
+
+// validAuth check that AUTH is enabled
+func validAuth(s *Session, req *CommandRequest) error {
+	if s.Config.Authenticator == nil && !s.externalAllowed() {
+		return badSeqErr
+	}
+	if !s.authAllowed() && !s.externalAllowed() {
+		return encryptRequiredErr
+	}
+	return nil
+}
+
+// queuedReply return the reply to the message id accepted
+func queuedReply(id string) string {
+	return REPLY_250 + ": queued as " + id
+}
+
+// reply send err as reply or reply on success
+func (s *Session) reply(err error, reply string) error {
+	if err != nil {
+		return s.Reply.TransmitErr(err)
+	}
+	return s.Reply.Transmit(reply)
+}
+
+func (s *Session) cmdHelo(req *CommandRequest) error {
+	if err := s.checkHelo(req.Arg); err != nil {
+		return s.Reply.TransmitErr(err)
+	}
+	// HELO and EHLO reset the mail transaction
+	s.HeloName, s.ehlo = req.Arg, false
+	s.abort()
+	s.reset()
+	s.transition(req.Verb)
+	return s.Reply.Transmit(REPLY_250)
+}
+
+func (s *Session) cmdEhlo(req *CommandRequest) error {
+	if err := s.checkHelo(req.Arg); err != nil {
+		return s.Reply.TransmitErr(err)
+	}
+	s.HeloName, s.ehlo = req.Arg, true
+	s.abort()
+	s.reset()
+	s.transition(req.Verb)
+	lines := append([]string{s.Hostname() + " greets " + req.Arg}, s.Extensions()...)
+	return s.Reply.TransmitLines(250, lines)
+}
+
+func (s *Session) cmdMail(req *CommandRequest) error {
+	s.beginTransaction()
+	s.envl.ID = newID()
+	err := s.Mail(req.line, s.envl)
+	if err == nil {
+		s.transition(req.Verb)
+	} else {
+		s.traceError(err)
+		s.endTransaction()
+		s.envl.ctx = nil
+	}
+	return s.reply(err, REPLY_250)
+}
+
+func (s *Session) cmdRcpt(req *CommandRequest) error {
+	err := s.Rcpt(req.line, s.envl)
+	s.recordRcpt(s.envl, err)
+	if err != nil {
+		s.jitter()
+	}
+	if err == nil {
+		s.transition(req.Verb)
+	}
+	return s.reply(err, REPLY_250_RCPT)
+}
+
+func (s *Session) cmdData(req *CommandRequest) error {
+	if err := s.checkDataBody(s.envl, s.chunks != nil); err != nil {
+		return s.Reply.TransmitErr(err)
+	}
+	if err := s.checkOverload(s.envl); err != nil {
+		return s.Reply.TransmitErr(err)
+	}
+	if err := s.Reply.Transmit(REPLY_354); err != nil {
+		return err
+	}
+	s.transition(req.Verb)
+
+	limit, _ := s.messageLimit()
+	r := s.newDataReader(limit)
+	var err error
+	_, span := s.span(s.traceContext(), "smtp.data.read")
+	if sb := s.streamBackend(); sb != nil {
+		err = s.receiveStream(s.envl, sb, r)
+		span.End()
+	} else {
+		var data []byte
+		data, err = io.ReadAll(r)
+		span.SetAttribute("smtp.message_size", r.n)
+		span.End()
+		if err == nil {
+			err = s.receive(s.envl, data)
+		} else if r.connErr == nil && r.truncated {
+			s.finishMessage(s.envl, err)
+		} else if r.connErr == nil {
+			s.countMessage(s.envl, err)
+		}
+	}
+	if r.connErr != nil {
+		return r.connErr
+	}
+
+	// mail transaction completed, start a new one
+	id := s.envl.ID
+	s.reset()
+	s.setState(StateHelloed)
+	if err != nil {
+		return s.Reply.TransmitErr(replyErr(err))
+	}
+	return s.Reply.Transmit(queuedReply(id))
+}
+
+func (s *Session) cmdBdat(req *CommandRequest) error {
+	if s.chunks == nil {
+		s.chunks = &bytes.Buffer{}
+	}
+	last, err := s.readChunk(req.line, s.chunks)
+	if err == priorityTooLargeErr || err == messageTooBigErr {
+		s.finishMessage(s.envl, err)
+	}
+	if err == nil && last {
+		err = s.checkOverload(s.envl)
+	}
+	if err == nil && last {
+		if err = s.scanData(s.chunks.Bytes()); err != nil {
+			s.countMessage(s.envl, err)
+		}
+	}
+	if err == nil && last {
+		err = s.receive(s.envl, s.chunks.Bytes())
+	}
+	reply := queuedReply(s.envl.ID)
+	if !last {
+		reply = fmt.Sprintf("250 2.0.0 %d octets received", s.chunks.Len())
+	}
+
+	// mail transaction completed or failed, start a new one
+	if last || err != nil {
+		s.reset()
+		s.setState(StateHelloed)
+	}
+	if err != nil {
+		return s.Reply.TransmitErr(replyErr(err))
+	}
+	return s.Reply.Transmit(reply)
+}
+
+func (s *Session) cmdAuth(req *CommandRequest) error {
+	return s.reply(s.Auth(req.line), REPLY_235)
+}
+
+func (s *Session) cmdRset(req *CommandRequest) error {
+	s.abort()
+	s.reset()
+	s.transition(req.Verb)
+	s.logf(LevelDebug, "%s", req.Verb)
+	return nil
+}
+
+func (s *Session) cmdQuit(req *CommandRequest) error {
+	s.transition(req.Verb)
+	return s.Reply.Transmit(s.replyText(replyQuit))
+}
+
+func (s *Session) cmdIgnore(req *CommandRequest) error {
+	if req.Verb == "\r\n" {
+		s.logf(LevelDebug, "empty line")
+	} else {
+		s.logf(LevelDebug, "%s", req.Verb)
+	}
+	return nil
+}
+
+func (s *Session) cmdHelp(req *CommandRequest) error {
+	return s.Reply.TransmitLines(214, helpText)
+}
+
+func (s *Session) cmdVrfy(req *CommandRequest) error {
+	reply, err := s.Vrfy(req.line)
+	return s.reply(err, reply)
+}
@@ -0,0 +1,57 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+// unregisterCommand remove verb from the command registry, so tests
+// don't leak their commands into other tests
+func unregisterCommand(verb string) {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	delete(commands, verb)
+}
+
+// TestRegisterCommand make sure that custom verbs are validated, run
+// in their states and can't replace registered verbs
+func TestRegisterCommand(t *testing.T) {
+	RegisterCommand(Command{
+		Verb:   "XDEBUG",
+		States: []State{StateHelloed, StateMail, StateRcpt},
+		Validate: func(s *Session, req *CommandRequest) error {
+			if req.Arg == "" {
+				return invalidCommandArgErr
+			}
+			return nil
+		},
+		Handle: func(s *Session, req *CommandRequest) error {
+			return s.Reply.Transmit("250 2.0.0 debug " + req.Arg + " sender=" + s.Envelope().OriginatorAddress)
+		},
+	})
+	t.Cleanup(func() { unregisterCommand("XDEBUG") })
+
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"XDEBUG on\r\n", "503 5.5.1 HELO/EHLO first"},
+		{"HELO client.com\r\nXDEBUG\r\n", "501 5.5.4"},
+		{"HELO client.com\r\nMAIL FROM:<some@example.com>\r\nXDEBUG addr=IPV6:2001:db8::1\r\n", "250 2.0.0 debug addr=IPV6:2001:db8::1 sender=some@example.com\r\n"},
+		{"HELO client.com\r\nXUNKNOWN\r\n", "503 5.5.1 Invalid command\r\n"},
+	}
+
+	for _, input := range cases {
+		out := runSession(t, &Config{}, input.input+"QUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("%q: got %q, expected %q", input.input, out, input.expected)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering DATA again should panic")
+		}
+	}()
+	RegisterCommand(Command{Verb: "DATA", Handle: func(s *Session, req *CommandRequest) error { return nil }})
+}
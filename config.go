@@ -0,0 +1,324 @@
+package session
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// Config represents optional behaviour of a session. zero value
+// of each field disable the feature
+type Config struct {
+	// Hostname is the name of this server used in replies
+	Hostname string
+
+	// Mode is ModeMTA or ModeMSA. submission (ModeMSA) require
+	// STARTTLS and AUTH before MAIL and add missing Date and
+	// Message-ID header fields
+	Mode Mode
+
+	// SenderOwner restrict MAIL FROM in submission mode to
+	// addresses owned by the authenticated user
+	SenderOwner SenderOwnerFunc
+
+	// SenderAuthorization grant addresses not owned by the user,
+	// e.g. SenderGrants. with SenderOwner, either may permit
+	SenderAuthorization SenderAuthorization
+
+	// AuthorizeHeaderFrom check From: header addresses of
+	// submitted messages like MAIL FROM
+	AuthorizeHeaderFrom bool
+
+	// MaxConnections limit the number of concurrent connections
+	// served by Server
+	MaxConnections int
+
+	// MaxConnectionsPerIP limit the number of concurrent connections
+	// from the same remote IP address
+	MaxConnectionsPerIP int
+
+	// PriorityConnections is the number of connections admitted over
+	// MaxConnections that only accept mail to postmaster and abuse
+	PriorityConnections int
+
+	// PriorityMaxSize limit size of messages accepted during
+	// overload, default to 64 KiB
+	PriorityMaxSize int
+
+	// SessionWorkers is the number of goroutines serving sessions of
+	// listeners, 0 serve each session in a new goroutine. when every
+	// worker is busy new connections receive 421
+	SessionWorkers int
+
+	// Overloaded report backpressure of the system, sessions then
+	// only accept mail to postmaster and abuse
+	Overloaded func() bool
+
+	// Chunking enable BDAT command (RFC 3030) and BINARYMIME
+	Chunking bool
+
+	// Strict7Bit reject messages with 8-bit data when the client
+	// didn't declare BODY=8BITMIME or SMTPUTF8
+	Strict7Bit bool
+
+	// BareEOL is the handling of bare CR and LF in message data,
+	// default to BareEOLNormalize
+	BareEOL BareEOL
+
+	// MaxLineLength is the maximum length of text lines in message
+	// data including <CRLF>, default to 1000. negative disable it
+	MaxLineLength int
+
+	// MaxHeaderSize is the maximum size of message header section,
+	// default to 64 KiB. negative disable it
+	MaxHeaderSize int
+
+	// MaxMessageSize is the maximum size of messages advertised with
+	// SIZE, default to 32 MiB. negative disable it
+	MaxMessageSize int
+
+	// BufferSize is the size of the read and write buffers of each
+	// connection, default to 4096. the buffers are pooled
+	BufferSize int
+
+	// Replies override the greeting, QUIT and shutdown replies
+	Replies *Replies
+
+	// GreetDelay delay the greeting, clients that send anything
+	// before it are rejected with 554 as early talkers
+	GreetDelay time.Duration
+
+	// WarmUp ramp acceptance limits after start
+	WarmUp *WarmUp
+
+	// RateLimits limit connections, messages and recipients
+	// of each client IP and sender domain
+	RateLimits *RateLimits
+
+	// Resolver is used by DNS based checks,
+	// default to net.DefaultResolver
+	Resolver Resolver
+
+	// CheckSPF evaluate SPF of the sender domain on MAIL FROM
+	CheckSPF bool
+
+	// RejectSPFFail reject MAIL FROM with 550 when SPF check fail
+	RejectSPFFail bool
+
+	// VerifyDKIM verify DKIM signatures of received messages
+	VerifyDKIM bool
+
+	// ARC verify ARC chains of received messages and seal
+	// forwarded messages
+	ARC *ARC
+
+	// DMARC evaluate DMARC policy of the From: header domain
+	// after SPF and DKIM
+	DMARC *DMARC
+
+	// AddAuthResults add Authentication-Results header with the
+	// results of SPF and DKIM checks
+	AddAuthResults bool
+
+	// AddReceived add Received header with the client, the
+	// protocol (ESMTPS for TLS sessions) and the recipient
+	AddReceived bool
+
+	// ReverseDNS look up the PTR name of clients at connection
+	// time and reject clients without or with mismatched name
+	ReverseDNS *ReverseDNS
+
+	// Helo check the hostname of HELO and EHLO
+	Helo *HeloPolicy
+
+	// DNSBL reject clients listed on DNS blocklists
+	DNSBL *DNSBL
+
+	// Authenticator enable AUTH command
+	Authenticator Authenticator
+
+	// ReplyJitter delay authentication failures and rejected
+	// recipients by up to ReplyJitter, e.g. 200ms, against timing
+	// analysis of which users exist
+	ReplyJitter time.Duration
+
+	// AuthAllowPlaintext permit AUTH in sessions without TLS,
+	// credentials are then sent in the clear. submission always
+	// require TLS
+	AuthAllowPlaintext bool
+
+	// TLSConfig enable STARTTLS command
+	TLSConfig *tls.Config
+
+	// CertAuthorizer authenticate clients presenting a certificate
+	// verified against TLSConfig.ClientCAs, as an alternative to AUTH
+	CertAuthorizer CertAuthorizer
+
+	// AuthExternal authenticate certificates of CertAuthorizer with
+	// AUTH EXTERNAL instead of at the TLS handshake, EXTERNAL is
+	// advertised to clients presenting a verified certificate
+	AuthExternal bool
+
+	// TLSTerminated treat every session as TLS because a proxy
+	// in front of the server terminate TLS, STARTTLS is then not
+	// advertised
+	TLSTerminated bool
+
+	// ProxyProtocol read PROXY protocol header (version 1 or 2)
+	// at the start of connections. the client address of the
+	// header is the remote address of the session, and the
+	// session is TLS when the SSL TLV report a TLS client
+	ProxyProtocol bool
+
+	// CheckAlignment compare the domain of MAIL FROM with the
+	// domain of From: header after DATA
+	CheckAlignment bool
+
+	// StrictAlignment require exact domain match instead of
+	// same organizational domain
+	StrictAlignment bool
+
+	// TagAlignment add X-Sender-Alignment header into the message
+	TagAlignment bool
+
+	// VRFY answer VRFY command accurately for trusted clients,
+	// everyone else receive 252
+	VRFY *VRFY
+
+	// Budgets limit total latency of external checks of each
+	// stage, checks not finished within the budget tempfail
+	// the command
+	Budgets map[Stage]time.Duration
+
+	// ShutdownTimeouts limit each stage of Server.Shutdown, stages
+	// without timeout are only limited by the context of Shutdown
+	ShutdownTimeouts map[ShutdownStage]time.Duration
+
+	// Filters inspect or rewrite message data before delivery
+	Filters []Filter
+
+	// VirusScanner scan message data while it is received,
+	// infected messages are rejected with the virus name
+	VirusScanner VirusScanner
+
+	// Policies accept or reject the session at each stage
+	Policies []Policy
+
+	// Backend receive accepted messages
+	Backend Backend
+
+	// Bouncer report recipients that Backend failed to deliver
+	// after the message was accepted, see RecipientErrors
+	Bouncer *Bouncer
+
+	// Aliases map alias and virtual recipients to their
+	// destinations at RCPT, RcptChecker only check recipients
+	// that are not aliases
+	Aliases AliasLookup
+
+	// RcptChecker accept or reject each recipient, default to
+	// Backend when it implement RcptChecker
+	RcptChecker RcptChecker
+
+	// Aborter is notified of abandoned mail transactions, default
+	// to Backend when it implement Aborter
+	Aborter Aborter
+
+	// CalendarHandler receive messages that contain calendar
+	// invitations before Backend
+	CalendarHandler CalendarHandler
+
+	// Unsubscribe is List-Unsubscribe template of each bulk
+	// sender tenant, injected into messages of authenticated users
+	Unsubscribe map[string]*UnsubscribeTemplate
+
+	// ReturnPath is the bounce return path of each tenant, the
+	// envelope sender of authenticated clients is rewritten to it
+	ReturnPath map[string]*ReturnPath
+
+	// MergeExpansion expand template messages of authenticated
+	// clients per recipient, see MergeHeader
+	MergeExpansion bool
+
+	// MailboxDedup deliver only one copy of a message to each mailbox
+	MailboxDedup *MailboxDedup
+
+	// ETRN allow clients to flush the queue of their domain
+	ETRN *ETRN
+
+	// ATRN deliver queued mail of customer domains over the
+	// reversed connection of authenticated clients
+	ATRN *ATRN
+
+	// FutureRelease let authenticated clients schedule delivery
+	// with HOLDFOR and HOLDUNTIL, the backend must be a Queue
+	FutureRelease *FutureRelease
+
+	// Quotas reject recipients over their mailbox or domain quota
+	Quotas *Quotas
+
+	// Sieve run per-recipient Sieve scripts before Backend
+	Sieve *Sieve
+
+	// MessageDedup detect messages received more than once
+	MessageDedup *MessageDedup
+
+	// Logger write session logs, without logger only warnings
+	// are written into the standard logger
+	Logger *Logger
+
+	// Metrics count connections and messages
+	Metrics *Metrics
+
+	// OnDisconnect is called when the connection is lost before
+	// QUIT, envl is the partial envelope of the transaction in
+	// progress or nil
+	OnDisconnect func(s *Session, envl *Envelope, err error)
+
+	// Tracer trace each connection, mail transaction, DATA,
+	// delivery and DNS checks. backends continue the trace from
+	// Envelope.Context
+	Tracer Tracer
+
+	// LocalDomains are the domains the server receive mail for.
+	// when set, other recipients are only accepted from
+	// authenticated clients and RelayNetworks. without them
+	// relaying isn't restricted
+	LocalDomains []string
+
+	// RelayNetworks are clients allowed to relay to any domain
+	RelayNetworks *AccessList
+
+	// XForwardClients are upstream MTAs allowed to send the
+	// original client with XFORWARD command
+	XForwardClients *AccessList
+
+	// Metadata accept per-message metadata from authenticated
+	// clients in MAIL parameter or header field
+	Metadata *Metadata
+
+	// Access reject blocklisted clients and senders
+	Access *Access
+
+	// Recorder record input of sessions to be replayed against
+	// a new build with Replayer
+	Recorder *Recorder
+
+	// Reputation track statistics of source IPs and sender
+	// domains, the scores are passed to Policies
+	Reputation *Reputation
+
+	// Tracker record disposition of every message
+	Tracker Tracker
+
+	// Capabilities aggregate the extensions used by each client
+	Capabilities *CapabilityReport
+}
+
+// resolver return the configured resolver or net.DefaultResolver
+func (c *Config) resolver() Resolver {
+	if c.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return c.Resolver
+}
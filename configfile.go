@@ -0,0 +1,570 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// default poll interval of ConfigLoader
+const defaultConfigInterval = 30 * time.Second
+
+// FileConfig is the configuration file read by ConfigLoader. the file
+// is written in a subset of TOML: tables, arrays of tables, strings,
+// integers, booleans and single line arrays, e.g.
+//
+//	hostname = "mx.example.com"
+//
+//	[[listeners]]
+//	addr = ":25"
+//
+//	[[listeners]]
+//	addr = ":465"
+//	tls = true
+//	mode = "msa"
+//
+//	[tls]
+//	cert = "/etc/session/cert.pem"
+//	key = "/etc/session/key.pem"
+//
+//	[limits]
+//	max_connections = 1000
+//
+//	[backend]
+//	type = "maildir"
+//	path = "/var/mail"
+type FileConfig struct {
+	Hostname string `json:"hostname"`
+	// Mode is "mta" (default) or "msa"
+	Mode         string           `json:"mode"`
+	LocalDomains []string         `json:"local_domains"`
+	Listeners    []ListenerConfig `json:"listeners"`
+	TLS          TLSFileConfig    `json:"tls"`
+	Limits       LimitsConfig     `json:"limits"`
+	Auth         AuthConfig       `json:"auth"`
+	Backend      BackendConfig    `json:"backend"`
+	Replies      RepliesConfig    `json:"replies"`
+}
+
+// ListenerConfig is a listening address, with implicit TLS when TLS
+// is set. the other keys override the config of the file for the
+// sessions of the listener, e.g. mode = "msa" on port 587
+type ListenerConfig struct {
+	Addr                string `json:"addr"`
+	TLS                 bool   `json:"tls"`
+	Mode                string `json:"mode"`
+	AuthAllowPlaintext  bool   `json:"auth_allow_plaintext"`
+	MaxConnections      int    `json:"max_connections"`
+	MaxConnectionsPerIP int    `json:"max_connections_per_ip"`
+}
+
+// TLSFileConfig is the PEM certificate and key files, reloaded with
+// the configuration
+type TLSFileConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// LimitsConfig set the limits of Config
+type LimitsConfig struct {
+	MaxConnections      int `json:"max_connections"`
+	MaxConnectionsPerIP int `json:"max_connections_per_ip"`
+	PriorityConnections int `json:"priority_connections"`
+	PriorityMaxSize     int `json:"priority_max_size"`
+	SessionWorkers      int `json:"session_workers"`
+	MaxLineLength       int `json:"max_line_length"`
+	MaxHeaderSize       int `json:"max_header_size"`
+	MaxMessageSize      int `json:"max_message_size"`
+	BufferSize          int `json:"buffer_size"`
+}
+
+// AuthConfig enable AUTH with a UserStore file. AUTH require TLS
+// unless AllowPlaintext
+type AuthConfig struct {
+	Users          string `json:"users"`
+	AllowPlaintext bool   `json:"allow_plaintext"`
+}
+
+// RepliesConfig set Config.Replies, e.g.
+//
+//	[replies]
+//	quit = "221 2.0.0 <host> closing connection"
+type RepliesConfig struct {
+	Greeting     string `json:"greeting"`
+	Quit         string `json:"quit"`
+	Shutdown     string `json:"shutdown"`
+	NotAccepting string `json:"not_accepting"`
+}
+
+// BackendConfig select the backend: "maildir" and "spool" deliver
+// into Path, "webhook" post to URL signed with Secret
+type BackendConfig struct {
+	Type   string `json:"type"`
+	Path   string `json:"path"`
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// ParseConfigFile parse the configuration file, unknown keys are
+// errors so typos are not silently ignored
+func ParseConfigFile(data []byte) (*FileConfig, error) {
+	tree, err := parseTOML(data)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	fc := &FileConfig{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(fc); err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+	return fc, nil
+}
+
+// parseTOML parse the TOML subset of FileConfig into maps
+func parseTOML(data []byte) (map[string]any, error) {
+	root := make(map[string]any)
+	table := root
+	for n, line := range strings.Split(string(data), "\n") {
+		fail := func(format string, args ...any) error {
+			return fmt.Errorf("config: line %d: %s", n+1, fmt.Sprintf(format, args...))
+		}
+		line = strings.TrimSpace(stripComment(line))
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "[["):
+			name := strings.TrimSpace(strings.TrimPrefix(strings.TrimSuffix(line, "]]"), "[["))
+			if !strings.HasSuffix(line, "]]") || !validKey(name) {
+				return nil, fail("invalid table %q", line)
+			}
+			list, ok := root[name].([]any)
+			if _, exists := root[name]; exists && !ok {
+				return nil, fail("%s is not an array of tables", name)
+			}
+			table = make(map[string]any)
+			root[name] = append(list, table)
+			continue
+		case strings.HasPrefix(line, "["):
+			name := strings.TrimSpace(strings.TrimPrefix(strings.TrimSuffix(line, "]"), "["))
+			if !strings.HasSuffix(line, "]") || !validKey(name) {
+				return nil, fail("invalid table %q", line)
+			}
+			if _, exists := root[name]; exists {
+				return nil, fail("duplicate table %s", name)
+			}
+			table = make(map[string]any)
+			root[name] = table
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !validKey(key) {
+			return nil, fail("expected key = value")
+		}
+		if _, exists := table[key]; exists {
+			return nil, fail("duplicate key %s", key)
+		}
+		v, rest, err := parseTOMLValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fail("%s: %v", key, err)
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, fail("%s: unexpected %q", key, rest)
+		}
+		table[key] = v
+	}
+	return root, nil
+}
+
+// stripComment remove the comment outside of strings
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// validKey report whether s is a bare key
+func validKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTOMLValue parse the value at the start of s and return the
+// rest of s
+func parseTOMLValue(s string) (any, string, error) {
+	switch {
+	case s == "":
+		return nil, "", errors.New("missing value")
+	case s[0] == '"':
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				v, err := strconv.Unquote(s[:i+1])
+				return v, s[i+1:], err
+			}
+		}
+		return nil, "", errors.New("unterminated string")
+	case s[0] == '\'':
+		i := strings.IndexByte(s[1:], '\'')
+		if i < 0 {
+			return nil, "", errors.New("unterminated string")
+		}
+		return s[1 : i+1], s[i+2:], nil
+	case s[0] == '[':
+		list := []any{}
+		s = strings.TrimSpace(s[1:])
+		for {
+			if strings.HasPrefix(s, "]") {
+				return list, s[1:], nil
+			}
+			v, rest, err := parseTOMLValue(s)
+			if err != nil {
+				return nil, "", err
+			}
+			list = append(list, v)
+			s = strings.TrimSpace(rest)
+			if strings.HasPrefix(s, ",") {
+				s = strings.TrimSpace(s[1:])
+			} else if !strings.HasPrefix(s, "]") {
+				return nil, "", errors.New("unterminated array")
+			}
+		}
+	}
+
+	end := strings.IndexAny(s, ",] \t")
+	if end < 0 {
+		end = len(s)
+	}
+	word, rest := s[:end], s[end:]
+	switch word {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	n, err := strconv.ParseInt(strings.ReplaceAll(word, "_", ""), 10, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid value %q", word)
+	}
+	return n, rest, nil
+}
+
+// ConfigLoader read the configuration file at Path and apply it to
+// Server. Base hold the settings that can't be written in the file
+// like filters and logger, it is copied into every loaded config.
+// reloading apply to new sessions only, live sessions keep the
+// config they started with. listeners are not changed by reload
+type ConfigLoader struct {
+	Path   string
+	Base   *Config
+	Server *Server
+	// Interval between checks of Watch, default to 30 seconds
+	Interval time.Duration
+
+	mu        sync.Mutex
+	modTime   time.Time
+	listeners []ListenerConfig
+	// served is the Listener of each of listeners once served
+	served []*Listener
+	cert   atomic.Pointer[tls.Certificate]
+}
+
+// OpenConfig load the configuration file at path and create the
+// server of its config
+func OpenConfig(path string, base *Config) (*ConfigLoader, error) {
+	l := &ConfigLoader{Path: path, Base: base}
+	config, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	l.Server = NewServer(config)
+	return l, nil
+}
+
+// Reload read the file again and apply it to new sessions. on error
+// the current config is kept
+func (l *ConfigLoader) Reload() error {
+	config, err := l.load()
+	if err != nil {
+		return err
+	}
+	l.Server.SetConfig(config)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, ln := range l.served {
+		// overrides are checked by load
+		c, _ := listenerConfig(config, l.listeners[i])
+		l.Server.SetListenerConfig(ln, c)
+	}
+	return nil
+}
+
+// load read the file and build its config
+func (l *ConfigLoader) load() (*Config, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fi, err := os.Stat(l.Path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(l.Path)
+	if err != nil {
+		return nil, err
+	}
+	fc, err := ParseConfigFile(data)
+	if err != nil {
+		return nil, err
+	}
+	config, cert, err := l.build(fc)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.listeners != nil && !slices.Equal(l.listeners, fc.Listeners) {
+		l.logf(LevelWarn, "config: listeners changed, restart to apply")
+	} else {
+		l.listeners = fc.Listeners
+	}
+	if cert != nil {
+		l.cert.Store(cert)
+	}
+	l.modTime = fi.ModTime()
+	return config, nil
+}
+
+// build create the config of fc, with the certificate of its TLS
+// files
+func (l *ConfigLoader) build(fc *FileConfig) (*Config, *tls.Certificate, error) {
+	config := &Config{}
+	if l.Base != nil {
+		*config = *l.Base
+	}
+	config.Hostname = fc.Hostname
+	mode, err := parseMode(fc.Mode)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.Mode = mode
+	if fc.LocalDomains != nil {
+		config.LocalDomains = fc.LocalDomains
+	}
+
+	config.MaxConnections = fc.Limits.MaxConnections
+	config.MaxConnectionsPerIP = fc.Limits.MaxConnectionsPerIP
+	config.PriorityConnections = fc.Limits.PriorityConnections
+	config.PriorityMaxSize = fc.Limits.PriorityMaxSize
+	config.SessionWorkers = fc.Limits.SessionWorkers
+	config.MaxLineLength = fc.Limits.MaxLineLength
+	config.MaxHeaderSize = fc.Limits.MaxHeaderSize
+	config.MaxMessageSize = fc.Limits.MaxMessageSize
+	config.BufferSize = fc.Limits.BufferSize
+
+	if fc.Replies != (RepliesConfig{}) {
+		replies := Replies(fc.Replies)
+		if err := replies.Check(); err != nil {
+			return nil, nil, fmt.Errorf("config: %v", err)
+		}
+		config.Replies = &replies
+	}
+
+	var cert *tls.Certificate
+	if fc.TLS.Cert != "" || fc.TLS.Key != "" {
+		c, err := tls.LoadX509KeyPair(fc.TLS.Cert, fc.TLS.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		cert = &c
+		// the certificate is taken on each handshake, so listeners
+		// of implicit TLS get reloaded certificates too
+		config.TLSConfig = &tls.Config{GetCertificate: l.getCertificate}
+		if l.Base != nil && l.Base.TLSConfig != nil {
+			config.TLSConfig = l.Base.TLSConfig.Clone()
+			config.TLSConfig.Certificates = nil
+			config.TLSConfig.GetCertificate = l.getCertificate
+		}
+	}
+
+	if fc.Auth.Users != "" {
+		users, err := OpenUserStore(fc.Auth.Users)
+		if err != nil {
+			return nil, nil, err
+		}
+		users.Logger = config.Logger
+		config.Authenticator = users
+	}
+	config.AuthAllowPlaintext = config.AuthAllowPlaintext || fc.Auth.AllowPlaintext
+
+	switch fc.Backend.Type {
+	case "":
+	case "maildir":
+		config.Backend = &Maildir{Root: fc.Backend.Path}
+	case "spool":
+		config.Backend = &Spool{Dir: fc.Backend.Path}
+	case "webhook":
+		w := &Webhook{URL: fc.Backend.URL}
+		if fc.Backend.Secret != "" {
+			w.Secret = []byte(fc.Backend.Secret)
+		}
+		config.Backend = w
+	default:
+		return nil, nil, fmt.Errorf("config: unknown backend %q", fc.Backend.Type)
+	}
+
+	for _, lc := range fc.Listeners {
+		if _, err := listenerConfig(config, lc); err != nil {
+			return nil, nil, err
+		}
+	}
+	return config, cert, nil
+}
+
+// parseMode parse the mode of the file, "" is ModeMTA
+func parseMode(mode string) (Mode, error) {
+	switch mode {
+	case "", "mta":
+		return ModeMTA, nil
+	case "msa":
+		return ModeMSA, nil
+	}
+	return ModeMTA, fmt.Errorf("config: unknown mode %q", mode)
+}
+
+// listenerConfig return config with the overrides of lc, nil when lc
+// has none and its sessions use the config of the server
+func listenerConfig(config *Config, lc ListenerConfig) (*Config, error) {
+	if lc.Mode == "" && !lc.AuthAllowPlaintext && lc.MaxConnections == 0 && lc.MaxConnectionsPerIP == 0 {
+		return nil, nil
+	}
+	c := *config
+	if lc.Mode != "" {
+		mode, err := parseMode(lc.Mode)
+		if err != nil {
+			return nil, err
+		}
+		c.Mode = mode
+	}
+	c.AuthAllowPlaintext = c.AuthAllowPlaintext || lc.AuthAllowPlaintext
+	if lc.MaxConnections != 0 {
+		c.MaxConnections = lc.MaxConnections
+	}
+	if lc.MaxConnectionsPerIP != 0 {
+		c.MaxConnectionsPerIP = lc.MaxConnectionsPerIP
+	}
+	return &c, nil
+}
+
+// getCertificate return the last loaded certificate
+func (l *ConfigLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := l.cert.Load(); cert != nil {
+		return cert, nil
+	}
+	return nil, errNoCertificate
+}
+
+// ListenAndServe serve the listeners of the file until one of them
+// fail, after Shutdown the returned error is ErrServerClosed
+func (l *ConfigLoader) ListenAndServe() error {
+	config := l.Server.config()
+	l.mu.Lock()
+	if len(l.listeners) == 0 {
+		l.mu.Unlock()
+		return errors.New("config: no listeners")
+	}
+	l.served = make([]*Listener, len(l.listeners))
+	for i, lc := range l.listeners {
+		c, _ := listenerConfig(config, lc)
+		l.served[i] = &Listener{Addr: lc.Addr, TLS: lc.TLS, Config: c}
+	}
+	served := l.served
+	l.mu.Unlock()
+	return l.Server.ListenAndServeListeners(served)
+}
+
+// logf write into the Logger of Server
+func (l *ConfigLoader) logf(level Level, format string, v ...interface{}) {
+	if l.Server != nil {
+		l.Server.logf(level, format, v...)
+		return
+	}
+	logf(nil, level, format, v...)
+}
+
+// modified report whether the file changed since it was loaded
+func (l *ConfigLoader) modified() bool {
+	fi, err := os.Stat(l.Path)
+	if err != nil {
+		l.logf(LevelWarn, "config: %v", err)
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !fi.ModTime().Equal(l.modTime)
+}
+
+// Watch reload the file on SIGHUP and when it is modified, checked
+// every Interval, until ctx is done
+func (l *ConfigLoader) Watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	t := time.NewTicker(durationOr(l.Interval, defaultConfigInterval))
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-t.C:
+			if !l.modified() {
+				continue
+			}
+		}
+		if err := l.Reload(); err != nil {
+			l.logf(LevelWarn, "config: %v", err)
+		} else {
+			l.logf(LevelInfo, "config: reloaded %s", l.Path)
+		}
+	}
+}
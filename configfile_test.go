@@ -0,0 +1,216 @@
+package session
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseConfigFile make sure that the TOML subset is parsed and
+// invalid files are rejected
+func TestParseConfigFile(t *testing.T) {
+	cases := []struct {
+		data     string
+		expected *FileConfig
+		err      string
+	}{
+		{`hostname = "mx.example.com" # comment
+local_domains = ["example.com", 'example.org']
+
+[[listeners]]
+addr = ":25"
+
+[[listeners]]
+addr = ":465"
+tls = true
+
+[limits]
+max_connections = 1_000
+max_connections_per_ip = 10
+
+[backend]
+type = "webhook"
+url = "https://example.com/#hook"
+`, &FileConfig{
+			Hostname:     "mx.example.com",
+			LocalDomains: []string{"example.com", "example.org"},
+			Listeners:    []ListenerConfig{{Addr: ":25"}, {Addr: ":465", TLS: true}},
+			Limits:       LimitsConfig{MaxConnections: 1000, MaxConnectionsPerIP: 10},
+			Backend:      BackendConfig{Type: "webhook", URL: "https://example.com/#hook"},
+		}, ""},
+		{"hostname = \"a\\tb\"", &FileConfig{Hostname: "a\tb"}, ""},
+		{"hostnme = \"x\"", nil, "unknown field"},
+		{"hostname = x", nil, "line 1: hostname: invalid value"},
+		{"hostname = \"x", nil, "unterminated string"},
+		{"[limits]\nmax_connections = 1\nmax_connections = 2", nil, "line 3: duplicate key"},
+		{"[limits]\n[limits]", nil, "duplicate table"},
+		{"[limits", nil, "invalid table"},
+		{"local_domains = [\"a\" \"b\"]", nil, "unterminated array"},
+		{"[limits]\nmax_connections = \"10\"", nil, "cannot unmarshal"},
+	}
+
+	for _, input := range cases {
+		fc, err := ParseConfigFile([]byte(input.data))
+		if input.err != "" {
+			if err == nil || !strings.Contains(err.Error(), input.err) {
+				t.Errorf("%q: got error %v, expected %q", input.data, err, input.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: got error %v", input.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(fc, input.expected) {
+			t.Errorf("%q: got %+v, expected %+v", input.data, fc, input.expected)
+		}
+	}
+}
+
+// writeTestCert write the certificate of testTLSConfig into PEM
+// files and return its DER bytes
+func writeTestCert(t *testing.T, certFile, keyFile string) []byte {
+	cert := testTLSConfig(t).Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	if err == nil {
+		err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Certificate[0]
+}
+
+// TestConfigLoaderReload make sure that reload apply new limits and
+// certificates to new sessions, live sessions keep their config and
+// an invalid file keeps the current config
+func TestConfigLoaderReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "session.toml")
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeTestCert(t, certFile, keyFile)
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tlsFiles := "[tls]\ncert = \"" + certFile + "\"\nkey = \"" + keyFile + "\"\n"
+	write("hostname = \"a.example.com\"\n[limits]\nmax_connections = 1\n" + tlsFiles)
+
+	l, err := OpenConfig(path, &Config{AddReceived: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := l.Server
+	live := srv.config()
+	if live.Hostname != "a.example.com" || live.MaxConnections != 1 || !live.AddReceived {
+		t.Fatalf("got config %+v", live)
+	}
+	cert, err := live.TLSConfig.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil || !reflect.DeepEqual(cert.Certificate[0], first) {
+		t.Fatalf("got certificate error %v", err)
+	}
+
+	second := writeTestCert(t, certFile, keyFile)
+	write("hostname = \"b.example.com\"\n[limits]\nmax_connections = 5\n" + tlsFiles)
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	config := srv.config()
+	if config.Hostname != "b.example.com" || config.MaxConnections != 5 || !config.AddReceived {
+		t.Errorf("got config %+v", config)
+	}
+	if live.Hostname != "a.example.com" {
+		t.Errorf("live config changed to %s", live.Hostname)
+	}
+	// listeners of implicit TLS clone the config of the server
+	// start, they must get the reloaded certificate too
+	cert, _ = live.TLSConfig.Clone().GetCertificate(&tls.ClientHelloInfo{})
+	if !reflect.DeepEqual(cert.Certificate[0], second) {
+		t.Errorf("certificate not reloaded")
+	}
+
+	write("hostname = \"c.example.com\"\n[backend]\ntype = \"tape\"\n")
+	if err := l.Reload(); err == nil || !strings.Contains(err.Error(), "unknown backend") {
+		t.Errorf("got error %v", err)
+	}
+	if srv.config() != config {
+		t.Errorf("invalid file replaced the config")
+	}
+
+	// a modified file is noticed by Watch
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(path, later, later)
+	if !l.modified() {
+		t.Errorf("modified file not noticed")
+	}
+}
+
+// TestConfigLoaderListeners make sure that listeners with overrides
+// get their own config, reloaded with the file
+func TestConfigLoaderListeners(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.toml")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	listeners := "[[listeners]]\naddr = \"127.0.0.1:0\"\n\n[[listeners]]\naddr = \"127.0.0.1:0\"\nauth_allow_plaintext = true\n\n[[listeners]]\naddr = \"127.0.0.1:0\"\nmode = \"msa\"\n"
+	write("hostname = \"a.example.com\"\n" + listeners + "max_connections = 5\n")
+
+	l, err := OpenConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- l.ListenAndServe()
+	}()
+	var mta, msa, internal *Listener
+	for mta == nil {
+		time.Sleep(time.Millisecond)
+		l.mu.Lock()
+		if l.served != nil {
+			mta, internal, msa = l.served[0], l.served[1], l.served[2]
+		}
+		l.mu.Unlock()
+	}
+	if c := l.Server.listenerConfig(mta); c != l.Server.config() {
+		t.Errorf("listener without overrides got its own config %+v", c)
+	}
+	c := l.Server.listenerConfig(msa)
+	if c.Hostname != "a.example.com" || c.Mode != ModeMSA || c.MaxConnections != 5 {
+		t.Errorf("got listener config %+v", c)
+	}
+	if c := l.Server.listenerConfig(internal); !c.AuthAllowPlaintext || l.Server.config().AuthAllowPlaintext {
+		t.Errorf("got plaintext AUTH %v on listener, %v on server", c.AuthAllowPlaintext, l.Server.config().AuthAllowPlaintext)
+	}
+
+	write("hostname = \"b.example.com\"\n" + listeners + "max_connections = 5\n")
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if c := l.Server.listenerConfig(msa); c.Hostname != "b.example.com" || c.Mode != ModeMSA {
+		t.Errorf("got reloaded listener config %+v", c)
+	}
+
+	write(strings.Replace(listeners, `"msa"`, `"lmtp"`, 1))
+	if err := l.Reload(); err == nil || !strings.Contains(err.Error(), "unknown mode") {
+		t.Errorf("got error %v, expected unknown mode", err)
+	}
+
+	l.Server.Shutdown(t.Context())
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("ListenAndServe() == %v, expected %v", err, ErrServerClosed)
+	}
+}
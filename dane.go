@@ -0,0 +1,123 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+)
+
+// TLSA certificate usages usable for SMTP (RFC 7672 section 3.1),
+// PKIX-TA(0) and PKIX-EE(1) are ignored
+const (
+	TLSADANETA = 2
+	TLSADANEEE = 3
+)
+
+// TLSA is a TLSA record (RFC 6698 section 2.1)
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// TLSAResolver look up TLSA records. only records of a zone signed
+// and validated with DNSSEC may be returned, unauthenticated answers
+// must be reported as not found
+type TLSAResolver interface {
+	LookupTLSA(ctx context.Context, name string) ([]TLSA, error)
+}
+
+// errTLSAMismatch is returned when no usable TLSA record match the
+// certificates of the server
+var errTLSAMismatch = errors.New("dane: no TLSA record match the server certificate")
+
+// tlsaRecords return the usable TLSA records of SMTP on host, nil
+// when host has none
+func tlsaRecords(ctx context.Context, r TLSAResolver, host, port string) ([]TLSA, error) {
+	records, err := r.LookupTLSA(ctx, "_"+port+"._tcp."+host)
+	if err != nil {
+		if de, ok := err.(*net.DNSError); ok && de.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var usable []TLSA
+	for _, rr := range records {
+		if rr.Usage == TLSADANETA || rr.Usage == TLSADANEEE {
+			usable = append(usable, rr)
+		}
+	}
+	return usable, nil
+}
+
+// match report whether cert is associated with rr
+func (rr TLSA) match(cert *x509.Certificate) bool {
+	var data []byte
+	switch rr.Selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch rr.MatchingType {
+	case 0:
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(data, rr.Data)
+}
+
+// verifyTLSA check the certificates of cs with records (RFC 7672
+// section 3.1). DANE-EE match the server certificate whatever its
+// name and validity, DANE-TA match a certificate of the chain which
+// must issue a certificate valid for host
+func verifyTLSA(records []TLSA, cs tls.ConnectionState, host string) error {
+	certs := cs.PeerCertificates
+	if len(certs) == 0 {
+		return errTLSAMismatch
+	}
+	for _, rr := range records {
+		if rr.Usage == TLSADANEEE && rr.match(certs[0]) {
+			return nil
+		}
+	}
+	for _, rr := range records {
+		if rr.Usage != TLSADANETA {
+			continue
+		}
+		for _, ta := range certs[1:] {
+			if !rr.match(ta) {
+				continue
+			}
+			roots := x509.NewCertPool()
+			roots.AddCert(ta)
+			intermediates := x509.NewCertPool()
+			for _, c := range certs[1:] {
+				intermediates.AddCert(c)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				DNSName:       host,
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			if err == nil {
+				return nil
+			}
+		}
+	}
+	return errTLSAMismatch
+}
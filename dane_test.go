@@ -0,0 +1,102 @@
+package session
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeTLSAResolver answer TLSA lookups from static records
+type fakeTLSAResolver map[string][]TLSA
+
+func (r fakeTLSAResolver) LookupTLSA(ctx context.Context, name string) ([]TLSA, error) {
+	if records, ok := r[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// testServerCert return a server certificate of host signed by ca
+func testServerCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, host string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// TestVerifyTLSA make sure that DANE-EE match the server certificate
+// and DANE-TA match an issuer of a certificate valid for the host
+func TestVerifyTLSA(t *testing.T) {
+	ca, caKey := testCA(t)
+	leaf := testServerCert(t, ca, caKey, "mx.domain.com")
+	other, _ := testCA(t)
+	spki := func(c *x509.Certificate) []byte {
+		sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+		return sum[:]
+	}
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca}}
+
+	cases := []struct {
+		records []TLSA
+		host    string
+		valid   bool
+	}{
+		{[]TLSA{{TLSADANEEE, 1, 1, spki(leaf)}}, "mx.domain.com", true},
+		{[]TLSA{{TLSADANEEE, 0, 0, leaf.Raw}}, "other.domain.com", true},
+		{[]TLSA{{TLSADANEEE, 1, 1, spki(ca)}}, "mx.domain.com", false},
+		{[]TLSA{{TLSADANETA, 1, 1, spki(ca)}}, "mx.domain.com", true},
+		{[]TLSA{{TLSADANETA, 1, 1, spki(ca)}}, "other.domain.com", false},
+		{[]TLSA{{TLSADANETA, 1, 1, spki(other)}}, "mx.domain.com", false},
+		{[]TLSA{{1, 1, 1, spki(leaf)}}, "mx.domain.com", false},
+		{[]TLSA{{TLSADANEEE, 1, 3, spki(leaf)}, {TLSADANETA, 0, 1, func() []byte {
+			sum := sha256.Sum256(ca.Raw)
+			return sum[:]
+		}()}}, "mx.domain.com", true},
+	}
+	for i, input := range cases {
+		err := verifyTLSA(input.records, cs, input.host)
+		if (err == nil) != input.valid {
+			t.Errorf("%d: got %v, expected valid %v", i, err, input.valid)
+		}
+	}
+}
+
+// TestTLSARecords make sure that only DANE usages are kept
+func TestTLSARecords(t *testing.T) {
+	r := fakeTLSAResolver{"_25._tcp.mx.domain.com": {{0, 1, 1, nil}, {TLSADANEEE, 1, 1, nil}}}
+	records, err := tlsaRecords(context.Background(), r, "mx.domain.com", "25")
+	if err != nil || len(records) != 1 || records[0].Usage != TLSADANEEE {
+		t.Errorf("got %v %v, expected single DANE-EE record", records, err)
+	}
+	records, err = tlsaRecords(context.Background(), r, "mx.other.com", "25")
+	if err != nil || records != nil {
+		t.Errorf("got %v %v, expected no record", records, err)
+	}
+}
@@ -0,0 +1,170 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default dedup window of MailboxDedup
+const defaultDedupWindow = 24 * time.Hour
+
+// MailboxDedup suppress duplicate copies of a message delivered to the
+// same final mailbox, e.g. when aliases expand to the same mailbox via
+// multiple paths. copies are identified by Message-ID and mailbox
+type MailboxDedup struct {
+	// Window is how long a delivered copy is remembered
+	Window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+	last time.Time
+}
+
+func (d *MailboxDedup) window() time.Duration {
+	if d.Window <= 0 {
+		return defaultDedupWindow
+	}
+	return d.Window
+}
+
+func dedupKey(msgID, mailbox string) string {
+	return msgID + "\x00" + strings.ToLower(mailbox)
+}
+
+// Filter split recipients into mailboxes that should receive the
+// message and duplicates. recipients that appear more than once
+// are always duplicate. message without Message-ID is only
+// deduplicated within the recipients
+func (d *MailboxDedup) Filter(msgID string, rcpts []string) (keep, dup []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	in := make(map[string]bool, len(rcpts))
+	for _, rcpt := range rcpts {
+		mailbox := strings.ToLower(rcpt)
+		if in[mailbox] {
+			dup = append(dup, rcpt)
+			continue
+		}
+		in[mailbox] = true
+
+		if msgID != "" {
+			if t, ok := d.seen[dedupKey(msgID, rcpt)]; ok && now.Sub(t) < d.window() {
+				dup = append(dup, rcpt)
+				continue
+			}
+		}
+		keep = append(keep, rcpt)
+	}
+	return keep, dup
+}
+
+// Mark remember the message delivered to mailboxes
+func (d *MailboxDedup) Mark(msgID string, mailboxes []string) {
+	if msgID == "" {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen == nil {
+		d.seen = make(map[string]time.Time)
+	}
+
+	now := time.Now()
+	for _, mailbox := range mailboxes {
+		d.seen[dedupKey(msgID, mailbox)] = now
+	}
+
+	// prune expired entries at most once per window
+	if now.Sub(d.last) > d.window() {
+		for k, t := range d.seen {
+			if now.Sub(t) >= d.window() {
+				delete(d.seen, k)
+			}
+		}
+		d.last = now
+	}
+}
+
+// MessageDedup detect the same message received more than once within
+// the window, e.g. when client retry after the reply to DATA was lost.
+// messages are identified by Message-ID, or by hash of the body when
+// there is no Message-ID, together with sender and recipients
+type MessageDedup struct {
+	// Window is how long a received message is remembered
+	Window time.Duration
+
+	// Hash always identify messages by hash of the body
+	Hash bool
+
+	// Drop accept and discard duplicates without delivery,
+	// otherwise duplicates are delivered with Envelope.Duplicate
+	Drop bool
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+	last time.Time
+}
+
+func (d *MessageDedup) window() time.Duration {
+	if d.Window <= 0 {
+		return defaultDedupWindow
+	}
+	return d.Window
+}
+
+// Key return the identity of the message
+func (d *MessageDedup) Key(envl *Envelope, data []byte) string {
+	id := ""
+	if !d.Hash {
+		id = messageID(data)
+	}
+	if id == "" {
+		_, body := splitMessage(data)
+		sum := sha256.Sum256(body)
+		id = "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	rcpts := make([]string, len(envl.RecipientAddress))
+	for i, rcpt := range envl.RecipientAddress {
+		rcpts[i] = strings.ToLower(rcpt)
+	}
+	sort.Strings(rcpts)
+	return id + "\x00" + strings.ToLower(envl.OriginatorAddress) + "\x00" + strings.Join(rcpts, ",")
+}
+
+// Seen report whether key was marked within the window
+func (d *MessageDedup) Seen(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, ok := d.seen[key]
+	return ok && time.Since(t) < d.window()
+}
+
+// Mark remember the message key
+func (d *MessageDedup) Mark(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen == nil {
+		d.seen = make(map[string]time.Time)
+	}
+
+	now := time.Now()
+	d.seen[key] = now
+
+	// prune expired entries at most once per window
+	if now.Sub(d.last) > d.window() {
+		for k, t := range d.seen {
+			if now.Sub(t) >= d.window() {
+				delete(d.seen, k)
+			}
+		}
+		d.last = now
+	}
+}
@@ -0,0 +1,140 @@
+package session
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestMailboxDedupFilter make sure that duplicate mailboxes are
+// suppressed within the window
+func TestMailboxDedupFilter(t *testing.T) {
+	d := &MailboxDedup{Window: time.Hour}
+	d.Mark("<1@example.com>", []string{"some@domain.com"})
+
+	cases := []struct {
+		msgID     string
+		rcpts     []string
+		keep, dup int
+	}{
+		{"<1@example.com>", []string{"Some@Domain.com", "other@domain.com"}, 1, 1},
+		{"<2@example.com>", []string{"some@domain.com", "other@domain.com"}, 2, 0},
+		{"<2@example.com>", []string{"other@domain.com", "OTHER@domain.com"}, 1, 1},
+		{"", []string{"some@domain.com", "some@domain.com"}, 1, 1},
+	}
+
+	for _, input := range cases {
+		keep, dup := d.Filter(input.msgID, input.rcpts)
+		if len(keep) != input.keep || len(dup) != input.dup {
+			t.Errorf("%q %v: got keep=%v dup=%v, expected %d kept and %d duplicate",
+				input.msgID, input.rcpts, keep, dup, input.keep, input.dup)
+		}
+	}
+
+	expired := &MailboxDedup{Window: time.Nanosecond}
+	expired.Mark("<1@example.com>", []string{"some@domain.com"})
+	time.Sleep(time.Millisecond)
+	if _, dup := expired.Filter("<1@example.com>", []string{"some@domain.com"}); len(dup) != 0 {
+		t.Errorf("expired copy should not be duplicate")
+	}
+}
+
+// TestSessionMailboxDedup make sure that duplicate copies are not
+// delivered and recorded in tracking log
+func TestSessionMailboxDedup(t *testing.T) {
+	var delivered [][]string
+	var events []*TrackingEvent
+	config := &Config{
+		MailboxDedup: &MailboxDedup{},
+		Tracker: TrackerFunc(func(ev *TrackingEvent) {
+			events = append(events, ev)
+		}),
+		Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			delivered = append(delivered, envl.RecipientAddress)
+			return nil
+		}),
+	}
+
+	transaction := "MAIL FROM:<some@example.com>\r\nRCPT TO:<a@domain.com>\r\nRCPT TO:<A@domain.com>\r\n" +
+		"DATA\r\nMessage-ID: <1@example.com>\r\n\r\nbody\r\n.\r\n"
+	runSession(t, config, "HELO client.com\r\n"+transaction+transaction+"QUIT\r\n")
+
+	if len(delivered) != 1 || len(delivered[0]) != 1 {
+		t.Errorf("got delivered %v, expected one copy", delivered)
+	}
+
+	types := map[string]int{}
+	for _, ev := range events {
+		types[ev.Type]++
+	}
+	if types[TrackDelivered] != 1 || types[TrackDuplicate] != 3 {
+		t.Errorf("got tracking events %v, expected 1 delivered and 3 duplicate", types)
+	}
+}
+
+// TestMessageDedupKey make sure that messages are identified by
+// Message-ID or body hash together with the envelope
+func TestMessageDedupKey(t *testing.T) {
+	envl := &Envelope{OriginatorAddress: "some@example.com", RecipientAddress: []string{"a@domain.com", "b@domain.com"}}
+	reordered := &Envelope{OriginatorAddress: "Some@example.com", RecipientAddress: []string{"B@domain.com", "a@domain.com"}}
+	other := &Envelope{OriginatorAddress: "some@example.com", RecipientAddress: []string{"a@domain.com"}}
+	msg := []byte("Message-ID: <1@example.com>\r\n\r\nbody\r\n")
+	resent := []byte("Received: from relay\r\nMessage-ID: <1@example.com>\r\n\r\nbody\r\n")
+	noID := []byte("Subject: hi\r\n\r\nbody\r\n")
+	noIDResent := []byte("Received: from relay\r\nSubject: hi\r\n\r\nbody\r\n")
+
+	cases := []struct {
+		d      *MessageDedup
+		e1, e2 *Envelope
+		m1, m2 []byte
+		equal  bool
+	}{
+		{&MessageDedup{}, envl, reordered, msg, resent, true},
+		{&MessageDedup{}, envl, other, msg, msg, false},
+		{&MessageDedup{}, envl, envl, noID, noIDResent, true},
+		{&MessageDedup{}, envl, envl, msg, noID, false},
+		{&MessageDedup{Hash: true}, envl, envl, msg, noID, true},
+	}
+
+	for i, input := range cases {
+		k1, k2 := input.d.Key(input.e1, input.m1), input.d.Key(input.e2, input.m2)
+		if (k1 == k2) != input.equal {
+			t.Errorf("case %d: got keys %q and %q, expected equal=%t", i, k1, k2, input.equal)
+		}
+	}
+}
+
+// TestSessionMessageDedup make sure that retried messages are either
+// dropped or flagged to the backend
+func TestSessionMessageDedup(t *testing.T) {
+	transaction := "MAIL FROM:<some@example.com>\r\nRCPT TO:<a@domain.com>\r\n" +
+		"DATA\r\nMessage-ID: <1@example.com>\r\n\r\nbody\r\n.\r\n"
+
+	for _, drop := range []bool{false, true} {
+		var duplicates []bool
+		config := &Config{
+			MessageDedup: &MessageDedup{Drop: drop},
+			Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+				duplicates = append(duplicates, envl.Duplicate)
+				return nil
+			}),
+		}
+		runSession(t, config, "HELO client.com\r\n"+transaction+transaction+"QUIT\r\n")
+
+		expected := "[false true]"
+		if drop {
+			expected = "[false]"
+		}
+		if got := fmt.Sprint(duplicates); got != expected {
+			t.Errorf("drop=%t: got duplicate flags %s, expected %s", drop, got, expected)
+		}
+	}
+
+	// duplicates are dropped for StreamBackend too
+	b := &streamRecorder{}
+	config := &Config{MessageDedup: &MessageDedup{Drop: true}, Backend: b}
+	runSession(t, config, "HELO client.com\r\n"+transaction+transaction+"QUIT\r\n")
+	if b.streamed+b.buffered != 1 {
+		t.Errorf("got %d streamed %d buffered, expected one delivery", b.streamed, b.buffered)
+	}
+}
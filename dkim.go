@@ -0,0 +1,421 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIM results (RFC 8601 section 2.7.1)
+const (
+	DKIMPass      = "pass"
+	DKIMFail      = "fail"
+	DKIMNeutral   = "neutral"
+	DKIMTempError = "temperror"
+	DKIMPermError = "permerror"
+)
+
+// maximum DKIM-Signature verified in a message
+const maxDKIMSignatures = 5
+
+// default timeout of DKIM key lookup
+const defaultDKIMTimeout = 10 * time.Second
+
+// DKIMResult represents verification result of a DKIM-Signature
+type DKIMResult struct {
+	Result   string
+	Domain   string
+	Selector string
+	// Reason explain result other than pass
+	Reason string
+}
+
+type dkimError struct {
+	result, reason string
+}
+
+func (e *dkimError) Error() string {
+	return e.result + ": " + e.reason
+}
+
+func dkimPermErr(reason string) error {
+	return &dkimError{DKIMPermError, reason}
+}
+
+// headerField represents a raw header field including folded
+// continuation lines and the terminating <CRLF>
+type headerField struct {
+	name string
+	raw  string
+}
+
+// value return the unfolded value of the field
+func (f headerField) value() string {
+	i := strings.Index(f.raw, ":")
+	v := strings.NewReplacer("\r\n", "", "\n", "").Replace(f.raw[i+1:])
+	return strings.TrimSpace(v)
+}
+
+// splitMessage split message data into header fields and body
+func splitMessage(data []byte) ([]headerField, []byte) {
+	var fields []headerField
+	rest := data
+	for len(rest) > 0 {
+		i := bytes.IndexByte(rest, '\n')
+		line := rest
+		if i >= 0 {
+			line = rest[:i+1]
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return fields, rest[len(line):]
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += string(line)
+		} else {
+			name := string(line)
+			if j := strings.Index(name, ":"); j >= 0 {
+				name = name[:j]
+			}
+			fields = append(fields, headerField{name: strings.TrimSpace(name), raw: string(line)})
+		}
+		rest = rest[len(line):]
+	}
+	return fields, nil
+}
+
+// parseTags parse tag-list like "v=1; a=rsa-sha256; d=example.com"
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.Index(part, "=")
+		if i < 0 {
+			return nil, dkimPermErr("malformed tag")
+		}
+		name := strings.TrimSpace(part[:i])
+		if _, ok := tags[name]; ok {
+			return nil, dkimPermErr("duplicate tag " + name)
+		}
+		tags[name] = strings.TrimSpace(part[i+1:])
+	}
+	return tags, nil
+}
+
+// removeWSP remove every whitespace including folding
+func removeWSP(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+// collapseWSP reduce every sequence of whitespace into single space
+func collapseWSP(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			if !space {
+				b.WriteByte(' ')
+			}
+			space = true
+			continue
+		}
+		space = false
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// canonicalHeader canonicalize a header field (RFC 6376 section 3.4)
+func canonicalHeader(f headerField, relaxed bool) string {
+	if !relaxed {
+		return f.raw
+	}
+	unfolded := strings.NewReplacer("\r\n", "", "\n", "").Replace(f.raw)
+	i := strings.Index(unfolded, ":")
+	name := strings.ToLower(strings.TrimRight(unfolded[:i], " \t"))
+	return name + ":" + strings.TrimSpace(collapseWSP(unfolded[i+1:])) + "\r\n"
+}
+
+// canonicalBody canonicalize message body (RFC 6376 section 3.4)
+func canonicalBody(body []byte, relaxed bool) []byte {
+	lines := strings.Split(strings.Replace(string(body), "\r\n", "\n", -1), "\n")
+	var b bytes.Buffer
+	empty := 0
+	for i, line := range lines {
+		if i == len(lines)-1 && line == "" {
+			break
+		}
+		if relaxed {
+			line = strings.TrimRight(collapseWSP(line), " ")
+		}
+		if line == "" {
+			empty++
+			continue
+		}
+		for ; empty > 0; empty-- {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	if b.Len() == 0 && !relaxed {
+		return []byte("\r\n")
+	}
+	return b.Bytes()
+}
+
+// selectHeaders pick header fields listed in h= from the bottom of the
+// header, every listed name consume one instance of the field
+func selectHeaders(fields []headerField, names []string) []headerField {
+	used := make(map[int]bool)
+	var selected []headerField
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, strings.TrimSpace(name)) {
+				used[i] = true
+				selected = append(selected, fields[i])
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// stripSignature empty value of b= tag in DKIM-Signature field
+func stripSignature(raw string) string {
+	i := strings.Index(raw, ":")
+	prefix, value := raw[:i+1], raw[i+1:]
+	var b strings.Builder
+	for j, part := range strings.Split(value, ";") {
+		if j > 0 {
+			b.WriteByte(';')
+		}
+		if k := strings.Index(part, "="); k >= 0 && strings.TrimSpace(part[:k]) == "b" {
+			part = part[:k+1]
+		}
+		b.WriteString(part)
+	}
+	return prefix + b.String()
+}
+
+// dkimKey lookup public key of selector._domainkey.domain
+func dkimKey(ctx context.Context, resolver Resolver, selector, domain, algo string) (crypto.PublicKey, error) {
+	txts, err := resolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		if de, ok := err.(*net.DNSError); ok && de.IsNotFound {
+			return nil, dkimPermErr("no key for signature")
+		}
+		return nil, &dkimError{DKIMTempError, "key unavailable"}
+	}
+	if len(txts) == 0 {
+		return nil, dkimPermErr("no key for signature")
+	}
+
+	tags, err := parseTags(strings.Join(txts, ""))
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, dkimPermErr("invalid key version")
+	}
+	p := removeWSP(tags["p"])
+	if p == "" {
+		return nil, dkimPermErr("key revoked")
+	}
+	raw, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, dkimPermErr("malformed public key")
+	}
+
+	keyType := tags["k"]
+	if keyType == "" {
+		keyType = "rsa"
+	}
+	if !strings.HasPrefix(algo, keyType+"-") {
+		return nil, dkimPermErr("inappropriate key algorithm")
+	}
+
+	switch keyType {
+	case "rsa":
+		if pub, err := x509.ParsePKIXPublicKey(raw); err == nil {
+			if rsaPub, ok := pub.(*rsa.PublicKey); ok {
+				return rsaPub, nil
+			}
+		}
+		if rsaPub, err := x509.ParsePKCS1PublicKey(raw); err == nil {
+			return rsaPub, nil
+		}
+	case "ed25519":
+		if len(raw) == ed25519.PublicKeySize {
+			return ed25519.PublicKey(raw), nil
+		}
+	}
+	return nil, dkimPermErr("malformed public key")
+}
+
+// dkimCanonicalization parse c= tag into header and body relaxed flags
+func dkimCanonicalization(c string) (header, body bool, err error) {
+	if c == "" {
+		return false, false, nil
+	}
+	parts := strings.SplitN(c, "/", 2)
+	if len(parts) == 1 {
+		parts = append(parts, "simple")
+	}
+	for i, p := range parts {
+		switch p {
+		case "simple":
+		case "relaxed":
+			if i == 0 {
+				header = true
+			} else {
+				body = true
+			}
+		default:
+			return false, false, dkimPermErr("unknown canonicalization")
+		}
+	}
+	return header, body, nil
+}
+
+// dkimHeaderHash compute hash of selected headers and the signature
+// field with empty b= value
+func dkimHeaderHash(fields []headerField, sig headerField, names []string, relaxed bool) []byte {
+	h := sha256.New()
+	for _, f := range selectHeaders(fields, names) {
+		h.Write([]byte(canonicalHeader(f, relaxed)))
+	}
+	stripped := headerField{name: sig.name, raw: stripSignature(sig.raw)}
+	h.Write([]byte(strings.TrimRight(canonicalHeader(stripped, relaxed), "\r\n")))
+	return h.Sum(nil)
+}
+
+// verifySignature verify a single DKIM-Signature field
+func verifySignature(ctx context.Context, resolver Resolver, fields []headerField, body []byte, sig headerField) *DKIMResult {
+	res := &DKIMResult{}
+	err := func() error {
+		tags, err := parseTags(sig.value())
+		if err != nil {
+			return err
+		}
+		res.Domain, res.Selector = tags["d"], tags["s"]
+
+		for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+			if _, ok := tags[required]; !ok {
+				return dkimPermErr("missing tag " + required)
+			}
+		}
+		if tags["v"] != "1" {
+			return dkimPermErr("incompatible version")
+		}
+		algo := tags["a"]
+		if algo != "rsa-sha256" && algo != "ed25519-sha256" {
+			return dkimPermErr("unsupported algorithm")
+		}
+
+		names := strings.Split(removeWSP(tags["h"]), ":")
+		signsFrom := false
+		for _, n := range names {
+			signsFrom = signsFrom || strings.EqualFold(n, "From")
+		}
+		if !signsFrom {
+			return dkimPermErr("From field not signed")
+		}
+
+		if x, ok := tags["x"]; ok {
+			exp, err := strconv.ParseInt(x, 10, 64)
+			if err != nil {
+				return dkimPermErr("malformed expiration")
+			}
+			if time.Now().Unix() > exp {
+				return dkimPermErr("signature expired")
+			}
+		}
+
+		relaxedHeader, relaxedBody, err := dkimCanonicalization(tags["c"])
+		if err != nil {
+			return err
+		}
+
+		// the whole body is hashed whatever l= says, content
+		// appended after the signed length must not pass
+		// (RFC 6376 section 8.2)
+		canon := canonicalBody(body, relaxedBody)
+		if l, ok := tags["l"]; ok {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 0 || n > len(canon) {
+				return dkimPermErr("invalid body length")
+			}
+		}
+		bodyHash := sha256.Sum256(canon)
+		expected, err := base64.StdEncoding.DecodeString(removeWSP(tags["bh"]))
+		if err != nil || !bytes.Equal(expected, bodyHash[:]) {
+			return &dkimError{DKIMFail, "body hash did not verify"}
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(removeWSP(tags["b"]))
+		if err != nil {
+			return dkimPermErr("malformed signature")
+		}
+
+		pub, err := dkimKey(ctx, resolver, res.Selector, res.Domain, algo)
+		if err != nil {
+			return err
+		}
+
+		hash := dkimHeaderHash(fields, sig, names, relaxedHeader)
+		if err := verifyKeySignature(pub, hash, signature); err != nil {
+			return &dkimError{DKIMFail, "signature did not verify"}
+		}
+		return nil
+	}()
+
+	if err == nil {
+		res.Result = DKIMPass
+		return res
+	}
+	if e, ok := err.(*dkimError); ok {
+		res.Result, res.Reason = e.result, e.reason
+	} else {
+		res.Result, res.Reason = DKIMPermError, err.Error()
+	}
+	return res
+}
+
+// VerifyDKIM verify every DKIM-Signature of message data. return
+// nil when the message is not signed
+func VerifyDKIM(ctx context.Context, resolver Resolver, data []byte) []*DKIMResult {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultDKIMTimeout)
+		defer cancel()
+	}
+
+	fields, body := splitMessage(data)
+	var results []*DKIMResult
+	for _, f := range fields {
+		if !strings.EqualFold(f.name, "DKIM-Signature") {
+			continue
+		}
+		if len(results) == maxDKIMSignatures {
+			break
+		}
+		results = append(results, verifySignature(ctx, resolver, fields, body, f))
+	}
+	return results
+}
@@ -0,0 +1,147 @@
+//go:debug rsa1024min=0
+
+package session
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+const dkimTestMessage = "From: Some <some@example.com>\r\n" +
+	"To: other@domain.com\r\n" +
+	"Subject:   Hello    there \r\n" +
+	"\r\n" +
+	"Hi  there  \r\n" +
+	"\r\n" +
+	"\r\n"
+
+// signDKIM sign message data for tests with the given tags
+func signDKIM(t *testing.T, key crypto.Signer, data, tags string) string {
+	fields, body := splitMessage([]byte(data))
+	parsed, err := parseTags(tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relaxedHeader, relaxedBody, _ := dkimCanonicalization(parsed["c"])
+	bh := sha256.Sum256(canonicalBody(body, relaxedBody))
+
+	sig := headerField{
+		name: "DKIM-Signature",
+		raw:  "DKIM-Signature: " + tags + "; bh=" + base64.StdEncoding.EncodeToString(bh[:]) + "; b=\r\n",
+	}
+	hash := dkimHeaderHash(fields, sig, strings.Split(parsed["h"], ":"), relaxedHeader)
+
+	var signature []byte
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, hash)
+	default:
+		signature, err = key.Sign(rand.Reader, hash, crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sig.raw = strings.TrimSuffix(sig.raw, "\r\n") + base64.StdEncoding.EncodeToString(signature) + "\r\n"
+	return sig.raw + data
+}
+
+// TestCanonicalBody make sure that body canonicalized as RFC 6376
+func TestCanonicalBody(t *testing.T) {
+	cases := []struct {
+		body     string
+		relaxed  bool
+		expected string
+	}{
+		{"", false, "\r\n"},
+		{"", true, ""},
+		{"a  b \r\n\r\n\r\n", false, "a  b \r\n"},
+		{"a  b \r\n\r\n\r\n", true, "a b\r\n"},
+		{" c \r\n\r\nd\r\n", true, " c\r\n\r\nd\r\n"},
+		{"no crlf", false, "no crlf\r\n"},
+	}
+
+	for _, input := range cases {
+		got := string(canonicalBody([]byte(input.body), input.relaxed))
+		if got != input.expected {
+			t.Errorf("%q relaxed=%t: got %q, expected %q", input.body, input.relaxed, got, input.expected)
+		}
+	}
+}
+
+// TestVerifyDKIM verify rsa-sha256 and ed25519-sha256 signatures
+func TestVerifyDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	shortKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortPub, _ := x509.MarshalPKIXPublicKey(&shortKey.PublicKey)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	r := &fakeResolver{txts: map[string][]string{
+		"rsa._domainkey.example.com":     {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+		"ed._domainkey.example.com":      {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+		"revoked._domainkey.example.com": {"v=DKIM1; p="},
+		"short._domainkey.example.com":   {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(shortPub)},
+	}}
+
+	cases := []struct {
+		data   string
+		result string
+	}{
+		{signDKIM(t, rsaKey, dkimTestMessage, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=rsa; h=From:To:Subject"), DKIMPass},
+		{signDKIM(t, rsaKey, dkimTestMessage, "v=1; a=rsa-sha256; d=example.com; s=rsa; h=From:Subject"), DKIMPass},
+		{signDKIM(t, edKey, dkimTestMessage, "v=1; a=ed25519-sha256; c=relaxed/simple; d=example.com; s=ed; h=From:To"), DKIMPass},
+		// modified body and header
+		{strings.Replace(signDKIM(t, rsaKey, dkimTestMessage, "v=1; a=rsa-sha256; d=example.com; s=rsa; h=From:Subject"), "Hi", "Ho", 1), DKIMFail},
+		{strings.Replace(signDKIM(t, edKey, dkimTestMessage, "v=1; a=ed25519-sha256; d=example.com; s=ed; h=From:To"), "other@", "evil@", 1), DKIMFail},
+		// key problems
+		{signDKIM(t, edKey, dkimTestMessage, "v=1; a=ed25519-sha256; d=example.com; s=rsa; h=From"), DKIMPermError},
+		{signDKIM(t, edKey, dkimTestMessage, "v=1; a=ed25519-sha256; d=example.com; s=revoked; h=From"), DKIMPermError},
+		{signDKIM(t, edKey, dkimTestMessage, "v=1; a=ed25519-sha256; d=example.com; s=missing; h=From"), DKIMPermError},
+		{signDKIM(t, shortKey, dkimTestMessage, "v=1; a=rsa-sha256; d=example.com; s=short; h=From"), DKIMFail},
+		// From not signed
+		{signDKIM(t, edKey, dkimTestMessage, "v=1; a=ed25519-sha256; d=example.com; s=ed; h=To"), DKIMPermError},
+		// body length
+		{signDKIM(t, edKey, dkimTestMessage, "v=1; a=ed25519-sha256; d=example.com; s=ed; h=From; l=13"), DKIMPass},
+		{signDKIM(t, edKey, dkimTestMessage, "v=1; a=ed25519-sha256; d=example.com; s=ed; h=From; l=13") + "Unsigned\r\n", DKIMFail},
+		{signDKIM(t, edKey, dkimTestMessage, "v=1; a=ed25519-sha256; d=example.com; s=ed; h=From; l=100"), DKIMPermError},
+	}
+
+	for i, input := range cases {
+		results := VerifyDKIM(context.Background(), r, []byte(input.data))
+		if len(results) != 1 || results[0].Result != input.result {
+			t.Errorf("case %d: got %+v, expected %q", i, results, input.result)
+		}
+	}
+
+	if results := VerifyDKIM(context.Background(), r, []byte(dkimTestMessage)); results != nil {
+		t.Errorf("unsigned message: got %+v, expected nil", results)
+	}
+}
+
+// TestRemoveAuthResults make sure that only our forged results removed
+func TestRemoveAuthResults(t *testing.T) {
+	data := "Authentication-Results: mx.example.com; spf=pass\r\n" +
+		"Authentication-Results: other.org;\r\n dkim=pass\r\n" +
+		"Subject: test\r\n\r\nbody\r\n"
+	expected := "Authentication-Results: other.org;\r\n dkim=pass\r\n" +
+		"Subject: test\r\n\r\nbody\r\n"
+
+	got := string(removeAuthResults([]byte(data), "MX.example.com"))
+	if got != expected {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
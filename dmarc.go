@@ -0,0 +1,473 @@
+package session
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DMARC results (RFC 7489, RFC 8601 section 2.7.1)
+const (
+	DMARCPass      = "pass"
+	DMARCFail      = "fail"
+	DMARCNone      = "none"
+	DMARCTempError = "temperror"
+	DMARCPermError = "permerror"
+)
+
+// DMARC policies and dispositions
+const (
+	DispositionNone       = "none"
+	DispositionQuarantine = "quarantine"
+	DispositionReject     = "reject"
+)
+
+// default timeout of DMARC record lookup
+const defaultDMARCTimeout = 5 * time.Second
+
+// dmarcRejectErr is sent when DMARC policy of the From: domain
+// reject the message and enforcement is enabled
+var dmarcRejectErr = NewSMTPError(550, [3]int{5, 7, 1}, "Message rejected by DMARC policy of the sender domain")
+
+// dmarcFromErr is sent when DMARC can't be evaluated because the
+// From: header is missing or invalid and enforcement is enabled
+var dmarcFromErr = NewSMTPError(550, [3]int{5, 7, 1}, "Message rejected: missing or invalid From: header")
+
+// DMARCRecord is a DMARC policy record published in DNS
+type DMARCRecord struct {
+	// Domain is the domain the record was found at
+	Domain string
+	// Policy and SubdomainPolicy are p= and sp= tags
+	Policy          string
+	SubdomainPolicy string
+	// Percent is pct= tag, the percentage of failing messages
+	// the policy is applied to
+	Percent int
+	// StrictDKIM and StrictSPF are adkim=s and aspf=s
+	StrictDKIM bool
+	StrictSPF  bool
+	// ReportURIs is rua= tag, where aggregate reports are sent
+	ReportURIs []string
+}
+
+// ParseDMARC parse DMARC record of domain like
+// "v=DMARC1; p=reject; rua=mailto:dmarc@example.com"
+func ParseDMARC(domain, txt string) (*DMARCRecord, error) {
+	tags, err := parseTags(txt)
+	if err != nil {
+		return nil, err
+	}
+	if tags["v"] != "DMARC1" {
+		return nil, fmt.Errorf("dmarc: invalid version %q", tags["v"])
+	}
+	r := &DMARCRecord{Domain: domain, Percent: 100}
+	switch r.Policy = strings.ToLower(tags["p"]); r.Policy {
+	case DispositionNone, DispositionQuarantine, DispositionReject:
+	default:
+		return nil, fmt.Errorf("dmarc: invalid policy %q", tags["p"])
+	}
+	r.SubdomainPolicy = r.Policy
+	if sp, ok := tags["sp"]; ok {
+		switch sp = strings.ToLower(sp); sp {
+		case DispositionNone, DispositionQuarantine, DispositionReject:
+			r.SubdomainPolicy = sp
+		}
+	}
+	if pct, ok := tags["pct"]; ok {
+		if n, err := strconv.Atoi(pct); err == nil && n >= 0 && n <= 100 {
+			r.Percent = n
+		}
+	}
+	r.StrictDKIM = strings.EqualFold(tags["adkim"], "s")
+	r.StrictSPF = strings.EqualFold(tags["aspf"], "s")
+	for _, uri := range strings.Split(tags["rua"], ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			r.ReportURIs = append(r.ReportURIs, uri)
+		}
+	}
+	return r, nil
+}
+
+// DMARCResult is the DMARC evaluation of a message
+type DMARCResult struct {
+	Result string
+	// Domain is the domain of From: header
+	Domain string
+	// Policy is the policy that applied to Domain, Disposition
+	// is the policy applied to the message after sampling
+	Policy      string
+	Disposition string
+	// SPFAligned and DKIMAligned report which passing
+	// identifier aligned with Domain
+	SPFAligned  bool
+	DKIMAligned bool
+	// Record is the policy record, nil when none was found
+	Record *DMARCRecord `json:",omitempty"`
+}
+
+// String return the result formatted for Authentication-Results
+func (r *DMARCResult) String() string {
+	s := "dmarc=" + r.Result
+	if r.Policy != "" {
+		s += " (p=" + r.Policy + " dis=" + r.Disposition + ")"
+	}
+	if r.Domain != "" {
+		s += " header.from=" + r.Domain
+	}
+	return s
+}
+
+// lookupDMARC return the record at _dmarc.domain, nil when there
+// is none. more than one record or an invalid record is no record
+// (RFC 7489 section 6.6.3)
+func lookupDMARC(ctx context.Context, resolver Resolver, domain string) (*DMARCRecord, error) {
+	txts, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			records = append(records, txt)
+		}
+	}
+	if len(records) != 1 {
+		return nil, nil
+	}
+	rec, err := ParseDMARC(domain, records[0])
+	if err != nil {
+		return nil, nil
+	}
+	return rec, nil
+}
+
+// CheckDMARC evaluate DMARC policy of the From: header domain of data
+// with the SPF result of sender and DKIM results. sender is the
+// MAIL FROM address, or the HELO name with the null reverse-path.
+// a message without exactly one valid From: field is a permerror
+// with reject disposition (RFC 7489 section 6.6.1)
+func CheckDMARC(ctx context.Context, resolver Resolver, data []byte, sender, spf string, dkim []*DKIMResult) *DMARCResult {
+	res := &DMARCResult{Result: DMARCNone}
+	domains, err := headerFromDomains(data)
+	if err != nil || len(domains) == 0 || slices.Contains(domains, "") {
+		res.Result = DMARCPermError
+		res.Disposition = DispositionReject
+		return res
+	}
+	// a message with several author domains can't be evaluated
+	for _, d := range domains[1:] {
+		if d != domains[0] {
+			res.Result = DMARCPermError
+			return res
+		}
+	}
+	res.Domain = domains[0]
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultDMARCTimeout)
+		defer cancel()
+	}
+
+	rec, err := lookupDMARC(ctx, resolver, ToASCII(res.Domain))
+	subdomain := false
+	if err == nil && rec == nil {
+		if org := OrganizationalDomain(res.Domain); org != res.Domain {
+			rec, err = lookupDMARC(ctx, resolver, ToASCII(org))
+			subdomain = true
+		}
+	}
+	if err != nil {
+		res.Result = DMARCTempError
+		return res
+	}
+	if rec == nil {
+		return res
+	}
+	res.Record = rec
+
+	senderDomain := domainOf(sender)
+	if senderDomain == "" {
+		senderDomain = strings.ToLower(sender)
+	}
+	res.SPFAligned = spf == SPFPass && domainsAligned(senderDomain, res.Domain, rec.StrictSPF)
+	for _, r := range dkim {
+		if r.Result == DKIMPass && domainsAligned(strings.ToLower(r.Domain), res.Domain, rec.StrictDKIM) {
+			res.DKIMAligned = true
+			break
+		}
+	}
+
+	res.Policy = rec.Policy
+	if subdomain {
+		res.Policy = rec.SubdomainPolicy
+	}
+	res.Disposition = DispositionNone
+	if res.SPFAligned || res.DKIMAligned {
+		res.Result = DMARCPass
+		return res
+	}
+	res.Result = DMARCFail
+	res.Disposition = res.Policy
+	// messages outside the sample get the next weaker policy
+	if rec.Percent < 100 && rand.IntN(100) >= rec.Percent {
+		switch res.Disposition {
+		case DispositionReject:
+			res.Disposition = DispositionQuarantine
+		case DispositionQuarantine:
+			res.Disposition = DispositionNone
+		}
+	}
+	return res
+}
+
+// DMARC evaluate DMARC policy of received messages after SPF and
+// DKIM, which need Config.CheckSPF and Config.VerifyDKIM. messages
+// of authenticated clients are not evaluated
+type DMARC struct {
+	// Enforce reject messages with reject disposition and tag
+	// messages with quarantine disposition with QuarantineHeader,
+	// otherwise the result is only recorded on the envelope
+	Enforce bool
+	// QuarantineHeader default to X-DMARC-Quarantine
+	QuarantineHeader string
+
+	// Reports aggregate the results for DMARC reports
+	Reports *DMARCReports
+}
+
+// quarantineHeader return the name of the quarantine header field
+func (d *DMARC) quarantineHeader() string {
+	if d.QuarantineHeader == "" {
+		return "X-DMARC-Quarantine"
+	}
+	return d.QuarantineHeader
+}
+
+// checkDMARC evaluate DMARC of the message, the result is recorded
+// on the envelope and data tagged when quarantined
+func (s *Session) checkDMARC(envl *Envelope, data []byte) []byte {
+	d := s.Config.DMARC
+	if d == nil || s.Principal != nil {
+		return data
+	}
+	sender := envl.OriginatorAddress
+	if sender == "" {
+		sender = s.HeloName
+	}
+	ctx, span := s.span(envl.Context(), "smtp.dmarc")
+	envl.DMARC = CheckDMARC(ctx, s.Config.resolver(), data, sender, envl.SPF, envl.DKIM)
+	span.SetAttribute("dmarc.result", envl.DMARC.Result)
+	span.End()
+
+	if d.Reports != nil {
+		d.Reports.Add(s.RemoteIP(), envl)
+	}
+	if d.Enforce {
+		// the tag of the sender can't be trusted
+		data = removeHeader(data, d.quarantineHeader())
+		if envl.DMARC.Disposition == DispositionQuarantine {
+			data = prependHeader(data, d.quarantineHeader(), "yes; "+envl.DMARC.String())
+		}
+	}
+	return data
+}
+
+// enforceDMARC reject the message when its disposition is reject
+func (s *Session) enforceDMARC(envl *Envelope) error {
+	d := s.Config.DMARC
+	if d != nil && d.Enforce && envl.DMARC != nil && envl.DMARC.Disposition == DispositionReject {
+		if envl.DMARC.Domain == "" {
+			return dmarcFromErr
+		}
+		return dmarcRejectErr
+	}
+	return nil
+}
+
+// dmarcRow is a row of aggregate report
+type dmarcRow struct {
+	SourceIP    string
+	HeaderFrom  string
+	Disposition string
+	DKIM, SPF   string
+	SPFDomain   string
+	SPFResult   string
+}
+
+// DMARCReports aggregate DMARC results per From: domain for aggregate
+// reports (RFC 7489 section 7.2)
+type DMARCReports struct {
+	mu      sync.Mutex
+	begin   time.Time
+	rows    map[dmarcRow]int
+	records map[string]*DMARCRecord
+}
+
+// Add count the DMARC result of envl received from ip, messages of
+// domains without record are not reported
+func (r *DMARCReports) Add(ip net.IP, envl *Envelope) {
+	res := envl.DMARC
+	if res == nil || res.Record == nil {
+		return
+	}
+	row := dmarcRow{
+		HeaderFrom:  res.Domain,
+		Disposition: res.Disposition,
+		DKIM:        passFail(res.DKIMAligned),
+		SPF:         passFail(res.SPFAligned),
+		SPFDomain:   domainOf(envl.OriginatorAddress),
+		SPFResult:   envl.SPF,
+	}
+	if ip != nil {
+		row.SourceIP = ip.String()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rows == nil {
+		r.rows = make(map[dmarcRow]int)
+		r.records = make(map[string]*DMARCRecord)
+		r.begin = time.Now()
+	}
+	r.rows[row]++
+	r.records[res.Domain] = res.Record
+}
+
+// passFail return DMARCPass when ok, otherwise DMARCFail
+func passFail(ok bool) string {
+	if ok {
+		return DMARCPass
+	}
+	return DMARCFail
+}
+
+// DMARCAggregate is the aggregate report of a domain, it is
+// marshaled into the XML of RFC 7489 appendix C
+type DMARCAggregate struct {
+	XMLName  xml.Name `xml:"feedback"`
+	Metadata struct {
+		OrgName   string `xml:"org_name"`
+		Email     string `xml:"email"`
+		ReportID  string `xml:"report_id"`
+		DateRange struct {
+			Begin int64 `xml:"begin"`
+			End   int64 `xml:"end"`
+		} `xml:"date_range"`
+	} `xml:"report_metadata"`
+	Policy struct {
+		Domain string `xml:"domain"`
+		ADKIM  string `xml:"adkim"`
+		ASPF   string `xml:"aspf"`
+		P      string `xml:"p"`
+		SP     string `xml:"sp"`
+		Pct    int    `xml:"pct"`
+	} `xml:"policy_published"`
+	Records []DMARCAggregateRecord `xml:"record"`
+
+	// ReportURIs is where the report should be sent
+	ReportURIs []string `xml:"-"`
+}
+
+// DMARCAggregateRecord is a row of DMARCAggregate
+type DMARCAggregateRecord struct {
+	Row struct {
+		SourceIP string `xml:"source_ip"`
+		Count    int    `xml:"count"`
+		Policy   struct {
+			Disposition string `xml:"disposition"`
+			DKIM        string `xml:"dkim"`
+			SPF         string `xml:"spf"`
+		} `xml:"policy_evaluated"`
+	} `xml:"row"`
+	Identifiers struct {
+		HeaderFrom string `xml:"header_from"`
+	} `xml:"identifiers"`
+	AuthResults struct {
+		SPF struct {
+			Domain string `xml:"domain"`
+			Result string `xml:"result"`
+		} `xml:"spf"`
+	} `xml:"auth_results"`
+}
+
+// alignmentMode return the adkim or aspf value of strict
+func alignmentMode(strict bool) string {
+	if strict {
+		return "s"
+	}
+	return "r"
+}
+
+// Aggregate return the report of each domain since the previous
+// call and start a new reporting period. org and email identify the
+// reporting organization
+func (r *DMARCReports) Aggregate(org, email string, now time.Time) []*DMARCAggregate {
+	r.mu.Lock()
+	rows, records, begin := r.rows, r.records, r.begin
+	r.rows, r.records = nil, nil
+	r.mu.Unlock()
+
+	reports := make(map[string]*DMARCAggregate)
+	for row, count := range rows {
+		rep := reports[row.HeaderFrom]
+		if rep == nil {
+			rec := records[row.HeaderFrom]
+			rep = &DMARCAggregate{ReportURIs: rec.ReportURIs}
+			rep.Metadata.OrgName, rep.Metadata.Email = org, email
+			rep.Metadata.ReportID = newID()
+			rep.Metadata.DateRange.Begin, rep.Metadata.DateRange.End = begin.Unix(), now.Unix()
+			rep.Policy.Domain = rec.Domain
+			rep.Policy.ADKIM, rep.Policy.ASPF = alignmentMode(rec.StrictDKIM), alignmentMode(rec.StrictSPF)
+			rep.Policy.P, rep.Policy.SP, rep.Policy.Pct = rec.Policy, rec.SubdomainPolicy, rec.Percent
+			reports[row.HeaderFrom] = rep
+		}
+		var rr DMARCAggregateRecord
+		rr.Row.SourceIP, rr.Row.Count = row.SourceIP, count
+		rr.Row.Policy.Disposition, rr.Row.Policy.DKIM, rr.Row.Policy.SPF = row.Disposition, row.DKIM, row.SPF
+		rr.Identifiers.HeaderFrom = row.HeaderFrom
+		rr.AuthResults.SPF.Domain, rr.AuthResults.SPF.Result = row.SPFDomain, row.SPFResult
+		rep.Records = append(rep.Records, rr)
+	}
+
+	domains := make([]string, 0, len(reports))
+	for d := range reports {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	out := make([]*DMARCAggregate, 0, len(reports))
+	for _, d := range domains {
+		rep := reports[d]
+		sort.Slice(rep.Records, func(i, j int) bool {
+			a, b := rep.Records[i].Row, rep.Records[j].Row
+			if a.SourceIP != b.SourceIP {
+				return a.SourceIP < b.SourceIP
+			}
+			return a.Count > b.Count
+		})
+		out = append(out, rep)
+	}
+	return out
+}
+
+// XML return the report as XML document
+func (a *DMARCAggregate) XML() ([]byte, error) {
+	b, err := xml.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
@@ -0,0 +1,120 @@
+package session
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+var dmarcResolver = &fakeResolver{
+	txts: map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine; rua=mailto:dmarc@example.com"},
+		"_dmarc.strict.com":  {"v=DMARC1; p=quarantine; aspf=s; adkim=s"},
+		"_dmarc.monitor.com": {"v=DMARC1; p=none"},
+		"_dmarc.twice.com":   {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+		"_dmarc.invalid.com": {"v=DMARC1; p=drop"},
+		"_dmarc.unknown.com": {"spf2.0/pra"},
+		"_dmarc.example.net": {"v=DMARC1; p=reject; pct=0"},
+	},
+}
+
+// TestCheckDMARC evaluate DMARC with aligned and unaligned identifiers
+func TestCheckDMARC(t *testing.T) {
+	pass := []*DKIMResult{{Result: DKIMPass, Domain: "mail.example.com"}}
+	cases := []struct {
+		from, sender, spf string
+		dkim              []*DKIMResult
+		result, policy    string
+		disposition       string
+	}{
+		{"a@example.com", "b@example.com", SPFPass, nil, DMARCPass, DispositionReject, DispositionNone},
+		{"a@example.com", "b@bounce.example.com", SPFPass, nil, DMARCPass, DispositionReject, DispositionNone},
+		{"a@example.com", "b@other.com", SPFPass, pass, DMARCPass, DispositionReject, DispositionNone},
+		{"a@example.com", "b@other.com", SPFPass, nil, DMARCFail, DispositionReject, DispositionReject},
+		{"a@example.com", "b@example.com", SPFSoftFail, nil, DMARCFail, DispositionReject, DispositionReject},
+		{"a@news.example.com", "b@other.com", SPFNone, nil, DMARCFail, DispositionQuarantine, DispositionQuarantine},
+		{"a@strict.com", "b@mail.strict.com", SPFPass, nil, DMARCFail, DispositionQuarantine, DispositionQuarantine},
+		{"a@monitor.com", "b@other.com", SPFPass, nil, DMARCFail, DispositionNone, DispositionNone},
+		{"a@example.net", "b@other.com", SPFPass, nil, DMARCFail, DispositionReject, DispositionQuarantine},
+		{"a@twice.com", "b@other.com", SPFPass, nil, DMARCNone, "", ""},
+		{"a@invalid.com", "b@other.com", SPFPass, nil, DMARCNone, "", ""},
+		{"a@unknown.com", "b@other.com", SPFPass, nil, DMARCNone, "", ""},
+		{"a@example.com, c@other.com", "b@example.com", SPFPass, nil, DMARCPermError, "", ""},
+		{"<a@example.com", "b@example.com", SPFPass, nil, DMARCPermError, "", DispositionReject},
+		{"a@example.com\r\nFrom: c@other.com", "b@example.com", SPFPass, nil, DMARCPermError, "", DispositionReject},
+	}
+
+	for _, input := range cases {
+		data := []byte("From: " + input.from + "\r\nSubject: a\r\n\r\nbody\r\n")
+		res := CheckDMARC(context.Background(), dmarcResolver, data, input.sender, input.spf, input.dkim)
+		if res.Result != input.result || res.Policy != input.policy || res.Disposition != input.disposition {
+			t.Errorf("%s via %s: got %s p=%s dis=%s, expected %s p=%s dis=%s", input.from, input.sender,
+				res.Result, res.Policy, res.Disposition, input.result, input.policy, input.disposition)
+		}
+	}
+
+	res := CheckDMARC(context.Background(), dmarcResolver, []byte("Subject: a\r\n\r\nbody\r\n"), "b@example.com", SPFPass, nil)
+	if res.Result != DMARCPermError || res.Disposition != DispositionReject {
+		t.Errorf("without From: got %s dis=%s, expected permerror dis=reject", res.Result, res.Disposition)
+	}
+}
+
+// TestSessionDMARC make sure that reject disposition is enforced,
+// quarantined messages are tagged and results are aggregated
+func TestSessionDMARC(t *testing.T) {
+	reports := &DMARCReports{}
+	var data []byte
+	config := &Config{
+		Resolver:       dmarcResolver,
+		DMARC:          &DMARC{Enforce: true, Reports: reports},
+		AddAuthResults: true,
+		Backend: BackendFunc(func(envl *Envelope, d []byte) error {
+			data = d
+			return nil
+		}),
+	}
+	session := func(from string) string {
+		return runSessionFrom(t, config, "192.0.2.1:1025", "HELO client.com\r\nMAIL FROM:<b@other.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\n"+
+			"From: "+from+"\r\nX-DMARC-Quarantine: forged\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+	}
+
+	out := session("a@example.com")
+	if !strings.Contains(out, "550 5.7.1 Message rejected by DMARC policy of the sender domain\r\n") {
+		t.Errorf("reject: got %q", out)
+	}
+	out = session("<a@example.com")
+	if !strings.Contains(out, "550 5.7.1 Message rejected: missing or invalid From: header\r\n") {
+		t.Errorf("invalid From: got %q", out)
+	}
+	out = session("a@news.example.com")
+	expected := "X-DMARC-Quarantine: yes; dmarc=fail (p=quarantine dis=quarantine) header.from=news.example.com\r\n"
+	if !strings.Contains(out, "250 2.0.0 OK: queued as ") || !strings.Contains(string(data), expected) || strings.Contains(string(data), "forged") {
+		t.Errorf("quarantine: got %q, %q", out, data)
+	}
+	if !strings.Contains(string(data), "Authentication-Results: localhost;\r\n\tdmarc=fail") {
+		t.Errorf("got %q, expected DMARC in Authentication-Results", data)
+	}
+
+	aggr := reports.Aggregate("Example", "postmaster@localhost", time.Now())
+	if len(aggr) != 2 || aggr[0].Records[0].Identifiers.HeaderFrom != "example.com" || aggr[0].Records[0].Row.SourceIP != "192.0.2.1" {
+		t.Fatalf("got %+v, expected reports of example.com and news.example.com", aggr)
+	}
+	if aggr[0].ReportURIs[0] != "mailto:dmarc@example.com" || aggr[0].Records[0].Row.Policy.Disposition != DispositionReject {
+		t.Errorf("got %+v", aggr[0])
+	}
+	doc, err := aggr[1].XML()
+	if err != nil || !strings.Contains(string(doc), "<header_from>news.example.com</header_from>") {
+		t.Errorf("got %s, %v", doc, err)
+	}
+	if aggr := reports.Aggregate("Example", "postmaster@localhost", time.Now()); len(aggr) != 0 {
+		t.Errorf("got %d reports, expected new period", len(aggr))
+	}
+	// reject disposition is enforced for StreamBackend too
+	b := &streamRecorder{}
+	config = &Config{Resolver: dmarcResolver, DMARC: &DMARC{Enforce: true}, Backend: b}
+	out = session("a@example.com")
+	if !strings.Contains(out, "550 5.7.1 Message rejected by DMARC policy") || b.streamed+b.buffered != 0 {
+		t.Errorf("stream: got %q, %d streamed %d buffered", out, b.streamed, b.buffered)
+	}
+}
@@ -0,0 +1,190 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default settings of DNSBL
+const (
+	defaultDNSBLConcurrency = 16
+	defaultDNSBLCacheTTL    = 10 * time.Minute
+	defaultDNSBLTimeout     = 5 * time.Second
+)
+
+// Resolver is the DNS resolver used by lookups, *net.Resolver
+// implement this interface
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// DNSBLResult represents result of DNS blocklist lookup
+type DNSBLResult struct {
+	Listed bool
+	// Zone is the first zone that list the address
+	Zone string
+	// Text is the TXT record of the listing if any
+	Text string
+}
+
+type dnsblEntry struct {
+	result  DNSBLResult
+	expires time.Time
+}
+
+// DNSBL check client IP address against DNS blocklists
+// like zen.spamhaus.org
+type DNSBL struct {
+	Zones []string
+
+	// AtMail defer the check until MAIL command, otherwise
+	// the check is done when connection arrive
+	AtMail bool
+
+	// Resolver default to net.DefaultResolver
+	Resolver Resolver
+
+	// Concurrency limit the number of lookups in flight
+	Concurrency int
+
+	CacheTTL time.Duration
+	Timeout  time.Duration
+
+	// Message is the text of 554 reply, {ip} and {zone} are
+	// replaced with client address and the listing zone
+	Message string
+
+	once  sync.Once
+	sem   chan struct{}
+	mu    sync.Mutex
+	cache map[string]dnsblEntry
+}
+
+func (d *DNSBL) init() {
+	d.once.Do(func() {
+		n := d.Concurrency
+		if n <= 0 {
+			n = defaultDNSBLConcurrency
+		}
+		d.sem = make(chan struct{}, n)
+		d.cache = make(map[string]dnsblEntry)
+	})
+}
+
+func (d *DNSBL) resolver() Resolver {
+	if d.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return d.Resolver
+}
+
+// reverseIP return the DNSBL query label of ip, "1.2.3.4" => "4.3.2.1"
+// and IPv6 address is reversed nibble by nibble
+func reverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+	const hex = "0123456789abcdef"
+	labels := make([]string, 0, 32)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		labels = append(labels, string(hex[ip16[i]&0xf]), string(hex[ip16[i]>>4]))
+	}
+	return strings.Join(labels, ".")
+}
+
+// lookup query a single zone, lookup errors are treated as not listed
+func (d *DNSBL) lookup(ctx context.Context, query, zone string) DNSBLResult {
+	select {
+	case d.sem <- struct{}{}:
+		defer func() { <-d.sem }()
+	case <-ctx.Done():
+		return DNSBLResult{}
+	}
+
+	name := query + "." + zone
+	addrs, err := d.resolver().LookupHost(ctx, name)
+	if err != nil || len(addrs) == 0 {
+		return DNSBLResult{}
+	}
+
+	res := DNSBLResult{Listed: true, Zone: zone}
+	if txt, err := d.resolver().LookupTXT(ctx, name); err == nil && len(txt) > 0 {
+		res.Text = txt[0]
+	}
+	return res
+}
+
+// Check query every zone concurrently and return the first listing
+// in the order of Zones. results are cached for CacheTTL
+func (d *DNSBL) Check(ctx context.Context, ip net.IP) DNSBLResult {
+	d.init()
+	key := ip.String()
+
+	d.mu.Lock()
+	entry, ok := d.cache[key]
+	d.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.result
+	}
+
+	query := reverseIP(ip)
+	if query == "" || len(d.Zones) == 0 {
+		return DNSBLResult{}
+	}
+
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = defaultDNSBLTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results := make([]DNSBLResult, len(d.Zones))
+	var wg sync.WaitGroup
+	for i, zone := range d.Zones {
+		wg.Add(1)
+		go func(i int, zone string) {
+			defer wg.Done()
+			results[i] = d.lookup(ctx, query, zone)
+		}(i, zone)
+	}
+	wg.Wait()
+
+	var res DNSBLResult
+	for _, r := range results {
+		if r.Listed {
+			res = r
+			break
+		}
+	}
+
+	ttl := d.CacheTTL
+	if ttl <= 0 {
+		ttl = defaultDNSBLCacheTTL
+	}
+	d.mu.Lock()
+	d.cache[key] = dnsblEntry{result: res, expires: time.Now().Add(ttl)}
+	d.mu.Unlock()
+	return res
+}
+
+// Reject return the 554 rejection reply of listed client
+func (d *DNSBL) Reject(ip net.IP, res DNSBLResult) *SMTPError {
+	msg := d.Message
+	if msg == "" {
+		msg = "Service unavailable; client [{ip}] blocked using {zone}"
+	}
+	msg = strings.NewReplacer("{ip}", ip.String(), "{zone}", res.Zone).Replace(msg)
+	return NewSMTPError(554, [3]int{5, 7, 1}, msg)
+}
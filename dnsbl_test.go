@@ -0,0 +1,132 @@
+package session
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeResolver answer lookups from static records
+type fakeResolver struct {
+	mu      sync.Mutex
+	hosts   map[string][]string
+	txts    map[string][]string
+	mxs     map[string][]*net.MX
+	ptrs    map[string][]string
+	queries int
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries++
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r.txts[name]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mxs, ok := r.mxs[name]; ok {
+		return mxs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := r.ptrs[addr]; ok {
+		return names, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+// TestReverseIP make sure that query label of IPv4 and IPv6 are valid
+func TestReverseIP(t *testing.T) {
+	cases := []struct {
+		ip, expected string
+	}{
+		{"1.2.3.4", "4.3.2.1"},
+		{"127.0.0.2", "2.0.0.127"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2"},
+	}
+
+	for _, input := range cases {
+		got := reverseIP(net.ParseIP(input.ip))
+		if got != input.expected {
+			t.Errorf("%q: got %q, expected %q", input.ip, got, input.expected)
+		}
+	}
+}
+
+// TestDNSBLCheck make sure that listing is found in order of zones
+// and the result is cached
+func TestDNSBLCheck(t *testing.T) {
+	r := &fakeResolver{
+		hosts: map[string][]string{
+			"2.0.0.127.bl.example.org":  {"127.0.0.2"},
+			"2.0.0.127.zen.example.org": {"127.0.0.4"},
+		},
+		txts: map[string][]string{
+			"2.0.0.127.zen.example.org": {"listed for spam"},
+		},
+	}
+	d := &DNSBL{Zones: []string{"zen.example.org", "bl.example.org"}, Resolver: r}
+
+	cases := []struct {
+		ip     string
+		listed bool
+		zone   string
+	}{
+		{"127.0.0.2", true, "zen.example.org"},
+		{"127.0.0.1", false, ""},
+	}
+
+	for _, input := range cases {
+		res := d.Check(context.Background(), net.ParseIP(input.ip))
+		if res.Listed != input.listed || res.Zone != input.zone {
+			t.Errorf("%q: got %+v, expected listed=%t zone=%q", input.ip, res, input.listed, input.zone)
+		}
+	}
+
+	queries := r.queries
+	d.Check(context.Background(), net.ParseIP("127.0.0.2"))
+	if r.queries != queries {
+		t.Errorf("cached result should not query resolver")
+	}
+}
+
+// TestSessionDNSBL make sure that listed client is rejected at
+// connection time or at MAIL time
+func TestSessionDNSBL(t *testing.T) {
+	r := &fakeResolver{hosts: map[string][]string{"2.0.0.127.bl.example.org": {"127.0.0.2"}}}
+
+	cases := []struct {
+		dnsbl    *DNSBL
+		remote   string
+		expected string
+	}{
+		{&DNSBL{Zones: []string{"bl.example.org"}, Resolver: r}, "127.0.0.2:2525",
+			"554 5.7.1 Service unavailable; client [127.0.0.2] blocked using bl.example.org\r\n"},
+		{&DNSBL{Zones: []string{"bl.example.org"}, Resolver: r, AtMail: true, Message: "{ip} listed"}, "127.0.0.2:2525",
+			"554 5.7.1 127.0.0.2 listed\r\n"},
+		{&DNSBL{Zones: []string{"bl.example.org"}, Resolver: r}, "127.0.0.1:2525",
+			"250 2.0.0 OK\r\n"},
+	}
+
+	for _, input := range cases {
+		config := &Config{DNSBL: input.dnsbl}
+		out := runSessionFrom(t, config, input.remote, "HELO client.com\r\nMAIL FROM:<some@example.com>\r\nQUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("got %q, expected %q", out, input.expected)
+		}
+	}
+}
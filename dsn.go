@@ -0,0 +1,237 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DSN notify conditions of NOTIFY parameter (RFC 3461 section 4.1)
+const (
+	NotifyNever   = "NEVER"
+	NotifySuccess = "SUCCESS"
+	NotifyFailure = "FAILURE"
+	NotifyDelay   = "DELAY"
+)
+
+// DSN return types of RET parameter
+const (
+	RetFull = "FULL"
+	RetHdrs = "HDRS"
+)
+
+// DSN actions of per-recipient fields
+const (
+	ActionFailed    = "failed"
+	ActionDelayed   = "delayed"
+	ActionDelivered = "delivered"
+)
+
+var dsnParamErr = NewSMTPError(501, [3]int{5, 5, 4}, "Invalid DSN parameter")
+
+// DSNRecipient represents DSN parameters of RCPT command
+type DSNRecipient struct {
+	Notify []string `json:",omitempty"`
+	// ORCPT is the original recipient like "rfc822;some@domain.com"
+	ORCPT string `json:",omitempty"`
+}
+
+// notify report whether the condition is requested. without NOTIFY
+// parameter only failures are reported
+func (r *DSNRecipient) notify(cond string) bool {
+	if r == nil || len(r.Notify) == 0 {
+		return cond == NotifyFailure
+	}
+	for _, n := range r.Notify {
+		if n == cond {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeXtext decode xtext of ENVID and ORCPT (RFC 3461 section 4)
+func decodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 33 || c > 126 || c == '=' {
+			return "", dsnParamErr
+		}
+		if c != '+' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", dsnParamErr
+		}
+		var v byte
+		if _, err := fmt.Sscanf(s[i+1:i+3], "%02X", &v); err != nil {
+			return "", dsnParamErr
+		}
+		b.WriteByte(v)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// encodeXtext encode s as xtext
+func encodeXtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 33 || c > 126 || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseMailDSN parse RET and ENVID parameters of MAIL command
+func parseMailDSN(params map[string]string, envl *Envelope) error {
+	if ret, ok := params["RET"]; ok {
+		ret = strings.ToUpper(ret)
+		if ret != RetFull && ret != RetHdrs {
+			return dsnParamErr
+		}
+		envl.DSNRet = ret
+	}
+	if envid, ok := params["ENVID"]; ok {
+		v, err := decodeXtext(envid)
+		if err != nil || v == "" || len(v) > 100 {
+			return dsnParamErr
+		}
+		envl.DSNEnvID = v
+	}
+	return nil
+}
+
+// parseRcptDSN parse NOTIFY and ORCPT parameters of RCPT command,
+// nil is returned without DSN parameters
+func parseRcptDSN(params map[string]string) (*DSNRecipient, error) {
+	notify, hasNotify := params["NOTIFY"]
+	orcpt, hasOrcpt := params["ORCPT"]
+	if !hasNotify && !hasOrcpt {
+		return nil, nil
+	}
+
+	r := &DSNRecipient{}
+	if hasNotify {
+		for _, n := range strings.Split(strings.ToUpper(notify), ",") {
+			switch n {
+			case NotifyNever, NotifySuccess, NotifyFailure, NotifyDelay:
+				r.Notify = append(r.Notify, n)
+			default:
+				return nil, dsnParamErr
+			}
+		}
+		// NEVER MUST NOT be combined with other values
+		if len(r.Notify) > 1 && r.notify(NotifyNever) {
+			return nil, dsnParamErr
+		}
+	}
+	if hasOrcpt {
+		v, err := decodeXtext(orcpt)
+		if err != nil || !strings.Contains(v, ";") {
+			return nil, dsnParamErr
+		}
+		r.ORCPT = v
+	}
+	return r, nil
+}
+
+// dsnStatus return the status code of delivery result
+func dsnStatus(r *DeliveryResult, action string) string {
+	if e, ok := r.Err.(*SMTPError); ok && e.Enhanced() != "" {
+		return e.Enhanced()
+	}
+	switch action {
+	case ActionFailed:
+		return "5.0.0"
+	case ActionDelayed:
+		return "4.0.0"
+	}
+	return "2.0.0"
+}
+
+// dsnSubjects is the subject of DSN of each action
+var dsnSubjects = map[string]string{
+	ActionFailed:    "Undelivered Mail Returned to Sender",
+	ActionDelayed:   "Delayed Mail (still being retried)",
+	ActionDelivered: "Successful Mail Delivery Report",
+}
+
+// dsnIntros is the human readable part of DSN of each action
+var dsnIntros = map[string]string{
+	ActionFailed:    "Your message could not be delivered to the following recipients:",
+	ActionDelayed:   "Your message has not been delivered yet to the following recipients, delivery will be retried:",
+	ActionDelivered: "Your message was successfully delivered to the following recipients:",
+}
+
+// BuildDSN build multipart/report delivery status notification
+// (RFC 3464) of the action for the results. the returned message
+// include headers of the original message, or the full message
+// when RET=FULL was requested
+func BuildDSN(hostname string, envl *Envelope, action string, results []*DeliveryResult, arrival time.Time, data []byte) []byte {
+	boundary := newSpoolID()
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", hostname)
+	fmt.Fprintf(&b, "To: <%s>\r\n", envl.OriginatorAddress)
+	fmt.Fprintf(&b, "Subject: %s\r\n", dsnSubjects[action])
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+
+	// human readable part
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "%s\r\n\r\n", dsnIntros[action])
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(&b, "<%s>: %s\r\n", r.Recipient, strings.Replace(r.Err.Error(), "\r\n", " ", -1))
+		} else {
+			fmt.Fprintf(&b, "<%s>\r\n", r.Recipient)
+		}
+	}
+
+	// machine readable part
+	fmt.Fprintf(&b, "\r\n--%s\r\nContent-Type: message/delivery-status\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", hostname)
+	if envl.DSNEnvID != "" {
+		fmt.Fprintf(&b, "Original-Envelope-Id: %s\r\n", envl.DSNEnvID)
+	}
+	fmt.Fprintf(&b, "Arrival-Date: %s\r\n", arrival.Format(time.RFC1123Z))
+	for _, r := range results {
+		b.WriteString("\r\n")
+		if p := envl.DSNRcpt[r.Recipient]; p != nil && p.ORCPT != "" {
+			fmt.Fprintf(&b, "Original-Recipient: %s\r\n", p.ORCPT)
+		}
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", r.Recipient)
+		fmt.Fprintf(&b, "Action: %s\r\n", action)
+		fmt.Fprintf(&b, "Status: %s\r\n", dsnStatus(r, action))
+		if r.Err != nil {
+			fmt.Fprintf(&b, "Diagnostic-Code: smtp; %s\r\n", strings.Replace(r.Err.Error(), "\r\n", " ", -1))
+		}
+	}
+
+	// returned content
+	if envl.DSNRet == RetFull {
+		fmt.Fprintf(&b, "\r\n--%s\r\nContent-Type: message/rfc822\r\n\r\n", boundary)
+		b.Write(data)
+	} else {
+		fmt.Fprintf(&b, "\r\n--%s\r\nContent-Type: text/rfc822-headers\r\n\r\n", boundary)
+		fields, _ := splitMessage(data)
+		for _, f := range fields {
+			b.WriteString(f.raw)
+		}
+	}
+	if !bytes.HasSuffix(b.Bytes(), []byte("\r\n")) {
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+	return b.Bytes()
+}
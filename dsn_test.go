@@ -0,0 +1,218 @@
+package session
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestXtext make sure that xtext is decoded and encoded back
+func TestXtext(t *testing.T) {
+	cases := []struct {
+		encoded, decoded string
+		valid            bool
+	}{
+		{"rfc822;some@domain.com", "rfc822;some@domain.com", true},
+		{"rfc822;a+2Bb@domain.com", "rfc822;a+b@domain.com", true},
+		{"id+20with+3Dspace", "id with=space", true},
+		{"bad+2", "", false},
+		{"bad+ZZ", "", false},
+		{"bad=value", "", false},
+	}
+
+	for _, input := range cases {
+		got, err := decodeXtext(input.encoded)
+		if (err == nil) != input.valid || got != input.decoded {
+			t.Errorf("%q: got %q %v, expected %q", input.encoded, got, err, input.decoded)
+			continue
+		}
+		if input.valid && encodeXtext(got) != input.encoded {
+			t.Errorf("%q: encoded back as %q", input.decoded, encodeXtext(got))
+		}
+	}
+}
+
+// TestParseRcptDSN make sure that NOTIFY and ORCPT are validated
+func TestParseRcptDSN(t *testing.T) {
+	cases := []struct {
+		params map[string]string
+		notify string
+		orcpt  string
+		valid  bool
+	}{
+		{map[string]string{}, "", "", true},
+		{map[string]string{"NOTIFY": "success,delay"}, "SUCCESS,DELAY", "", true},
+		{map[string]string{"NOTIFY": "NEVER"}, "NEVER", "", true},
+		{map[string]string{"NOTIFY": "NEVER,FAILURE"}, "", "", false},
+		{map[string]string{"NOTIFY": "SOMETIMES"}, "", "", false},
+		{map[string]string{"ORCPT": "rfc822;a+2Bb@domain.com"}, "", "rfc822;a+b@domain.com", true},
+		{map[string]string{"ORCPT": "a@domain.com"}, "", "", false},
+	}
+
+	for _, input := range cases {
+		r, err := parseRcptDSN(input.params)
+		if (err == nil) != input.valid {
+			t.Errorf("%v: got error %v, expected valid=%t", input.params, err, input.valid)
+			continue
+		}
+		if r == nil {
+			if input.notify != "" || input.orcpt != "" {
+				t.Errorf("%v: got nil, expected notify %q orcpt %q", input.params, input.notify, input.orcpt)
+			}
+			continue
+		}
+		if strings.Join(r.Notify, ",") != input.notify || r.ORCPT != input.orcpt {
+			t.Errorf("%v: got %+v, expected notify %q orcpt %q", input.params, r, input.notify, input.orcpt)
+		}
+	}
+}
+
+// TestParseMailDSN make sure that RET and ENVID are validated
+func TestParseMailDSN(t *testing.T) {
+	cases := []struct {
+		params map[string]string
+		ret    string
+		envid  string
+		valid  bool
+	}{
+		{map[string]string{"RET": "full", "ENVID": "QQ314159"}, RetFull, "QQ314159", true},
+		{map[string]string{"RET": "HDRS"}, RetHdrs, "", true},
+		{map[string]string{"RET": "BODY"}, "", "", false},
+		{map[string]string{"ENVID": strings.Repeat("x", 101)}, "", "", false},
+	}
+
+	for _, input := range cases {
+		envl := &Envelope{}
+		err := parseMailDSN(input.params, envl)
+		if (err == nil) != input.valid {
+			t.Errorf("%v: got error %v, expected valid=%t", input.params, err, input.valid)
+			continue
+		}
+		if input.valid && (envl.DSNRet != input.ret || envl.DSNEnvID != input.envid) {
+			t.Errorf("%v: got ret %q envid %q, expected %q %q", input.params, envl.DSNRet, envl.DSNEnvID, input.ret, input.envid)
+		}
+	}
+}
+
+// TestSessionDSN make sure that DSN is advertised and invalid
+// parameters are rejected
+func TestSessionDSN(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"EHLO client.com\r\nQUIT\r\n", "250-DSN\r\n"},
+		{"EHLO client.com\r\nMAIL FROM:<some@example.com> RET=HDRS ENVID=QQ314159\r\nQUIT\r\n", "250 2.0.0 OK\r\n"},
+		{"EHLO client.com\r\nMAIL FROM:<some@example.com> RET=BODY\r\nQUIT\r\n", "501 5.5.4 Invalid DSN parameter\r\n"},
+		{"EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<a@domain.com> NOTIFY=NEVER,DELAY\r\nQUIT\r\n", "501 5.5.4 Invalid DSN parameter\r\n"},
+	}
+
+	for _, input := range cases {
+		out := runSession(t, &Config{}, input.input)
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("%q: got %q, expected %q", input.input, out, input.expected)
+		}
+	}
+}
+
+// TestBuildDSN make sure that the report contain per recipient
+// fields and the returned content
+func TestBuildDSN(t *testing.T) {
+	data := []byte("Subject: test\r\nFrom: some@example.com\r\n\r\nsecret body\r\n")
+	envl := &Envelope{
+		OriginatorAddress: "some@example.com",
+		DSNEnvID:          "QQ314159",
+		DSNRcpt: map[string]*DSNRecipient{
+			"a@domain.com": {ORCPT: "rfc822;a@domain.com"},
+		},
+	}
+	results := []*DeliveryResult{{Recipient: "a@domain.com", Err: NewSMTPError(550, [3]int{5, 1, 1}, "unknown user")}}
+
+	cases := []struct {
+		ret      string
+		expected []string
+		absent   string
+	}{
+		{"", []string{
+			"Content-Type: multipart/report; report-type=delivery-status;",
+			"Original-Envelope-Id: QQ314159\r\n",
+			"Original-Recipient: rfc822;a@domain.com\r\n",
+			"Final-Recipient: rfc822; a@domain.com\r\nAction: failed\r\nStatus: 5.1.1\r\n",
+			"Content-Type: text/rfc822-headers\r\n\r\nSubject: test\r\n",
+		}, "secret body"},
+		{RetFull, []string{
+			"Content-Type: message/rfc822\r\n\r\nSubject: test\r\n",
+			"secret body",
+		}, "text/rfc822-headers"},
+	}
+
+	for _, input := range cases {
+		envl.DSNRet = input.ret
+		out := string(BuildDSN("mx.example.org", envl, ActionFailed, results, time.Now(), data))
+		for _, e := range input.expected {
+			if !strings.Contains(out, e) {
+				t.Errorf("RET=%q: %q not found in %q", input.ret, e, out)
+			}
+		}
+		if strings.Contains(out, input.absent) {
+			t.Errorf("RET=%q: %q found in %q", input.ret, input.absent, out)
+		}
+	}
+}
+
+// TestQueueNotify make sure that notifications follow NOTIFY
+// parameter of each recipient
+func TestQueueNotify(t *testing.T) {
+	transport := TransportFunc(func(ctx context.Context, envl *Envelope, data []byte) []*DeliveryResult {
+		var results []*DeliveryResult
+		for _, rcpt := range envl.RecipientAddress {
+			r := &DeliveryResult{Recipient: rcpt}
+			if strings.HasPrefix(rcpt, "unknown") {
+				r.Err = NewSMTPError(550, [3]int{5, 1, 1}, "unknown user")
+			}
+			results = append(results, r)
+		}
+		return results
+	})
+
+	cases := []struct {
+		rcpt     string
+		notify   []string
+		expected string
+	}{
+		{"unknown@domain.com", nil, "Action: failed"},
+		{"unknown@domain.com", []string{NotifyNever}, ""},
+		{"ok@domain.com", nil, ""},
+		{"ok@domain.com", []string{NotifySuccess}, "Action: delivered"},
+	}
+
+	for _, input := range cases {
+		sp := &Spool{Dir: t.TempDir()}
+		q := &Queue{Spool: sp, Transport: transport}
+		envl := &Envelope{
+			OriginatorAddress: "some@example.com",
+			RecipientAddress:  []string{input.rcpt},
+			DSNRcpt:           map[string]*DSNRecipient{input.rcpt: {Notify: input.notify}},
+		}
+		if err := q.Deliver(envl, []byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		q.RunOnce(context.Background())
+
+		ids, _ := sp.List()
+		if input.expected == "" {
+			if len(ids) != 0 {
+				t.Errorf("%s %v: got %d spooled messages, expected none", input.rcpt, input.notify, len(ids))
+			}
+			continue
+		}
+		if len(ids) != 1 {
+			t.Fatalf("%s %v: got %d spooled messages, expected notification", input.rcpt, input.notify, len(ids))
+		}
+		_, data, _ := sp.Read(ids[0])
+		if !strings.Contains(string(data), input.expected) {
+			t.Errorf("%s %v: %q not found in %q", input.rcpt, input.notify, input.expected, data)
+		}
+	}
+}
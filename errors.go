@@ -0,0 +1,85 @@
+package session
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SMTPError represents a SMTP error reply with reply code,
+// enhanced status code (RFC 3463) and one or more lines of text
+type SMTPError struct {
+	Code         int
+	EnhancedCode [3]int
+	Message      []string
+}
+
+// NewSMTPError create a new SMTPError, each of msg become
+// one line of the reply text
+func NewSMTPError(code int, enhanced [3]int, msg ...string) *SMTPError {
+	return &SMTPError{
+		Code:         code,
+		EnhancedCode: enhanced,
+		Message:      msg,
+	}
+}
+
+// Enhanced return the enhanced status code as string like "5.1.1".
+// return empty string if the error doesn't have enhanced status code
+func (e *SMTPError) Enhanced() string {
+	if e.EnhancedCode == [3]int{} {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d.%d", e.EnhancedCode[0], e.EnhancedCode[1], e.EnhancedCode[2])
+}
+
+// Text return the reply text lines prefixed with enhanced status code
+func (e *SMTPError) Text() []string {
+	enhanced := e.Enhanced()
+	if enhanced == "" {
+		return e.Message
+	}
+	if len(e.Message) == 0 {
+		return []string{enhanced}
+	}
+
+	text := make([]string, len(e.Message))
+	for i, m := range e.Message {
+		text[i] = enhanced + " " + m
+	}
+	return text
+}
+
+// Lines render the error as reply lines without <CRLF>
+func (e *SMTPError) Lines() []string {
+	return replyLines(e.Code, e.Text())
+}
+
+// replyLines format reply text with reply code. every line except
+// the last one use "-" as separator after the code
+func replyLines(code int, text []string) []string {
+	if len(text) == 0 {
+		text = []string{""}
+	}
+
+	lines := make([]string, len(text))
+	for i, t := range text {
+		sep := "-"
+		if i == len(text)-1 {
+			sep = " "
+		}
+		lines[i] = strings.TrimRight(fmt.Sprintf("%03d%s%s", code, sep, t), " ")
+	}
+	return lines
+}
+
+// Error render the error as a complete reply, multiline
+// replies are separated by <CRLF>
+func (e *SMTPError) Error() string {
+	return strings.Join(e.Lines(), "\r\n")
+}
+
+// Temporary report whether the error is a transient
+// negative completion reply (4yz)
+func (e *SMTPError) Temporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
@@ -0,0 +1,47 @@
+package session
+
+import (
+	"testing"
+)
+
+// TestSMTPErrorRender make sure that SMTPError rendered as valid
+// single line and multiline replies
+func TestSMTPErrorRender(t *testing.T) {
+	cases := []struct {
+		err      *SMTPError
+		expected string
+	}{
+		{NewSMTPError(555, [3]int{5, 5, 2}, "Syntax error"), "555 5.5.2 Syntax error"},
+		{NewSMTPError(250, [3]int{}, "OK"), "250 OK"},
+		{NewSMTPError(421, [3]int{4, 4, 2}), "421 4.4.2"},
+		{NewSMTPError(550, [3]int{5, 1, 1}, "first", "second", "third"),
+			"550-5.1.1 first\r\n550-5.1.1 second\r\n550 5.1.1 third"},
+	}
+
+	for _, input := range cases {
+		got := input.err.Error()
+		if got != input.expected {
+			t.Errorf("got: %q, expected: %q", got, input.expected)
+		}
+	}
+}
+
+// TestSMTPErrorTemporary make sure that only 4yz replies are temporary
+func TestSMTPErrorTemporary(t *testing.T) {
+	cases := []struct {
+		code      int
+		temporary bool
+	}{
+		{250, false},
+		{421, true},
+		{451, true},
+		{550, false},
+	}
+
+	for _, input := range cases {
+		got := NewSMTPError(input.code, [3]int{}).Temporary()
+		if got != input.temporary {
+			t.Errorf("%d.Temporary() == %t, expected %t", input.code, got, input.temporary)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package session
+
+import (
+	"fmt"
+	"strings"
+)
+
+// etrnArgErr is replied to invalid ETRN argument (RFC 1985)
+var etrnArgErr = NewSMTPError(501, [3]int{5, 5, 4}, "Syntax: ETRN domain")
+
+// ETRN flush the queue of a domain on request of clients with
+// dynamic connectivity (RFC 1985). a client may flush a domain when
+// its IP address is in Networks or it is authenticated as one of
+// Users of the domain
+type ETRN struct {
+	Queue *Queue
+	// Networks map domains to the client networks allowed to
+	// flush them
+	Networks map[string]*AccessList
+	// Users map domains to the users allowed to flush them
+	Users map[string][]string
+}
+
+// Allowed report whether the client may flush domain
+func (e *ETRN) Allowed(s *Session, domain string) bool {
+	domain = strings.ToLower(domain)
+	if e.Networks[domain].MatchIP(s.RemoteIP()) {
+		return true
+	}
+	if s.Principal == nil {
+		return false
+	}
+	for _, user := range e.Users[domain] {
+		if strings.EqualFold(user, s.Principal.Username) {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	RegisterCommand(Command{
+		Verb:     "ETRN",
+		States:   []State{StateHelloed},
+		Validate: validETRN,
+		Handle:   (*Session).cmdETRN,
+	})
+}
+
+// parseETRN return the domain of "domain" or "@domain" argument,
+// queue names of "#queue" are not supported
+func parseETRN(arg string) (domain string, subdomains bool, err error) {
+	arg = strings.TrimSpace(arg)
+	if strings.HasPrefix(arg, "@") {
+		arg, subdomains = arg[1:], true
+	}
+	if arg == "" || strings.ContainsAny(arg, " #@[]") {
+		return "", false, etrnArgErr
+	}
+	return strings.TrimSuffix(arg, "."), subdomains, nil
+}
+
+// validETRN check that ETRN is enabled and the argument is valid
+func validETRN(s *Session, req *CommandRequest) error {
+	if s.Config.ETRN == nil {
+		return notImplementedErr
+	}
+	_, _, err := parseETRN(req.Arg)
+	return err
+}
+
+// cmdETRN start the delivery of messages queued for the domain
+func (s *Session) cmdETRN(req *CommandRequest) error {
+	domain, subdomains, _ := parseETRN(req.Arg)
+	e := s.Config.ETRN
+	if !e.Allowed(s, domain) {
+		s.logf(LevelInfo, "ETRN %s denied", req.Arg)
+		return s.Reply.TransmitErr(NewSMTPError(459, [3]int{4, 7, 1}, "Node "+domain+" not allowed: access denied"))
+	}
+	n, err := e.Queue.FlushDomain(domain, subdomains)
+	if err != nil {
+		s.logf(LevelWarn, "ETRN %s: %v", req.Arg, err)
+		return s.Reply.TransmitErr(NewSMTPError(458, [3]int{4, 3, 0}, "Unable to queue messages for node "+domain))
+	}
+	s.logf(LevelInfo, "ETRN %s flushed %d messages", req.Arg, n)
+	if n == 0 {
+		return s.Reply.Transmit(fmt.Sprintf("251 2.0.0 No messages waiting for node %s", domain))
+	}
+	return s.Reply.Transmit(fmt.Sprintf("253 2.0.0 OK, %d pending messages for node %s started", n, domain))
+}
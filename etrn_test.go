@@ -0,0 +1,98 @@
+package session
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseETRN make sure that domain and subdomain forms are accepted
+func TestParseETRN(t *testing.T) {
+	cases := []struct {
+		arg        string
+		domain     string
+		subdomains bool
+		valid      bool
+	}{
+		{"example.com", "example.com", false, true},
+		{"@example.com.", "example.com", true, true},
+		{"#queue", "", false, false},
+		{"", "", false, false},
+		{"@", "", false, false},
+		{"user@example.com", "", false, false},
+	}
+
+	for _, input := range cases {
+		domain, subdomains, err := parseETRN(input.arg)
+		if (err == nil) != input.valid || domain != input.domain || subdomains != input.subdomains {
+			t.Errorf("%q: got %q %t %v, expected %q %t valid=%t", input.arg, domain, subdomains, err,
+				input.domain, input.subdomains, input.valid)
+		}
+	}
+}
+
+// TestSessionETRN make sure that authorized clients flush the queued
+// messages of their domain before they are due
+func TestSessionETRN(t *testing.T) {
+	var sent []string
+	fail := true
+	transport := TransportFunc(func(ctx context.Context, envl *Envelope, data []byte) []*DeliveryResult {
+		var results []*DeliveryResult
+		for _, rcpt := range envl.RecipientAddress {
+			r := &DeliveryResult{Recipient: rcpt}
+			if fail {
+				r.Err = NewSMTPError(421, [3]int{4, 4, 2}, "not connected")
+			} else {
+				sent = append(sent, rcpt)
+			}
+			results = append(results, r)
+		}
+		return results
+	})
+	q := &Queue{Spool: &Spool{Dir: t.TempDir()}, Transport: transport, MinRetry: time.Hour}
+	for _, rcpt := range []string{"a@example.com", "b@sub.example.com", "c@example.org"} {
+		if err := q.Deliver(&Envelope{OriginatorAddress: "some@example.net", RecipientAddress: []string{rcpt}}, []byte("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.RunOnce(context.Background())
+	fail = false
+
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	allowed, _ := ParseAccessList([]string{local.String()})
+	config := &Config{ETRN: &ETRN{Queue: q, Networks: map[string]*AccessList{"example.com": allowed}}}
+
+	cases := []struct {
+		arg      string
+		expected string
+		sent     string
+	}{
+		{"example.org", "459 4.7.1 Node example.org not allowed", ""},
+		{"#mail", "501 5.5.4", ""},
+		{"example.com", "253 2.0.0 OK, 1 pending messages for node example.com started", "a@example.com"},
+		{"@example.com", "253 2.0.0 OK, 1 pending messages for node example.com started", "b@sub.example.com"},
+	}
+
+	for _, input := range cases {
+		sent = nil
+		out := runSessionFrom(t, config, "127.0.0.1:2525", "EHLO client\r\nETRN "+input.arg+"\r\nQUIT\r\n")
+		if !strings.Contains(out, "ETRN\r\n") || !strings.Contains(out, input.expected) {
+			t.Errorf("%s: got %q, expected %q", input.arg, out, input.expected)
+		}
+		q.RunOnce(context.Background())
+		if got := strings.Join(sent, ","); got != input.sent {
+			t.Errorf("%s: got sent %q, expected %q", input.arg, got, input.sent)
+		}
+	}
+
+	out := runSessionFrom(t, config, "127.0.0.1:2525", "EHLO client\r\nETRN example.com\r\nQUIT\r\n")
+	if !strings.Contains(out, "251 2.0.0 No messages waiting for node example.com") {
+		t.Errorf("got %q, expected no messages", out)
+	}
+	out = runSessionFrom(t, &Config{}, "127.0.0.1:2525", "EHLO client\r\nETRN example.com\r\nQUIT\r\n")
+	if strings.Contains(out, "ETRN") || !strings.Contains(out, "502 5.5.1") {
+		t.Errorf("got %q, expected ETRN not implemented", out)
+	}
+}
@@ -0,0 +1,174 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaults of FeedFetcher
+const (
+	defaultFeedInterval = time.Hour
+	maxFeedSize         = 32 << 20
+)
+
+// feed formats
+const (
+	FeedText = "text"
+	FeedJSON = "json"
+)
+
+// Feed is a blocklist or allowlist downloaded over HTTPS
+type Feed struct {
+	Name string
+	URL  string
+	// Format is FeedText (one entry per line) or FeedJSON (array of
+	// entries or object with "entries" array), default to the
+	// Content-Type of the response
+	Format string
+	// Allow mark the feed as allowlist
+	Allow bool
+}
+
+// FeedFetcher periodically download feeds and swap them into Access.
+// unchanged feeds are detected with ETag, a failed download keep
+// the previous list
+type FeedFetcher struct {
+	Access *Access
+	Feeds  []Feed
+	// Interval between downloads, default to 1 hour
+	Interval time.Duration
+	// Client default to http.DefaultClient
+	Client *http.Client
+	// Logger receive the errors of Run, default to the standard
+	// logger
+	Logger *Logger
+
+	mu    sync.Mutex
+	etags map[string]string
+}
+
+// Run fetch the feeds immediately and then every Interval
+// until ctx is done
+func (f *FeedFetcher) Run(ctx context.Context) {
+	t := time.NewTicker(durationOr(f.Interval, defaultFeedInterval))
+	defer t.Stop()
+	for {
+		if err := f.Fetch(ctx); err != nil {
+			logf(f.Logger, LevelWarn, "feed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Fetch download every feed once, the first error is returned
+// after all feeds are tried
+func (f *FeedFetcher) Fetch(ctx context.Context) error {
+	var first error
+	for _, feed := range f.Feeds {
+		if err := f.fetch(ctx, feed); err != nil && first == nil {
+			first = fmt.Errorf("%s: %v", feed.Name, err)
+		}
+	}
+	return first
+}
+
+func (f *FeedFetcher) fetch(ctx context.Context, feed Feed) error {
+	u, err := url.Parse(feed.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("feed URL must use https")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feed.URL, nil)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	etag := f.etags[feed.URL]
+	f.mu.Unlock()
+	if etag != "" && f.Access.Feed(feed.Name) != nil {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxFeedSize {
+		return fmt.Errorf("feed larger than %d bytes", maxFeedSize)
+	}
+
+	format := feed.Format
+	if format == "" {
+		format = FeedText
+		if strings.Contains(resp.Header.Get("Content-Type"), "json") {
+			format = FeedJSON
+		}
+	}
+	l, err := parseFeed(format, data)
+	if err != nil {
+		return err
+	}
+
+	f.Access.SetFeed(feed.Name, feed.Allow, l)
+	f.mu.Lock()
+	if f.etags == nil {
+		f.etags = make(map[string]string)
+	}
+	f.etags[feed.URL] = resp.Header.Get("ETag")
+	f.mu.Unlock()
+	return nil
+}
+
+// parseFeed parse feed data in format
+func parseFeed(format string, data []byte) (*AccessList, error) {
+	switch format {
+	case FeedText:
+		return ReadAccessList(bytes.NewReader(data))
+	case FeedJSON:
+		var entries []string
+		if err := json.Unmarshal(data, &entries); err != nil {
+			var obj struct {
+				Entries []string `json:"entries"`
+			}
+			if err := json.Unmarshal(data, &obj); err != nil {
+				return nil, err
+			}
+			entries = obj.Entries
+		}
+		return ParseAccessList(entries)
+	}
+	return nil, fmt.Errorf("unknown feed format %q", format)
+}
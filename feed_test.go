@@ -0,0 +1,84 @@
+package session
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestFeedFetcher make sure that feeds are parsed, swapped and
+// cached with ETag
+func TestFeedFetcher(t *testing.T) {
+	var notModified int
+	body := "192.0.2.0/24\n"
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/block.txt":
+			if r.Header.Get("If-None-Match") == `"v1"` && body == "192.0.2.0/24\n" {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(body))
+		case "/allow.json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"entries": ["192.0.2.1"]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	access := &Access{}
+	f := &FeedFetcher{
+		Access: access,
+		Client: srv.Client(),
+		Feeds: []Feed{
+			{Name: "block", URL: srv.URL + "/block.txt"},
+			{Name: "allow", URL: srv.URL + "/allow.json", Allow: true},
+		},
+	}
+	if err := f.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"192.0.2.1", false},
+		{"192.0.2.2", true},
+		{"198.51.100.1", false},
+	}
+	for _, input := range cases {
+		if got := access.BlockedIP(net.ParseIP(input.ip)); got != input.blocked {
+			t.Errorf("%q: got blocked %t, expected %t", input.ip, got, input.blocked)
+		}
+	}
+
+	// unchanged feed is not downloaded again
+	f.Fetch(context.Background())
+	if notModified != 1 {
+		t.Errorf("got %d not modified responses, expected 1", notModified)
+	}
+
+	// failed feed keep the previous list
+	body = "invalid/99\n"
+	if err := f.Fetch(context.Background()); err == nil {
+		t.Errorf("invalid feed should fail")
+	}
+	if !access.BlockedIP(net.ParseIP("192.0.2.2")) {
+		t.Errorf("previous list should be kept")
+	}
+}
+
+// TestFeedHTTPS make sure that feeds are only fetched over HTTPS
+func TestFeedHTTPS(t *testing.T) {
+	f := &FeedFetcher{Access: &Access{}, Feeds: []Feed{{Name: "plain", URL: "http://example.com/list.txt"}}}
+	if err := f.Fetch(context.Background()); err == nil {
+		t.Errorf("plain HTTP feed should fail")
+	}
+}
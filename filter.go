@@ -0,0 +1,38 @@
+package session
+
+import "context"
+
+// Filter inspect or rewrite message data after DATA, returning an
+// error reject the message
+type Filter interface {
+	Filter(envl *Envelope, data []byte) ([]byte, error)
+}
+
+// FilterFunc is an adapter to allow the use of ordinary
+// functions as Filter
+type FilterFunc func(envl *Envelope, data []byte) ([]byte, error)
+
+// Filter call f(envl, data)
+func (f FilterFunc) Filter(envl *Envelope, data []byte) ([]byte, error) {
+	return f(envl, data)
+}
+
+// filter run every configured filter in order, Envelope.Context of
+// the filters is ctx of the data stage
+func (s *Session) filter(ctx context.Context, envl *Envelope, data []byte) ([]byte, error) {
+	tctx := envl.ctx
+	envl.ctx = ctx
+	defer func() { envl.ctx = tctx }()
+	for _, f := range s.Config.Filters {
+		if sim, ok := f.(*Simulation); ok {
+			sim.simulateFilter(s, envl, data)
+			continue
+		}
+		var err error
+		data, err = f.Filter(envl, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,95 @@
+package session
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// default maximum hold of FutureRelease
+const defaultMaxHold = 7 * 24 * time.Hour
+
+var (
+	// holdSyntaxErr is sent for malformed or out of range HOLDFOR
+	// and HOLDUNTIL parameters (RFC 4865 section 5)
+	holdSyntaxErr = NewSMTPError(501, [3]int{5, 5, 4}, "Invalid HOLDFOR or HOLDUNTIL parameter")
+	// holdAuthErr is sent when unauthenticated client ask for
+	// future release
+	holdAuthErr = NewSMTPError(554, [3]int{5, 7, 1}, "Future release requires authentication")
+	// holdUnsupportedErr is sent for HOLDFOR and HOLDUNTIL when
+	// FutureRelease isn't configured
+	holdUnsupportedErr = NewSMTPError(555, [3]int{5, 5, 4}, "HOLDFOR and HOLDUNTIL not supported")
+)
+
+// FutureRelease let authenticated clients hold messages in the queue
+// until a later time with HOLDFOR and HOLDUNTIL parameters of MAIL
+// (RFC 4865). the release time is kept in Envelope.HoldUntil and the
+// message is not attempted before it, even by ETRN and ATRN
+type FutureRelease struct {
+	// MaxHold is the longest hold accepted, default to 7 days
+	MaxHold time.Duration
+}
+
+// maxHold return MaxHold or its default
+func (f *FutureRelease) maxHold() time.Duration {
+	return durationOr(f.MaxHold, defaultMaxHold)
+}
+
+// extension return FUTURERELEASE keyword with the maximum interval
+// in seconds and the maximum release date
+func (f *FutureRelease) extension(now time.Time) string {
+	max := f.maxHold()
+	return "FUTURERELEASE " + strconv.FormatInt(int64(max/time.Second), 10) + " " +
+		now.Add(max).UTC().Format(time.RFC3339)
+}
+
+// parse return the release time of HOLDFOR or HOLDUNTIL in params,
+// zero when there is none or it is already past
+func (f *FutureRelease) parse(params map[string]string, now time.Time) (time.Time, error) {
+	holdFor, hasFor := params["HOLDFOR"]
+	holdUntil, hasUntil := params["HOLDUNTIL"]
+	var release time.Time
+	switch {
+	case hasFor && hasUntil:
+		return time.Time{}, holdSyntaxErr
+	case hasFor:
+		n, err := strconv.ParseUint(holdFor, 10, 32)
+		if err != nil || len(holdFor) > 9 {
+			return time.Time{}, holdSyntaxErr
+		}
+		release = now.Add(time.Duration(n) * time.Second)
+	case hasUntil:
+		t, err := time.Parse(time.RFC3339, strings.ToUpper(holdUntil))
+		if err != nil {
+			return time.Time{}, holdSyntaxErr
+		}
+		release = t
+	default:
+		return time.Time{}, nil
+	}
+	if release.Sub(now) > f.maxHold() {
+		return time.Time{}, holdSyntaxErr
+	}
+	if !release.After(now) {
+		return time.Time{}, nil
+	}
+	return release.UTC(), nil
+}
+
+// mailHold return the release time asked in MAIL parameters, only
+// authenticated clients may hold messages
+func (s *Session) mailHold(params map[string]string) (time.Time, error) {
+	_, hasFor := params["HOLDFOR"]
+	_, hasUntil := params["HOLDUNTIL"]
+	if !hasFor && !hasUntil {
+		return time.Time{}, nil
+	}
+	f := s.Config.FutureRelease
+	if f == nil {
+		return time.Time{}, holdUnsupportedErr
+	}
+	if s.Principal == nil {
+		return time.Time{}, holdAuthErr
+	}
+	return f.parse(params, time.Now())
+}
@@ -0,0 +1,136 @@
+package session
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFutureReleaseParse make sure that HOLDFOR and HOLDUNTIL are
+// validated against MaxHold
+func TestFutureReleaseParse(t *testing.T) {
+	f := &FutureRelease{MaxHold: 24 * time.Hour}
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		params   map[string]string
+		expected time.Time
+		err      error
+	}{
+		{map[string]string{}, time.Time{}, nil},
+		{map[string]string{"HOLDFOR": "3600"}, now.Add(time.Hour), nil},
+		{map[string]string{"HOLDFOR": "0"}, time.Time{}, nil},
+		{map[string]string{"HOLDFOR": "86401"}, time.Time{}, holdSyntaxErr},
+		{map[string]string{"HOLDFOR": "-1"}, time.Time{}, holdSyntaxErr},
+		{map[string]string{"HOLDUNTIL": "2026-10-17T20:00:00+02:00"}, now.Add(6 * time.Hour), nil},
+		{map[string]string{"HOLDUNTIL": "2026-10-17t13:30:00z"}, now.Add(90 * time.Minute), nil},
+		{map[string]string{"HOLDUNTIL": "2026-10-16T12:00:00Z"}, time.Time{}, nil},
+		{map[string]string{"HOLDUNTIL": "2026-10-19T12:00:00Z"}, time.Time{}, holdSyntaxErr},
+		{map[string]string{"HOLDUNTIL": "tomorrow"}, time.Time{}, holdSyntaxErr},
+		{map[string]string{"HOLDFOR": "60", "HOLDUNTIL": "2026-10-17T13:00:00Z"}, time.Time{}, holdSyntaxErr},
+	}
+	for _, input := range cases {
+		got, err := f.parse(input.params, now)
+		if !got.Equal(input.expected) || err != input.err {
+			t.Errorf("%v: got %v %v, expected %v %v", input.params, got, err, input.expected, input.err)
+		}
+	}
+}
+
+// TestSessionFutureRelease make sure that only authenticated clients
+// may hold messages and FUTURERELEASE is advertised
+func TestSessionFutureRelease(t *testing.T) {
+	auth := "AUTH PLAIN " + plainResponse("user", "secret") + "\r\n"
+	cases := []struct {
+		config bool
+		auth   bool
+		param  string
+		reply  string
+		held   bool
+	}{
+		{true, true, " HOLDFOR=3600", "250 2.0.0 OK", true},
+		{true, true, "", "250 2.0.0 OK", false},
+		{true, true, " HOLDFOR=999999", "501 5.5.4", false},
+		{true, false, " HOLDFOR=3600", "554 5.7.1", false},
+		{false, true, " HOLDFOR=3600", "555 5.5.4", false},
+	}
+	for _, input := range cases {
+		var envl *Envelope
+		config := &Config{
+			Authenticator:      testAuthenticator,
+			AuthAllowPlaintext: true,
+			Backend: BackendFunc(func(e *Envelope, data []byte) error {
+				envl = e
+				return nil
+			}),
+		}
+		if input.config {
+			config.FutureRelease = &FutureRelease{}
+		}
+		session := "EHLO client.com\r\n"
+		if input.auth {
+			session += auth
+		}
+		session += "MAIL FROM:<user@example.com>" + input.param + "\r\nRCPT TO:<some@domain.com>\r\nDATA\r\nSubject: a\r\n\r\nbody\r\n.\r\nQUIT\r\n"
+		out := runSession(t, config, session)
+		if !strings.Contains(out, input.reply) {
+			t.Errorf("%v %q: got %q, expected %q", input.config, input.param, out, input.reply)
+			continue
+		}
+		if input.config && !strings.Contains(out, "FUTURERELEASE 604800 ") {
+			t.Errorf("%q: FUTURERELEASE not advertised in %q", input.param, out)
+		}
+		if input.held && (envl == nil || time.Until(envl.HoldUntil) < 59*time.Minute) {
+			t.Errorf("%q: got envelope %+v, expected held for an hour", input.param, envl)
+		}
+	}
+}
+
+// TestQueueHold make sure that held messages are neither attempted
+// nor flushed before their release
+func TestQueueHold(t *testing.T) {
+	var sent int
+	transport := TransportFunc(func(ctx context.Context, envl *Envelope, data []byte) []*DeliveryResult {
+		sent++
+		return []*DeliveryResult{{Recipient: envl.RecipientAddress[0]}}
+	})
+	sp := &Spool{Dir: t.TempDir()}
+	q := &Queue{Spool: sp, Transport: transport}
+	envl := &Envelope{
+		OriginatorAddress: "some@example.com",
+		RecipientAddress:  []string{"some@domain.com"},
+		HoldUntil:         time.Now().Add(time.Hour),
+	}
+	if err := q.Deliver(envl, []byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	q.RunOnce(context.Background())
+	if n, err := q.FlushDomain("domain.com", false); n != 0 || err != nil {
+		t.Errorf("got %d flushed %v, expected held message to stay", n, err)
+	}
+	n, err := q.DeliverDomains(context.Background(), []string{"domain.com"}, func() (Transport, error) {
+		return transport, nil
+	})
+	if n != 0 || err != nil || sent != 0 {
+		t.Fatalf("got %d sent, expected held message to stay", sent)
+	}
+
+	ids, _ := sp.List()
+	rec, err := sp.readRecord(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.NextAttempt.Equal(envl.HoldUntil) {
+		t.Errorf("got next attempt %v, expected %v", rec.NextAttempt, envl.HoldUntil)
+	}
+	rec.Envelope.HoldUntil = time.Now().Add(-time.Second)
+	rec.NextAttempt = rec.Envelope.HoldUntil
+	if err := sp.writeRecord(ids[0], rec); err != nil {
+		t.Fatal(err)
+	}
+	q.RunOnce(context.Background())
+	if sent != 1 {
+		t.Errorf("got %d sent, expected released message", sent)
+	}
+}
@@ -0,0 +1,40 @@
+package session
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// earlyTalkerErr is sent to clients that talk before the greeting
+var earlyTalkerErr = NewSMTPError(554, [3]int{5, 5, 1}, "Protocol error: talked before greeting")
+
+// checkEarlyTalker wait Config.GreetDelay before the greeting and
+// reject the client when it send anything meanwhile. RFC 5321
+// clients wait for the greeting, spam bots often don't
+func (s *Session) checkEarlyTalker() error {
+	delay := s.Config.GreetDelay
+	if delay <= 0 {
+		return nil
+	}
+	// data of a pipelined PROXY header or TLS handshake
+	if s.Reader.Buffered() > 0 {
+		return earlyTalkerErr
+	}
+
+	s.Conn.SetReadDeadline(time.Now().Add(delay))
+	_, err := s.Reader.Peek(1)
+	s.Conn.SetReadDeadline(time.Time{})
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		// server began draining while waiting
+		if s.drained() {
+			s.Conn.SetReadDeadline(time.Now())
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return earlyTalkerErr
+}
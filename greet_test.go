@@ -0,0 +1,44 @@
+package session
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSessionEarlyTalker make sure that clients sending commands
+// before the greeting are rejected and patient clients are greeted
+func TestSessionEarlyTalker(t *testing.T) {
+	config := &Config{GreetDelay: 50 * time.Millisecond}
+	out := runSession(t, config, "HELO client.com\r\nQUIT\r\n")
+	if !strings.HasPrefix(out, "554 5.5.1 Protocol error: talked before greeting\r\n") || strings.Contains(out, "220") {
+		t.Errorf("early talker: got %q", out)
+	}
+
+	server, client := net.Pipe()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	s := New(server, wg, nil)
+	s.Config = config
+	go s.Serve()
+
+	start := time.Now()
+	r := bufio.NewReader(client)
+	greeting, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(greeting, "220 ") || time.Since(start) < config.GreetDelay {
+		t.Errorf("patient client: got %q after %v", greeting, time.Since(start))
+	}
+	fmt.Fprint(client, "QUIT\r\n")
+	if reply, _ := r.ReadString('\n'); !strings.HasPrefix(reply, "221 ") {
+		t.Errorf("patient client: got %q, expected 221", reply)
+	}
+	client.Close()
+	wg.Wait()
+}
@@ -0,0 +1,139 @@
+package session
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// default timeout of DNS lookups of HeloPolicy
+const defaultHeloTimeout = 5 * time.Second
+
+// default replies of HeloPolicy checks
+var (
+	heloBareIPErr     = NewSMTPError(501, [3]int{5, 5, 2}, "IP address must be written as address literal")
+	heloOwnNameErr    = NewSMTPError(550, [3]int{5, 7, 1}, "You are not me")
+	heloUnresolvedErr = NewSMTPError(550, [3]int{5, 7, 1}, "Hostname does not resolve")
+	heloRDNSErr       = NewSMTPError(550, [3]int{5, 7, 1}, "Hostname does not match reverse DNS")
+	heloTempErr       = NewSMTPError(450, [3]int{4, 4, 3}, "Temporary DNS failure checking hostname")
+)
+
+// HeloPolicy check the hostname of HELO and EHLO. each check is
+// enabled on its own, the message replace the text of its default
+// reply. clients allowlisted by Config.Access are not checked
+type HeloPolicy struct {
+	// RejectBareIP reject IP addresses not written as address
+	// literal like [192.0.2.1]
+	RejectBareIP  bool
+	BareIPMessage string
+
+	// RejectOwnName reject our own Hostname and address literal of
+	// the local address, clients claiming them are forged
+	RejectOwnName  bool
+	OwnNameMessage string
+
+	// RequireResolve reject hostnames without A or AAAA record
+	RequireResolve    bool
+	UnresolvedMessage string
+
+	// RequireRDNS reject hostnames that are not a PTR name of
+	// the client address
+	RequireRDNS bool
+	RDNSMessage string
+
+	// Timeout limit DNS lookups, default to 5s. lookups failing
+	// for other reasons than a missing name tempfail the command
+	Timeout time.Duration
+}
+
+// reject return the reply of a failed check with message as text
+func (p *HeloPolicy) reject(err *SMTPError, message string) error {
+	if message == "" {
+		return err
+	}
+	return NewSMTPError(err.Code, err.EnhancedCode, message)
+}
+
+// Check check the hostname name of HELO sent by client remote to
+// server local. domains are compared without trailing dot
+func (p *HeloPolicy) Check(ctx context.Context, resolver Resolver, name, hostname string, local, remote net.IP) error {
+	if p.RejectBareIP && net.ParseIP(name) != nil {
+		return p.reject(heloBareIPErr, p.BareIPMessage)
+	}
+
+	literal := strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]")
+	if p.RejectOwnName {
+		own := strings.EqualFold(trimDot(name), trimDot(hostname))
+		if literal && local != nil {
+			ip := net.ParseIP(strings.TrimPrefix(strings.ToUpper(name[1:len(name)-1]), "IPV6:"))
+			own = local.Equal(ip) && !local.IsLoopback()
+		}
+		if own {
+			return p.reject(heloOwnNameErr, p.OwnNameMessage)
+		}
+	}
+
+	// address literals and IPs have no name to look up
+	if literal || net.ParseIP(name) != nil || (!p.RequireResolve && !p.RequireRDNS) {
+		return nil
+	}
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = defaultHeloTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if p.RequireResolve {
+		if _, err := resolver.LookupHost(ctx, name); err != nil {
+			if isNotFound(err) {
+				return p.reject(heloUnresolvedErr, p.UnresolvedMessage)
+			}
+			return heloTempErr
+		}
+	}
+	if p.RequireRDNS && remote != nil {
+		names, err := resolver.LookupAddr(ctx, remote.String())
+		if err != nil && !isNotFound(err) {
+			return heloTempErr
+		}
+		for _, n := range names {
+			if strings.EqualFold(trimDot(n), trimDot(name)) {
+				return nil
+			}
+		}
+		return p.reject(heloRDNSErr, p.RDNSMessage)
+	}
+	return nil
+}
+
+// trimDot remove the trailing dot of absolute domain name
+func trimDot(name string) string {
+	return strings.TrimSuffix(name, ".")
+}
+
+// isNotFound report whether err of DNS lookup is a missing name
+func isNotFound(err error) bool {
+	de, ok := err.(*net.DNSError)
+	return ok && de.IsNotFound
+}
+
+// checkHelo check the hostname of HELO or EHLO with Config.Helo
+func (s *Session) checkHelo(name string) error {
+	p := s.Config.Helo
+	if p == nil {
+		return nil
+	}
+	remote := s.RemoteIP()
+	if s.Config.Access.AllowedIP(remote) {
+		return nil
+	}
+	var local net.IP
+	if addr := s.Conn.LocalAddr(); addr != nil {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			local = net.ParseIP(host)
+		}
+	}
+	return p.Check(s.traceContext(), s.Config.resolver(), name, s.Hostname(), local, remote)
+}
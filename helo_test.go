@@ -0,0 +1,57 @@
+package session
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestHeloPolicy make sure that each check of HELO hostname is
+// applied only when enabled
+func TestHeloPolicy(t *testing.T) {
+	r := &fakeResolver{
+		hosts: map[string][]string{"client.example.org": {"192.0.2.1"}, "other.example.org": {"192.0.2.9"}},
+		ptrs:  map[string][]string{"192.0.2.1": {"client.example.org."}},
+	}
+	local, remote := net.ParseIP("192.0.2.25"), net.ParseIP("192.0.2.1")
+	cases := []struct {
+		policy   HeloPolicy
+		name     string
+		expected string
+	}{
+		{HeloPolicy{}, "192.0.2.1", ""},
+		{HeloPolicy{RejectBareIP: true}, "192.0.2.1", "501 5.5.2 IP address must be written as address literal"},
+		{HeloPolicy{RejectBareIP: true, BareIPMessage: "Use [192.0.2.1]"}, "2001:db8::1", "501 5.5.2 Use [192.0.2.1]"},
+		{HeloPolicy{RejectBareIP: true}, "[192.0.2.1]", ""},
+		{HeloPolicy{RejectOwnName: true}, "MX.example.com.", "550 5.7.1 You are not me"},
+		{HeloPolicy{RejectOwnName: true}, "[192.0.2.25]", "550 5.7.1 You are not me"},
+		{HeloPolicy{RejectOwnName: true}, "[192.0.2.1]", ""},
+		{HeloPolicy{RequireResolve: true}, "client.example.org", ""},
+		{HeloPolicy{RequireResolve: true, UnresolvedMessage: "Who are you"}, "unknown.example.org", "550 5.7.1 Who are you"},
+		{HeloPolicy{RequireResolve: true}, "[192.0.2.1]", ""},
+		{HeloPolicy{RequireRDNS: true}, "client.example.org", ""},
+		{HeloPolicy{RequireRDNS: true}, "other.example.org", "550 5.7.1 Hostname does not match reverse DNS"},
+	}
+
+	for _, input := range cases {
+		got := ""
+		if err := input.policy.Check(context.Background(), r, input.name, "mx.example.com", local, remote); err != nil {
+			got = err.Error()
+		}
+		if got != input.expected {
+			t.Errorf("%+v %q: got %q, expected %q", input.policy, input.name, got, input.expected)
+		}
+	}
+}
+
+// TestSessionHelo make sure that rejected HELO leave the session
+// waiting for a valid greeting
+func TestSessionHelo(t *testing.T) {
+	config := &Config{Hostname: "mx.example.com", Helo: &HeloPolicy{RejectOwnName: true}}
+	out := runSession(t, config, "EHLO mx.example.com\r\nMAIL FROM:<some@example.com>\r\nHELO client.com\r\nQUIT\r\n")
+	expected := "550 5.7.1 You are not me\r\n503 5.5.1 HELO/EHLO first\r\n250 2.0.0 OK\r\n221"
+	if !strings.Contains(out, expected) {
+		t.Errorf("got %q, expected %q", out, expected)
+	}
+}
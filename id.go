@@ -0,0 +1,46 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// idAlphabet is the Crockford base32 alphabet, IDs have no ambiguous
+// letters and sort like the time they were generated at
+const idAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// idLen is the length of IDs: 80 bits in base32
+const idLen = 16
+
+// newID return a unique ID of session or message: 48 bits of unix
+// time in milliseconds followed by 32 random bits, in base32
+func newID() string {
+	return formatID(time.Now(), randomUint32())
+}
+
+// formatID return the ID of time t and random bits r
+func formatID(t time.Time, r uint32) string {
+	hi := uint64(t.UnixMilli()) & (1<<48 - 1)
+	lo := uint64(r)
+	// 80 bits are 16 groups of 5 bits, 10 of hi and lo each
+	v := hi<<2 | lo>>30
+	var b [idLen]byte
+	for i := 9; i >= 0; i-- {
+		b[i] = idAlphabet[v&31]
+		v >>= 5
+	}
+	v = lo & (1<<30 - 1)
+	for i := idLen - 1; i >= 10; i-- {
+		b[i] = idAlphabet[v&31]
+		v >>= 5
+	}
+	return string(b[:])
+}
+
+// randomUint32 return 32 random bits
+func randomUint32() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
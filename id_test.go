@@ -0,0 +1,48 @@
+package session
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFormatID make sure that IDs have a fixed length and sort
+// like the time they were generated at
+func TestFormatID(t *testing.T) {
+	t0 := time.UnixMilli(1700000000000)
+	cases := []struct {
+		a, b string
+	}{
+		{formatID(t0, 0xffffffff), formatID(t0.Add(time.Millisecond), 0)},
+		{formatID(t0, 0), formatID(t0, 1)},
+		{formatID(t0.Add(time.Hour), 0xffffffff), formatID(t0.Add(24*time.Hour), 0)},
+	}
+
+	for _, input := range cases {
+		if len(input.a) != idLen || len(input.b) != idLen {
+			t.Errorf("%q, %q: expected length %d", input.a, input.b, idLen)
+		}
+		if input.a >= input.b {
+			t.Errorf("got %q >= %q, expected ID to sort by time", input.a, input.b)
+		}
+	}
+	if id := newID(); strings.Trim(id, idAlphabet) != "" {
+		t.Errorf("got %q, expected only letters of %q", id, idAlphabet)
+	}
+}
+
+// TestSessionQueuedID make sure that the reply to DATA give the ID
+// of the message seen by the backend
+func TestSessionQueuedID(t *testing.T) {
+	var id string
+	config := &Config{
+		Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			id = envl.ID
+			return nil
+		}),
+	}
+	out := runSession(t, config, "HELO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\nSubject: a\r\n\r\n.\r\nQUIT\r\n")
+	if len(id) != idLen || !strings.Contains(out, "250 2.0.0 OK: queued as "+id+"\r\n221") {
+		t.Errorf("got %q, expected message ID %q in reply", out, id)
+	}
+}
@@ -0,0 +1,209 @@
+package session
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// punycode parameters (RFC 3492 section 5)
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+	acePrefix       = "xn--"
+)
+
+var errPunycode = errors.New("session: invalid punycode")
+
+// isASCII report whether s contains only ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyThreshold(k, bias int) int {
+	t := k - bias
+	if t < punyTMin {
+		return punyTMin
+	}
+	if t > punyTMax {
+		return punyTMax
+	}
+	return t
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// punyEncode encode a label into punycode without ACE prefix
+func punyEncode(label string) string {
+	runes := []rune(label)
+	var out strings.Builder
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out.WriteRune(r)
+		}
+	}
+	b := out.Len()
+	h := b
+	if b > 0 {
+		out.WriteByte('-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for h < len(runes) {
+		m := int(utf8.MaxRune)
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out.WriteByte(punyDigit(t + (q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out.WriteByte(punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return out.String()
+}
+
+// punyDecode decode punycode label without ACE prefix
+func punyDecode(s string) (string, error) {
+	var output []rune
+	pos := 0
+	if b := strings.LastIndexByte(s, '-'); b > 0 {
+		output = []rune(s[:b])
+		pos = b + 1
+	}
+
+	n, i, bias := punyInitialN, 0, punyInitialBias
+	for pos < len(s) {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos >= len(s) {
+				return "", errPunycode
+			}
+			c := s[pos]
+			pos++
+			var digit int
+			switch {
+			case c >= 'a' && c <= 'z':
+				digit = int(c - 'a')
+			case c >= 'A' && c <= 'Z':
+				digit = int(c - 'A')
+			case c >= '0' && c <= '9':
+				digit = int(c-'0') + 26
+			default:
+				return "", errPunycode
+			}
+			i += digit * w
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			w *= punyBase - t
+			if w > utf8.MaxRune {
+				return "", errPunycode
+			}
+		}
+		bias = punyAdapt(i-oldi, len(output)+1, oldi == 0)
+		n += i / (len(output) + 1)
+		i %= len(output) + 1
+		if n > utf8.MaxRune {
+			return "", errPunycode
+		}
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = rune(n)
+		i++
+	}
+	return string(output), nil
+}
+
+// ToASCII convert internationalized domain name into its ASCII form
+// like "xn--bcher-kva.de". labels are lowercased, full IDNA mapping
+// and normalization is not performed
+func ToASCII(domain string) string {
+	if isASCII(domain) {
+		return domain
+	}
+	labels := strings.Split(domain, ".")
+	for i, l := range labels {
+		if !isASCII(l) {
+			labels[i] = acePrefix + punyEncode(strings.ToLower(l))
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// ToUnicode convert ASCII form of domain name back to Unicode,
+// labels that are not valid punycode are kept as is
+func ToUnicode(domain string) string {
+	labels := strings.Split(domain, ".")
+	for i, l := range labels {
+		if len(l) > len(acePrefix) && strings.EqualFold(l[:len(acePrefix)], acePrefix) {
+			if u, err := punyDecode(l[len(acePrefix):]); err == nil {
+				labels[i] = u
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// asciiAddress convert domain of addr into ASCII form. ok is false
+// when the local part is not ASCII and can't be downgraded
+func asciiAddress(addr string) (string, bool) {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return addr, isASCII(addr)
+	}
+	return addr[:i+1] + ToASCII(addr[i+1:]), isASCII(addr[:i])
+}
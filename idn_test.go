@@ -0,0 +1,79 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestToASCII(t *testing.T) {
+	cases := []struct {
+		unicode, ascii string
+	}{
+		{"domain.com", "domain.com"},
+		{"bücher.de", "xn--bcher-kva.de"},
+		{"münchen.de", "xn--mnchen-3ya.de"},
+		{"пример.рф", "xn--e1afmkfd.xn--p1ai"},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah"},
+	}
+
+	for _, input := range cases {
+		if got := ToASCII(input.unicode); got != input.ascii {
+			t.Errorf("ToASCII(%q) == %q, expected %q", input.unicode, got, input.ascii)
+		}
+		if got := ToUnicode(input.ascii); got != input.unicode {
+			t.Errorf("ToUnicode(%q) == %q, expected %q", input.ascii, got, input.unicode)
+		}
+	}
+
+	if got := ToUnicode("xn--!!.com"); got != "xn--!!.com" {
+		t.Errorf("got %q, expected invalid label kept", got)
+	}
+}
+
+func TestAsciiAddress(t *testing.T) {
+	cases := []struct {
+		addr, expected string
+		ok             bool
+	}{
+		{"some@domain.com", "some@domain.com", true},
+		{"some@bücher.de", "some@xn--bcher-kva.de", true},
+		{"用户@例え.テスト", "用户@xn--r8jz45g.xn--zckzah", false},
+	}
+
+	for _, input := range cases {
+		got, ok := asciiAddress(input.addr)
+		if got != input.expected || ok != input.ok {
+			t.Errorf("asciiAddress(%q) == %q, %v, expected %q, %v", input.addr, got, ok, input.expected, input.ok)
+		}
+	}
+}
+
+// TestSessionSMTPUTF8 make sure that UTF-8 addresses are accepted
+// only in SMTPUTF8 transaction
+func TestSessionSMTPUTF8(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+		utf8     bool
+	}{
+		{"EHLO client.com\r\n", "250-SMTPUTF8\r\n", false},
+		{"EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<用户@例え.テスト>\r\n", "553 5.6.7", false},
+		{"EHLO client.com\r\nMAIL FROM:<José@bücher.de>\r\n", "553 5.6.7", false},
+		{"EHLO client.com\r\nMAIL FROM:<José@bücher.de> SMTPUTF8\r\nRCPT TO:<用户@例え.テスト>\r\nDATA\r\nSubject: test\r\n\r\n.\r\n", "250 2.0.0 OK\r\n250 2.1.5 OK\r\n354", true},
+	}
+
+	for _, input := range cases {
+		var delivered *Envelope
+		config := &Config{Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			delivered = envl
+			return nil
+		})}
+		out := runSession(t, config, input.input+"QUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("got: %q, expected %q", out, input.expected)
+		}
+		if input.utf8 && (delivered == nil || !delivered.SMTPUTF8 || delivered.RecipientAddress[0] != "用户@例え.テスト") {
+			t.Errorf("got delivered %+v, expected SMTPUTF8 envelope", delivered)
+		}
+	}
+}
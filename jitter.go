@@ -0,0 +1,17 @@
+package session
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// jitter delay a failure reply by a random duration between half of
+// Config.ReplyJitter and ReplyJitter, so the time of the reply
+// doesn't reveal which check rejected the command
+func (s *Session) jitter() {
+	max := s.Config.ReplyJitter
+	if max <= 0 {
+		return
+	}
+	time.Sleep(max/2 + rand.N(max-max/2))
+}
@@ -0,0 +1,48 @@
+package session
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestReplyJitter make sure that authentication failures and rejected
+// recipients are delayed by at least half of ReplyJitter
+func TestReplyJitter(t *testing.T) {
+	jitter := 60 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	srv := NewServer(&Config{
+		Authenticator:      testAuthenticator,
+		AuthAllowPlaintext: true,
+		LocalDomains:       []string{"example.com"},
+		ReplyJitter:        jitter,
+	})
+	go srv.Serve(l)
+
+	c := dialTestClient(t, l.Addr().String())
+	defer c.conn.Close()
+	c.cmd(t, "EHLO client.com", "250 ")
+
+	cases := []struct {
+		line  string
+		reply string
+	}{
+		{"AUTH PLAIN " + plainResponse("user", "wrong"), "535 5.7.8"},
+		{"AUTH PLAIN " + plainResponse("nobody", "secret"), "535 5.7.8"},
+		{"MAIL FROM:<a@client.com>", "250 "},
+		{"RCPT TO:<user@other.com>", "554 5.7.1"},
+	}
+
+	for _, input := range cases {
+		start := time.Now()
+		c.cmd(t, input.line, input.reply)
+		elapsed := time.Since(start)
+		if input.reply[0] == '5' && elapsed < jitter/2 {
+			t.Errorf("%s: got reply after %v, expected at least %v", input.line, elapsed, jitter/2)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package session
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+)
+
+// line and header limits (RFC 5321 section 4.5.3.1). AUTH lines may be
+// longer to carry the initial response (RFC 4954 section 4)
+const (
+	maxCommandLine       = 512
+	maxAuthLine          = 12288
+	defaultMaxLineLength = 1000
+	defaultMaxHeaderSize = 64 << 10
+	// defaultMaxMessageSize is the size limit of messages when
+	// Config.MaxMessageSize is not set
+	defaultMaxMessageSize = 32 << 20
+)
+
+var (
+	lineTooLongErr    = NewSMTPError(500, [3]int{5, 5, 6}, "Line too long")
+	headerTooLargeErr = NewSMTPError(552, [3]int{5, 3, 4}, "Message header too large")
+	messageTooBigErr  = NewSMTPError(552, [3]int{5, 3, 4}, "Message size exceeds fixed maximum message size")
+)
+
+// readLine read a line including <CRLF>. a line longer than max
+// bytes is consumed up to its end and lineTooLongErr is returned
+func (s *Session) readLine(max int) (string, error) {
+	var line []byte
+	long := false
+	for {
+		part, err := s.Reader.ReadSlice('\n')
+		if !long && len(line)+len(part) > max {
+			long, line = true, nil
+		}
+		if !long {
+			line = append(line, part...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return string(line), err
+		}
+		break
+	}
+	if long {
+		return "", lineTooLongErr
+	}
+	return string(line), nil
+}
+
+// readCommand read a command line, only AUTH command may exceed
+// 512 bytes
+func (s *Session) readCommand() (string, error) {
+	line, err := s.readLine(maxAuthLine)
+	if err == nil && len(line) > maxCommandLine && !strings.HasPrefix(strings.ToUpper(line), "AUTH ") {
+		return "", lineTooLongErr
+	}
+	return line, err
+}
+
+// maxLineLength return the limit of text lines in message data,
+// zero means unlimited
+func (s *Session) maxLineLength() int {
+	switch {
+	case s.Config.MaxLineLength < 0:
+		return 0
+	case s.Config.MaxLineLength == 0:
+		return defaultMaxLineLength
+	}
+	return s.Config.MaxLineLength
+}
+
+// maxHeaderSize return the limit of header section, zero means
+// unlimited
+func (s *Session) maxHeaderSize() int {
+	switch {
+	case s.Config.MaxHeaderSize < 0:
+		return 0
+	case s.Config.MaxHeaderSize == 0:
+		return defaultMaxHeaderSize
+	}
+	return s.Config.MaxHeaderSize
+}
+
+// maxMessageSize return the limit of message size advertised with
+// SIZE extension (RFC 1870), zero means unlimited
+func (s *Session) maxMessageSize() int {
+	switch {
+	case s.Config.MaxMessageSize < 0:
+		return 0
+	case s.Config.MaxMessageSize == 0:
+		return defaultMaxMessageSize
+	}
+	return s.Config.MaxMessageSize
+}
+
+// messageLimit return the size limit of the current message and the
+// error of messages over it, the limit is lowered during overload
+func (s *Session) messageLimit() (int, error) {
+	max := s.maxMessageSize()
+	if s.Overloaded() && (max == 0 || s.priorityMaxSize() < max) {
+		return s.priorityMaxSize(), priorityTooLargeErr
+	}
+	return max, messageTooBigErr
+}
+
+// checkMessageSize reject MAIL with SIZE parameter over the limit
+func (s *Session) checkMessageSize(params map[string]string) error {
+	max := s.maxMessageSize()
+	if v, ok := params["SIZE"]; ok && max > 0 {
+		if size, err := strconv.ParseInt(v, 10, 64); err == nil && size > int64(max) {
+			return messageTooBigErr
+		}
+	}
+	return nil
+}
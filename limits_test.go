@@ -0,0 +1,104 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestSessionCommandLineLimit make sure that overlong command lines
+// are consumed and rejected as a whole
+func TestSessionCommandLineLimit(t *testing.T) {
+	long := "MAIL FROM:<" + strings.Repeat("a", 600) + "@example.com>\r\n"
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"HELO client.com\r\n" + long + "HELO client.com\r\n", "500 5.5.6 Line too long\r\n250 2.0.0 OK\r\n221"},
+		{"HELO client.com\r\nMAIL FROM:<" + strings.Repeat("a", 400) + "@example.com>\r\n", "250 2.0.0 OK\r\n221"},
+		{"HELO client.com\r\nNOOP " + strings.Repeat("x", 20000) + "\r\nHELO client.com\r\n", "500 5.5.6 Line too long\r\n250 2.0.0 OK\r\n221"},
+	}
+
+	for _, input := range cases {
+		out := runSession(t, &Config{}, input.input+"QUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("got %q, expected %q", out, input.expected)
+		}
+	}
+}
+
+// TestSessionDataLimits make sure that overlong text lines and header
+// sections are rejected after the end of data
+func TestSessionDataLimits(t *testing.T) {
+	cases := []struct {
+		config   *Config
+		data     string
+		expected string
+	}{
+		{&Config{}, "Subject: a\r\n\r\n" + strings.Repeat("x", 998) + "\r\n.\r\n", "250 2.0.0 OK: queued as "},
+		{&Config{}, "Subject: a\r\n\r\n" + strings.Repeat("x", 999) + "\r\n.\r\n", "500 5.5.6 Line too long\r\n221"},
+		{&Config{MaxLineLength: -1}, "Subject: a\r\n\r\n" + strings.Repeat("x", 5000) + "\r\n.\r\n", "250 2.0.0 OK: queued as "},
+		// the end of data is still found after a line longer than
+		// the read buffer
+		{&Config{}, "Subject: a\r\n\r\n" + strings.Repeat("x", 5000) + "\r\n.\r\n", "500 5.5.6 Line too long\r\n221"},
+		{&Config{}, "Subject: a\r\n\r\n" + strings.Repeat("x", 5000) + "\r\nmore\r\n.\r\n", "500 5.5.6 Line too long\r\n221"},
+		{&Config{MaxHeaderSize: 100}, strings.Repeat("X-Long: header\r\n", 10) + "\r\nbody\r\n.\r\n", "552 5.3.4 Message header too large\r\n221"},
+		{&Config{MaxHeaderSize: 100}, "Subject: a\r\n\r\n" + strings.Repeat("body\r\n", 100) + ".\r\n", "250 2.0.0 OK: queued as "},
+	}
+
+	for _, input := range cases {
+		out := runSession(t, input.config, "HELO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\n"+input.data+"QUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("got %q, expected %q", out, input.expected)
+		}
+	}
+}
+
+// TestSessionMessageSize make sure that the size limit is advertised
+// and messages over it are rejected on MAIL and after DATA, whether
+// they are buffered or streamed
+func TestSessionMessageSize(t *testing.T) {
+	body := "Subject: a\r\n\r\n" + strings.Repeat("body\r\n", 20) + ".\r\n"
+	cases := []struct {
+		config   *Config
+		input    string
+		expected string
+	}{
+		{&Config{}, "", "250-SIZE 33554432\r\n"},
+		{&Config{MaxMessageSize: -1}, "", "250-SIZE\r\n"},
+		{&Config{MaxMessageSize: 100}, "MAIL FROM:<some@example.com> SIZE=101\r\n", "552 5.3.4 Message size exceeds fixed maximum message size\r\n221"},
+		{&Config{MaxMessageSize: 100}, "MAIL FROM:<some@example.com> SIZE=100\r\nRCPT TO:<some@domain.com>\r\nDATA\r\n" + body,
+			"354 Go ahead\r\n552 5.3.4 Message size exceeds fixed maximum message size\r\n221"},
+		{&Config{MaxMessageSize: 200}, "MAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\n" + body, "250 2.0.0 OK: queued as "},
+		{&Config{MaxMessageSize: 100, Backend: &streamRecorder{}}, "MAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\n" + body,
+			"354 Go ahead\r\n552 5.3.4 Message size exceeds fixed maximum message size\r\n221"},
+	}
+
+	for _, input := range cases {
+		out := runSession(t, input.config, "EHLO client.com\r\n"+input.input+"QUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("got %q, expected %q", out, input.expected)
+		}
+		if b, ok := input.config.Backend.(*streamRecorder); ok && (b.streamed != 1 || b.readErr != messageTooBigErr) {
+			t.Errorf("got %d streamed with read error %v, expected rejected stream", b.streamed, b.readErr)
+		}
+	}
+}
+
+// TestFoldedValue make sure that added header fields can't inject
+// new fields while folding is kept
+func TestFoldedValue(t *testing.T) {
+	cases := []struct {
+		value, expected string
+	}{
+		{"mx.example.org;\r\n\tspf=pass", "mx.example.org;\r\n\tspf=pass"},
+		{"value\r\nBcc: victim@example.com", "value  Bcc: victim@example.com"},
+		{"value\n\nbody", "value  body"},
+		{"value\r", "value "},
+	}
+
+	for _, input := range cases {
+		if got := foldedValue(input.value); got != input.expected {
+			t.Errorf("%q: got %q, expected %q", input.value, got, input.expected)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package session
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// Listener is a listening address served by Server with its own
+// config, e.g. port 25 in ModeMTA, port 465 with implicit TLS and
+// port 587 in ModeMSA. sessions of every listener share connection
+// tracking, session workers and Shutdown of the server, backends
+// and queue are shared by setting the same ones in each config
+type Listener struct {
+	// Addr is the TCP address to listen on
+	Addr string
+	// TLS serve implicit TLS with Config.TLSConfig (RFC 8314)
+	TLS bool
+	// Config of the sessions of the listener, nil use Server.Config.
+	// its MaxConnections limit the sessions of the listener only
+	Config *Config
+}
+
+// ListenAndServeListeners listen on the address of every listener
+// then serve them until one of them fail, after Shutdown the
+// returned error is ErrServerClosed. no listener is served when an
+// address can't be listened on
+func (srv *Server) ListenAndServeListeners(listeners []*Listener) error {
+	ls := make([]net.Listener, 0, len(listeners))
+	for _, ln := range listeners {
+		l, err := net.Listen("tcp", ln.Addr)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return err
+		}
+		ls = append(ls, l)
+	}
+	errc := make(chan error, len(listeners))
+	for i, ln := range listeners {
+		go func() {
+			errc <- srv.ServeListener(ls[i], ln)
+		}()
+	}
+	return <-errc
+}
+
+// ServeListener is like Serve with the config of ln, with implicit
+// TLS when ln.TLS is set
+func (srv *Server) ServeListener(l net.Listener, ln *Listener) error {
+	config := srv.listenerConfig(ln)
+	if config.WarmUp != nil {
+		config.WarmUp.Start(time.Now())
+	}
+	var tlsConfig *tls.Config
+	if ln.TLS {
+		if config.TLSConfig != nil {
+			tlsConfig = config.TLSConfig.Clone()
+		}
+		if tlsConfig == nil || len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil {
+			l.Close()
+			return errNoCertificate
+		}
+	}
+	return srv.serve(l, ln, tlsConfig)
+}
+
+// SetListenerConfig replace the config of new sessions of ln, nil
+// use Server.Config. live sessions keep the config they started with
+func (srv *Server) SetListenerConfig(ln *Listener, config *Config) {
+	if config != nil && config.WarmUp != nil {
+		config.WarmUp.Start(time.Now())
+	}
+	srv.mu.Lock()
+	ln.Config = config
+	srv.mu.Unlock()
+}
+
+// listenerConfig return the config of new sessions of ln
+func (srv *Server) listenerConfig(ln *Listener) *Config {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if ln != nil && ln.Config != nil {
+		return ln.Config
+	}
+	return srv.Config
+}
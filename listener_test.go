@@ -0,0 +1,73 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestServerListeners make sure that each listener serve sessions
+// with its own config and connection limit, and Shutdown close every
+// listener
+func TestServerListeners(t *testing.T) {
+	srv := NewServer(&Config{Hostname: "mx.example.com", MaxConnections: 10})
+	mta := &Listener{}
+	msa := &Listener{Config: &Config{Hostname: "submit.example.com", Mode: ModeMSA, MaxConnections: 1}}
+
+	served := make(chan error, 2)
+	addrs := make(map[*Listener]string)
+	for _, ln := range []*Listener{mta, msa} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[ln] = l.Addr().String()
+		go func() {
+			served <- srv.ServeListener(l, ln)
+		}()
+	}
+
+	c := dialTestClient(t, addrs[mta])
+	c.cmd(t, "EHLO client.com", "250 ")
+	submit := dialTestClient(t, addrs[msa])
+	submit.cmd(t, "EHLO client.com", "250 ")
+
+	// the limit of the MSA listener don't count MTA sessions
+	conn, err := net.Dial("tcp", addrs[msa])
+	if err != nil {
+		t.Fatal(err)
+	}
+	(&testClient{conn: conn, reader: bufio.NewReader(conn)}).expect(t, "421 4.3.2 Too many connections")
+	dialTestClient(t, addrs[mta]).cmd(t, "QUIT", "221 2.0.0 mx.example.com")
+
+	// new sessions get the replaced config
+	submit.cmd(t, "QUIT", "221 2.0.0 submit.example.com")
+	srv.SetListenerConfig(msa, nil)
+	dialTestClient(t, addrs[msa]).cmd(t, "QUIT", "221 2.0.0 mx.example.com")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() == %v, expected nil", err)
+	}
+	for range 2 {
+		if err := <-served; err != ErrServerClosed {
+			t.Errorf("ServeListener() == %v, expected %v", err, ErrServerClosed)
+		}
+	}
+}
+
+// TestServerListenerTLS make sure that a listener of implicit TLS
+// require a certificate in its config
+func TestServerListenerTLS(t *testing.T) {
+	srv := NewServer(nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ServeListener(l, &Listener{TLS: true}); err != errNoCertificate {
+		t.Errorf("ServeListener() == %v, expected %v", err, errNoCertificate)
+	}
+}
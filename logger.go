@@ -0,0 +1,245 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Level is the severity of log message
+type Level int
+
+// log levels
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// String return the name of level
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parse level name like "debug"
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("session: unknown log level %q", name)
+}
+
+// Logger write session logs with runtime adjustable level, sampling
+// and transcript capture. every setting can be changed while
+// sessions are running, see Admin
+type Logger struct {
+	l *log.Logger
+
+	mu          sync.Mutex
+	level       Level
+	sampling    float64
+	transcripts map[string]bool
+}
+
+// NewLogger create a logger that write into w with level info
+// and without sampling
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{
+		l:           log.New(w, "", log.LstdFlags),
+		level:       LevelInfo,
+		sampling:    1,
+		transcripts: make(map[string]bool),
+	}
+}
+
+// SetLevel set the minimum level of written messages
+func (lg *Logger) SetLevel(level Level) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	lg.level = level
+}
+
+// Level return the minimum level of written messages
+func (lg *Logger) Level() Level {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	return lg.level
+}
+
+// SetSampling set the fraction of debug and info messages that are
+// written, rate is between 0 and 1. warnings and errors are
+// never sampled
+func (lg *Logger) SetSampling(rate float64) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("session: sampling rate %v out of range", rate)
+	}
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	lg.sampling = rate
+	return nil
+}
+
+// Sampling return the sampling rate
+func (lg *Logger) Sampling() float64 {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	return lg.sampling
+}
+
+// Capture enable or disable transcript capture of new sessions
+// from ip
+func (lg *Logger) Capture(ip string, on bool) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	if on {
+		lg.transcripts[ip] = true
+	} else {
+		delete(lg.transcripts, ip)
+	}
+}
+
+// Captured return every IP with transcript capture enabled
+func (lg *Logger) Captured() []string {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	ips := make([]string, 0, len(lg.transcripts))
+	for ip := range lg.transcripts {
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// capturing report whether transcript of ip is captured
+func (lg *Logger) capturing(ip string) bool {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	return lg.transcripts[ip]
+}
+
+// Logf write the message when level is enabled and sampled
+func (lg *Logger) Logf(level Level, format string, v ...interface{}) {
+	lg.mu.Lock()
+	write := level >= lg.level && (level >= LevelWarn || rand.Float64() < lg.sampling)
+	lg.mu.Unlock()
+	if write {
+		lg.l.Output(2, level.String()+": "+fmt.Sprintf(format, v...))
+	}
+}
+
+// redacted replace credentials in transcripts
+const redacted = "[redacted]"
+
+// transcript is a writer that log every line written
+// into a session transcript. credentials of AUTH are redacted
+type transcript struct {
+	lg     *Logger
+	prefix string
+	buf    bytes.Buffer
+	// client is set for the lines sent by the client. auth is
+	// shared by both directions, it is set from AUTH command until
+	// the server reply other than 334
+	client bool
+	auth   *atomic.Bool
+}
+
+func (t *transcript) Write(p []byte) (int, error) {
+	t.buf.Write(p)
+	for {
+		line, err := t.buf.ReadString('\n')
+		if err != nil {
+			// keep incomplete line until the rest is written
+			t.buf.Reset()
+			t.buf.WriteString(line)
+			break
+		}
+		t.lg.l.Print(t.prefix + t.redact(strings.TrimRight(line, "\r\n")))
+	}
+	return len(p), nil
+}
+
+// redact return line without the credentials of AUTH command and
+// the responses to its challenges
+func (t *transcript) redact(line string) string {
+	if !t.client {
+		if t.auth.Load() && !strings.HasPrefix(line, "334") {
+			t.auth.Store(false)
+		}
+		return line
+	}
+	if t.auth.Load() {
+		return redacted
+	}
+	verb, arg, _ := strings.Cut(line, " ")
+	if !strings.EqualFold(verb, "AUTH") {
+		return line
+	}
+	t.auth.Store(true)
+	if mech, resp, _ := strings.Cut(strings.TrimSpace(arg), " "); resp != "" {
+		return verb + " " + mech + " " + redacted
+	}
+	return line
+}
+
+// logf write session log into Config.Logger, without logger
+// only warnings and errors are written into the standard logger
+func (s *Session) logf(level Level, format string, v ...interface{}) {
+	if s.Config.Logger != nil {
+		client := remoteIP(s.Conn)
+		if name := s.remoteName(); name != "" {
+			client = name + "[" + client + "]"
+		}
+		if xf := s.xforward; xf != nil && xf.Addr != "" {
+			client = xf.Addr + " via " + client
+		}
+		s.Config.Logger.Logf(level, "session %s %s: "+format, append([]interface{}{s.ID, client}, v...)...)
+		return
+	}
+	if level >= LevelWarn {
+		log.Printf(format, v...)
+	}
+}
+
+// logf write server log into Config.Logger like Session.logf
+func (srv *Server) logf(level Level, format string, v ...interface{}) {
+	logf(srv.config().Logger, level, format, v...)
+}
+
+// logf write into lg, without Logger only warnings and errors are
+// written to the standard logger
+func logf(lg *Logger, level Level, format string, v ...interface{}) {
+	if lg != nil {
+		lg.Logf(level, format, v...)
+		return
+	}
+	if level >= LevelWarn {
+		log.Printf(format, v...)
+	}
+}
+
+// captureTranscript log everything read from and written to the
+// connection when transcript capture of the client is enabled
+func (s *Session) captureTranscript() {
+	lg := s.Config.Logger
+	ip := remoteIP(s.Conn)
+	if lg == nil || !lg.capturing(ip) {
+		return
+	}
+	prefix := "transcript " + ip + " "
+	auth := &atomic.Bool{}
+	s.Reader = bufio.NewReader(io.TeeReader(s.Reader, &transcript{lg: lg, prefix: prefix + "C: ", client: true, auth: auth}))
+	s.Reply.w = bufio.NewWriter(io.MultiWriter(s.Conn, &transcript{lg: lg, prefix: prefix + "S: ", auth: auth}))
+}
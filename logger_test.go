@@ -0,0 +1,144 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected Level
+		err      bool
+	}{
+		{"debug", LevelDebug, false},
+		{"INFO", LevelInfo, false},
+		{"warn", LevelWarn, false},
+		{"error", LevelError, false},
+		{"verbose", 0, true},
+	}
+
+	for _, input := range cases {
+		got, err := ParseLevel(input.name)
+		if (err != nil) != input.err || got != input.expected {
+			t.Errorf("ParseLevel(%q) == %v, %v, expected %v", input.name, got, err, input.expected)
+		}
+	}
+}
+
+// TestLoggerLevelSampling make sure that messages below the level
+// are dropped and sampling never drop warnings
+func TestLoggerLevelSampling(t *testing.T) {
+	var buf bytes.Buffer
+	lg := NewLogger(&buf)
+
+	lg.Logf(LevelDebug, "hidden debug")
+	lg.Logf(LevelInfo, "visible info")
+	lg.SetLevel(LevelDebug)
+	lg.Logf(LevelDebug, "visible debug")
+	lg.SetSampling(0)
+	lg.Logf(LevelInfo, "sampled info")
+	lg.Logf(LevelWarn, "visible warn")
+
+	out := buf.String()
+	for _, s := range []string{"info: visible info", "debug: visible debug", "warn: visible warn"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("got: %q, expected %q", out, s)
+		}
+	}
+	for _, s := range []string{"hidden debug", "sampled info"} {
+		if strings.Contains(out, s) {
+			t.Errorf("got: %q, unexpected %q", out, s)
+		}
+	}
+	if err := lg.SetSampling(2); err == nil {
+		t.Errorf("expected error of sampling rate out of range")
+	}
+}
+
+// TestSessionTranscript make sure that transcript is captured only
+// for the enabled IP
+func TestSessionTranscript(t *testing.T) {
+	var buf bytes.Buffer
+	lg := NewLogger(&buf)
+	lg.SetLevel(LevelError)
+	lg.Capture("192.0.2.1", true)
+	config := &Config{Logger: lg}
+
+	runSessionFrom(t, config, "192.0.2.2:25", "NOOP\r\nQUIT\r\n")
+	if buf.Len() != 0 {
+		t.Errorf("got: %q, expected no transcript", buf.String())
+	}
+
+	runSessionFrom(t, config, "192.0.2.1:25", "NOOP\r\nQUIT\r\n")
+	out := buf.String()
+	for _, s := range []string{"192.0.2.1 S: 220 ", "192.0.2.1 C: NOOP", "192.0.2.1 C: QUIT", "192.0.2.1 S: 221 "} {
+		if !strings.Contains(out, s) {
+			t.Errorf("got: %q, expected %q", out, s)
+		}
+	}
+}
+
+// TestSessionTranscriptAuth make sure that credentials of AUTH and
+// responses to its challenges are redacted from transcripts
+func TestSessionTranscriptAuth(t *testing.T) {
+	var buf bytes.Buffer
+	lg := NewLogger(&buf)
+	lg.SetLevel(LevelError)
+	lg.Capture("192.0.2.1", true)
+
+	server, client := net.Pipe()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	s := New(&pipeConn{Conn: server, remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}}, wg, nil)
+	s.Config = &Config{Logger: lg, Authenticator: testAuthenticator, AuthAllowPlaintext: true}
+	go s.Serve()
+
+	r := bufio.NewReader(client)
+	expect := func(prefix string) {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(line) > 3 && line[3] == '-' {
+				continue
+			}
+			if !strings.HasPrefix(line, prefix) {
+				t.Fatalf("got %q, expected %q", line, prefix)
+			}
+			return
+		}
+	}
+	expect("220 ")
+	for _, command := range [][2]string{
+		{"EHLO client.com", "250 "},
+		{"AUTH PLAIN " + plainResponse("user", "wrong"), "535 "},
+		{"AUTH PLAIN", "334 "},
+		{plainResponse("user", "secret"), "235 "},
+		{"HELP", "214 "},
+		{"QUIT", "221 "},
+	} {
+		fmt.Fprintf(client, "%s\r\n", command[0])
+		expect(command[1])
+	}
+	client.Close()
+	wg.Wait()
+
+	out := buf.String()
+	for _, secret := range []string{plainResponse("user", "wrong"), plainResponse("user", "secret")} {
+		if strings.Contains(out, secret) {
+			t.Errorf("got %q, expected %q redacted", out, secret)
+		}
+	}
+	for _, line := range []string{"C: AUTH PLAIN [redacted]\n", "C: AUTH PLAIN\n", "C: [redacted]\n", "S: 235 ", "C: HELP\n"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("got %q, expected %q", out, line)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// errMailbox is returned for recipients that can't be mapped to a
+// Maildir safely
+var errMailbox = errors.New("maildir: invalid mailbox")
+
+// maildirCount make unique file names within the process
+var maildirCount uint64
+
+// Maildir is a Backend delivering each recipient's copy into a
+// Maildir, Root/domain/local by default. messages are written into
+// tmp, synced to disk and moved into new
+type Maildir struct {
+	Root string
+	// Path return the Maildir of rcpt, default to Root/domain/local
+	Path func(rcpt string) (string, error)
+}
+
+// path return the Maildir of rcpt
+func (m *Maildir) path(rcpt string) (string, error) {
+	if m.Path != nil {
+		return m.Path(rcpt)
+	}
+	i := strings.LastIndex(rcpt, "@")
+	if i <= 0 {
+		return "", errMailbox
+	}
+	local, domain := strings.ToLower(rcpt[:i]), strings.ToLower(rcpt[i+1:])
+	for _, part := range []string{local, domain} {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "/\\\x00") {
+			return "", errMailbox
+		}
+	}
+	return filepath.Join(m.Root, domain, local), nil
+}
+
+// maildirName return a unique file name "time.MusecPpidQn.host"
+// (https://cr.yp.to/proto/maildir.html)
+func maildirName() string {
+	now := time.Now()
+	host, _ := os.Hostname()
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	n := atomic.AddUint64(&maildirCount, 1)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, host)
+}
+
+// folderPath return the Maildir++ folder of Envelope.Folder,
+// "Work/Reports" is stored in ".Work.Reports"
+func folderPath(dir, folder string) (string, error) {
+	if folder == "" || strings.EqualFold(folder, "INBOX") {
+		return dir, nil
+	}
+	parts := strings.Split(folder, "/")
+	for _, part := range parts {
+		if part == "" || strings.HasPrefix(part, ".") || strings.ContainsAny(part, "\\\x00") {
+			return "", errMailbox
+		}
+	}
+	return filepath.Join(dir, "."+strings.Join(parts, ".")), nil
+}
+
+// Deliver write a copy of data for every recipient with Return-Path
+// and Delivered-To header fields into Envelope.Folder. a failure of
+// any copy fail the delivery
+func (m *Maildir) Deliver(envl *Envelope, data []byte) error {
+	for _, rcpt := range envl.RecipientAddress {
+		msg := prependHeader(data, "Delivered-To", rcpt)
+		msg = prependHeader(msg, "Return-Path", "<"+envl.OriginatorAddress+">")
+		if err := m.deliver(rcpt, envl.Folder, msg); err != nil {
+			return fmt.Errorf("maildir: %s: %v", rcpt, err)
+		}
+	}
+	return nil
+}
+
+// deliver write msg into the folder of the Maildir of rcpt
+func (m *Maildir) deliver(rcpt, folder string, msg []byte) error {
+	dir, err := m.path(rcpt)
+	if err != nil {
+		return err
+	}
+	if dir, err = folderPath(dir, folder); err != nil {
+		return err
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	name := maildirName()
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(msg); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "new", name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Join(dir, "new"))
+}
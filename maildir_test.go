@@ -0,0 +1,96 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMaildirPath make sure that recipients are mapped under Root
+// and unsafe local parts are rejected
+func TestMaildirPath(t *testing.T) {
+	m := &Maildir{Root: "/var/mail"}
+
+	cases := []struct {
+		rcpt     string
+		expected string
+		err      error
+	}{
+		{"User@Example.com", "/var/mail/example.com/user", nil},
+		{"first.last@example.com", "/var/mail/example.com/first.last", nil},
+		{"..@example.com", "", errMailbox},
+		{"a/b@example.com", "", errMailbox},
+		{"user@..", "", errMailbox},
+		{"postmaster", "", errMailbox},
+	}
+
+	for _, input := range cases {
+		got, err := m.path(input.rcpt)
+		if got != input.expected || err != input.err {
+			t.Errorf("%s: got %q %v, expected %q %v", input.rcpt, got, err, input.expected, input.err)
+		}
+	}
+}
+
+// TestMaildirFolderPath make sure that folders are mapped to
+// Maildir++ subdirectories
+func TestMaildirFolderPath(t *testing.T) {
+	cases := []struct {
+		folder   string
+		expected string
+		err      error
+	}{
+		{"", "/var/mail/user", nil},
+		{"INBOX", "/var/mail/user", nil},
+		{"Work", "/var/mail/user/.Work", nil},
+		{"Work/Reports", "/var/mail/user/.Work.Reports", nil},
+		{"../other", "", errMailbox},
+		{"Work//Reports", "", errMailbox},
+	}
+
+	for _, input := range cases {
+		got, err := folderPath("/var/mail/user", input.folder)
+		if got != input.expected || err != input.err {
+			t.Errorf("%q: got %q %v, expected %q %v", input.folder, got, err, input.expected, input.err)
+		}
+	}
+}
+
+// TestMaildirDeliver make sure that every recipient get a copy in
+// new with Return-Path and Delivered-To header fields
+func TestMaildirDeliver(t *testing.T) {
+	root := t.TempDir()
+	config := &Config{Backend: &Maildir{Root: root}}
+	out := runSession(t, config, "EHLO client.com\r\nMAIL FROM:<a@client.com>\r\nRCPT TO:<bob@example.com>\r\n"+
+		"RCPT TO:<carol@example.org>\r\nDATA\r\nSubject: hello\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+	if !strings.Contains(out, "250 2.0.0 OK: queued as ") {
+		t.Fatalf("got %q, expected message accepted", out)
+	}
+
+	for _, rcpt := range []string{"bob@example.com", "carol@example.org"} {
+		dir, _ := (&Maildir{Root: root}).path(rcpt)
+		if files, _ := os.ReadDir(filepath.Join(dir, "tmp")); len(files) != 0 {
+			t.Errorf("%s: got %d files in tmp, expected none", rcpt, len(files))
+		}
+		if _, err := os.Stat(filepath.Join(dir, "cur")); err != nil {
+			t.Errorf("%s: %v", rcpt, err)
+		}
+		files, err := os.ReadDir(filepath.Join(dir, "new"))
+		if err != nil || len(files) != 1 {
+			t.Fatalf("%s: got %d files in new %v, expected 1", rcpt, len(files), err)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "new", files[0].Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "Return-Path: <a@client.com>\r\nDelivered-To: " + rcpt + "\r\nSubject: hello\r\n\r\nbody\r\n"
+		if string(data) != expected {
+			t.Errorf("%s: got %q, expected %q", rcpt, data, expected)
+		}
+	}
+
+	if a, b := maildirName(), maildirName(); a == b {
+		t.Errorf("got duplicate file name %q", a)
+	}
+}
@@ -0,0 +1,139 @@
+package session
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/mail"
+	"strings"
+)
+
+// MergeHeader is the header used by authenticated clients to submit
+// per-recipient variables of a template message. the value is base64
+// encoded JSON object keyed by recipient address, e.g.
+// {"some@domain.com": {"name": "Some"}}
+const MergeHeader = "X-Merge-Data"
+
+// invalidMergeErr is sent when merge data can't be decoded
+var invalidMergeErr = NewSMTPError(554, [3]int{5, 6, 0}, "Invalid merge data")
+
+// MergeMessage represents a message expanded for one recipient
+type MergeMessage struct {
+	Envelope *Envelope
+	Data     []byte
+}
+
+// mergeData decode the merge header of message. return nil
+// when the message is not a template
+func mergeData(data []byte) (map[string]map[string]string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil
+	}
+	value := msg.Header.Get(MergeHeader)
+	if value == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+	if err != nil {
+		return nil, invalidMergeErr
+	}
+	vars := make(map[string]map[string]string)
+	if err := json.Unmarshal(raw, &vars); err != nil {
+		return nil, invalidMergeErr
+	}
+
+	// recipient address is case insensitive
+	merge := make(map[string]map[string]string, len(vars))
+	for rcpt, v := range vars {
+		merge[strings.ToLower(rcpt)] = v
+	}
+	return merge, nil
+}
+
+// Merge expand template message into one message per recipient.
+// "{{name}}" in headers and body is replaced with the recipient
+// variable and "{{recipient}}" with the recipient address, unknown
+// variables are replaced with empty string. return
+// nil when the message doesn't have merge header
+func Merge(envl *Envelope, data []byte) ([]*MergeMessage, error) {
+	merge, err := mergeData(data)
+	if err != nil || merge == nil {
+		return nil, err
+	}
+	template := removeHeader(data, MergeHeader)
+
+	msgs := make([]*MergeMessage, 0, len(envl.RecipientAddress))
+	for _, rcpt := range envl.RecipientAddress {
+		vars := map[string]string{"recipient": rcpt}
+		for k, v := range merge[strings.ToLower(rcpt)] {
+			vars[k] = v
+		}
+
+		e := *envl
+		e.RecipientAddress = []string{rcpt}
+		msgs = append(msgs, &MergeMessage{
+			Envelope: &e,
+			Data:     expandTemplate(template, vars),
+		})
+	}
+	return msgs, nil
+}
+
+// expandTemplate replace every "{{name}}" in template with vars[name]
+func expandTemplate(template []byte, vars map[string]string) []byte {
+	var out bytes.Buffer
+	out.Grow(len(template))
+	for {
+		i := bytes.Index(template, []byte("{{"))
+		if i < 0 {
+			break
+		}
+		j := bytes.Index(template[i+2:], []byte("}}"))
+		if j < 0 {
+			break
+		}
+		out.Write(template[:i])
+		out.WriteString(vars[strings.TrimSpace(string(template[i+2:i+2+j]))])
+		template = template[i+2+j+2:]
+	}
+	out.Write(template)
+	return out.Bytes()
+}
+
+// removeHeader remove every field with the name (and its folded
+// continuation lines) from the header section of message data
+func removeHeader(data []byte, name string) []byte {
+	prefix := strings.ToLower(name) + ":"
+	var out bytes.Buffer
+	out.Grow(len(data))
+
+	inHeader, skipping := true, false
+	rest := data
+	for len(rest) > 0 && inHeader {
+		i := bytes.IndexByte(rest, '\n')
+		line := rest
+		if i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+
+		switch {
+		case len(bytes.TrimRight(line, "\r\n")) == 0:
+			// end of header section
+			inHeader = false
+			skipping = false
+		case line[0] == ' ' || line[0] == '\t':
+			// continuation line belong to previous field
+		default:
+			skipping = strings.HasPrefix(strings.ToLower(string(line)), prefix)
+		}
+
+		if !skipping {
+			out.Write(line)
+		}
+	}
+	out.Write(rest)
+	return out.Bytes()
+}
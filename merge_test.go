@@ -0,0 +1,102 @@
+package session
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func mergeHeaderValue(json string) string {
+	return base64.StdEncoding.EncodeToString([]byte(json))
+}
+
+// TestRemoveHeader make sure that field and its continuation
+// lines are removed only from header section
+func TestRemoveHeader(t *testing.T) {
+	cases := []struct {
+		data, expected string
+	}{
+		{"A: 1\r\nX-Merge-Data: abc\r\n def\r\nB: 2\r\n\r\nX-Merge-Data: body\r\n",
+			"A: 1\r\nB: 2\r\n\r\nX-Merge-Data: body\r\n"},
+		{"x-merge-data: abc\r\n\r\nbody\r\n", "\r\nbody\r\n"},
+		{"A: 1\r\n\r\nbody\r\n", "A: 1\r\n\r\nbody\r\n"},
+	}
+
+	for _, input := range cases {
+		got := string(removeHeader([]byte(input.data), MergeHeader))
+		if got != input.expected {
+			t.Errorf("%q: got %q, expected %q", input.data, got, input.expected)
+		}
+	}
+}
+
+// TestMerge make sure that template expanded per recipient
+func TestMerge(t *testing.T) {
+	envl := &Envelope{
+		OriginatorAddress: "app@example.com",
+		RecipientAddress:  []string{"a@domain.com", "B@domain.com"},
+	}
+	data := "X-Merge-Data: " + mergeHeaderValue(`{"a@domain.com":{"name":"Alice"},"b@domain.com":{"name":"Bob"}}`) + "\r\n" +
+		"Subject: Hi {{name}}\r\n\r\nHello {{name}} <{{recipient}}>\r\n"
+
+	msgs, err := Merge(envl, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"Subject: Hi Alice\r\n\r\nHello Alice <a@domain.com>\r\n",
+		"Subject: Hi Bob\r\n\r\nHello Bob <B@domain.com>\r\n",
+	}
+	if len(msgs) != len(expected) {
+		t.Fatalf("got %d messages, expected %d", len(msgs), len(expected))
+	}
+	for i, m := range msgs {
+		if string(m.Data) != expected[i] {
+			t.Errorf("got %q, expected %q", m.Data, expected[i])
+		}
+		if len(m.Envelope.RecipientAddress) != 1 || m.Envelope.RecipientAddress[0] != envl.RecipientAddress[i] {
+			t.Errorf("got recipients %v, expected %q", m.Envelope.RecipientAddress, envl.RecipientAddress[i])
+		}
+	}
+
+	cases := []struct {
+		data string
+		err  error
+	}{
+		{"Subject: plain\r\n\r\nbody\r\n", nil},
+		{"X-Merge-Data: !!!\r\n\r\nbody\r\n", invalidMergeErr},
+		{"X-Merge-Data: " + mergeHeaderValue("[1, 2]") + "\r\n\r\nbody\r\n", invalidMergeErr},
+	}
+	for _, input := range cases {
+		msgs, err := Merge(envl, []byte(input.data))
+		if err != input.err || msgs != nil {
+			t.Errorf("%q: got %v %v, expected nil %v", input.data, msgs, err, input.err)
+		}
+	}
+}
+
+// TestSessionMerge make sure that template message is fanned out
+// only for authenticated clients
+func TestSessionMerge(t *testing.T) {
+	var delivered []string
+	config := &Config{
+		Authenticator:      testAuthenticator,
+		AuthAllowPlaintext: true,
+		MergeExpansion:     true,
+		Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			delivered = append(delivered, strings.Join(envl.RecipientAddress, ",")+" "+string(data))
+			return nil
+		}),
+	}
+
+	input := "EHLO client.com\r\nAUTH PLAIN " + plainResponse("user", "secret") + "\r\n" +
+		"MAIL FROM:<app@example.com>\r\nRCPT TO:<a@domain.com>\r\nRCPT TO:<b@domain.com>\r\n" +
+		"DATA\r\nX-Merge-Data: " + mergeHeaderValue(`{"a@domain.com":{"name":"Alice"}}`) + "\r\n\r\nHi {{name}}\r\n.\r\nQUIT\r\n"
+	runSession(t, config, input)
+
+	expected := []string{"a@domain.com \r\nHi Alice\r\n", "b@domain.com \r\nHi \r\n"}
+	if strings.Join(delivered, "|") != strings.Join(expected, "|") {
+		t.Errorf("got %q, expected %q", delivered, expected)
+	}
+}
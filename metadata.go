@@ -0,0 +1,167 @@
+package session
+
+import (
+	"sort"
+	"strings"
+)
+
+// defaults of Metadata
+const (
+	defaultMetadataHeader = "X-Message-Metadata"
+	defaultMetadataValue  = 256
+	metadataParam         = "XMETADATA"
+)
+
+// metadataErr is sent for metadata that is malformed or not allowed
+var metadataErr = NewSMTPError(550, [3]int{5, 6, 0}, "Invalid message metadata")
+
+// Metadata accept opaque metadata of messages like campaign or tenant
+// ID from authenticated clients, either in MAIL parameter XMETADATA
+// (xtext) or in a header field, both "key=value; key=value". the
+// metadata is kept in Envelope.Metadata for backends and tracking,
+// the header field of other clients is always removed
+type Metadata struct {
+	// Header is the header field name, default to
+	// X-Message-Metadata
+	Header string
+	// Keys are the allowed keys, empty allow every key
+	Keys []string
+	// MaxValue is the maximum length of a value, default to 256
+	MaxValue int
+	// Preserve keep the header field in delivered message
+	Preserve bool
+}
+
+// header return the configured header field name
+func (m *Metadata) header() string {
+	if m.Header == "" {
+		return defaultMetadataHeader
+	}
+	return m.Header
+}
+
+// parse validate "key=value; key=value" into md
+func (m *Metadata) parse(s string, md map[string]string) error {
+	max := m.MaxValue
+	if max <= 0 {
+		max = defaultMetadataValue
+	}
+	for _, pair := range strings.Split(s, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		if !ok || !validMetadataKey(key) || len(value) > max || !isPrintableASCII(value) {
+			return metadataErr
+		}
+		if len(m.Keys) > 0 && !containsFold(m.Keys, key) {
+			return metadataErr
+		}
+		md[key] = value
+	}
+	return nil
+}
+
+// validMetadataKey report whether key is made of a-z, 0-9, "-"
+// and "_"
+func validMetadataKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// isPrintableASCII report whether s only contain printable ASCII
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// containsFold report whether list contain s ignoring case
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatMetadata return md as "key=value; key=value" ordered by key
+func formatMetadata(md map[string]string) string {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + md[k]
+	}
+	return strings.Join(pairs, "; ")
+}
+
+// mailMetadata return XMETADATA parameter of MAIL, only
+// authenticated clients may send it
+func (s *Session) mailMetadata(params map[string]string) (map[string]string, error) {
+	value, ok := params[metadataParam]
+	if !ok {
+		return nil, nil
+	}
+	m := s.Config.Metadata
+	if m == nil || s.Principal == nil {
+		return nil, metadataErr
+	}
+	decoded, err := decodeXtext(value)
+	if err != nil {
+		return nil, metadataErr
+	}
+	md := make(map[string]string)
+	if err := m.parse(decoded, md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// headerMetadata read the metadata header field of message data into
+// the envelope, MAIL parameter win over the header field. the field
+// is removed unless the client is authenticated and Preserve is set
+func (s *Session) headerMetadata(envl *Envelope, data []byte) ([]byte, error) {
+	m := s.Config.Metadata
+	if m == nil {
+		return data, nil
+	}
+	name := m.header()
+	if s.Principal != nil {
+		fields, _ := splitMessage(data)
+		md := make(map[string]string)
+		for _, f := range fields {
+			if strings.EqualFold(f.name, name) {
+				if err := m.parse(f.value(), md); err != nil {
+					return data, err
+				}
+			}
+		}
+		for k, v := range envl.Metadata {
+			md[k] = v
+		}
+		if len(md) > 0 {
+			envl.Metadata = md
+		}
+		if m.Preserve {
+			return data, nil
+		}
+	}
+	return removeHeader(data, name), nil
+}
@@ -0,0 +1,131 @@
+package session
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestMetadataParse make sure that keys and values are validated
+func TestMetadataParse(t *testing.T) {
+	m := &Metadata{Keys: []string{"campaign", "tenant-id"}, MaxValue: 8}
+
+	cases := []struct {
+		value    string
+		expected map[string]string
+		err      error
+	}{
+		{"campaign=spring; tenant-id=42", map[string]string{"campaign": "spring", "tenant-id": "42"}, nil},
+		{" Campaign = spring ;", map[string]string{"campaign": "spring"}, nil},
+		{"", map[string]string{}, nil},
+		{"campaign", nil, metadataErr},
+		{"other=1", nil, metadataErr},
+		{"campaign=too-long-value", nil, metadataErr},
+		{"campaign=a\x01b", nil, metadataErr},
+		{"camp aign=1", nil, metadataErr},
+	}
+
+	for _, input := range cases {
+		md := make(map[string]string)
+		err := m.parse(input.value, md)
+		if err != input.err {
+			t.Errorf("%q: got error %v, expected %v", input.value, err, input.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(md, input.expected) {
+			t.Errorf("%q: got %v, expected %v", input.value, md, input.expected)
+		}
+	}
+}
+
+// TestSessionMetadata make sure that metadata of authenticated clients
+// reach the backend and tracker, and the header field is removed or
+// preserved
+func TestSessionMetadata(t *testing.T) {
+	auth := "AUTH PLAIN " + plainResponse("user", "secret") + "\r\n"
+
+	cases := []struct {
+		auth     bool
+		preserve bool
+		param    string
+		header   string
+		reply    string
+		expected map[string]string
+		kept     bool
+	}{
+		{true, false, " XMETADATA=campaign+3Dspring;tenant+3Da+2Bb", "", "250 2.0.0 OK", map[string]string{"campaign": "spring", "tenant": "a+b"}, false},
+		{true, false, "", "campaign=spring", "250 2.0.0 OK", map[string]string{"campaign": "spring"}, false},
+		{true, true, "", "campaign=spring", "250 2.0.0 OK", map[string]string{"campaign": "spring"}, true},
+		{true, false, " XMETADATA=campaign+3Dmail", "campaign=header; tenant=a", "250 2.0.0 OK", map[string]string{"campaign": "mail", "tenant": "a"}, false},
+		{true, false, "", "campaign", "550 5.6.0 Invalid message metadata", nil, false},
+		{false, true, "", "campaign=spring", "250 2.0.0 OK", nil, false},
+		{false, false, " XMETADATA=campaign+3Dspring", "", "550 5.6.0 Invalid message metadata", nil, false},
+	}
+
+	for _, input := range cases {
+		var envl *Envelope
+		var message []byte
+		var events []*TrackingEvent
+		config := &Config{
+			Authenticator:      testAuthenticator,
+			AuthAllowPlaintext: true,
+			Metadata:           &Metadata{Preserve: input.preserve},
+			Backend: BackendFunc(func(e *Envelope, data []byte) error {
+				envl, message = e, data
+				return nil
+			}),
+			Tracker: TrackerFunc(func(ev *TrackingEvent) {
+				events = append(events, ev)
+			}),
+		}
+		session := "EHLO client.com\r\n"
+		if input.auth {
+			session += auth
+		}
+		session += "MAIL FROM:<user@example.com>" + input.param + "\r\nRCPT TO:<some@domain.com>\r\nDATA\r\n"
+		if input.header != "" {
+			session += "X-Message-Metadata: " + input.header + "\r\n"
+		}
+		session += "Subject: a\r\n\r\nbody\r\n.\r\nQUIT\r\n"
+		out := runSession(t, config, session)
+		if !strings.Contains(out, input.reply) {
+			t.Errorf("%q %q: got %q, expected %q", input.param, input.header, out, input.reply)
+			continue
+		}
+		if !strings.Contains(out, "XMETADATA\r\n") {
+			t.Errorf("%q %q: XMETADATA not advertised in %q", input.param, input.header, out)
+		}
+		if envl == nil {
+			continue
+		}
+		if !reflect.DeepEqual(envl.Metadata, input.expected) {
+			t.Errorf("%q %q: got metadata %v, expected %v", input.param, input.header, envl.Metadata, input.expected)
+		}
+		if kept := strings.Contains(string(message), "X-Message-Metadata:"); kept != input.kept {
+			t.Errorf("%q %q: got header kept %v, expected %v", input.param, input.header, kept, input.kept)
+		}
+		for _, ev := range events {
+			if !reflect.DeepEqual(ev.Metadata, input.expected) {
+				t.Errorf("%q %q: got event metadata %v, expected %v", input.param, input.header, ev.Metadata, input.expected)
+			}
+		}
+	}
+}
+
+// TestEnvelopeMetadataJSON make sure that metadata survive envelope
+// serialization
+func TestEnvelopeMetadataJSON(t *testing.T) {
+	envl := &Envelope{OriginatorAddress: "user@example.com", Metadata: map[string]string{"campaign": "spring"}}
+	b, err := json.Marshal(envl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &Envelope{}
+	if err := json.Unmarshal(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Metadata, envl.Metadata) {
+		t.Errorf("got %v, expected %v", got.Metadata, envl.Metadata)
+	}
+}
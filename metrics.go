@@ -0,0 +1,211 @@
+package session
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// optional metric labels
+const (
+	LabelASN    = "asn"
+	LabelTenant = "tenant"
+	LabelDomain = "domain"
+)
+
+// default number of distinct values of each optional label
+const defaultMaxLabelValues = 100
+
+// labelOther replace label values over the cardinality limit
+const labelOther = "other"
+
+// Metrics count session events and export them in Prometheus text
+// format. optional labels are disabled unless listed in Labels, and
+// each of them has at most MaxValues distinct values, the rest are
+// counted as "other"
+type Metrics struct {
+	// Labels is the list of enabled optional labels:
+	// LabelASN, LabelTenant and LabelDomain
+	Labels []string
+
+	// MaxValues limit distinct values of each label, default to 100
+	MaxValues int
+
+	// ASN return the autonomous system number of ip,
+	// required by LabelASN
+	ASN func(ip net.IP) string
+
+	mu       sync.Mutex
+	values   map[string]map[string]struct{}
+	counters map[string]map[string]uint64
+}
+
+// label is a name and value pair of metric label
+type label struct {
+	name, value string
+}
+
+// enabled report whether optional label name is enabled
+func (m *Metrics) enabled(name string) bool {
+	for _, l := range m.Labels {
+		if l == name {
+			return true
+		}
+	}
+	return false
+}
+
+// value return v when the label is within cardinality limit,
+// otherwise "other". m.mu MUST be held
+func (m *Metrics) value(name, v string) string {
+	if m.values == nil {
+		m.values = make(map[string]map[string]struct{})
+	}
+	seen, ok := m.values[name]
+	if !ok {
+		seen = make(map[string]struct{})
+		m.values[name] = seen
+	}
+	if _, ok := seen[v]; ok {
+		return v
+	}
+	max := m.MaxValues
+	if max <= 0 {
+		max = defaultMaxLabelValues
+	}
+	if len(seen) >= max {
+		return labelOther
+	}
+	seen[v] = struct{}{}
+	return v
+}
+
+// escapeLabel escape label value of text exposition format
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// add increase metric by n. fixed labels are always kept, optional
+// labels are dropped when disabled and capped by MaxValues
+func (m *Metrics) add(metric string, n uint64, fixed []label, optional []label) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := append([]label{}, fixed...)
+	for _, l := range optional {
+		if !m.enabled(l.name) {
+			continue
+		}
+		v := l.value
+		if v == "" {
+			v = "unknown"
+		}
+		labels = append(labels, label{l.name, m.value(l.name, v)})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = fmt.Sprintf(`%s="%s"`, l.name, escapeLabel(l.value))
+	}
+	key := strings.Join(parts, ",")
+
+	if m.counters == nil {
+		m.counters = make(map[string]map[string]uint64)
+	}
+	if m.counters[metric] == nil {
+		m.counters[metric] = make(map[string]uint64)
+	}
+	m.counters[metric][key] += n
+}
+
+// ServeHTTP write every counter in Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	names := make([]string, 0, len(m.counters))
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		keys := make([]string, 0, len(m.counters[name]))
+		for k := range m.counters[name] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if k == "" {
+				fmt.Fprintf(w, "%s %d\n", name, m.counters[name][k])
+			} else {
+				fmt.Fprintf(w, "%s{%s} %d\n", name, k, m.counters[name][k])
+			}
+		}
+	}
+}
+
+// metricLabels return optional labels of the session and envelope
+func (s *Session) metricLabels(envl *Envelope) []label {
+	m := s.Config.Metrics
+	var labels []label
+	if m.ASN != nil && m.enabled(LabelASN) {
+		asn := ""
+		if ip := s.RemoteIP(); ip != nil {
+			asn = m.ASN(ip)
+		}
+		labels = append(labels, label{LabelASN, asn})
+	}
+	if s.Principal != nil {
+		labels = append(labels, label{LabelTenant, s.Principal.Tenant})
+	} else {
+		labels = append(labels, label{LabelTenant, ""})
+	}
+	if envl != nil {
+		labels = append(labels, label{LabelDomain, strings.ToLower(domainOf(envl.OriginatorAddress))})
+	}
+	return labels
+}
+
+// countConnection count a new connection
+func (s *Session) countConnection() {
+	if s.Config.Metrics == nil {
+		return
+	}
+	s.Config.Metrics.add("smtp_connections_total", 1, nil, s.metricLabels(nil))
+}
+
+// countMessage count a message after DATA with its result
+func (s *Session) countMessage(envl *Envelope, err error) {
+	if s.Config.Metrics == nil {
+		return
+	}
+	result := "accepted"
+	if err != nil {
+		result = "rejected"
+		if e := replyErr(err); e.Temporary() {
+			result = "deferred"
+		}
+	}
+	labels := s.metricLabels(envl)
+	fixed := []label{{"result", result}}
+	s.Config.Metrics.add("smtp_messages_total", 1, fixed, labels)
+	s.Config.Metrics.add("smtp_recipients_total", uint64(len(envl.RecipientAddress)), fixed, labels)
+}
+
+// countDisconnect count a connection lost in state
+func (s *Session) countDisconnect(state State) {
+	if s.Config.Metrics == nil {
+		return
+	}
+	s.Config.Metrics.add("smtp_disconnects_total", 1, []label{{"state", state.String()}}, s.metricLabels(nil))
+}
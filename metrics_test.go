@@ -0,0 +1,61 @@
+package session
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestMetricsCardinality make sure that disabled labels are dropped
+// and values over the limit are counted as other
+func TestMetricsCardinality(t *testing.T) {
+	m := &Metrics{Labels: []string{LabelDomain}, MaxValues: 2}
+	for _, d := range []string{"a.com", "b.com", "c.com", "d.com", "a.com"} {
+		m.add("smtp_messages_total", 1, []label{{"result", "accepted"}}, []label{{LabelDomain, d}, {LabelTenant, "acme"}})
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, nil)
+	out := rec.Body.String()
+
+	expected := []string{
+		`smtp_messages_total{domain="a.com",result="accepted"} 2`,
+		`smtp_messages_total{domain="b.com",result="accepted"} 1`,
+		`smtp_messages_total{domain="other",result="accepted"} 2`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e+"\n") {
+			t.Errorf("got: %q, expected line %q", out, e)
+		}
+	}
+	if strings.Contains(out, "tenant") {
+		t.Errorf("got: %q, expected disabled tenant label dropped", out)
+	}
+}
+
+// TestSessionMetrics make sure that session count connections
+// and messages
+func TestSessionMetrics(t *testing.T) {
+	m := &Metrics{
+		Labels: []string{LabelASN, LabelDomain},
+		ASN:    func(ip net.IP) string { return "AS64496" },
+	}
+	config := &Config{Metrics: m}
+	runSessionFrom(t, config, "192.0.2.1:25", "EHLO client.com\r\nMAIL FROM:<some@Example.com>\r\nRCPT TO:<a@domain.com>\r\nRCPT TO:<b@domain.com>\r\nDATA\r\nSubject: test\r\n\r\n.\r\nQUIT\r\n")
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, nil)
+	out := rec.Body.String()
+
+	expected := []string{
+		`smtp_connections_total{asn="AS64496"} 1`,
+		`smtp_messages_total{asn="AS64496",domain="example.com",result="accepted"} 1`,
+		`smtp_recipients_total{asn="AS64496",domain="example.com",result="accepted"} 2`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e+"\n") {
+			t.Errorf("got: %q, expected line %q", out, e)
+		}
+	}
+}
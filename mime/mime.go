@@ -0,0 +1,195 @@
+// Package mime parses messages accepted by session into headers,
+// text and HTML bodies and attachments.
+//
+// Reader walk the MIME tree of a message and return its leaf parts
+// one at a time, with the Content-Transfer-Encoding decoded, so large
+// attachments can be streamed without loading them in memory. Parse
+// read the whole message for the common case.
+package mime
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	stdmime "mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// MaxDepth is the maximum nesting of multipart, deeper multipart
+// are returned as a leaf part
+const MaxDepth = 10
+
+// Part is a leaf part of a message. reading Part return its content
+// with the transfer encoding decoded. the content is only readable
+// until next call of Reader.NextPart
+type Part struct {
+	Header textproto.MIMEHeader
+	// MediaType is the lowercase media type of Content-Type, default
+	// to text/plain, and Params its parameters like charset
+	MediaType string
+	Params    map[string]string
+	// Disposition is the lowercase Content-Disposition type and
+	// Filename the filename parameter or Content-Type name parameter
+	Disposition string
+	Filename    string
+	// Depth is the multipart nesting of the part, 0 for message
+	// that is not multipart
+	Depth int
+
+	r io.Reader
+}
+
+// Read read the decoded content
+func (p *Part) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+// IsAttachment report whether the part is an attachment rather than
+// a text or HTML body of the message
+func (p *Part) IsAttachment() bool {
+	if p.Disposition == "attachment" || p.Filename != "" {
+		return true
+	}
+	return p.MediaType != "text/plain" && p.MediaType != "text/html"
+}
+
+// newPart parse the header of a part with raw content r
+func newPart(header textproto.MIMEHeader, r io.Reader, depth int) *Part {
+	p := &Part{Header: header, Depth: depth}
+	mediaType, params, err := stdmime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 section 5.2
+		mediaType, params = "text/plain", map[string]string{"charset": "us-ascii"}
+	}
+	p.MediaType, p.Params = mediaType, params
+	disposition, dparams, _ := stdmime.ParseMediaType(header.Get("Content-Disposition"))
+	p.Disposition, p.Filename = disposition, dparams["filename"]
+	if p.Filename == "" {
+		p.Filename = params["name"]
+	}
+	p.r = Decode(header.Get("Content-Transfer-Encoding"), r)
+	return p
+}
+
+// Decode wrap r with decoder of the Content-Transfer-Encoding
+func Decode(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// Reader return the leaf parts of a message in order
+type Reader struct {
+	// Header is the header of the message
+	Header mail.Header
+
+	stack []*multipart.Reader
+	leaf  *Part
+}
+
+// NewReader read the message header from r
+func NewReader(r io.Reader) (*Reader, error) {
+	msg, err := mail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	mr := &Reader{Header: msg.Header}
+	top := newPart(textproto.MIMEHeader(msg.Header), msg.Body, 0)
+	if !mr.push(top) {
+		mr.leaf = top
+	}
+	return mr, nil
+}
+
+// push start walking p when it is multipart
+func (mr *Reader) push(p *Part) bool {
+	if !strings.HasPrefix(p.MediaType, "multipart/") || len(mr.stack) >= MaxDepth {
+		return false
+	}
+	boundary := p.Params["boundary"]
+	if boundary == "" {
+		return false
+	}
+	mr.stack = append(mr.stack, multipart.NewReader(p.r, boundary))
+	return true
+}
+
+// NextPart return the next leaf part, or io.EOF after the last one
+func (mr *Reader) NextPart() (*Part, error) {
+	if mr.leaf != nil {
+		p := mr.leaf
+		mr.leaf = nil
+		return p, nil
+	}
+	for len(mr.stack) > 0 {
+		top := mr.stack[len(mr.stack)-1]
+		// use NextRawPart, transfer encoding is decoded by Part
+		raw, err := top.NextRawPart()
+		if err == io.EOF {
+			mr.stack = mr.stack[:len(mr.stack)-1]
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		p := newPart(raw.Header, raw, len(mr.stack))
+		if !mr.push(p) {
+			return p, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// Attachment is an attachment of parsed message
+type Attachment struct {
+	Filename  string
+	MediaType string
+	Data      []byte
+}
+
+// Message is a parsed message. Text and HTML are the first text and
+// HTML bodies, every other part is an attachment
+type Message struct {
+	Header      mail.Header
+	Text        string
+	HTML        string
+	Attachments []*Attachment
+}
+
+// Parse read the whole message from r
+func Parse(r io.Reader) (*Message, error) {
+	mr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{Header: mr.Header}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return msg, nil
+		}
+		if err != nil {
+			return msg, err
+		}
+		data, err := io.ReadAll(p)
+		if err != nil {
+			return msg, err
+		}
+		switch {
+		case !p.IsAttachment() && p.MediaType == "text/plain" && msg.Text == "":
+			msg.Text = string(data)
+		case !p.IsAttachment() && p.MediaType == "text/html" && msg.HTML == "":
+			msg.HTML = string(data)
+		default:
+			msg.Attachments = append(msg.Attachments, &Attachment{Filename: p.Filename, MediaType: p.MediaType, Data: data})
+		}
+	}
+}
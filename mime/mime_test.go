@@ -0,0 +1,92 @@
+package mime
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+const nested = "Subject: hello\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+	"preamble\r\n" +
+	"--b\r\nContent-Type: multipart/alternative; boundary=c\r\n\r\n" +
+	"--c\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nh=C3=A9llo\r\n" +
+	"--c\r\nContent-Type: text/html\r\n\r\n<p>hello</p>\r\n--c--\r\n" +
+	"--b\r\nContent-Type: text/plain; name=notes.txt\r\n\r\nnotes\r\n" +
+	"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"a b.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n\r\nJVBE\r\nRg==\r\n--b--\r\n"
+
+// TestReader make sure that leaf parts are returned in order with
+// their content decoded
+func TestReader(t *testing.T) {
+	cases := []struct {
+		mediaType  string
+		filename   string
+		depth      int
+		attachment bool
+		content    string
+	}{
+		{"text/plain", "", 2, false, "héllo"},
+		{"text/html", "", 2, false, "<p>hello</p>"},
+		{"text/plain", "notes.txt", 1, true, "notes"},
+		{"application/pdf", "a b.pdf", 1, true, "%PDF"},
+	}
+
+	mr, err := NewReader(strings.NewReader(nested))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mr.Header.Get("Subject"); got != "hello" {
+		t.Errorf("got subject %q", got)
+	}
+	for _, input := range cases {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("%s: %v", input.mediaType, err)
+		}
+		// leave html unread, NextPart skip the rest of the part
+		if input.mediaType == "text/html" {
+			continue
+		}
+		content, err := io.ReadAll(p)
+		if err != nil || string(content) != input.content {
+			t.Errorf("%s: got %q %v, expected %q", input.mediaType, content, err, input.content)
+		}
+		if p.MediaType != input.mediaType || p.Filename != input.filename || p.Depth != input.depth || p.IsAttachment() != input.attachment {
+			t.Errorf("%s: got %+v", input.mediaType, p)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("got %v, expected EOF", err)
+	}
+}
+
+// TestParse make sure that messages are split into text, HTML and
+// attachments, including messages that are not multipart
+func TestParse(t *testing.T) {
+	cases := []struct {
+		data        string
+		text        string
+		html        string
+		attachments int
+	}{
+		{nested, "héllo", "<p>hello</p>", 2},
+		{"Subject: a\r\n\r\nplain body\r\n", "plain body\r\n", "", 0},
+		{"Content-Type: text/html\r\n\r\n<b>x</b>", "", "<b>x</b>", 0},
+		{"Content-Type: image/png\r\nContent-Transfer-Encoding: base64\r\n\r\niVBO", "", "", 1},
+		{"Content-Type: multipart/mixed\r\n\r\nno boundary", "", "", 1},
+	}
+
+	for _, input := range cases {
+		msg, err := Parse(strings.NewReader(input.data))
+		if err != nil {
+			t.Fatalf("%q: %v", input.data, err)
+		}
+		if msg.Text != input.text || msg.HTML != input.html || len(msg.Attachments) != input.attachments {
+			t.Errorf("%q: got %q %q %d attachments", input.data, msg.Text, msg.HTML, len(msg.Attachments))
+		}
+	}
+
+	if _, err := Parse(strings.NewReader("no header")); err == nil {
+		t.Errorf("got no error, expected invalid message")
+	}
+}
@@ -0,0 +1,241 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MTA-STS policy modes (RFC 8461 section 3.2)
+const (
+	STSEnforce = "enforce"
+	STSTesting = "testing"
+	STSNone    = "none"
+)
+
+// limits of MTA-STS policies
+const (
+	// maxSTSPolicySize is the largest policy file fetched
+	maxSTSPolicySize = 64 << 10
+	// maxSTSMaxAge is the largest max_age, about a year
+	maxSTSMaxAge = 31557600
+	// defaultSTSTimeout is the timeout of policy fetch
+	defaultSTSTimeout = time.Minute
+)
+
+// STSPolicy is the MTA-STS policy of a domain
+type STSPolicy struct {
+	// ID is the id of the _mta-sts TXT record
+	ID     string
+	Mode   string
+	MX     []string
+	MaxAge time.Duration
+
+	expires time.Time
+}
+
+// Match report whether host is an allowed mail exchanger. a pattern
+// "*.example.com" match a single leftmost label
+func (p *STSPolicy) Match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, mx := range p.MX {
+		mx = strings.ToLower(strings.TrimSuffix(mx, "."))
+		if suffix, ok := strings.CutPrefix(mx, "*."); ok {
+			i := strings.IndexByte(host, '.')
+			if i > 0 && host[i+1:] == suffix {
+				return true
+			}
+		} else if host == mx {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSTSPolicy parse the policy file of MTA-STS (RFC 8461 section 3.2)
+func ParseSTSPolicy(text string) (*STSPolicy, error) {
+	p := &STSPolicy{}
+	var version string
+	maxAge := -1
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("mta-sts: invalid line %q", line)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "version":
+			version = value
+		case "mode":
+			p.Mode = value
+		case "mx":
+			p.MX = append(p.MX, value)
+		case "max_age":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("mta-sts: invalid max_age %q", value)
+			}
+			maxAge = min(n, maxSTSMaxAge)
+		}
+	}
+
+	switch {
+	case version != "STSv1":
+		return nil, fmt.Errorf("mta-sts: unsupported version %q", version)
+	case p.Mode != STSEnforce && p.Mode != STSTesting && p.Mode != STSNone:
+		return nil, fmt.Errorf("mta-sts: invalid mode %q", p.Mode)
+	case maxAge < 0:
+		return nil, errors.New("mta-sts: missing max_age")
+	case p.Mode != STSNone && len(p.MX) == 0:
+		return nil, errors.New("mta-sts: missing mx")
+	}
+	p.MaxAge = time.Duration(maxAge) * time.Second
+	return p, nil
+}
+
+// stsRecordID return the id of the _mta-sts TXT record of domain, ""
+// when there is none
+func stsRecordID(txts []string) (string, error) {
+	var id string
+	found := 0
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=STSv1") {
+			continue
+		}
+		found++
+		for _, field := range strings.Split(txt, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(field), "id="); ok {
+				id = v
+			}
+		}
+	}
+	switch {
+	case found == 0:
+		return "", nil
+	case found > 1:
+		return "", errors.New("mta-sts: multiple TXT records")
+	case id == "" || len(id) > 32:
+		return "", errors.New("mta-sts: invalid id")
+	}
+	return id, nil
+}
+
+// MTASTS fetch and cache the MTA-STS policies of recipient domains
+// (RFC 8461)
+type MTASTS struct {
+	// Resolver is used to look up _mta-sts TXT records,
+	// default to net.DefaultResolver
+	Resolver Resolver
+	// HTTPClient fetch policies, redirects are never followed,
+	// default to http.DefaultClient
+	HTTPClient *http.Client
+	// Timeout of policy fetch, default to 1 minute
+	Timeout time.Duration
+
+	once  sync.Once
+	mu    sync.Mutex
+	cache map[string]*STSPolicy
+}
+
+func (m *MTASTS) init() {
+	m.once.Do(func() {
+		m.cache = make(map[string]*STSPolicy)
+	})
+}
+
+func (m *MTASTS) resolver() Resolver {
+	if m.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return m.Resolver
+}
+
+// Policy return the policy of domain, nil when it has none. the
+// cached policy is used until max_age expire or the id of the TXT
+// record change, and when the new policy can't be fetched
+func (m *MTASTS) Policy(ctx context.Context, domain string) (*STSPolicy, error) {
+	m.init()
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	m.mu.Lock()
+	cached := m.cache[domain]
+	m.mu.Unlock()
+	if cached != nil && time.Now().After(cached.expires) {
+		cached = nil
+	}
+
+	txts, err := m.resolver().LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		if de, ok := err.(*net.DNSError); ok && de.IsNotFound {
+			return cached, nil
+		}
+		return cached, err
+	}
+	id, err := stsRecordID(txts)
+	if err != nil || id == "" {
+		return cached, err
+	}
+	if cached != nil && cached.ID == id {
+		return cached, nil
+	}
+
+	p, err := m.fetch(ctx, domain)
+	if err != nil {
+		return cached, err
+	}
+	p.ID = id
+	p.expires = time.Now().Add(p.MaxAge)
+	m.mu.Lock()
+	m.cache[domain] = p
+	m.mu.Unlock()
+	return p, nil
+}
+
+// fetch get the policy file of domain over HTTPS
+func (m *MTASTS) fetch(ctx context.Context, domain string) (*STSPolicy, error) {
+	ctx, cancel := context.WithTimeout(ctx, durationOr(m.Timeout, defaultSTSTimeout))
+	defer cancel()
+
+	client := http.Client{}
+	if m.HTTPClient != nil {
+		client = *m.HTTPClient
+	}
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://mta-sts."+domain+"/.well-known/mta-sts.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("mta-sts: policy fetch: %s", resp.Status)
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != "text/plain" {
+		return nil, fmt.Errorf("mta-sts: policy content type %q", mt)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSTSPolicySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSTSPolicySize {
+		return nil, errors.New("mta-sts: policy too large")
+	}
+	return ParseSTSPolicy(string(body))
+}
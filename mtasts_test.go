@@ -0,0 +1,103 @@
+package session
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseSTSPolicy(t *testing.T) {
+	cases := []struct {
+		text  string
+		valid bool
+	}{
+		{"version: STSv1\r\nmode: enforce\r\nmx: mx.example.com\r\nmx: *.example.net\r\nmax_age: 86400\r\n", true},
+		{"version: STSv1\nmode: none\nmax_age: 0\n", true},
+		{"version: STSv1\nmode: testing\nmax_age: 86400\n", false},
+		{"version: STSv2\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n", false},
+		{"version: STSv1\nmode: strict\nmx: mx.example.com\nmax_age: 86400\n", false},
+		{"version: STSv1\nmode: enforce\nmx: mx.example.com\n", false},
+		{"version: STSv1\nmode: enforce\nmx mx.example.com\nmax_age: 86400\n", false},
+	}
+	for _, input := range cases {
+		_, err := ParseSTSPolicy(input.text)
+		if (err == nil) != input.valid {
+			t.Errorf("%q: got %v, expected valid %v", input.text, err, input.valid)
+		}
+	}
+}
+
+func TestSTSPolicyMatch(t *testing.T) {
+	p := &STSPolicy{MX: []string{"mx.example.com", "*.example.net"}}
+	cases := []struct {
+		host     string
+		expected bool
+	}{
+		{"mx.example.com", true},
+		{"MX.Example.com.", true},
+		{"mx2.example.com", false},
+		{"mx.example.net", true},
+		{"a.mx.example.net", false},
+		{"example.net", false},
+	}
+	for _, input := range cases {
+		if got := p.Match(input.host); got != input.expected {
+			t.Errorf("%q: got %v, expected %v", input.host, got, input.expected)
+		}
+	}
+}
+
+// TestMTASTSPolicy make sure that policies are fetched over HTTPS and
+// cached until the id of the TXT record change
+func TestMTASTSPolicy(t *testing.T) {
+	fetches := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if r.Host != "mta-sts.example.com" || r.URL.Path != "/.well-known/mta-sts.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("version: STSv1\nmode: enforce\nmx: *.example.com\nmax_age: 86400\n"))
+	}))
+	defer srv.Close()
+	client := srv.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial(network, srv.Listener.Addr().String())
+	}
+	client.Transport = transport
+
+	resolver := &fakeResolver{txts: map[string][]string{
+		"_mta-sts.example.com": {"v=STSv1; id=20240101T000000;"},
+		"_mta-sts.example.org": {"v=STSv1; id=1", "v=STSv1; id=2"},
+	}}
+	m := &MTASTS{Resolver: resolver, HTTPClient: client}
+
+	p, err := m.Policy(context.Background(), "example.com")
+	if err != nil || p == nil || p.Mode != STSEnforce || p.ID != "20240101T000000" {
+		t.Fatalf("got %+v %v, expected enforced policy", p, err)
+	}
+	if p, _ = m.Policy(context.Background(), "example.com"); p == nil || fetches != 1 {
+		t.Errorf("got %d fetches, expected cached policy", fetches)
+	}
+	resolver.txts["_mta-sts.example.com"] = []string{"v=STSv1; id=2"}
+	if p, _ = m.Policy(context.Background(), "example.com"); p == nil || p.ID != "2" || fetches != 2 {
+		t.Errorf("got %d fetches, expected new policy", fetches)
+	}
+
+	// the cached policy is used when the TXT record disappear
+	delete(resolver.txts, "_mta-sts.example.com")
+	if p, err = m.Policy(context.Background(), "example.com"); p == nil || err != nil {
+		t.Errorf("got %v %v, expected cached policy", p, err)
+	}
+
+	if p, err = m.Policy(context.Background(), "example.org"); p != nil || err == nil {
+		t.Errorf("got %v %v, expected error of multiple records", p, err)
+	}
+	if p, err = m.Policy(context.Background(), "example.net"); p != nil || err != nil {
+		t.Errorf("got %v %v, expected no policy", p, err)
+	}
+}
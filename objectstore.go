@@ -0,0 +1,126 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+// Uploader put objects into an object store, e.g. an S3 bucket. the
+// S3 client is chosen by the application
+type Uploader interface {
+	// Upload store size bytes read from r under key, size is -1 when
+	// the message is streamed from the connection
+	Upload(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+}
+
+// UploaderFunc is an adapter to allow the use of ordinary functions
+// as Uploader
+type UploaderFunc func(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+
+// Upload call f(ctx, key, r, size, contentType)
+func (f UploaderFunc) Upload(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	return f(ctx, key, r, size, contentType)
+}
+
+// ObjectDeleter is implemented by Uploader that can remove objects,
+// it is used to remove objects whose metadata was not recorded
+type ObjectDeleter interface {
+	Delete(ctx context.Context, key string) error
+}
+
+// StoredObject describe a message uploaded by ObjectBackend
+type StoredObject struct {
+	Key       string
+	Size      int64
+	SHA256    string
+	MessageID string
+	Envelope  *Envelope
+}
+
+// ObjectBackend is a Backend uploading message data to an object
+// store while it is received, without a copy on local disk. the
+// metadata of every uploaded message is given to Record, e.g. to
+// insert it into a database
+type ObjectBackend struct {
+	Uploader Uploader
+	// Prefix is prepended to the default keys "2006/01/02/<id>.eml"
+	Prefix string
+	// Key return the object key of a message instead of the default
+	Key func(envl *Envelope) string
+	// Record is called after the upload, an error fail the delivery
+	Record func(ctx context.Context, obj *StoredObject) error
+	// Timeout bound the upload and Record, no timeout when zero
+	Timeout time.Duration
+	// Logger receive errors deleting objects, default to the
+	// standard logger
+	Logger *Logger
+}
+
+// key return the object key of envl
+func (b *ObjectBackend) key(envl *Envelope) string {
+	if b.Key != nil {
+		return b.Key(envl)
+	}
+	return b.Prefix + time.Now().UTC().Format("2006/01/02/") + newSpoolID() + ".eml"
+}
+
+// Deliver upload data and record its metadata
+func (b *ObjectBackend) Deliver(envl *Envelope, data []byte) error {
+	return b.store(envl, bytes.NewReader(data), int64(len(data)), messageID(data))
+}
+
+// DeliverStream upload the message while it is read from r and
+// record its metadata, MessageID of StoredObject is not set
+func (b *ObjectBackend) DeliverStream(envl *Envelope, r io.Reader) error {
+	return b.store(envl, r, -1, "")
+}
+
+// countWriter count bytes written
+type countWriter int64
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	*c += countWriter(len(p))
+	return len(p), nil
+}
+
+// store upload r and record its metadata. when Record fail the
+// object is deleted if Uploader implement ObjectDeleter
+func (b *ObjectBackend) store(envl *Envelope, r io.Reader, size int64, msgID string) error {
+	ctx := context.Background()
+	if b.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.Timeout)
+		defer cancel()
+	}
+	h := sha256.New()
+	var n countWriter
+	key := b.key(envl)
+	err := b.Uploader.Upload(ctx, key, io.TeeReader(r, io.MultiWriter(h, &n)), size, "message/rfc822")
+	if err != nil {
+		return err
+	}
+	if b.Record == nil {
+		return nil
+	}
+	obj := &StoredObject{
+		Key:       key,
+		Size:      int64(n),
+		SHA256:    hex.EncodeToString(h.Sum(nil)),
+		MessageID: msgID,
+		Envelope:  envl,
+	}
+	err = b.Record(ctx, obj)
+	if err == nil {
+		return nil
+	}
+	if d, ok := b.Uploader.(ObjectDeleter); ok {
+		if err := d.Delete(context.Background(), obj.Key); err != nil {
+			logf(b.Logger, LevelWarn, "objectstore: %v", err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memoryStore is an Uploader keeping objects in memory
+type memoryStore struct {
+	mu      sync.Mutex
+	objects map[string]string
+}
+
+func (m *memoryStore) Upload(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if (size >= 0 && int64(len(data)) != size) || contentType != "message/rfc822" {
+		return errors.New("invalid upload")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.objects == nil {
+		m.objects = make(map[string]string)
+	}
+	m.objects[key] = string(data)
+	return nil
+}
+
+func (m *memoryStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+// TestObjectBackend make sure that messages are streamed, recorded
+// and removed when they can't be recorded
+func TestObjectBackend(t *testing.T) {
+	cases := []struct {
+		upload  error
+		record  error
+		reply   string
+		objects int
+	}{
+		{nil, nil, "250 2.0.0 OK: queued as ", 1},
+		{errors.New("bucket down"), nil, "451 4.3.0", 0},
+		{nil, errors.New("database down"), "451 4.3.0", 0},
+		{nil, NewSMTPError(552, [3]int{5, 2, 2}, "Mailbox full"), "552 5.2.2", 0},
+	}
+
+	for _, input := range cases {
+		store := &memoryStore{}
+		var recorded *StoredObject
+		b := &ObjectBackend{
+			Uploader: UploaderFunc(func(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+				if input.upload != nil {
+					return input.upload
+				}
+				return store.Upload(ctx, key, r, size, contentType)
+			}),
+			Prefix: "inbound/",
+			Record: func(ctx context.Context, obj *StoredObject) error {
+				recorded = obj
+				return input.record
+			},
+		}
+		if input.upload == nil {
+			// delete through the store when the record fail
+			b.Uploader = store
+		}
+		out := runSession(t, &Config{Backend: b}, "EHLO client.com\r\nMAIL FROM:<a@client.com>\r\nRCPT TO:<b@example.com>\r\n"+
+			"DATA\r\nMessage-ID: <1@client.com>\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+		if !strings.Contains(out, input.reply) {
+			t.Errorf("%v %v: got %q, expected %q", input.upload, input.record, out, input.reply)
+		}
+		if len(store.objects) != input.objects {
+			t.Errorf("%v %v: got %d objects, expected %d", input.upload, input.record, len(store.objects), input.objects)
+		}
+		if input.upload != nil {
+			continue
+		}
+		if !strings.HasPrefix(recorded.Key, "inbound/") || !strings.HasSuffix(recorded.Key, ".eml") ||
+			recorded.MessageID != "" || recorded.Size != 36 || len(recorded.SHA256) != 64 {
+			t.Errorf("got %+v", recorded)
+		}
+	}
+}
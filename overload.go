@@ -0,0 +1,66 @@
+package session
+
+import (
+	"strings"
+)
+
+// default size limit of messages accepted during overload
+const defaultPriorityMaxSize = 64 * 1024
+
+// priorityMailboxes are local parts that still receive mail
+// during overload (RFC 5321 section 4.5.1, RFC 2142)
+var priorityMailboxes = []string{"postmaster", "abuse"}
+
+var (
+	// overloadErr is sent to other recipients during overload
+	overloadErr = NewSMTPError(452, [3]int{4, 3, 1}, "Insufficient system resources, try again later")
+	// priorityTooLargeErr is sent when message to priority
+	// mailbox exceed the size limit during overload
+	priorityTooLargeErr = NewSMTPError(552, [3]int{5, 3, 4}, "Message too big for system under load")
+)
+
+// isPriorityRcpt report whether addr is postmaster or abuse mailbox
+func isPriorityRcpt(addr string) bool {
+	local := addr
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		local = addr[:i]
+	}
+	for _, m := range priorityMailboxes {
+		if strings.EqualFold(local, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Overloaded report whether the session only accept mail to
+// postmaster and abuse, either because it was admitted over the
+// connection limit or Config.Overloaded report backpressure
+func (s *Session) Overloaded() bool {
+	if s.overloaded {
+		return true
+	}
+	return s.Config.Overloaded != nil && s.Config.Overloaded()
+}
+
+// priorityMaxSize return size limit of messages during overload
+func (s *Session) priorityMaxSize() int {
+	if s.Config.PriorityMaxSize > 0 {
+		return s.Config.PriorityMaxSize
+	}
+	return defaultPriorityMaxSize
+}
+
+// checkOverload check the envelope before DATA during overload,
+// every recipient MUST be a priority mailbox
+func (s *Session) checkOverload(envl *Envelope) error {
+	if !s.Overloaded() {
+		return nil
+	}
+	for _, rcpt := range envl.RecipientAddress {
+		if !isPriorityRcpt(rcpt) {
+			return overloadErr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestIsPriorityRcpt(t *testing.T) {
+	cases := []struct {
+		addr     string
+		expected bool
+	}{
+		{"postmaster@domain.com", true},
+		{"PostMaster@domain.com", true},
+		{"abuse@domain.com", true},
+		{"postmaster", true},
+		{"some@domain.com", false},
+		{"postmaster.team@domain.com", false},
+	}
+
+	for _, input := range cases {
+		got := isPriorityRcpt(input.addr)
+		if got != input.expected {
+			t.Errorf("isPriorityRcpt(%q) == %v, expected %v", input.addr, got, input.expected)
+		}
+	}
+}
+
+// TestSessionOverload make sure that only mail to postmaster and
+// abuse within the size limit is accepted during overload
+func TestSessionOverload(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected []string
+	}{
+		{
+			"EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nQUIT\r\n",
+			[]string{"452 4.3.1 Insufficient system resources"},
+		},
+		{
+			"EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<abuse@domain.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\nSubject: spam\r\n\r\nbody\r\n.\r\nQUIT\r\n",
+			[]string{"250 2.1.5", "452 4.3.1", "354", "250 2.0.0", "221"},
+		},
+		{
+			"EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<postmaster@domain.com>\r\nDATA\r\nSubject: big\r\n\r\n" +
+				strings.Repeat("0123456789\r\n", 20) + ".\r\nQUIT\r\n",
+			[]string{"250 2.1.5", "354", "552 5.3.4"},
+		},
+	}
+
+	for _, input := range cases {
+		var delivered []string
+		config := &Config{
+			PriorityMaxSize: 128,
+			Overloaded:      func() bool { return true },
+			Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+				delivered = append(delivered, envl.RecipientAddress...)
+				return nil
+			}),
+		}
+		out := runSession(t, config, input.input)
+
+		pos := 0
+		for _, e := range input.expected {
+			i := strings.Index(out[pos:], e)
+			if i < 0 {
+				t.Fatalf("got: %q, expected %q in order", out, e)
+			}
+			pos += i
+		}
+		for _, rcpt := range delivered {
+			if !isPriorityRcpt(rcpt) {
+				t.Errorf("delivered to %q during overload", rcpt)
+			}
+		}
+	}
+}
+
+// TestServerPriorityConnections make sure that connection over
+// MaxConnections is admitted only for postmaster and abuse
+func TestServerPriorityConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(&Config{MaxConnections: 1, PriorityConnections: 1})
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+
+	first := dialTestClient(t, l.Addr().String())
+	second := dialTestClient(t, l.Addr().String())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	third := &testClient{conn: conn, reader: bufio.NewReader(conn)}
+	third.expect(t, "421 4.3.2 Too many connections")
+
+	first.cmd(t, "EHLO client.com", "250")
+	first.cmd(t, "MAIL FROM:<some@example.com>", "250")
+	first.cmd(t, "RCPT TO:<some@domain.com>", "250")
+
+	second.cmd(t, "EHLO client.com", "250")
+	second.cmd(t, "MAIL FROM:<some@example.com>", "250")
+	second.cmd(t, "RCPT TO:<some@domain.com>", "452")
+	second.cmd(t, "RCPT TO:<postmaster@domain.com>", "250")
+
+	first.cmd(t, "QUIT", "221")
+	second.cmd(t, "QUIT", "221")
+}
@@ -0,0 +1,102 @@
+package session
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// pbkdf2Prefix is the prefix of PBKDF2-SHA256 hashes of passlib
+const pbkdf2Prefix = "$pbkdf2-sha256$"
+
+// ErrPasswordScheme is returned for a hash of unregistered scheme
+var ErrPasswordScheme = errors.New("session: unknown password hash scheme")
+
+// PasswordVerifier report whether password match hash
+type PasswordVerifier func(hash, password string) (bool, error)
+
+var (
+	schemesMu       sync.RWMutex
+	passwordSchemes = map[string]PasswordVerifier{argon2Prefix: verifyArgon2, pbkdf2Prefix: verifyPBKDF2}
+)
+
+// verifySem bound concurrent password verifications, an argon2id
+// hash use 19 MiB of memory and parallel AUTH attempts would
+// exhaust it
+var verifySem = make(chan struct{}, runtime.GOMAXPROCS(0))
+
+// RegisterPasswordScheme add verifier of hashes starting with prefix.
+// the package only verify argon2id and PBKDF2-SHA256 itself, bcrypt
+// ("$2y$", "$2b$") hashes are verified by registering e.g.
+// golang.org/x/crypto implementation
+func RegisterPasswordScheme(prefix string, verify PasswordVerifier) {
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	passwordSchemes[prefix] = verify
+}
+
+// VerifyPassword report whether password match hash of any
+// registered scheme. verifications wait for each other beyond the
+// number of CPUs
+func VerifyPassword(hash, password string) (bool, error) {
+	schemesMu.RLock()
+	var verify PasswordVerifier
+	for prefix, v := range passwordSchemes {
+		if strings.HasPrefix(hash, prefix) {
+			verify = v
+			break
+		}
+	}
+	schemesMu.RUnlock()
+	if verify == nil {
+		return false, ErrPasswordScheme
+	}
+	verifySem <- struct{}{}
+	defer func() { <-verifySem }()
+	return verify(hash, password)
+}
+
+// ab64 is the base64 alphabet of passlib, "." instead of "+"
+var ab64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./").WithPadding(base64.NoPadding)
+
+// HashPassword hash password with argon2id in the PHC string format:
+// $argon2id$v=19$m=memory,t=time,p=threads$salt$checksum. hashes of
+// other schemes are still verified
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hashArgon2(password, salt, argon2Time, argon2Memory, argon2Threads), nil
+}
+
+func verifyPBKDF2(hash, password string) (bool, error) {
+	parts := strings.Split(strings.TrimPrefix(hash, pbkdf2Prefix), "$")
+	if len(parts) != 3 {
+		return false, ErrPasswordScheme
+	}
+	rounds, err := strconv.Atoi(parts[0])
+	if err != nil || rounds <= 0 {
+		return false, ErrPasswordScheme
+	}
+	salt, err := ab64.DecodeString(parts[1])
+	if err != nil {
+		return false, ErrPasswordScheme
+	}
+	expected, err := ab64.DecodeString(parts[2])
+	if err != nil || len(expected) == 0 {
+		return false, ErrPasswordScheme
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, rounds, len(expected))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
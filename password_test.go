@@ -0,0 +1,100 @@
+package session
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testHash is PBKDF2-SHA256 of "secret" with 1000 rounds made by
+// Python hashlib
+const testHash = "$pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0c2FsdA$dClvKSmj66n6MdMWNv3Go4mvH1Ym2WIGiJvquqa.mfE"
+
+// testArgon2Hash is argon2id of "secret" with salt "saltsaltsaltsalt",
+// 64 KiB of memory and 1 pass
+const testArgon2Hash = "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$+v0rf6ETYAIpqJIjJyARZ3W3zqJlkf+0TRXzsLHmR6o"
+
+// TestVerifyPassword make sure that hashes are verified by the
+// scheme of their prefix
+func TestVerifyPassword(t *testing.T) {
+	RegisterPasswordScheme("{PLAIN}", func(hash, password string) (bool, error) {
+		return hash[len("{PLAIN}"):] == password, nil
+	})
+
+	cases := []struct {
+		hash     string
+		password string
+		expected bool
+		err      error
+	}{
+		{testHash, "secret", true, nil},
+		{testHash, "wrong", false, nil},
+		{"$pbkdf2-sha256$1000$c2FsdA", "secret", false, ErrPasswordScheme},
+		{"$pbkdf2-sha256$x$c2FsdA$c2FsdA", "secret", false, ErrPasswordScheme},
+		{testArgon2Hash, "secret", true, nil},
+		{testArgon2Hash, "wrong", false, nil},
+		{"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$c2FsdA", "secret", false, ErrPasswordScheme},
+		{"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$c2FsdHNhbHQ", "secret", false, ErrPasswordScheme},
+		{"$2y$10$c2FsdHNhbHRzYWx0c2FsdA", "secret", false, ErrPasswordScheme},
+		{"{PLAIN}secret", "secret", true, nil},
+	}
+
+	for _, input := range cases {
+		got, err := VerifyPassword(input.hash, input.password)
+		if got != input.expected || err != input.err {
+			t.Errorf("%q: got %v, %v, expected %v, %v", input.hash, got, err, input.expected, input.err)
+		}
+	}
+}
+
+// TestHashPassword make sure that hashes are salted and verified
+func TestHashPassword(t *testing.T) {
+	a, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := HashPassword("secret")
+	if a == b {
+		t.Error("hashes of the same password are equal")
+	}
+	if !strings.HasPrefix(a, "$argon2id$v=19$m=19456,t=2,p=1$") {
+		t.Errorf("got %q, expected argon2id hash", a)
+	}
+	if ok, err := VerifyPassword(a, "secret"); !ok || err != nil {
+		t.Errorf("%q: got %v, %v, expected match", a, ok, err)
+	}
+}
+
+// TestVerifyPasswordConcurrency make sure that concurrent
+// verifications are bounded
+func TestVerifyPasswordConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var running, max int
+	RegisterPasswordScheme("{SLOW}", func(hash, password string) (bool, error) {
+		mu.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return true, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4*cap(verifySem); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			VerifyPassword("{SLOW}", "secret")
+		}()
+	}
+	wg.Wait()
+	if max > cap(verifySem) {
+		t.Errorf("got %d concurrent verifications, expected at most %d", max, cap(verifySem))
+	}
+}
@@ -0,0 +1,281 @@
+package session
+
+import (
+	"net/netip"
+	"strings"
+	"unicode/utf8"
+)
+
+// the parsers of this file check the paths of MAIL and RCPT without
+// allocating, except for source routes. an address is atom "@"
+// domain, atom is made of ASCII letters and digits, ".", "_", "-"
+// and UTF-8 for SMTPUTF8 (RFC 6531). a domain is labels ending with
+// "." followed by a top-level domain: 2 or more letters, an A-label
+// or 2 or more non-ASCII characters. like the path syntax of RFC
+// 5321, the path may start with a source route which is ignored.
+// the domain may also be an address literal like [192.0.2.1] or
+// [IPv6:2001:db8::1]
+
+// isAtomByte report whether b may appear in local part and domain,
+// bytes of UTF-8 sequences included
+func isAtomByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' ||
+		b == '.' || b == '_' || b == '-' || b >= utf8.RuneSelf
+}
+
+// isLetter report whether b is an ASCII letter
+func isLetter(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// atomEnd return the end of the atom bytes of s starting at i
+func atomEnd(s string, i int) int {
+	for i < len(s) && isAtomByte(s[i]) {
+		i++
+	}
+	return i
+}
+
+// nonASCIIEnd return the end of the non-ASCII characters at the start
+// of t and their number
+func nonASCIIEnd(t string) (end, n int) {
+	for end < len(t) && t[end] >= utf8.RuneSelf {
+		_, size := utf8.DecodeRuneInString(t[end:])
+		end += size
+		n++
+	}
+	return end, n
+}
+
+// validTLD report whether t is a top-level domain
+func validTLD(t string) bool {
+	letters := 0
+	for letters < len(t) && isLetter(t[letters]) {
+		letters++
+	}
+	if letters == len(t) {
+		return letters >= 2
+	}
+	if rest, ok := strings.CutPrefix(t, "xn--"); ok && rest != "" {
+		for i := 0; i < len(rest); i++ {
+			if b := rest[i]; !isLetter(b) && !(b >= '0' && b <= '9') && b != '-' {
+				return false
+			}
+		}
+		return true
+	}
+	end, n := nonASCIIEnd(t)
+	return end == len(t) && n >= 2
+}
+
+// validDomain report whether the atom bytes d are a domain
+func validDomain(d string) bool {
+	// the top-level domain has no ".", it follow the last one
+	i := strings.LastIndexByte(d, '.')
+	return i >= 1 && validTLD(d[i+1:])
+}
+
+// validAddressLiteral report whether lit, without brackets, is an
+// IPv4 address or an IPv6 address tagged "IPv6:" (RFC 5321 section
+// 4.1.3)
+func validAddressLiteral(lit string) bool {
+	if len(lit) > 5 && strings.EqualFold(lit[:5], "IPv6:") {
+		a, err := netip.ParseAddr(lit[5:])
+		return err == nil && a.Is6() && a.Zone() == ""
+	}
+	a, err := netip.ParseAddr(lit)
+	return err == nil && a.Is4()
+}
+
+// literalEnd match the address literal at i of s and return the end
+// after "]", -1 when there is none
+func literalEnd(s string, i int) int {
+	if i >= len(s) || s[i] != '[' {
+		return -1
+	}
+	j := strings.IndexByte(s[i:], ']')
+	if j < 0 || !validAddressLiteral(s[i+1:i+j]) {
+		return -1
+	}
+	return i + j + 1
+}
+
+// addrEnd match the address at i of s followed by ">" and return the
+// end of the address, -1 when there is none
+func addrEnd(s string, i int) int {
+	at := atomEnd(s, i)
+	if at == i || at == len(s) || s[at] != '@' {
+		return -1
+	}
+	if end := literalEnd(s, at+1); end >= 0 {
+		if end == len(s) || s[end] != '>' {
+			return -1
+		}
+		return end
+	}
+	end := atomEnd(s, at+1)
+	if end == len(s) || s[end] != '>' || !validDomain(s[at+1:end]) {
+		return -1
+	}
+	return end
+}
+
+// validMailPath report whether arg contain the path "<" address ">"
+func validMailPath(arg string) bool {
+	for i := 0; i < len(arg); i++ {
+		if arg[i] == '<' && addrEnd(arg, i+1) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPath report whether arg contain something in angle brackets
+func hasPath(arg string) bool {
+	i := strings.IndexByte(arg, '<')
+	return i >= 0 && strings.LastIndexByte(arg, '>') > i+1
+}
+
+// validRcptPath report whether arg contain the path "<" address ">"
+// with optional source route like "<@a.example,@b.example:address>"
+func validRcptPath(arg string) bool {
+	for i := 0; i < len(arg); i++ {
+		if arg[i] != '<' {
+			continue
+		}
+		if addrEnd(arg, i+1) >= 0 || i+2 < len(arg) && arg[i+1] == ':' && addrEnd(arg, i+2) >= 0 {
+			return true
+		}
+		if i+1 < len(arg) && arg[i+1] == '@' {
+			r := routeMatcher{s: arg, memo: make([]int8, len(arg)+1)}
+			if r.match(i + 1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// routeMatcher match the rest of path after "<": the source route
+// and the address. the end of route domains is ambiguous when "," or
+// ":" is omitted, so every possible end is tried and results are
+// memoized by position
+type routeMatcher struct {
+	s    string
+	memo []int8
+}
+
+func (r *routeMatcher) match(i int) bool {
+	switch r.memo[i] {
+	case 1:
+		return true
+	case -1:
+		return false
+	}
+	ok := r.matchRoute(i)
+	r.memo[i] = -1
+	if ok {
+		r.memo[i] = 1
+	}
+	return ok
+}
+
+func (r *routeMatcher) matchRoute(i int) bool {
+	s := r.s
+	if addrEnd(s, i) >= 0 {
+		return true
+	}
+	if i < len(s) && s[i] == ':' && addrEnd(s, i+1) >= 0 {
+		return true
+	}
+	if i == len(s) || s[i] != '@' {
+		return false
+	}
+	start := i + 1
+	run := atomEnd(s, start)
+	for k := start + 1; k < run; k++ {
+		if s[k] != '.' {
+			continue
+		}
+		for _, end := range tldEnds(s[k+1 : run]) {
+			e := k + 1 + end
+			if r.match(e) || e < len(s) && s[e] == ',' && r.match(e+1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tldEnds return every end of a top-level domain at the start of t
+func tldEnds(t string) []int {
+	var ends []int
+	letters := 0
+	for letters < len(t) && isLetter(t[letters]) {
+		letters++
+	}
+	for n := 2; n <= letters; n++ {
+		ends = append(ends, n)
+	}
+	if strings.HasPrefix(t, "xn--") {
+		for n := 4; n < len(t); n++ {
+			if b := t[n]; !isLetter(b) && !(b >= '0' && b <= '9') && b != '-' {
+				break
+			}
+			ends = append(ends, n+1)
+		}
+	}
+	for end, n := 0, 0; end < len(t) && t[end] >= utf8.RuneSelf; {
+		_, size := utf8.DecodeRuneInString(t[end:])
+		end += size
+		if n++; n >= 2 {
+			ends = append(ends, end)
+		}
+	}
+	return ends
+}
+
+// findAddress return the first address in s, "" when there is none
+func findAddress(s string) string {
+	for i := 0; i < len(s); {
+		if !isAtomByte(s[i]) {
+			i++
+			continue
+		}
+		at := atomEnd(s, i)
+		if at < len(s) && s[at] == '@' {
+			if end := literalEnd(s, at+1); end >= 0 {
+				return s[i:end]
+			}
+			if end := domainEnd(s[at+1 : atomEnd(s, at+1)]); end > 0 {
+				return s[i : at+1+end]
+			}
+		}
+		i = at + 1
+	}
+	return ""
+}
+
+// domainEnd return the end of the longest domain at the start of the
+// atom bytes d, -1 when there is none
+func domainEnd(d string) int {
+	for k := len(d) - 1; k >= 1; k-- {
+		if d[k] != '.' {
+			continue
+		}
+		t := d[k+1:]
+		letters := 0
+		for letters < len(t) && isLetter(t[letters]) {
+			letters++
+		}
+		if letters >= 2 {
+			return k + 1 + letters
+		}
+		// an A-label start with letters, so only non-ASCII
+		// characters are left
+		if end, n := nonASCIIEnd(t); n >= 2 {
+			return k + 1 + end
+		}
+	}
+	return -1
+}
@@ -0,0 +1,185 @@
+package session
+
+import (
+	"math/rand"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// the regular expressions replaced by the parsers of path.go, kept
+// as reference
+const (
+	reAtom   = `[a-zA-Z0-9._\-\x{80}-\x{10FFFF}]+`
+	reDomain = `(?:` + reAtom + `\.)+(?:[a-zA-Z]{2,}|xn--[a-zA-Z0-9-]+|[\x{80}-\x{10FFFF}]{2,})`
+	reAddr   = reAtom + `@` + reDomain
+)
+
+var (
+	rArgSyntax = regexp.MustCompile(`<(.+)>`)
+	rMailAddr  = regexp.MustCompile(reAddr)
+	rRcptArg   = regexp.MustCompile(`<(?:@` + reDomain + `,?)*:?` + reAddr + `>`)
+	rMailArg   = regexp.MustCompile(`<` + reAddr + `>`)
+)
+
+// pathCases are arguments of MAIL and RCPT
+var pathCases = []string{
+	"<some@domain.com>",
+	"<some@domain.com> SIZE=1000 BODY=8BITMIME",
+	"<some.anot-her@sub.domain.com> with-extension",
+	"<@host.io,@abchost.com:some@domain.com> NOTIFY=NEVER",
+	"<@hostA.io,@hostB.io:some@email.com,some@anohet.com>",
+	"<@a.comx@b.com>",
+	"<@a.co:b@c.xn--p1ai>",
+	"<a+b@example.com>",
+	"<a@b.xn--abc>",
+	"<用户@例子.广告>",
+	"<a@b.é>",
+	"<a@b.\xff\xfe>",
+	"<>",
+	"<invalid formatted email>",
+	"some@valid.email.com",
+	"x <a@b.com",
+	"<a@.com>",
+	"<a@b..com>",
+	"<a@b.c>",
+	"<a@b.com.x>",
+	"a@b.com.x",
+	"x@y z@a.com",
+	"x@y.xn--abc",
+}
+
+// TestPathParsers make sure that the parsers accept what the regular
+// expressions they replaced matched
+func TestPathParsers(t *testing.T) {
+	check := func(arg string) {
+		if got, expected := validMailPath(arg), rMailArg.MatchString(arg); got != expected {
+			t.Errorf("validMailPath(%q) == %v, expected %v", arg, got, expected)
+		}
+		if got, expected := validRcptPath(arg), rRcptArg.MatchString(arg); got != expected {
+			t.Errorf("validRcptPath(%q) == %v, expected %v", arg, got, expected)
+		}
+		if got, expected := hasPath(arg), rArgSyntax.MatchString(arg); got != expected {
+			t.Errorf("hasPath(%q) == %v, expected %v", arg, got, expected)
+		}
+		if got, expected := findAddress(arg), rMailAddr.FindString(arg); got != expected {
+			t.Errorf("findAddress(%q) == %q, expected %q", arg, got, expected)
+		}
+	}
+	for _, arg := range pathCases {
+		check(arg)
+	}
+
+	// random arguments made of the bytes that matter
+	alphabet := []string{"<", ">", "@", ".", ",", ":", " ", "a", "b", "Z", "1", "-", "_", "+", "xn--", "com", "é", "例", "\xff"}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		b := make([]byte, 0, 32)
+		for n := rnd.Intn(16); n > 0; n-- {
+			b = append(b, alphabet[rnd.Intn(len(alphabet))]...)
+		}
+		check(string(b))
+	}
+}
+
+// TestAddressLiteral make sure that IPv4 and IPv6 address literals
+// are accepted as domain of paths
+func TestAddressLiteral(t *testing.T) {
+	cases := []struct {
+		arg   string
+		valid bool
+		addr  string
+	}{
+		{"<postmaster@[192.0.2.1]>", true, "postmaster@[192.0.2.1]"},
+		{"<a@[IPv6:2001:db8::1]> SIZE=10", true, "a@[IPv6:2001:db8::1]"},
+		{"<a@[ipv6:::1]>", true, "a@[ipv6:::1]"},
+		{"<a@[IPv6:192.0.2.1]>", false, ""},
+		{"<a@[2001:db8::1]>", false, ""},
+		{"<a@[IPv6:fe80::1%eth0]>", false, ""},
+		{"<a@[192.0.2.256]>", false, ""},
+		{"<a@[192.0.2.1]x>", false, ""},
+		{"<a@[192.0.2.1>", false, ""},
+	}
+
+	for _, input := range cases {
+		if got := validMailPath(input.arg); got != input.valid {
+			t.Errorf("validMailPath(%q) == %v, expected %v", input.arg, got, input.valid)
+		}
+		if got := validRcptPath(input.arg); got != input.valid {
+			t.Errorf("validRcptPath(%q) == %v, expected %v", input.arg, got, input.valid)
+		}
+		if input.valid {
+			if got := findAddress(input.arg); got != input.addr {
+				t.Errorf("findAddress(%q) == %q, expected %q", input.arg, got, input.addr)
+			}
+		}
+	}
+}
+
+func BenchmarkValidMailPath(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		validMailPath("<some.another@sub.domain.com> SIZE=1000")
+	}
+}
+
+func BenchmarkValidMailPathRegexp(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		rMailArg.MatchString("<some.another@sub.domain.com> SIZE=1000")
+	}
+}
+
+func BenchmarkValidRcptPath(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		validRcptPath("<some.another@sub.domain.com> NOTIFY=NEVER")
+	}
+}
+
+func BenchmarkValidRcptPathRegexp(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		rRcptArg.MatchString("<some.another@sub.domain.com> NOTIFY=NEVER")
+	}
+}
+
+func BenchmarkFindAddress(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		findAddress("<some.another@sub.domain.com> NOTIFY=NEVER")
+	}
+}
+
+func BenchmarkFindAddressRegexp(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		rMailAddr.FindString("<some.another@sub.domain.com> NOTIFY=NEVER")
+	}
+}
+
+// FuzzAddressParse make sure that the path parsers never panic and
+// agree with each other
+func FuzzAddressParse(f *testing.F) {
+	for _, arg := range pathCases {
+		f.Add(arg)
+	}
+	f.Add("<a@[IPv6:2001:db8::1]> SIZE=10")
+	f.Add("<@a.co,@[192.0.2.1]:b@c.com>")
+	f.Fuzz(func(t *testing.T, arg string) {
+		mail, rcpt, path := validMailPath(arg), validRcptPath(arg), hasPath(arg)
+		if mail && !rcpt {
+			t.Errorf("%q: valid MAIL path but not RCPT path", arg)
+		}
+		if rcpt && !path {
+			t.Errorf("%q: valid RCPT path without angle brackets", arg)
+		}
+		addr := findAddress(arg)
+		if !strings.Contains(arg, addr) {
+			t.Errorf("%q: address %q not in argument", arg, addr)
+		}
+		if mail && addr == "" {
+			t.Errorf("%q: valid MAIL path without address", arg)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package session
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// kinds of plugin
+const (
+	PluginFilter = "filter"
+	PluginAuth   = "auth"
+	PluginSink   = "sink"
+	PluginPolicy = "policy"
+)
+
+// Options is the configuration of plugin instance
+type Options map[string]string
+
+// Factory create a plugin instance from options. the instance MUST
+// implement the interface of its kind: Filter, Authenticator,
+// Backend or Policy
+type Factory func(opts Options) (interface{}, error)
+
+var (
+	pluginsMu sync.RWMutex
+	plugins   = make(map[string]map[string]Factory)
+)
+
+// Register make a plugin available by kind and name. it is intended
+// to be called from init function of the plugin package, and panic
+// when the same name is registered twice or kind is unknown
+func Register(kind, name string, factory Factory) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	switch kind {
+	case PluginFilter, PluginAuth, PluginSink, PluginPolicy:
+	default:
+		panic("session: Register of unknown plugin kind " + kind)
+	}
+	if factory == nil {
+		panic("session: Register factory is nil")
+	}
+	if plugins[kind] == nil {
+		plugins[kind] = make(map[string]Factory)
+	}
+	if _, dup := plugins[kind][name]; dup {
+		panic("session: Register called twice for " + kind + " " + name)
+	}
+	plugins[kind][name] = factory
+}
+
+// Plugins return sorted names of registered plugins of kind
+func Plugins(kind string) []string {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	var names []string
+	for name := range plugins[kind] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewPlugin create an instance of registered plugin
+func NewPlugin(kind, name string, opts Options) (interface{}, error) {
+	pluginsMu.RLock()
+	factory, ok := plugins[kind][name]
+	pluginsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("session: unknown %s plugin %q", kind, name)
+	}
+	return factory(opts)
+}
+
+// PluginSpec is a plugin instance in the configuration
+type PluginSpec struct {
+	Kind    string
+	Name    string
+	Options Options
+	// Simulate run filter and policy plugins in simulate mode,
+	// see Simulation
+	Simulate bool
+}
+
+// LoadPlugins instantiate every plugin and attach it to the config.
+// filters and policies are appended in order, auth and sink plugin
+// replace Authenticator and Backend
+func (c *Config) LoadPlugins(specs []PluginSpec) error {
+	for _, spec := range specs {
+		p, err := NewPlugin(spec.Kind, spec.Name, spec.Options)
+		if err != nil {
+			return err
+		}
+
+		ok := false
+		switch spec.Kind {
+		case PluginFilter:
+			var f Filter
+			if f, ok = p.(Filter); ok {
+				if spec.Simulate {
+					f = SimulateFilter(spec.Name, f)
+				}
+				c.Filters = append(c.Filters, f)
+			}
+		case PluginAuth:
+			c.Authenticator, ok = p.(Authenticator)
+		case PluginSink:
+			c.Backend, ok = p.(Backend)
+		case PluginPolicy:
+			var pol Policy
+			if pol, ok = p.(Policy); ok {
+				if spec.Simulate {
+					pol = Simulate(spec.Name, pol)
+				}
+				c.Policies = append(c.Policies, pol)
+			}
+		}
+		if !ok {
+			return fmt.Errorf("session: %s plugin %q has type %T", spec.Kind, spec.Name, p)
+		}
+	}
+	return nil
+}
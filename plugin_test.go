@@ -0,0 +1,90 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func init() {
+	Register(PluginFilter, "test-tag", func(opts Options) (interface{}, error) {
+		header := opts["header"]
+		if header == "" {
+			return nil, errors.New("header option is required")
+		}
+		return FilterFunc(func(envl *Envelope, data []byte) ([]byte, error) {
+			return prependHeader(data, header, "yes"), nil
+		}), nil
+	})
+	Register(PluginPolicy, "test-deny", func(opts Options) (interface{}, error) {
+		return PolicyFunc(func(ctx context.Context, req *PolicyRequest) error {
+			if req.Stage == StageRcpt && strings.HasPrefix(req.Recipient, opts["prefix"]) {
+				return NewSMTPError(550, [3]int{5, 7, 1}, "Denied by policy")
+			}
+			return nil
+		}), nil
+	})
+	Register(PluginSink, "test-not-backend", func(opts Options) (interface{}, error) {
+		return "not a backend", nil
+	})
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic on duplicate registration")
+		}
+	}()
+	Register(PluginFilter, "test-tag", func(opts Options) (interface{}, error) { return nil, nil })
+}
+
+func TestConfigLoadPlugins(t *testing.T) {
+	cases := []struct {
+		specs []PluginSpec
+		err   bool
+	}{
+		{[]PluginSpec{{Kind: PluginFilter, Name: "test-tag", Options: Options{"header": "X-Tag"}}}, false},
+		{[]PluginSpec{{Kind: PluginFilter, Name: "test-tag"}}, true},
+		{[]PluginSpec{{Kind: PluginFilter, Name: "missing"}}, true},
+		{[]PluginSpec{{Kind: PluginSink, Name: "test-not-backend"}}, true},
+	}
+
+	for _, input := range cases {
+		err := (&Config{}).LoadPlugins(input.specs)
+		if (err != nil) != input.err {
+			t.Errorf("LoadPlugins(%v) error %v, expected error %v", input.specs, err, input.err)
+		}
+	}
+
+	if names := Plugins(PluginPolicy); !strings.Contains(strings.Join(names, ","), "test-deny") {
+		t.Errorf("got policy plugins %v, expected test-deny", names)
+	}
+}
+
+// TestSessionPlugins make sure that loaded filters and policies are
+// applied by session
+func TestSessionPlugins(t *testing.T) {
+	var delivered []byte
+	config := &Config{
+		Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			delivered = data
+			return nil
+		}),
+	}
+	err := config.LoadPlugins([]PluginSpec{
+		{Kind: PluginFilter, Name: "test-tag", Options: Options{"header": "X-Tag"}},
+		{Kind: PluginPolicy, Name: "test-deny", Options: Options{"prefix": "blocked"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := runSession(t, config, "EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<blocked@domain.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\nSubject: test\r\n\r\n.\r\nQUIT\r\n")
+	if !strings.Contains(out, "550 5.7.1 Denied by policy") {
+		t.Errorf("got: %q, expected recipient denied by policy", out)
+	}
+	if !strings.HasPrefix(string(delivered), "X-Tag: yes\r\n") {
+		t.Errorf("got delivered %q, expected X-Tag header", delivered)
+	}
+}
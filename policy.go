@@ -0,0 +1,118 @@
+package session
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+)
+
+// Stage is the point of SMTP transaction where policy is checked
+type Stage string
+
+// stages of SMTP transaction
+const (
+	StageConnect Stage = "connect"
+	StageMail    Stage = "mail"
+	StageRcpt    Stage = "rcpt"
+	StageData    Stage = "data"
+)
+
+// PolicyRequest represents the state of session checked by Policy
+type PolicyRequest struct {
+	Stage    Stage
+	Session  *Session
+	Envelope *Envelope
+	// Recipient is the address of RCPT command at StageRcpt
+	Recipient string
+	// IPReputation and DomainReputation are reputation scores of
+	// the source IP and sender domain when Config.Reputation is set
+	IPReputation     float64
+	DomainReputation float64
+	// TLS is the state of TLS connection, nil without TLS or
+	// when TLS is terminated by a proxy
+	TLS *tls.ConnectionState
+}
+
+// Policy accept or reject the session at each stage, returning an
+// error reject the command. the error SHOULD be *SMTPError
+type Policy interface {
+	Check(ctx context.Context, req *PolicyRequest) error
+}
+
+// PolicyFunc is an adapter to allow the use of ordinary
+// functions as Policy
+type PolicyFunc func(ctx context.Context, req *PolicyRequest) error
+
+// Check call f(ctx, req)
+func (f PolicyFunc) Check(ctx context.Context, req *PolicyRequest) error {
+	return f(ctx, req)
+}
+
+// checkPolicy check every configured policy, the first error win.
+// the remaining budget of ctx is shared between policies, when it
+// is exhausted the rest are skipped and the command is tempfailed
+func (s *Session) checkPolicy(ctx context.Context, stage Stage, envl *Envelope, rcpt string) error {
+	if len(s.Config.Policies) == 0 {
+		return nil
+	}
+	req := &PolicyRequest{Stage: stage, Session: s, Envelope: envl, Recipient: rcpt, TLS: s.TLSState()}
+	if r := s.Config.Reputation; r != nil {
+		ip, domain := s.reputationSource(envl)
+		req.IPReputation, req.DomainReputation = r.IPScore(ctx, ip), NeutralReputation
+		if domain != "" {
+			req.DomainReputation = r.DomainScore(ctx, domain)
+		}
+	}
+	for i, p := range s.Config.Policies {
+		if ctx.Err() != nil {
+			return budgetErr
+		}
+		pctx, cancel := share(ctx, len(s.Config.Policies)-i)
+		err := p.Check(pctx, req)
+		cancel()
+		if err != nil {
+			return replyErr(err)
+		}
+	}
+	return nil
+}
+
+// Verdict is the decision of external filter or policy
+type Verdict struct {
+	// Action is "accept", "reject" or "tempfail"
+	Action   string `json:"action"`
+	Code     int    `json:"code,omitempty"`
+	Enhanced string `json:"enhanced,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// Err convert rejecting verdict into SMTPError, accepting
+// verdict return nil
+func (v *Verdict) Err() error {
+	var code int
+	var enhanced [3]int
+	msg := v.Message
+	switch v.Action {
+	case "", "accept":
+		return nil
+	case "reject":
+		code, enhanced, msg = 550, [3]int{5, 7, 1}, "Rejected by filter"
+		if v.Code >= 500 && v.Code < 600 {
+			code = v.Code
+		}
+	case "tempfail":
+		code, enhanced, msg = 451, [3]int{4, 7, 1}, "Temporarily rejected by filter"
+		if v.Code >= 400 && v.Code < 500 {
+			code = v.Code
+		}
+	default:
+		return fmt.Errorf("unknown action %q", v.Action)
+	}
+	if e, ok := parseEnhanced(v.Enhanced); ok && e[0] == code/100 {
+		enhanced = e
+	}
+	if v.Message != "" {
+		msg = v.Message
+	}
+	return NewSMTPError(code, enhanced, msg)
+}
@@ -0,0 +1,34 @@
+package session
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestVerdictErr(t *testing.T) {
+	cases := []struct {
+		verdict  string
+		expected string
+	}{
+		{`{"action":"accept"}`, ""},
+		{`{"action":"reject"}`, "550 5.7.1 Rejected by filter"},
+		{`{"action":"reject","code":554,"enhanced":"5.7.0","message":"Spam"}`, "554 5.7.0 Spam"},
+		{`{"action":"reject","code":250}`, "550 5.7.1 Rejected by filter"},
+		{`{"action":"tempfail","enhanced":"5.7.0"}`, "451 4.7.1 Temporarily rejected by filter"},
+		{`{"action":"quarantine"}`, `unknown action "quarantine"`},
+	}
+
+	for _, input := range cases {
+		v := &Verdict{}
+		if err := json.Unmarshal([]byte(input.verdict), v); err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if err := v.Err(); err != nil {
+			got = err.Error()
+		}
+		if got != input.expected {
+			t.Errorf("got: %q, expected: %q", got, input.expected)
+		}
+	}
+}
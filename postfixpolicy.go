@@ -0,0 +1,219 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default settings of PostfixPolicy
+const (
+	defaultPostfixPolicyTimeout = 5 * time.Second
+	maxPostfixPolicyIdle        = 4
+)
+
+// PostfixPolicy is a Policy that delegate the decision at RCPT and
+// end of DATA to a policy daemon speaking the Postfix policy
+// delegation protocol, like postgrey or policyd-spf. the response
+// actions OK, DUNNO, REJECT, DEFER, DEFER_IF_PERMIT and numeric
+// replies are supported, other actions are treated like DUNNO
+type PostfixPolicy struct {
+	// Network and Address of the daemon, e.g. "tcp" and
+	// "127.0.0.1:10023" or "unix" and "/run/policyd.sock"
+	Network string
+	Address string
+
+	// Timeout of each request, default to 5 seconds
+	Timeout time.Duration
+	// FailOpen accept when the daemon is unavailable
+	FailOpen bool
+
+	mu   sync.Mutex
+	idle []net.Conn
+}
+
+// get return an idle connection or dial a new one
+func (p *PostfixPolicy) get(ctx context.Context) (net.Conn, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+	var d net.Dialer
+	return d.DialContext(ctx, p.Network, p.Address)
+}
+
+// put keep the connection for the next request
+func (p *PostfixPolicy) put(c net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) >= maxPostfixPolicyIdle {
+		c.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+// postfixAttrs return the request attributes of the policy request
+func postfixAttrs(req *PolicyRequest) [][2]string {
+	s, envl := req.Session, req.Envelope
+	state, protocol := "RCPT", "SMTP"
+	if req.Stage == StageData {
+		state = "END-OF-MESSAGE"
+	}
+	if s.ehlo {
+		protocol = "ESMTP"
+	}
+	name := s.remoteName()
+	if name == "" {
+		name = "unknown"
+	}
+	attrs := [][2]string{
+		{"request", "smtpd_access_policy"},
+		{"protocol_state", state},
+		{"protocol_name", protocol},
+		{"helo_name", s.HeloName},
+		{"queue_id", envl.ID},
+		{"sender", envl.OriginatorAddress},
+		{"recipient", req.Recipient},
+		{"recipient_count", strconv.Itoa(len(envl.RecipientAddress))},
+		{"client_address", s.RemoteIP().String()},
+		{"client_name", name},
+		{"reverse_client_name", name},
+		{"instance", envl.ID},
+	}
+	if s.Principal != nil {
+		attrs = append(attrs, [2]string{"sasl_username", s.Principal.Username})
+	}
+	if cs := req.TLS; cs != nil {
+		attrs = append(attrs,
+			[2]string{"encryption_protocol", tlsVersionName(cs.Version)},
+			[2]string{"encryption_cipher", tls.CipherSuiteName(cs.CipherSuite)})
+	}
+	return attrs
+}
+
+// query send the attributes and return the action of the response
+func (p *PostfixPolicy) query(ctx context.Context, attrs [][2]string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, durationOr(p.Timeout, defaultPostfixPolicyTimeout))
+	defer cancel()
+	c, err := p.get(ctx)
+	if err != nil {
+		return "", err
+	}
+	deadline, _ := ctx.Deadline()
+	c.SetDeadline(deadline)
+
+	w := bufio.NewWriter(c)
+	for _, a := range attrs {
+		// values must not break the line based protocol
+		v := strings.NewReplacer("\r", "", "\n", "").Replace(a[1])
+		fmt.Fprintf(w, "%s=%s\n", a[0], v)
+	}
+	w.WriteString("\n")
+	if err := w.Flush(); err != nil {
+		c.Close()
+		return "", err
+	}
+
+	action := ""
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			c.Close()
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "action=") {
+			action = strings.TrimPrefix(line, "action=")
+		}
+	}
+	if r.Buffered() > 0 {
+		// unexpected data, the connection is out of sync
+		c.Close()
+	} else {
+		c.SetDeadline(time.Time{})
+		p.put(c)
+	}
+	if action == "" {
+		return "", fmt.Errorf("postfix policy: response without action")
+	}
+	return action, nil
+}
+
+// postfixVerdict convert the response action into reply error,
+// unknown action return an error that is not *SMTPError
+func postfixVerdict(action string) error {
+	verb, text := action, ""
+	if i := strings.IndexAny(action, " \t"); i >= 0 {
+		verb, text = action[:i], strings.TrimSpace(action[i+1:])
+	}
+
+	if code, err := strconv.Atoi(verb); err == nil && len(verb) == 3 {
+		if code < 400 || code >= 600 {
+			if code >= 200 && code < 300 {
+				return nil
+			}
+			return fmt.Errorf("postfix policy: invalid reply code %d", code)
+		}
+		v := &Verdict{Action: "reject", Code: code, Message: text}
+		if code < 500 {
+			v.Action = "tempfail"
+		}
+		if f := strings.Fields(text); len(f) > 0 {
+			if e, ok := parseEnhanced(f[0]); ok && e[0] == code/100 {
+				v.Enhanced, v.Message = f[0], strings.TrimSpace(strings.TrimPrefix(text, f[0]))
+			}
+		}
+		return v.Err()
+	}
+
+	switch strings.ToUpper(verb) {
+	case "OK", "DUNNO":
+		return nil
+	case "REJECT":
+		if text == "" {
+			text = "Access denied"
+		}
+		return NewSMTPError(550, [3]int{5, 7, 1}, text)
+	case "DEFER", "DEFER_IF_PERMIT":
+		if text == "" {
+			text = "Service temporarily unavailable"
+		}
+		return NewSMTPError(450, [3]int{4, 7, 1}, text)
+	case "DEFER_IF_REJECT", "PREPEND", "HOLD", "DISCARD", "FILTER", "REDIRECT", "BCC", "WARN", "INFO":
+		return nil
+	}
+	return fmt.Errorf("postfix policy: unknown action %q", action)
+}
+
+// Check query the daemon at StageRcpt and StageData
+func (p *PostfixPolicy) Check(ctx context.Context, req *PolicyRequest) error {
+	if req.Stage != StageRcpt && req.Stage != StageData {
+		return nil
+	}
+	action, err := p.query(ctx, postfixAttrs(req))
+	if err == nil {
+		if err = postfixVerdict(action); err == nil || isSMTPError(err) {
+			return err
+		}
+	}
+	req.Session.logf(LevelWarn, "%v", err)
+	if p.FailOpen {
+		return nil
+	}
+	return localErr
+}
@@ -0,0 +1,142 @@
+package session
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestPostfixVerdict make sure that response actions are converted
+// into replies
+func TestPostfixVerdict(t *testing.T) {
+	cases := []struct {
+		action   string
+		expected string
+	}{
+		{"OK", ""},
+		{"dunno", ""},
+		{"PREPEND X-Policy: yes", ""},
+		{"REJECT", "550 5.7.1 Access denied"},
+		{"REJECT Greylisted too long", "550 5.7.1 Greylisted too long"},
+		{"DEFER_IF_PERMIT Greylisted, try again", "450 4.7.1 Greylisted, try again"},
+		{"554 5.7.0 Spam source", "554 5.7.0 Spam source"},
+		{"451 Try later", "451 4.7.1 Try later"},
+		{"250 fine", ""},
+		{"SOMETIMES", "unknown"},
+		{"199 odd", "invalid"},
+	}
+
+	for _, input := range cases {
+		got := ""
+		if err := postfixVerdict(input.action); err != nil {
+			got = err.Error()
+		}
+		if !strings.Contains(got, input.expected) || (input.expected == "") != (got == "") {
+			t.Errorf("%q: got %q, expected %q", input.action, got, input.expected)
+		}
+	}
+}
+
+// servePostfixPolicy run a policy daemon that reject recipients
+// starting with "spam" and record every request
+func servePostfixPolicy(t *testing.T) (string, *[]map[string]string, *sync.Mutex) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var mu sync.Mutex
+	var requests []map[string]string
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				attrs := map[string]string{}
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimRight(line, "\n")
+					if line != "" {
+						kv := strings.SplitN(line, "=", 2)
+						attrs[kv[0]] = kv[1]
+						continue
+					}
+					mu.Lock()
+					requests = append(requests, attrs)
+					mu.Unlock()
+					action := "DUNNO"
+					if strings.HasPrefix(attrs["recipient"], "spam") {
+						action = "REJECT No spam please"
+					}
+					c.Write([]byte("action=" + action + "\n\n"))
+					attrs = map[string]string{}
+				}
+			}(c)
+		}
+	}()
+	return l.Addr().String(), &requests, &mu
+}
+
+// TestSessionPostfixPolicy make sure that the daemon is consulted at
+// RCPT and end of DATA over a reused connection
+func TestSessionPostfixPolicy(t *testing.T) {
+	addr, requests, mu := servePostfixPolicy(t)
+	p := &PostfixPolicy{Network: "tcp", Address: addr}
+	config := &Config{Policies: []Policy{p}}
+
+	out := runSession(t, config, "EHLO client.example.org\r\nMAIL FROM:<a@example.org>\r\n"+
+		"RCPT TO:<spam@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nSubject: hi\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+	if !strings.Contains(out, "550 5.7.1 No spam please") || !strings.Contains(out, "250 2.0.0") {
+		t.Errorf("got %q, expected spam recipient rejected and message accepted", out)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	states := []string{}
+	for _, req := range *requests {
+		states = append(states, req["protocol_state"])
+		if req["request"] != "smtpd_access_policy" || req["sender"] != "a@example.org" ||
+			req["helo_name"] != "client.example.org" || req["protocol_name"] != "ESMTP" || req["queue_id"] == "" {
+			t.Errorf("got request %v", req)
+		}
+	}
+	if got := strings.Join(states, ","); got != "RCPT,RCPT,END-OF-MESSAGE" {
+		t.Errorf("got protocol states %s, expected RCPT,RCPT,END-OF-MESSAGE", got)
+	}
+	if len(p.idle) != 1 {
+		t.Errorf("got %d idle connections, expected 1", len(p.idle))
+	}
+}
+
+// TestPostfixPolicyUnavailable make sure that unavailable daemon
+// tempfail unless FailOpen
+func TestPostfixPolicyUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	for _, failOpen := range []bool{false, true} {
+		config := &Config{Policies: []Policy{&PostfixPolicy{Network: "tcp", Address: addr, FailOpen: failOpen}}}
+		out := runSession(t, config, "HELO client\r\nMAIL FROM:<a@example.org>\r\nRCPT TO:<b@example.com>\r\nQUIT\r\n")
+		expected := "451 4.3.0"
+		if failOpen {
+			expected = "250 2.1.5"
+		}
+		if !strings.Contains(out, expected) {
+			t.Errorf("failOpen=%t: got %q, expected %q", failOpen, out, expected)
+		}
+	}
+}
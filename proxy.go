@@ -0,0 +1,199 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol constants (haproxy proxy-protocol.txt)
+const (
+	proxyV1Prefix  = "PROXY "
+	proxyV1MaxLine = 107
+	proxyV2Sig     = "\r\n\r\n\x00\r\nQUIT\n"
+
+	proxyV2CmdLocal = 0x0
+	proxyV2CmdProxy = 0x1
+	proxyV2TCP4     = 0x11
+	proxyV2TCP6     = 0x21
+
+	pp2TypeSSL       = 0x20
+	pp2SubtypeSSLVer = 0x21
+	pp2SubtypeCipher = 0x23
+	pp2ClientSSL     = 0x01
+
+	proxyHeaderTimeout = 10 * time.Second
+)
+
+// errProxyHeader is returned for a missing or malformed PROXY header
+var errProxyHeader = errors.New("session: invalid PROXY protocol header")
+
+// proxyHeader is the connection information sent by the proxy. Source
+// is nil for health checks of the proxy (LOCAL and UNKNOWN)
+type proxyHeader struct {
+	Source net.Addr
+	// TLS is set when the client connected to the proxy over TLS
+	TLS        bool
+	TLSVersion string
+	TLSCipher  string
+}
+
+// readProxyHeader read PROXY protocol header version 1 or 2
+func readProxyHeader(r *bufio.Reader) (*proxyHeader, error) {
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err == nil && string(sig) == proxyV2Sig {
+		return readProxyV2(r)
+	}
+	if prefix, err := r.Peek(len(proxyV1Prefix)); err != nil || string(prefix) != proxyV1Prefix {
+		return nil, errProxyHeader
+	}
+	return readProxyV1(r)
+}
+
+// readProxyV1 parse "PROXY TCP4 src dst sport dport\r\n"
+func readProxyV1(r *bufio.Reader) (*proxyHeader, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLine {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &proxyHeader{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errProxyHeader
+	}
+	return &proxyHeader{Source: &net.TCPAddr{IP: ip, Port: int(port)}}, nil
+}
+
+// readProxyV2 parse the binary header and its TLVs
+func readProxyV2(r *bufio.Reader) (*proxyHeader, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	hdr := &proxyHeader{}
+	switch head[12] & 0xf {
+	case proxyV2CmdLocal:
+		return hdr, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, errProxyHeader
+	}
+
+	var tlvs []byte
+	switch head[13] {
+	case proxyV2TCP4:
+		if len(body) < 12 {
+			return nil, errProxyHeader
+		}
+		hdr.Source = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}
+		tlvs = body[12:]
+	case proxyV2TCP6:
+		if len(body) < 36 {
+			return nil, errProxyHeader
+		}
+		hdr.Source = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}
+		tlvs = body[36:]
+	default:
+		// unsupported address family, keep the connection address
+		return hdr, nil
+	}
+
+	err := eachTLV(tlvs, func(typ byte, value []byte) {
+		// PP2_TYPE_SSL: client flags, verify result, sub-TLVs
+		if typ != pp2TypeSSL || len(value) < 5 || value[0]&pp2ClientSSL == 0 {
+			return
+		}
+		hdr.TLS = true
+		eachTLV(value[5:], func(typ byte, value []byte) {
+			switch typ {
+			case pp2SubtypeSSLVer:
+				hdr.TLSVersion = string(value)
+			case pp2SubtypeCipher:
+				hdr.TLSCipher = string(value)
+			}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hdr, nil
+}
+
+// eachTLV call fn with every type-length-value of data
+func eachTLV(data []byte, fn func(typ byte, value []byte)) error {
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return errProxyHeader
+		}
+		n := int(binary.BigEndian.Uint16(data[1:]))
+		if len(data) < 3+n {
+			return errProxyHeader
+		}
+		fn(data[0], data[3:3+n])
+		data = data[3+n:]
+	}
+	return nil
+}
+
+// proxyConn is a connection with the client address of PROXY header
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxy read the PROXY header sent by the proxy in front of the
+// server, the session then see the address of the client and is
+// treated as TLS when the client connected to the proxy over TLS
+func (s *Session) readProxy() error {
+	s.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	hdr, err := readProxyHeader(s.Reader)
+	s.Conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	if hdr.Source != nil {
+		s.mu.Lock()
+		s.Conn = &proxyConn{Conn: s.Conn, remote: hdr.Source}
+		s.mu.Unlock()
+	}
+	if hdr.TLS {
+		s.setTLS(hdr.TLSVersion, hdr.TLSCipher)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package session
+
+import (
+	"bufio"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// proxyV2 build PROXY protocol version 2 header from 192.0.2.7:4000
+// with tlvs
+func proxyV2(cmd byte, tlvs ...[]byte) string {
+	body := []byte{192, 0, 2, 7, 198, 51, 100, 1, 0x0f, 0xa0, 0, 25}
+	for _, tlv := range tlvs {
+		body = append(body, tlv...)
+	}
+	head := append([]byte(proxyV2Sig), 0x20|cmd, proxyV2TCP4, 0, 0)
+	binary.BigEndian.PutUint16(head[14:], uint16(len(body)))
+	return string(append(head, body...))
+}
+
+// tlv encode type-length-value
+func tlv(typ byte, value []byte) []byte {
+	return append([]byte{typ, byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+// sslTLV is PP2_TYPE_SSL of a TLS client with version sub-TLV
+var sslTLV = tlv(pp2TypeSSL, append(append([]byte{pp2ClientSSL, 0, 0, 0, 0},
+	tlv(pp2SubtypeSSLVer, []byte("TLSv1.3"))...), tlv(pp2SubtypeCipher, []byte("ECDHE-RSA-AES128-GCM-SHA256"))...))
+
+// TestReadProxyHeader make sure that both versions of PROXY protocol
+// are parsed and malformed headers are rejected
+func TestReadProxyHeader(t *testing.T) {
+	cases := []struct {
+		input   string
+		source  string
+		tls     string
+		invalid bool
+	}{
+		{"PROXY TCP4 192.0.2.7 198.51.100.1 4000 25\r\nEHLO", "192.0.2.7:4000", "", false},
+		{"PROXY TCP6 2001:db8::7 2001:db8::1 4000 25\r\n", "[2001:db8::7]:4000", "", false},
+		{"PROXY UNKNOWN\r\n", "", "", false},
+		{"PROXY TCP4 2001:db8::7 198.51.100.1 4000 25\r\n", "", "", true},
+		{"PROXY TCP4 192.0.2.7 198.51.100.1 4000\r\n", "", "", true},
+		{"EHLO client.com\r\n", "", "", true},
+		{proxyV2(proxyV2CmdProxy), "192.0.2.7:4000", "", false},
+		{proxyV2(proxyV2CmdProxy, sslTLV), "192.0.2.7:4000", "TLSv1.3", false},
+		{proxyV2(proxyV2CmdProxy, tlv(pp2TypeSSL, []byte{0, 0, 0, 0, 0})), "192.0.2.7:4000", "", false},
+		{proxyV2(proxyV2CmdLocal), "", "", false},
+		{proxyV2(proxyV2CmdProxy, []byte{pp2TypeSSL, 0, 9}), "", "", true},
+	}
+
+	for _, input := range cases {
+		hdr, err := readProxyHeader(bufio.NewReader(strings.NewReader(input.input)))
+		if input.invalid {
+			if err == nil {
+				t.Errorf("%q: expected error", input.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: got error %v", input.input, err)
+			continue
+		}
+		source := ""
+		if hdr.Source != nil {
+			source = hdr.Source.String()
+		}
+		tls := ""
+		if hdr.TLS {
+			tls = hdr.TLSVersion
+		}
+		if source != input.source || tls != input.tls {
+			t.Errorf("%q: got %q %q, expected %q %q", input.input, source, tls, input.source, input.tls)
+		}
+	}
+}
+
+// TestSessionProxyProtocol make sure that the session behind a TLS
+// terminating proxy see the client address, don't offer STARTTLS,
+// permit AUTH and record ESMTPSA in Received header
+func TestSessionProxyProtocol(t *testing.T) {
+	cases := []struct {
+		header   string
+		config   Config
+		expected string
+		received string
+	}{
+		{proxyV2(proxyV2CmdProxy, sslTLV), Config{ProxyProtocol: true}, "235 2.7.0", "from client.com ([192.0.2.7])\r\n\tby localhost with ESMTPSA (version=TLSv1.3 cipher=ECDHE-RSA-AES128-GCM-SHA256)"},
+		{"PROXY TCP4 192.0.2.7 198.51.100.1 4000 25\r\n", Config{ProxyProtocol: true}, "538 5.7.11", "with ESMTP\r\n"},
+		{"", Config{TLSTerminated: true}, "235 2.7.0", "with ESMTPSA\r\n"},
+		{"", Config{}, "538 5.7.11", "from client.com ([unknown])"},
+	}
+
+	for _, input := range cases {
+		var data []byte
+		config := input.config
+		config.Authenticator = testAuthenticator
+		config.TLSConfig = testTLSConfig(t)
+		config.AddReceived = true
+		config.Backend = BackendFunc(func(envl *Envelope, d []byte) error {
+			data = d
+			return nil
+		})
+
+		out := runSession(t, &config, input.header+"EHLO client.com\r\n"+
+			"AUTH PLAIN "+plainResponse("user", "secret")+"\r\n"+
+			"MAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\nSubject: a\r\n\r\n.\r\nQUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("%q: got %q, expected %q", input.header, out, input.expected)
+		}
+		if secure := input.expected == "235 2.7.0"; strings.Contains(out, "STARTTLS") == secure {
+			t.Errorf("%q: got %q, STARTTLS offered in TLS session or missing", input.header, out)
+		}
+		if !strings.HasPrefix(string(data), "Received: ") || !strings.Contains(string(data), input.received) {
+			t.Errorf("%q: got %q, expected Received header with %q", input.header, data, input.received)
+		}
+	}
+}
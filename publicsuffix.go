@@ -0,0 +1,66 @@
+package session
+
+import (
+	_ "embed"
+	"strings"
+	"sync"
+)
+
+// publicSuffixList is a copy of https://publicsuffix.org/list/public_suffix_list.dat
+//
+//go:embed public_suffix_list.dat
+var publicSuffixList string
+
+// kinds of public suffix rule, a name may have several
+const (
+	suffixRule = 1 << iota
+	suffixWildcard
+	suffixException
+)
+
+var (
+	suffixOnce  sync.Once
+	suffixRules map[string]int
+)
+
+// parseSuffixRules parse the rules of the public suffix list, "*.ck"
+// is a wildcard of "ck" and "!www.ck" an exception
+func parseSuffixRules(list string) map[string]int {
+	rules := make(map[string]int)
+	for _, line := range strings.Split(list, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		rule := strings.ToLower(fields[0])
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			rules[rule[1:]] |= suffixException
+		case strings.HasPrefix(rule, "*."):
+			rules[rule[2:]] |= suffixWildcard
+		default:
+			rules[rule] |= suffixRule
+		}
+	}
+	return rules
+}
+
+// publicSuffixLabels return the number of labels of the public suffix
+// of labels, without matching rule it is the last label (RFC 7489
+// section 3.2)
+func publicSuffixLabels(labels []string) int {
+	suffixOnce.Do(func() {
+		suffixRules = parseSuffixRules(publicSuffixList)
+	})
+	for i := range labels {
+		name := strings.Join(labels[i:], ".")
+		rule := suffixRules[name]
+		if rule&suffixException != 0 {
+			return len(labels) - i - 1
+		}
+		if rule&suffixRule != 0 || i+1 < len(labels) && suffixRules[strings.Join(labels[i+1:], ".")]&suffixWildcard != 0 {
+			return len(labels) - i
+		}
+	}
+	return 1
+}
@@ -0,0 +1,370 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default settings of Queue
+const (
+	defaultQueueInterval = 30 * time.Second
+	defaultMinRetry      = time.Minute
+	defaultMaxRetry      = 4 * time.Hour
+	defaultMaxAge        = 5 * 24 * time.Hour
+)
+
+// errNoResult is used when Transport didn't report a recipient
+var errNoResult = errors.New("queue: no delivery result")
+
+// DeliveryResult represents the outcome of delivery to one recipient
+type DeliveryResult struct {
+	Recipient string
+	// Err is nil when the message delivered. *SMTPError with 5yz
+	// code is permanent failure, any other error is temporary
+	Err error
+}
+
+// Permanent report whether the delivery failed permanently
+func (r *DeliveryResult) Permanent() bool {
+	return isPermanent(r.Err)
+}
+
+// Transport deliver queued messages to their next hop
+type Transport interface {
+	// Send attempt to deliver message to every recipient of envl
+	// and return a result for each of them
+	Send(ctx context.Context, envl *Envelope, data []byte) []*DeliveryResult
+}
+
+// TransportFunc is an adapter to allow the use of ordinary
+// functions as Transport
+type TransportFunc func(ctx context.Context, envl *Envelope, data []byte) []*DeliveryResult
+
+// Send call f(ctx, envl, data)
+func (f TransportFunc) Send(ctx context.Context, envl *Envelope, data []byte) []*DeliveryResult {
+	return f(ctx, envl, data)
+}
+
+// Queue is a Backend that store accepted messages in the spool and
+// deliver them with Transport, retrying temporary failures with
+// exponential backoff. recipients that fail permanently or still fail
+// after MaxAge are reported to the sender with delivery status
+// notification, and so are delays and successes when requested
+// with DSN NOTIFY parameter
+type Queue struct {
+	Spool     *Spool
+	Transport Transport
+
+	// Hostname is used as the reporting MTA of notifications
+	Hostname string
+
+	// Interval between scans of the spool
+	Interval time.Duration
+	// MinRetry is the delay after first failure, doubled on every
+	// next failure up to MaxRetry
+	MinRetry time.Duration
+	MaxRetry time.Duration
+	// MaxAge is how long a message is retried before it bounce
+	MaxAge time.Duration
+	// Logger receive delivery errors, default to the standard
+	// logger
+	Logger *Logger
+
+	once sync.Once
+	wake chan struct{}
+	mu   sync.Mutex
+
+	// forced are messages attempted on the next run even when
+	// not due, see FlushDomain
+	fmu    sync.Mutex
+	forced map[string]bool
+}
+
+func (q *Queue) init() {
+	q.once.Do(func() {
+		q.wake = make(chan struct{}, 1)
+	})
+}
+
+func durationOr(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// Deliver write the message into the spool and wake up the runner
+func (q *Queue) Deliver(envl *Envelope, data []byte) error {
+	if err := q.Spool.Deliver(envl, data); err != nil {
+		return err
+	}
+	q.Flush()
+	return nil
+}
+
+// Flush wake up the runner to attempt every due message now
+func (q *Queue) Flush() {
+	q.init()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// FlushDomain attempt every message with recipients in domain on the
+// next run even when not due, subdomains include its subdomains.
+// return the number of messages
+func (q *Queue) FlushDomain(domain string, subdomains bool) (int, error) {
+	ids, err := q.Spool.List()
+	if err != nil {
+		return 0, err
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	var matched []string
+	for _, id := range ids {
+		rec, err := q.Spool.readRecord(id)
+		if err != nil || rec.held(time.Now()) {
+			continue
+		}
+		for _, rcpt := range rec.Envelope.RecipientAddress {
+			d := domainOf(rcpt)
+			if d == domain || (subdomains && strings.HasSuffix(d, "."+domain)) {
+				matched = append(matched, id)
+				break
+			}
+		}
+	}
+	if len(matched) == 0 {
+		return 0, nil
+	}
+
+	q.fmu.Lock()
+	if q.forced == nil {
+		q.forced = make(map[string]bool)
+	}
+	for _, id := range matched {
+		q.forced[id] = true
+	}
+	q.fmu.Unlock()
+	q.Flush()
+	return len(matched), nil
+}
+
+// DeliverDomains deliver now every queued recipient in domains with
+// the Transport returned by open, which is only called when there
+// are such messages. return the number of messages
+func (q *Queue) DeliverDomains(ctx context.Context, domains []string, open func() (Transport, error)) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ids, err := q.Spool.List()
+	if err != nil {
+		return 0, err
+	}
+	type match struct {
+		id    string
+		rec   *spoolRecord
+		rcpts []string
+	}
+	var matches []match
+	for _, id := range ids {
+		rec, err := q.Spool.readRecord(id)
+		if err != nil || rec.held(time.Now()) {
+			continue
+		}
+		var rcpts []string
+		for _, rcpt := range rec.Envelope.RecipientAddress {
+			if containsFold(domains, domainOf(rcpt)) {
+				rcpts = append(rcpts, rcpt)
+			}
+		}
+		if len(rcpts) > 0 {
+			matches = append(matches, match{id, rec, rcpts})
+		}
+	}
+	if len(matches) == 0 {
+		return 0, nil
+	}
+
+	t, err := open()
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range matches {
+		if err := q.send(ctx, m.id, m.rec, t, m.rcpts); err != nil {
+			logf(q.Logger, LevelWarn, "queue: %s: %v", m.id, err)
+		}
+	}
+	return len(matches), nil
+}
+
+// force report whether id was flushed and clear the flag
+func (q *Queue) force(id string) bool {
+	q.fmu.Lock()
+	defer q.fmu.Unlock()
+	forced := q.forced[id]
+	delete(q.forced, id)
+	return forced
+}
+
+// Run process the spool until ctx is done
+func (q *Queue) Run(ctx context.Context) {
+	q.init()
+	ticker := time.NewTicker(durationOr(q.Interval, defaultQueueInterval))
+	defer ticker.Stop()
+
+	for {
+		q.RunOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// RunOnce attempt delivery of every due message in the spool
+func (q *Queue) RunOnce(ctx context.Context) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ids, err := q.Spool.List()
+	if err != nil {
+		logf(q.Logger, LevelWarn, "queue: %v", err)
+		return
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := q.attempt(ctx, id); err != nil {
+			logf(q.Logger, LevelWarn, "queue: %s: %v", id, err)
+		}
+	}
+}
+
+// backoff return the delay before next attempt
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := durationOr(q.MinRetry, defaultMinRetry)
+	max := durationOr(q.MaxRetry, defaultMaxRetry)
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// attempt deliver a single spooled message when it is due
+func (q *Queue) attempt(ctx context.Context, id string) error {
+	rec, err := q.Spool.readRecord(id)
+	if err != nil {
+		return err
+	}
+	if rec.held(time.Now()) {
+		return nil
+	}
+	if time.Now().Before(rec.NextAttempt) && !q.force(id) {
+		return nil
+	}
+	return q.send(ctx, id, rec, q.Transport, rec.Envelope.RecipientAddress)
+}
+
+// send deliver the message to rcpts with t, the other recipients
+// stay in the queue untouched
+func (q *Queue) send(ctx context.Context, id string, rec *spoolRecord, t Transport, rcpts []string) error {
+	data, err := q.Spool.readData(id, rec)
+	if err != nil {
+		return err
+	}
+
+	envl := *rec.Envelope
+	envl.RecipientAddress = rcpts
+	results := make(map[string]*DeliveryResult)
+	for _, r := range t.Send(ctx, &envl, data) {
+		results[r.Recipient] = r
+	}
+
+	var pending []string
+	var failed, delivered, delayed []*DeliveryResult
+	now := time.Now()
+	retry := false
+	expired := now.Sub(rec.released()) >= durationOr(q.MaxAge, defaultMaxAge)
+	for _, rcpt := range rec.Envelope.RecipientAddress {
+		if !contains(rcpts, rcpt) {
+			pending = append(pending, rcpt)
+			continue
+		}
+		r, ok := results[rcpt]
+		if !ok {
+			r = &DeliveryResult{Recipient: rcpt, Err: errNoResult}
+		}
+		dsn := rec.Envelope.DSNRcpt[rcpt]
+		switch {
+		case r.Err == nil:
+			if dsn.notify(NotifySuccess) {
+				delivered = append(delivered, r)
+			}
+		case r.Permanent() || expired:
+			if dsn.notify(NotifyFailure) {
+				failed = append(failed, r)
+			}
+		default:
+			pending = append(pending, r.Recipient)
+			retry = true
+			rec.LastError = r.Err.Error()
+			if dsn.notify(NotifyDelay) && !contains(rec.Delayed, rcpt) {
+				delayed = append(delayed, r)
+				rec.Delayed = append(rec.Delayed, rcpt)
+			}
+		}
+	}
+
+	q.notify(rec, ActionFailed, failed, data)
+	q.notify(rec, ActionDelivered, delivered, data)
+	q.notify(rec, ActionDelayed, delayed, data)
+	if len(pending) == 0 {
+		return q.Spool.Remove(id)
+	}
+
+	if retry {
+		rec.Attempts++
+		rec.NextAttempt = now.Add(q.backoff(rec.Attempts))
+	}
+	rec.Envelope.RecipientAddress = pending
+	return q.Spool.writeRecord(id, rec)
+}
+
+// contains report whether list contains s
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// notify queue delivery status notification of the action to the
+// sender. message from null sender never bounce to avoid loops
+func (q *Queue) notify(rec *spoolRecord, action string, results []*DeliveryResult, data []byte) {
+	if len(results) == 0 || rec.Envelope.OriginatorAddress == "" {
+		return
+	}
+
+	hostname := q.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	dsn := BuildDSN(hostname, rec.Envelope, action, results, rec.Queued, data)
+
+	envl := &Envelope{RecipientAddress: []string{rec.Envelope.OriginatorAddress}}
+	if _, err := q.Spool.Write(envl, dsn); err != nil {
+		logf(q.Logger, LevelWarn, "queue: dsn: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package session
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestQueueBackoff make sure that retry delay doubled up to MaxRetry
+func TestQueueBackoff(t *testing.T) {
+	q := &Queue{MinRetry: time.Minute, MaxRetry: 10 * time.Minute}
+	cases := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{5, 10 * time.Minute},
+		{50, 10 * time.Minute},
+	}
+
+	for _, input := range cases {
+		got := q.backoff(input.attempts)
+		if got != input.expected {
+			t.Errorf("backoff(%d) == %v, expected %v", input.attempts, got, input.expected)
+		}
+	}
+}
+
+// TestQueueRetry make sure that delivered recipients removed,
+// temporary failures retried and permanent failures bounced
+func TestQueueRetry(t *testing.T) {
+	var sent [][]string
+	transport := TransportFunc(func(ctx context.Context, envl *Envelope, data []byte) []*DeliveryResult {
+		sent = append(sent, envl.RecipientAddress)
+		var results []*DeliveryResult
+		for _, rcpt := range envl.RecipientAddress {
+			r := &DeliveryResult{Recipient: rcpt}
+			switch {
+			case strings.HasPrefix(rcpt, "later"):
+				r.Err = NewSMTPError(451, [3]int{4, 3, 0}, "try later")
+			case strings.HasPrefix(rcpt, "unknown"):
+				r.Err = NewSMTPError(550, [3]int{5, 1, 1}, "unknown user")
+			}
+			results = append(results, r)
+		}
+		return results
+	})
+
+	sp := &Spool{Dir: t.TempDir()}
+	q := &Queue{Spool: sp, Transport: transport, MinRetry: time.Hour}
+	envl := &Envelope{
+		OriginatorAddress: "some@example.com",
+		RecipientAddress:  []string{"ok@domain.com", "later@domain.com", "unknown@domain.com"},
+	}
+	if err := q.Deliver(envl, []byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	q.RunOnce(context.Background())
+
+	ids, _ := sp.List()
+	if len(ids) != 2 {
+		t.Fatalf("got %d spooled messages, expected deferred message and bounce", len(ids))
+	}
+
+	var deferred, bounce *Envelope
+	for _, id := range ids {
+		envl, data, _ := sp.Read(id)
+		if envl.OriginatorAddress == "" {
+			bounce = envl
+			if !strings.Contains(string(data), "<unknown@domain.com>: 550 5.1.1 unknown user") {
+				t.Errorf("bounce doesn't report failed recipient: %q", data)
+			}
+		} else {
+			deferred = envl
+		}
+	}
+	if deferred == nil || strings.Join(deferred.RecipientAddress, ",") != "later@domain.com" {
+		t.Errorf("got deferred %+v, expected later@domain.com", deferred)
+	}
+	if bounce == nil || bounce.RecipientAddress[0] != "some@example.com" {
+		t.Errorf("got bounce %+v, expected bounce to sender", bounce)
+	}
+
+	// deferred message is not due yet, only the bounce is sent
+	sent = nil
+	q.RunOnce(context.Background())
+	if len(sent) != 1 || sent[0][0] != "some@example.com" {
+		t.Errorf("got sent %v, expected only the bounce", sent)
+	}
+}
+
+// TestQueueMaxAge make sure that expired message bounce and bounce
+// of null sender is not generated
+func TestQueueMaxAge(t *testing.T) {
+	transport := TransportFunc(func(ctx context.Context, envl *Envelope, data []byte) []*DeliveryResult {
+		return []*DeliveryResult{{Recipient: envl.RecipientAddress[0], Err: NewSMTPError(451, [3]int{4, 3, 0}, "try later")}}
+	})
+	sp := &Spool{Dir: t.TempDir()}
+	q := &Queue{Spool: sp, Transport: transport, MaxAge: time.Nanosecond}
+
+	q.Deliver(&Envelope{RecipientAddress: []string{"later@domain.com"}}, []byte("Subject: bounce\r\n\r\n"))
+	time.Sleep(time.Millisecond)
+	q.RunOnce(context.Background())
+
+	if ids, _ := sp.List(); len(ids) != 0 {
+		t.Errorf("got %d spooled messages, expected expired message removed without bounce", len(ids))
+	}
+}
@@ -0,0 +1,326 @@
+package session
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+)
+
+// overQuotaErr is replied for recipients whose mailbox or domain is
+// over quota
+var overQuotaErr = NewSMTPError(452, [3]int{4, 2, 2}, "Mailbox full")
+
+// default table of SQLQuota
+const defaultQuotaTable = "quotas"
+
+// Quota is the storage limit of a mailbox, zero field is unlimited
+type Quota struct {
+	Bytes    int64 `json:"bytes"`
+	Messages int64 `json:"messages"`
+}
+
+// exceeded report whether a message of size bytes exceed the quota
+// over used. unknown size only check that the quota is not full
+func (q Quota) exceeded(used Quota, size int64) bool {
+	if q.Messages > 0 && used.Messages+1 > q.Messages {
+		return true
+	}
+	return q.Bytes > 0 && (used.Bytes >= q.Bytes || used.Bytes+size > q.Bytes)
+}
+
+// QuotaSource return the quota of mailboxes
+type QuotaSource interface {
+	// Quota return the quota of mailbox, zero Quota when the
+	// mailbox has no limit
+	Quota(mailbox string) (Quota, error)
+}
+
+// QuotaUsage track the storage used by mailboxes and domains
+type QuotaUsage interface {
+	// Usage return the bytes and messages stored in key
+	Usage(ctx context.Context, key string) (Quota, error)
+	// Add account a message of size bytes delivered to key
+	Add(ctx context.Context, key string, size int64) error
+}
+
+// Quotas enforce quotas of mailboxes and domains at RCPT, with the
+// size declared on MAIL FROM, and at end of DATA with the actual
+// size. recipients over quota are replied 452 4.2.2
+type Quotas struct {
+	// Mailboxes return the quota by address, e.g. UserStore
+	Mailboxes QuotaSource
+	// Domains return the quota by domain of the recipient
+	Domains QuotaSource
+	Usage   QuotaUsage
+}
+
+// keys return the mailbox and domain keys of rcpt with their quota
+func (q *Quotas) keys(rcpt string) ([]string, []Quota, error) {
+	var keys []string
+	var quotas []Quota
+	rcpt = strings.ToLower(rcpt)
+	for _, k := range []struct {
+		src QuotaSource
+		key string
+	}{{q.Mailboxes, rcpt}, {q.Domains, domainOf(rcpt)}} {
+		if k.src == nil || k.key == "" {
+			continue
+		}
+		quota, err := k.src.Quota(k.key)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys, quotas = append(keys, k.key), append(quotas, quota)
+	}
+	return keys, quotas, nil
+}
+
+// Check return overQuotaErr when a message of size bytes doesn't fit
+// into the mailbox or domain of rcpt, size is 0 when unknown
+func (q *Quotas) Check(ctx context.Context, rcpt string, size int64) error {
+	keys, quotas, err := q.keys(rcpt)
+	if err != nil {
+		return localErr
+	}
+	for i, key := range keys {
+		if quotas[i] == (Quota{}) {
+			continue
+		}
+		used, err := q.Usage.Usage(ctx, key)
+		if err != nil {
+			return localErr
+		}
+		if quotas[i].exceeded(used, size) {
+			return overQuotaErr
+		}
+	}
+	return nil
+}
+
+// Add account the delivered message to the mailbox and domain of rcpt
+func (q *Quotas) Add(ctx context.Context, rcpt string, size int64) error {
+	rcpt = strings.ToLower(rcpt)
+	for _, key := range []string{rcpt, domainOf(rcpt)} {
+		if key == "" {
+			continue
+		}
+		if err := q.Usage.Add(ctx, key, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkQuota check the quota of rcpt at RCPT with the declared size
+func (s *Session) checkQuota(ctx context.Context, rcpt string) error {
+	q := s.Config.Quotas
+	if q == nil {
+		return nil
+	}
+	var size int64
+	if s.caps.sized {
+		size = s.caps.size
+	}
+	return q.Check(ctx, rcpt, size)
+}
+
+// quotaErrors check the quota of every recipient with the size of
+// data, the recipients over quota are returned as RecipientErrors
+func (s *Session) quotaErrors(envl *Envelope, data []byte) error {
+	q := s.Config.Quotas
+	if q == nil {
+		return nil
+	}
+	errs := make(RecipientErrors)
+	for _, rcpt := range envl.RecipientAddress {
+		if err := q.Check(envl.Context(), rcpt, int64(len(data))); err != nil {
+			errs[rcpt] = err
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// handoverQuota hand over message to the recipients within quota,
+// the recipients over quota are added to the returned RecipientErrors
+func (s *Session) handoverQuota(envl *Envelope, data []byte) error {
+	errs, ok := s.quotaErrors(envl, data).(RecipientErrors)
+	if !ok {
+		return s.handover(envl, data)
+	}
+	var rcpts []string
+	for _, rcpt := range envl.RecipientAddress {
+		if errs[rcpt] == nil {
+			rcpts = append(rcpts, rcpt)
+		}
+	}
+	if len(rcpts) == 0 {
+		return errs
+	}
+	e := *envl
+	e.RecipientAddress = rcpts
+	err := s.handover(&e, data)
+	if rerrs, ok := err.(RecipientErrors); ok {
+		for rcpt, rerr := range rerrs {
+			errs[rcpt] = rerr
+		}
+	} else if err != nil {
+		return err
+	}
+	return errs
+}
+
+// addQuota account the message delivered to rcpts
+func (s *Session) addQuota(envl *Envelope, rcpts []string, data []byte) {
+	q := s.Config.Quotas
+	if q == nil {
+		return
+	}
+	for _, rcpt := range rcpts {
+		if err := q.Add(envl.Context(), rcpt, int64(len(data))); err != nil {
+			s.logf(LevelWarn, "quota of <%s>: %v", rcpt, err)
+		}
+	}
+}
+
+// MemoryQuota is a QuotaSource and QuotaUsage kept in memory, the
+// usage must be loaded with SetUsage on start
+type MemoryQuota struct {
+	mu     sync.Mutex
+	limits map[string]Quota
+	usage  map[string]Quota
+}
+
+// SetLimit set the quota of mailbox or domain key
+func (m *MemoryQuota) SetLimit(key string, quota Quota) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.limits == nil {
+		m.limits = make(map[string]Quota)
+	}
+	m.limits[strings.ToLower(key)] = quota
+}
+
+// SetUsage replace the usage of key, e.g. after messages are expunged
+func (m *MemoryQuota) SetUsage(key string, used Quota) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.usage == nil {
+		m.usage = make(map[string]Quota)
+	}
+	m.usage[strings.ToLower(key)] = used
+}
+
+// Quota implements QuotaSource
+func (m *MemoryQuota) Quota(key string) (Quota, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.limits[strings.ToLower(key)], nil
+}
+
+// Usage implements QuotaUsage
+func (m *MemoryQuota) Usage(ctx context.Context, key string) (Quota, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usage[strings.ToLower(key)], nil
+}
+
+// Add implements QuotaUsage
+func (m *MemoryQuota) Add(ctx context.Context, key string, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.usage == nil {
+		m.usage = make(map[string]Quota)
+	}
+	key = strings.ToLower(key)
+	used := m.usage[key]
+	used.Bytes += size
+	used.Messages++
+	m.usage[key] = used
+	return nil
+}
+
+// SQLQuota is a QuotaSource and QuotaUsage stored in a database, one
+// row of limits and usage per mailbox or domain. the table is
+// created by Migrate
+type SQLQuota struct {
+	DB *sql.DB
+	// Dialect default to SQLiteDialect
+	Dialect SQLDialect
+	// Table default to "quotas"
+	Table string
+}
+
+func (q *SQLQuota) table() string {
+	if q.Table == "" {
+		return defaultQuotaTable
+	}
+	return q.Table
+}
+
+// p return the bind parameter n
+func (q *SQLQuota) p(n int) string {
+	if q.Dialect.Placeholder == nil {
+		return SQLiteDialect.Placeholder(n)
+	}
+	return q.Dialect.Placeholder(n)
+}
+
+// Migrate create the table
+func (q *SQLQuota) Migrate(ctx context.Context) error {
+	_, err := q.DB.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+q.table()+" (name VARCHAR(320) PRIMARY KEY, "+
+		"limit_bytes BIGINT NOT NULL DEFAULT 0, limit_messages BIGINT NOT NULL DEFAULT 0, "+
+		"used_bytes BIGINT NOT NULL DEFAULT 0, used_messages BIGINT NOT NULL DEFAULT 0)")
+	return err
+}
+
+// get read two columns of key, missing row is zero Quota
+func (q *SQLQuota) get(ctx context.Context, columns, key string) (Quota, error) {
+	var r Quota
+	err := q.DB.QueryRowContext(ctx, "SELECT "+columns+" FROM "+q.table()+" WHERE name = "+q.p(1),
+		strings.ToLower(key)).Scan(&r.Bytes, &r.Messages)
+	if err == sql.ErrNoRows {
+		return Quota{}, nil
+	}
+	return r, err
+}
+
+// upsert run update and insert the row of key when it doesn't exist
+func (q *SQLQuota) upsert(ctx context.Context, update, insert string, a, b int64, key string) error {
+	key = strings.ToLower(key)
+	res, err := q.DB.ExecContext(ctx, "UPDATE "+q.table()+" SET "+update+" WHERE name = "+q.p(3), a, b, key)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	_, err = q.DB.ExecContext(ctx, "INSERT INTO "+q.table()+" (name, "+insert+") VALUES ("+
+		q.p(1)+", "+q.p(2)+", "+q.p(3)+")", key, a, b)
+	return err
+}
+
+// SetLimit set the quota of mailbox or domain key
+func (q *SQLQuota) SetLimit(ctx context.Context, key string, quota Quota) error {
+	return q.upsert(ctx, "limit_bytes = "+q.p(1)+", limit_messages = "+q.p(2),
+		"limit_bytes, limit_messages", quota.Bytes, quota.Messages, key)
+}
+
+// Quota implements QuotaSource
+func (q *SQLQuota) Quota(key string) (Quota, error) {
+	return q.get(context.Background(), "limit_bytes, limit_messages", key)
+}
+
+// Usage implements QuotaUsage
+func (q *SQLQuota) Usage(ctx context.Context, key string) (Quota, error) {
+	return q.get(ctx, "used_bytes, used_messages", key)
+}
+
+// Add implements QuotaUsage
+func (q *SQLQuota) Add(ctx context.Context, key string, size int64) error {
+	return q.upsert(ctx, "used_bytes = used_bytes + "+q.p(1)+", used_messages = used_messages + "+q.p(2),
+		"used_bytes, used_messages", size, 1, key)
+}
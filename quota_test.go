@@ -0,0 +1,157 @@
+package session
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+// TestQuotaExceeded make sure that message count and bytes are
+// checked with known and unknown size
+func TestQuotaExceeded(t *testing.T) {
+	cases := []struct {
+		quota    Quota
+		used     Quota
+		size     int64
+		exceeded bool
+	}{
+		{Quota{}, Quota{Bytes: 1 << 40, Messages: 1 << 20}, 100, false},
+		{Quota{Messages: 10}, Quota{Messages: 9}, 0, false},
+		{Quota{Messages: 10}, Quota{Messages: 10}, 0, true},
+		{Quota{Bytes: 1000}, Quota{Bytes: 999}, 0, false},
+		{Quota{Bytes: 1000}, Quota{Bytes: 1000}, 0, true},
+		{Quota{Bytes: 1000}, Quota{Bytes: 900}, 100, false},
+		{Quota{Bytes: 1000}, Quota{Bytes: 900}, 101, true},
+	}
+
+	for _, input := range cases {
+		if got := input.quota.exceeded(input.used, input.size); got != input.exceeded {
+			t.Errorf("%+v used %+v size %d: got %t, expected %t", input.quota, input.used, input.size, got, input.exceeded)
+		}
+	}
+}
+
+// TestSessionQuotas make sure that recipients over mailbox or domain
+// quota are rejected at RCPT and end of DATA, and usage is accounted
+func TestSessionQuotas(t *testing.T) {
+	mq := &MemoryQuota{}
+	mq.SetLimit("full@example.com", Quota{Messages: 1})
+	mq.SetUsage("full@example.com", Quota{Messages: 1})
+	mq.SetLimit("small@example.com", Quota{Bytes: 100})
+	mq.SetLimit("closed.example.com", Quota{Bytes: 10})
+	mq.SetUsage("closed.example.com", Quota{Bytes: 10})
+
+	var delivered []string
+	config := &Config{
+		Quotas: &Quotas{Mailboxes: mq, Domains: mq, Usage: mq},
+		Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			delivered = append(delivered, envl.RecipientAddress...)
+			return nil
+		}),
+	}
+
+	cases := []struct {
+		mail      string
+		rcpts     []string
+		body      string
+		expected  []string
+		delivered string
+	}{
+		{"MAIL FROM:<a@example.org>", []string{"full@example.com"}, "hi", []string{"452 4.2.2 Mailbox full"}, ""},
+		{"MAIL FROM:<a@example.org>", []string{"user@closed.example.com"}, "hi", []string{"452 4.2.2 Mailbox full"}, ""},
+		{"MAIL FROM:<a@example.org> SIZE=500", []string{"small@example.com"}, "hi", []string{"452 4.2.2 Mailbox full"}, ""},
+		{"MAIL FROM:<a@example.org>", []string{"small@example.com"}, strings.Repeat("x", 200), []string{"250 2.1.5", "452 4.2.2 Mailbox full"}, ""},
+		{"MAIL FROM:<a@example.org>", []string{"small@example.com", "user@example.com"}, strings.Repeat("x", 200), []string{"250 2.0.0"}, "user@example.com"},
+		{"MAIL FROM:<a@example.org>", []string{"small@example.com"}, "hi", []string{"250 2.0.0"}, "small@example.com"},
+	}
+
+	for _, input := range cases {
+		delivered = nil
+		cmds := "EHLO client\r\n" + input.mail + "\r\n"
+		for _, rcpt := range input.rcpts {
+			cmds += "RCPT TO:<" + rcpt + ">\r\n"
+		}
+		out := runSession(t, config, cmds+"DATA\r\nSubject: hi\r\n\r\n"+input.body+"\r\n.\r\nQUIT\r\n")
+		for _, want := range input.expected {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s %v: got %q, expected %q", input.mail, input.rcpts, out, want)
+			}
+		}
+		if got := strings.Join(delivered, ","); got != input.delivered {
+			t.Errorf("%s %v: got delivered %q, expected %q", input.mail, input.rcpts, got, input.delivered)
+		}
+	}
+
+	if used, _ := mq.Usage(context.Background(), "small@example.com"); used.Messages != 1 || used.Bytes == 0 {
+		t.Errorf("got usage %+v, expected one message", used)
+	}
+	if used, _ := mq.Usage(context.Background(), "example.com"); used.Messages != 2 {
+		t.Errorf("got domain usage %+v, expected two messages", used)
+	}
+}
+
+// TestSessionQuotasStream make sure that quotas are enforced the same
+// whether Backend can receive streamed message data or not
+func TestSessionQuotasStream(t *testing.T) {
+	for _, backend := range []Backend{BackendFunc(func(envl *Envelope, data []byte) error { return nil }), &streamRecorder{}} {
+		mq := &MemoryQuota{}
+		mq.SetLimit("user@example.com", Quota{Messages: 1})
+		config := &Config{
+			Quotas:  &Quotas{Mailboxes: mq, Usage: mq},
+			Backend: backend,
+		}
+		msg := "MAIL FROM:<a@example.org>\r\nRCPT TO:<user@example.com>\r\nDATA\r\nSubject: hi\r\n\r\nhi\r\n.\r\n"
+		out := runSession(t, config, "EHLO client\r\n"+msg+msg+"QUIT\r\n")
+		if strings.Count(out, "queued as") != 1 || !strings.Contains(out, "452 4.2.2 Mailbox full") {
+			t.Errorf("%T: got %q, expected the second message over quota", backend, out)
+		}
+		if used, _ := mq.Usage(context.Background(), "user@example.com"); used.Messages != 1 {
+			t.Errorf("%T: got usage %+v, expected one message", backend, used)
+		}
+	}
+}
+
+// TestSQLQuota make sure that limits and usage are stored by name
+func TestSQLQuota(t *testing.T) {
+	db, err := sql.Open("sessiontest", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	q := &SQLQuota{DB: db}
+	if err := q.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.SetLimit(ctx, "User@example.com", Quota{Bytes: 1000, Messages: 10}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := q.Add(ctx, "user@example.com", 300); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Add(ctx, "example.com", 300); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if limit, err := q.Quota("user@example.com"); err != nil || limit != (Quota{Bytes: 1000, Messages: 10}) {
+		t.Errorf("got limit %+v %v", limit, err)
+	}
+	if used, err := q.Usage(ctx, "user@example.com"); err != nil || used != (Quota{Bytes: 600, Messages: 2}) {
+		t.Errorf("got usage %+v %v", used, err)
+	}
+	if limit, err := q.Quota("example.com"); err != nil || limit != (Quota{}) {
+		t.Errorf("got domain limit %+v %v", limit, err)
+	}
+	if used, err := q.Usage(ctx, "unknown@example.com"); err != nil || used != (Quota{}) {
+		t.Errorf("got unknown usage %+v %v", used, err)
+	}
+
+	quotas := &Quotas{Mailboxes: q, Usage: q}
+	if err := quotas.Check(ctx, "user@example.com", 500); err != overQuotaErr {
+		t.Errorf("got %v, expected over quota", err)
+	}
+}
@@ -0,0 +1,175 @@
+package session
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweep idle buckets when the number of buckets exceed this
+const maxIdleBuckets = 10000
+
+var (
+	// rateConnErr is sent when connection rate of client IP exceeded
+	rateConnErr = NewSMTPError(421, [3]int{4, 7, 0}, "Too many connections from your IP, try again later")
+	// rateMsgErr is sent when message rate of client IP or
+	// sender domain exceeded
+	rateMsgErr = NewSMTPError(450, [3]int{4, 7, 1}, "Message rate limit exceeded, try again later")
+	// tooManyRcptErr is sent when recipients per message exceeded
+	tooManyRcptErr = NewSMTPError(452, [3]int{4, 5, 3}, "Too many recipients")
+)
+
+// Rate is Count events per Per duration, zero Count is unlimited
+type Rate struct {
+	Count int
+	Per   time.Duration
+}
+
+// Limiter decide whether another event of key is within rate.
+// implement it to share limits between servers
+type Limiter interface {
+	Allow(ctx context.Context, key string, rate Rate) (bool, error)
+}
+
+// bucket is the token bucket of a key
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// TokenBucket is in-memory Limiter, every key has a bucket of
+// rate.Count tokens refilled continuously over rate.Per
+type TokenBucket struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// Allow take a token of key
+func (tb *TokenBucket) Allow(ctx context.Context, key string, rate Rate) (bool, error) {
+	return tb.allow(key, rate, time.Now()), nil
+}
+
+func (tb *TokenBucket) allow(key string, rate Rate, now time.Time) bool {
+	if rate.Count <= 0 || rate.Per <= 0 {
+		return true
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if tb.buckets == nil {
+		tb.buckets = make(map[string]*bucket)
+	}
+	capacity := float64(rate.Count)
+	refill := func(b *bucket) {
+		b.tokens += now.Sub(b.last).Seconds() * capacity / rate.Per.Seconds()
+		if b.tokens > capacity {
+			b.tokens = capacity
+		}
+		b.last = now
+	}
+
+	b, ok := tb.buckets[key]
+	if !ok {
+		if len(tb.buckets) >= maxIdleBuckets {
+			// drop buckets that are full again, they behave
+			// the same as a new bucket
+			for k, b := range tb.buckets {
+				if refill(b); b.tokens >= capacity {
+					delete(tb.buckets, k)
+				}
+			}
+		}
+		b = &bucket{tokens: capacity, last: now}
+		tb.buckets[key] = b
+	}
+	refill(b)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RateLimits limit connections and messages of each client IP and
+// sender domain
+type RateLimits struct {
+	// ConnectionsPerIP limit new connections, exceeded
+	// connection is closed with 421
+	ConnectionsPerIP Rate
+	// MessagesPerIP and MessagesPerDomain limit MAIL commands
+	// by client IP and sender domain, exceeded MAIL get 450
+	MessagesPerIP     Rate
+	MessagesPerDomain Rate
+	// MessagesPerUser limit MAIL commands of authenticated
+	// clients, each app token is limited on its own
+	MessagesPerUser Rate
+	// RecipientsPerMessage limit RCPT commands of a transaction
+	RecipientsPerMessage int
+
+	// Limiter keep the state of limits, default to TokenBucket
+	Limiter Limiter
+
+	local TokenBucket
+}
+
+// limiter return the configured or the in-memory limiter
+func (rl *RateLimits) limiter() Limiter {
+	if rl.Limiter != nil {
+		return rl.Limiter
+	}
+	return &rl.local
+}
+
+// allow check key against rate. errors of external limiter
+// fail open so an outage doesn't stop mail flow
+func (rl *RateLimits) allow(ctx context.Context, key string, rate Rate) bool {
+	if rate.Count <= 0 {
+		return true
+	}
+	ok, err := rl.limiter().Allow(ctx, key, rate)
+	return ok || err != nil
+}
+
+// checkConnectionRate check connection rate of the client
+func (s *Session) checkConnectionRate(ctx context.Context) error {
+	rl := s.Config.RateLimits
+	if rl == nil {
+		return nil
+	}
+	if !rl.allow(ctx, "conn:"+remoteIP(s.Conn), rl.ConnectionsPerIP) {
+		return rateConnErr
+	}
+	return nil
+}
+
+// checkMessageRate check message rate of the client and sender
+// domain on MAIL command
+func (s *Session) checkMessageRate(ctx context.Context, sender string) error {
+	rl := s.Config.RateLimits
+	if rl == nil {
+		return nil
+	}
+	if !rl.allow(ctx, "msg-ip:"+remoteIP(s.Conn), rl.MessagesPerIP) {
+		return rateMsgErr
+	}
+	if d := strings.ToLower(domainOf(sender)); d != "" && !rl.allow(ctx, "msg-domain:"+d, rl.MessagesPerDomain) {
+		return rateMsgErr
+	}
+	if p := s.Principal; p != nil && !rl.allow(ctx, "msg-user:"+p.Credential(), rl.MessagesPerUser) {
+		return rateMsgErr
+	}
+	return nil
+}
+
+// checkRcptLimit check number of recipients of the transaction
+func (s *Session) checkRcptLimit(envl *Envelope) error {
+	rl := s.Config.RateLimits
+	if rl == nil || rl.RecipientsPerMessage <= 0 {
+		return nil
+	}
+	if len(envl.RecipientAddress) >= rl.RecipientsPerMessage {
+		return tooManyRcptErr
+	}
+	return nil
+}
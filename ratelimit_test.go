@@ -0,0 +1,87 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTokenBucket make sure that tokens are refilled over time
+// and each key has its own bucket
+func TestTokenBucket(t *testing.T) {
+	tb := &TokenBucket{}
+	rate := Rate{Count: 2, Per: time.Minute}
+	now := time.Now()
+
+	cases := []struct {
+		key      string
+		at       time.Duration
+		expected bool
+	}{
+		{"a", 0, true},
+		{"a", time.Second, true},
+		{"a", 2 * time.Second, false},
+		{"b", 2 * time.Second, true},
+		{"a", 30 * time.Second, true},
+		{"a", 31 * time.Second, false},
+	}
+
+	for _, input := range cases {
+		got := tb.allow(input.key, rate, now.Add(input.at))
+		if got != input.expected {
+			t.Errorf("allow(%q) at %v == %v, expected %v", input.key, input.at, got, input.expected)
+		}
+	}
+
+	if !tb.allow("a", Rate{}, now) {
+		t.Errorf("expected zero rate to be unlimited")
+	}
+}
+
+type failingLimiter struct{}
+
+func (failingLimiter) Allow(ctx context.Context, key string, rate Rate) (bool, error) {
+	return false, errors.New("limiter unavailable")
+}
+
+// TestSessionRateLimits make sure that exceeded limits are replied
+// with 421, 450 and 452
+func TestSessionRateLimits(t *testing.T) {
+	cases := []struct {
+		limits   *RateLimits
+		input    string
+		expected string
+	}{
+		{
+			&RateLimits{MessagesPerIP: Rate{1, time.Hour}},
+			"EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nRSET\r\nMAIL FROM:<some@example.com>\r\nQUIT\r\n",
+			"450 4.7.1 Message rate limit exceeded",
+		},
+		{
+			&RateLimits{RecipientsPerMessage: 1},
+			"EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<a@domain.com>\r\nRCPT TO:<b@domain.com>\r\nQUIT\r\n",
+			"452 4.5.3 Too many recipients",
+		},
+		{
+			&RateLimits{MessagesPerIP: Rate{1, time.Hour}, Limiter: failingLimiter{}},
+			"EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nQUIT\r\n",
+			"250 2.0.0",
+		},
+	}
+
+	for _, input := range cases {
+		out := runSession(t, &Config{RateLimits: input.limits}, input.input)
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("got: %q, expected %q", out, input.expected)
+		}
+	}
+
+	limits := &RateLimits{ConnectionsPerIP: Rate{1, time.Minute}}
+	runSession(t, &Config{RateLimits: limits}, "QUIT\r\n")
+	out := runSession(t, &Config{RateLimits: limits}, "QUIT\r\n")
+	if !strings.HasPrefix(out, "421 4.7.0") {
+		t.Errorf("got: %q, expected 421 on second connection", out)
+	}
+}
@@ -0,0 +1,176 @@
+package session
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default settings of ReverseDNS
+const (
+	defaultRDNSCacheTTL = 10 * time.Minute
+	defaultRDNSTimeout  = 5 * time.Second
+)
+
+// replies of ReverseDNS (RFC 7372)
+var (
+	rdnsErr     = NewSMTPError(550, [3]int{5, 7, 25}, "Reverse DNS validation failed")
+	rdnsTempErr = NewSMTPError(450, [3]int{4, 7, 25}, "Temporary failure looking up reverse DNS")
+)
+
+// ReverseDNSResult is the PTR name of a client address
+type ReverseDNSResult struct {
+	// Name is the first PTR name without trailing dot, empty
+	// when the address has no PTR record
+	Name string
+	// Confirmed is set when Name resolve back to the address
+	// (forward-confirmed reverse DNS)
+	Confirmed bool
+	// Temporary is set when the lookup failed for other reasons
+	// than a missing name, the result is then not cached
+	Temporary bool
+}
+
+type rdnsEntry struct {
+	result  ReverseDNSResult
+	expires time.Time
+}
+
+// ReverseDNS look up the PTR name of clients at connection time.
+// the confirmed name is written into Received header and logs
+type ReverseDNS struct {
+	// RejectMissing reject clients without PTR record
+	RejectMissing bool
+	// RejectMismatch reject clients whose PTR name doesn't
+	// resolve back to their address
+	RejectMismatch bool
+	// Message is the text of 550 reply, {ip} is replaced with
+	// the client address
+	Message string
+
+	CacheTTL time.Duration
+	Timeout  time.Duration
+
+	mu    sync.Mutex
+	cache map[string]rdnsEntry
+}
+
+// Lookup return the PTR name of ip, checked against the addresses
+// of the name. results are cached for CacheTTL
+func (r *ReverseDNS) Lookup(ctx context.Context, resolver Resolver, ip net.IP) ReverseDNSResult {
+	key := ip.String()
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.result
+	}
+
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultRDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var res ReverseDNSResult
+	names, err := resolver.LookupAddr(ctx, key)
+	if err != nil && !isNotFound(err) {
+		return ReverseDNSResult{Temporary: true}
+	}
+	for i, name := range names {
+		name = trimDot(name)
+		if i == 0 {
+			res.Name = name
+		}
+		addrs, err := resolver.LookupHost(ctx, name)
+		if err != nil && !isNotFound(err) {
+			return ReverseDNSResult{Name: res.Name, Temporary: true}
+		}
+		if containsIP(addrs, ip) {
+			res.Name, res.Confirmed = name, true
+			break
+		}
+	}
+
+	ttl := r.CacheTTL
+	if ttl <= 0 {
+		ttl = defaultRDNSCacheTTL
+	}
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = make(map[string]rdnsEntry)
+	}
+	r.cache[key] = rdnsEntry{result: res, expires: time.Now().Add(ttl)}
+	r.mu.Unlock()
+	return res
+}
+
+// containsIP report whether addrs contain ip
+func containsIP(addrs []string, ip net.IP) bool {
+	for _, a := range addrs {
+		if ip.Equal(net.ParseIP(a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reject return the reply to the client ip with result res, nil
+// when the client is accepted
+func (r *ReverseDNS) Reject(ip net.IP, res ReverseDNSResult) *SMTPError {
+	missing := res.Name == ""
+	if !(r.RejectMissing && missing) && !(r.RejectMismatch && !res.Confirmed) {
+		return nil
+	}
+	if res.Temporary {
+		return rdnsTempErr
+	}
+	if r.Message == "" {
+		return rdnsErr
+	}
+	return NewSMTPError(550, [3]int{5, 7, 25}, strings.ReplaceAll(r.Message, "{ip}", ip.String()))
+}
+
+// ReverseDNS return the PTR name of the client looked up at
+// connection time, see Config.ReverseDNS
+func (s *Session) ReverseDNS() ReverseDNSResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rdns
+}
+
+// remoteName return the forward-confirmed PTR name of the client
+func (s *Session) remoteName() string {
+	if rdns := s.ReverseDNS(); rdns.Confirmed {
+		return rdns.Name
+	}
+	return ""
+}
+
+// checkReverseDNS look up the PTR name of the client and reject it
+// according to Config.ReverseDNS. allowlisted clients are not rejected
+func (s *Session) checkReverseDNS(ctx context.Context) error {
+	r := s.Config.ReverseDNS
+	ip := s.RemoteIP()
+	if r == nil || ip == nil {
+		return nil
+	}
+	ctx, span := s.span(ctx, "smtp.rdns")
+	res := r.Lookup(ctx, s.Config.resolver(), ip)
+	span.SetAttribute("rdns.name", res.Name)
+	span.End()
+
+	s.mu.Lock()
+	s.rdns = res
+	s.mu.Unlock()
+	if s.Config.Access.AllowedIP(ip) {
+		return nil
+	}
+	if err := r.Reject(ip, res); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package session
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestReverseDNS make sure that PTR names are forward-confirmed
+// and clients are rejected only by enabled checks
+func TestReverseDNS(t *testing.T) {
+	r := &fakeResolver{
+		hosts: map[string][]string{"mail.example.org": {"192.0.2.1"}, "forged.example.org": {"192.0.2.99"}},
+		ptrs: map[string][]string{
+			"192.0.2.1": {"mail.example.org."},
+			"192.0.2.2": {"forged.example.org."},
+		},
+	}
+	cases := []struct {
+		rdns     *ReverseDNS
+		ip       string
+		expected ReverseDNSResult
+		reject   string
+	}{
+		{&ReverseDNS{RejectMissing: true, RejectMismatch: true}, "192.0.2.1", ReverseDNSResult{Name: "mail.example.org", Confirmed: true}, ""},
+		{&ReverseDNS{RejectMissing: true}, "192.0.2.2", ReverseDNSResult{Name: "forged.example.org"}, ""},
+		{&ReverseDNS{RejectMismatch: true}, "192.0.2.2", ReverseDNSResult{Name: "forged.example.org"}, "550 5.7.25 Reverse DNS validation failed"},
+		{&ReverseDNS{}, "192.0.2.3", ReverseDNSResult{}, ""},
+		{&ReverseDNS{RejectMissing: true, Message: "No PTR for {ip}"}, "192.0.2.3", ReverseDNSResult{}, "550 5.7.25 No PTR for 192.0.2.3"},
+	}
+
+	for _, input := range cases {
+		ip := net.ParseIP(input.ip)
+		got := input.rdns.Lookup(context.Background(), r, ip)
+		if got != input.expected {
+			t.Errorf("%s: got %+v, expected %+v", input.ip, got, input.expected)
+		}
+		reject := ""
+		if err := input.rdns.Reject(ip, got); err != nil {
+			reject = err.Error()
+		}
+		if reject != input.reject {
+			t.Errorf("%s: got %q, expected %q", input.ip, reject, input.reject)
+		}
+	}
+}
+
+// TestSessionReverseDNS make sure that the confirmed name is written
+// into Received header and unknown clients are rejected at connection
+func TestSessionReverseDNS(t *testing.T) {
+	r := &fakeResolver{
+		hosts: map[string][]string{"mail.example.org": {"192.0.2.1"}},
+		ptrs:  map[string][]string{"192.0.2.1": {"mail.example.org."}},
+	}
+	var data []byte
+	config := &Config{
+		Resolver:    r,
+		ReverseDNS:  &ReverseDNS{RejectMissing: true},
+		AddReceived: true,
+		Backend: BackendFunc(func(envl *Envelope, d []byte) error {
+			data = d
+			return nil
+		}),
+	}
+	runSessionFrom(t, config, "192.0.2.1:1025", "HELO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\nSubject: a\r\n\r\n.\r\nQUIT\r\n")
+	if !strings.HasPrefix(string(data), "Received: from client.com (mail.example.org [192.0.2.1])") {
+		t.Errorf("got %q, expected PTR name in Received header", data)
+	}
+
+	out := runSessionFrom(t, config, "192.0.2.3:1025", "HELO client.com\r\nQUIT\r\n")
+	if !strings.HasPrefix(out, "550 5.7.25 Reverse DNS validation failed\r\n") {
+		t.Errorf("got %q, expected client without PTR rejected", out)
+	}
+}
@@ -0,0 +1,59 @@
+package session
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// protocol return the protocol of Received header (RFC 3848),
+// ESMTPS for TLS sessions and ESMTPA for authenticated clients
+func (s *Session) protocol() string {
+	if !s.ehlo {
+		return "SMTP"
+	}
+	proto := "ESMTP"
+	if s.TLS() {
+		proto += "S"
+	}
+	if s.Principal != nil {
+		proto += "A"
+	}
+	return proto
+}
+
+// received return the value of Received header of the message
+// (RFC 5321 section 4.4) naming the original client of XFORWARD.
+// the recipient is only added when there is exactly one so the
+// other recipients are not disclosed
+func (s *Session) received(envl *Envelope) string {
+	helo, name, addr, proto := s.client()
+	if helo == "" {
+		helo = "unknown"
+	}
+	if addr == "" {
+		addr = "unknown"
+	} else if strings.Contains(addr, ":") {
+		// TCP-info of IPv6 client is an address literal
+		addr = "IPv6:" + addr
+	}
+	from := helo + " ([" + addr + "])"
+	if name != "" {
+		from = helo + " (" + name + " [" + addr + "])"
+	}
+	value := fmt.Sprintf("from %s\r\n\tby %s with %s", from, s.Hostname(), proto)
+	var params []string
+	if v := s.TLSVersion(); v != "" {
+		params = append(params, "version="+v)
+	}
+	if c := s.TLSCipher(); c != "" {
+		params = append(params, "cipher="+c)
+	}
+	if len(params) > 0 {
+		value += " (" + strings.Join(params, " ") + ")"
+	}
+	if len(envl.RecipientAddress) == 1 {
+		value += "\r\n\tfor <" + envl.RecipientAddress[0] + ">"
+	}
+	return value + ";\r\n\t" + time.Now().Format(time.RFC1123Z)
+}
@@ -0,0 +1,40 @@
+package session
+
+import "strings"
+
+// relayDeniedErr is sent for recipients outside local domains
+var relayDeniedErr = NewSMTPError(554, [3]int{5, 7, 1}, "Relay access denied")
+
+// isLocalDomain report whether mail to domain is accepted from any
+// client. address without domain like <postmaster> is local
+func (c *Config) isLocalDomain(domain string) bool {
+	if domain == "" {
+		return true
+	}
+	domain = strings.ToLower(ToASCII(domain))
+	for _, d := range c.LocalDomains {
+		if strings.EqualFold(ToASCII(strings.TrimSuffix(d, ".")), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// relayAllowed report whether the client may send to any domain
+func (s *Session) relayAllowed() bool {
+	return s.Principal != nil || s.Config.RelayNetworks.MatchIP(s.RemoteIP())
+}
+
+// checkRelay reject recipients outside LocalDomains unless the client
+// is authenticated or in RelayNetworks. without LocalDomains every
+// recipient is accepted
+func (s *Session) checkRelay(rcpt string) error {
+	if len(s.Config.LocalDomains) == 0 || s.relayAllowed() {
+		return nil
+	}
+	if s.Config.isLocalDomain(domainOf(rcpt)) {
+		return nil
+	}
+	s.logf(LevelInfo, "relay to <%s> denied", rcpt)
+	return relayDeniedErr
+}
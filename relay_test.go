@@ -0,0 +1,50 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestRelay make sure that recipients outside local domains are only
+// accepted from authenticated clients and relay networks
+func TestRelay(t *testing.T) {
+	networks, err := ParseAccessList([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := "AUTH PLAIN " + plainResponse("user", "secret") + "\r\n"
+
+	cases := []struct {
+		remote   string
+		auth     bool
+		domains  []string
+		rcpt     string
+		expected string
+	}{
+		{"192.0.2.1:25", false, []string{"example.com"}, "user@example.com", "250 2.1.5 OK"},
+		{"192.0.2.1:25", false, []string{"example.com"}, "user@EXAMPLE.com", "250 2.1.5 OK"},
+		{"192.0.2.1:25", false, []string{"example.com."}, "user@example.com", "250 2.1.5 OK"},
+		{"192.0.2.1:25", false, []string{"example.com"}, "user@other.com", "554 5.7.1 Relay access denied"},
+		{"192.0.2.1:25", false, []string{"example.com"}, "user@sub.example.com", "554 5.7.1 Relay access denied"},
+		{"192.0.2.1:25", true, []string{"example.com"}, "user@other.com", "250 2.1.5 OK"},
+		{"10.1.2.3:25", false, []string{"example.com"}, "user@other.com", "250 2.1.5 OK"},
+		{"192.0.2.1:25", false, nil, "user@other.com", "250 2.1.5 OK"},
+	}
+
+	for _, input := range cases {
+		config := &Config{
+			Authenticator:      testAuthenticator,
+			AuthAllowPlaintext: true,
+			LocalDomains:       input.domains,
+			RelayNetworks:      networks,
+		}
+		session := "EHLO client.com\r\n"
+		if input.auth {
+			session += auth
+		}
+		out := runSessionFrom(t, config, input.remote, session+"MAIL FROM:<a@client.com>\r\nRCPT TO:<"+input.rcpt+">\r\nQUIT\r\n")
+		if !strings.Contains(out, input.expected+"\r\n") {
+			t.Errorf("%s %v %s: got %q, expected %q", input.remote, input.auth, input.rcpt, out, input.expected)
+		}
+	}
+}
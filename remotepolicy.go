@@ -0,0 +1,135 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+)
+
+// default settings of RemotePolicy
+const (
+	defaultRemoteTimeout = 2 * time.Second
+	remoteRetryDelay     = 100 * time.Millisecond
+)
+
+// CheckRequest is the session state sent to remote policy service
+type CheckRequest struct {
+	RemoteIP  string
+	Helo      string
+	Principal string
+	MailFrom  string
+	Rcpt      string
+	RcptTo    []string
+}
+
+// PolicyService is the client of remote filter and policy service
+// defined in remotepolicy.proto. this package doesn't depend on
+// gRPC, wrap the generated client to implement PolicyService.
+// CheckData stream body to the service in chunks
+type PolicyService interface {
+	CheckConnect(ctx context.Context, req *CheckRequest) (*Verdict, error)
+	CheckMail(ctx context.Context, req *CheckRequest) (*Verdict, error)
+	CheckRcpt(ctx context.Context, req *CheckRequest) (*Verdict, error)
+	CheckData(ctx context.Context, req *CheckRequest, body io.Reader) (*Verdict, error)
+}
+
+// RemotePolicy is a Policy and Filter that call out to PolicyService
+// with a deadline on each call and retry on transport errors. when
+// the service is still unavailable the session is tempfailed, or
+// accepted with FailOpen
+type RemotePolicy struct {
+	Service PolicyService
+
+	// Timeout of each attempt, default to 2 seconds
+	Timeout time.Duration
+	// Retries is the number of attempts after the first one
+	Retries int
+	// FailOpen accept when the service is unavailable
+	FailOpen bool
+}
+
+// call run f with deadline and retries, and convert the verdict
+func (rp *RemotePolicy) call(ctx context.Context, f func(ctx context.Context) (*Verdict, error)) error {
+retry:
+	for attempt := 0; attempt <= rp.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				break retry
+			case <-time.After(time.Duration(attempt) * remoteRetryDelay):
+			}
+		}
+
+		actx, cancel := context.WithTimeout(ctx, durationOr(rp.Timeout, defaultRemoteTimeout))
+		v, err := f(actx)
+		cancel()
+		if err == nil && v != nil {
+			// unknown action is treated like unavailable service
+			if err = v.Err(); err == nil || isSMTPError(err) {
+				return err
+			}
+		}
+	}
+	if rp.FailOpen {
+		return nil
+	}
+	return localErr
+}
+
+// isSMTPError report whether err is *SMTPError
+func isSMTPError(err error) bool {
+	_, ok := err.(*SMTPError)
+	return ok
+}
+
+// checkRequest build the request of the session state
+func checkRequest(s *Session, envl *Envelope, rcpt string) *CheckRequest {
+	req := &CheckRequest{Rcpt: rcpt}
+	if s != nil {
+		req.RemoteIP = remoteIP(s.Conn)
+		req.Helo = s.HeloName
+		if s.Principal != nil {
+			req.Principal = s.Principal.Username
+		}
+	}
+	if envl != nil {
+		req.MailFrom = envl.OriginatorAddress
+		req.RcptTo = envl.RecipientAddress
+	}
+	return req
+}
+
+// Check call the service method of the stage. message data is
+// checked by Filter
+func (rp *RemotePolicy) Check(ctx context.Context, req *PolicyRequest) error {
+	r := checkRequest(req.Session, req.Envelope, req.Recipient)
+	switch req.Stage {
+	case StageConnect:
+		return rp.call(ctx, func(ctx context.Context) (*Verdict, error) {
+			return rp.Service.CheckConnect(ctx, r)
+		})
+	case StageMail:
+		return rp.call(ctx, func(ctx context.Context) (*Verdict, error) {
+			return rp.Service.CheckMail(ctx, r)
+		})
+	case StageRcpt:
+		return rp.call(ctx, func(ctx context.Context) (*Verdict, error) {
+			return rp.Service.CheckRcpt(ctx, r)
+		})
+	}
+	return nil
+}
+
+// Filter stream the message data to CheckData within the data stage
+// budget of envl
+func (rp *RemotePolicy) Filter(envl *Envelope, data []byte) ([]byte, error) {
+	r := checkRequest(nil, envl, "")
+	err := rp.call(envl.Context(), func(ctx context.Context) (*Verdict, error) {
+		return rp.Service.CheckData(ctx, r, bytes.NewReader(data))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
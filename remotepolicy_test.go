@@ -0,0 +1,117 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePolicyService reply verdicts from the action of each stage,
+// the first failures calls return transport error
+type fakePolicyService struct {
+	actions  map[Stage]string
+	failures int
+	calls    int
+	body     string
+}
+
+func (f *fakePolicyService) verdict(ctx context.Context, stage Stage) (*Verdict, error) {
+	f.calls++
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("unavailable")
+	}
+	if f.actions[stage] == "hang" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return &Verdict{Action: f.actions[stage]}, nil
+}
+
+func (f *fakePolicyService) CheckConnect(ctx context.Context, req *CheckRequest) (*Verdict, error) {
+	return f.verdict(ctx, StageConnect)
+}
+
+func (f *fakePolicyService) CheckMail(ctx context.Context, req *CheckRequest) (*Verdict, error) {
+	return f.verdict(ctx, StageMail)
+}
+
+func (f *fakePolicyService) CheckRcpt(ctx context.Context, req *CheckRequest) (*Verdict, error) {
+	return f.verdict(ctx, StageRcpt)
+}
+
+func (f *fakePolicyService) CheckData(ctx context.Context, req *CheckRequest, body io.Reader) (*Verdict, error) {
+	b, _ := io.ReadAll(body)
+	f.body = string(b)
+	return f.verdict(ctx, StageData)
+}
+
+func TestRemotePolicyCall(t *testing.T) {
+	cases := []struct {
+		service  *fakePolicyService
+		retries  int
+		failOpen bool
+		expected string
+		calls    int
+	}{
+		{&fakePolicyService{actions: map[Stage]string{StageMail: "reject"}}, 0, false, "550 5.7.1", 1},
+		{&fakePolicyService{failures: 1}, 1, false, "", 2},
+		{&fakePolicyService{failures: 2}, 1, false, "451 4.3.0", 2},
+		{&fakePolicyService{failures: 2}, 1, true, "", 2},
+		{&fakePolicyService{actions: map[Stage]string{StageMail: "hang"}}, 0, false, "451 4.3.0", 1},
+	}
+
+	for _, input := range cases {
+		rp := &RemotePolicy{Service: input.service, Retries: input.retries, FailOpen: input.failOpen, Timeout: 10 * time.Millisecond}
+		err := rp.Check(context.Background(), &PolicyRequest{Stage: StageMail, Envelope: &Envelope{}})
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if !strings.HasPrefix(got, input.expected) || (input.expected == "") != (got == "") {
+			t.Errorf("got: %q, expected: %q", got, input.expected)
+		}
+		if input.service.calls != input.calls {
+			t.Errorf("got %d calls, expected %d", input.service.calls, input.calls)
+		}
+	}
+}
+
+// TestSessionRemotePolicy make sure that session call the service
+// at every stage and stream message data
+func TestSessionRemotePolicy(t *testing.T) {
+	service := &fakePolicyService{actions: map[Stage]string{StageRcpt: "accept", StageData: "tempfail"}}
+	rp := &RemotePolicy{Service: service}
+	config := &Config{Policies: []Policy{rp}, Filters: []Filter{rp}}
+
+	out := runSession(t, config, "EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\nSubject: test\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+	if !strings.Contains(out, "451 4.7.1 Temporarily rejected by filter") {
+		t.Errorf("got: %q, expected tempfail after DATA", out)
+	}
+	if service.calls != 4 {
+		t.Errorf("got %d calls, expected 4", service.calls)
+	}
+	if service.body != "Subject: test\r\n\r\nbody\r\n" {
+		t.Errorf("got body %q", service.body)
+	}
+}
+
+// TestSessionRemotePolicyBudget make sure that the remote filter is
+// bounded by the budget of the data stage
+func TestSessionRemotePolicyBudget(t *testing.T) {
+	service := &fakePolicyService{actions: map[Stage]string{StageData: "hang"}}
+	rp := &RemotePolicy{Service: service, Timeout: time.Minute}
+	config := &Config{Filters: []Filter{rp}, Budgets: map[Stage]time.Duration{StageData: 50 * time.Millisecond}}
+
+	start := time.Now()
+	out := runSession(t, config, "EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\nSubject: test\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+	if !strings.Contains(out, "451 4.3.0") {
+		t.Errorf("got: %q, expected local error after DATA", out)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("got reply after %v, expected the data stage budget", d)
+	}
+}
@@ -0,0 +1,318 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaults of Recorder and replay targets
+const (
+	defaultRecordSize  = 10 << 20
+	defaultReplayIdle  = time.Second
+	recordingExt       = ".rec"
+	defaultReplayLimit = 30 * time.Second
+)
+
+// Recording is the input of an inbound session
+type Recording struct {
+	ID      string
+	Remote  string
+	Started time.Time
+	Input   []byte
+	// Truncated is set when the input exceed MaxSize of Recorder
+	Truncated bool `json:",omitempty"`
+}
+
+// Recorder record everything sent by clients of sessions started
+// before Until into a file per session in Dir. replies are not
+// recorded, Replayer produce them again
+type Recorder struct {
+	Dir string
+	// Until is the end of recording window, zero record forever
+	Until time.Time
+	// MaxSize is the maximum recorded input per session,
+	// default to 10 MiB
+	MaxSize int
+}
+
+// active report whether sessions started at now are recorded
+func (r *Recorder) active(now time.Time) bool {
+	return r != nil && (r.Until.IsZero() || now.Before(r.Until))
+}
+
+// wrap return conn that record its input, errors writing the
+// recording go to lg
+func (r *Recorder) wrap(conn net.Conn, lg *Logger) net.Conn {
+	size := r.MaxSize
+	if size <= 0 {
+		size = defaultRecordSize
+	}
+	rc := &recordConn{
+		Conn: conn,
+		dir:  r.Dir,
+		max:  size,
+		lg:   lg,
+		rec:  &Recording{ID: newSpoolID(), Started: time.Now()},
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		rc.rec.Remote = addr.String()
+	}
+	return rc
+}
+
+// recordConn copy read data into the recording and write it
+// on Close
+type recordConn struct {
+	net.Conn
+	dir string
+	max int
+	lg  *Logger
+
+	mu     sync.Mutex
+	rec    *Recording
+	closed bool
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	if room := c.max - len(c.rec.Input); room < n {
+		c.rec.Input = append(c.rec.Input, b[:max(room, 0)]...)
+		c.rec.Truncated = true
+	} else {
+		c.rec.Input = append(c.rec.Input, b[:n]...)
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *recordConn) Close() error {
+	err := c.Conn.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return err
+	}
+	c.closed = true
+	data, jerr := json.Marshal(c.rec)
+	if jerr == nil {
+		jerr = writeFile(filepath.Join(c.dir, c.rec.ID+recordingExt), data)
+	}
+	if jerr != nil {
+		logf(c.lg, LevelWarn, "recorder: %v", jerr)
+	}
+	return err
+}
+
+// ReadRecordings read every recording in dir ordered by start time
+func ReadRecordings(dir string) ([]*Recording, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+recordingExt))
+	if err != nil {
+		return nil, err
+	}
+	var recs []*Recording
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		rec := &Recording{}
+		if err := json.Unmarshal(data, rec); err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Started.Before(recs[j].Started) })
+	return recs, nil
+}
+
+// ReplayTarget run a recorded session and return its replies
+type ReplayTarget interface {
+	Replay(ctx context.Context, rec *Recording) ([]string, error)
+}
+
+// ConfigTarget replay sessions in process with Config, the recorded
+// remote address is kept so address based checks behave the same
+type ConfigTarget struct {
+	Config *Config
+	// Idle is how long to wait for more replies after the
+	// input is sent, default to 1 second
+	Idle time.Duration
+}
+
+// replayConn is a pipe end with the recorded remote address
+type replayConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *replayConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Replay serve the recording in a new session
+func (t *ConfigTarget) Replay(ctx context.Context, rec *Recording) ([]string, error) {
+	server, client := net.Pipe()
+	conn := net.Conn(server)
+	if addr, err := net.ResolveTCPAddr("tcp", rec.Remote); err == nil {
+		conn = &replayConn{Conn: server, remote: addr}
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	s := New(conn, wg, nil)
+	s.Config = t.Config
+	go s.Serve()
+
+	replies, err := exchange(ctx, client, rec.Input, durationOr(t.Idle, defaultReplayIdle))
+	conn.Close()
+	return replies, err
+}
+
+// AddrTarget replay sessions against a running server at Addr,
+// e.g. a new build listening on another port
+type AddrTarget struct {
+	Addr string
+	// Idle is how long to wait for more replies after the
+	// input is sent, default to 1 second
+	Idle time.Duration
+}
+
+// Replay send the recording to the server
+func (t *AddrTarget) Replay(ctx context.Context, rec *Recording) ([]string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", t.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchange(ctx, conn, rec.Input, durationOr(t.Idle, defaultReplayIdle))
+}
+
+// exchange write input into conn and read replies until the
+// connection is closed or idle
+func exchange(ctx context.Context, conn net.Conn, input []byte, idle time.Duration) ([]string, error) {
+	go conn.Write(input)
+
+	deadline := time.Now().Add(defaultReplayLimit)
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d
+	}
+
+	var out bytes.Buffer
+	buf := make([]byte, 4096)
+	for time.Now().Before(deadline) {
+		conn.SetReadDeadline(time.Now().Add(idle))
+		n, err := conn.Read(buf)
+		out.Write(buf[:n])
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			if err != io.EOF && out.Len() == 0 {
+				return nil, err
+			}
+			break
+		}
+	}
+	return replyCodes(out.Bytes()), nil
+}
+
+// replyCodes return reply code and enhanced status code of the
+// last line of every reply
+func replyCodes(out []byte) []string {
+	var codes []string
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		if len(line) < 3 || (len(line) > 3 && line[3] != ' ') {
+			continue
+		}
+		code := line[:3]
+		if fields := strings.Fields(line[3:]); len(fields) > 0 && isEnhancedCode(fields[0]) {
+			code += " " + fields[0]
+		}
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+// isEnhancedCode report whether s look like "2.0.0"
+func isEnhancedCode(s string) bool {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	for _, p := range parts {
+		if p == "" || strings.Trim(p, "0123456789") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// ReplayDiff is a reply that differ between targets, missing reply
+// is empty
+type ReplayDiff struct {
+	ID        string
+	Index     int
+	Baseline  string
+	Candidate string
+}
+
+// Replayer feed recordings to two targets side by side and compare
+// the replies, including the verdict of every message
+type Replayer struct {
+	Baseline  ReplayTarget
+	Candidate ReplayTarget
+}
+
+// Replay run every recording and return the differences
+func (r *Replayer) Replay(ctx context.Context, recs []*Recording) ([]ReplayDiff, error) {
+	var diffs []ReplayDiff
+	for _, rec := range recs {
+		var base, cand []string
+		var berr, cerr error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			base, berr = r.Baseline.Replay(ctx, rec)
+		}()
+		go func() {
+			defer wg.Done()
+			cand, cerr = r.Candidate.Replay(ctx, rec)
+		}()
+		wg.Wait()
+		if berr != nil {
+			return diffs, berr
+		}
+		if cerr != nil {
+			return diffs, cerr
+		}
+
+		for i := 0; i < len(base) || i < len(cand); i++ {
+			var b, c string
+			if i < len(base) {
+				b = base[i]
+			}
+			if i < len(cand) {
+				c = cand[i]
+			}
+			if b != c {
+				diffs = append(diffs, ReplayDiff{ID: rec.ID, Index: i, Baseline: b, Candidate: c})
+			}
+		}
+	}
+	return diffs, nil
+}
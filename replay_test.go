@@ -0,0 +1,75 @@
+package session
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReplyCodes make sure that the last line of every reply is taken
+func TestReplyCodes(t *testing.T) {
+	out := "220 <host> ready\r\n250-host\r\n250-8BITMIME\r\n250 HELP\r\n550 5.1.1 unknown\r\n221 2.0.0 Bye\r\n"
+	expected := "220,250,550 5.1.1,221 2.0.0"
+	if got := strings.Join(replyCodes([]byte(out)), ","); got != expected {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
+
+// TestRecordReplay make sure that recorded sessions are replayed
+// and verdict changes of the candidate are reported
+func TestRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(&Config{Recorder: &Recorder{Dir: dir}})
+	go srv.Serve(l)
+
+	c := dialTestClient(t, l.Addr().String())
+	c.cmd(t, "HELO client.com", "250")
+	c.cmd(t, "MAIL FROM:<some@example.com>", "250")
+	c.cmd(t, "RCPT TO:<blocked@domain.com>", "250")
+	c.cmd(t, "DATA", "354")
+	c.cmd(t, "Subject: test\r\n\r\nbody\r\n.", "250")
+	c.cmd(t, "QUIT", "221")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+
+	recs, err := ReadRecordings(dir)
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("got %d recordings %v, expected 1", len(recs), err)
+	}
+	if !strings.HasPrefix(string(recs[0].Input), "HELO client.com\r\n") || !strings.HasPrefix(recs[0].Remote, "127.0.0.1:") {
+		t.Errorf("got recording %+v", recs[0])
+	}
+
+	block := PolicyFunc(func(ctx context.Context, req *PolicyRequest) error {
+		if req.Stage == StageRcpt && strings.HasPrefix(req.Recipient, "blocked") {
+			return NewSMTPError(550, [3]int{5, 7, 1}, "blocked")
+		}
+		return nil
+	})
+	r := &Replayer{
+		Baseline:  &ConfigTarget{Config: &Config{}},
+		Candidate: &ConfigTarget{Config: &Config{Policies: []Policy{block}}},
+	}
+	diffs, err := r.Replay(ctx, recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RCPT is rejected, so DATA and the message text fail too
+	if len(diffs) == 0 || diffs[0].Index != 3 || diffs[0].Baseline != "250 2.1.5" || diffs[0].Candidate != "550 5.7.1" {
+		t.Errorf("got diffs %+v, expected rejected RCPT first", diffs)
+	}
+
+	r.Candidate = &ConfigTarget{Config: &Config{}}
+	if diffs, _ := r.Replay(ctx, recs); len(diffs) != 0 {
+		t.Errorf("got diffs %+v of the same config, expected none", diffs)
+	}
+}
@@ -0,0 +1,102 @@
+package session
+
+import (
+	"fmt"
+	"strings"
+)
+
+// replies sent outside of command replies
+const (
+	replyGreeting = iota
+	replyQuit
+	replyShutdown
+	replyNotAccepting
+)
+
+// Replies override the texts of the greeting, the QUIT reply and the
+// replies sent when the server is shutting down or not accepting
+// messages. "<host>" is replaced by Session.Hostname, empty replies
+// use the defaults REPLY_220, REPLY_221, REPLY_421_DOWN and REPLY_453
+type Replies struct {
+	Greeting     string
+	Quit         string
+	Shutdown     string
+	NotAccepting string
+}
+
+// replyDefaults are the default replies and the code of each reply
+var replyDefaults = [...]struct {
+	name  string
+	code  string
+	reply string
+}{
+	replyGreeting:     {"greeting", "220", REPLY_220},
+	replyQuit:         {"quit", "221", REPLY_221},
+	replyShutdown:     {"shutdown", "421", REPLY_421_DOWN},
+	replyNotAccepting: {"not accepting", "453", REPLY_453},
+}
+
+// get return the configured reply of kind, "" when it isn't set
+func (r *Replies) get(kind int) string {
+	if r == nil {
+		return ""
+	}
+	switch kind {
+	case replyGreeting:
+		return r.Greeting
+	case replyQuit:
+		return r.Quit
+	case replyShutdown:
+		return r.Shutdown
+	case replyNotAccepting:
+		return r.NotAccepting
+	}
+	return ""
+}
+
+// Check report the first reply that doesn't start with its reply
+// code, or with an enhanced status code of another class. the
+// greeting has no enhanced status code (RFC 2034 section 3)
+func (r *Replies) Check() error {
+	for kind, d := range replyDefaults {
+		text := r.get(kind)
+		if text == "" {
+			continue
+		}
+		rest, ok := strings.CutPrefix(text, d.code+" ")
+		if !ok {
+			return fmt.Errorf("replies: %s reply must start with %q", d.name, d.code+" ")
+		}
+		if kind == replyGreeting {
+			continue
+		}
+		if enhanced, _, _ := strings.Cut(rest, " "); !validEnhancedCode(enhanced, d.code[0]) {
+			return fmt.Errorf("replies: %s reply must have an enhanced status code %c.x.x", d.name, d.code[0])
+		}
+	}
+	return nil
+}
+
+// validEnhancedCode report whether s is an enhanced status code of
+// class (RFC 3463 section 2)
+func validEnhancedCode(s string, class byte) bool {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 || parts[0] != string(class) {
+		return false
+	}
+	for _, p := range parts[1:] {
+		if p == "" || len(p) > 3 || strings.Trim(p, "0123456789") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// replyText return the reply of kind with the hostname of s
+func (s *Session) replyText(kind int) string {
+	text := s.Config.Replies.get(kind)
+	if text == "" {
+		text = replyDefaults[kind].reply
+	}
+	return strings.ReplaceAll(text, "<host>", s.Hostname())
+}
@@ -0,0 +1,95 @@
+package session
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSessionReplies make sure that the greeting and QUIT replies
+// have the hostname and can be overridden
+func TestSessionReplies(t *testing.T) {
+	cases := []struct {
+		config   *Config
+		expected string
+	}{
+		{&Config{}, "220 localhost Maillennia ESMTP ready\r\n221 2.0.0 localhost OK bye\r\n"},
+		{&Config{Hostname: "mx.example.com"}, "220 mx.example.com Maillennia ESMTP ready\r\n221 2.0.0 mx.example.com OK bye\r\n"},
+		{&Config{Hostname: "mx.example.com", Replies: &Replies{
+			Greeting: "220 <host> ESMTP",
+			Quit:     "221 2.0.0 Closing connection",
+		}}, "220 mx.example.com ESMTP\r\n221 2.0.0 Closing connection\r\n"},
+		{&Config{Replies: &Replies{Shutdown: "421 4.3.2 Maintenance"}}, "220 localhost Maillennia ESMTP ready\r\n221 2.0.0 localhost OK bye\r\n"},
+	}
+
+	for _, input := range cases {
+		if out := runSession(t, input.config, "QUIT\r\n"); out != input.expected {
+			t.Errorf("got %q, expected %q", out, input.expected)
+		}
+	}
+}
+
+// TestServerShutdownReply make sure that idle sessions receive the
+// configured shutdown reply
+func TestServerShutdownReply(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(&Config{Hostname: "mx.example.com", Replies: &Replies{Shutdown: "421 4.3.2 <host> Maintenance, try later"}})
+	go srv.Serve(l)
+
+	idle := dialTestClient(t, l.Addr().String())
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+	idle.expect(t, "421 4.3.2 mx.example.com Maintenance, try later\r\n")
+}
+
+func TestRepliesCheck(t *testing.T) {
+	cases := []struct {
+		replies *Replies
+		err     string
+	}{
+		{nil, ""},
+		{&Replies{}, ""},
+		{&Replies{Greeting: "220 <host> ready", Quit: "221 2.0.0 bye", Shutdown: "421 4.3.2 down", NotAccepting: "453 4.3.2 busy"}, ""},
+		{&Replies{Greeting: "250 <host> ready"}, "greeting reply must start with \"220 \""},
+		{&Replies{Quit: "221 bye"}, "quit reply must have an enhanced status code 2.x.x"},
+		{&Replies{Shutdown: "421 5.3.2 down"}, "shutdown reply must have an enhanced status code 4.x.x"},
+		{&Replies{NotAccepting: "453 4.3.2x busy"}, "not accepting reply must have an enhanced status code"},
+		{&Replies{NotAccepting: "554 5.3.2 busy"}, "not accepting reply must start with \"453 \""},
+	}
+
+	for _, input := range cases {
+		err := input.replies.Check()
+		if input.err == "" && err != nil || input.err != "" && (err == nil || !strings.Contains(err.Error(), input.err)) {
+			t.Errorf("%+v: got %v, expected %q", input.replies, err, input.err)
+		}
+	}
+}
+
+// TestConfigFileReplies make sure that the replies table is checked
+// and set into Config
+func TestConfigFileReplies(t *testing.T) {
+	fc, err := ParseConfigFile([]byte("[replies]\nquit = \"221 2.0.0 <host> closing\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _, err := (&ConfigLoader{}).build(fc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Replies == nil || config.Replies.Quit != "221 2.0.0 <host> closing" {
+		t.Errorf("got %+v, expected the quit reply", config.Replies)
+	}
+
+	fc.Replies.Shutdown = "421 bye"
+	if _, _, err := (&ConfigLoader{}).build(fc); err == nil || !strings.Contains(err.Error(), "shutdown reply") {
+		t.Errorf("got %v, expected shutdown reply error", err)
+	}
+}
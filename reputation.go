@@ -0,0 +1,347 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaults of Reputation
+const (
+	defaultReputationHalfLife = 7 * 24 * time.Hour
+	defaultSpamThreshold      = 5
+	defaultReputationVolume   = 10
+
+	// NeutralReputation is the score of sender without history
+	NeutralReputation = 0.5
+)
+
+// ReputationStats represents rolling statistics of a source IP or
+// sender domain. counters decay exponentially since Updated
+type ReputationStats struct {
+	// Messages is the volume of accepted messages
+	Messages float64
+	// Recipients count every RCPT command, Bounces count the ones
+	// rejected permanently
+	Recipients float64
+	Bounces    float64
+	// SpamTotal is the sum of SpamCount spam scores
+	SpamTotal float64
+	SpamCount float64
+	Updated   time.Time
+}
+
+// BounceRate return the ratio of rejected recipients
+func (st *ReputationStats) BounceRate() float64 {
+	if st.Recipients == 0 {
+		return 0
+	}
+	return st.Bounces / st.Recipients
+}
+
+// SpamAverage return the average spam score
+func (st *ReputationStats) SpamAverage() float64 {
+	if st.SpamCount == 0 {
+		return 0
+	}
+	return st.SpamTotal / st.SpamCount
+}
+
+// decay age the counters to now, every halfLife halve them
+func (st *ReputationStats) decay(now time.Time, halfLife time.Duration) {
+	if !st.Updated.IsZero() && now.After(st.Updated) {
+		f := math.Pow(0.5, float64(now.Sub(st.Updated))/float64(halfLife))
+		st.Messages *= f
+		st.Recipients *= f
+		st.Bounces *= f
+		st.SpamTotal *= f
+		st.SpamCount *= f
+	}
+	st.Updated = now
+}
+
+// ReputationStore persist reputation statistics by key. Load
+// return nil without error for unknown key
+type ReputationStore interface {
+	Load(ctx context.Context, key string) (*ReputationStats, error)
+	Save(ctx context.Context, key string, st *ReputationStats) error
+}
+
+// MemoryReputationStore keep reputation statistics in memory
+type MemoryReputationStore struct {
+	mu    sync.Mutex
+	stats map[string]ReputationStats
+}
+
+// Load return a copy of statistics of key
+func (m *MemoryReputationStore) Load(ctx context.Context, key string) (*ReputationStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.stats[key]
+	if !ok {
+		return nil, nil
+	}
+	return &st, nil
+}
+
+// Save store a copy of st
+func (m *MemoryReputationStore) Save(ctx context.Context, key string, st *ReputationStats) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stats == nil {
+		m.stats = make(map[string]ReputationStats)
+	}
+	m.stats[key] = *st
+	return nil
+}
+
+// FileReputationStore keep reputation statistics in memory and
+// write them into a JSON file on every Save, so they survive
+// restarts. the file is read on first use
+type FileReputationStore struct {
+	Path string
+
+	mu     sync.Mutex
+	loaded bool
+	stats  map[string]ReputationStats
+}
+
+func (f *FileReputationStore) load() error {
+	if f.loaded {
+		return nil
+	}
+	f.stats = make(map[string]ReputationStats)
+	data, err := os.ReadFile(f.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &f.stats); err != nil {
+			return err
+		}
+	}
+	f.loaded = true
+	return nil
+}
+
+// Load return a copy of statistics of key
+func (f *FileReputationStore) Load(ctx context.Context, key string) (*ReputationStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	st, ok := f.stats[key]
+	if !ok {
+		return nil, nil
+	}
+	return &st, nil
+}
+
+// Save store a copy of st and rewrite the file atomically
+func (f *FileReputationStore) Save(ctx context.Context, key string, st *ReputationStats) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.load(); err != nil {
+		return err
+	}
+	f.stats[key] = *st
+	data, err := json.Marshal(f.stats)
+	if err != nil {
+		return err
+	}
+	return writeFile(f.Path, data)
+}
+
+// Reputation maintain statistics of source IPs and sender domains
+// and turn them into scores between 0 (bad) and 1 (good) for
+// policies
+type Reputation struct {
+	// Store default to MemoryReputationStore
+	Store ReputationStore
+	// HalfLife is the time after which old statistics weigh
+	// half, default to 7 days
+	HalfLife time.Duration
+	// SpamThreshold is the average spam score considered spam,
+	// default to 5
+	SpamThreshold float64
+	// Volume is the number of messages after which statistics
+	// weigh as much as the neutral score, default to 10
+	Volume float64
+
+	mu    sync.Mutex
+	local MemoryReputationStore
+}
+
+// reputation keys of IP and domain
+func ipReputationKey(ip string) string         { return "ip:" + ip }
+func domainReputationKey(domain string) string { return "domain:" + domain }
+
+func (r *Reputation) store() ReputationStore {
+	if r.Store == nil {
+		return &r.local
+	}
+	return r.Store
+}
+
+func (r *Reputation) halfLife() time.Duration {
+	if r.HalfLife <= 0 {
+		return defaultReputationHalfLife
+	}
+	return r.HalfLife
+}
+
+// update apply fn to decayed statistics of every non empty key
+func (r *Reputation) update(ctx context.Context, keys []string, fn func(st *ReputationStats)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		st, err := r.store().Load(ctx, key)
+		if err != nil {
+			return err
+		}
+		if st == nil {
+			st = &ReputationStats{}
+		}
+		st.decay(now, r.halfLife())
+		fn(st)
+		if err := r.store().Save(ctx, key, st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keys return reputation keys of ip and domain, empty ones
+// are skipped
+func reputationKeys(ip, domain string) []string {
+	var keys []string
+	if ip != "" {
+		keys = append(keys, ipReputationKey(ip))
+	}
+	if domain != "" {
+		keys = append(keys, domainReputationKey(domain))
+	}
+	return keys
+}
+
+// RecordMessage count an accepted message from ip and domain
+func (r *Reputation) RecordMessage(ctx context.Context, ip, domain string) error {
+	return r.update(ctx, reputationKeys(ip, domain), func(st *ReputationStats) {
+		st.Messages++
+	})
+}
+
+// RecordRecipient count a recipient from ip and domain, bounced
+// report whether it was rejected permanently
+func (r *Reputation) RecordRecipient(ctx context.Context, ip, domain string, bounced bool) error {
+	return r.update(ctx, reputationKeys(ip, domain), func(st *ReputationStats) {
+		st.Recipients++
+		if bounced {
+			st.Bounces++
+		}
+	})
+}
+
+// RecordSpamScore add a spam score of a message from ip and domain,
+// it is meant to be called by filters that scan messages
+func (r *Reputation) RecordSpamScore(ctx context.Context, ip, domain string, score float64) error {
+	return r.update(ctx, reputationKeys(ip, domain), func(st *ReputationStats) {
+		st.SpamTotal += score
+		st.SpamCount++
+	})
+}
+
+// Stats return decayed statistics of key, nil for unknown key
+func (r *Reputation) Stats(ctx context.Context, key string) (*ReputationStats, error) {
+	st, err := r.store().Load(ctx, key)
+	if err != nil || st == nil {
+		return nil, err
+	}
+	st.decay(time.Now(), r.halfLife())
+	return st, nil
+}
+
+// score turn statistics into a score, little volume keep the
+// score close to NeutralReputation
+func (r *Reputation) score(st *ReputationStats) float64 {
+	if st == nil {
+		return NeutralReputation
+	}
+	threshold := r.SpamThreshold
+	if threshold <= 0 {
+		threshold = defaultSpamThreshold
+	}
+	volume := r.Volume
+	if volume <= 0 {
+		volume = defaultReputationVolume
+	}
+
+	raw := (1 - st.BounceRate()) * (1 - math.Max(0, math.Min(st.SpamAverage()/threshold, 1)))
+	n := math.Max(st.Messages, st.Recipients)
+	w := n / (n + volume)
+	return w*raw + (1-w)*NeutralReputation
+}
+
+// Score return the reputation score of key, NeutralReputation
+// when key is unknown or the store fail
+func (r *Reputation) Score(ctx context.Context, key string) float64 {
+	st, err := r.Stats(ctx, key)
+	if err != nil {
+		return NeutralReputation
+	}
+	return r.score(st)
+}
+
+// IPScore return the reputation score of source IP
+func (r *Reputation) IPScore(ctx context.Context, ip string) float64 {
+	return r.Score(ctx, ipReputationKey(ip))
+}
+
+// DomainScore return the reputation score of sender domain
+func (r *Reputation) DomainScore(ctx context.Context, domain string) float64 {
+	return r.Score(ctx, domainReputationKey(domain))
+}
+
+// reputationSource return the source IP and sender domain of session
+func (s *Session) reputationSource(envl *Envelope) (ip, domain string) {
+	if remote := s.RemoteIP(); remote != nil {
+		ip = remote.String()
+	}
+	if envl != nil {
+		domain = domainOf(envl.OriginatorAddress)
+	}
+	return ip, domain
+}
+
+// recordRcpt update reputation with result of RCPT command
+func (s *Session) recordRcpt(envl *Envelope, err error) {
+	if s.Config.Reputation == nil {
+		return
+	}
+	e, ok := err.(*SMTPError)
+	bounced := ok && e.Code >= 500
+	ip, domain := s.reputationSource(envl)
+	if err := s.Config.Reputation.RecordRecipient(context.Background(), ip, domain, bounced); err != nil {
+		s.logf(LevelWarn, "reputation: %v", err)
+	}
+}
+
+// recordMessage update reputation with accepted message
+func (s *Session) recordMessage(envl *Envelope, err error) {
+	if s.Config.Reputation == nil || err != nil {
+		return
+	}
+	ip, domain := s.reputationSource(envl)
+	if err := s.Config.Reputation.RecordMessage(context.Background(), ip, domain); err != nil {
+		s.logf(LevelWarn, "reputation: %v", err)
+	}
+}
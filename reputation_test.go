@@ -0,0 +1,112 @@
+package session
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReputationDecay make sure that counters halve every half life
+func TestReputationDecay(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		age      time.Duration
+		expected float64
+	}{
+		{0, 8},
+		{time.Hour, 4},
+		{3 * time.Hour, 1},
+	}
+
+	for _, input := range cases {
+		st := &ReputationStats{Messages: 8, Updated: now.Add(-input.age)}
+		st.decay(now, time.Hour)
+		if math.Abs(st.Messages-input.expected) > 1e-9 {
+			t.Errorf("age %v: got %v, expected %v", input.age, st.Messages, input.expected)
+		}
+	}
+}
+
+// TestReputationScore make sure that bounces and spam lower the score
+// and unknown senders are neutral
+func TestReputationScore(t *testing.T) {
+	ctx := context.Background()
+	r := &Reputation{Volume: 1}
+
+	for i := 0; i < 20; i++ {
+		r.RecordRecipient(ctx, "192.0.2.1", "good.com", false)
+		r.RecordMessage(ctx, "192.0.2.1", "good.com")
+		r.RecordRecipient(ctx, "192.0.2.2", "bounce.com", true)
+		r.RecordMessage(ctx, "192.0.2.3", "spam.com")
+		r.RecordSpamScore(ctx, "192.0.2.3", "spam.com", 10)
+	}
+
+	cases := []struct {
+		score    float64
+		min, max float64
+	}{
+		{r.IPScore(ctx, "192.0.2.1"), 0.9, 1},
+		{r.DomainScore(ctx, "good.com"), 0.9, 1},
+		{r.IPScore(ctx, "192.0.2.2"), 0, 0.1},
+		{r.DomainScore(ctx, "spam.com"), 0, 0.1},
+		{r.IPScore(ctx, "192.0.2.99"), NeutralReputation, NeutralReputation},
+	}
+
+	for i, input := range cases {
+		if input.score < input.min || input.score > input.max {
+			t.Errorf("%d: got score %v, expected between %v and %v", i, input.score, input.min, input.max)
+		}
+	}
+}
+
+// TestFileReputationStore make sure that statistics survive a new store
+func TestFileReputationStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "reputation.json")
+
+	r := &Reputation{Store: &FileReputationStore{Path: path}}
+	r.RecordRecipient(ctx, "192.0.2.1", "example.com", true)
+
+	r = &Reputation{Store: &FileReputationStore{Path: path}}
+	st, err := r.Stats(ctx, domainReputationKey("example.com"))
+	if err != nil || st == nil {
+		t.Fatalf("got %v %v, expected stored statistics", st, err)
+	}
+	if math.Abs(st.Bounces-1) > 1e-6 || math.Abs(st.Recipients-1) > 1e-6 {
+		t.Errorf("got %+v, expected 1 bounced recipient", st)
+	}
+}
+
+// TestSessionReputation make sure that rejected recipients are recorded
+// and policies receive the scores
+func TestSessionReputation(t *testing.T) {
+	var got []float64
+	rep := &Reputation{Volume: 1}
+	config := &Config{
+		Reputation: rep,
+		Policies: []Policy{PolicyFunc(func(ctx context.Context, req *PolicyRequest) error {
+			if req.Stage != StageRcpt {
+				return nil
+			}
+			got = append(got, req.IPReputation)
+			if strings.HasPrefix(req.Recipient, "unknown") {
+				return NewSMTPError(550, [3]int{5, 1, 1}, "unknown user")
+			}
+			return nil
+		})},
+	}
+
+	runSessionFrom(t, config, "192.0.2.1:2525", "HELO client.com\r\nMAIL FROM:<some@example.com>\r\n"+
+		"RCPT TO:<unknown1@domain.com>\r\nRCPT TO:<unknown2@domain.com>\r\nRCPT TO:<ok@domain.com>\r\nQUIT\r\n")
+
+	if len(got) != 3 || got[0] != NeutralReputation || got[2] >= got[0] {
+		t.Errorf("got scores %v, expected neutral score lowered by bounces", got)
+	}
+	st, _ := rep.Stats(context.Background(), domainReputationKey("example.com"))
+	if st == nil || math.Round(st.Recipients) != 3 || math.Round(st.Bounces) != 2 {
+		t.Errorf("got %+v, expected 3 recipients and 2 bounces", st)
+	}
+}
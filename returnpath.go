@@ -0,0 +1,100 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// defaultBounceLocal is the local part of rewritten return paths
+const defaultBounceLocal = "bounces"
+
+// ReturnPath rewrite the envelope sender of a tenant to its bounce
+// domain, "bounces+tag=local=domain@bounce.tenant.com". the original
+// sender is kept VERP-style so bounces route back to the tenant, and
+// tag sign it like BATV so forged bounces can be told apart
+type ReturnPath struct {
+	// Domain is the bounce domain of the tenant
+	Domain string
+	// Local is the local part before the token, default to bounces
+	Local string
+	// Key sign the token, without key the tag is omitted
+	Key []byte
+}
+
+// local return the configured local part
+func (rp *ReturnPath) local() string {
+	if rp.Local == "" {
+		return defaultBounceLocal
+	}
+	return rp.Local
+}
+
+// tag return the signature of sender, empty without Key
+func (rp *ReturnPath) tag(sender string) string {
+	if len(rp.Key) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, rp.Key)
+	mac.Write([]byte(strings.ToLower(sender)))
+	return hex.EncodeToString(mac.Sum(nil))[:10]
+}
+
+// Rewrite return the return path of sender, the null sender and
+// addresses without domain are returned as is
+func (rp *ReturnPath) Rewrite(sender string) string {
+	i := strings.LastIndex(sender, "@")
+	if i <= 0 {
+		return sender
+	}
+	token := sender[:i] + "=" + sender[i+1:]
+	if tag := rp.tag(sender); tag != "" {
+		token = tag + "=" + token
+	}
+	return rp.local() + "+" + token + "@" + rp.Domain
+}
+
+// Original return the original sender of a rewritten return path,
+// e.g. the recipient of a bounce. false when addr is not a return
+// path of the tenant or the tag doesn't match
+func (rp *ReturnPath) Original(addr string) (string, bool) {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 || !strings.EqualFold(addr[i+1:], rp.Domain) {
+		return "", false
+	}
+	local, token, ok := strings.Cut(addr[:i], "+")
+	if !ok || !strings.EqualFold(local, rp.local()) {
+		return "", false
+	}
+	tag := ""
+	if len(rp.Key) > 0 {
+		tag, token, ok = strings.Cut(token, "=")
+		if !ok {
+			return "", false
+		}
+	}
+	j := strings.LastIndex(token, "=")
+	if j <= 0 || j == len(token)-1 {
+		return "", false
+	}
+	sender := token[:j] + "@" + token[j+1:]
+	if !hmac.Equal([]byte(tag), []byte(rp.tag(sender))) {
+		return "", false
+	}
+	return sender, true
+}
+
+// rewriteReturnPath replace the envelope sender of authenticated
+// client with the return path of its tenant
+func (s *Session) rewriteReturnPath(envl *Envelope) {
+	if s.Principal == nil || envl.OriginatorAddress == "" {
+		return
+	}
+	rp := s.Config.ReturnPath[s.Principal.Tenant]
+	if rp == nil {
+		return
+	}
+	envl.OriginalSender = envl.OriginatorAddress
+	envl.OriginatorAddress = rp.Rewrite(envl.OriginatorAddress)
+}
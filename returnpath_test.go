@@ -0,0 +1,100 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestReturnPath make sure that senders are rewritten to the bounce
+// domain and the original sender is recovered from valid tokens only
+func TestReturnPath(t *testing.T) {
+	signed := &ReturnPath{Domain: "bounce.tenant.com", Key: []byte("key")}
+	plain := &ReturnPath{Domain: "bounce.tenant.com", Local: "rp"}
+
+	cases := []struct {
+		rp       *ReturnPath
+		sender   string
+		expected string
+	}{
+		{plain, "user@example.com", "rp+user=example.com@bounce.tenant.com"},
+		{plain, "a=b+c@example.com", "rp+a=b+c=example.com@bounce.tenant.com"},
+		{plain, "", ""},
+		{signed, "user@example.com", "bounces+" + signed.tag("user@example.com") + "=user=example.com@bounce.tenant.com"},
+	}
+
+	for _, input := range cases {
+		got := input.rp.Rewrite(input.sender)
+		if got != input.expected {
+			t.Errorf("%q: got %q, expected %q", input.sender, got, input.expected)
+		}
+		if input.sender == "" {
+			continue
+		}
+		original, ok := input.rp.Original(got)
+		if !ok || original != input.sender {
+			t.Errorf("%q: got original %q %v, expected %q", got, original, ok, input.sender)
+		}
+	}
+
+	invalid := []string{
+		"bounces+0000000000=user=example.com@bounce.tenant.com",
+		"bounces+user=example.com@bounce.tenant.com",
+		"other+" + signed.tag("user@example.com") + "=user=example.com@bounce.tenant.com",
+		"bounces+" + signed.tag("user@example.com") + "=user=example.com@other.com",
+		"user@example.com",
+	}
+	for _, addr := range invalid {
+		if original, ok := signed.Original(addr); ok {
+			t.Errorf("%q: got original %q, expected invalid", addr, original)
+		}
+	}
+}
+
+// TestSessionReturnPath make sure that the envelope sender of
+// authenticated clients is rewritten per tenant
+func TestSessionReturnPath(t *testing.T) {
+	auth := "AUTH PLAIN " + plainResponse("user", "secret") + "\r\n"
+	data := "RCPT TO:<some@domain.com>\r\nDATA\r\nSubject: a\r\n\r\n.\r\nQUIT\r\n"
+
+	cases := []struct {
+		auth     bool
+		sender   string
+		expected string
+		original string
+	}{
+		{true, "user@example.com", "bounces+user=example.com@bounce.tenant.com", "user@example.com"},
+		{false, "user@example.com", "user@example.com", ""},
+	}
+
+	for _, input := range cases {
+		var envl *Envelope
+		var sender string
+		config := &Config{
+			Authenticator:      testAuthenticator,
+			AuthAllowPlaintext: true,
+			ReturnPath:         map[string]*ReturnPath{"tenant": {Domain: "bounce.tenant.com"}},
+			Backend: BackendFunc(func(e *Envelope, data []byte) error {
+				envl = e
+				return nil
+			}),
+			Tracker: TrackerFunc(func(ev *TrackingEvent) {
+				sender = ev.Sender
+			}),
+		}
+		session := "EHLO client.com\r\n"
+		if input.auth {
+			session += auth
+		}
+		out := runSession(t, config, session+"MAIL FROM:<"+input.sender+">\r\n"+data)
+		if !strings.Contains(out, "250 2.0.0 OK: queued as ") || envl == nil {
+			t.Errorf("%q: got %q, expected message accepted", input.sender, out)
+			continue
+		}
+		if envl.OriginatorAddress != input.expected || envl.OriginalSender != input.original {
+			t.Errorf("%q: got %q %q, expected %q %q", input.sender, envl.OriginatorAddress, envl.OriginalSender, input.expected, input.original)
+		}
+		if sender != input.sender {
+			t.Errorf("%q: got tracked sender %q", input.sender, sender)
+		}
+	}
+}
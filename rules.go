@@ -0,0 +1,253 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// rule actions
+const (
+	RuleAccept = "accept"
+	RuleReject = "reject"
+	RuleDefer  = "defer"
+	RuleTag    = "tag"
+)
+
+// Rule match the state of session and map it to an action. empty
+// matchers match everything. Helo, Sender and Recipient are
+// case-insensitive patterns of path.Match like "*@example.com"
+type Rule struct {
+	// Stage limit the rule to one stage
+	Stage Stage
+	// Client match the client IP address
+	Client *AccessList
+	Helo   string
+	Sender string
+	// Recipient match the recipient at StageRcpt and any
+	// recipient at StageData
+	Recipient string
+	// Auth and TLS match whether the client is authenticated and
+	// whether the connection is encrypted, "yes" or "no"
+	Auth string
+	TLS  string
+
+	// Action is RuleAccept, RuleReject, RuleDefer or RuleTag
+	Action string
+	// Code, Enhanced and Message override the reply of reject
+	// and defer
+	Code     int
+	Enhanced string
+	Message  string
+	// Tag is added to Envelope.Tags by RuleTag
+	Tag string
+}
+
+// matchPattern report whether s match the pattern case-insensitively
+func matchPattern(pattern, s string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(s))
+	return ok
+}
+
+// matchFlag report whether on match "yes" or "no"
+func matchFlag(flag string, on bool) bool {
+	return flag == "" || (flag == "yes") == on
+}
+
+// Match report whether the rule match req
+func (r *Rule) Match(req *PolicyRequest) bool {
+	s := req.Session
+	if r.Stage != "" && r.Stage != req.Stage {
+		return false
+	}
+	if r.Client != nil && !r.Client.MatchIP(s.RemoteIP()) {
+		return false
+	}
+	if r.Helo != "" && !matchPattern(r.Helo, s.HeloName) {
+		return false
+	}
+	if r.Sender != "" && (req.Envelope == nil || !matchPattern(r.Sender, req.Envelope.OriginatorAddress)) {
+		return false
+	}
+	if r.Recipient != "" {
+		rcpts := []string{req.Recipient}
+		if req.Stage == StageData && req.Envelope != nil {
+			rcpts = req.Envelope.RecipientAddress
+		}
+		found := false
+		for _, rcpt := range rcpts {
+			if rcpt != "" && matchPattern(r.Recipient, rcpt) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return matchFlag(r.Auth, s.Principal != nil) && matchFlag(r.TLS, req.TLS != nil)
+}
+
+// hasTag report whether tags contain tag
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules is a table of rules evaluated in order. the first matching
+// accept, reject or defer rule end the evaluation while tag rules
+// tag the envelope once and continue. no match accept
+type Rules []*Rule
+
+// Check implements Policy
+func (rules Rules) Check(ctx context.Context, req *PolicyRequest) error {
+	for _, r := range rules {
+		if !r.Match(req) {
+			continue
+		}
+		switch r.Action {
+		case RuleTag:
+			if req.Envelope != nil && !hasTag(req.Envelope.Tags, r.Tag) {
+				req.Envelope.Tags = append(req.Envelope.Tags, r.Tag)
+			}
+		case RuleDefer:
+			v := &Verdict{Action: "tempfail", Code: r.Code, Enhanced: r.Enhanced, Message: r.Message}
+			return v.Err()
+		default:
+			v := &Verdict{Action: r.Action, Code: r.Code, Enhanced: r.Enhanced, Message: r.Message}
+			return v.Err()
+		}
+	}
+	return nil
+}
+
+// ParseRules read one rule per line, text after "#" is comment.
+// a rule is a list of key=value matchers followed by the action
+//
+//	stage=rcpt client=192.0.2.0/24 auth=no reject 550 5.7.1 Relaying denied
+//	sender=*@example.com tls=no defer Encryption required
+//	helo=*.dynamic.example.net tag dynamic
+//	client=10.0.0.0/8 accept
+//
+// matchers are stage, client (comma separated networks), helo,
+// sender, recipient, auth and tls. reject and defer take an optional
+// code, enhanced code and message, tag take the tag name
+func ParseRules(r io.Reader) (Rules, error) {
+	var rules Rules
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("rules: line %d: %v", n, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// parseRule parse a single rule line
+func parseRule(line string) (*Rule, error) {
+	r := &Rule{}
+	fields := strings.Fields(line)
+	i := 0
+	for ; i < len(fields) && strings.Contains(fields[i], "="); i++ {
+		kv := strings.SplitN(fields[i], "=", 2)
+		key, value := strings.ToLower(kv[0]), kv[1]
+		switch key {
+		case "stage":
+			switch Stage(strings.ToLower(value)) {
+			case StageConnect, StageMail, StageRcpt, StageData:
+				r.Stage = Stage(strings.ToLower(value))
+			default:
+				return nil, fmt.Errorf("unknown stage %q", value)
+			}
+		case "client":
+			l, err := ParseAccessList(strings.Split(value, ","))
+			if err != nil {
+				return nil, err
+			}
+			r.Client = l
+		case "helo":
+			r.Helo = value
+		case "sender":
+			r.Sender = value
+		case "recipient":
+			r.Recipient = value
+		case "auth", "tls":
+			value = strings.ToLower(value)
+			if value != "yes" && value != "no" {
+				return nil, fmt.Errorf("%s must be yes or no", key)
+			}
+			if key == "auth" {
+				r.Auth = value
+			} else {
+				r.TLS = value
+			}
+		default:
+			return nil, fmt.Errorf("unknown matcher %q", key)
+		}
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", value)
+		}
+	}
+	if i == len(fields) {
+		return nil, fmt.Errorf("missing action")
+	}
+
+	r.Action = strings.ToLower(fields[i])
+	args := fields[i+1:]
+	switch r.Action {
+	case RuleAccept:
+		if len(args) > 0 {
+			return nil, fmt.Errorf("unexpected %q after accept", args[0])
+		}
+	case RuleTag:
+		if len(args) != 1 {
+			return nil, fmt.Errorf("tag take one name")
+		}
+		r.Tag = args[0]
+	case RuleReject, RuleDefer:
+		class := 5
+		if r.Action == RuleDefer {
+			class = 4
+		}
+		if len(args) > 0 {
+			if code, err := strconv.Atoi(args[0]); err == nil {
+				if code/100 != class {
+					return nil, fmt.Errorf("invalid %s code %d", r.Action, code)
+				}
+				r.Code, args = code, args[1:]
+			}
+		}
+		if len(args) > 0 {
+			if e, ok := parseEnhanced(args[0]); ok {
+				if e[0] != class {
+					return nil, fmt.Errorf("invalid %s enhanced code %s", r.Action, args[0])
+				}
+				r.Enhanced, args = args[0], args[1:]
+			}
+		}
+		r.Message = strings.Join(args, " ")
+	default:
+		return nil, fmt.Errorf("unknown action %q", r.Action)
+	}
+	return r, nil
+}
@@ -0,0 +1,93 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestParseRules make sure that matchers and actions are parsed
+// and invalid rules are rejected
+func TestParseRules(t *testing.T) {
+	cases := []struct {
+		line  string
+		valid bool
+	}{
+		{"stage=rcpt client=192.0.2.0/24,10.0.0.1 auth=no reject 550 5.7.1 Relaying denied", true},
+		{"sender=*@example.com tls=no defer Encryption required", true},
+		{"helo=*.dynamic.example.net tag dynamic", true},
+		{"accept", true},
+		{"reject", true},
+		{"stage=helo accept", false},
+		{"client=bad/99 accept", false},
+		{"auth=maybe accept", false},
+		{"color=red accept", false},
+		{"sender=[a accept", false},
+		{"sender=*@example.com", false},
+		{"reject 450 Not now", false},
+		{"defer 550 Now", false},
+		{"defer 5.7.1 Now", false},
+		{"tag", false},
+		{"accept now", false},
+		{"discard", false},
+	}
+
+	for _, input := range cases {
+		_, err := ParseRules(strings.NewReader(input.line))
+		if (err == nil) != input.valid {
+			t.Errorf("%q: got error %v, expected valid=%t", input.line, err, input.valid)
+		}
+	}
+}
+
+// TestSessionRules make sure that the first matching rule decide
+// and tag rules tag the envelope
+func TestSessionRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+# local clients may send anything
+client=10.0.0.0/8 accept
+helo=*.dynamic.example.net stage=mail reject 554 5.7.1 Dynamic hosts not accepted
+sender=*@example.com tag partner
+stage=rcpt recipient=postmaster@* accept
+stage=rcpt recipient=*@closed.example.com defer 451 4.2.1 Mailbox closed
+stage=rcpt tls=no sender=*@secure.example.com reject Encryption required
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tags []string
+	config := &Config{
+		Policies: []Policy{rules},
+		Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			tags = envl.Tags
+			return nil
+		}),
+	}
+
+	cases := []struct {
+		remote   string
+		helo     string
+		from, to string
+		expected string
+		tags     string
+	}{
+		{"10.1.2.3:25", "host.dynamic.example.net", "a@secure.example.com", "b@closed.example.com", "250 2.0.0", ""},
+		{"192.0.2.1:25", "host.dynamic.example.net", "a@example.org", "b@example.org", "554 5.7.1 Dynamic hosts not accepted", ""},
+		{"192.0.2.1:25", "mx.example.org", "a@example.com", "b@example.org", "250 2.0.0", "partner"},
+		{"192.0.2.1:25", "mx.example.org", "a@example.org", "b@closed.example.com", "451 4.2.1 Mailbox closed", ""},
+		{"192.0.2.1:25", "mx.example.org", "a@secure.example.com", "b@example.org", "550 5.7.1 Encryption required", ""},
+		{"192.0.2.1:25", "mx.example.org", "a@secure.example.com", "postmaster@example.org", "250 2.0.0", ""},
+	}
+
+	for _, input := range cases {
+		tags = nil
+		out := runSessionFrom(t, config, input.remote, "HELO "+input.helo+"\r\nMAIL FROM:<"+input.from+">\r\nRCPT TO:<"+input.to+">\r\n"+
+			"DATA\r\nSubject: hi\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("%s %s %s => %s: got %q, expected %q", input.remote, input.helo, input.from, input.to, out, input.expected)
+		}
+		if strings.Join(tags, ",") != input.tags {
+			t.Errorf("%s => %s: got tags %v, expected %q", input.from, input.to, tags, input.tags)
+		}
+	}
+}
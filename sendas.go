@@ -0,0 +1,103 @@
+package session
+
+import (
+	"bytes"
+	"net/mail"
+	"path"
+	"strings"
+)
+
+// send-as error replies
+var (
+	headerFromErr = NewSMTPError(553, [3]int{5, 7, 1}, "From: header address not permitted for user")
+)
+
+// SenderAuthorization grant authenticated users the use of sender
+// addresses they don't own, e.g. a shared mailbox or a domain
+type SenderAuthorization interface {
+	// AuthorizeSender report whether p may send as addr
+	AuthorizeSender(p *Principal, addr string) (bool, error)
+}
+
+// AuthorizeSender call f(p, addr), owned addresses are authorized
+func (f SenderOwnerFunc) AuthorizeSender(p *Principal, addr string) (bool, error) {
+	return f(p, addr), nil
+}
+
+// SenderGrants is the send-as patterns of each username. a pattern is
+// an address, "@example.com" for any address of the domain, or
+// a wildcard like "*@*.example.com", "sales-*@example.com" or "*"
+type SenderGrants map[string][]string
+
+// AuthorizeSender report whether a pattern of the user match addr
+func (g SenderGrants) AuthorizeSender(p *Principal, addr string) (bool, error) {
+	addr = strings.ToLower(addr)
+	for _, pattern := range g[p.Username] {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "@") {
+			pattern = "*" + pattern
+		}
+		if ok, _ := path.Match(pattern, addr); ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// authorizeSender check that the authenticated user owns or is granted
+// addr, without SenderOwner and SenderAuthorization every address
+// is allowed
+func (s *Session) authorizeSender(addr string) error {
+	checks := []SenderAuthorization{}
+	if s.Config.SenderOwner != nil {
+		checks = append(checks, s.Config.SenderOwner)
+	}
+	if s.Config.SenderAuthorization != nil {
+		checks = append(checks, s.Config.SenderAuthorization)
+	}
+	if len(checks) == 0 {
+		return nil
+	}
+	for _, check := range checks {
+		ok, err := check.AuthorizeSender(s.Principal, addr)
+		if err != nil {
+			s.logf(LevelWarn, "sender authorization: %v", err)
+			return localErr
+		}
+		if ok {
+			return nil
+		}
+	}
+	s.logf(LevelInfo, "%s not permitted for %s", addr, s.Principal.Credential())
+	return senderOwnerErr
+}
+
+// checkHeaderFrom check that every From: header address of submitted
+// message is permitted for the user when AuthorizeHeaderFrom is set.
+// message with more than one From: field is rejected (RFC 5322
+// section 3.6), its other fields would never be checked
+func (s *Session) checkHeaderFrom(data []byte) error {
+	if !s.submission() || !s.Config.AuthorizeHeaderFrom || s.Principal == nil {
+		return nil
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return headerFromErr
+	}
+	if len(msg.Header["From"]) != 1 {
+		return headerFromErr
+	}
+	addrs, err := msg.Header.AddressList("From")
+	if err != nil || len(addrs) == 0 {
+		return headerFromErr
+	}
+	for _, a := range addrs {
+		if err := s.authorizeSender(a.Address); err != nil {
+			if err == senderOwnerErr {
+				return headerFromErr
+			}
+			return err
+		}
+	}
+	return nil
+}
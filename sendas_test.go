@@ -0,0 +1,77 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestSenderGrants make sure that address, domain and wildcard grants
+// match the sender
+func TestSenderGrants(t *testing.T) {
+	grants := SenderGrants{
+		"user": {"Shared@example.com", "@example.org", "sales-*@example.net", "*@*.example.io"},
+		"root": {"*"},
+	}
+
+	cases := []struct {
+		username string
+		addr     string
+		expected bool
+	}{
+		{"user", "shared@example.com", true},
+		{"user", "other@example.com", false},
+		{"user", "any@EXAMPLE.org", true},
+		{"user", "any@sub.example.org", false},
+		{"user", "sales-eu@example.net", true},
+		{"user", "support@example.net", false},
+		{"user", "a@mail.example.io", true},
+		{"root", "anyone@anywhere.com", true},
+		{"nobody", "shared@example.com", false},
+	}
+
+	for _, input := range cases {
+		got, _ := grants.AuthorizeSender(&Principal{Username: input.username}, input.addr)
+		if got != input.expected {
+			t.Errorf("%s as %s: got %v, expected %v", input.username, input.addr, got, input.expected)
+		}
+	}
+}
+
+// TestSessionSendAs make sure that the user may use owned and granted
+// addresses in MAIL FROM and From: header
+func TestSessionSendAs(t *testing.T) {
+	auth := "AUTH PLAIN " + plainResponse("user", "secret") + "\r\n"
+	data := "RCPT TO:<some@domain.com>\r\nDATA\r\nFrom: %s\r\nSubject: a\r\n\r\n.\r\n"
+
+	cases := []struct {
+		sender   string
+		from     string
+		expected string
+	}{
+		{"user@example.com", "User <user@example.com>", "354 Go ahead\r\n250 2.0.0 OK"},
+		{"shared@example.com", "shared@example.com", "354 Go ahead\r\n250 2.0.0 OK"},
+		{"other@example.com", "other@example.com", "553 5.7.1 Sender address rejected: not permitted for user"},
+		{"user@example.com", "CEO <ceo@example.com>", "553 5.7.1 From: header address not permitted for user"},
+		{"user@example.com", "user@example.com, ceo@example.com", "553 5.7.1 From: header"},
+		{"user@example.com", "user@example.com\r\nFrom: ceo@example.com", "553 5.7.1 From: header"},
+		{"user@example.com", "user@example.com\r\nfrom: user@example.com", "553 5.7.1 From: header"},
+	}
+
+	for _, input := range cases {
+		config := &Config{
+			Mode:                ModeMSA,
+			TLSTerminated:       true,
+			Authenticator:       testAuthenticator,
+			AuthorizeHeaderFrom: true,
+			SenderOwner: func(p *Principal, sender string) bool {
+				return sender == p.Username+"@example.com"
+			},
+			SenderAuthorization: SenderGrants{"user": {"shared@example.com"}},
+		}
+		out := runSession(t, config, "EHLO client.com\r\n"+auth+"MAIL FROM:<"+input.sender+">\r\n"+
+			strings.Replace(data, "%s", input.from, 1)+"QUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("%s %q: got %q, expected %q", input.sender, input.from, out, input.expected)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package session
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Server.Serve after Shutdown
+var ErrServerClosed = errors.New("session: Server closed")
+
+// tooManyConnErr is sent when connection limit exceeded
+var tooManyConnErr = NewSMTPError(421, [3]int{4, 3, 2}, "Too many connections")
+
+// Server accept connections and serve each of them in a session
+type Server struct {
+	Config *Config
+
+	mu        sync.Mutex
+	closing   bool
+	listeners map[net.Listener]struct{}
+	sessions  map[*Session]struct{}
+	perIP     map[string]int
+	// perListener is the number of sessions of each Listener
+	perListener map[*Listener]int
+	wg          sync.WaitGroup
+	// paused reject new connections, serial number the sessions
+	paused bool
+	serial uint64
+
+	// pool hand sessions to idle workers of Config.SessionWorkers,
+	// poolWorkers is the number of workers, poolStop stop them
+	pool        chan *Session
+	poolWorkers int
+	poolStop    chan struct{}
+
+	// hooks of Shutdown stages and workers stopped at
+	// ShutdownDelivery
+	hooks       map[ShutdownStage][]shutdownHook
+	workerCtx   context.Context
+	stopWorkers context.CancelFunc
+	workers     sync.WaitGroup
+}
+
+// NewServer create a new server, every session use the config
+func NewServer(config *Config) *Server {
+	if config == nil {
+		config = &Config{}
+	}
+	if config.WarmUp != nil {
+		config.WarmUp.Start(time.Now())
+	}
+	return &Server{
+		Config:      config,
+		listeners:   make(map[net.Listener]struct{}),
+		sessions:    make(map[*Session]struct{}),
+		perIP:       make(map[string]int),
+		perListener: make(map[*Listener]int),
+		pool:        make(chan *Session),
+		poolStop:    make(chan struct{}),
+	}
+}
+
+// SetConfig replace the config of new sessions, live sessions keep
+// the config they started with
+func (srv *Server) SetConfig(config *Config) {
+	srv.mu.Lock()
+	srv.Config = config
+	srv.mu.Unlock()
+}
+
+// config return the config of new sessions
+func (srv *Server) config() *Config {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.Config
+}
+
+// ListenAndServe listen on TCP network address addr and serve
+// incoming connections. addr without host like ":25" or with the
+// unspecified address "[::]:25" listen on a dual-stack socket
+// accepting IPv4 and IPv6 clients
+func (srv *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+// Serve accept incoming connections on the listener l and serve
+// each of them in a new session. Serve always return non-nil error,
+// after Shutdown the returned error is ErrServerClosed
+func (srv *Server) Serve(l net.Listener) error {
+	return srv.serve(l, nil, nil)
+}
+
+// ListenAndServeTLS listen on the TCP network address addr for
+// implicit TLS (SMTPS, port 465, RFC 8314), see ServeTLS
+func (srv *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.ServeTLS(l, certFile, keyFile)
+}
+
+// ServeTLS is like Serve with implicit TLS: the TLS handshake happen
+// before the 220 greeting. the certificate is loaded from certFile
+// and keyFile, or taken from Config.TLSConfig when they are empty
+func (srv *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config := &tls.Config{}
+	if c := srv.config().TLSConfig; c != nil {
+		config = c.Clone()
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		l.Close()
+		return errNoCertificate
+	}
+	return srv.serve(l, nil, config)
+}
+
+// serve accept connections of l with the config of ln, with implicit
+// TLS when config is set
+func (srv *Server) serve(l net.Listener, ln *Listener, config *tls.Config) error {
+	srv.mu.Lock()
+	if srv.closing {
+		srv.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	srv.listeners[l] = struct{}{}
+	srv.mu.Unlock()
+
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.listeners, l)
+		srv.mu.Unlock()
+		l.Close()
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if srv.isClosing() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// back off on accept errors, e.g. EMFILE when the
+			// process is out of file descriptors
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			srv.logf(LevelWarn, "accept: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		srv.serveConn(conn, ln, config)
+	}
+}
+
+// Handler serve a SMTP session on a connection, it is the SMTP
+// analogue of http.Handler
+type Handler interface {
+	ServeSMTP(ctx context.Context, conn net.Conn)
+}
+
+// serveConn serve the connection in a new tracked session. the
+// connection is rejected when connection limit exceeded
+func (srv *Server) serveConn(conn net.Conn, ln *Listener, config *tls.Config) {
+	s := srv.track(conn, ln)
+	if s == nil {
+		return
+	}
+	s.implicitTLS = config
+	if n := s.Config.SessionWorkers; n > 0 {
+		srv.dispatch(s, n)
+		return
+	}
+	go srv.run(s)
+}
+
+// dispatch hand s to an idle worker or to a new one when there are
+// less than max workers, otherwise s is rejected with 421
+func (srv *Server) dispatch(s *Session, max int) {
+	select {
+	case srv.pool <- s:
+		return
+	default:
+	}
+
+	srv.mu.Lock()
+	start := srv.poolWorkers < max
+	if start {
+		srv.poolWorkers++
+	}
+	srv.mu.Unlock()
+	if start {
+		go srv.worker(s)
+		return
+	}
+
+	srv.untrack(s, remoteIP(s.Conn))
+	s.logf(LevelWarn, "every session worker is busy")
+	go func() {
+		s.Reply.TransmitErr(tooManyConnErr)
+		s.Close()
+	}()
+}
+
+// worker serve s then the sessions handed by dispatch until the
+// listeners are closed
+func (srv *Server) worker(s *Session) {
+	defer func() {
+		srv.mu.Lock()
+		srv.poolWorkers--
+		srv.mu.Unlock()
+	}()
+	for {
+		srv.run(s)
+		select {
+		case s = <-srv.pool:
+		case <-srv.poolStop:
+			return
+		}
+	}
+}
+
+// ServeSMTP serve conn in a tracked session and return when the
+// session end. conn may come from anywhere: custom tunnels, QUIC
+// streams, net.Pipe in tests, see StreamConn. the session is
+// subject to connection limits and Shutdown like sessions of
+// listeners, and it is drained when ctx is done
+func (srv *Server) ServeSMTP(ctx context.Context, conn net.Conn) {
+	s := srv.track(conn, nil)
+	if s == nil {
+		return
+	}
+	stop := context.AfterFunc(ctx, s.drain)
+	defer stop()
+	srv.run(s)
+}
+
+// track create a session of conn accepted by ln and add it into the
+// served sessions, nil is returned when conn is rejected
+func (srv *Server) track(conn net.Conn, ln *Listener) *Session {
+	config := srv.listenerConfig(ln)
+	if config.Recorder.active(time.Now()) {
+		conn = config.Recorder.wrap(conn, config.Logger)
+	}
+	conn = &countConn{Conn: conn}
+	s := newSession(conn, &srv.wg, nil, config.BufferSize)
+	s.Config = config
+	s.raw, s.started = conn, time.Now()
+	ip := remoteIP(conn)
+
+	srv.mu.Lock()
+	if srv.closing {
+		srv.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+	// a listener with its own config limit its own sessions
+	sessions := len(srv.sessions)
+	if ln != nil && config == ln.Config {
+		sessions = srv.perListener[ln]
+	}
+	ok, overloaded := srv.admit(config, ip, sessions)
+	if !ok || srv.paused {
+		srv.mu.Unlock()
+		err := tooManyConnErr
+		if srv.paused {
+			err = pausedErr
+		}
+		go func() {
+			s.Reply.TransmitErr(err)
+			conn.Close()
+			s.releaseBuffers()
+		}()
+		return nil
+	}
+	srv.serial++
+	s.serial = srv.serial
+	s.overloaded = overloaded
+	s.listener = ln
+	srv.sessions[s] = struct{}{}
+	srv.perIP[ip]++
+	if ln != nil {
+		srv.perListener[ln]++
+	}
+	srv.wg.Add(1)
+	srv.mu.Unlock()
+	return s
+}
+
+// run serve the tracked session and remove it when done
+func (srv *Server) run(s *Session) {
+	defer srv.untrack(s, remoteIP(s.Conn))
+	s.Serve()
+}
+
+// untrack remove the session of ip from the served sessions
+func (srv *Server) untrack(s *Session, ip string) {
+	srv.mu.Lock()
+	delete(srv.sessions, s)
+	if srv.perIP[ip]--; srv.perIP[ip] <= 0 {
+		delete(srv.perIP, ip)
+	}
+	if ln := s.listener; ln != nil {
+		if srv.perListener[ln]--; srv.perListener[ln] <= 0 {
+			delete(srv.perListener, ln)
+		}
+	}
+	srv.mu.Unlock()
+}
+
+// streamConn adapt a stream into net.Conn
+type streamConn struct {
+	io.ReadWriteCloser
+	local, remote net.Addr
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+// deadlines are passed to the stream when it support them
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetDeadline(time.Time) error }); ok {
+		return d.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// StreamConn adapt a stream that is not a net.Conn for ServeSMTP,
+// remote is the address used by address based checks and may be
+// nil. deadlines are ignored unless the stream support them, so
+// idle sessions of such streams are only closed by Shutdown deadline
+func StreamConn(rwc io.ReadWriteCloser, local, remote net.Addr) net.Conn {
+	return &streamConn{ReadWriteCloser: rwc, local: local, remote: remote}
+}
+
+// admit report whether a new connection from ip is within
+// connection limits. connection over MaxConnections but within
+// PriorityConnections is admitted as overloaded. srv.mu MUST be held
+func (srv *Server) admit(config *Config, ip string, sessions int) (ok, overloaded bool) {
+	if max := config.MaxConnectionsPerIP; max > 0 && srv.perIP[ip] >= max {
+		return false, false
+	}
+	if max := config.MaxConnections; max > 0 && sessions >= max {
+		if sessions >= max+config.PriorityConnections {
+			return false, false
+		}
+		return true, true
+	}
+	return true, false
+}
+
+// Connections return the number of served connections
+// from each remote IP address
+func (srv *Server) Connections() map[string]int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	conns := make(map[string]int, len(srv.perIP))
+	for ip, n := range srv.perIP {
+		conns[ip] = n
+	}
+	return conns
+}
+
+// remoteIP return IP address of the remote side of conn
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func (srv *Server) isClosing() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closing
+}
@@ -0,0 +1,303 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestClient(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{conn: conn, reader: bufio.NewReader(conn)}
+	c.expect(t, "220 ")
+	return c
+}
+
+// expect read a reply and make sure it start with prefix
+func (c *testClient) expect(t *testing.T, prefix string) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected %q, got error %v", prefix, err)
+		}
+		if len(line) > 3 && line[3] == '-' {
+			continue
+		}
+		if !strings.HasPrefix(line, prefix) {
+			t.Fatalf("got: %q, expected prefix: %q", line, prefix)
+		}
+		return
+	}
+}
+
+func (c *testClient) cmd(t *testing.T, line, prefix string) {
+	fmt.Fprintf(c.conn, "%s\r\n", line)
+	c.expect(t, prefix)
+}
+
+// TestServerShutdown make sure that idle sessions receive 421 and
+// session in the middle of transaction can finish the transaction
+func TestServerShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(nil)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+
+	idle := dialTestClient(t, l.Addr().String())
+	busy := dialTestClient(t, l.Addr().String())
+	busy.cmd(t, "EHLO client.com", "250")
+	busy.cmd(t, "MAIL FROM:<some@example.com>", "250")
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+
+	idle.expect(t, "421 4.3.2 localhost Service shutting down\r\n")
+
+	busy.cmd(t, "RCPT TO:<some@domain.com>", "250")
+	busy.cmd(t, "DATA", "354")
+	busy.cmd(t, "Subject: test\r\n\r\nbody\r\n.", "250")
+	busy.expect(t, "421 ")
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() == %v, expected nil", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve() == %v, expected %v", err, ErrServerClosed)
+	}
+}
+
+// TestServerShutdownDeadline make sure that remaining sessions are
+// closed when the context is done
+func TestServerShutdownDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(nil)
+	go srv.Serve(l)
+
+	busy := dialTestClient(t, l.Addr().String())
+	busy.cmd(t, "EHLO client.com", "250")
+	busy.cmd(t, "MAIL FROM:<some@example.com>", "250")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() == %v, expected %v", err, context.DeadlineExceeded)
+	}
+}
+
+// TestServerConnectionLimit make sure that connections over the
+// limit are rejected with 421
+func TestServerConnectionLimit(t *testing.T) {
+	cases := []struct {
+		config *Config
+	}{
+		{&Config{MaxConnections: 1}},
+		{&Config{MaxConnectionsPerIP: 1}},
+	}
+
+	for _, input := range cases {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := NewServer(input.config)
+		go srv.Serve(l)
+
+		first := dialTestClient(t, l.Addr().String())
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		second := &testClient{conn: conn, reader: bufio.NewReader(conn)}
+		second.expect(t, "421 4.3.2 Too many connections")
+
+		if n := srv.Connections()["127.0.0.1"]; n != 1 {
+			t.Errorf("got %d connections, expected 1", n)
+		}
+
+		first.cmd(t, "QUIT", "221")
+		srv.Shutdown(context.Background())
+	}
+}
+
+// TestServerSessionWorkers make sure that connections over the busy
+// workers are rejected with 421 and idle workers serve new sessions
+func TestServerSessionWorkers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(&Config{SessionWorkers: 1})
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+
+	dial := func() *testClient {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &testClient{conn: conn, reader: bufio.NewReader(conn)}
+	}
+
+	first := dial()
+	first.expect(t, "220 ")
+	dial().expect(t, "421 4.3.2 Too many connections")
+	first.cmd(t, "QUIT", "221")
+
+	// the worker is idle once the first session is untracked
+	for i := 0; ; i++ {
+		c := dial()
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := c.reader.ReadString('\n')
+		if strings.HasPrefix(line, "220 ") {
+			c.cmd(t, "QUIT", "221")
+			break
+		}
+		if err != nil || i == 100 {
+			t.Fatalf("got %q %v", line, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	srv.mu.Lock()
+	workers := srv.poolWorkers
+	srv.mu.Unlock()
+	if workers != 1 {
+		t.Errorf("got %d workers, expected 1", workers)
+	}
+}
+
+// TestServerServeSMTP make sure that sessions of arbitrary streams
+// are served, tracked and drained when ctx is done
+func TestServerServeSMTP(t *testing.T) {
+	srv := NewServer(&Config{MaxConnectionsPerIP: 1})
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2525}
+
+	server, client := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.ServeSMTP(ctx, StreamConn(server, nil, remote))
+		close(done)
+	}()
+
+	c := &testClient{conn: client, reader: bufio.NewReader(client)}
+	c.expect(t, "220 ")
+	c.cmd(t, "HELO client.com", "250")
+	if got := srv.Connections()["192.0.2.1"]; got != 1 {
+		t.Errorf("got %d connections, expected 1", got)
+	}
+
+	// second stream from the same address exceed the limit
+	server2, client2 := net.Pipe()
+	go srv.ServeSMTP(context.Background(), StreamConn(server2, nil, remote))
+	c2 := &testClient{conn: client2, reader: bufio.NewReader(client2)}
+	c2.expect(t, "421 4.3.2")
+
+	cancel()
+	c.expect(t, "421")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeSMTP didn't return after ctx is done")
+	}
+	if got := len(srv.Connections()); got != 0 {
+		t.Errorf("got %d tracked addresses, expected none", got)
+	}
+}
+
+// failingListener fail the first accepts with EMFILE
+type failingListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
+
+// TestServerAcceptError make sure that the server keep serving after
+// accept errors other than a closed listener
+func TestServerAcceptError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(&Config{Logger: NewLogger(io.Discard)})
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(&failingListener{Listener: l, failures: 3})
+	}()
+
+	c := dialTestClient(t, l.Addr().String())
+	c.cmd(t, "QUIT", "221")
+	l.Close()
+	select {
+	case err := <-served:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("got %v, expected closed listener", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return after the listener is closed")
+	}
+}
+
+// TestServerIPv6 make sure that IPv6 clients are served and their
+// address literals are accepted and written into Received header
+func TestServerIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback not available:", err)
+	}
+	var data []byte
+	srv := NewServer(&Config{AddReceived: true, Backend: BackendFunc(func(envl *Envelope, d []byte) error {
+		data = d
+		return nil
+	})})
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+
+	c := dialTestClient(t, l.Addr().String())
+	c.cmd(t, "HELO [IPv6:::1x]", "501")
+	c.cmd(t, "HELO [IPv6:::1]", "250")
+	c.cmd(t, "MAIL FROM:<a@[IPv6:2001:db8::1]>", "250")
+	c.cmd(t, "RCPT TO:<postmaster@[192.0.2.1]>", "250")
+	c.cmd(t, "DATA", "354")
+	c.cmd(t, "Subject: hi\r\n\r\nbody\r\n.", "250")
+	c.cmd(t, "QUIT", "221")
+
+	if !strings.HasPrefix(string(data), "Received: from [IPv6:::1] ([IPv6:::1])") {
+		t.Errorf("got %q, expected IPv6 address literal in Received header", data)
+	}
+}
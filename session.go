@@ -3,52 +3,61 @@ package session
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
-	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
-// define replies
-// TODO: add host command flags
+// define replies, "<host>" is replaced by Session.Hostname in the
+// replies of Replies
 const (
 	REPLY_220      = "220 <host> Maillennia ESMTP ready"
-	REPLY_221      = "221 2.0.0 Bye"
+	REPLY_221      = "221 2.0.0 <host> OK bye"
 	REPLY_250      = "250 2.0.0 OK"
 	REPLY_250_RCPT = "250 2.1.5 OK"
 	REPLY_354      = "354 Go ahead"
 	REPLY_421      = "421 4.4.2 Bad connection"
-	REPLY_453      = "453 5.3.2 System not accepting network message"
+	REPLY_421_DOWN = "421 4.3.2 <host> Service shutting down"
+	REPLY_453      = "453 4.3.2 <host> System not accepting network messages"
 	REPLY_503      = "503 5.5.1 Invalid command"
 )
 
-// predefined regex
-var (
-	rArgSyntax = regexp.MustCompile(`<(.+)>`)
-	rMailAddr  = regexp.MustCompile(`[a-zA-Z0-9._-]+@(?:[a-zA-Z0-9._-]+\.)+[a-zA-Z]{2,}`)
-	rRcptArg   = regexp.MustCompile(`<(?:@(?:[a-zA-Z0-9._-]+\.)+[a-zA-Z]{2,},?)*:?[a-zA-Z0-9._-]+@(?:[a-zA-Z0-9._-]+\.)+[a-zA-Z]{2,}>`)
-	rMailArg   = regexp.MustCompile(`<[a-zA-Z0-9._-]+@(?:[a-zA-Z0-9._-]+\.)+[a-zA-Z]{2,}>`)
-)
+// helpText is the reply text of HELP command
+var helpText = []string{
+	"2.0.0 Supported commands:",
+	"2.0.0 HELO EHLO AUTH MAIL RCPT DATA",
+	"2.0.0 RSET NOOP QUIT HELP VRFY EXPN",
+}
 
 // error replies
 var (
-	ehloFirstErr         = errors.New("503 5.5.1 HELO/EHLO first")
-	badSeqErr            = errors.New("503 5.5.1 Bad sequence of commands") // TODO: improve err reply of bad sequence command
-	syntaxErr            = errors.New("555 5.5.2 Syntax error")
-	invalidCommandArgErr = errors.New("501 5.5.4 Invalid command arguments")
-
-	invalidRcptEmailErr = errors.New("553-5.1.2 Invalid recipient email address.\r\n" +
-		"553-5.1.2 Please Check for any spelling errors\r\n" +
-		"553-5.1.2 make sure before & after recipient email address\r\n" +
-		"553 5.1.2 doesn't contain periods, spaces, or other punctuation.")
-
-	emailNotExistErr = errors.New("550-5.1.1 Recipient email address doesn't exist.\r\n" +
-		"550-5.1.1 Please Check for any spelling errors\r\n" +
-		"550-5.1.1 make sure before & after recipient email address\r\n" +
-		"550 5.1.1 doesn't contain periods, spaces, or other punctuation.")
+	ehloFirstErr         = NewSMTPError(503, [3]int{5, 5, 1}, "HELO/EHLO first")
+	badSeqErr            = NewSMTPError(503, [3]int{5, 5, 1}, "Bad sequence of commands") // TODO: improve err reply of bad sequence command
+	syntaxErr            = NewSMTPError(555, [3]int{5, 5, 2}, "Syntax error")
+	invalidCommandArgErr = NewSMTPError(501, [3]int{5, 5, 4}, "Invalid command arguments")
+
+	invalidRcptEmailErr = NewSMTPError(553, [3]int{5, 1, 2},
+		"Invalid recipient email address.",
+		"Please Check for any spelling errors",
+		"make sure before & after recipient email address",
+		"doesn't contain periods, spaces, or other punctuation.")
+
+	utf8RequiredErr = NewSMTPError(553, [3]int{5, 6, 7}, "Non-ASCII addresses require SMTPUTF8")
+
+	emailNotExistErr = NewSMTPError(550, [3]int{5, 1, 1},
+		"Recipient email address doesn't exist.",
+		"Please Check for any spelling errors",
+		"make sure before & after recipient email address",
+		"doesn't contain periods, spaces, or other punctuation.")
 )
 
 // reply represents a SMTP Replies
@@ -66,68 +75,135 @@ func (rp *Reply) Transmit(str string) error {
 	return nil
 }
 
-// TransmitErr send a reply to SMTP sender with custom error message
+// TransmitErr send a reply to SMTP sender with custom error message.
+// SMTPError is rendered line by line, other errors are sent as is
 func (rp *Reply) TransmitErr(err error) error {
-	fmt.Fprintf(rp.w, "%s\r\n", err.Error())
-	e := rp.w.Flush()
-	if e != nil {
+	if e, ok := err.(*SMTPError); ok {
+		return rp.TransmitLines(e.Code, e.Text())
+	}
+	return rp.Transmit(err.Error())
+}
+
+// TransmitLines send a multiline reply to SMTP sender. every line
+// except the last one is sent in "250-" continuation format
+func (rp *Reply) TransmitLines(code int, lines []string) error {
+	for _, line := range replyLines(code, lines) {
+		fmt.Fprintf(rp.w, "%s\r\n", line)
+	}
+	err := rp.w.Flush()
+	if err != nil {
 		return errors.New("Error while send a Reply")
 	}
 	return nil
 }
 
-// command represents a SMTP Commands
-type command string
+// command is a SMTP command line parsed once into its verb, argument
+// and ESMTP parameters. verb and arg are substrings of line, so
+// parsing a command only allocate for ESMTP parameters
+type command struct {
+	line   string
+	verb   string
+	arg    string
+	params map[string]string
+}
 
-// String return a command as string
-// command itu string, terus kenapa return string?
-// WTF?
-func (c command) String() string {
-	return string(c)
+// parseCommand parse the command line
+func parseCommand(line string) command {
+	c := command{line: line}
+	if line == "\r\n" {
+		c.verb = "\r\n"
+		return c
+	}
+	// the argument follow the verb as sent, upper casing may change
+	// the length of non-ASCII verbs
+	raw := verbOf(line)
+	c.verb = upperVerb(raw)
+	c.arg = strings.TrimSpace(strings.TrimLeftFunc(line, unicode.IsSpace)[len(raw):])
+	if c.verb == "MAIL FROM:" || c.verb == "RCPT TO:" {
+		c.params = parseParams(c.arg)
+	}
+	return c
 }
 
-// Verb extract a command verb from line
-func (c command) Verb() string {
-	if c.String() == "\r\n" {
-		return "\r\n"
+// verbOf return the verb at the start of line as sent, "" when the
+// line is too short to have one
+func verbOf(line string) string {
+	verb := strings.TrimSpace(line)
+	if len(verb) < 4 {
+		return ""
+	}
+	first := verb
+	if i := strings.IndexFunc(verb, unicode.IsSpace); i >= 0 {
+		first = verb[:i]
+	}
+	// "MAIL FROM:" and "RCPT TO:" verbs include the keyword
+	if strings.EqualFold(first, "MAIL") || strings.EqualFold(first, "RCPT") {
+		if i := strings.IndexByte(verb, ':'); i > 0 {
+			return verb[:i+1]
+		}
 	}
+	return first
+}
 
-	verb := strings.TrimSpace(c.String())
-	if len(verb) == 4 {
-		return strings.ToUpper(verb)
+// maxVerbLen is the longest verb upper cased without allocation
+const maxVerbLen = 16
+
+// upperVerb return verb upper cased, the registered verb is returned
+// instead of a new string
+func upperVerb(verb string) string {
+	lower := false
+	for i := 0; i < len(verb); i++ {
+		if b := verb[i]; b >= 'a' && b <= 'z' || b >= utf8.RuneSelf {
+			lower = true
+			break
+		}
 	}
-	if len(verb) > 4 {
-		i := strings.Index(verb, ":")
-		if i > 0 {
-			return strings.ToUpper(verb[:i+1])
-		} else {
-			s := strings.Split(verb, " ")
-			return strings.ToUpper(s[0])
+	if !lower {
+		return verb
+	}
+	if len(verb) <= maxVerbLen {
+		var buf [maxVerbLen]byte
+		for i := 0; i < len(verb); i++ {
+			b := verb[i]
+			if b >= 'a' && b <= 'z' {
+				b -= 'a' - 'A'
+			}
+			buf[i] = b
+		}
+		commandsMu.RLock()
+		cmd := commands[string(buf[:len(verb)])]
+		commandsMu.RUnlock()
+		if cmd != nil {
+			return cmd.Verb
 		}
 	}
-	return ""
+	return strings.ToUpper(verb)
+}
+
+// String return the command line
+func (c command) String() string {
+	return c.line
 }
 
-// Arg extract argument from command
+// Verb return the upper cased verb like "EHLO" or "MAIL FROM:"
+func (c command) Verb() string {
+	return c.verb
+}
+
+// Arg return the argument of the command
 func (c command) Arg() string {
-	if c.String() == "\r\n" {
-		return ""
-	}
-	line := c.String()
-	i := len(c.Verb())
-	arg := strings.TrimSpace(line[i:])
-	return arg
+	return c.arg
 }
 
 // Valid check validity general of command. syntax, arg, etc.
 func (c command) ValidLine() (bool, error) {
 	// empty lines
-	if c.String() == "" {
+	if c.line == "" {
 		return false, syntaxErr
 	}
 
 	// every command should terminated with <CRLF>
-	if r := strings.HasSuffix(c.String(), "\r\n"); !r {
+	if r := strings.HasSuffix(c.line, "\r\n"); !r {
 		return false, syntaxErr
 	}
 
@@ -137,8 +213,11 @@ func (c command) ValidLine() (bool, error) {
 // ValidHello check validity of EHLO & HELO command
 func (c command) ValidHello() (bool, error) {
 	// HELO & EHLO should have an argument and not more than one
-	args := strings.Split(c.Arg(), " ")
-	if c.Arg() == "" || len(args) > 1 {
+	if c.Arg() == "" || strings.Contains(c.Arg(), " ") {
+		return false, invalidCommandArgErr
+	}
+	// address literal like [IPv6:2001:db8::1] must be valid
+	if strings.HasPrefix(c.Arg(), "[") && literalEnd(c.Arg(), 0) != len(c.Arg()) {
 		return false, invalidCommandArgErr
 	}
 
@@ -151,7 +230,7 @@ func (c command) ValidMail() (bool, error) {
 		return false, syntaxErr
 	}
 
-	if !rMailArg.MatchString(c.Arg()) {
+	if !validMailPath(c.Arg()) {
 		return false, invalidCommandArgErr
 	}
 
@@ -161,11 +240,11 @@ func (c command) ValidMail() (bool, error) {
 // ValidRcpt check validity of RCPT command
 func (c command) ValidRcpt() (bool, error) {
 
-	if c.Arg() == "" || !rArgSyntax.MatchString(c.Arg()) {
+	if c.Arg() == "" || !hasPath(c.Arg()) {
 		return false, syntaxErr
 	}
 
-	if !rRcptArg.MatchString(c.Arg()) {
+	if !validRcptPath(c.Arg()) {
 		return false, invalidRcptEmailErr
 	}
 	// TODO: email address shoule exist on database
@@ -193,94 +272,219 @@ func (c command) ValidQuit() (bool, error) {
 	return true, nil
 }
 
+// Params return ESMTP parameters after the path of MAIL and RCPT
+// command like "SIZE=1000 SMTPUTF8". keywords are uppercased
+func (c command) Params() map[string]string {
+	if c.verb == "MAIL FROM:" || c.verb == "RCPT TO:" {
+		return c.params
+	}
+	return parseParams(c.arg)
+}
+
+// parseParams parse ESMTP parameters after the path of arg, nil when
+// there is none
+func parseParams(arg string) map[string]string {
+	i := strings.LastIndexByte(arg, '>')
+	if i < 0 {
+		return nil
+	}
+	var params map[string]string
+	for rest := arg[i+1:]; ; {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		if rest == "" {
+			return params
+		}
+		p := rest
+		if j := strings.IndexFunc(rest, unicode.IsSpace); j >= 0 {
+			p, rest = rest[:j], rest[j:]
+		} else {
+			rest = ""
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		k, v, _ := strings.Cut(p, "=")
+		params[strings.ToUpper(k)] = v
+	}
+}
+
 // EmailAddress extract email address from command arguments
 func (c command) EmailAddress() string {
-	return rMailAddr.FindString(c.Arg())
+	return findAddress(c.Arg())
 }
 
 // Envelopes represents envelope for mail object
 // on each session
 type Envelope struct {
+	// ID is the unique ID of the message, given to the client in
+	// the reply to DATA or last BDAT
+	ID                string
 	OriginatorAddress string
 	RecipientAddress  []string
 	Extension         string
+	Alignment         *AlignmentResult
+	// SMTPUTF8 is set when MAIL FROM has SMTPUTF8 parameter,
+	// the transaction may contain UTF-8 addresses and headers
+	SMTPUTF8 bool
+	// DSNRet and DSNEnvID are RET and ENVID parameters of MAIL
+	// FROM, DSNRcpt is NOTIFY and ORCPT parameters of each
+	// recipient (RFC 3461)
+	DSNRet   string
+	DSNEnvID string
+	DSNRcpt  map[string]*DSNRecipient
+	// Body is the body type of BODY parameter on MAIL FROM:
+	// Body7Bit, Body8BitMIME or BodyBinaryMIME
+	Body string
+	// SPF is the result of SPF check on MAIL FROM
+	SPF string
+	// DKIM is the verification result of every DKIM-Signature
+	DKIM []*DKIMResult
+	// ARC is the validation result of ARC chain, see Config.ARC
+	ARC *ARCResult `json:",omitempty"`
+	// DMARC is the DMARC evaluation of From: header domain,
+	// see Config.DMARC
+	DMARC *DMARCResult `json:",omitempty"`
+	// Folder is the mailbox of the single recipient chosen by
+	// Sieve fileinto, empty for the inbox
+	Folder string `json:",omitempty"`
+	// Tags are added by tag rules of Rules policy
+	Tags []string `json:",omitempty"`
+	// Duplicate is set when the message was already received,
+	// see Config.MessageDedup
+	Duplicate bool `json:",omitempty"`
+	// TLS is the state of TLS connection the transaction was
+	// received over, nil without TLS
+	TLS *tls.ConnectionState `json:"-"`
+	// Metadata is opaque metadata of authenticated client like
+	// campaign ID, see Config.Metadata
+	Metadata map[string]string `json:",omitempty"`
+	// HoldUntil is the release time asked with HOLDFOR or HOLDUNTIL,
+	// see Config.FutureRelease
+	HoldUntil time.Time `json:",omitzero"`
+	// OriginalSender is the sender of authenticated client before
+	// OriginatorAddress was rewritten, see Config.ReturnPath
+	OriginalSender string `json:",omitempty"`
+
+	// ctx is the context of the mail transaction
+	ctx context.Context
 }
 
 func NewEnvelope() *Envelope {
 	return &Envelope{}
 }
 
-// SessionValidity represent validity of each session
-type SessionValidity struct {
-	HeloFirst bool
-	MailFirst bool
-	RcptFirst bool
-}
-
 // Session represents session on new connection
 type Session struct {
 	Conn       net.Conn
-	Validity   *SessionValidity
 	Reader     *bufio.Reader
 	Writer     *bufio.Writer
 	Reply      *Reply
 	Wg         *sync.WaitGroup
 	ChanClosed chan bool
+	Config     *Config
+	Principal  *Principal
+	HeloName   string
+	// ID is the unique ID of the connection, it start every log
+	// line of the session
+	ID string
+
+	// envl is the envelope of current mail transaction, chunks
+	// receive message data of BDAT commands
+	envl   *Envelope
+	chunks *bytes.Buffer
+
+	// ehlo is set when the client greeted with EHLO
+	ehlo bool
+
+	// xforward is the original client of the mail transaction
+	xforward *XForward
+
+	// mu guard state, draining, the connection and TLS status
+	mu         sync.Mutex
+	state      State
+	draining   bool
+	secure     bool
+	tlsVersion string
+	tlsCipher  string
+	tlsState   *tls.ConnectionState
+
+	// implicitTLS is the TLS config of SMTPS listener, the
+	// handshake happen before the greeting
+	implicitTLS *tls.Config
+	// caps is the protocol capabilities used in the session
+	caps capabilityUsage
+
+	// rdns is the PTR name of the client, see Config.ReverseDNS
+	rdns ReverseDNSResult
+
+	// overloaded is set when admitted over the connection limit
+	overloaded bool
+	// listener accepted the connection, nil outside of ServeListener
+	listener *Listener
+
+	// traceCtx and traceSpan trace the connection, txSpan the
+	// current mail transaction
+	traceCtx  context.Context
+	traceSpan Span
+	txSpan    Span
+
+	// serial, started and raw identify the session tracked by
+	// Server, live is its state shown by Server.Sessions
+	serial  uint64
+	started time.Time
+	raw     net.Conn
+	live    liveInfo
+
+	// buffers is the pool of bufR and bufW, the buffers of the
+	// connection shared by Reader, Writer and Reply
+	buffers *bufferPool
+	bufR    *bufio.Reader
+	bufW    *bufio.Writer
 }
 
 // New create a new session
 func New(conn net.Conn, wg *sync.WaitGroup, chanclosed chan bool) *Session {
-	rp := &Reply{
-		w: bufio.NewWriter(conn),
-	}
-
-	validity := &SessionValidity{
-		HeloFirst: false,
-		MailFirst: false,
-		RcptFirst: false,
-	}
+	return newSession(conn, wg, chanclosed, 0)
+}
 
+// newSession create a session with buffers of size taken from their
+// pool, see Config.BufferSize
+func newSession(conn net.Conn, wg *sync.WaitGroup, chanclosed chan bool, size int) *Session {
+	p := buffers(size)
+	r, w := p.reader(conn), p.writer(conn)
 	return &Session{
 		Conn:       conn,
-		Validity:   validity,
-		Reader:     bufio.NewReader(conn),
-		Writer:     bufio.NewWriter(conn),
-		Reply:      rp,
+		Reader:     r,
+		Writer:     w,
+		Reply:      &Reply{w: w},
 		Wg:         wg,
 		ChanClosed: chanclosed,
+		Config:     &Config{},
+		ID:         newID(),
+		buffers:    p,
+		bufR:       r,
+		bufW:       w,
 	}
 }
 
-// Close close the open connection of session
+// Close close the open connection of session. the session is done
+// after the connection is closed, so recordings are written when
+// Server.Shutdown return
 func (s *Session) Close() error {
-	s.Wg.Done()
-	// log.Println("session:", s.Conn.RemoteAddr(), "disconnected")
+	defer s.Wg.Done()
+	s.logf(LevelInfo, "disconnected")
 
 	err := s.Conn.Close()
+	s.releaseBuffers()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// SetHeloFirst mark a session as valid. Session valid if
-// initialized with Hello command
-func (s *Session) SetHeloFirst(heloFirst bool) {
-	s.Validity.HeloFirst = heloFirst
-}
-
-// SetMailFirst mark a session as valid if MAIL command
-// appear before RCPT command
-func (s *Session) SetMailFirst(mailFirst bool) {
-	s.Validity.MailFirst = mailFirst
-}
-
-// SetRcptFirst mark a session as valid if MAIL command
-// appear before RCPT command
-func (s *Session) SetRcptFirst(rcptFirst bool) {
-	s.Validity.RcptFirst = rcptFirst
-}
-
+// Valid check validity of command line, whether the command is
+// allowed in the current state of the session, and syntax and
+// arguments of registered commands
 func (s *Session) Valid(c command) (bool, error) {
 	// check validity of line
 	_, err := c.ValidLine()
@@ -288,113 +492,523 @@ func (s *Session) Valid(c command) (bool, error) {
 		return false, err
 	}
 
-	// validation for EHLO & HELO command
-	if c.Verb() == "EHLO" || c.Verb() == "HELO" {
-		_, err := c.ValidHello()
-		if err != nil {
+	verb := c.Verb()
+	if verb == "BDAT" && !s.Config.Chunking {
+		return false, notImplementedErr
+	}
+
+	// command MUST be allowed in the current state
+	cmd := lookupCommand(verb)
+	if err := s.allowed(verb, cmd); err != nil {
+		return false, err
+	}
+
+	if cmd != nil && cmd.Validate != nil {
+		if err := cmd.Validate(s, newCommandRequest(c)); err != nil {
 			return false, err
 		}
+	}
+	return true, nil
+}
 
-		s.SetHeloFirst(true)
-		return true, nil
+// Hostname return the host name used in replies
+func (s *Session) Hostname() string {
+	if s.Config.Hostname == "" {
+		return "localhost"
 	}
+	return s.Config.Hostname
+}
 
-	// validation for MAIL command
-	if c.Verb() == "MAIL FROM:" {
-		// MUST appear after EHLO/HELO
-		if !s.Validity.HeloFirst {
-			return false, ehloFirstErr
-		}
+// Extensions return the service extensions advertised on EHLO reply
+func (s *Session) Extensions() []string {
+	ext := []string{"ENHANCEDSTATUSCODES", "8BITMIME", "SMTPUTF8", "DSN", "SIZE"}
+	if max := s.maxMessageSize(); max > 0 {
+		ext[len(ext)-1] = "SIZE " + strconv.Itoa(max)
+	}
+	if s.Config.Chunking {
+		ext = append(ext, "CHUNKING", "BINARYMIME")
+	}
+	ext = append(ext, "HELP")
+	if s.offerTLS() {
+		ext = append(ext, "STARTTLS")
+	}
+	if s.xforwardAllowed() {
+		ext = append(ext, xforwardAttrs)
+	}
+	var mechs []string
+	if s.authAllowed() {
+		mechs = append(mechs, "PLAIN")
+	}
+	if s.externalAllowed() {
+		mechs = append(mechs, "EXTERNAL")
+	}
+	if len(mechs) > 0 {
+		ext = append(ext, "AUTH "+strings.Join(mechs, " "))
+	}
+	if s.Config.Metadata != nil {
+		ext = append(ext, metadataParam)
+	}
+	if s.Config.FutureRelease != nil {
+		ext = append(ext, s.Config.FutureRelease.extension(time.Now()))
+	}
+	if s.Config.ETRN != nil {
+		ext = append(ext, "ETRN")
+	}
+	if s.Config.ATRN != nil {
+		ext = append(ext, "ATRN")
+	}
+	return ext
+}
 
-		// syntax MUST valid
-		_, err := c.ValidMail()
-		if err != nil {
-			return false, err
-		}
+// CheckChanClosed check a channel ChanClosed if received then
+// reply with 453 and close the connection.
+//
+// Deprecated: sessions of Server are closed by Server.Shutdown
+func (s *Session) CheckChanClosed() bool {
+	// if signal for close the session received
+	// then close the session gracefully
+	select {
+	case <-s.ChanClosed:
+		s.Reply.Transmit(s.replyText(replyNotAccepting))
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadData read message data until end of data indicator "<CRLF>.<CRLF>"
+func (s *Session) ReadData() []byte {
+	data, _ := s.readData(0)
+	return data
+}
 
-		s.SetMailFirst(true)
-		return true, nil
+// readData is like ReadData, when limit is positive messages over
+// limit bytes are rejected without buffering. leading dot of
+// lines is removed (RFC 5321 section 4.5.2) and bare CR and LF are
+// handled according to Config.BareEOL. messages with bare CR or LF
+// in reject mode, overlong lines or header section are read up to
+// the end of data and the *SMTPError is returned. other errors are
+// I/O errors of the connection
+func (s *Session) readData(limit int) ([]byte, error) {
+	data, err := io.ReadAll(s.newDataReader(limit))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ProcessMessage run enabled checks on received message data and
+// return the message data that should be delivered
+func (s *Session) ProcessMessage(envl *Envelope, data []byte) []byte {
+	// verify on the original data before any header added
+	if s.Config.VerifyDKIM {
+		ctx, span := s.span(envl.Context(), "smtp.dkim")
+		envl.DKIM = VerifyDKIM(ctx, s.Config.resolver(), data)
+		span.End()
+	}
+	s.verifyARC(envl, data)
+
+	if s.submission() {
+		data = s.fixupMessage(data)
 	}
 
-	// validation for RCPT command
-	if c.Verb() == "RCPT TO:" {
-		// MUST appear after EHLO/HELO
-		if !s.Validity.HeloFirst {
-			return false, ehloFirstErr
+	if s.Config.CheckAlignment {
+		envl.Alignment = CheckAlignment(envl.OriginatorAddress, data, s.Config.StrictAlignment)
+		if s.Config.TagAlignment {
+			data = prependHeader(data, "X-Sender-Alignment", envl.Alignment.String())
 		}
+	}
 
-		// MUST appear after MAIL
-		if !s.Validity.MailFirst {
-			return false, badSeqErr
+	data = s.checkDMARC(envl, data)
+
+	// bulk sender tenant
+	if s.Principal != nil {
+		if tpl := s.Config.Unsubscribe[s.Principal.Tenant]; tpl != nil {
+			data = tpl.Inject(envl, s.Principal.Tenant, data)
 		}
+	}
+	s.rewriteReturnPath(envl)
 
-		_, err := c.ValidRcpt()
+	if s.Config.AddAuthResults {
+		data = removeAuthResults(data, s.Hostname())
+		data = prependHeader(data, "Authentication-Results", AuthResults(s.Hostname(), envl))
+	}
+
+	if s.Config.AddReceived {
+		data = prependHeader(data, "Received", s.received(envl))
+	}
+	return data
+}
+
+// Deliver hand over accepted message to delivery. template message
+// of authenticated client is expanded and delivered per recipient
+func (s *Session) Deliver(envl *Envelope, data []byte) error {
+	if s.Config.MergeExpansion && s.Principal != nil {
+		msgs, err := Merge(envl, data)
 		if err != nil {
-			return false, err
+			return err
+		}
+		if msgs != nil {
+			for _, m := range msgs {
+				if err := s.deliver(m.Envelope, m.Data); err != nil {
+					return err
+				}
+			}
+			return nil
 		}
-
-		s.SetRcptFirst(true)
-		return true, nil
 	}
+	return s.deliver(envl, data)
+}
 
-	// validation for DATA command
-	if c.Verb() == "DATA" {
-		// MUST appear after EHLO/HELO
-		if !s.Validity.HeloFirst {
-			return false, ehloFirstErr
+// deliver suppress duplicate messages and mailboxes and hand over
+// message to calendar handler and backend
+func (s *Session) deliver(envl *Envelope, data []byte) error {
+	msgID := messageID(data)
+	var key string
+	if d := s.Config.MessageDedup; d != nil {
+		key = d.Key(envl, data)
+		if d.Seen(key) {
+			if d.Drop {
+				s.track(TrackDuplicate, envl, msgID, envl.RecipientAddress, "dropped duplicate message")
+				return nil
+			}
+			envl.Duplicate = true
+		}
+	}
+	if d := s.Config.MailboxDedup; d != nil {
+		keep, dup := d.Filter(msgID, envl.RecipientAddress)
+		s.track(TrackDuplicate, envl, msgID, dup, "suppressed duplicate copy")
+		if len(keep) == 0 {
+			return nil
+		}
+		if len(dup) > 0 {
+			e := *envl
+			e.RecipientAddress = keep
+			envl = &e
 		}
+	}
 
-		// MUST appear after MAIL & RCPT
-		if !s.Validity.MailFirst || !s.Validity.RcptFirst {
-			return false, badSeqErr
+	ctx, span := s.span(envl.Context(), "smtp.deliver")
+	tctx := envl.ctx
+	envl.ctx = ctx
+	arrival := time.Now()
+	err := s.handoverQuota(envl, data)
+	envl.ctx = tctx
+	if errs, ok := err.(RecipientErrors); ok {
+		var delivered []string
+		delivered, err = s.bounce(envl, errs, arrival, data)
+		if err == nil {
+			e := *envl
+			e.RecipientAddress = delivered
+			envl = &e
 		}
+	}
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		return err
+	}
 
-		// TODO: validate recipients MUST greater than 0
+	if d := s.Config.MailboxDedup; d != nil {
+		d.Mark(msgID, envl.RecipientAddress)
+	}
+	if d := s.Config.MessageDedup; d != nil {
+		d.Mark(key)
+	}
+	s.addQuota(envl, envl.RecipientAddress, data)
+	s.track(TrackDelivered, envl, msgID, envl.RecipientAddress, "")
+	return nil
+}
 
-		_, err := c.ValidData()
-		if err != nil {
-			return false, err
+// handover hand over message to calendar handler and backend
+func (s *Session) handover(envl *Envelope, data []byte) error {
+	if s.Config.CalendarHandler != nil {
+		invitations := FindInvitations(data)
+		if len(invitations) > 0 {
+			deliver, err := s.Config.CalendarHandler.HandleCalendar(envl, invitations, data)
+			if err != nil || !deliver {
+				return err
+			}
 		}
+	}
 
-		return true, nil
+	if s.Config.Backend == nil {
+		return nil
 	}
+	if s.Config.Sieve != nil {
+		return s.sieveDeliver(envl, data)
+	}
+	return s.Config.Backend.Deliver(envl, data)
+}
 
-	// validation for QUIT command
-	if c.Verb() == "QUIT" {
-		_, err := c.ValidQuit()
-		if err != nil {
-			return false, err
-		}
+// drain mark the session to be closed after the current mail
+// transaction. idle session is interrupted immediately
+func (s *Session) drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+	if !s.state.inTransaction() {
+		s.Conn.SetReadDeadline(time.Now())
+	}
+}
 
-		return true, nil
+// drained report whether the session is draining and has no
+// mail transaction in progress
+func (s *Session) drained() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining && !s.state.inTransaction()
+}
+
+// disconnect abort the session whose connection is lost with err,
+// the transaction in progress is passed to OnDisconnect
+func (s *Session) disconnect(err error) {
+	state := s.State()
+	var envl *Envelope
+	if state.inTransaction() {
+		envl = s.envl
+		s.traceError(err)
+	}
+	if errors.Is(err, io.EOF) {
+		s.logf(LevelInfo, "disconnected in %s", state)
+	} else {
+		s.logf(LevelInfo, "disconnected in %s: %v", state, err)
 	}
+	s.countDisconnect(state)
+	if s.Config.OnDisconnect != nil {
+		s.Config.OnDisconnect(s, envl, err)
+	}
+	s.abort()
+}
 
-	return true, nil
+// RemoteIP return IP address of the SMTP sender
+func (s *Session) RemoteIP() net.IP {
+	return net.ParseIP(remoteIP(s.Conn))
 }
 
-// CheckChanClosed check a channel ChanClosed if received then
-// reply with 453 and close the connection
-func (s *Session) CheckChanClosed() bool {
-	// if signal for close the session received
-	// then close the session gracefully
-	select {
-	case <-s.ChanClosed:
-		err := s.Reply.Transmit(REPLY_453)
-		if err != nil {
-			return true
+// CheckDNSBL check the client against DNS blocklists when the
+// check is configured for the stage (connection or MAIL).
+// authenticated clients are not checked at MAIL stage
+func (s *Session) CheckDNSBL(ctx context.Context, atMail bool) error {
+	d := s.Config.DNSBL
+	if d == nil || d.AtMail != atMail || (atMail && s.Principal != nil) {
+		return nil
+	}
+	ip := s.RemoteIP()
+	if ip == nil || s.Config.Access.AllowedIP(ip) {
+		return nil
+	}
+	ctx, span := s.span(ctx, "smtp.dnsbl")
+	res := d.Check(ctx, ip)
+	span.SetAttribute("dnsbl.listed", res.Listed)
+	span.End()
+	if res.Listed {
+		return d.Reject(ip, res)
+	}
+	return nil
+}
+
+// Mail run checks of MAIL command and fill the envelope sender
+func (s *Session) Mail(c command, envl *Envelope) error {
+	ctx, done := s.stageContext(StageMail)
+	defer done()
+
+	dctx, cancel := share(ctx, 3)
+	err := s.CheckDNSBL(dctx, true)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	addr := c.EmailAddress()
+	if err := s.checkSubmission(addr); err != nil {
+		return err
+	}
+	_, utf8 := c.Params()["SMTPUTF8"]
+	if !utf8 && !isASCII(addr) {
+		return utf8RequiredErr
+	}
+	if err := s.checkAccessSender(addr); err != nil {
+		return err
+	}
+	body, err := s.bodyType(c.Params()["BODY"])
+	if err != nil {
+		return err
+	}
+	if err := s.checkMessageSize(c.Params()); err != nil {
+		return err
+	}
+	dsn := &Envelope{}
+	if err := parseMailDSN(c.Params(), dsn); err != nil {
+		return err
+	}
+	md, err := s.mailMetadata(c.Params())
+	if err != nil {
+		return err
+	}
+	hold, err := s.mailHold(c.Params())
+	if err != nil {
+		return err
+	}
+	if err := s.checkWarmUp(StageMail); err != nil {
+		return err
+	}
+	if err := s.checkMessageRate(ctx, addr); err != nil {
+		return err
+	}
+	if s.Config.CheckSPF {
+		if ip := s.RemoteIP(); ip != nil {
+			sctx, cancel := share(ctx, 2)
+			sctx, span := s.span(sctx, "smtp.spf")
+			envl.SPF = CheckSPF(sctx, s.Config.resolver(), ip, addr, s.HeloName)
+			span.SetAttribute("spf.result", envl.SPF)
+			span.End()
+			cancel()
+			if envl.SPF == SPFFail && s.Config.RejectSPFFail && s.Principal == nil {
+				return spfFailErr
+			}
 		}
-		return true
-	default:
-		return false
 	}
+
+	// fill the OriginatorAddress & Extension of envelope here
+	envl.OriginatorAddress = addr
+	envl.SMTPUTF8 = utf8
+	envl.Body = body
+	envl.DSNRet, envl.DSNEnvID = dsn.DSNRet, dsn.DSNEnvID
+	envl.TLS = s.TLSState()
+	envl.Metadata = md
+	envl.HoldUntil = hold
+	// envl.Extension = "extension"
+	return s.checkPolicy(ctx, StageMail, envl, "")
+}
+
+// Rcpt run checks of RCPT command and add the recipient into
+// the envelope
+func (s *Session) Rcpt(c command, envl *Envelope) error {
+	addr := c.EmailAddress()
+	if !envl.SMTPUTF8 && !isASCII(addr) {
+		return utf8RequiredErr
+	}
+	if err := s.checkRelay(addr); err != nil {
+		return err
+	}
+	if s.Overloaded() && !isPriorityRcpt(addr) {
+		return overloadErr
+	}
+	if err := s.checkRcptLimit(envl); err != nil {
+		return err
+	}
+	dsn, err := parseRcptDSN(c.Params())
+	if err != nil {
+		return err
+	}
+	ctx, done := s.stageContext(StageRcpt)
+	defer done()
+	if err := s.checkPolicy(ctx, StageRcpt, envl, addr); err != nil {
+		return err
+	}
+	dests, err := s.expandAlias(ctx, addr)
+	if err != nil {
+		return err
+	}
+	aliased := dests != nil
+	if aliased {
+		s.logf(LevelDebug, "alias <%s> expanded to %v", addr, dests)
+	} else {
+		if err := s.checkRcpt(ctx, envl, addr); err != nil {
+			return err
+		}
+		dests = []string{addr}
+	}
+	for _, d := range dests {
+		if err := s.checkQuota(ctx, d); err != nil {
+			return err
+		}
+	}
+	for _, d := range dests {
+		// destinations shared by several aliases are added once
+		if aliased && containsFold(envl.RecipientAddress, d) {
+			continue
+		}
+		envl.RecipientAddress = append(envl.RecipientAddress, d)
+		if dsn != nil {
+			if envl.DSNRcpt == nil {
+				envl.DSNRcpt = make(map[string]*DSNRecipient)
+			}
+			envl.DSNRcpt[d] = dsn
+		}
+	}
+	return nil
+}
+
+// connect run checks of a new connection before greeting
+func (s *Session) connect() error {
+	if err := s.checkAccessIP(); err != nil {
+		return err
+	}
+	ctx, done := s.stageContext(StageConnect)
+	defer done()
+
+	dctx, cancel := share(ctx, 3)
+	err := s.CheckDNSBL(dctx, false)
+	cancel()
+	if err != nil {
+		return err
+	}
+	rctx, cancel := share(ctx, 2)
+	err = s.checkReverseDNS(rctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	if err := s.checkWarmUp(StageConnect); err != nil {
+		return err
+	}
+	if err := s.checkConnectionRate(ctx); err != nil {
+		return err
+	}
+	return s.checkPolicy(ctx, StageConnect, nil, "")
 }
 
 // Serve serve connected SMTP sender
 func (s *Session) Serve() {
 	defer s.Close()
+	defer s.reportCapabilities()
+
+	if s.Config.ProxyProtocol {
+		if err := s.readProxy(); err != nil {
+			s.logf(LevelWarn, "PROXY header: %v", err)
+			return
+		}
+	}
+	if s.implicitTLS != nil {
+		if err := s.handshake(s.implicitTLS); err != nil {
+			s.logf(LevelInfo, "TLS handshake: %v", err)
+			return
+		}
+	}
+	if s.Config.TLSTerminated && !s.TLS() {
+		s.setTLS("", "")
+	}
+	s.startTrace()
+	defer s.endTrace()
+	s.captureTranscript()
+	s.logf(LevelInfo, "connected")
+	if err := s.connect(); err != nil {
+		s.Reply.TransmitErr(err)
+		return
+	}
 
-	// log.Println("session:", s.Conn.RemoteAddr(), "connected")
-	err := s.Reply.Transmit(REPLY_220)
+	if err := s.checkEarlyTalker(); err != nil {
+		if err == earlyTalkerErr {
+			s.logf(LevelInfo, "early talker rejected")
+			s.Reply.TransmitErr(err)
+		}
+		return
+	}
+
+	s.countConnection()
+	err := s.Reply.Transmit(s.replyText(replyGreeting))
 	if err != nil {
 		return
 	}
@@ -405,17 +1019,32 @@ func (s *Session) Serve() {
 	// in what event occurs?
 
 	// create new envelope
-	envl := NewEnvelope()
+	s.reset()
 
 	for {
+		// server is shutting down, close the idle session
+		if s.drained() {
+			s.Reply.Transmit(s.replyText(replyShutdown))
+			return
+		}
 
 		// read from connection, return non-escaped string include \r\n
-		line, err := s.Reader.ReadString('\n')
+		line, err := s.readCommand()
+		pipelined := s.Reader.Buffered() > 0
+		if err == lineTooLongErr {
+			if s.Reply.TransmitErr(err) != nil {
+				return
+			}
+			continue
+		}
 		if err != nil {
-			err := s.Reply.Transmit(REPLY_453)
-			if err != nil {
+			if s.drained() {
+				s.Reply.Transmit(s.replyText(replyShutdown))
 				return
 			}
+			// the client is gone, a partial line is not a command
+			s.disconnect(err)
+			return
 		}
 
 		// check signal from smtp server
@@ -426,9 +1055,13 @@ func (s *Session) Serve() {
 
 		// check validity of session like valid line,
 		// command sequences, command syntax, command argument, etc.
-		c := command(line)
+		c := parseCommand(line)
 		valid, err := s.Valid(c)
 		if !valid && err != nil {
+			// chunk of rejected BDAT MUST still be read
+			if c.Verb() == "BDAT" {
+				s.discardChunk(c)
+			}
 			// reply with custom error
 			e := s.Reply.TransmitErr(err)
 			if e != nil {
@@ -437,83 +1070,25 @@ func (s *Session) Serve() {
 			continue
 		}
 
-		switch c.Verb() {
-		case "HELO":
-			err := s.Reply.Transmit(REPLY_250)
-			if err != nil {
-				return
-			}
-		case "EHLO":
-			// TODO: implment Extended SMTP
-			err := s.Reply.Transmit(REPLY_250)
-			if err != nil {
-				return
-			}
-		case "MAIL FROM:":
-			// fill the OriginatorAddress & Extension of envelope here
-			envl.OriginatorAddress = c.EmailAddress()
-			// envl.Extension = "extension"
+		s.observeCommand(c, pipelined)
 
-			err := s.Reply.Transmit(REPLY_250)
-			if err != nil {
-				return
-			}
-		case "RCPT TO:":
-			envl.RecipientAddress = append(envl.RecipientAddress, c.EmailAddress())
-			err := s.Reply.Transmit(REPLY_250_RCPT)
-			if err != nil {
-				return
-			}
-		case "DATA":
-			err := s.Reply.Transmit(REPLY_354)
-			if err != nil {
+		// run the registered command
+		cmd := lookupCommand(c.Verb())
+		if cmd == nil {
+			if s.Reply.Transmit(REPLY_503) != nil {
 				return
 			}
-
-			var messageData bytes.Buffer
-			// receive message data here
-			for {
-				// we SHOULD receive data in form of bytes
-				msgDataLine, err := s.Reader.ReadSlice('\n')
-				if err != nil {
-					// TODO: Handle error here
-					log.Println(err)
-				}
-				// break if
-				if bytes.Equal(msgDataLine, []byte(".\r\n")) {
-					break
-				}
-				// append each line into message content
-				_, err = messageData.Write(msgDataLine)
-				if err != nil {
-					log.Printf("%v\n", err)
-				}
-				log.Printf("%q", messageData)
-			}
-		case "\r\n":
-			log.Println("enter")
-		case "RSET":
-			log.Println(c.Verb())
-		case "QUIT":
-			err := s.Reply.Transmit(REPLY_221)
-			if err != nil {
-				return
+			continue
+		}
+		if err := cmd.Handle(s, newCommandRequest(c)); err != nil {
+			if s.State() != StateQuit {
+				s.disconnect(err)
 			}
 			return
-		case "NOOP":
-			log.Println(c.Verb())
-		case "HELP":
-			log.Println(c.Verb())
-		case "EXPN":
-			log.Println(c.Verb())
-		case "VRFY":
-			log.Println(c.Verb())
-		default:
-			e := s.Reply.Transmit(REPLY_503)
-			if e != nil {
-				return
-			}
 		}
-
+		s.updateLive()
+		if s.State() == StateQuit {
+			return
+		}
 	}
 }
@@ -1,6 +1,14 @@
 package session
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -19,7 +27,7 @@ func TestCommandValidLine(t *testing.T) {
 	}
 
 	for _, input := range cases {
-		c := command(input.line)
+		c := parseCommand(input.line)
 		got, err := c.ValidLine()
 		if got != input.valid {
 			t.Errorf("%q.ValidLine() == %t, expected %t", input.line, got, input.valid)
@@ -70,7 +78,7 @@ func TestCommandVerb(t *testing.T) {
 	}
 
 	for _, input := range cases {
-		verb := command(input.valid_line).Verb()
+		verb := parseCommand(input.valid_line).Verb()
 		if verb != input.expected_verb {
 			t.Errorf("%q: got %q, expected %q", input.valid_line, verb, input.expected_verb)
 		}
@@ -98,6 +106,8 @@ func TestCommandArg(t *testing.T) {
 
 		{"MAIL FROM:<reverse-path> <mail-parameter>\r\n", "<reverse-path> <mail-parameter>"},
 		{"mail from: <reverse-path> <mail-parameter>\r\n", "<reverse-path> <mail-parameter>"},
+		{"  MAIL FROM:<reverse-path>\r\n", "<reverse-path>"},
+		{"\tehlo some-string\r\n", "some-string"},
 
 		// TODO: validate RCPT TO arg
 		// {"RCPT TO: some-string\r\n", "RCPT TO:"},
@@ -105,7 +115,7 @@ func TestCommandArg(t *testing.T) {
 	}
 
 	for _, input := range cases {
-		arg := command(input.valid_line).Arg()
+		arg := parseCommand(input.valid_line).Arg()
 		if arg != input.expected_arg {
 			t.Errorf("%q: got %q, expected %q", input.valid_line, arg, input.expected_arg)
 		}
@@ -136,7 +146,7 @@ func TestValidityOfHelloCommand(t *testing.T) {
 	}
 
 	for _, input := range cases {
-		got, err := command(input.line).ValidHello()
+		got, err := parseCommand(input.line).ValidHello()
 		if got != input.valid {
 			t.Errorf("%q.Valid() == %t, expected %t", input.line, got, input.valid)
 		}
@@ -174,7 +184,7 @@ func TestCommandEmailAddress(t *testing.T) {
 	}
 
 	for _, input := range cases {
-		emailAddr := command(input.valid_line).EmailAddress()
+		emailAddr := parseCommand(input.valid_line).EmailAddress()
 		if emailAddr != input.expected_email_addr {
 			t.Errorf("%q: got %q, expected %q", input.valid_line, emailAddr, input.expected_email_addr)
 		}
@@ -202,7 +212,7 @@ func TestValidityOfMailCommand(t *testing.T) {
 	}
 
 	for _, input := range cases {
-		got, err := command(input.line).ValidMail()
+		got, err := parseCommand(input.line).ValidMail()
 		if got != input.valid {
 			t.Errorf("%q.Valid() == %t, expected %t", input.line, got, input.valid)
 		}
@@ -244,7 +254,7 @@ func TestValidityOfRcptCommand(t *testing.T) {
 	}
 
 	for _, input := range cases {
-		got, err := command(input.line).ValidRcpt()
+		got, err := parseCommand(input.line).ValidRcpt()
 		if got != input.valid {
 			t.Errorf("%q.ValidRcpt() == %t, expected %t", input.line, got, input.valid)
 		}
@@ -276,7 +286,7 @@ func TestValidityOfDataCommand(t *testing.T) {
 	}
 
 	for _, input := range cases {
-		got, err := command(input.line).ValidData()
+		got, err := parseCommand(input.line).ValidData()
 		if got != input.valid {
 			t.Errorf("%q.ValidData() == %t, expected %t", input.line, got, input.valid)
 		}
@@ -306,7 +316,7 @@ func TestValidityOfQuitCommand(t *testing.T) {
 	}
 
 	for _, input := range cases {
-		got, err := command(input.line).ValidQuit()
+		got, err := parseCommand(input.line).ValidQuit()
 		if got != input.valid {
 			t.Errorf("%q.ValidQuit() == %t, expected %t", input.line, got, input.valid)
 		}
@@ -321,3 +331,391 @@ func TestValidityOfQuitCommand(t *testing.T) {
 		}
 	}
 }
+
+// TestReplyTransmitLines make sure that multiline replies use
+// continuation format on every line except the last one
+func TestReplyTransmitLines(t *testing.T) {
+	cases := []struct {
+		code     int
+		lines    []string
+		expected string
+	}{
+		{250, []string{"OK"}, "250 OK\r\n"},
+		{250, []string{"mail.domain.com greets client", "HELP"}, "250-mail.domain.com greets client\r\n250 HELP\r\n"},
+		{214, []string{"a", "b", "c"}, "214-a\r\n214-b\r\n214 c\r\n"},
+	}
+
+	for _, input := range cases {
+		var buf bytes.Buffer
+		rp := &Reply{w: bufio.NewWriter(&buf)}
+		err := rp.TransmitLines(input.code, input.lines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != input.expected {
+			t.Errorf("got: %q, expected: %q", buf.String(), input.expected)
+		}
+	}
+}
+
+// runSession serve a session over in-memory connection, send input
+// as SMTP sender and return every reply until the session closed
+func runSession(t *testing.T, config *Config, input string) string {
+	return runSessionFrom(t, config, "", input)
+}
+
+// pipeConn is in-memory connection with custom remote address
+type pipeConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// runSessionFrom is like runSession with remote address of SMTP
+// sender set to remote
+func runSessionFrom(t *testing.T, config *Config, remote string, input string) string {
+	server, client := net.Pipe()
+	conn := net.Conn(server)
+	if remote != "" {
+		addr, err := net.ResolveTCPAddr("tcp", remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn = &pipeConn{Conn: server, remote: addr}
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	s := New(conn, wg, nil)
+	if config != nil {
+		s.Config = config
+	}
+	go s.Serve()
+
+	go func() {
+		fmt.Fprint(client, input)
+	}()
+
+	out, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	return string(out)
+}
+
+// TestSessionDisconnect make sure that a lost connection end the
+// session without reply, OnDisconnect receive the partial envelope
+// and the transaction is aborted
+func TestSessionDisconnect(t *testing.T) {
+	const helo = "HELO client.com\r\n"
+	const tx = helo + "MAIL FROM:<from@example.com>\r\nRCPT TO:<to@example.com>\r\n"
+	cases := []struct {
+		input    string
+		replies  int
+		called   bool
+		state    State
+		rcpts    int
+		expected string
+	}{
+		{helo, 2, true, StateHelloed, -1, `smtp_disconnects_total{state="helloed"} 1`},
+		{helo + "MAIL FROM:<from@example.com>\r\nNOOP", 3, true, StateMail, 0, `smtp_disconnects_total{state="mail"} 1`},
+		{tx, 4, true, StateRcpt, 1, `smtp_disconnects_total{state="rcpt"} 1`},
+		{tx + "DATA\r\nSubject: partial\r\n", 5, true, StateData, 1, `smtp_disconnects_total{state="data"} 1`},
+		{helo + "QUIT\r\n", 3, false, StateQuit, -1, ""},
+	}
+
+	for _, input := range cases {
+		var called bool
+		var state State
+		var envl, aborted *Envelope
+		metrics := &Metrics{}
+		config := &Config{Metrics: metrics, OnDisconnect: func(s *Session, e *Envelope, err error) {
+			called, state, envl = true, s.State(), e
+		}, Aborter: AborterFunc(func(e *Envelope) {
+			aborted = e
+		})}
+
+		server, client := net.Pipe()
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		s := New(server, wg, nil)
+		s.Config = config
+		go s.Serve()
+
+		go fmt.Fprint(client, input.input)
+		r := bufio.NewReader(client)
+		for n := 0; n < input.replies; {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%q: %v", input.input, err)
+			}
+			if len(line) > 3 && line[3] == ' ' {
+				n++
+			}
+		}
+		client.Close()
+		wg.Wait()
+
+		if called != input.called || called && state != input.state {
+			t.Errorf("%q: got called %v in %v, expected %v in %v", input.input, called, state, input.called, input.state)
+		}
+		switch {
+		case input.rcpts < 0 && envl != nil:
+			t.Errorf("%q: got envelope %+v, expected nil", input.input, envl)
+		case input.rcpts >= 0 && (envl == nil || envl.OriginatorAddress != "from@example.com" || len(envl.RecipientAddress) != input.rcpts):
+			t.Errorf("%q: got envelope %+v, expected %d recipients", input.input, envl, input.rcpts)
+		}
+		if aborted != envl {
+			t.Errorf("%q: got aborted %+v, expected %+v", input.input, aborted, envl)
+		}
+
+		w := httptest.NewRecorder()
+		metrics.ServeHTTP(w, nil)
+		if out := w.Body.String(); input.expected != "" && !strings.Contains(out, input.expected) || input.expected == "" && strings.Contains(out, "smtp_disconnects_total") {
+			t.Errorf("%q: got metrics %q, expected %q", input.input, out, input.expected)
+		}
+	}
+}
+
+// TestCommandParams make sure that ESMTP parameters are parsed
+func TestCommandParams(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected map[string]string
+	}{
+		{"MAIL FROM:<some@domain.com>\r\n", map[string]string{}},
+		{"MAIL FROM:<some@domain.com> smtputf8\r\n", map[string]string{"SMTPUTF8": ""}},
+		{"MAIL FROM:<some@domain.com> SIZE=1000 BODY=8BITMIME\r\n", map[string]string{"SIZE": "1000", "BODY": "8BITMIME"}},
+		{"RCPT TO:<some@domain.com> NOTIFY=SUCCESS,FAILURE\r\n", map[string]string{"NOTIFY": "SUCCESS,FAILURE"}},
+	}
+
+	for _, input := range cases {
+		got := parseCommand(input.line).Params()
+		if len(got) != len(input.expected) {
+			t.Errorf("%q: got %v, expected %v", input.line, got, input.expected)
+			continue
+		}
+		for k, v := range input.expected {
+			if got[k] != v {
+				t.Errorf("%q: got %v, expected %v", input.line, got, input.expected)
+			}
+		}
+	}
+}
+
+// TestParseCommandAllocs make sure that commands are parsed without
+// allocation, except for ESMTP parameters
+func TestParseCommandAllocs(t *testing.T) {
+	cases := []struct {
+		line   string
+		allocs float64
+	}{
+		{"EHLO client.example.com\r\n", 0},
+		{"ehlo client.example.com\r\n", 0},
+		{"MAIL FROM:<some@domain.com>\r\n", 0},
+		{"mail from:<some@domain.com>\r\n", 0},
+		{"RCPT TO:<some@domain.com>\r\n", 0},
+		{"DATA\r\n", 0},
+		{"MAIL FROM:<some@domain.com> SIZE=1000\r\n", 2},
+	}
+
+	for _, input := range cases {
+		var c command
+		allocs := testing.AllocsPerRun(100, func() {
+			c = parseCommand(input.line)
+		})
+		if allocs > input.allocs {
+			t.Errorf("%q: got %v allocations, expected %v", input.line, allocs, input.allocs)
+		}
+		if c.Verb() == "" {
+			t.Errorf("%q: no verb", input.line)
+		}
+	}
+}
+
+func BenchmarkParseCommand(b *testing.B) {
+	lines := []string{
+		"EHLO client.example.com\r\n",
+		"MAIL FROM:<some.another@sub.domain.com>\r\n",
+		"RCPT TO:<some@domain.com>\r\n",
+		"DATA\r\n",
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, line := range lines {
+			parseCommand(line)
+		}
+	}
+}
+
+// FuzzCommandParse make sure that parsing and validating hostile
+// command lines never panic and the parts come from the line
+func FuzzCommandParse(f *testing.F) {
+	for _, line := range []string{
+		"EHLO client.com\r\n",
+		"MAIL FROM:<some@domain.com> SIZE=1000 BODY=8BITMIME\r\n",
+		"rcpt to:<@a.com,@b.com:some@domain.com> NOTIFY=SUCCESS ORCPT=rfc822;a+2Bb@c.com\r\n",
+		"  MAIL FROM:<>\r\n",
+		"\r\n",
+		"\xc9\x90\xc9\x90\xc9\x90\xc9\x90\r\n",
+	} {
+		f.Add(line)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		c := parseCommand(line)
+		if !strings.Contains(line, c.Arg()) {
+			t.Errorf("arg %q not in line %q", c.Arg(), line)
+		}
+		if c.Verb() != strings.ToUpper(c.Verb()) {
+			t.Errorf("verb %q not upper cased", c.Verb())
+		}
+		c.Params()
+		c.ValidLine()
+		c.ValidHello()
+		c.ValidMail()
+		c.ValidRcpt()
+		c.ValidData()
+		c.ValidQuit()
+		if addr := c.EmailAddress(); !strings.Contains(line, addr) {
+			t.Errorf("address %q not in line %q", addr, line)
+		}
+	})
+}
+
+// benchClient is the client of a session served over in-memory
+// connection for benchmarks. replies are read ahead by a goroutine,
+// only their last line is kept
+type benchClient struct {
+	conn    net.Conn
+	replies chan string
+}
+
+// startBenchSession serve a session of config and read its greeting,
+// the session is ended with QUIT when the benchmark is done
+func startBenchSession(b *testing.B, config *Config) *benchClient {
+	server, client := net.Pipe()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	s := New(server, wg, nil)
+	s.Config = config
+	go s.Serve()
+
+	c := &benchClient{conn: client, replies: make(chan string, 64)}
+	go func() {
+		defer close(c.replies)
+		r := bufio.NewReader(client)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if len(line) > 3 && line[3] == '-' {
+				continue
+			}
+			c.replies <- line
+		}
+	}()
+	c.expect(b, 1)
+	b.Cleanup(func() {
+		fmt.Fprint(client, "QUIT\r\n")
+		for range c.replies {
+		}
+		wg.Wait()
+	})
+	return c
+}
+
+// expect read n replies and fail unless they are positive
+func (c *benchClient) expect(b *testing.B, n int) {
+	for i := 0; i < n; i++ {
+		line, ok := <-c.replies
+		if !ok || line[0] != '2' && line[0] != '3' {
+			b.Fatalf("got reply %q", line)
+		}
+	}
+}
+
+// run send script b.N times, waiting for its replies each time or,
+// pipelined, sending every script at once while replies are read
+func (c *benchClient) run(b *testing.B, script []string, replies int, pipelined bool) {
+	b.ResetTimer()
+	if pipelined {
+		go func() {
+			w := bufio.NewWriter(c.conn)
+			for i := 0; i < b.N; i++ {
+				for _, part := range script {
+					w.WriteString(part)
+				}
+			}
+			w.Flush()
+		}()
+		c.expect(b, b.N*replies)
+		return
+	}
+	for i := 0; i < b.N; i++ {
+		for _, part := range script {
+			io.WriteString(c.conn, part)
+			c.expect(b, 1)
+		}
+	}
+}
+
+// BenchmarkSessionCommands measure commands per second of a session
+func BenchmarkSessionCommands(b *testing.B) {
+	for _, pipelined := range []bool{false, true} {
+		name := "sequential"
+		if pipelined {
+			name = "pipelined"
+		}
+		b.Run(name, func(b *testing.B) {
+			c := startBenchSession(b, &Config{})
+			b.ReportAllocs()
+			c.run(b, []string{"HELO client.example.com\r\n"}, 1, pipelined)
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "commands/s")
+		})
+	}
+}
+
+// BenchmarkSessionMessages measure messages per second of a session
+// with small and 10MB messages
+func BenchmarkSessionMessages(b *testing.B) {
+	small := "Subject: test\r\n\r\nbody\r\n"
+	var large strings.Builder
+	large.WriteString("Subject: test\r\n\r\n")
+	line := strings.Repeat("x", 76) + "\r\n"
+	for large.Len() < 10<<20 {
+		large.WriteString(line)
+	}
+
+	for _, size := range []struct {
+		name, message string
+	}{{"small", small}, {"10MB", large.String()}} {
+		for _, pipelined := range []bool{false, true} {
+			name := size.name + "/sequential"
+			if pipelined {
+				name = size.name + "/pipelined"
+			}
+			b.Run(name, func(b *testing.B) {
+				c := startBenchSession(b, &Config{
+					Backend: BackendFunc(func(envl *Envelope, data []byte) error { return nil }),
+				})
+				io.WriteString(c.conn, "EHLO client.example.com\r\n")
+				c.expect(b, 1)
+				b.SetBytes(int64(len(size.message)))
+				b.ReportAllocs()
+				c.run(b, []string{
+					"MAIL FROM:<some@example.com>\r\n",
+					"RCPT TO:<some@domain.com>\r\n",
+					"DATA\r\n",
+					size.message + ".\r\n",
+				}, 4, pipelined)
+				b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "messages/s")
+			})
+		}
+	}
+}
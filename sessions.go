@@ -0,0 +1,198 @@
+package session
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// pausedErr is sent to connections while accepting is paused
+var pausedErr = NewSMTPError(421, [3]int{4, 3, 2}, "Service paused, try again later")
+
+// SessionInfo is a snapshot of a live session
+type SessionInfo struct {
+	ID         uint64    `json:"id"`
+	RemoteIP   string    `json:"remote_ip"`
+	State      string    `json:"state"`
+	Helo       string    `json:"helo,omitempty"`
+	Principal  string    `json:"principal,omitempty"`
+	TLS        bool      `json:"tls"`
+	Sender     string    `json:"sender,omitempty"`
+	Recipients []string  `json:"recipients,omitempty"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	Started    time.Time `json:"started"`
+	Duration   float64   `json:"duration_seconds"`
+}
+
+// countConn count bytes read and written on the connection
+type countConn struct {
+	net.Conn
+	in, out atomic.Int64
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.Add(int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.Add(int64(n))
+	return n, err
+}
+
+// liveInfo is the part of the session state shown in SessionInfo,
+// updated by the session after each command. guarded by Session.mu
+type liveInfo struct {
+	remoteIP   string
+	helo       string
+	principal  string
+	sender     string
+	recipients []string
+}
+
+// updateLive copy the session state into s.live
+func (s *Session) updateLive() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.live.remoteIP = remoteIP(s.Conn)
+	s.live.helo = s.HeloName
+	s.live.principal = ""
+	if s.Principal != nil {
+		s.live.principal = s.Principal.Username
+	}
+	s.live.sender, s.live.recipients = "", nil
+	if s.state.inTransaction() && s.envl != nil {
+		s.live.sender = s.envl.OriginatorAddress
+		s.live.recipients = append([]string(nil), s.envl.RecipientAddress...)
+	}
+}
+
+// info return the snapshot of the session
+func (s *Session) info(now time.Time) SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := SessionInfo{
+		ID:         s.serial,
+		RemoteIP:   s.live.remoteIP,
+		State:      s.state.String(),
+		Helo:       s.live.helo,
+		Principal:  s.live.principal,
+		TLS:        s.secure,
+		Sender:     s.live.sender,
+		Recipients: s.live.recipients,
+		Started:    s.started,
+		Duration:   now.Sub(s.started).Seconds(),
+	}
+	if info.RemoteIP == "" {
+		info.RemoteIP = remoteIP(s.raw)
+	}
+	if c, ok := s.raw.(*countConn); ok {
+		info.BytesIn, info.BytesOut = c.in.Load(), c.out.Load()
+	}
+	return info
+}
+
+// Sessions return a snapshot of the live sessions, oldest first
+func (srv *Server) Sessions() []SessionInfo {
+	now := time.Now()
+	srv.mu.Lock()
+	sessions := make([]*Session, 0, len(srv.sessions))
+	for s := range srv.sessions {
+		sessions = append(sessions, s)
+	}
+	srv.mu.Unlock()
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, s.info(now))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Kill close the connection of session id, it report whether the
+// session was found
+func (srv *Server) Kill(id uint64) bool {
+	srv.mu.Lock()
+	var found *Session
+	for s := range srv.sessions {
+		if s.serial == id {
+			found = s
+			break
+		}
+	}
+	srv.mu.Unlock()
+	if found == nil {
+		return false
+	}
+	found.logf(LevelWarn, "killed by administrator")
+	found.raw.Close()
+	return true
+}
+
+// Pause reject new connections with 421 until Resume, live
+// sessions are not affected
+func (srv *Server) Pause() {
+	srv.mu.Lock()
+	srv.paused = true
+	srv.mu.Unlock()
+}
+
+// Resume accept new connections again after Pause
+func (srv *Server) Resume() {
+	srv.mu.Lock()
+	srv.paused = false
+	srv.mu.Unlock()
+}
+
+// Paused report whether accepting is paused
+func (srv *Server) Paused() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.paused
+}
+
+// sessionsStatus is the reply of GET /sessions
+type sessionsStatus struct {
+	Paused   bool          `json:"paused"`
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+// serveSessions handle the sessions endpoints of Admin.
+//
+//	GET    /sessions      live sessions and whether accepting is paused
+//	DELETE /sessions/{id} close the connection of session id
+//	PUT    /pause         reject new connections with 421
+//	DELETE /pause         accept new connections again
+func (a *Admin) serveSessions(w http.ResponseWriter, r *http.Request, path string) {
+	switch {
+	case path == "/sessions" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, sessionsStatus{Paused: a.Server.Paused(), Sessions: a.Server.Sessions()})
+	case strings.HasPrefix(path, "/sessions/") && r.Method == http.MethodDelete:
+		id, err := strconv.ParseUint(strings.TrimPrefix(path, "/sessions/"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid session id", http.StatusBadRequest)
+			return
+		}
+		if !a.Server.Kill(id) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case path == "/pause" && r.Method == http.MethodPut:
+		a.Server.Pause()
+		w.WriteHeader(http.StatusNoContent)
+	case path == "/pause" && r.Method == http.MethodDelete:
+		a.Server.Resume()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,93 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestAdminSessions make sure that live sessions are listed, killed
+// and that accepting is paused and resumed through Admin
+func TestAdminSessions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(nil)
+	go srv.Serve(l)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+	admin := &Admin{Server: srv}
+
+	c := dialTestClient(t, l.Addr().String())
+	c.cmd(t, "EHLO client.com", "250")
+	c.cmd(t, "MAIL FROM:<a@client.com>", "250")
+	c.cmd(t, "RCPT TO:<b@example.com>", "250")
+
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	var status sessionsStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || len(status.Sessions) != 1 {
+		t.Fatalf("got %d %q", rec.Code, rec.Body)
+	}
+	info := status.Sessions[0]
+	if info.RemoteIP != "127.0.0.1" || info.State != "rcpt" || info.Helo != "client.com" ||
+		info.Sender != "a@client.com" || !reflect.DeepEqual(info.Recipients, []string{"b@example.com"}) {
+		t.Errorf("got session %+v", info)
+	}
+	if info.BytesIn == 0 || info.BytesOut == 0 || status.Paused {
+		t.Errorf("got session %+v, paused %v", info, status.Paused)
+	}
+
+	cases := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{http.MethodDelete, "/sessions/x", http.StatusBadRequest},
+		{http.MethodDelete, "/sessions/999", http.StatusNotFound},
+		{http.MethodPost, "/sessions", http.StatusMethodNotAllowed},
+		{http.MethodPut, "/pause", http.StatusNoContent},
+	}
+	for _, input := range cases {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(input.method, input.path, nil))
+		if rec.Code != input.code {
+			t.Errorf("%s %s: got %d, expected %d", input.method, input.path, rec.Code, input.code)
+		}
+	}
+
+	// new connections are rejected while paused, live session is not
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	paused := &testClient{conn: conn, reader: bufio.NewReader(conn)}
+	paused.expect(t, "421 4.3.2 Service paused")
+	c.cmd(t, "RCPT TO:<c@example.com>", "250")
+
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/pause", nil))
+	if rec.Code != http.StatusNoContent || srv.Paused() {
+		t.Errorf("got %d, paused %v", rec.Code, srv.Paused())
+	}
+
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/sessions/1", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("got %d, expected %d", rec.Code, http.StatusNoContent)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.reader.ReadString('\n'); err == nil {
+		t.Errorf("killed session is still connected")
+	}
+}
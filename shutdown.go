@@ -0,0 +1,198 @@
+package session
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// ShutdownStage is a step of Server.Shutdown, stages run in order
+type ShutdownStage int
+
+// stages of Server.Shutdown in the order they run
+const (
+	// ShutdownListeners stop accepting new connections
+	ShutdownListeners ShutdownStage = iota
+	// ShutdownSessions reply 421 to idle sessions and wait for
+	// mail transactions in progress
+	ShutdownSessions
+	// ShutdownWriters flush writers of accepted messages, e.g.
+	// spool and queue writers
+	ShutdownWriters
+	// ShutdownDelivery stop workers started by Server.Start like
+	// the queue runner
+	ShutdownDelivery
+	// ShutdownStores close stores used by the previous stages
+	ShutdownStores
+)
+
+var shutdownStageNames = []string{"listeners", "sessions", "writers", "delivery", "stores"}
+
+func (st ShutdownStage) String() string {
+	if st < 0 || int(st) >= len(shutdownStageNames) {
+		return "unknown"
+	}
+	return shutdownStageNames[st]
+}
+
+// shutdownHook is a function run at a shutdown stage
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// OnShutdown register fn to run at stage of Shutdown, hooks of a
+// stage run in order of registration. fn should return when ctx is
+// done, the stage timeout or the deadline of Shutdown
+func (srv *Server) OnShutdown(stage ShutdownStage, name string, fn func(ctx context.Context) error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.hooks == nil {
+		srv.hooks = make(map[ShutdownStage][]shutdownHook)
+	}
+	srv.hooks[stage] = append(srv.hooks[stage], shutdownHook{name, fn})
+}
+
+// Start run a background worker like Queue.Run or FeedFetcher.Run
+// until ShutdownDelivery stage of Shutdown cancel its context
+func (srv *Server) Start(name string, run func(ctx context.Context)) {
+	srv.mu.Lock()
+	if srv.workerCtx == nil {
+		srv.workerCtx, srv.stopWorkers = context.WithCancel(context.Background())
+	}
+	ctx := srv.workerCtx
+	srv.workers.Add(1)
+	srv.mu.Unlock()
+
+	go func() {
+		defer srv.workers.Done()
+		run(ctx)
+		srv.logf(LevelInfo, "shutdown: worker %s stopped", name)
+	}()
+}
+
+// Shutdown gracefully shut down the server, stage by stage:
+// listeners, sessions, writers, delivery and stores. idle sessions
+// receive 421 and sessions in the middle of mail transaction can
+// finish the transaction. every stage is limited by ctx and by its
+// Config.ShutdownTimeouts, when one is exceeded the remaining
+// connections are closed and the next stages still run, so stores
+// are closed. the first error is returned
+func (srv *Server) Shutdown(ctx context.Context) error {
+	var first error
+	for stage := ShutdownListeners; stage <= ShutdownStores; stage++ {
+		sctx, cancel := ctx, context.CancelFunc(func() {})
+		if d := srv.config().ShutdownTimeouts[stage]; d > 0 {
+			sctx, cancel = context.WithTimeout(ctx, d)
+		}
+		start := time.Now()
+		err := srv.shutdownStage(sctx, stage)
+		cancel()
+		if err != nil {
+			srv.logf(LevelWarn, "shutdown: %s: %v", stage, err)
+			if first == nil {
+				first = err
+			}
+		}
+		srv.logf(LevelInfo, "shutdown: %s done in %v", stage, time.Since(start).Round(time.Millisecond))
+	}
+	return first
+}
+
+// shutdownStage run stage and its hooks
+func (srv *Server) shutdownStage(ctx context.Context, stage ShutdownStage) error {
+	var first error
+	switch stage {
+	case ShutdownListeners:
+		srv.closeListeners()
+	case ShutdownSessions:
+		first = srv.drainSessions(ctx)
+	case ShutdownDelivery:
+		first = srv.stopDelivery(ctx)
+	}
+
+	srv.mu.Lock()
+	hooks := srv.hooks[stage]
+	srv.mu.Unlock()
+	for _, h := range hooks {
+		if err := h.fn(ctx); err != nil {
+			srv.logf(LevelWarn, "shutdown: %s %s: %v", stage, h.name, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// closeListeners stop accepting new connections
+func (srv *Server) closeListeners() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !srv.closing {
+		close(srv.poolStop)
+	}
+	srv.closing = true
+	for l := range srv.listeners {
+		l.Close()
+	}
+}
+
+// drainSessions drain every session and wait until they end, when
+// ctx is done the remaining connections are closed. sessions that
+// don't end on closed connection, e.g. stuck in Backend, are not
+// waited for
+func (srv *Server) drainSessions(ctx context.Context) error {
+	srv.mu.Lock()
+	for s := range srv.sessions {
+		s.drain()
+	}
+	srv.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		srv.mu.Lock()
+		conns := make([]net.Conn, 0, len(srv.sessions))
+		for s := range srv.sessions {
+			s.mu.Lock()
+			conns = append(conns, s.Conn)
+			s.mu.Unlock()
+		}
+		srv.mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return ctx.Err()
+	}
+}
+
+// stopDelivery cancel workers and wait until they return
+func (srv *Server) stopDelivery(ctx context.Context) error {
+	srv.mu.Lock()
+	stop := srv.stopWorkers
+	srv.mu.Unlock()
+	if stop == nil {
+		return nil
+	}
+	stop()
+
+	done := make(chan struct{})
+	go func() {
+		srv.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,134 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestShutdownOrder make sure that stages run in order, workers are
+// stopped at delivery stage and stores are closed after a stage
+// timed out
+func TestShutdownOrder(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	srv := NewServer(&Config{
+		Logger:           NewLogger(&logs),
+		ShutdownTimeouts: map[ShutdownStage]time.Duration{ShutdownSessions: 100 * time.Millisecond},
+	})
+	go srv.Serve(l)
+
+	var mu sync.Mutex
+	var order []string
+	add := func(s string) {
+		mu.Lock()
+		order = append(order, s)
+		mu.Unlock()
+	}
+	hook := func(name string) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			add(name)
+			return nil
+		}
+	}
+	srv.OnShutdown(ShutdownStores, "store", hook("stores"))
+	srv.OnShutdown(ShutdownWriters, "spool", hook("writers"))
+	srv.OnShutdown(ShutdownDelivery, "queue", hook("delivery"))
+	srv.Start("queue", func(ctx context.Context) {
+		<-ctx.Done()
+		add("worker")
+	})
+
+	// session in the middle of transaction exceed the stage timeout
+	c := dialTestClient(t, l.Addr().String())
+	defer c.conn.Close()
+	c.cmd(t, "HELO client.com", "250")
+	c.cmd(t, "MAIL FROM:<some@example.com>", "250")
+
+	start := time.Now()
+	err = srv.Shutdown(context.Background())
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v, expected sessions stage timeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("got shutdown after %v, expected stage timeout", d)
+	}
+	expected := []string{"writers", "worker", "delivery", "stores"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("got %v, expected %v", order, expected)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Errorf("got connection accepted after shutdown")
+	}
+	for _, line := range []string{"warn: shutdown: sessions: context deadline exceeded", "info: shutdown: worker queue stopped", "info: shutdown: stores done in"} {
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("got logs %q, expected %q", logs.String(), line)
+		}
+	}
+}
+
+// TestShutdownStuckSession make sure that Shutdown doesn't wait for
+// a session stuck in Backend after the sessions stage timed out
+func TestShutdownStuckSession(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	received := make(chan struct{})
+	srv := NewServer(&Config{
+		Logger:           NewLogger(io.Discard),
+		ShutdownTimeouts: map[ShutdownStage]time.Duration{ShutdownSessions: 100 * time.Millisecond},
+		Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			close(received)
+			<-release
+			return nil
+		}),
+	})
+	go srv.Serve(l)
+
+	c := dialTestClient(t, l.Addr().String())
+	defer c.conn.Close()
+	c.cmd(t, "HELO client.com", "250")
+	c.cmd(t, "MAIL FROM:<some@example.com>", "250")
+	c.cmd(t, "RCPT TO:<some@domain.com>", "250")
+	c.cmd(t, "DATA", "354")
+	fmt.Fprintf(c.conn, "Subject: test\r\n\r\nbody\r\n.\r\n")
+	<-received
+
+	start := time.Now()
+	if err := srv.Shutdown(context.Background()); err != context.DeadlineExceeded {
+		t.Errorf("got %v, expected sessions stage timeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("got shutdown after %v, expected stage timeout", d)
+	}
+}
+
+// TestShutdownStageString make sure that stages have names
+func TestShutdownStageString(t *testing.T) {
+	cases := []struct {
+		stage    ShutdownStage
+		expected string
+	}{
+		{ShutdownListeners, "listeners"},
+		{ShutdownStores, "stores"},
+		{ShutdownStage(9), "unknown"},
+	}
+	for _, input := range cases {
+		if got := input.stage.String(); got != input.expected {
+			t.Errorf("%d: got %q, expected %q", input.stage, got, input.expected)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sieve actions (RFC 5228, RFC 5230)
+const (
+	SieveKeep     = "keep"
+	SieveFileInto = "fileinto"
+	SieveDiscard  = "discard"
+	SieveRedirect = "redirect"
+	SieveVacation = "vacation"
+)
+
+// default vacation interval of Sieve
+const defaultVacationDays = 7
+
+// SieveAction is an action taken by a Sieve script
+type SieveAction struct {
+	// Type is SieveKeep, SieveFileInto, SieveDiscard, SieveRedirect
+	// or SieveVacation
+	Type string
+	// Mailbox is the folder of fileinto
+	Mailbox string
+	// Address is the destination of redirect
+	Address string
+	// Subject, Reason and Days are the vacation reply and the
+	// interval between replies to the same sender
+	Subject string
+	Reason  string
+	Days    int
+}
+
+// SieveInterpreter run Sieve scripts, wrap a Sieve implementation
+// to use it. the returned actions cancel the implicit keep like RFC
+// 5228 except vacation, no action keep the message
+type SieveInterpreter interface {
+	Run(ctx context.Context, script []byte, envl *Envelope, rcpt string, data []byte) ([]*SieveAction, error)
+}
+
+// SieveStore return the active script of recipient, nil script
+// deliver the message without filtering
+type SieveStore interface {
+	Script(ctx context.Context, rcpt string) ([]byte, error)
+}
+
+// SieveDir is a SieveStore reading Root/domain/local.sieve
+type SieveDir struct {
+	Root string
+}
+
+// Script implements SieveStore
+func (d *SieveDir) Script(ctx context.Context, rcpt string) ([]byte, error) {
+	i := strings.LastIndex(rcpt, "@")
+	if i <= 0 {
+		return nil, nil
+	}
+	local, domain := strings.ToLower(rcpt[:i]), strings.ToLower(rcpt[i+1:])
+	for _, part := range []string{local, domain} {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "/\\\x00") {
+			return nil, nil
+		}
+	}
+	script, err := os.ReadFile(filepath.Join(d.Root, domain, local+".sieve"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return script, err
+}
+
+// Sieve run the Sieve script of each recipient between acceptance
+// and delivery. fileinto deliver with Envelope.Folder, redirect and
+// vacation replies are sent through Outbound. a failing script keep
+// the message
+type Sieve struct {
+	Store       SieveStore
+	Interpreter SieveInterpreter
+	// Outbound deliver redirected messages and vacation replies,
+	// e.g. Queue. they are dropped when nil
+	Outbound Backend
+
+	mu      sync.Mutex
+	replied map[string]time.Time
+}
+
+// sieveEnvelope return copy of envl for rcpt delivered into folder
+func sieveEnvelope(envl *Envelope, rcpt, folder string) *Envelope {
+	e := *envl
+	e.RecipientAddress = []string{rcpt}
+	e.Folder = folder
+	return &e
+}
+
+// Filter run the scripts and return the envelopes to deliver, the
+// recipients without script are kept in one envelope
+func (sv *Sieve) Filter(ctx context.Context, envl *Envelope, data []byte) []*Envelope {
+	var envls []*Envelope
+	var plain []string
+	for _, rcpt := range envl.RecipientAddress {
+		script, err := sv.Store.Script(ctx, rcpt)
+		if err != nil || script == nil {
+			plain = append(plain, rcpt)
+			continue
+		}
+		actions, err := sv.Interpreter.Run(ctx, script, envl, rcpt, data)
+		if err != nil {
+			plain = append(plain, rcpt)
+			continue
+		}
+
+		keep := true
+		for _, a := range actions {
+			switch a.Type {
+			case SieveKeep:
+				envls = append(envls, sieveEnvelope(envl, rcpt, ""))
+			case SieveFileInto:
+				envls = append(envls, sieveEnvelope(envl, rcpt, a.Mailbox))
+			case SieveRedirect:
+				sv.send(&Envelope{ID: newID(), OriginatorAddress: envl.OriginatorAddress, RecipientAddress: []string{a.Address}}, data)
+			case SieveVacation:
+				sv.vacation(envl, rcpt, a, data)
+				continue
+			}
+			keep = false
+		}
+		if keep {
+			plain = append(plain, rcpt)
+		}
+	}
+	if len(plain) > 0 {
+		e := *envl
+		e.RecipientAddress = plain
+		envls = append([]*Envelope{&e}, envls...)
+	}
+	return envls
+}
+
+// send deliver message through Outbound
+func (sv *Sieve) send(envl *Envelope, data []byte) {
+	if sv.Outbound != nil {
+		sv.Outbound.Deliver(envl, data)
+	}
+}
+
+// vacation send the vacation reply of rcpt once per interval to
+// each sender, never to automatic and list messages (RFC 5230)
+func (sv *Sieve) vacation(envl *Envelope, rcpt string, a *SieveAction, data []byte) {
+	sender := envl.OriginatorAddress
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if sender == "" || err != nil {
+		return
+	}
+	h := msg.Header
+	if as := h.Get("Auto-Submitted"); as != "" && !strings.EqualFold(as, "no") {
+		return
+	}
+	switch strings.ToLower(h.Get("Precedence")) {
+	case "bulk", "list", "junk":
+		return
+	}
+	if h.Get("List-Id") != "" {
+		return
+	}
+
+	days := a.Days
+	if days <= 0 {
+		days = defaultVacationDays
+	}
+	key := strings.ToLower(rcpt) + "\x00" + strings.ToLower(sender)
+	now := time.Now()
+	sv.mu.Lock()
+	if t, ok := sv.replied[key]; ok && now.Sub(t) < time.Duration(days)*24*time.Hour {
+		sv.mu.Unlock()
+		return
+	}
+	if sv.replied == nil {
+		sv.replied = make(map[string]time.Time)
+	}
+	sv.replied[key] = now
+	sv.mu.Unlock()
+
+	subject := a.Subject
+	if subject == "" {
+		subject = "Auto: " + h.Get("Subject")
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: <%s>\r\n", rcpt)
+	fmt.Fprintf(&b, "To: <%s>\r\n", sender)
+	fmt.Fprintf(&b, "Subject: %s\r\n", foldedValue(subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	if id := h.Get("Message-Id"); id != "" {
+		fmt.Fprintf(&b, "In-Reply-To: %s\r\nReferences: %s\r\n", id, id)
+	}
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied (vacation)\r\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.Replace(strings.Replace(a.Reason, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	b.WriteString("\r\n")
+
+	// replies use the null sender to avoid loops
+	sv.send(&Envelope{ID: newID(), RecipientAddress: []string{sender}}, b.Bytes())
+}
+
+// sieveDeliver deliver the envelopes filtered by Config.Sieve. the
+// failures are returned as RecipientErrors
+func (s *Session) sieveDeliver(envl *Envelope, data []byte) error {
+	errs := make(RecipientErrors)
+	for _, e := range s.Config.Sieve.Filter(envl.Context(), envl, data) {
+		err := s.Config.Backend.Deliver(e, data)
+		if rerrs, ok := err.(RecipientErrors); ok {
+			for rcpt, rerr := range rerrs {
+				errs[rcpt] = rerr
+			}
+		} else if err != nil {
+			for _, rcpt := range e.RecipientAddress {
+				errs[rcpt] = err
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
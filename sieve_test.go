@@ -0,0 +1,141 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lineSieve is a SieveInterpreter running one action per line of
+// the script like "fileinto Work" or "vacation Out of office"
+type lineSieve struct{}
+
+func (lineSieve) Run(ctx context.Context, script []byte, envl *Envelope, rcpt string, data []byte) ([]*SieveAction, error) {
+	var actions []*SieveAction
+	for _, line := range strings.Split(strings.TrimSpace(string(script)), "\n") {
+		f := strings.SplitN(line, " ", 2)
+		a := &SieveAction{Type: f[0]}
+		switch f[0] {
+		case SieveFileInto:
+			a.Mailbox = f[1]
+		case SieveRedirect:
+			a.Address = f[1]
+		case SieveVacation:
+			a.Reason = f[1]
+		case SieveKeep, SieveDiscard:
+		default:
+			return nil, errors.New("syntax error")
+		}
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
+
+// TestSieveDir make sure that scripts are read from Root/domain/local.sieve
+func TestSieveDir(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "example.com"), 0700)
+	os.WriteFile(filepath.Join(root, "example.com", "user.sieve"), []byte("discard"), 0600)
+	d := &SieveDir{Root: root}
+
+	cases := []struct {
+		rcpt     string
+		expected string
+	}{
+		{"User@Example.com", "discard"},
+		{"other@example.com", ""},
+		{"../user@example.com", ""},
+		{"postmaster", ""},
+	}
+
+	for _, input := range cases {
+		got, err := d.Script(context.Background(), input.rcpt)
+		if err != nil || string(got) != input.expected {
+			t.Errorf("%s: got %q %v, expected %q", input.rcpt, got, err, input.expected)
+		}
+	}
+}
+
+// TestSessionSieve make sure that scripts of each recipient decide
+// the folders, redirects and vacation replies
+func TestSessionSieve(t *testing.T) {
+	scripts := map[string]string{
+		"work@example.com":     "fileinto Work",
+		"trash@example.com":    "discard",
+		"fwd@example.com":      "redirect other@example.org",
+		"both@example.com":     "keep\nfileinto Archive",
+		"away@example.com":     "vacation Out of office",
+		"broken@example.com":   "frobnicate",
+		"vacation@example.com": "vacation Gone\nfileinto Later",
+	}
+	store := sieveStoreFunc(func(rcpt string) []byte {
+		if s, ok := scripts[rcpt]; ok {
+			return []byte(s)
+		}
+		return nil
+	})
+
+	var delivered, outbound []string
+	config := &Config{
+		Sieve: &Sieve{Store: store, Interpreter: lineSieve{}, Outbound: BackendFunc(func(envl *Envelope, data []byte) error {
+			outbound = append(outbound, "<"+envl.OriginatorAddress+">"+strings.Join(envl.RecipientAddress, ","))
+			return nil
+		})},
+		Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			delivered = append(delivered, strings.Join(envl.RecipientAddress, ",")+"/"+envl.Folder)
+			return nil
+		}),
+	}
+
+	cases := []struct {
+		rcpts     []string
+		headers   string
+		delivered string
+		outbound  string
+	}{
+		{[]string{"plain@example.com", "plain2@example.com"}, "", "plain@example.com,plain2@example.com/", ""},
+		{[]string{"plain@example.com", "work@example.com"}, "", "plain@example.com/ work@example.com/Work", ""},
+		{[]string{"trash@example.com"}, "", "", ""},
+		{[]string{"fwd@example.com"}, "", "", "<sender@example.net>other@example.org"},
+		{[]string{"both@example.com"}, "", "both@example.com/ both@example.com/Archive", ""},
+		{[]string{"away@example.com"}, "", "away@example.com/", "<>sender@example.net"},
+		{[]string{"away@example.com"}, "", "away@example.com/", ""},
+		{[]string{"vacation@example.com"}, "Precedence: bulk\r\n", "vacation@example.com/Later", ""},
+		{[]string{"broken@example.com"}, "", "broken@example.com/", ""},
+	}
+
+	for _, input := range cases {
+		delivered, outbound = nil, nil
+		cmds := "HELO client\r\nMAIL FROM:<sender@example.net>\r\n"
+		for _, rcpt := range input.rcpts {
+			cmds += "RCPT TO:<" + rcpt + ">\r\n"
+		}
+		out := runSession(t, config, cmds+"DATA\r\n"+input.headers+"Subject: hi\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+		if !strings.Contains(out, "250 2.0.0") {
+			t.Errorf("%v: got %q, expected message accepted", input.rcpts, out)
+		}
+		if got := strings.Join(delivered, " "); got != input.delivered {
+			t.Errorf("%v: got delivered %q, expected %q", input.rcpts, got, input.delivered)
+		}
+		if got := strings.Join(outbound, " "); got != input.outbound {
+			t.Errorf("%v: got outbound %q, expected %q", input.rcpts, got, input.outbound)
+		}
+	}
+	// scripts run for StreamBackend too
+	b := &streamRecorder{}
+	config.Backend = b
+	runSession(t, config, "HELO client\r\nMAIL FROM:<sender@example.net>\r\nRCPT TO:<trash@example.com>\r\nDATA\r\nSubject: hi\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+	if b.streamed+b.buffered != 0 {
+		t.Errorf("stream: got %d streamed %d buffered, expected discarded message", b.streamed, b.buffered)
+	}
+}
+
+// sieveStoreFunc is a SieveStore of a function
+type sieveStoreFunc func(rcpt string) []byte
+
+func (f sieveStoreFunc) Script(ctx context.Context, rcpt string) ([]byte, error) {
+	return f(rcpt), nil
+}
@@ -0,0 +1,77 @@
+package session
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Simulation run a policy or filter in simulate mode: its would-be
+// rejections are logged and counted but never enforced, so false
+// positives can be measured before the rule is enabled. it is added
+// to Config.Policies or Config.Filters in place of the rule
+type Simulation struct {
+	// Name identify the rule in logs and metrics
+	Name string
+
+	policy Policy
+	rule   Filter
+
+	checks uint64
+	hits   uint64
+}
+
+// Simulate return policy p in simulate mode
+func Simulate(name string, p Policy) *Simulation {
+	return &Simulation{Name: name, policy: p}
+}
+
+// SimulateFilter return filter f in simulate mode
+func SimulateFilter(name string, f Filter) *Simulation {
+	return &Simulation{Name: name, rule: f}
+}
+
+// Stats return the number of checks and would-be rejections
+func (sim *Simulation) Stats() (checks, hits uint64) {
+	return atomic.LoadUint64(&sim.checks), atomic.LoadUint64(&sim.hits)
+}
+
+// record count a check and log the would-be verdict err
+func (sim *Simulation) record(s *Session, stage Stage, err error) {
+	atomic.AddUint64(&sim.checks, 1)
+	if err == nil {
+		return
+	}
+	atomic.AddUint64(&sim.hits, 1)
+	e := replyErr(err)
+	// verdicts outside of sessions are only counted
+	if s == nil {
+		return
+	}
+	s.logf(LevelInfo, "simulate %s: would reject %s: %v", sim.Name, stage, e)
+	s.Config.Metrics.add("smtp_simulated_rejections_total", 1, []label{{"rule", sim.Name}, {"stage", string(stage)}}, s.metricLabels(nil))
+}
+
+// Check run the policy and record its verdict, always return nil
+func (sim *Simulation) Check(ctx context.Context, req *PolicyRequest) error {
+	if sim.policy == nil {
+		return nil
+	}
+	sim.record(req.Session, req.Stage, sim.policy.Check(ctx, req))
+	return nil
+}
+
+// Filter run the filter on a copy of data and record its verdict,
+// data is returned unchanged
+func (sim *Simulation) Filter(envl *Envelope, data []byte) ([]byte, error) {
+	sim.simulateFilter(nil, envl, data)
+	return data, nil
+}
+
+// simulateFilter run the filter of session s
+func (sim *Simulation) simulateFilter(s *Session, envl *Envelope, data []byte) {
+	if sim.rule == nil {
+		return
+	}
+	_, err := sim.rule.Filter(envl, append([]byte(nil), data...))
+	sim.record(s, StageData, err)
+}
@@ -0,0 +1,66 @@
+package session
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestSimulation make sure that policies and filters in simulate mode
+// are counted but never reject or rewrite messages
+func TestSimulation(t *testing.T) {
+	var delivered []byte
+	metrics := &Metrics{}
+	config := &Config{
+		Metrics: metrics,
+		Filters: []Filter{SimulateFilter("spam", FilterFunc(func(envl *Envelope, data []byte) ([]byte, error) {
+			return prependHeader(data, "X-Spam", "yes"), errors.New("spam")
+		}))},
+		Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			delivered = data
+			return nil
+		}),
+	}
+	err := config.LoadPlugins([]PluginSpec{
+		{Kind: PluginPolicy, Name: "test-deny", Options: Options{"prefix": "blocked"}, Simulate: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := runSession(t, config, "EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<blocked@domain.com>\r\n"+
+		"RCPT TO:<some@domain.com>\r\nDATA\r\nSubject: test\r\n\r\n.\r\nQUIT\r\n")
+	if strings.Contains(out, "550") || !strings.Contains(out, "250 2.0.0 OK: queued as ") {
+		t.Errorf("got %q, expected every command accepted", out)
+	}
+	if string(delivered) != "Subject: test\r\n\r\n" {
+		t.Errorf("got delivered %q, expected message unchanged", delivered)
+	}
+
+	cases := []struct {
+		sim    *Simulation
+		checks uint64
+		hits   uint64
+	}{
+		{config.Policies[0].(*Simulation), 5, 1},
+		{config.Filters[0].(*Simulation), 1, 1},
+	}
+	for _, input := range cases {
+		checks, hits := input.sim.Stats()
+		if checks != input.checks || hits != input.hits {
+			t.Errorf("%s: got %d checks %d hits, expected %d %d", input.sim.Name, checks, hits, input.checks, input.hits)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, expected := range []string{
+		`smtp_simulated_rejections_total{rule="test-deny",stage="rcpt"} 1`,
+		`smtp_simulated_rejections_total{rule="spam",stage="data"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), expected) {
+			t.Errorf("got metrics %q, expected %q", rec.Body.String(), expected)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+// Package smtptest provides an in-memory SMTP harness to test
+// backends, policies and configurations of session without sockets.
+//
+// Server run a session.Server on a listener of net.Pipe connections
+// and Client talk to it line by line:
+//
+//	srv := smtptest.NewServer(t, &session.Config{Backend: backend})
+//	c := srv.Dial(t)
+//	c.Expect("EHLO client.example", 250)
+//	c.Expect("MAIL FROM:<a@example.com>", 250)
+//	c.Expect("RCPT TO:<b@example.com>", 250)
+//	c.Data("Subject: hi\r\n\r\nhello\r\n").AssertCode(t, 250)
+//
+// or run a whole script of commands and expected replies:
+//
+//	c.Script(`
+//	C: EHLO client.example
+//	S: 250
+//	C: RCPT TO:<b@example.com>
+//	S: 503 5.5.1
+//	`)
+package smtptest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pyk/session"
+)
+
+// DefaultRemote is the address of clients of Server.Dial, taken from
+// the documentation range of RFC 5737
+const DefaultRemote = "192.0.2.1:49152"
+
+// DefaultTimeout is the timeout of Client waiting for a reply
+const DefaultTimeout = 5 * time.Second
+
+// maxPending is the number of reply lines read ahead by Client, so
+// the server doesn't block on pipelined replies of net.Pipe
+const maxPending = 4096
+
+// errListenerClosed is returned by Accept and Dial after Close
+var errListenerClosed = errors.New("smtptest: listener closed")
+
+// Listener is a net.Listener of in-memory connections made by Dial
+type Listener struct {
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+// NewListener create a listener of in-memory connections
+func NewListener() *Listener {
+	return &Listener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// Accept wait for the next connection made by Dial
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+// Close stop Accept and Dial
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr return the address of the server side of connections
+func (l *Listener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25}
+}
+
+// Dial connect to the listener from remote, an "ip:port" address
+func (l *Listener) Dial(remote string) (net.Conn, error) {
+	addr, err := net.ResolveTCPAddr("tcp", remote)
+	if err != nil {
+		return nil, err
+	}
+	server, client := net.Pipe()
+	select {
+	case l.conns <- &conn{Conn: server, local: l.Addr(), remote: addr}:
+		return client, nil
+	case <-l.done:
+		server.Close()
+		client.Close()
+		return nil, errListenerClosed
+	}
+}
+
+// conn is the server side of in-memory connection with TCP addresses
+type conn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+// Server is a session.Server serving in-memory connections
+type Server struct {
+	*session.Server
+	Listener *Listener
+
+	mu      sync.Mutex
+	clients []*Client
+	served  chan error
+}
+
+// NewServer start serving config, the server is shut down when the
+// test and its subtests are done
+func NewServer(t testing.TB, config *session.Config) *Server {
+	srv := &Server{
+		Server:   session.NewServer(config),
+		Listener: NewListener(),
+		served:   make(chan error, 1),
+	}
+	go func() { srv.served <- srv.Server.Serve(srv.Listener) }()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Dial connect a client from DefaultRemote and read the greeting
+func (srv *Server) Dial(t testing.TB) *Client {
+	t.Helper()
+	return srv.DialFrom(t, DefaultRemote)
+}
+
+// DialFrom connect a client from remote, an "ip:port" address, and
+// read the greeting
+func (srv *Server) DialFrom(t testing.TB, remote string) *Client {
+	t.Helper()
+	nc, err := srv.Listener.Dial(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(t, nc)
+	srv.mu.Lock()
+	srv.clients = append(srv.clients, c)
+	srv.mu.Unlock()
+	c.Reply().AssertCode(t, 220)
+	return c
+}
+
+// Close disconnect the clients and shut down the server
+func (srv *Server) Close() {
+	srv.mu.Lock()
+	clients := srv.clients
+	srv.clients = nil
+	srv.mu.Unlock()
+	for _, c := range clients {
+		c.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	srv.Server.Shutdown(ctx)
+	srv.Listener.Close()
+}
+
+// Reply is a reply of the server
+type Reply struct {
+	Code int
+	// Lines are the texts following the code of each line
+	Lines []string
+}
+
+// String return the reply as sent, lines separated by "\n"
+func (r *Reply) String() string {
+	lines := make([]string, len(r.Lines))
+	for i, line := range r.Lines {
+		sep := "-"
+		if i == len(r.Lines)-1 {
+			sep = " "
+		}
+		lines[i] = strconv.Itoa(r.Code) + sep + line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Enhanced return the enhanced status code of the reply like
+// "2.1.0", "" when there is none
+func (r *Reply) Enhanced() string {
+	if len(r.Lines) == 0 {
+		return ""
+	}
+	word, _, _ := strings.Cut(r.Lines[0], " ")
+	parts := strings.Split(word, ".")
+	if len(parts) != 3 || !strings.HasPrefix(strconv.Itoa(r.Code), parts[0]) {
+		return ""
+	}
+	for _, p := range parts {
+		if _, err := strconv.Atoi(p); err != nil {
+			return ""
+		}
+	}
+	return word
+}
+
+// Has report whether a line of the reply start with prefix, e.g. an
+// EHLO keyword
+func (r *Reply) Has(prefix string) bool {
+	for _, line := range r.Lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// AssertCode fail the test when the reply code isn't code
+func (r *Reply) AssertCode(t testing.TB, code int) *Reply {
+	t.Helper()
+	if r.Code != code {
+		t.Fatalf("got reply %q, expected code %d", r, code)
+	}
+	return r
+}
+
+// AssertEnhanced fail the test when the enhanced status code isn't
+// enhanced like "5.7.1"
+func (r *Reply) AssertEnhanced(t testing.TB, enhanced string) *Reply {
+	t.Helper()
+	if got := r.Enhanced(); got != enhanced {
+		t.Fatalf("got reply %q, expected enhanced code %s", r, enhanced)
+	}
+	return r
+}
+
+// Client is the SMTP client side of a connection
+type Client struct {
+	// Timeout of reading a reply, default to DefaultTimeout
+	Timeout time.Duration
+
+	t     testing.TB
+	conn  net.Conn
+	lines chan string
+	err   error
+}
+
+// NewClient create a client of conn, failures of its methods fail t.
+// replies are read ahead as net.Pipe has no buffer
+func NewClient(t testing.TB, conn net.Conn) *Client {
+	c := &Client{t: t, conn: conn, lines: make(chan string, maxPending)}
+	go c.readLines()
+	return c
+}
+
+// readLines read reply lines into c.lines until the connection fail
+func (c *Client) readLines() {
+	r := bufio.NewReader(c.conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			c.err = err
+			close(c.lines)
+			return
+		}
+		c.lines <- strings.TrimRight(line, "\r\n")
+	}
+}
+
+// readLine return the next reply line
+func (c *Client) readLine() (string, error) {
+	timer := time.NewTimer(c.timeout())
+	defer timer.Stop()
+	select {
+	case line, ok := <-c.lines:
+		if !ok {
+			return "", c.err
+		}
+		return line, nil
+	case <-timer.C:
+		return "", errors.New("smtptest: reply timeout")
+	}
+}
+
+// Send write line ended with CRLF without waiting for the reply,
+// e.g. to pipeline commands
+func (c *Client) Send(line string) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout()))
+	if _, err := fmt.Fprintf(c.conn, "%s\r\n", line); err != nil {
+		c.t.Fatalf("send %q: %v", line, err)
+	}
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return c.Timeout
+}
+
+// ReadReply read the next reply, multiline replies included
+func (c *Client) ReadReply() (*Reply, error) {
+	r := &Reply{}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 3 {
+			return nil, fmt.Errorf("smtptest: malformed reply %q", line)
+		}
+		code, err := strconv.Atoi(line[:3])
+		if err != nil || (r.Code != 0 && code != r.Code) {
+			return nil, fmt.Errorf("smtptest: malformed reply %q", line)
+		}
+		r.Code = code
+		if len(line) == 3 {
+			r.Lines = append(r.Lines, "")
+			return r, nil
+		}
+		r.Lines = append(r.Lines, line[4:])
+		switch line[3] {
+		case ' ':
+			return r, nil
+		case '-':
+		default:
+			return nil, fmt.Errorf("smtptest: malformed reply %q", line)
+		}
+	}
+}
+
+// Reply read the next reply, a failure fail the test
+func (c *Client) Reply() *Reply {
+	c.t.Helper()
+	r, err := c.ReadReply()
+	if err != nil {
+		c.t.Fatalf("read reply: %v", err)
+	}
+	return r
+}
+
+// Cmd send line and read its reply
+func (c *Client) Cmd(line string) *Reply {
+	c.t.Helper()
+	c.Send(line)
+	return c.Reply()
+}
+
+// Expect send line and fail the test when its reply code isn't code
+func (c *Client) Expect(line string, code int) *Reply {
+	c.t.Helper()
+	r := c.Cmd(line)
+	if r.Code != code {
+		c.t.Fatalf("%s: got reply %q, expected code %d", line, r, code)
+	}
+	return r
+}
+
+// Data send DATA and, when the server is ready, the message with
+// leading dots doubled and the end of data. it return the reply of
+// DATA when the server refused it, otherwise the reply of the message
+func (c *Client) Data(message string) *Reply {
+	c.t.Helper()
+	if r := c.Cmd("DATA"); r.Code != 354 {
+		return r
+	}
+	if message != "" && !strings.HasSuffix(message, "\r\n") {
+		message += "\r\n"
+	}
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(message, "\r\n") {
+		if strings.HasPrefix(line, ".") {
+			b.WriteByte('.')
+		}
+		b.WriteString(line)
+	}
+	b.WriteString(".")
+	return c.Cmd(b.String())
+}
+
+// Script run the exchange of script, one line per command prefixed
+// with "C: " and one line per expected reply prefixed with "S: ",
+// which must be a prefix of the last line of the reply like "250" or
+// "550 5.1.1". commands not followed by a reply are pipelined, blank
+// lines are ignored
+func (c *Client) Script(script string) {
+	c.t.Helper()
+	for i, line := range strings.Split(script, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "C: "):
+			c.Send(line[3:])
+		case strings.HasPrefix(line, "S: "):
+			r := c.Reply()
+			last := strconv.Itoa(r.Code) + " " + r.Lines[len(r.Lines)-1]
+			if !strings.HasPrefix(last, line[3:]) {
+				c.t.Fatalf("script line %d: got reply %q, expected %q", i+1, r, line[3:])
+			}
+		default:
+			c.t.Fatalf("script line %d: %q is neither C: nor S:", i+1, line)
+		}
+	}
+}
+
+// Close close the connection without QUIT
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
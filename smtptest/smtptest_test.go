@@ -0,0 +1,67 @@
+package smtptest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pyk/session"
+)
+
+// TestServer make sure that a message is delivered through the
+// in-memory server and replies are parsed
+func TestServer(t *testing.T) {
+	var received []string
+	srv := NewServer(t, &session.Config{
+		Backend: session.BackendFunc(func(envl *session.Envelope, data []byte) error {
+			received = append(received, string(data))
+			return nil
+		}),
+	})
+
+	c := srv.Dial(t)
+	ehlo := c.Expect("EHLO client.example", 250)
+	if !ehlo.Has("ENHANCEDSTATUSCODES") || len(ehlo.Lines) < 2 {
+		t.Errorf("got EHLO reply %q, expected extensions", ehlo)
+	}
+	c.Expect("MAIL FROM:<a@example.com>", 250).AssertEnhanced(t, "2.0.0")
+	c.Expect("RCPT TO:<b@example.net>", 250)
+	c.Data("Subject: hi\r\n\r\n.hidden\r\n").AssertCode(t, 250)
+	c.Expect("QUIT", 221)
+
+	if len(received) != 1 || !strings.HasSuffix(received[0], "\r\n.hidden\r\n") {
+		t.Errorf("got received %q, expected message with unstuffed dot", received)
+	}
+}
+
+// TestScript make sure that scripts pipeline commands and check the
+// replies in order
+func TestScript(t *testing.T) {
+	srv := NewServer(t, nil)
+	c := srv.DialFrom(t, "198.51.100.7:2525")
+	c.Script(`
+		C: EHLO client.example
+		S: 250
+		C: RCPT TO:<b@example.net>
+		C: HELP
+		S: 503 5.5.1
+		S: 214
+	`)
+}
+
+func TestReplyEnhanced(t *testing.T) {
+	cases := []struct {
+		reply    Reply
+		expected string
+	}{
+		{Reply{250, []string{"2.1.0 OK"}}, "2.1.0"},
+		{Reply{550, []string{"5.7.1 Relaying denied"}}, "5.7.1"},
+		{Reply{250, []string{"mx.example.com greets client"}}, ""},
+		{Reply{550, []string{"2.1.0 OK"}}, ""},
+		{Reply{354, []string{"Go ahead"}}, ""},
+	}
+	for _, input := range cases {
+		if got := input.reply.Enhanced(); got != input.expected {
+			t.Errorf("%q: got %q, expected %q", input.reply.String(), got, input.expected)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// default timeout of spam checks
+const defaultSpamTimeout = 10 * time.Second
+
+// actions of SpamVerdict, named after Rspamd actions
+const (
+	SpamNoAction       = "no action"
+	SpamGreylist       = "greylist"
+	SpamAddHeader      = "add header"
+	SpamRewriteSubject = "rewrite subject"
+	SpamSoftReject     = "soft reject"
+	SpamReject         = "reject"
+)
+
+var (
+	spamRejectErr     = NewSMTPError(550, [3]int{5, 7, 1}, "Message rejected as spam")
+	spamSoftRejectErr = NewSMTPError(451, [3]int{4, 7, 1}, "Message deferred, try again later")
+	spamGreylistErr   = NewSMTPError(451, [3]int{4, 7, 1}, "Greylisted, try again later")
+)
+
+// SpamVerdict is the result of a spam check
+type SpamVerdict struct {
+	Action    string
+	Score     float64
+	Threshold float64
+	Symbols   []string
+	// Subject is the rewritten subject with SpamRewriteSubject
+	Subject string
+}
+
+// SpamChecker scan message data for spam
+type SpamChecker interface {
+	CheckSpam(ctx context.Context, envl *Envelope, data []byte) (*SpamVerdict, error)
+}
+
+// SpamFilter is a Filter acting on the verdict of Checker: messages
+// are rejected, deferred or tagged with X-Spam-Status, and the
+// subject rewritten. add it to Config.Filters of each listener that
+// should be checked
+type SpamFilter struct {
+	Checker SpamChecker
+	// Timeout of the check, default to 10 seconds
+	Timeout time.Duration
+	// FailOpen accept the message untagged when the check fail,
+	// otherwise it is deferred
+	FailOpen bool
+	// Logger receive the errors of fail open checks, default to
+	// the standard logger
+	Logger *Logger
+}
+
+// Filter check data and act on the verdict
+func (f *SpamFilter) Filter(envl *Envelope, data []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), durationOr(f.Timeout, defaultSpamTimeout))
+	defer cancel()
+	v, err := f.Checker.CheckSpam(ctx, envl, data)
+	// X-Spam-Status of the sender can't be trusted
+	data = removeHeader(data, "X-Spam-Status")
+	if err != nil {
+		if f.FailOpen {
+			logf(f.Logger, LevelWarn, "spam: %v", err)
+			return data, nil
+		}
+		return nil, err
+	}
+
+	switch v.Action {
+	case SpamReject:
+		return nil, spamRejectErr
+	case SpamSoftReject:
+		return nil, spamSoftRejectErr
+	case SpamGreylist:
+		return nil, spamGreylistErr
+	case SpamRewriteSubject:
+		if v.Subject != "" {
+			data = prependHeader(removeHeader(data, "Subject"), "Subject", v.Subject)
+		}
+	}
+	return prependHeader(data, "X-Spam-Status", v.status()), nil
+}
+
+// status return the value of X-Spam-Status header field
+func (v *SpamVerdict) status() string {
+	spam := "No"
+	if v.Action == SpamAddHeader || v.Action == SpamRewriteSubject {
+		spam = "Yes"
+	}
+	s := fmt.Sprintf("%s, score=%.2f required=%.2f", spam, v.Score, v.Threshold)
+	if len(v.Symbols) > 0 {
+		s += " tests=" + strings.Join(v.Symbols, ",")
+	}
+	return s
+}
+
+// Rspamd is a SpamChecker using the HTTP API of Rspamd
+// (https://rspamd.com/doc/developers/protocol.html)
+type Rspamd struct {
+	// URL of the controller or normal worker, e.g.
+	// "http://localhost:11333"
+	URL      string
+	Password string
+	// Client default to http.DefaultClient
+	Client *http.Client
+}
+
+// rspamdResult is the reply of /checkv2
+type rspamdResult struct {
+	Action        string                     `json:"action"`
+	Score         float64                    `json:"score"`
+	RequiredScore float64                    `json:"required_score"`
+	Subject       string                     `json:"subject"`
+	Symbols       map[string]json.RawMessage `json:"symbols"`
+}
+
+// CheckSpam post data to /checkv2
+func (r *Rspamd) CheckSpam(ctx context.Context, envl *Envelope, data []byte) (*SpamVerdict, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(r.URL, "/")+"/checkv2", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("From", envl.OriginatorAddress)
+	for _, rcpt := range envl.RecipientAddress {
+		req.Header.Add("Rcpt", rcpt)
+	}
+	if r.Password != "" {
+		req.Header.Set("Password", r.Password)
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rspamd: %s", resp.Status)
+	}
+	var res rspamdResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	v := &SpamVerdict{Action: res.Action, Score: res.Score, Threshold: res.RequiredScore, Subject: res.Subject}
+	for name := range res.Symbols {
+		v.Symbols = append(v.Symbols, name)
+	}
+	sort.Strings(v.Symbols)
+	return v, nil
+}
+
+// errSpamd is returned for malformed spamd replies
+var errSpamd = errors.New("spamd: invalid reply")
+
+// SpamAssassin is a SpamChecker using the spamd protocol. spam is
+// tagged, or rejected from RejectScore when it is positive
+type SpamAssassin struct {
+	// Addr of spamd, default to "localhost:783"
+	Addr string
+	// User is the user whose preferences are used
+	User        string
+	RejectScore float64
+}
+
+// CheckSpam send SYMBOLS request to spamd
+func (sa *SpamAssassin) CheckSpam(ctx context.Context, envl *Envelope, data []byte) (*SpamVerdict, error) {
+	addr := sa.Addr
+	if addr == "" {
+		addr = "localhost:783"
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "SYMBOLS SPAMC/1.5\r\nContent-length: %d\r\n", len(data))
+	if sa.User != "" {
+		fmt.Fprintf(w, "User: %s\r\n", sa.User)
+	}
+	w.WriteString("\r\n")
+	w.Write(data)
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	// SPAMD/1.1 0 EX_OK
+	if f := strings.Fields(line); len(f) < 2 || f[1] != "0" {
+		return nil, fmt.Errorf("spamd: %s", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	v, err := parseSpamdHeader(header.Get("Spam"))
+	if err != nil {
+		return nil, err
+	}
+	body, _ := io.ReadAll(tp.R)
+	for _, sym := range strings.Split(strings.TrimSpace(string(body)), ",") {
+		if sym != "" {
+			v.Symbols = append(v.Symbols, sym)
+		}
+	}
+	if v.Action == SpamAddHeader && sa.RejectScore > 0 && v.Score >= sa.RejectScore {
+		v.Action = SpamReject
+	}
+	return v, nil
+}
+
+// parseSpamdHeader parse "True ; 15.0 / 5.0"
+func parseSpamdHeader(value string) (*SpamVerdict, error) {
+	spam, scores, ok := strings.Cut(value, ";")
+	if !ok {
+		return nil, errSpamd
+	}
+	score, threshold, ok := strings.Cut(scores, "/")
+	if !ok {
+		return nil, errSpamd
+	}
+	v := &SpamVerdict{Action: SpamNoAction}
+	var err1, err2 error
+	v.Score, err1 = strconv.ParseFloat(strings.TrimSpace(score), 64)
+	v.Threshold, err2 = strconv.ParseFloat(strings.TrimSpace(threshold), 64)
+	if err1 != nil || err2 != nil {
+		return nil, errSpamd
+	}
+	switch strings.ToLower(strings.TrimSpace(spam)) {
+	case "true", "yes":
+		v.Action = SpamAddHeader
+	}
+	return v, nil
+}
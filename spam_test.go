@@ -0,0 +1,133 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"reflect"
+	"testing"
+)
+
+// TestSpamFilter make sure that every action of the verdict is
+// applied to the message
+func TestSpamFilter(t *testing.T) {
+	cases := []struct {
+		verdict  *SpamVerdict
+		err      error
+		failOpen bool
+		reply    error
+		header   string
+	}{
+		{&SpamVerdict{Action: SpamNoAction, Score: 1, Threshold: 15}, nil, false, nil,
+			"X-Spam-Status: No, score=1.00 required=15.00\r\nSubject: hi\r\n"},
+		{&SpamVerdict{Action: SpamAddHeader, Score: 7, Threshold: 15, Symbols: []string{"A", "B"}}, nil, false, nil,
+			"X-Spam-Status: Yes, score=7.00 required=15.00 tests=A,B\r\nSubject: hi\r\n"},
+		{&SpamVerdict{Action: SpamRewriteSubject, Score: 8, Threshold: 15, Subject: "[SPAM] hi"}, nil, false, nil,
+			"X-Spam-Status: Yes, score=8.00 required=15.00\r\nSubject: [SPAM] hi\r\n"},
+		{&SpamVerdict{Action: SpamGreylist}, nil, false, spamGreylistErr, ""},
+		{&SpamVerdict{Action: SpamSoftReject}, nil, false, spamSoftRejectErr, ""},
+		{&SpamVerdict{Action: SpamReject}, nil, false, spamRejectErr, ""},
+		{nil, errors.New("down"), true, nil, "Subject: hi\r\n"},
+	}
+
+	for _, input := range cases {
+		f := &SpamFilter{
+			Checker: spamCheckerFunc(func(ctx context.Context, envl *Envelope, data []byte) (*SpamVerdict, error) {
+				return input.verdict, input.err
+			}),
+			FailOpen: input.failOpen,
+		}
+		data, err := f.Filter(&Envelope{}, []byte("X-Spam-Status: Yes, forged\r\nSubject: hi\r\n\r\nbody\r\n"))
+		if err != input.reply {
+			t.Errorf("%+v: got %v, expected %v", input.verdict, err, input.reply)
+		}
+		if err == nil && string(data) != input.header+"\r\nbody\r\n" {
+			t.Errorf("%+v: got %q", input.verdict, data)
+		}
+	}
+}
+
+type spamCheckerFunc func(ctx context.Context, envl *Envelope, data []byte) (*SpamVerdict, error)
+
+func (f spamCheckerFunc) CheckSpam(ctx context.Context, envl *Envelope, data []byte) (*SpamVerdict, error) {
+	return f(ctx, envl, data)
+}
+
+// TestRspamd make sure that the envelope is sent to /checkv2 and
+// the reply is converted into a verdict
+func TestRspamd(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/checkv2" || r.Header.Get("Password") != "q1" || r.Header.Get("From") != "a@client.com" ||
+			!reflect.DeepEqual(r.Header.Values("Rcpt"), []string{"b@example.com", "c@example.com"}) || string(body) != "Subject: hi\r\n\r\n" {
+			t.Errorf("got request %s %v %q", r.URL.Path, r.Header, body)
+		}
+		io.WriteString(w, `{"action":"add header","score":7.5,"required_score":15,"symbols":{"R_SPF_FAIL":{"score":1},"BAYES_SPAM":{"score":5}}}`)
+	}))
+	defer srv.Close()
+
+	r := &Rspamd{URL: srv.URL + "/", Password: "q1"}
+	envl := &Envelope{OriginatorAddress: "a@client.com", RecipientAddress: []string{"b@example.com", "c@example.com"}}
+	v, err := r.CheckSpam(context.Background(), envl, []byte("Subject: hi\r\n\r\n"))
+	expected := &SpamVerdict{Action: SpamAddHeader, Score: 7.5, Threshold: 15, Symbols: []string{"BAYES_SPAM", "R_SPF_FAIL"}}
+	if err != nil || !reflect.DeepEqual(v, expected) {
+		t.Errorf("got %+v %v, expected %+v", v, err, expected)
+	}
+}
+
+// TestSpamAssassin make sure that spamd SYMBOLS requests are sent
+// and replies parsed, with rejection from RejectScore
+func TestSpamAssassin(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	replies := []string{
+		"SPAMD/1.1 0 EX_OK\r\nSpam: True ; 7.5 / 5.0\r\n\r\nBAYES_99,URIBL_BLACK\r\n",
+		"SPAMD/1.1 0 EX_OK\r\nSpam: True ; 21.0 / 5.0\r\n\r\nBAYES_99\r\n",
+		"SPAMD/1.1 0 EX_OK\r\nSpam: False ; 0.1 / 5.0\r\n\r\n",
+		"SPAMD/1.0 76 Bad header line\r\n",
+	}
+	go func() {
+		for _, reply := range replies {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tp := textproto.NewReader(bufio.NewReader(conn))
+			line, _ := tp.ReadLine()
+			header, _ := tp.ReadMIMEHeader()
+			body, _ := io.ReadAll(tp.R)
+			if line != "SYMBOLS SPAMC/1.5" || header.Get("User") != "mail" || header.Get("Content-Length") != fmt.Sprint(len(body)) {
+				t.Errorf("got request %q %v %q", line, header, body)
+			}
+			io.WriteString(conn, reply)
+			conn.Close()
+		}
+	}()
+
+	cases := []struct {
+		action string
+		score  float64
+		ok     bool
+	}{
+		{SpamAddHeader, 7.5, true},
+		{SpamReject, 21, true},
+		{SpamNoAction, 0.1, true},
+		{"", 0, false},
+	}
+	sa := &SpamAssassin{Addr: l.Addr().String(), User: "mail", RejectScore: 20}
+	for i, input := range cases {
+		v, err := sa.CheckSpam(context.Background(), &Envelope{}, []byte("Subject: hi\r\n\r\nbody\r\n"))
+		if (err == nil) != input.ok || (err == nil && (v.Action != input.action || v.Score != input.score)) {
+			t.Errorf("%d: got %+v %v, expected %s %v", i, v, err, input.action, input.score)
+		}
+	}
+}
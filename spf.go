@@ -0,0 +1,440 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SPF results (RFC 7208 section 2.6)
+const (
+	SPFNone      = "none"
+	SPFNeutral   = "neutral"
+	SPFPass      = "pass"
+	SPFFail      = "fail"
+	SPFSoftFail  = "softfail"
+	SPFTempError = "temperror"
+	SPFPermError = "permerror"
+)
+
+// limit of DNS querying terms (RFC 7208 section 4.6.4)
+const spfLookupLimit = 10
+
+// default timeout of SPF evaluation
+const defaultSPFTimeout = 20 * time.Second
+
+// spfFailErr is sent when SPF check fail and rejection enabled
+var spfFailErr = NewSMTPError(550, [3]int{5, 7, 23}, "SPF validation failed")
+
+var (
+	errSPFPerm = errors.New("spf: permanent error")
+	errSPFTemp = errors.New("spf: temporary error")
+)
+
+// spfQualifiers map mechanism qualifier to result
+var spfQualifiers = map[byte]string{
+	'+': SPFPass,
+	'-': SPFFail,
+	'~': SPFSoftFail,
+	'?': SPFNeutral,
+}
+
+// spfCheck represents state of a single check_host() evaluation
+type spfCheck struct {
+	ctx      context.Context
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+}
+
+// CheckSPF evaluate SPF policy of sender domain for the client ip.
+// when sender is empty (null reverse-path), HELO name is checked
+func CheckSPF(ctx context.Context, resolver Resolver, ip net.IP, sender, helo string) string {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	domain := ToASCII(domainOf(sender))
+	if domain == "" {
+		return SPFNone
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultSPFTimeout)
+		defer cancel()
+	}
+
+	c := &spfCheck{ctx: ctx, resolver: resolver, ip: ip, sender: sender, helo: helo}
+	res, err := c.checkHost(domain)
+	switch err {
+	case errSPFPerm:
+		return SPFPermError
+	case errSPFTemp:
+		return SPFTempError
+	}
+	return res
+}
+
+// record find the single SPF record of domain
+func (c *spfCheck) record(domain string) (string, error) {
+	txts, err := c.resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		if de, ok := err.(*net.DNSError); ok && de.IsNotFound {
+			return "", nil
+		}
+		return "", errSPFTemp
+	}
+
+	record := ""
+	for _, txt := range txts {
+		if txt == "v=spf1" || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			if record != "" {
+				return "", errSPFPerm
+			}
+			record = txt
+		}
+	}
+	return record, nil
+}
+
+// checkHost implement check_host() function of RFC 7208
+func (c *spfCheck) checkHost(domain string) (string, error) {
+	record, err := c.record(domain)
+	if err != nil {
+		return "", err
+	}
+	if record == "" {
+		return SPFNone, nil
+	}
+
+	redirect := ""
+	for _, term := range strings.Fields(record)[1:] {
+		// modifiers
+		if i := strings.Index(term, "="); i > 0 && !strings.ContainsAny(term[:i], ":/") {
+			if strings.EqualFold(term[:i], "redirect") {
+				redirect = term[i+1:]
+			}
+			continue
+		}
+
+		result := SPFPass
+		if r, ok := spfQualifiers[term[0]]; ok {
+			result = r
+			term = term[1:]
+		}
+
+		match, err := c.mechanism(term, domain)
+		if err != nil {
+			return "", err
+		}
+		if match {
+			return result, nil
+		}
+	}
+
+	if redirect != "" {
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return "", err
+		}
+		if err := c.countLookup(); err != nil {
+			return "", err
+		}
+		res, err := c.checkHost(target)
+		if err == nil && res == SPFNone {
+			return "", errSPFPerm
+		}
+		return res, err
+	}
+	return SPFNeutral, nil
+}
+
+func (c *spfCheck) countLookup() error {
+	c.lookups++
+	if c.lookups > spfLookupLimit {
+		return errSPFPerm
+	}
+	return nil
+}
+
+// splitMechanism split "name:domain-spec/cidr" into its parts
+func splitMechanism(term string) (name, spec, cidr string) {
+	name = term
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, spec = term[:i], term[i:]
+	}
+	if strings.HasPrefix(spec, ":") {
+		spec = spec[1:]
+	} else {
+		cidr, spec = spec, ""
+	}
+	if i := strings.Index(spec, "/"); i >= 0 {
+		spec, cidr = spec[:i], spec[i:]
+	}
+	return strings.ToLower(name), spec, cidr
+}
+
+// parseCIDR parse dual cidr length "/24//64" of a and mx mechanisms
+func parseCIDR(cidr string) (v4, v6 int, err error) {
+	v4, v6 = 32, 128
+	if cidr == "" {
+		return v4, v6, nil
+	}
+	parts := strings.SplitN(cidr, "//", 2)
+	if parts[0] != "" {
+		if v4, err = strconv.Atoi(strings.TrimPrefix(parts[0], "/")); err != nil || v4 < 0 || v4 > 32 {
+			return 0, 0, errSPFPerm
+		}
+	}
+	if len(parts) == 2 {
+		if v6, err = strconv.Atoi(parts[1]); err != nil || v6 < 0 || v6 > 128 {
+			return 0, 0, errSPFPerm
+		}
+	}
+	return v4, v6, nil
+}
+
+// matchIP report whether candidate address match client ip in
+// the network of prefix length
+func (c *spfCheck) matchIP(candidate net.IP, v4, v6 int) bool {
+	if ip4 := c.ip.To4(); ip4 != nil {
+		cand4 := candidate.To4()
+		return cand4 != nil && ip4.Mask(net.CIDRMask(v4, 32)).Equal(cand4.Mask(net.CIDRMask(v4, 32)))
+	}
+	if candidate.To4() != nil {
+		return false
+	}
+	return c.ip.Mask(net.CIDRMask(v6, 128)).Equal(candidate.Mask(net.CIDRMask(v6, 128)))
+}
+
+// matchHost resolve host and match every address with client ip
+func (c *spfCheck) matchHost(host string, v4, v6 int) (bool, error) {
+	addrs, err := c.resolver.LookupHost(c.ctx, host)
+	if err != nil {
+		if de, ok := err.(*net.DNSError); ok && de.IsNotFound {
+			return false, nil
+		}
+		return false, errSPFTemp
+	}
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && c.matchIP(ip, v4, v6) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mechanism evaluate a single mechanism
+func (c *spfCheck) mechanism(term, domain string) (bool, error) {
+	name, spec, cidr := splitMechanism(term)
+
+	target := domain
+	if spec != "" {
+		t, err := c.expand(spec, domain)
+		if err != nil {
+			return false, err
+		}
+		target = t
+	}
+
+	switch name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		network := spec + cidr
+		if !strings.Contains(network, "/") {
+			if name == "ip4" {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(network)
+		if err != nil {
+			return false, errSPFPerm
+		}
+		return n.Contains(c.ip), nil
+	case "a":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		v4, v6, err := parseCIDR(cidr)
+		if err != nil {
+			return false, err
+		}
+		return c.matchHost(target, v4, v6)
+	case "mx":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		v4, v6, err := parseCIDR(cidr)
+		if err != nil {
+			return false, err
+		}
+		mxs, err := c.resolver.LookupMX(c.ctx, target)
+		if err != nil {
+			if de, ok := err.(*net.DNSError); ok && de.IsNotFound {
+				return false, nil
+			}
+			return false, errSPFTemp
+		}
+		for i, mx := range mxs {
+			if i >= spfLookupLimit {
+				return false, errSPFPerm
+			}
+			if ok, err := c.matchHost(mx.Host, v4, v6); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	case "include":
+		if spec == "" {
+			return false, errSPFPerm
+		}
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		res, err := c.checkHost(target)
+		if err != nil {
+			return false, err
+		}
+		switch res {
+		case SPFPass:
+			return true, nil
+		case SPFNone:
+			return false, errSPFPerm
+		}
+		return false, nil
+	case "exists":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		return c.matchHost(target, 0, 0)
+	case "ptr":
+		// ptr is deprecated (RFC 7208 section 5.5), never match
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	return false, errSPFPerm
+}
+
+// expand expand macros of domain-spec (RFC 7208 section 7)
+func (c *spfCheck) expand(spec, domain string) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", errSPFPerm
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+		case '_':
+			out.WriteByte(' ')
+		case '-':
+			out.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 0 {
+				return "", errSPFPerm
+			}
+			v, err := c.macro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(v)
+			i += end
+		default:
+			return "", errSPFPerm
+		}
+	}
+	return out.String(), nil
+}
+
+// macro expand a single macro like "ir" or "d2"
+func (c *spfCheck) macro(m, domain string) (string, error) {
+	if m == "" {
+		return "", errSPFPerm
+	}
+
+	var value string
+	switch strings.ToLower(m[:1]) {
+	case "s":
+		value = c.sender
+	case "l":
+		value = c.sender[:strings.LastIndex(c.sender, "@")]
+	case "o":
+		value = domainOf(c.sender)
+	case "d":
+		value = domain
+	case "i":
+		if ip4 := c.ip.To4(); ip4 != nil {
+			value = ip4.String()
+		} else {
+			value = reverseIP(c.ip)
+			value = reverseLabels(value, ".")
+		}
+	case "v":
+		value = "in-addr"
+		if c.ip.To4() == nil {
+			value = "ip6"
+		}
+	case "h":
+		value = c.helo
+	default:
+		return "", errSPFPerm
+	}
+
+	// transformers: digits, reverse and delimiters
+	m = m[1:]
+	digits := 0
+	for len(m) > 0 && m[0] >= '0' && m[0] <= '9' {
+		digits = digits*10 + int(m[0]-'0')
+		m = m[1:]
+	}
+	reverse := false
+	if len(m) > 0 && (m[0] == 'r' || m[0] == 'R') {
+		reverse = true
+		m = m[1:]
+	}
+	delims := "."
+	if m != "" {
+		delims = m
+	}
+
+	labels := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delims, r)
+	})
+	if reverse {
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+	}
+	if digits > 0 && digits < len(labels) {
+		labels = labels[len(labels)-digits:]
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// reverseLabels reverse order of labels separated by sep
+func reverseLabels(s, sep string) string {
+	labels := strings.Split(s, sep)
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, sep)
+}
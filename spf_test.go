@@ -0,0 +1,90 @@
+package session
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+var spfResolver = &fakeResolver{
+	txts: map[string][]string{
+		"example.com":         {"v=spf1 ip4:192.0.2.0/24 mx include:_spf.example.net -all"},
+		"_spf.example.net":    {"v=spf1 ip6:2001:db8::/32 a:relay.example.net ~all"},
+		"soft.com":            {"v=spf1 ~all"},
+		"redirect.com":        {"v=spf1 redirect=example.com"},
+		"twice.com":           {"v=spf1 -all", "v=spf1 +all"},
+		"macro.com":           {"v=spf1 exists:%{ir}.%{l}._spf.%{d} -all"},
+		"loop.com":            {"v=spf1 include:loop.com -all"},
+		"other.com":           {"google-site-verification=abc"},
+		"neutral.com":         {"v=spf1 ?all"},
+		"unknown-mechanism.c": {"v=spf1 foo -all"},
+	},
+	hosts: map[string][]string{
+		"mx1.example.com":             {"198.51.100.10"},
+		"relay.example.net":           {"203.0.113.5"},
+		"4.3.2.1.some._spf.macro.com": {"127.0.0.2"},
+		"mail.client.com":             {"192.0.2.1"},
+	},
+	mxs: map[string][]*net.MX{
+		"example.com": {{Host: "mx1.example.com", Pref: 10}},
+	},
+}
+
+// TestCheckSPF evaluate SPF policies for each mechanisms
+func TestCheckSPF(t *testing.T) {
+	cases := []struct {
+		ip, sender, result string
+	}{
+		{"192.0.2.55", "some@example.com", SPFPass},
+		{"198.51.100.10", "some@example.com", SPFPass},
+		{"2001:db8::1", "some@example.com", SPFPass},
+		{"203.0.113.5", "some@example.com", SPFPass},
+		{"203.0.113.6", "some@example.com", SPFFail},
+		{"203.0.113.6", "some@soft.com", SPFSoftFail},
+		{"192.0.2.55", "some@redirect.com", SPFPass},
+		{"203.0.113.6", "some@redirect.com", SPFFail},
+		{"192.0.2.55", "some@twice.com", SPFPermError},
+		{"1.2.3.4", "some@macro.com", SPFPass},
+		{"1.2.3.5", "some@macro.com", SPFFail},
+		{"1.2.3.4", "some@loop.com", SPFPermError},
+		{"1.2.3.4", "some@other.com", SPFNone},
+		{"1.2.3.4", "some@nowhere.com", SPFNone},
+		{"1.2.3.4", "some@neutral.com", SPFNeutral},
+		{"1.2.3.4", "some@unknown-mechanism.c", SPFPermError},
+	}
+
+	for _, input := range cases {
+		got := CheckSPF(context.Background(), spfResolver, net.ParseIP(input.ip), input.sender, "client.com")
+		if got != input.result {
+			t.Errorf("%s %s: got %q, expected %q", input.ip, input.sender, got, input.result)
+		}
+	}
+}
+
+// TestSessionSPF make sure that SPF result recorded on envelope and
+// hard fail rejected when configured
+func TestSessionSPF(t *testing.T) {
+	var spf string
+	config := &Config{
+		Resolver: spfResolver,
+		CheckSPF: true,
+		Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			spf = envl.SPF
+			return nil
+		}),
+	}
+
+	input := "HELO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\n" +
+		"DATA\r\nSubject: test\r\n\r\nbody\r\n.\r\nQUIT\r\n"
+	runSessionFrom(t, config, "203.0.113.6:2525", input)
+	if spf != SPFFail {
+		t.Errorf("got SPF %q, expected %q", spf, SPFFail)
+	}
+
+	config.RejectSPFFail = true
+	out := runSessionFrom(t, config, "203.0.113.6:2525", input)
+	if !strings.Contains(out, "550 5.7.23 SPF validation failed\r\n503 5.5.1 Bad sequence") {
+		t.Errorf("got %q, expected SPF rejection", out)
+	}
+}
@@ -0,0 +1,289 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// spool file extensions, envelope file is renamed last so its
+// presence mark a complete message
+const (
+	spoolEnvelopeExt = ".env"
+	spoolMessageExt  = ".msg"
+)
+
+// spoolErr is sent when message can't be written to the spool
+var spoolErr = NewSMTPError(451, [3]int{4, 3, 0}, "Unable to queue message, try again later")
+
+// SpoolStats represents counters of spool writes
+type SpoolStats struct {
+	Written uint64
+	Failed  uint64
+	// Corrupted count writes that didn't match on read back
+	Corrupted uint64
+}
+
+// spoolRecord represents content of envelope file
+type spoolRecord struct {
+	Envelope *Envelope
+	// Body is the address of message data in BodyStore,
+	// empty when the data is stored in message file
+	Body string `json:",omitempty"`
+
+	// delivery state used by Queue
+	Queued      time.Time
+	Attempts    int       `json:",omitempty"`
+	NextAttempt time.Time `json:",omitempty"`
+	LastError   string    `json:",omitempty"`
+	// Delayed list recipients already notified of delay
+	Delayed []string `json:",omitempty"`
+}
+
+// held report whether the message is held for future release
+func (rec *spoolRecord) held(now time.Time) bool {
+	return now.Before(rec.Envelope.HoldUntil)
+}
+
+// released return when the message entered the queue or was
+// released from hold
+func (rec *spoolRecord) released() time.Time {
+	if rec.Envelope.HoldUntil.After(rec.Queued) {
+		return rec.Envelope.HoldUntil
+	}
+	return rec.Queued
+}
+
+// Spool is a Backend that write accepted messages into a directory.
+// every message is stored as envelope file (JSON) and message file
+type Spool struct {
+	Dir string
+
+	// Bodies store message data content-addressed instead of
+	// a message file per spooled message
+	Bodies *BodyStore
+
+	// Verify read back written files and compare the checksum
+	// before the message is accepted
+	Verify bool
+
+	written   uint64
+	failed    uint64
+	corrupted uint64
+}
+
+// Stats return counters of the spool
+func (sp *Spool) Stats() SpoolStats {
+	return SpoolStats{
+		Written:   atomic.LoadUint64(&sp.written),
+		Failed:    atomic.LoadUint64(&sp.failed),
+		Corrupted: atomic.LoadUint64(&sp.corrupted),
+	}
+}
+
+// newSpoolID generate a unique id of spooled message
+func newSpoolID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%x%s", time.Now().UnixNano(), hex.EncodeToString(b))
+}
+
+// writeFile write data to path atomically, data is written to
+// a temporary file, synced to disk, and renamed to path
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// syncDir make renames inside dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// verifyFile compare SHA-256 of the file with sum
+func verifyFile(path string, sum [sha256.Size]byte) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	return bytes.Equal(h.Sum(nil), sum[:]), nil
+}
+
+// Write store envelope and message data into the spool
+// and return the id of spooled message
+func (sp *Spool) Write(envl *Envelope, data []byte) (string, error) {
+	id := newSpoolID()
+	base := filepath.Join(sp.Dir, id)
+	now := time.Now()
+	rec := &spoolRecord{Envelope: envl, Queued: now, NextAttempt: now}
+	if envl.HoldUntil.After(now) {
+		rec.NextAttempt = envl.HoldUntil
+	}
+
+	if sp.Bodies != nil {
+		sum, err := sp.Bodies.Put(data)
+		if err != nil {
+			return "", err
+		}
+		rec.Body = sum
+	} else if err := writeFile(base+spoolMessageExt, data); err != nil {
+		return "", err
+	}
+
+	env, err := json.Marshal(rec)
+	if err == nil {
+		err = writeFile(base+spoolEnvelopeExt, env)
+	}
+	if err == nil {
+		err = syncDir(sp.Dir)
+	}
+	if err == nil && sp.Verify {
+		err = sp.verify(base, rec, data, env)
+	}
+	if err != nil {
+		if rec.Body != "" {
+			sp.Bodies.Release(rec.Body)
+		}
+		os.Remove(base + spoolMessageExt)
+		os.Remove(base + spoolEnvelopeExt)
+		return "", err
+	}
+	return id, nil
+}
+
+// verify read back spooled files and compare their checksum
+func (sp *Spool) verify(base string, rec *spoolRecord, data, env []byte) error {
+	ok, err := verifyFile(base+spoolEnvelopeExt, sha256.Sum256(env))
+	if err == nil && ok {
+		if rec.Body != "" {
+			ok, err = sp.Bodies.Verify(rec.Body)
+		} else {
+			ok, err = verifyFile(base+spoolMessageExt, sha256.Sum256(data))
+		}
+	}
+	if err != nil || !ok {
+		atomic.AddUint64(&sp.corrupted, 1)
+		return fmt.Errorf("spool: verification of %s failed", base)
+	}
+	return nil
+}
+
+// readRecord read and decode envelope file of spooled message
+func (sp *Spool) readRecord(id string) (*spoolRecord, error) {
+	env, err := os.ReadFile(filepath.Join(sp.Dir, id+spoolEnvelopeExt))
+	if err != nil {
+		return nil, err
+	}
+	rec := &spoolRecord{}
+	if err := json.Unmarshal(env, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// writeRecord replace envelope file of spooled message atomically
+func (sp *Spool) writeRecord(id string, rec *spoolRecord) error {
+	env, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(sp.Dir, id+spoolEnvelopeExt), env)
+}
+
+// readData read message data of the record
+func (sp *Spool) readData(id string, rec *spoolRecord) ([]byte, error) {
+	if rec.Body != "" {
+		if sp.Bodies == nil {
+			return nil, ErrBodyNotFound
+		}
+		return sp.Bodies.Get(rec.Body)
+	}
+	return os.ReadFile(filepath.Join(sp.Dir, id+spoolMessageExt))
+}
+
+// Read return envelope and message data of spooled message
+func (sp *Spool) Read(id string) (*Envelope, []byte, error) {
+	rec, err := sp.readRecord(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := sp.readData(id, rec)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rec.Envelope, data, nil
+}
+
+// List return id of every spooled message
+func (sp *Spool) List() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(sp.Dir, "*"+spoolEnvelopeExt))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(paths))
+	for i, p := range paths {
+		ids[i] = strings.TrimSuffix(filepath.Base(p), spoolEnvelopeExt)
+	}
+	return ids, nil
+}
+
+// Remove delete spooled message and release its body
+func (sp *Spool) Remove(id string) error {
+	base := filepath.Join(sp.Dir, id)
+	if rec, err := sp.readRecord(id); err == nil && rec.Body != "" && sp.Bodies != nil {
+		sp.Bodies.Release(rec.Body)
+	}
+	os.Remove(base + spoolMessageExt)
+	err := os.Remove(base + spoolEnvelopeExt)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Deliver write the message into the spool. failure is replied
+// with temporary error so SMTP sender retry later
+func (sp *Spool) Deliver(envl *Envelope, data []byte) error {
+	if _, err := sp.Write(envl, data); err != nil {
+		atomic.AddUint64(&sp.failed, 1)
+		return spoolErr
+	}
+	atomic.AddUint64(&sp.written, 1)
+	return nil
+}
@@ -0,0 +1,109 @@
+package session
+
+import (
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+)
+
+// TestSpoolDeliver make sure that envelope and message written and
+// verified in the spool directory
+func TestSpoolDeliver(t *testing.T) {
+	sp := &Spool{Dir: t.TempDir(), Verify: true}
+	envl := &Envelope{OriginatorAddress: "some@example.com", RecipientAddress: []string{"other@domain.com"}}
+	data := []byte("Subject: test\r\n\r\nbody\r\n")
+
+	id, err := sp.Write(envl, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, msg, err := sp.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != string(data) || got.OriginatorAddress != envl.OriginatorAddress {
+		t.Errorf("got %+v %q, expected %+v %q", got, msg, envl, data)
+	}
+
+	if err := sp.Deliver(envl, data); err != nil {
+		t.Errorf("Deliver() == %v, expected nil", err)
+	}
+	if stats := sp.Stats(); stats.Written != 1 || stats.Corrupted != 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	// unwritable spool is replied with temporary error
+	bad := &Spool{Dir: filepath.Join(sp.Dir, "missing")}
+	if err := bad.Deliver(envl, data); err != spoolErr {
+		t.Errorf("Deliver() == %v, expected %v", err, spoolErr)
+	}
+	if stats := bad.Stats(); stats.Failed != 1 {
+		t.Errorf("got stats %+v, expected 1 failed", stats)
+	}
+}
+
+// TestVerifyFile make sure that checksum mismatch detected
+func TestVerifyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := writeFile(path, []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		content string
+		ok      bool
+	}{
+		{"content", true},
+		{"corrupted", false},
+	}
+	for _, input := range cases {
+		ok, err := verifyFile(path, sha256.Sum256([]byte(input.content)))
+		if err != nil || ok != input.ok {
+			t.Errorf("%q: got %t %v, expected %t", input.content, ok, err, input.ok)
+		}
+	}
+}
+
+// TestSpoolBodyStore make sure that identical bodies stored once and
+// removed when the last spooled message removed
+func TestSpoolBodyStore(t *testing.T) {
+	dir := t.TempDir()
+	sp := &Spool{Dir: dir, Verify: true, Bodies: &BodyStore{Dir: t.TempDir()}}
+	data := []byte("Subject: list\r\n\r\nbody\r\n")
+
+	var ids []string
+	for _, rcpt := range []string{"a@domain.com", "b@domain.com", "c@domain.com"} {
+		id, err := sp.Write(&Envelope{RecipientAddress: []string{rcpt}}, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	bodies, _ := filepath.Glob(filepath.Join(sp.Bodies.Dir, "*"))
+	if len(bodies) != 2 {
+		t.Errorf("got body files %v, expected body and its reference count", bodies)
+	}
+	sum := filepath.Base(bodies[0])
+	if n, _ := sp.Bodies.Refs(sum); n != 3 {
+		t.Errorf("got %d references, expected 3", n)
+	}
+
+	for i, id := range ids {
+		_, got, err := sp.Read(id)
+		if err != nil || string(got) != string(data) {
+			t.Errorf("Read(%q) == %q %v, expected %q", id, got, err, data)
+		}
+		if err := sp.Remove(id); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := sp.Bodies.Refs(sum); n != len(ids)-i-1 {
+			t.Errorf("got %d references, expected %d", n, len(ids)-i-1)
+		}
+	}
+
+	if _, err := sp.Bodies.Get(sum); err != ErrBodyNotFound {
+		t.Errorf("Get() == %v, expected %v", err, ErrBodyNotFound)
+	}
+}
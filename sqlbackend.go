@@ -0,0 +1,208 @@
+package session
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// default tables of SQLBackend
+const (
+	defaultMessagesTable   = "messages"
+	defaultRecipientsTable = "message_recipients"
+)
+
+// SQLDialect is the SQL syntax differences between databases
+type SQLDialect struct {
+	// Placeholder return the bind parameter n, starting at 1
+	Placeholder func(n int) string
+	// BlobType is the column type of message bodies
+	BlobType string
+}
+
+// dialects of common databases
+var (
+	SQLiteDialect   = SQLDialect{Placeholder: func(int) string { return "?" }, BlobType: "BLOB"}
+	MySQLDialect    = SQLDialect{Placeholder: func(int) string { return "?" }, BlobType: "LONGBLOB"}
+	PostgresDialect = SQLDialect{Placeholder: func(n int) string { return "$" + strconv.Itoa(n) }, BlobType: "BYTEA"}
+)
+
+// SQLBackend is a Backend storing accepted messages in a database,
+// one row of envelope metadata and body per message and one row per
+// recipient. with Bodies the body is stored in the BodyStore and
+// the row keep its reference. the database driver is chosen by the
+// application, tables are created by Migrate
+type SQLBackend struct {
+	DB *sql.DB
+	// Dialect default to SQLiteDialect
+	Dialect SQLDialect
+	// MessagesTable and RecipientsTable default to "messages"
+	// and "message_recipients"
+	MessagesTable   string
+	RecipientsTable string
+	// Bodies store bodies outside of the database
+	Bodies *BodyStore
+}
+
+// ErrMessageNotFound is returned by SQLBackend.Message for unknown ID
+var ErrMessageNotFound = errors.New("session: message not found")
+
+func (b *SQLBackend) dialect() SQLDialect {
+	if b.Dialect.Placeholder == nil {
+		return SQLiteDialect
+	}
+	return b.Dialect
+}
+
+func (b *SQLBackend) messages() string {
+	if b.MessagesTable == "" {
+		return defaultMessagesTable
+	}
+	return b.MessagesTable
+}
+
+func (b *SQLBackend) recipients() string {
+	if b.RecipientsTable == "" {
+		return defaultRecipientsTable
+	}
+	return b.RecipientsTable
+}
+
+// placeholders return n bind parameters separated by comma
+func (b *SQLBackend) placeholders(n int) string {
+	p := make([]string, n)
+	for i := range p {
+		p[i] = b.dialect().Placeholder(i + 1)
+	}
+	return strings.Join(p, ", ")
+}
+
+// migrations return schema changes by version, new versions are
+// only appended
+func (b *SQLBackend) migrations() [][]string {
+	m, r := b.messages(), b.recipients()
+	return [][]string{
+		{
+			"CREATE TABLE " + m + " (id VARCHAR(64) PRIMARY KEY, received_at TIMESTAMP NOT NULL, " +
+				"sender VARCHAR(320) NOT NULL, message_id VARCHAR(998), size INTEGER NOT NULL, " +
+				"envelope TEXT NOT NULL, body " + b.dialect().BlobType + ", body_ref VARCHAR(64))",
+			"CREATE TABLE " + r + " (message_id VARCHAR(64) NOT NULL, recipient VARCHAR(320) NOT NULL)",
+		},
+		{
+			"CREATE INDEX " + r + "_message_id ON " + r + " (message_id)",
+			"CREATE INDEX " + r + "_recipient ON " + r + " (recipient)",
+		},
+	}
+}
+
+// Migrate create or upgrade the tables to the current schema. the
+// applied version is kept in table MessagesTable_schema
+func (b *SQLBackend) Migrate(ctx context.Context) error {
+	version := b.messages() + "_schema"
+	if _, err := b.DB.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+version+" (version INTEGER NOT NULL)"); err != nil {
+		return err
+	}
+	var current sql.NullInt64
+	if err := b.DB.QueryRowContext(ctx, "SELECT MAX(version) FROM "+version).Scan(&current); err != nil {
+		return err
+	}
+	for i, stmts := range b.migrations() {
+		v := int64(i + 1)
+		if v <= current.Int64 {
+			continue
+		}
+		tx, err := b.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range stmts {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("sql: migration %d: %v", v, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+version+" (version) VALUES ("+b.placeholders(1)+")", v); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deliver insert the message and its recipients in a transaction
+func (b *SQLBackend) Deliver(envl *Envelope, data []byte) error {
+	ctx := context.Background()
+	env, err := json.Marshal(envl)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	var ref sql.NullString
+	if b.Bodies != nil {
+		sum, err := b.Bodies.Put(data)
+		if err != nil {
+			return err
+		}
+		ref = sql.NullString{String: sum, Valid: true}
+	} else {
+		body = data
+	}
+
+	id := newSpoolID()
+	tx, err := b.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO "+b.messages()+
+		" (id, received_at, sender, message_id, size, envelope, body, body_ref) VALUES ("+b.placeholders(8)+")",
+		id, time.Now().UTC(), envl.OriginatorAddress, messageID(data), len(data), string(env), body, ref)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, rcpt := range envl.RecipientAddress {
+		_, err := tx.ExecContext(ctx, "INSERT INTO "+b.recipients()+" (message_id, recipient) VALUES ("+b.placeholders(2)+")", id, rcpt)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Message return the envelope and data of stored message id
+func (b *SQLBackend) Message(ctx context.Context, id string) (*Envelope, []byte, error) {
+	var env string
+	var body []byte
+	var ref sql.NullString
+	err := b.DB.QueryRowContext(ctx, "SELECT envelope, body, body_ref FROM "+b.messages()+
+		" WHERE id = "+b.placeholders(1), id).Scan(&env, &body, &ref)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	envl := &Envelope{}
+	if err := json.Unmarshal([]byte(env), envl); err != nil {
+		return nil, nil, err
+	}
+	if ref.Valid {
+		if b.Bodies == nil {
+			return nil, nil, ErrBodyNotFound
+		}
+		body, err = b.Bodies.Get(ref.String)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return envl, body, nil
+}
@@ -0,0 +1,236 @@
+package session
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDB is the state of a database of fakeDriver, it only know the
+// statements of SQLBackend and SQLQuota
+type fakeDB struct {
+	mu         sync.Mutex
+	ddl        []string
+	version    int64
+	messages   map[string][]driver.Value
+	recipients [][]driver.Value
+	// quotas are limit and used bytes and messages by name
+	quotas map[string]*[4]int64
+}
+
+var (
+	fakeDBsMu sync.Mutex
+	fakeDBs   = map[string]*fakeDB{}
+)
+
+func init() {
+	sql.Register("sessiontest", fakeDriver{})
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBsMu.Lock()
+	defer fakeDBsMu.Unlock()
+	db := fakeDBs[name]
+	if db == nil {
+		db = &fakeDB{messages: make(map[string][]driver.Value), quotas: make(map[string]*[4]int64)}
+		fakeDBs[name] = db
+	}
+	return &fakeConn{db}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{c.db, query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	switch {
+	case strings.HasPrefix(s.query, "CREATE TABLE IF NOT EXISTS"):
+	case strings.HasPrefix(s.query, "CREATE"):
+		db.ddl = append(db.ddl, s.query)
+	case strings.HasPrefix(s.query, "INSERT INTO messages_schema"):
+		db.version = args[0].(int64)
+	case strings.HasPrefix(s.query, "INSERT INTO messages "):
+		db.messages[args[0].(string)] = args
+	case strings.HasPrefix(s.query, "INSERT INTO message_recipients"):
+		db.recipients = append(db.recipients, args)
+	case strings.HasPrefix(s.query, "UPDATE quotas SET"):
+		q, ok := db.quotas[args[2].(string)]
+		if !ok {
+			return driver.RowsAffected(0), nil
+		}
+		if strings.Contains(s.query, "limit_bytes") {
+			q[0], q[1] = args[0].(int64), args[1].(int64)
+		} else {
+			q[2], q[3] = q[2]+args[0].(int64), q[3]+args[1].(int64)
+		}
+	case strings.HasPrefix(s.query, "INSERT INTO quotas (name, limit_bytes"):
+		db.quotas[args[0].(string)] = &[4]int64{args[1].(int64), args[2].(int64), 0, 0}
+	case strings.HasPrefix(s.query, "INSERT INTO quotas (name, used_bytes"):
+		db.quotas[args[0].(string)] = &[4]int64{0, 0, args[1].(int64), args[2].(int64)}
+	default:
+		return nil, errors.New("unexpected statement " + s.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	switch {
+	case strings.HasPrefix(s.query, "SELECT MAX(version)"):
+		if db.version == 0 {
+			return &fakeRows{rows: [][]driver.Value{{nil}}}, nil
+		}
+		return &fakeRows{rows: [][]driver.Value{{db.version}}}, nil
+	case strings.HasPrefix(s.query, "SELECT envelope, body, body_ref"):
+		row, ok := db.messages[args[0].(string)]
+		if !ok {
+			return &fakeRows{}, nil
+		}
+		return &fakeRows{rows: [][]driver.Value{{row[5], row[6], row[7]}}}, nil
+	case strings.HasPrefix(s.query, "SELECT limit_bytes, limit_messages FROM quotas"),
+		strings.HasPrefix(s.query, "SELECT used_bytes, used_messages FROM quotas"):
+		q, ok := db.quotas[args[0].(string)]
+		if !ok {
+			return &fakeRows{}, nil
+		}
+		if strings.HasPrefix(s.query, "SELECT limit") {
+			return &fakeRows{rows: [][]driver.Value{{q[0], q[1]}}}, nil
+		}
+		return &fakeRows{rows: [][]driver.Value{{q[2], q[3]}}}, nil
+	}
+	return nil, errors.New("unexpected query " + s.query)
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return make([]string, 3)[:len(r.cols())] }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) cols() []driver.Value {
+	if len(r.rows) == 0 {
+		return make([]driver.Value, 3)
+	}
+	return r.rows[0]
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// TestSQLBackendMigrate make sure that migrations are applied once
+// and use the configured tables and dialect
+func TestSQLBackendMigrate(t *testing.T) {
+	db, err := sql.Open("sessiontest", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	b := &SQLBackend{DB: db, Dialect: PostgresDialect}
+
+	for i := 0; i < 2; i++ {
+		if err := b.Migrate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := fakeDBs[t.Name()]
+	if state.version != 2 || len(state.ddl) != 4 {
+		t.Errorf("got version %d and %d statements, expected 2 and 4", state.version, len(state.ddl))
+	}
+	if !strings.Contains(state.ddl[0], "body BYTEA") {
+		t.Errorf("got %q, expected BYTEA body", state.ddl[0])
+	}
+	if got := b.placeholders(3); got != "$1, $2, $3" {
+		t.Errorf("got placeholders %q", got)
+	}
+}
+
+// TestSQLBackendDeliver make sure that messages are stored with their
+// recipients and read back, with body inline or in BodyStore
+func TestSQLBackendDeliver(t *testing.T) {
+	cases := []struct {
+		name   string
+		bodies *BodyStore
+	}{
+		{"inline", nil},
+		{"bodystore", &BodyStore{Dir: t.TempDir()}},
+	}
+
+	for _, input := range cases {
+		db, err := sql.Open("sessiontest", t.Name()+input.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &SQLBackend{DB: db, Bodies: input.bodies}
+		out := runSession(t, &Config{Backend: b}, "EHLO client.com\r\nMAIL FROM:<a@client.com>\r\nRCPT TO:<b@example.com>\r\n"+
+			"RCPT TO:<c@example.com>\r\nDATA\r\nMessage-ID: <1@client.com>\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+		if !strings.Contains(out, "250 2.0.0 OK: queued as ") {
+			t.Fatalf("%s: got %q, expected message accepted", input.name, out)
+		}
+
+		state := fakeDBs[t.Name()+input.name]
+		if len(state.messages) != 1 || len(state.recipients) != 2 {
+			t.Fatalf("%s: got %d messages %d recipients, expected 1 and 2", input.name, len(state.messages), len(state.recipients))
+		}
+		var id string
+		for k, row := range state.messages {
+			id = k
+			if row[2] != "a@client.com" || row[3] != "<1@client.com>" {
+				t.Errorf("%s: got row %v", input.name, row)
+			}
+			if body, _ := row[6].([]byte); (len(body) == 0) != (input.bodies != nil) {
+				t.Errorf("%s: got body %v and ref %v", input.name, row[6], row[7])
+			}
+		}
+		if state.recipients[1][0] != id || state.recipients[1][1] != "c@example.com" {
+			t.Errorf("%s: got recipient %v", input.name, state.recipients[1])
+		}
+
+		envl, data, err := b.Message(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(envl.RecipientAddress, []string{"b@example.com", "c@example.com"}) ||
+			string(data) != "Message-ID: <1@client.com>\r\n\r\nbody\r\n" {
+			t.Errorf("%s: got %v %q", input.name, envl.RecipientAddress, data)
+		}
+		if _, _, err := b.Message(context.Background(), "unknown"); err != ErrMessageNotFound {
+			t.Errorf("%s: got %v, expected not found", input.name, err)
+		}
+		db.Close()
+	}
+}
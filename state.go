@@ -0,0 +1,129 @@
+package session
+
+// State is the state of a SMTP session
+type State int
+
+// states of a session, a mail transaction go from StateMail to
+// StateData and back to StateHelloed
+const (
+	// StateGreeting is a new session waiting for HELO/EHLO
+	StateGreeting State = iota
+	// StateHelloed is a session outside of mail transaction
+	StateHelloed
+	// StateMail is a transaction with sender but no recipient
+	StateMail
+	// StateRcpt is a transaction with at least one recipient
+	StateRcpt
+	// StateData is a transaction receiving message data
+	StateData
+	// StateQuit is a session that received QUIT
+	StateQuit
+)
+
+var stateNames = map[State]string{
+	StateGreeting: "greeting",
+	StateHelloed:  "helloed",
+	StateMail:     "mail",
+	StateRcpt:     "rcpt",
+	StateData:     "data",
+	StateQuit:     "quit",
+}
+
+// String return the name of state
+func (st State) String() string {
+	if name, ok := stateNames[st]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// transitions is the state after a successful command in each
+// state. a verb missing from the state is out of sequence
+var transitions = map[State]map[string]State{
+	StateGreeting: {
+		"HELO": StateHelloed, "EHLO": StateHelloed,
+		"RSET": StateGreeting, "NOOP": StateGreeting, "HELP": StateGreeting,
+		"VRFY": StateGreeting, "EXPN": StateGreeting, "\r\n": StateGreeting,
+		"QUIT": StateQuit,
+	},
+	StateHelloed: {
+		"HELO": StateHelloed, "EHLO": StateHelloed,
+		"MAIL FROM:": StateMail, "AUTH": StateHelloed,
+		"RSET": StateHelloed, "NOOP": StateHelloed, "HELP": StateHelloed,
+		"VRFY": StateHelloed, "EXPN": StateHelloed, "\r\n": StateHelloed,
+		"QUIT": StateQuit,
+	},
+	StateMail: {
+		"HELO": StateHelloed, "EHLO": StateHelloed,
+		"RCPT TO:": StateRcpt, "RSET": StateHelloed,
+		"NOOP": StateMail, "HELP": StateMail, "VRFY": StateMail,
+		"EXPN": StateMail, "\r\n": StateMail,
+		"QUIT": StateQuit,
+	},
+	StateRcpt: {
+		"HELO": StateHelloed, "EHLO": StateHelloed,
+		"RCPT TO:": StateRcpt, "DATA": StateData, "BDAT": StateRcpt,
+		"RSET": StateHelloed, "NOOP": StateRcpt, "HELP": StateRcpt,
+		"VRFY": StateRcpt, "EXPN": StateRcpt, "\r\n": StateRcpt,
+		"QUIT": StateQuit,
+	},
+	// message data is read by the command that entered the state
+	StateData: {},
+	StateQuit: {},
+}
+
+// knownVerbs is the set of verbs in the transition table, other
+// verbs are unrecognized commands rather than out of sequence
+var knownVerbs = func() map[string]bool {
+	verbs := make(map[string]bool)
+	for _, next := range transitions {
+		for verb := range next {
+			verbs[verb] = true
+		}
+	}
+	return verbs
+}()
+
+// next return the state after successful command verb, the error
+// is the reply when the command is out of sequence
+func (st State) next(verb string) (State, error) {
+	if !knownVerbs[verb] {
+		return st, nil
+	}
+	if next, ok := transitions[st][verb]; ok {
+		return next, nil
+	}
+	if st == StateGreeting {
+		return st, ehloFirstErr
+	}
+	return st, badSeqErr
+}
+
+// inTransaction report whether a mail transaction is in progress
+func (st State) inTransaction() bool {
+	return st >= StateMail && st <= StateData
+}
+
+// State return the current state of the session
+func (s *Session) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// setState move the session into st
+func (s *Session) setState(st State) {
+	s.mu.Lock()
+	s.state = st
+	s.mu.Unlock()
+}
+
+// transition move the session into the state after successful
+// command verb, out of sequence command is ignored
+func (s *Session) transition(verb string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if next, err := s.state.next(verb); err == nil {
+		s.state = next
+	}
+}
@@ -0,0 +1,67 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestStateNext make sure that the transition table accept commands
+// in sequence and reject the others with the right reply
+func TestStateNext(t *testing.T) {
+	cases := []struct {
+		state    State
+		verb     string
+		expected State
+		err      error
+	}{
+		{StateGreeting, "EHLO", StateHelloed, nil},
+		{StateGreeting, "NOOP", StateGreeting, nil},
+		{StateGreeting, "MAIL FROM:", StateGreeting, ehloFirstErr},
+		{StateGreeting, "AUTH", StateGreeting, ehloFirstErr},
+		{StateGreeting, "QUIT", StateQuit, nil},
+		{StateHelloed, "MAIL FROM:", StateMail, nil},
+		{StateHelloed, "RCPT TO:", StateHelloed, badSeqErr},
+		{StateHelloed, "DATA", StateHelloed, badSeqErr},
+		{StateMail, "RCPT TO:", StateRcpt, nil},
+		{StateMail, "MAIL FROM:", StateMail, badSeqErr},
+		{StateMail, "AUTH", StateMail, badSeqErr},
+		{StateMail, "DATA", StateMail, badSeqErr},
+		{StateMail, "RSET", StateHelloed, nil},
+		{StateRcpt, "RCPT TO:", StateRcpt, nil},
+		{StateRcpt, "DATA", StateData, nil},
+		{StateRcpt, "BDAT", StateRcpt, nil},
+		{StateRcpt, "EHLO", StateHelloed, nil},
+		{StateData, "QUIT", StateData, badSeqErr},
+		{StateHelloed, "XUNKNOWN", StateHelloed, nil},
+	}
+
+	for _, input := range cases {
+		got, err := input.state.next(input.verb)
+		if got != input.expected || err != input.err {
+			t.Errorf("%s %q: got %s, %v, expected %s, %v", input.state, input.verb, got, err, input.expected, input.err)
+		}
+	}
+}
+
+// TestSessionState make sure that the session follow the transaction
+// and failed commands don't change the state
+func TestSessionState(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"MAIL FROM:<some@example.com>\r\n", "503 5.5.1 HELO/EHLO first"},
+		{"HELO client.com\r\nRCPT TO:<some@domain.com>\r\n", "503 5.5.1 Bad sequence of commands"},
+		{"HELO client.com\r\nMAIL FROM:<some@example.com>\r\nMAIL FROM:<some@example.com>\r\n", "250 2.0.0 OK\r\n503 5.5.1 Bad sequence of commands"},
+		{"HELO client.com\r\nMAIL FROM:<some@example.com>\r\nRSET\r\nMAIL FROM:<some@example.com>\r\n", "250 2.0.0 OK\r\n250 2.0.0 OK\r\n221"},
+		{"HELO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<bad address>\r\nDATA\r\n", "503 5.5.1 Bad sequence of commands\r\n221"},
+		{"HELO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\nSubject: a\r\n\r\n.\r\nRCPT TO:<some@domain.com>\r\n", "\r\n503 5.5.1 Bad sequence of commands\r\n221"},
+	}
+
+	for _, input := range cases {
+		out := runSession(t, &Config{}, input.input+"QUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("%q: got %q, expected %q", input.input, out, input.expected)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+// StreamBackend is implemented by Backend that can receive message
+// data while it is read from the connection, so the session doesn't
+// buffer the message. it is used for DATA when no enabled feature
+// needs the whole message, see Session.streamBackend
+type StreamBackend interface {
+	Backend
+	// DeliverStream read the message from r until io.EOF. an error
+	// from r means the message is rejected and must be discarded.
+	// returning *SMTPError reject the message with that reply
+	DeliverStream(envl *Envelope, r io.Reader) error
+}
+
+// dataReader decode message data of DATA command from the connection
+// line by line until the end of data indicator "<CRLF>.<CRLF>". see
+// readData for the handling of long lines and bare CR and LF
+type dataReader struct {
+	s                  *Session
+	maxLine, maxHeader int
+	// limit reject message over limit bytes when positive, the
+	// data beyond it is discarded
+	limit     int
+	truncated bool
+
+	line    []byte
+	buf     []byte
+	pending []byte
+	n       int
+
+	header     bool
+	headerSize int
+	// overlong is set when the content of the current line was
+	// dropped for being longer than maxLine
+	overlong bool
+	crlf     bool
+	bare     bool
+	rejected error
+	// err is returned after the end of data, io.EOF or the
+	// *SMTPError of rejected message. connErr is I/O error of the
+	// connection
+	err     error
+	connErr error
+	// scan is the virus scan of the message data
+	scan *virusScan
+}
+
+// newDataReader return reader of message data from the session
+func (s *Session) newDataReader(limit int) *dataReader {
+	return &dataReader{
+		s:         s,
+		maxLine:   s.maxLineLength(),
+		maxHeader: s.maxHeaderSize(),
+		limit:     limit,
+		header:    true,
+		// the end of data indicator is only valid after <CRLF>
+		crlf: true,
+		scan: s.startScan(),
+	}
+}
+
+// Read return decoded message data
+func (r *dataReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.readLine()
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// readLine read and decode the next line into pending
+func (r *dataReader) readLine() {
+	s := r.s
+	for {
+		// we SHOULD receive data in form of bytes
+		part, err := s.Reader.ReadSlice('\n')
+		r.line = append(r.line, part...)
+		// drop the content of overlong line but keep its last bytes,
+		// the line ending tell whether the end of data may follow
+		if r.maxLine > 0 && len(r.line) > r.maxLine+1 {
+			r.overlong = true
+			r.line = r.line[:copy(r.line, r.line[len(r.line)-2:])]
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			r.connErr, r.err = err, err
+			if r.scan != nil {
+				r.scan.abort(err)
+			}
+			return
+		}
+		break
+	}
+	if r.crlf && !r.overlong && bytes.Equal(r.line, []byte(".\r\n")) {
+		if r.bare {
+			s.logf(LevelInfo, "bare CR or LF in message data")
+		}
+		if r.scan != nil {
+			if err := r.s.finishScan(r.scan); err != nil && r.rejected == nil {
+				r.rejected = err
+			}
+		}
+		r.err = io.EOF
+		if r.rejected != nil {
+			r.err = r.rejected
+		}
+		return
+	}
+
+	content := bytes.TrimSuffix(r.line, []byte("\n"))
+	r.crlf = bytes.HasSuffix(content, []byte("\r"))
+	content = bytes.TrimSuffix(content, []byte("\r"))
+	if bytes.HasPrefix(content, []byte(".")) {
+		content = content[1:]
+	}
+	if (r.overlong || r.maxLine > 0 && len(content)+2 > r.maxLine) && r.rejected == nil {
+		r.rejected = lineTooLongErr
+	}
+	if !r.crlf || bytes.IndexByte(content, '\r') >= 0 {
+		r.bare = true
+		content = normalizeEOL(content)
+		if s.Config.BareEOL == BareEOLReject && r.rejected == nil {
+			r.rejected = bareEOLErr
+		}
+	}
+	if r.header {
+		r.header = len(content) > 0
+		r.headerSize += len(content) + 2
+		if r.maxHeader > 0 && r.headerSize > r.maxHeader && r.rejected == nil {
+			r.rejected = headerTooLargeErr
+		}
+	}
+	r.line = r.line[:0]
+	r.overlong = false
+
+	if r.rejected != nil {
+		return
+	}
+	if r.limit > 0 && r.n+len(content)+2 > r.limit {
+		r.truncated = true
+		_, r.rejected = s.messageLimit()
+		return
+	}
+	r.buf = append(append(r.buf[:0], content...), '\r', '\n')
+	r.pending = r.buf
+	r.n += len(r.buf)
+	if r.scan != nil {
+		r.scan.write(r.buf)
+	}
+}
+
+// streamBackend return the backend when it implement StreamBackend
+// and the message can be streamed to it. features that inspect or
+// rewrite the message need the whole message and disable streaming
+func (s *Session) streamBackend() StreamBackend {
+	sb, ok := s.Config.Backend.(StreamBackend)
+	if !ok || s.Overloaded() {
+		return nil
+	}
+	c := s.Config
+	if len(c.Filters) > 0 || c.VerifyDKIM || c.CheckAlignment || c.AddAuthResults || c.Strict7Bit ||
+		c.Metadata != nil || c.MergeExpansion || c.MailboxDedup != nil || c.CalendarHandler != nil || s.submission() {
+		return nil
+	}
+	// quotas account the size of the delivered message, duplicates
+	// are identified by its header or hash, DMARC evaluate From:,
+	// ARC verify and seal the whole message, Sieve scripts test it
+	// per recipient and Bouncer return it to the sender
+	if c.Quotas != nil || c.MessageDedup != nil || c.DMARC != nil || c.ARC != nil || c.Sieve != nil || c.Bouncer != nil {
+		return nil
+	}
+	if s.Principal != nil && c.Unsubscribe[s.Principal.Tenant] != nil {
+		return nil
+	}
+	return sb
+}
+
+// receiveStream check the envelope and stream message data of DATA
+// from r to sb. the data is read up to the end of data whatever the
+// result so the session stay in sync with the client
+func (s *Session) receiveStream(envl *Envelope, sb StreamBackend, r *dataReader) error {
+	ctx, done := s.stageContext(StageData)
+	err := s.checkPolicy(ctx, StageData, envl, "")
+	done()
+
+	if err == nil {
+		s.rewriteReturnPath(envl)
+		var data io.Reader = r
+		if s.Config.AddReceived {
+			field := "Received: " + foldedValue(s.received(envl)) + "\r\n"
+			data = io.MultiReader(strings.NewReader(field), r)
+		}
+		ctx, span := s.span(envl.Context(), "smtp.deliver")
+		tctx := envl.ctx
+		envl.ctx = ctx
+		err = sb.DeliverStream(envl, data)
+		envl.ctx = tctx
+		span.SetError(err)
+		span.End()
+	}
+	io.Copy(io.Discard, r)
+	if r.connErr != nil {
+		return r.connErr
+	}
+	if r.truncated {
+		s.finishMessage(envl, r.err)
+		return r.err
+	}
+	if r.err != io.EOF {
+		// rejected message data take precedence over the backend
+		// that failed reading it
+		s.countMessage(envl, r.err)
+		return r.err
+	}
+
+	s.observeMessage(r.n)
+	if err == nil {
+		s.track(TrackDelivered, envl, "", envl.RecipientAddress, "")
+	}
+	s.finishMessage(envl, err)
+	return err
+}
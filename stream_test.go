@@ -0,0 +1,120 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// streamRecorder is a StreamBackend recording how messages are
+// delivered. with fail it stop reading after few bytes and fail
+type streamRecorder struct {
+	streamed, buffered int
+	data               string
+	readErr            error
+	fail               error
+}
+
+func (b *streamRecorder) Deliver(envl *Envelope, data []byte) error {
+	b.buffered++
+	b.data = string(data)
+	return nil
+}
+
+func (b *streamRecorder) DeliverStream(envl *Envelope, r io.Reader) error {
+	b.streamed++
+	if b.fail != nil {
+		io.ReadFull(r, make([]byte, 4))
+		return b.fail
+	}
+	data, err := io.ReadAll(r)
+	b.data, b.readErr = string(data), err
+	return err
+}
+
+// TestStreamBackend make sure that message data is streamed decoded
+// to StreamBackend, unless a feature need the whole message, and
+// that the session stay in sync when the stream is not read
+func TestStreamBackend(t *testing.T) {
+	tooLarge := NewSMTPError(552, [3]int{5, 3, 4}, "Message too big")
+	cases := []struct {
+		name     string
+		config   *Config
+		backend  *streamRecorder
+		data     string
+		reply    string
+		streamed bool
+		expected string
+	}{
+		{"stream", &Config{}, &streamRecorder{}, "Subject: a\r\n\r\n..dot\r\nline\r\n", "250 2.0.0 OK: queued as ", true,
+			"Subject: a\r\n\r\n.dot\r\nline\r\n"},
+		{"received", &Config{AddReceived: true}, &streamRecorder{}, "Subject: a\r\n\r\nbody\r\n", "250 2.0.0 OK: queued as ", true,
+			"Received: from client.com"},
+		{"filters", &Config{Filters: []Filter{FilterFunc(func(envl *Envelope, data []byte) ([]byte, error) { return data, nil })}},
+			&streamRecorder{}, "Subject: a\r\n\r\nbody\r\n", "250 2.0.0 OK: queued as ", false, "Subject: a\r\n\r\nbody\r\n"},
+		{"bare", &Config{BareEOL: BareEOLReject}, &streamRecorder{}, "Subject: a\r\n\r\nbare\nline\r\n", "554 5.6.11", true,
+			"Subject: a\r\n\r\n"},
+		{"fail", &Config{}, &streamRecorder{fail: tooLarge}, "Subject: a\r\n\r\n" + strings.Repeat("line\r\n", 1000), "552 5.3.4 Message too big\r\n221", true,
+			""},
+	}
+
+	for _, input := range cases {
+		input.config.Backend = input.backend
+		out := runSession(t, input.config, "EHLO client.com\r\nMAIL FROM:<a@client.com>\r\nRCPT TO:<b@example.com>\r\n"+
+			"DATA\r\n"+input.data+".\r\nQUIT\r\n")
+		if !strings.Contains(out, input.reply) {
+			t.Errorf("%s: got %q, expected %q", input.name, out, input.reply)
+		}
+		b := input.backend
+		if input.streamed != (b.streamed == 1) || b.streamed+b.buffered != 1 {
+			t.Errorf("%s: got %d streamed %d buffered", input.name, b.streamed, b.buffered)
+		}
+		if !strings.HasPrefix(b.data, input.expected) {
+			t.Errorf("%s: got data %q, expected %q", input.name, b.data, input.expected)
+		}
+		if input.reply[0] == '5' && input.backend.fail == nil && b.readErr == nil {
+			t.Errorf("%s: got no read error for rejected data", input.name)
+		}
+	}
+}
+
+// FuzzDataDecode make sure that decoding hostile message data never
+// panic, always produce CRLF lines and stop at the end of data
+func FuzzDataDecode(f *testing.F) {
+	for _, data := range []string{
+		"Subject: test\r\n\r\nbody\r\n.\r\n",
+		"..leading dot\r\n.\r\n",
+		"bare\nLF\rCR\r\n.\r\n",
+		"Subject: " + strings.Repeat("x", 100) + "\r\n\r\n.\r\n",
+		"no end of data\r\n",
+		".\r\n",
+	} {
+		f.Add(data, false)
+	}
+	f.Add("bare\nLF\r\n.\r\n", true)
+	f.Fuzz(func(t *testing.T, data string, reject bool) {
+		s := &Session{
+			Reader: bufio.NewReaderSize(strings.NewReader(data), 16),
+			Config: &Config{MaxLineLength: 64, MaxHeaderSize: 256},
+		}
+		if reject {
+			s.Config.BareEOL = BareEOLReject
+		}
+		r := s.newDataReader(0)
+		out, err := io.ReadAll(r)
+		if len(out) > 0 && !bytes.HasSuffix(out, []byte("\r\n")) {
+			t.Errorf("%q: output %q doesn't end with CRLF", data, out)
+		}
+		if n := bytes.Count(out, []byte("\n")); n != bytes.Count(out, []byte("\r\n")) || n != bytes.Count(out, []byte("\r")) {
+			t.Errorf("%q: output %q has bare CR or LF", data, out)
+		}
+		// the end of data is recognized at the start of data and
+		// after CRLF, whatever the lines before
+		end := strings.HasPrefix(data, ".\r\n") || strings.Contains(data, "\r\n.\r\n")
+		if end && r.connErr != nil {
+			t.Errorf("%q: end of data not found: %v", data, err)
+		}
+	})
+}
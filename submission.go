@@ -0,0 +1,69 @@
+package session
+
+import (
+	"strings"
+	"time"
+)
+
+// Mode is the role of the server
+type Mode int
+
+const (
+	// ModeMTA relay and receive mail from other servers
+	ModeMTA Mode = iota
+	// ModeMSA accept submission of authenticated users on port
+	// 587 (RFC 6409)
+	ModeMSA
+)
+
+// submission error replies
+var (
+	tlsRequiredErr  = NewSMTPError(530, [3]int{5, 7, 0}, "Must issue a STARTTLS command first")
+	authRequiredErr = NewSMTPError(530, [3]int{5, 7, 0}, "Authentication required")
+	senderOwnerErr  = NewSMTPError(553, [3]int{5, 7, 1}, "Sender address rejected: not permitted for user")
+)
+
+// SenderOwnerFunc report whether the authenticated user owns sender
+type SenderOwnerFunc func(p *Principal, sender string) bool
+
+// submission report whether the session is a message submission
+func (s *Session) submission() bool {
+	return s.Config.Mode == ModeMSA
+}
+
+// checkSubmission require TLS and AUTH before MAIL and check that the
+// user owns or is granted the sender address in submission mode
+func (s *Session) checkSubmission(sender string) error {
+	if !s.submission() {
+		return nil
+	}
+	if !s.TLS() {
+		return tlsRequiredErr
+	}
+	if s.Principal == nil {
+		return authRequiredErr
+	}
+	return s.authorizeSender(sender)
+}
+
+// fixupMessage add Date and Message-ID header fields missing from a
+// submitted message (RFC 6409 section 8)
+func (s *Session) fixupMessage(data []byte) []byte {
+	fields, _ := splitMessage(data)
+	var hasDate, hasID bool
+	for _, f := range fields {
+		switch strings.ToLower(f.name) {
+		case "date":
+			hasDate = true
+		case "message-id":
+			hasID = true
+		}
+	}
+	if !hasID {
+		data = prependHeader(data, "Message-ID", "<"+newSpoolID()+"@"+s.Hostname()+">")
+	}
+	if !hasDate {
+		data = prependHeader(data, "Date", time.Now().Format(time.RFC1123Z))
+	}
+	return data
+}
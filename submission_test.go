@@ -0,0 +1,63 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestSessionSubmission make sure that submission require TLS and
+// AUTH before MAIL and restrict senders to addresses of the user
+func TestSessionSubmission(t *testing.T) {
+	owner := SenderOwnerFunc(func(p *Principal, sender string) bool {
+		return sender == p.Username+"@example.com"
+	})
+	auth := "AUTH PLAIN " + plainResponse("user", "secret") + "\r\n"
+
+	cases := []struct {
+		config   Config
+		input    string
+		expected string
+	}{
+		{Config{}, "MAIL FROM:<user@example.com>\r\n", "530 5.7.0 Must issue a STARTTLS command first"},
+		{Config{}, auth, "538 5.7.11"},
+		{Config{TLSTerminated: true}, "MAIL FROM:<user@example.com>\r\n", "530 5.7.0 Authentication required"},
+		{Config{TLSTerminated: true}, auth + "MAIL FROM:<user@example.com>\r\n", "235 2.7.0 Authentication successful\r\n250"},
+		{Config{TLSTerminated: true}, auth + "MAIL FROM:<other@example.com>\r\n", "553 5.7.1 Sender address rejected: not permitted for user"},
+	}
+
+	for _, input := range cases {
+		config := input.config
+		config.Mode = ModeMSA
+		config.Authenticator = testAuthenticator
+		config.SenderOwner = owner
+		out := runSession(t, &config, "EHLO client.com\r\n"+input.input+"QUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("%q: got %q, expected %q", input.input, out, input.expected)
+		}
+	}
+}
+
+// TestSubmissionFixup make sure that missing Date and Message-ID are
+// added to submitted messages
+func TestSubmissionFixup(t *testing.T) {
+	cases := []struct {
+		data     string
+		date     bool
+		expected string
+	}{
+		{"Subject: a\r\n\r\nbody\r\n", true, "@mx.example.com>\r\nSubject: a\r\n"},
+		{"Date: Mon, 2 Jan 2006 15:04:05 +0000\r\nSubject: a\r\n\r\n", false, "Message-ID: <"},
+		{"date: Mon, 2 Jan 2006 15:04:05 +0000\r\nmessage-id: <a@b>\r\n\r\n", false, "date: Mon"},
+	}
+
+	s := &Session{Config: &Config{Mode: ModeMSA, Hostname: "mx.example.com"}}
+	for _, input := range cases {
+		got := string(s.ProcessMessage(&Envelope{}, []byte(input.data)))
+		if strings.HasPrefix(got, "Date: ") != input.date || !strings.Contains(got, input.expected) {
+			t.Errorf("%q: got %q, expected %q", input.data, got, input.expected)
+		}
+		if strings.Count(strings.ToLower(got), "message-id:") != 1 {
+			t.Errorf("%q: got %q, expected one Message-ID", input.data, got)
+		}
+	}
+}
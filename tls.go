@@ -0,0 +1,198 @@
+package session
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// tlsHandshakeTimeout limit the TLS handshake of STARTTLS and SMTPS
+const tlsHandshakeTimeout = 30 * time.Second
+
+// errNoCertificate is returned by ServeTLS without certificate
+var errNoCertificate = errors.New("session: no TLS certificate")
+
+// define STARTTLS replies
+const (
+	REPLY_220_TLS = "220 2.0.0 Ready to start TLS"
+)
+
+// tls error replies
+var (
+	tlsVersionErr      = NewSMTPError(530, [3]int{5, 7, 0}, "Newer TLS version required")
+	tlsUnavailableErr  = NewSMTPError(454, [3]int{4, 7, 0}, "TLS not available")
+	tlsAlreadyErr      = NewSMTPError(503, [3]int{5, 5, 1}, "Already in TLS")
+	encryptRequiredErr = NewSMTPError(538, [3]int{5, 7, 11}, "Encryption required for requested authentication mechanism")
+)
+
+func init() {
+	RegisterCommand(Command{
+		Verb:     "STARTTLS",
+		States:   []State{StateHelloed},
+		Validate: validStartTLS,
+		Handle:   (*Session).cmdStartTLS,
+	})
+}
+
+// TLS report whether the session is encrypted, either by STARTTLS
+// or by a proxy that terminated TLS in front of the server
+func (s *Session) TLS() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.secure
+}
+
+// TLSVersion return the TLS version of the session like "TLSv1.3",
+// empty when unknown
+func (s *Session) TLSVersion() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tlsVersion
+}
+
+// TLSState return the state of TLS connection after STARTTLS or
+// implicit TLS, nil without TLS or when TLS is terminated by a proxy
+func (s *Session) TLSState() *tls.ConnectionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tlsState
+}
+
+// TLSCipher return the cipher suite of the session like
+// "TLS_AES_128_GCM_SHA256", empty when unknown
+func (s *Session) TLSCipher() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tlsCipher
+}
+
+// setTLS mark the session as encrypted
+func (s *Session) setTLS(version, cipher string) {
+	s.mu.Lock()
+	s.secure, s.tlsVersion, s.tlsCipher = true, version, cipher
+	s.mu.Unlock()
+}
+
+// tlsVersionName return name of TLS version like "TLSv1.3", the
+// format of OpenSSL and PROXY protocol
+func tlsVersionName(v uint16) string {
+	return strings.Replace(tls.VersionName(v), "TLS ", "TLSv", 1)
+}
+
+// handshake run TLS handshake on the connection as server, the
+// session then read and write through TLS
+func (s *Session) handshake(config *tls.Config) error {
+	if s.Config.CertAuthorizer != nil && config.ClientAuth == tls.NoClientCert {
+		config = config.Clone()
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	conn := tls.Server(s.Conn, config)
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	s.setConn(conn)
+
+	state := conn.ConnectionState()
+	s.setTLS(tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	s.mu.Lock()
+	s.tlsState = &state
+	s.mu.Unlock()
+	s.logf(LevelInfo, "TLS %s %s", s.TLSVersion(), s.TLSCipher())
+	s.authorizeCert(&state)
+	return nil
+}
+
+// setConn replace the connection of the session, e.g. after TLS
+// handshake. buffered input is discarded
+func (s *Session) setConn(conn net.Conn) {
+	s.mu.Lock()
+	s.Conn = conn
+	s.mu.Unlock()
+	s.bufR.Reset(conn)
+	s.bufW.Reset(conn)
+	s.Reader, s.Writer, s.Reply.w = s.bufR, s.bufW, s.bufW
+	s.captureTranscript()
+}
+
+// offerTLS report whether STARTTLS is advertised
+func (s *Session) offerTLS() bool {
+	return s.Config.TLSConfig != nil && !s.TLS()
+}
+
+// authAllowed report whether AUTH is permitted in the session, TLS
+// is required unless AuthAllowPlaintext and submission always
+// require it
+func (s *Session) authAllowed() bool {
+	requireTLS := !s.Config.AuthAllowPlaintext || s.submission()
+	return s.Config.Authenticator != nil && (!requireTLS || s.TLS())
+}
+
+// validStartTLS check that STARTTLS is enabled and not done yet
+func validStartTLS(s *Session, req *CommandRequest) error {
+	if req.Arg != "" {
+		return invalidCommandArgErr
+	}
+	if s.TLS() {
+		return tlsAlreadyErr
+	}
+	if s.Config.TLSConfig == nil {
+		return tlsUnavailableErr
+	}
+	return nil
+}
+
+// cmdStartTLS upgrade the connection (RFC 3207). commands pipelined
+// after STARTTLS are discarded and the client must send EHLO again.
+// everything learned from the client before TLS is forgotten (RFC
+// 3207 section 4.2), a client certificate may authenticate it again
+func (s *Session) cmdStartTLS(req *CommandRequest) error {
+	if err := s.Reply.Transmit(REPLY_220_TLS); err != nil {
+		return err
+	}
+
+	s.Principal = nil
+	s.HeloName, s.ehlo = "", false
+	s.reset()
+	s.setState(StateGreeting)
+	if err := s.handshake(s.Config.TLSConfig); err != nil {
+		s.logf(LevelInfo, "TLS handshake: %v", err)
+		return err
+	}
+	return nil
+}
+
+// tlsVersions map names of tlsVersionName to versions
+var tlsVersions = map[string]uint16{
+	"TLSv1.0": tls.VersionTLS10,
+	"TLSv1.1": tls.VersionTLS11,
+	"TLSv1.2": tls.VersionTLS12,
+	"TLSv1.3": tls.VersionTLS13,
+}
+
+// RequireTLS is a Policy rejecting MAIL of sessions without TLS or
+// with TLS version older than min like tls.VersionTLS12. version of
+// TLS terminated by a proxy is known from PROXY protocol only
+func RequireTLS(min uint16) Policy {
+	return PolicyFunc(func(ctx context.Context, req *PolicyRequest) error {
+		if req.Stage != StageMail {
+			return nil
+		}
+		s := req.Session
+		if !s.TLS() {
+			return tlsRequiredErr
+		}
+		version := tlsVersions[s.TLSVersion()]
+		if state := s.TLSState(); state != nil {
+			version = state.Version
+		}
+		if version < min {
+			return tlsVersionErr
+		}
+		return nil
+	})
+}
@@ -0,0 +1,214 @@
+package session
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTLSConfig return server config with self-signed certificate
+// of localhost
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// TestSessionStartTLS make sure that STARTTLS upgrade the session,
+// AUTH is only permitted after it and Received header say ESMTPSA
+func TestSessionStartTLS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []byte, 1)
+	srv := NewServer(&Config{
+		TLSConfig:     testTLSConfig(t),
+		Authenticator: testAuthenticator,
+		AddReceived:   true,
+		Policies:      []Policy{RequireTLS(tls.VersionTLS12)},
+		Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			if envl.TLS == nil || envl.TLS.Version != tls.VersionTLS13 {
+				return errors.New("missing TLS state")
+			}
+			received <- data
+			return nil
+		}),
+	})
+	go srv.Serve(l)
+	defer l.Close()
+
+	plain := dialTestClient(t, l.Addr().String())
+	plain.cmd(t, "EHLO client.com", "250")
+	plain.cmd(t, "AUTH PLAIN "+plainResponse("user", "secret"), "538 5.7.11")
+	plain.cmd(t, "STARTTLS now", "501 5.5.4")
+	plain.conn.Close()
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Error("AUTH offered before STARTTLS")
+	}
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Error("STARTTLS offered in TLS session")
+	}
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err == nil {
+		t.Error("STARTTLS accepted twice")
+	}
+	if err := c.Auth(smtp.PlainAuth("", "user", "secret", "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("some@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("some@domain.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Subject: a\r\n\r\nbody\r\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := string(<-received)
+	if !strings.Contains(data, "with ESMTPSA (version=TLSv1.3 cipher=TLS_AES_128_GCM_SHA256)") {
+		t.Errorf("got %q, expected Received header with ESMTPSA", data)
+	}
+}
+
+// TestSessionStartTLSReset make sure that the HELO name and the
+// principal authenticated before STARTTLS are forgotten
+func TestSessionStartTLSReset(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	srv := NewServer(&Config{
+		TLSConfig:          testTLSConfig(t),
+		Authenticator:      testAuthenticator,
+		AuthAllowPlaintext: true,
+	})
+	go srv.Serve(l)
+
+	c := dialTestClient(t, l.Addr().String())
+	c.cmd(t, "EHLO client.com", "250")
+	c.cmd(t, "AUTH PLAIN "+plainResponse("user", "secret"), "235 2.7.0")
+	c.cmd(t, "STARTTLS", "220 2.0.0")
+	conn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c = &testClient{conn: conn, reader: bufio.NewReader(conn)}
+	c.cmd(t, "MAIL FROM:<user@example.com>", "503 5.5.1 HELO/EHLO first")
+	c.cmd(t, "EHLO client.com", "250")
+	c.cmd(t, "AUTH PLAIN "+plainResponse("user", "secret"), "235 2.7.0")
+	c.cmd(t, "MAIL FROM:<user@example.com>", "250")
+	conn.Close()
+}
+
+// TestServerServeTLS make sure that SMTPS sessions start with TLS
+// handshake and are treated like sessions after STARTTLS
+func TestServerServeTLS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(&Config{
+		TLSConfig:     testTLSConfig(t),
+		Authenticator: testAuthenticator,
+	})
+	go srv.ServeTLS(l, "", "")
+	defer l.Close()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &testClient{conn: conn, reader: bufio.NewReader(conn)}
+	c.expect(t, "220 ")
+	fmt.Fprint(conn, "EHLO client.com\r\n")
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(line, "STARTTLS") {
+			t.Errorf("got %q, STARTTLS offered in SMTPS session", line)
+		}
+		if strings.HasPrefix(line, "250 ") {
+			break
+		}
+	}
+	c.cmd(t, "AUTH PLAIN "+plainResponse("user", "secret"), "235 2.7.0")
+	c.cmd(t, "STARTTLS", "503 5.5.1 Already in TLS")
+
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewServer(nil).ServeTLS(l2, "", ""); err != errNoCertificate {
+		t.Errorf("got %v, expected error without certificate", err)
+	}
+}
+
+// TestRequireTLS make sure that the policy reject MAIL without TLS or
+// with old TLS version
+func TestRequireTLS(t *testing.T) {
+	oldTLS := tlv(pp2TypeSSL, append([]byte{pp2ClientSSL, 0, 0, 0, 0}, tlv(pp2SubtypeSSLVer, []byte("TLSv1.1"))...))
+
+	cases := []struct {
+		header   string
+		expected string
+	}{
+		{"PROXY TCP4 192.0.2.7 198.51.100.1 4000 25\r\n", "530 5.7.0 Must issue a STARTTLS command first"},
+		{proxyV2(proxyV2CmdProxy, oldTLS), "530 5.7.0 Newer TLS version required"},
+		{proxyV2(proxyV2CmdProxy, sslTLV), "250 2.0.0 OK"},
+	}
+
+	for _, input := range cases {
+		config := &Config{ProxyProtocol: true, Policies: []Policy{RequireTLS(tls.VersionTLS12)}}
+		out := runSession(t, config, input.header+"EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nQUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("%q: got %q, expected %q", input.header, out, input.expected)
+		}
+	}
+}
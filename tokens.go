@@ -0,0 +1,123 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// app token errors
+var (
+	ErrUnknownToken  = errors.New("session: unknown app token")
+	ErrInvalidDevice = errors.New("session: invalid device name")
+)
+
+// AppToken is a per-device credential of a user. it is only accepted
+// by SMTP AUTH in place of the primary password and can be revoked
+// on its own. the secret is random, so a SHA-256 hash is kept
+type AppToken struct {
+	ID      string    `json:"id"`
+	Device  string    `json:"device"`
+	Created time.Time `json:"created"`
+	Hash    string    `json:"-"`
+}
+
+// String return the token as user option "id/created/hash/device"
+func (t *AppToken) String() string {
+	return fmt.Sprintf("%s/%d/%s/%s", t.ID, t.Created.Unix(), t.Hash, t.Device)
+}
+
+// parseAppToken parse the token option value
+func parseAppToken(value string) (AppToken, error) {
+	parts := strings.SplitN(value, "/", 4)
+	if len(parts) != 4 || parts[0] == "" || len(parts[2]) != sha256.Size*2 {
+		return AppToken{}, fmt.Errorf("invalid token %q", value)
+	}
+	created, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return AppToken{}, fmt.Errorf("invalid token %q", value)
+	}
+	return AppToken{ID: parts[0], Created: time.Unix(created, 0).UTC(), Hash: parts[2], Device: parts[3]}, nil
+}
+
+// hashTokenSecret return hex SHA-256 of secret
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAppToken return a token of device and the credential given to
+// the user, "id.secret"
+func newAppToken(device string) (AppToken, string) {
+	id := make([]byte, 4)
+	rand.Read(id)
+	t := AppToken{ID: hex.EncodeToString(id), Device: device, Created: time.Now().UTC().Truncate(time.Second)}
+	secret := rand.Text()
+	t.Hash = hashTokenSecret(secret)
+	return t, t.ID + "." + secret
+}
+
+// matchToken return the app token of u matching credential
+func (u *User) matchToken(credential string) (*AppToken, bool) {
+	id, secret, ok := strings.Cut(credential, ".")
+	if !ok {
+		return nil, false
+	}
+	for i := range u.Tokens {
+		t := &u.Tokens[i]
+		if t.ID == id {
+			return t, subtle.ConstantTimeCompare([]byte(hashTokenSecret(secret)), []byte(t.Hash)) == 1
+		}
+	}
+	return nil, false
+}
+
+// checkToken refuse principal authenticated with an app token outside
+// of submission mode, app tokens are issued to mail clients only
+func (s *Session) checkToken(p *Principal) error {
+	if p.Token == "" || s.submission() {
+		return nil
+	}
+	s.logf(LevelInfo, "app token %s refused outside submission", p.Credential())
+	return authInvalidErr
+}
+
+// CreateToken add an app token of device to user and return the
+// credential, it can't be recovered later
+func (us *UserStore) CreateToken(name, device string) (AppToken, string, error) {
+	if device == "" || strings.ContainsAny(device, ",/:\t\r\n") {
+		return AppToken{}, "", ErrInvalidDevice
+	}
+	t, credential := newAppToken(device)
+	err := us.modify(name, "token created "+t.ID, func(u *User) error {
+		u.Tokens = append(append([]AppToken(nil), u.Tokens...), t)
+		return nil
+	})
+	if err != nil {
+		return AppToken{}, "", err
+	}
+	return t, credential, nil
+}
+
+// RevokeToken remove the app token id of user
+func (us *UserStore) RevokeToken(name, id string) error {
+	return us.modify(name, "token revoked "+id, func(u *User) error {
+		var tokens []AppToken
+		for _, t := range u.Tokens {
+			if t.ID != id {
+				tokens = append(tokens, t)
+			}
+		}
+		if len(tokens) == len(u.Tokens) {
+			return ErrUnknownToken
+		}
+		u.Tokens = tokens
+		return nil
+	})
+}
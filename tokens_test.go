@@ -0,0 +1,176 @@
+package session
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAppTokens make sure that app tokens authenticate on their own
+// and are revoked individually
+func TestAppTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("user:"+testHash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	us, err := OpenUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone, phoneCred, err := us.CreateToken("user", "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, laptopCred, _ := us.CreateToken("user", "laptop")
+	if _, _, err := us.CreateToken("user", "bad/device"); err != ErrInvalidDevice {
+		t.Errorf("got %v, expected invalid device", err)
+	}
+
+	// the file is read back with the tokens
+	if us, err = OpenUserStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.RevokeToken("user", phone.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.RevokeToken("user", phone.ID); err != ErrUnknownToken {
+		t.Errorf("got %v, expected unknown token", err)
+	}
+
+	cases := []struct {
+		password string
+		expected string
+		err      error
+	}{
+		{"secret", "user", nil},
+		{laptopCred, "user/" + laptopCred[:8], nil},
+		{phoneCred, "", ErrAuthFailed},
+		{laptopCred[:9] + "wrong", "", ErrAuthFailed},
+	}
+	for _, input := range cases {
+		p, err := us.Authenticate("user", input.password)
+		if err != input.err || (p != nil && p.Credential() != input.expected) {
+			t.Errorf("%q: got %+v, %v, expected %q, %v", input.password, p, err, input.expected, input.err)
+		}
+	}
+
+	// a password that start with the ID of a token still works
+	password := laptopCred[:9] + "password"
+	if err := us.SetPassword("user", password); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := us.Authenticate("user", password); err != nil || p.Credential() != "user" {
+		t.Errorf("got %+v, %v, expected password login", p, err)
+	}
+}
+
+// TestAdminTokens make sure that app tokens are managed through the
+// admin API and the credential is returned once
+func TestAdminTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("user:"+testHash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	us, err := OpenUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := &Admin{Accounts: us}
+
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/accounts/user/tokens", strings.NewReader(`{"device":"phone"}`)))
+	var created struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil || rec.Code != http.StatusCreated || created.Token == "" {
+		t.Fatalf("got %d %+v, %v, expected created token", rec.Code, created, err)
+	}
+
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/accounts/user/tokens", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `"device":"phone"`) || strings.Contains(body, created.Token[9:]) {
+		t.Errorf("got %s, expected token without secret", body)
+	}
+
+	cases := []struct {
+		method, path, body string
+		expected           int
+	}{
+		{http.MethodPost, "/accounts/user/tokens", `{"device":""}`, http.StatusBadRequest},
+		{http.MethodDelete, "/accounts/user/tokens/" + created.ID, "", http.StatusNoContent},
+		{http.MethodDelete, "/accounts/user/tokens/" + created.ID, "", http.StatusNotFound},
+	}
+	for _, input := range cases {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(input.method, input.path, strings.NewReader(input.body)))
+		if rec.Code != input.expected {
+			t.Errorf("%s %s: got status %d, expected %d", input.method, input.path, rec.Code, input.expected)
+		}
+	}
+}
+
+// TestSessionAppTokenRate make sure that each app token is rate
+// limited on its own
+func TestSessionAppTokenRate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("user:"+testHash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	us, err := OpenUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, phone, _ := us.CreateToken("user", "phone")
+	_, laptop, _ := us.CreateToken("user", "laptop")
+	config := &Config{Mode: ModeMSA, TLSTerminated: true, Authenticator: us, RateLimits: &RateLimits{MessagesPerUser: Rate{Count: 1, Per: time.Hour}}}
+
+	cases := []struct {
+		password string
+		expected string
+	}{
+		{phone, "235 2.7.0 Authentication successful\r\n250"},
+		{phone, "235 2.7.0 Authentication successful\r\n450"},
+		{laptop, "235 2.7.0 Authentication successful\r\n250"},
+	}
+	for _, input := range cases {
+		out := runSession(t, config, "EHLO client.com\r\nAUTH PLAIN "+plainResponse("user", input.password)+"\r\nMAIL FROM:<some@example.com>\r\nQUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("%q: got %q, expected %q", input.password, out, input.expected)
+		}
+	}
+}
+
+// TestSessionAppTokenMTA make sure that app tokens are refused
+// outside of submission mode while the password is accepted
+func TestSessionAppTokenMTA(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("user:"+testHash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	us, err := OpenUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, phone, _ := us.CreateToken("user", "phone")
+	config := &Config{Mode: ModeMTA, TLSTerminated: true, Authenticator: us}
+
+	cases := []struct {
+		password string
+		expected string
+	}{
+		{phone, "535 5.7.8 Authentication credentials invalid"},
+		{"secret", "235 2.7.0 Authentication successful"},
+	}
+	for _, input := range cases {
+		out := runSession(t, config, "EHLO client.com\r\nAUTH PLAIN "+plainResponse("user", input.password)+"\r\nQUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("%q: got %q, expected %q", input.password, out, input.expected)
+		}
+	}
+}
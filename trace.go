@@ -0,0 +1,108 @@
+package session
+
+import (
+	"context"
+	"net"
+)
+
+// Tracer start spans of sessions, e.g. an adapter of OpenTelemetry
+// trace.Tracer. spans started from a context must be children of
+// the span of that context
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a traced operation
+type Span interface {
+	SetAttribute(key string, value any)
+	// SetError mark the span failed with err
+	SetError(err error)
+	End()
+}
+
+// noopSpan is the span when Config.Tracer is nil
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value any) {}
+func (noopSpan) SetError(err error)                 {}
+func (noopSpan) End()                               {}
+
+// Context return the context of the mail transaction carrying its
+// trace, for backends and filters
+func (e *Envelope) Context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+// span start a child span of ctx
+func (s *Session) span(ctx context.Context, name string) (context.Context, Span) {
+	if s.Config.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return s.Config.Tracer.Start(ctx, name)
+}
+
+// startTrace start the span of the connection
+func (s *Session) startTrace() {
+	s.traceCtx, s.traceSpan = s.span(context.Background(), "smtp.session")
+	if ip := s.RemoteIP(); ip != nil {
+		s.traceSpan.SetAttribute("net.peer.ip", ip.String())
+	}
+	if addr := s.Conn.LocalAddr(); addr != nil {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			s.traceSpan.SetAttribute("net.host.port", port)
+		}
+	}
+}
+
+// endTrace end spans of the connection and its transaction
+func (s *Session) endTrace() {
+	s.endTransaction()
+	if s.traceSpan == nil {
+		return
+	}
+	s.traceSpan.SetAttribute("smtp.helo", s.HeloName)
+	s.traceSpan.SetAttribute("smtp.tls", s.TLS())
+	s.traceSpan.End()
+}
+
+// traceContext return the context of the transaction, or of the
+// session outside of transaction
+func (s *Session) traceContext() context.Context {
+	if s.envl != nil && s.envl.ctx != nil {
+		return s.envl.ctx
+	}
+	if s.traceCtx != nil {
+		return s.traceCtx
+	}
+	return context.Background()
+}
+
+// beginTransaction start the span of mail transaction at MAIL
+func (s *Session) beginTransaction() {
+	s.endTransaction()
+	if s.traceCtx == nil {
+		return
+	}
+	s.envl.ctx, s.txSpan = s.span(s.traceCtx, "smtp.transaction")
+}
+
+// endTransaction end the span of the current mail transaction
+func (s *Session) endTransaction() {
+	if s.txSpan == nil {
+		return
+	}
+	s.txSpan.SetAttribute("smtp.mail_from", s.envl.OriginatorAddress)
+	s.txSpan.SetAttribute("smtp.rcpt_count", len(s.envl.RecipientAddress))
+	s.txSpan.End()
+	s.txSpan = nil
+}
+
+// traceError mark the transaction failed with err
+func (s *Session) traceError(err error) {
+	if s.txSpan != nil && err != nil {
+		s.txSpan.SetError(err)
+	}
+}
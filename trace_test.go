@@ -0,0 +1,123 @@
+package session
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testSpan is a span recorded by testTracer
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]any
+	err    error
+	ended  bool
+}
+
+func (sp *testSpan) SetAttribute(key string, value any) { sp.attrs[key] = value }
+func (sp *testSpan) SetError(err error) {
+	if err != nil {
+		sp.err = err
+	}
+}
+func (sp *testSpan) End() { sp.ended = true }
+
+type spanKey struct{}
+
+// testTracer record every started span
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (tr *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*testSpan)
+	sp := &testSpan{name: name, parent: parent, attrs: make(map[string]any)}
+	tr.mu.Lock()
+	tr.spans = append(tr.spans, sp)
+	tr.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// tree return "name<parent" of every span
+func (tr *testTracer) tree() []string {
+	var out []string
+	for _, sp := range tr.spans {
+		s := sp.name
+		if sp.parent != nil {
+			s += "<" + sp.parent.name
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// TestTracing make sure that the connection, transactions, DATA,
+// delivery and DNS checks are traced and backends get the trace
+func TestTracing(t *testing.T) {
+	cases := []struct {
+		name     string
+		backend  Backend
+		expected []string
+	}{
+		{"buffered", nil, []string{"smtp.session", "smtp.transaction<smtp.session", "smtp.spf<smtp.transaction",
+			"smtp.transaction<smtp.session", "smtp.spf<smtp.transaction", "smtp.data.read<smtp.transaction", "smtp.deliver<smtp.transaction"}},
+		{"stream", &streamRecorder{}, []string{"smtp.session", "smtp.transaction<smtp.session", "smtp.spf<smtp.transaction",
+			"smtp.transaction<smtp.session", "smtp.spf<smtp.transaction", "smtp.data.read<smtp.transaction", "smtp.deliver<smtp.transaction"}},
+	}
+
+	for _, input := range cases {
+		tr := &testTracer{}
+		var backendSpan *testSpan
+		backend := input.backend
+		if backend == nil {
+			backend = BackendFunc(func(envl *Envelope, data []byte) error {
+				backendSpan, _ = envl.Context().Value(spanKey{}).(*testSpan)
+				return nil
+			})
+		}
+		config := &Config{Tracer: tr, CheckSPF: true, Resolver: &fakeResolver{}, Backend: backend}
+		out := runSessionFrom(t, config, "192.0.2.1:2525", "EHLO client.com\r\nMAIL FROM:<a@client.com>\r\nRSET\r\n"+
+			"MAIL FROM:<a@client.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nSubject: a\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+		if !strings.Contains(out, "250 2.0.0 OK: queued as ") {
+			t.Fatalf("%s: got %q", input.name, out)
+		}
+
+		if got := tr.tree(); !reflect.DeepEqual(got, input.expected) {
+			t.Errorf("%s: got spans %v, expected %v", input.name, got, input.expected)
+		}
+		for _, sp := range tr.spans {
+			if !sp.ended {
+				t.Errorf("%s: span %s not ended", input.name, sp.name)
+			}
+		}
+		if ip := tr.spans[0].attrs["net.peer.ip"]; ip != "192.0.2.1" {
+			t.Errorf("%s: got peer %v", input.name, ip)
+		}
+		tx := tr.spans[3]
+		if tx.attrs["smtp.mail_from"] != "a@client.com" || tx.attrs["smtp.rcpt_count"] != 1 {
+			t.Errorf("%s: got transaction attributes %v", input.name, tx.attrs)
+		}
+		if input.backend == nil && backendSpan != tr.spans[6] {
+			t.Errorf("%s: got backend span %+v, expected delivery span", input.name, backendSpan)
+		}
+	}
+}
+
+// TestTracingError make sure that rejected transactions are marked
+// failed
+func TestTracingError(t *testing.T) {
+	tr := &testTracer{}
+	config := &Config{Tracer: tr, Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+		return ErrRcptOverQuota
+	})}
+	runSession(t, config, "EHLO client.com\r\nMAIL FROM:<a@client.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nSubject: a\r\n\r\n.\r\nQUIT\r\n")
+	for _, sp := range tr.spans {
+		if (sp.name == "smtp.transaction" || sp.name == "smtp.deliver") && sp.err != ErrRcptOverQuota {
+			t.Errorf("%s: got error %v", sp.name, sp.err)
+		}
+	}
+}
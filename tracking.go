@@ -0,0 +1,73 @@
+package session
+
+import (
+	"bytes"
+	"net/mail"
+	"time"
+)
+
+// tracking event types
+const (
+	TrackDelivered = "delivered"
+	TrackDuplicate = "duplicate"
+	TrackBounced   = "bounced"
+)
+
+// TrackingEvent represents disposition of a message for one recipient
+type TrackingEvent struct {
+	Time      time.Time
+	Type      string
+	MessageID string
+	Sender    string
+	Recipient string
+	Detail    string
+	// Metadata is the metadata of the message, see Config.Metadata
+	Metadata map[string]string
+}
+
+// Tracker record tracking events of messages, e.g. into a log
+// searchable by operators
+type Tracker interface {
+	Track(ev *TrackingEvent)
+}
+
+// TrackerFunc is an adapter to allow the use of ordinary
+// functions as Tracker
+type TrackerFunc func(ev *TrackingEvent)
+
+// Track call f(ev)
+func (f TrackerFunc) Track(ev *TrackingEvent) {
+	f(ev)
+}
+
+// track record an event for each recipient when Tracker configured
+func (s *Session) track(typ string, envl *Envelope, msgID string, rcpts []string, detail string) {
+	if s.Config.Tracker == nil {
+		return
+	}
+	sender := envl.OriginatorAddress
+	if envl.OriginalSender != "" {
+		sender = envl.OriginalSender
+	}
+	now := time.Now()
+	for _, rcpt := range rcpts {
+		s.Config.Tracker.Track(&TrackingEvent{
+			Time:      now,
+			Type:      typ,
+			MessageID: msgID,
+			Sender:    sender,
+			Recipient: rcpt,
+			Detail:    detail,
+			Metadata:  envl.Metadata,
+		})
+	}
+}
+
+// messageID return the Message-ID header of message data
+func messageID(data []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	return msg.Header.Get("Message-Id")
+}
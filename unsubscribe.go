@@ -0,0 +1,61 @@
+package session
+
+import (
+	"bytes"
+	"net/mail"
+	"net/url"
+	"strings"
+)
+
+// UnsubscribeTemplate represents List-Unsubscribe header (RFC 2369)
+// injected into messages of a bulk sender tenant. URL and Mailto may
+// contain placeholders {sender}, {recipient} and {tenant}, {recipient}
+// is expanded only when the message has a single recipient
+type UnsubscribeTemplate struct {
+	URL    string
+	Mailto string
+	// OneClick add List-Unsubscribe-Post header (RFC 8058),
+	// only applied when URL is https
+	OneClick bool
+}
+
+// expand replace placeholders in s with escaped values of envelope
+func (tpl *UnsubscribeTemplate) expand(s string, envl *Envelope, tenant string, escape func(string) string) string {
+	recipient := ""
+	if len(envl.RecipientAddress) == 1 {
+		recipient = envl.RecipientAddress[0]
+	}
+	r := strings.NewReplacer(
+		"{sender}", escape(envl.OriginatorAddress),
+		"{recipient}", escape(recipient),
+		"{tenant}", escape(tenant),
+	)
+	return r.Replace(s)
+}
+
+// Inject add List-Unsubscribe headers into message data. message
+// that already have List-Unsubscribe header is returned as is
+func (tpl *UnsubscribeTemplate) Inject(envl *Envelope, tenant string, data []byte) []byte {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil || msg.Header.Get("List-Unsubscribe") != "" {
+		return data
+	}
+
+	var uris []string
+	link := ""
+	if tpl.URL != "" {
+		link = tpl.expand(tpl.URL, envl, tenant, url.QueryEscape)
+		uris = append(uris, "<"+link+">")
+	}
+	if tpl.Mailto != "" {
+		uris = append(uris, "<mailto:"+tpl.expand(tpl.Mailto, envl, tenant, url.PathEscape)+">")
+	}
+	if len(uris) == 0 {
+		return data
+	}
+
+	if tpl.OneClick && strings.HasPrefix(link, "https://") {
+		data = prependHeader(data, "List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+	return prependHeader(data, "List-Unsubscribe", strings.Join(uris, ", "))
+}
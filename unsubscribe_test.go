@@ -0,0 +1,72 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestUnsubscribeInject make sure that List-Unsubscribe headers are
+// expanded from template and existing header is preserved
+func TestUnsubscribeInject(t *testing.T) {
+	envl := &Envelope{
+		OriginatorAddress: "news@example.com",
+		RecipientAddress:  []string{"some+tag@domain.com"},
+	}
+
+	cases := []struct {
+		tpl      *UnsubscribeTemplate
+		data     string
+		expected string
+	}{
+		{&UnsubscribeTemplate{URL: "https://example.com/u?r={recipient}&t={tenant}", OneClick: true},
+			"Subject: news\r\n\r\nbody\r\n",
+			"List-Unsubscribe: <https://example.com/u?r=some%2Btag%40domain.com&t=acme>\r\n" +
+				"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\nSubject: news\r\n\r\nbody\r\n"},
+		{&UnsubscribeTemplate{URL: "http://example.com/u", Mailto: "unsub@example.com", OneClick: true},
+			"Subject: news\r\n\r\nbody\r\n",
+			"List-Unsubscribe: <http://example.com/u>, <mailto:unsub@example.com>\r\nSubject: news\r\n\r\nbody\r\n"},
+		{&UnsubscribeTemplate{URL: "https://example.com/u"},
+			"List-Unsubscribe: <https://own.com>\r\n\r\nbody\r\n",
+			"List-Unsubscribe: <https://own.com>\r\n\r\nbody\r\n"},
+		{&UnsubscribeTemplate{}, "Subject: news\r\n\r\nbody\r\n", "Subject: news\r\n\r\nbody\r\n"},
+	}
+
+	for _, input := range cases {
+		got := string(input.tpl.Inject(envl, "acme", []byte(input.data)))
+		if got != input.expected {
+			t.Errorf("got: %q, expected: %q", got, input.expected)
+		}
+	}
+}
+
+// TestSessionUnsubscribe make sure that headers injected only for
+// authenticated users of bulk sender tenant
+func TestSessionUnsubscribe(t *testing.T) {
+	var delivered []string
+	config := &Config{
+		Authenticator:      testAuthenticator,
+		AuthAllowPlaintext: true,
+		Unsubscribe: map[string]*UnsubscribeTemplate{
+			"tenant": {Mailto: "unsub@example.com"},
+		},
+		Backend: BackendFunc(func(envl *Envelope, data []byte) error {
+			delivered = append(delivered, string(data))
+			return nil
+		}),
+	}
+
+	transaction := "MAIL FROM:<news@example.com>\r\nRCPT TO:<some@domain.com>\r\n" +
+		"DATA\r\nSubject: news\r\n\r\nbody\r\n.\r\n"
+	runSession(t, config, "EHLO client.com\r\n"+transaction+
+		"AUTH PLAIN "+plainResponse("user", "secret")+"\r\n"+transaction+"QUIT\r\n")
+
+	if len(delivered) != 2 {
+		t.Fatalf("got %d delivered messages, expected 2", len(delivered))
+	}
+	if strings.Contains(delivered[0], "List-Unsubscribe") {
+		t.Errorf("unauthenticated message got List-Unsubscribe: %q", delivered[0])
+	}
+	if !strings.HasPrefix(delivered[1], "List-Unsubscribe: <mailto:unsub@example.com>\r\n") {
+		t.Errorf("authenticated message missing List-Unsubscribe: %q", delivered[1])
+	}
+}
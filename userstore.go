@@ -0,0 +1,259 @@
+package session
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User is an account of UserStore
+type User struct {
+	Name string
+	// Hash is the password hash, see VerifyPassword
+	Hash     string
+	Tenant   string
+	Quota    Quota
+	Disabled bool
+	// Tokens are app tokens accepted in place of the password
+	Tokens []AppToken
+}
+
+// String return the line of user in the user file
+func (u *User) String() string {
+	var opts []string
+	if u.Tenant != "" {
+		opts = append(opts, "tenant="+u.Tenant)
+	}
+	if u.Quota.Bytes > 0 {
+		opts = append(opts, "quota="+strconv.FormatInt(u.Quota.Bytes, 10))
+	}
+	if u.Quota.Messages > 0 {
+		opts = append(opts, "messages="+strconv.FormatInt(u.Quota.Messages, 10))
+	}
+	if u.Disabled {
+		opts = append(opts, "disabled")
+	}
+	for _, t := range u.Tokens {
+		opts = append(opts, "token="+t.String())
+	}
+	line := u.Name + ":" + u.Hash
+	if len(opts) > 0 {
+		line += ":" + strings.Join(opts, ",")
+	}
+	return line
+}
+
+// parseUser parse htpasswd style line "name:hash[:options]" where
+// options are comma separated tenant=, quota= (bytes with optional
+// K, M or G suffix), messages=, token= and disabled
+func parseUser(line string) (*User, error) {
+	parts := strings.SplitN(line, ":", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("session: invalid user line %q", line)
+	}
+	u := &User{Name: strings.ToLower(parts[0]), Hash: parts[1]}
+	if len(parts) < 3 {
+		return u, nil
+	}
+
+	for _, opt := range strings.Split(parts[2], ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(opt), "=")
+		var err error
+		switch key {
+		case "":
+		case "tenant":
+			u.Tenant = value
+		case "quota":
+			u.Quota.Bytes, err = parseSize(value)
+		case "messages":
+			u.Quota.Messages, err = strconv.ParseInt(value, 10, 64)
+		case "disabled":
+			u.Disabled = true
+		case "token":
+			var t AppToken
+			if t, err = parseAppToken(value); err == nil {
+				u.Tokens = append(u.Tokens, t)
+			}
+		default:
+			err = fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("session: user %s: %v", u.Name, err)
+		}
+	}
+	return u, nil
+}
+
+// parseSize parse size like "512", "10M" or "1G"
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// ReadUsers read user lines, blank lines and # comments are skipped
+func ReadUsers(r io.Reader) (map[string]*User, error) {
+	users := make(map[string]*User)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		u, err := parseUser(line)
+		if err != nil {
+			return nil, err
+		}
+		users[u.Name] = u
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// UserStore is a file of accounts for small deployments that run
+// submission without a database. it is an Authenticator and a
+// QuotaSource, and reload the file when it is modified
+type UserStore struct {
+	Path string
+	// Logger receive errors reading the file, default to the
+	// standard logger
+	Logger *Logger
+
+	mu       sync.RWMutex
+	users    map[string]*User
+	modTime  time.Time
+	activity []Activity
+
+	dummyOnce sync.Once
+	dummy     string
+}
+
+// OpenUserStore load the user file at path
+func OpenUserStore(path string) (*UserStore, error) {
+	us := &UserStore{Path: path}
+	if err := us.Reload(); err != nil {
+		return nil, err
+	}
+	return us, nil
+}
+
+// Reload read the user file again
+func (us *UserStore) Reload() error {
+	fi, err := os.Stat(us.Path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(us.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users, err := ReadUsers(f)
+	if err != nil {
+		return err
+	}
+
+	us.mu.Lock()
+	us.users, us.modTime = users, fi.ModTime()
+	us.mu.Unlock()
+	return nil
+}
+
+// refresh reload the file when it is modified, a file that can't be
+// read keeps the loaded users
+func (us *UserStore) refresh() {
+	fi, err := os.Stat(us.Path)
+	if err != nil {
+		logf(us.Logger, LevelWarn, "userstore: %v", err)
+		return
+	}
+	us.mu.RLock()
+	changed := !fi.ModTime().Equal(us.modTime)
+	us.mu.RUnlock()
+	if !changed {
+		return
+	}
+	if err := us.Reload(); err != nil {
+		logf(us.Logger, LevelWarn, "userstore: %v", err)
+	}
+}
+
+// User return the account of name
+func (us *UserStore) User(name string) (*User, bool) {
+	us.refresh()
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	u, ok := us.users[strings.ToLower(name)]
+	if !ok {
+		return nil, false
+	}
+	copied := *u
+	return &copied, true
+}
+
+// Authenticate verify the password or an app token of an enabled
+// user, the principal of app token has its ID
+func (us *UserStore) Authenticate(username, password string) (*Principal, error) {
+	u, ok := us.User(username)
+	if !ok {
+		// hash anyway so unknown users take as long as known ones
+		us.dummyOnce.Do(func() { us.dummy, _ = HashPassword("") })
+		VerifyPassword(us.dummy, password)
+		return nil, ErrAuthFailed
+	}
+	t, ok := u.matchToken(password)
+	if ok {
+		if u.Disabled {
+			us.record(u.Name, "auth failed token "+t.ID)
+			return nil, ErrAuthFailed
+		}
+		us.record(u.Name, "auth token "+t.ID)
+		return &Principal{Username: u.Name, Tenant: u.Tenant, Token: t.ID}, nil
+	}
+
+	// a password may look like a credential of a token of the user
+	match, err := VerifyPassword(u.Hash, password)
+	if err != nil {
+		logf(us.Logger, LevelWarn, "userstore: user %s: %v", u.Name, err)
+	}
+	if !match || u.Disabled {
+		if t != nil {
+			us.record(u.Name, "auth failed token "+t.ID)
+		} else {
+			us.record(u.Name, "auth failed")
+		}
+		return nil, ErrAuthFailed
+	}
+	us.record(u.Name, "auth")
+	return &Principal{Username: u.Name, Tenant: u.Tenant}, nil
+}
+
+// Quota return the quota of the user named mailbox
+func (us *UserStore) Quota(mailbox string) (Quota, error) {
+	u, ok := us.User(mailbox)
+	if !ok {
+		return Quota{}, nil
+	}
+	return u.Quota, nil
+}
@@ -0,0 +1,108 @@
+package session
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseUser make sure that user lines are parsed with options
+// and formatted back
+func TestParseUser(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected *User
+	}{
+		{"user:" + testHash, &User{Name: "user", Hash: testHash}},
+		{"User@Example.com:" + testHash + ":tenant=acme,quota=10M,messages=100,disabled",
+			&User{Name: "user@example.com", Hash: testHash, Tenant: "acme", Quota: Quota{Bytes: 10 << 20, Messages: 100}, Disabled: true}},
+		{"user", nil},
+		{":" + testHash, nil},
+		{"user:" + testHash + ":quota=10X", nil},
+		{"user:" + testHash + ":unknown", nil},
+	}
+
+	for _, input := range cases {
+		got, err := parseUser(input.line)
+		if input.expected == nil {
+			if err == nil {
+				t.Errorf("%q: expected error", input.line)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, input.expected) {
+			t.Errorf("%q: got %+v, %v, expected %+v", input.line, got, err, input.expected)
+			continue
+		}
+		if again, _ := parseUser(got.String()); !reflect.DeepEqual(again, got) {
+			t.Errorf("%q: formatted as %q", input.line, got.String())
+		}
+	}
+}
+
+// TestUserStore make sure that the store authenticate enabled users,
+// return quotas and reload the modified file
+func TestUserStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	content := "# accounts\nuser:" + testHash + ":tenant=acme,quota=1G\n" +
+		"old:" + testHash + ":disabled\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	us, err := OpenUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		username string
+		password string
+		tenant   string
+		err      error
+	}{
+		{"user", "secret", "acme", nil},
+		{"USER", "secret", "acme", nil},
+		{"user", "wrong", "", ErrAuthFailed},
+		{"old", "secret", "", ErrAuthFailed},
+		{"nobody", "secret", "", ErrAuthFailed},
+	}
+	for _, input := range cases {
+		p, err := us.Authenticate(input.username, input.password)
+		if err != input.err || (p != nil && p.Tenant != input.tenant) {
+			t.Errorf("%s: got %+v, %v, expected tenant %q, %v", input.username, p, err, input.tenant, input.err)
+		}
+	}
+
+	if q, _ := us.Quota("user"); q.Bytes != 1<<30 {
+		t.Errorf("got quota %+v, expected 1G", q)
+	}
+
+	// disable user and enable old
+	content = "user:" + testHash + ":disabled\nold:" + testHash + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path, future, future)
+	if _, err := us.Authenticate("user", "secret"); err != ErrAuthFailed {
+		t.Errorf("got %v, expected disabled user after reload", err)
+	}
+	if _, err := us.Authenticate("old", "secret"); err != nil {
+		t.Errorf("got %v, expected enabled user after reload", err)
+	}
+	// the loaded users are kept when the file is gone and the
+	// error is logged into Logger
+	var buf bytes.Buffer
+	us.Logger = NewLogger(&buf)
+	os.Remove(path)
+	if _, err := us.Authenticate("old", "secret"); err != nil {
+		t.Errorf("got %v, expected loaded user", err)
+	}
+	if !strings.Contains(buf.String(), "userstore: ") {
+		t.Errorf("got log %q, expected userstore error", buf.String())
+	}
+}
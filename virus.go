@@ -0,0 +1,183 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// default settings of ClamAV
+const (
+	defaultClamAVTimeout = 30 * time.Second
+	clamAVChunkSize      = 32 * 1024
+)
+
+// virusScanErr is replied when the scanner fail
+var virusScanErr = NewSMTPError(451, [3]int{4, 7, 0}, "Virus scan failed, try again later")
+
+// errScanDone stop the message data sent to finished scanner
+var errScanDone = errors.New("virus scan done")
+
+// VirusScanner scan message data for viruses while it is received
+type VirusScanner interface {
+	// ScanStream read message data from r and return the name of
+	// the virus found, or "" for clean message. r may return an
+	// error when the message is abandoned
+	ScanStream(ctx context.Context, r io.Reader) (virus string, err error)
+}
+
+// ClamAV is a VirusScanner sending message data to clamd with the
+// INSTREAM command
+type ClamAV struct {
+	// Addr of clamd, a path of unix socket or host:port, default
+	// to "localhost:3310"
+	Addr string
+	// Timeout of a scan, default to 30 seconds
+	Timeout time.Duration
+}
+
+// dial connect to clamd
+func (c *ClamAV) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	switch {
+	case c.Addr == "":
+		return d.DialContext(ctx, "tcp", "localhost:3310")
+	case strings.HasPrefix(c.Addr, "/"):
+		return d.DialContext(ctx, "unix", c.Addr)
+	}
+	return d.DialContext(ctx, "tcp", c.Addr)
+}
+
+// ScanStream send r in chunks as soon as they are read
+func (c *ClamAV) ScanStream(ctx context.Context, r io.Reader) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, durationOr(c.Timeout, defaultClamAVTimeout))
+	defer cancel()
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+clamAVChunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf[4:])
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			return "", rerr
+		}
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				// clamd close the connection when the stream
+				// exceed its size limit, read its reply
+				break
+			}
+		}
+		if rerr != nil {
+			binary.BigEndian.PutUint32(buf, 0)
+			conn.Write(buf[:4])
+			break
+		}
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	return parseClamAVReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamAVReply parse "stream: OK" or "stream: <name> FOUND"
+func parseClamAVReply(reply string) (string, error) {
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", errors.New("clamav: " + reply)
+}
+
+// virusErr return the reply of message infected by virus
+func virusErr(virus string) *SMTPError {
+	virus = strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '?'
+		}
+		return r
+	}, virus)
+	return NewSMTPError(554, [3]int{5, 7, 1}, "Message rejected: virus found: "+virus)
+}
+
+// virusScan is a scan running along the reading of message data
+type virusScan struct {
+	pw    *io.PipeWriter
+	done  chan struct{}
+	virus string
+	err   error
+}
+
+// startScan start scanning message data with Config.VirusScanner,
+// nil when not configured
+func (s *Session) startScan() *virusScan {
+	scanner := s.Config.VirusScanner
+	if scanner == nil {
+		return nil
+	}
+	pr, pw := io.Pipe()
+	vs := &virusScan{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(vs.done)
+		vs.virus, vs.err = scanner.ScanStream(context.Background(), pr)
+		pr.CloseWithError(errScanDone)
+	}()
+	return vs
+}
+
+// write send p to the scanner. data after the scanner returned is
+// dropped
+func (vs *virusScan) write(p []byte) {
+	vs.pw.Write(p)
+}
+
+// abort stop the scan of abandoned message
+func (vs *virusScan) abort(err error) {
+	vs.pw.CloseWithError(err)
+}
+
+// finish wait for the verdict. it return the reply of infected
+// message or failed scan
+func (s *Session) finishScan(vs *virusScan) error {
+	vs.pw.Close()
+	<-vs.done
+	if vs.err != nil {
+		s.logf(LevelWarn, "virus scan: %v", vs.err)
+		return virusScanErr
+	}
+	if vs.virus != "" {
+		s.logf(LevelInfo, "virus found: %s", vs.virus)
+		return virusErr(vs.virus)
+	}
+	return nil
+}
+
+// scanData scan complete message data, e.g. received with BDAT
+func (s *Session) scanData(data []byte) error {
+	vs := s.startScan()
+	if vs == nil {
+		return nil
+	}
+	io.Copy(vs.pw, bytes.NewReader(data))
+	return s.finishScan(vs)
+}
@@ -0,0 +1,115 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeClamd answer INSTREAM commands, messages containing EICAR are
+// infected
+func fakeClamd(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if cmd, _ := r.ReadString(0); cmd != "zINSTREAM\x00" {
+					t.Errorf("got command %q", cmd)
+					return
+				}
+				var data bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					io.CopyN(&data, r, int64(size))
+				}
+				if bytes.Contains(data.Bytes(), []byte("EICAR")) {
+					io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+				} else {
+					io.WriteString(conn, "stream: OK\x00")
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// TestVirusScanner make sure that infected messages are rejected
+// with the virus name whether they are buffered, streamed or sent
+// with BDAT
+func TestVirusScanner(t *testing.T) {
+	addr := fakeClamd(t)
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	clean := "Subject: a\r\n\r\n" + strings.Repeat("clean line\r\n", 10000)
+	infected := "Subject: a\r\n\r\nX5O!P%@AP EICAR-STANDARD-ANTIVIRUS-TEST-FILE\r\n"
+	virus := "554 5.7.1 Message rejected: virus found: Eicar-Test-Signature"
+	cases := []struct {
+		name    string
+		addr    string
+		backend Backend
+		data    string
+		reply   string
+	}{
+		{"clean", addr, nil, "DATA\r\n" + clean + ".\r\n", "250 2.0.0 OK: queued as "},
+		{"infected", addr, nil, "DATA\r\n" + infected + ".\r\n", virus},
+		{"stream clean", addr, &streamRecorder{}, "DATA\r\n" + clean + ".\r\n", "250 2.0.0 OK: queued as "},
+		{"stream infected", addr, &streamRecorder{}, "DATA\r\n" + infected + ".\r\n", virus},
+		{"bdat infected", addr, nil, "BDAT 60 LAST\r\n" + infected, virus},
+		{"down", down.Addr().String(), nil, "DATA\r\n" + infected + ".\r\n", "451 4.7.0"},
+	}
+
+	for _, input := range cases {
+		config := &Config{VirusScanner: &ClamAV{Addr: input.addr}, Backend: input.backend, Chunking: true}
+		out := runSession(t, config, "EHLO client.com\r\nMAIL FROM:<a@client.com>\r\nRCPT TO:<b@example.com>\r\n"+
+			input.data+"QUIT\r\n")
+		if !strings.Contains(out, input.reply) {
+			t.Errorf("%s: got %q, expected %q", input.name, out, input.reply)
+		}
+		if b, ok := input.backend.(*streamRecorder); ok && (b.readErr != nil) != (input.reply == virus) {
+			t.Errorf("%s: got read error %v", input.name, b.readErr)
+		}
+	}
+}
+
+// TestParseClamAVReply make sure that clamd replies are parsed
+func TestParseClamAVReply(t *testing.T) {
+	cases := []struct {
+		reply string
+		virus string
+		ok    bool
+	}{
+		{"stream: OK", "", true},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", "Win.Test.EICAR_HDB-1", true},
+		{"INSTREAM size limit exceeded. ERROR", "", false},
+	}
+	for _, input := range cases {
+		virus, err := parseClamAVReply(input.reply)
+		if virus != input.virus || (err == nil) != input.ok {
+			t.Errorf("%s: got %q %v", input.reply, virus, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package session
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// REPLY_252 is sent when VRFY is not answered accurately
+const REPLY_252 = "252 2.5.0 Cannot VRFY user, but will accept message and attempt delivery"
+
+// default rate limit of accurate VRFY replies
+const (
+	defaultVRFYLimit  = 10
+	defaultVRFYPeriod = time.Minute
+)
+
+// vrfyNotExistErr is sent when verified mailbox doesn't exist
+var vrfyNotExistErr = NewSMTPError(550, [3]int{5, 1, 1}, "Mailbox unavailable")
+
+// Verifier look up whether a mailbox exist
+type Verifier interface {
+	Verify(ctx context.Context, addr string) (bool, error)
+}
+
+// VerifierFunc is an adapter to allow the use of ordinary
+// functions as Verifier
+type VerifierFunc func(ctx context.Context, addr string) (bool, error)
+
+// Verify call f(ctx, addr)
+func (f VerifierFunc) Verify(ctx context.Context, addr string) (bool, error) {
+	return f(ctx, addr)
+}
+
+// VRFY answer VRFY command accurately for authenticated clients
+// and allowlisted networks, everyone else receive 252 so the
+// command can't be used to harvest addresses
+type VRFY struct {
+	Verifier Verifier
+
+	// Allow is the list of networks that receive accurate replies
+	// without authentication
+	Allow []*net.IPNet
+
+	// Limit is the number of accurate replies per client in each
+	// Period, replies over the limit fall back to 252.
+	// default to 10 per minute
+	Limit  int
+	Period time.Duration
+
+	limiter TokenBucket
+}
+
+// trusted report whether ip is in the allowlist
+func (v *VRFY) trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range v.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allow report whether the client identified by key may receive
+// another accurate reply
+func (v *VRFY) allow(key string) bool {
+	limit := v.Limit
+	if limit <= 0 {
+		limit = defaultVRFYLimit
+	}
+	return v.limiter.allow(key, Rate{limit, durationOr(v.Period, defaultVRFYPeriod)}, time.Now())
+}
+
+// Vrfy answer VRFY command, the returned string is the reply
+// to be sent on success
+func (s *Session) Vrfy(c command) (string, error) {
+	arg := strings.Trim(c.Arg(), "<>")
+	if arg == "" {
+		return "", invalidCommandArgErr
+	}
+
+	v := s.Config.VRFY
+	if v == nil || v.Verifier == nil {
+		return REPLY_252, nil
+	}
+
+	ip := s.RemoteIP()
+	key := ""
+	switch {
+	case s.Principal != nil:
+		key = "user:" + s.Principal.Username
+	case v.trusted(ip):
+		key = "ip:" + ip.String()
+	default:
+		return REPLY_252, nil
+	}
+	if !v.allow(key) {
+		return REPLY_252, nil
+	}
+
+	addr := arg
+	if a := findAddress(arg); a != "" {
+		addr = a
+	}
+	ok, err := v.Verifier.Verify(context.Background(), addr)
+	if err != nil {
+		return REPLY_252, nil
+	}
+	if !ok {
+		return "", vrfyNotExistErr
+	}
+	return "250 2.1.5 <" + addr + ">", nil
+}
@@ -0,0 +1,61 @@
+package session
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestSessionVrfy make sure that only trusted clients receive
+// accurate replies within the rate limit
+func TestSessionVrfy(t *testing.T) {
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	verifier := VerifierFunc(func(ctx context.Context, addr string) (bool, error) {
+		return addr == "some@domain.com", nil
+	})
+
+	cases := []struct {
+		config   *Config
+		remote   string
+		input    string
+		expected []string
+	}{
+		{
+			&Config{},
+			"",
+			"VRFY some@domain.com\r\nVRFY\r\nQUIT\r\n",
+			[]string{"252 2.5.0", "501 5.5.4"},
+		},
+		{
+			&Config{VRFY: &VRFY{Verifier: verifier, Allow: []*net.IPNet{internal}}},
+			"192.0.2.1:25",
+			"VRFY some@domain.com\r\nQUIT\r\n",
+			[]string{"252 2.5.0"},
+		},
+		{
+			&Config{VRFY: &VRFY{Verifier: verifier, Allow: []*net.IPNet{internal}}},
+			"10.1.2.3:25",
+			"VRFY <some@domain.com>\r\nVRFY other@domain.com\r\nQUIT\r\n",
+			[]string{"250 2.1.5 <some@domain.com>", "550 5.1.1"},
+		},
+		{
+			&Config{VRFY: &VRFY{Verifier: verifier, Allow: []*net.IPNet{internal}, Limit: 1}},
+			"10.1.2.3:25",
+			"VRFY other@domain.com\r\nVRFY other@domain.com\r\nQUIT\r\n",
+			[]string{"550 5.1.1", "252 2.5.0"},
+		},
+	}
+
+	for _, input := range cases {
+		out := runSessionFrom(t, input.config, input.remote, input.input)
+		pos := 0
+		for _, e := range input.expected {
+			i := strings.Index(out[pos:], e)
+			if i < 0 {
+				t.Fatalf("got: %q, expected %q in order", out, e)
+			}
+			pos += i + len(e)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// warmUpErr is sent when acceptance limit of warm-up is exceeded
+var warmUpErr = NewSMTPError(421, [3]int{4, 3, 2}, "System warming up, try again later")
+
+// warmUpMailErr is sent when message limit of warm-up is exceeded
+var warmUpMailErr = NewSMTPError(451, [3]int{4, 3, 2}, "System warming up, try again later")
+
+// WarmUp ramp acceptance limits after start from floor to maximum
+// over Period, so reconnect storms after restart don't overwhelm
+// cold caches and backends. zero maximum is unlimited after Period
+type WarmUp struct {
+	Period time.Duration
+
+	// connections per second
+	ConnectionFloor int
+	MaxConnections  int
+
+	// messages (MAIL commands) per second
+	MessageFloor int
+	MaxMessages  int
+
+	once    sync.Once
+	start   time.Time
+	buckets TokenBucket
+}
+
+// Start mark the beginning of warm-up, it is called by the first
+// check when not called before
+func (w *WarmUp) Start(now time.Time) {
+	w.once.Do(func() {
+		w.start = now
+	})
+}
+
+// limit return the current limit per second between floor and max,
+// zero is unlimited
+func (w *WarmUp) limit(floor, max int, now time.Time) int {
+	elapsed := now.Sub(w.start)
+	if elapsed >= w.Period {
+		return max
+	}
+	if max <= 0 || floor <= 0 {
+		// without floor or max the limit can't be ramped
+		return floor
+	}
+	return floor + int(float64(max-floor)*float64(elapsed)/float64(w.Period))
+}
+
+// allow take a token from the bucket of key with the current limit
+func (w *WarmUp) allow(key string, floor, max int, now time.Time) bool {
+	w.Start(now)
+	limit := w.limit(floor, max, now)
+	if limit <= 0 {
+		return true
+	}
+	return w.buckets.allow(key, Rate{Count: limit, Per: time.Second}, now)
+}
+
+// checkWarmUp check acceptance limit of the stage during warm-up
+func (s *Session) checkWarmUp(stage Stage) error {
+	w := s.Config.WarmUp
+	if w == nil {
+		return nil
+	}
+	now := time.Now()
+	switch stage {
+	case StageConnect:
+		if !w.allow("conn", w.ConnectionFloor, w.MaxConnections, now) {
+			return warmUpErr
+		}
+	case StageMail:
+		if !w.allow("msg", w.MessageFloor, w.MaxMessages, now) {
+			return warmUpMailErr
+		}
+	}
+	return nil
+}
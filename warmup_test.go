@@ -0,0 +1,50 @@
+package session
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWarmUpLimit make sure that the limit ramp from floor to max
+func TestWarmUpLimit(t *testing.T) {
+	start := time.Now()
+	w := &WarmUp{Period: 10 * time.Minute}
+	w.Start(start)
+
+	cases := []struct {
+		floor, max int
+		at         time.Duration
+		expected   int
+	}{
+		{10, 110, 0, 10},
+		{10, 110, 5 * time.Minute, 60},
+		{10, 110, 10 * time.Minute, 110},
+		{10, 0, 5 * time.Minute, 10},
+		{10, 0, 10 * time.Minute, 0},
+		{0, 0, 0, 0},
+	}
+
+	for _, input := range cases {
+		got := w.limit(input.floor, input.max, start.Add(input.at))
+		if got != input.expected {
+			t.Errorf("limit(%d, %d) at %v == %d, expected %d", input.floor, input.max, input.at, got, input.expected)
+		}
+	}
+}
+
+// TestSessionWarmUp make sure that connections and messages over
+// the warm-up limit are tempfailed
+func TestSessionWarmUp(t *testing.T) {
+	config := &Config{WarmUp: &WarmUp{Period: time.Hour, ConnectionFloor: 1, MaxConnections: 100, MessageFloor: 1, MaxMessages: 100}}
+
+	out := runSession(t, config, "EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nRSET\r\nMAIL FROM:<some@example.com>\r\nQUIT\r\n")
+	if !strings.Contains(out, "250 2.0.0 OK\r\n451 4.3.2 System warming up") {
+		t.Errorf("got: %q, expected second message tempfailed", out)
+	}
+
+	out = runSession(t, config, "QUIT\r\n")
+	if !strings.HasPrefix(out, "421 4.3.2 System warming up") {
+		t.Errorf("got: %q, expected second connection tempfailed", out)
+	}
+}
@@ -0,0 +1,199 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// default limits of WASM plugin calls
+const (
+	defaultWASMTimeout     = time.Second
+	defaultWASMMemoryPages = 256 // 16 MiB
+)
+
+// errNoWASMRuntime is returned when WASM plugin is loaded before
+// a runtime is installed with SetWASMRuntime
+var errNoWASMRuntime = errors.New("session: WASM runtime is not installed")
+
+// WASMLimits is the sandbox limits of a module instance
+type WASMLimits struct {
+	// MemoryPages is the maximum linear memory in 64 KiB pages
+	MemoryPages uint32
+}
+
+// WASMRuntime compile and instantiate WASM modules. this package
+// doesn't bundle a runtime, install an adapter of e.g. wazero with
+// SetWASMRuntime to enable "wasm" plugins
+type WASMRuntime interface {
+	Instantiate(ctx context.Context, module []byte, limits WASMLimits) (WASMModule, error)
+}
+
+// WASMModule is an instantiated module. Call pass input into the
+// exported function fn and return its output, the module has no
+// access to the host other than input and output
+type WASMModule interface {
+	Call(ctx context.Context, fn string, input []byte) ([]byte, error)
+	Close(ctx context.Context) error
+}
+
+var (
+	wasmMu      sync.RWMutex
+	wasmRuntime WASMRuntime
+)
+
+// SetWASMRuntime install the runtime used by "wasm" plugins
+func SetWASMRuntime(rt WASMRuntime) {
+	wasmMu.Lock()
+	defer wasmMu.Unlock()
+	wasmRuntime = rt
+}
+
+// wasmRequest is the input of exported functions. "check" receive
+// every field except Data, "filter" receive the message data too
+type wasmRequest struct {
+	Stage     Stage    `json:"stage"`
+	RemoteIP  string   `json:"remote_ip,omitempty"`
+	Helo      string   `json:"helo,omitempty"`
+	MailFrom  string   `json:"mail_from,omitempty"`
+	Rcpt      string   `json:"rcpt,omitempty"`
+	RcptTo    []string `json:"rcpt_to,omitempty"`
+	Data      []byte   `json:"data,omitempty"`
+	Principal string   `json:"principal,omitempty"`
+}
+
+// WASMPlugin is a Filter and Policy implemented by WASM module that
+// export "filter" and "check" functions. both take JSON request and
+// return JSON verdict like {"action":"reject","code":550,"message":"spam"}
+type WASMPlugin struct {
+	module  WASMModule
+	timeout time.Duration
+	// FailOpen accept when the module fail instead of tempfail
+	FailOpen bool
+
+	// modules are not safe for concurrent calls
+	mu sync.Mutex
+}
+
+// NewWASMPlugin instantiate module with the installed runtime
+func NewWASMPlugin(module []byte, limits WASMLimits, timeout time.Duration) (*WASMPlugin, error) {
+	wasmMu.RLock()
+	rt := wasmRuntime
+	wasmMu.RUnlock()
+	if rt == nil {
+		return nil, errNoWASMRuntime
+	}
+	if limits.MemoryPages == 0 {
+		limits.MemoryPages = defaultWASMMemoryPages
+	}
+	m, err := rt.Instantiate(context.Background(), module, limits)
+	if err != nil {
+		return nil, err
+	}
+	return &WASMPlugin{module: m, timeout: durationOr(timeout, defaultWASMTimeout)}, nil
+}
+
+// call run exported function fn with the request
+func (p *WASMPlugin) call(fn string, req *wasmRequest) error {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	output, err := p.module.Call(ctx, fn, input)
+	cancel()
+	p.mu.Unlock()
+
+	v := &Verdict{}
+	if err == nil {
+		err = json.Unmarshal(output, v)
+	}
+	if err == nil {
+		if err = v.Err(); err == nil || isSMTPError(err) {
+			return err
+		}
+	}
+	if p.FailOpen {
+		return nil
+	}
+	return localErr
+}
+
+// Filter call exported "filter" function with the message
+func (p *WASMPlugin) Filter(envl *Envelope, data []byte) ([]byte, error) {
+	req := &wasmRequest{
+		Stage:    StageData,
+		MailFrom: envl.OriginatorAddress,
+		RcptTo:   envl.RecipientAddress,
+		Data:     data,
+	}
+	if err := p.call("filter", req); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Check call exported "check" function with the session state
+func (p *WASMPlugin) Check(ctx context.Context, req *PolicyRequest) error {
+	r := &wasmRequest{Stage: req.Stage, Rcpt: req.Recipient}
+	if s := req.Session; s != nil {
+		r.RemoteIP = remoteIP(s.Conn)
+		r.Helo = s.HeloName
+		if s.Principal != nil {
+			r.Principal = s.Principal.Username
+		}
+	}
+	if req.Envelope != nil {
+		r.MailFrom = req.Envelope.OriginatorAddress
+		r.RcptTo = req.Envelope.RecipientAddress
+	}
+	return p.call("check", r)
+}
+
+// Close release the module instance
+func (p *WASMPlugin) Close() error {
+	return p.module.Close(context.Background())
+}
+
+// newWASMPlugin create WASM plugin from options: "path" of the module,
+// "timeout" of each call, "memory_pages" and "fail_open"
+func newWASMPlugin(opts Options) (interface{}, error) {
+	module, err := os.ReadFile(opts["path"])
+	if err != nil {
+		return nil, err
+	}
+
+	var limits WASMLimits
+	if v := opts["memory_pages"]; v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("wasm: invalid memory_pages %q", v)
+		}
+		limits.MemoryPages = uint32(n)
+	}
+	var timeout time.Duration
+	if v := opts["timeout"]; v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("wasm: invalid timeout %q", v)
+		}
+	}
+
+	p, err := NewWASMPlugin(module, limits, timeout)
+	if err != nil {
+		return nil, err
+	}
+	p.FailOpen = opts["fail_open"] == "true"
+	return p, nil
+}
+
+func init() {
+	Register(PluginFilter, "wasm", newWASMPlugin)
+	Register(PluginPolicy, "wasm", newWASMPlugin)
+}
@@ -0,0 +1,82 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeWASMRuntime run Go function instead of WASM module
+type fakeWASMRuntime struct {
+	fn func(fn string, req *wasmRequest) ([]byte, error)
+}
+
+func (rt *fakeWASMRuntime) Instantiate(ctx context.Context, module []byte, limits WASMLimits) (WASMModule, error) {
+	if string(module) != "\x00asm" {
+		return nil, errors.New("invalid module")
+	}
+	return rt, nil
+}
+
+func (rt *fakeWASMRuntime) Call(ctx context.Context, fn string, input []byte) ([]byte, error) {
+	req := &wasmRequest{}
+	if err := json.Unmarshal(input, req); err != nil {
+		return nil, err
+	}
+	return rt.fn(fn, req)
+}
+
+func (rt *fakeWASMRuntime) Close(ctx context.Context) error {
+	return nil
+}
+
+// TestWASMPlugin make sure that WASM plugin is loaded by name and
+// its verdict is applied by session
+func TestWASMPlugin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter.wasm")
+	if err := os.WriteFile(path, []byte("\x00asm"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{}
+	spec := []PluginSpec{{Kind: PluginFilter, Name: "wasm", Options: Options{"path": path}}}
+
+	SetWASMRuntime(nil)
+	if err := config.LoadPlugins(spec); err != errNoWASMRuntime {
+		t.Errorf("got %v, expected %v", err, errNoWASMRuntime)
+	}
+
+	SetWASMRuntime(&fakeWASMRuntime{fn: func(fn string, req *wasmRequest) ([]byte, error) {
+		if fn == "filter" && strings.Contains(string(req.Data), "viagra") {
+			return []byte(`{"action":"reject","code":554,"message":"Spam"}`), nil
+		}
+		if fn == "filter" && strings.Contains(string(req.Data), "crash") {
+			return nil, errors.New("trap")
+		}
+		return []byte(`{"action":"accept"}`), nil
+	}})
+	defer SetWASMRuntime(nil)
+
+	if err := config.LoadPlugins(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		body     string
+		expected string
+	}{
+		{"hello", "250 2.0.0"},
+		{"buy viagra", "554 5.7.1 Spam"},
+		{"crash", "451 4.3.0"},
+	}
+	for _, input := range cases {
+		out := runSession(t, config, "EHLO client.com\r\nMAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\nSubject: test\r\n\r\n"+input.body+"\r\n.\r\nQUIT\r\n")
+		if !strings.Contains(out, "354") || !strings.Contains(out[strings.Index(out, "354"):], input.expected) {
+			t.Errorf("got: %q, expected %q after DATA", out, input.expected)
+		}
+	}
+}
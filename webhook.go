@@ -0,0 +1,178 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pyk/session/mime"
+)
+
+// default settings of Webhook
+const (
+	defaultWebhookTimeout    = 10 * time.Second
+	defaultWebhookRetryDelay = time.Second
+)
+
+// WebhookSignatureHeader is the header field of Webhook signature,
+// "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">"
+const WebhookSignatureHeader = "X-Webhook-Signature"
+
+// webhookRejectErr is replied when the endpoint answer 406
+var webhookRejectErr = NewSMTPError(550, [3]int{5, 7, 1}, "Message rejected by recipient service")
+
+// errWebhookSignature is returned by VerifyWebhook
+var errWebhookSignature = errors.New("webhook: invalid signature")
+
+// WebhookPayload is the JSON body posted by Webhook. Raw is the whole
+// message, or Text, HTML and Attachments with Webhook.Parse
+type WebhookPayload struct {
+	Envelope    *Envelope
+	MessageID   string               `json:",omitempty"`
+	Subject     string               `json:",omitempty"`
+	Headers     map[string][]string  `json:",omitempty"`
+	Raw         []byte               `json:",omitempty"`
+	Text        string               `json:",omitempty"`
+	HTML        string               `json:",omitempty"`
+	Attachments []*WebhookAttachment `json:",omitempty"`
+}
+
+// WebhookAttachment is a non-text part of parsed message
+type WebhookAttachment struct {
+	Filename    string `json:",omitempty"`
+	ContentType string
+	Data        []byte
+}
+
+// Webhook is a Backend posting every accepted message to URL as
+// WebhookPayload. requests are signed with Secret and retried on
+// transport errors and 429 or 5xx replies. the endpoint reject the
+// message permanently by replying 406
+type Webhook struct {
+	URL string
+	// Client default to http.DefaultClient
+	Client *http.Client
+	// Secret sign requests in WebhookSignatureHeader when not empty
+	Secret []byte
+	// Parse send text, HTML and attachments instead of raw message
+	Parse bool
+	// Timeout of each attempt, default to 10 seconds
+	Timeout time.Duration
+	// Retries is the number of attempts after the first one, the
+	// delay is RetryDelay times the attempt, default to 1 second
+	Retries    int
+	RetryDelay time.Duration
+}
+
+// Payload build the payload of message data
+func (w *Webhook) Payload(envl *Envelope, data []byte) *WebhookPayload {
+	p := &WebhookPayload{Envelope: envl}
+	if !w.Parse {
+		p.Raw = data
+		if msg, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+			p.MessageID, p.Subject = msg.Header.Get("Message-Id"), msg.Header.Get("Subject")
+		}
+		return p
+	}
+	msg, err := mime.Parse(bytes.NewReader(data))
+	if err != nil && msg == nil {
+		p.Raw = data
+		return p
+	}
+	p.MessageID, p.Subject, p.Headers = msg.Header.Get("Message-Id"), msg.Header.Get("Subject"), msg.Header
+	p.Text, p.HTML = msg.Text, msg.HTML
+	for _, a := range msg.Attachments {
+		p.Attachments = append(p.Attachments, &WebhookAttachment{Filename: a.Filename, ContentType: a.MediaType, Data: a.Data})
+	}
+	return p
+}
+
+// signWebhook return the signature of body at t
+func signWebhook(secret []byte, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook check the WebhookSignatureHeader of a request body
+// signed with secret no longer than maxAge ago, any age when zero
+func VerifyWebhook(secret []byte, signature string, body []byte, maxAge time.Duration) error {
+	var ts string
+	for _, field := range strings.Split(signature, ",") {
+		if v, ok := strings.CutPrefix(field, "t="); ok {
+			ts = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errWebhookSignature
+	}
+	t := time.Unix(unix, 0)
+	if maxAge > 0 && time.Since(t) > maxAge {
+		return errWebhookSignature
+	}
+	if !hmac.Equal([]byte(signWebhook(secret, t, body)), []byte(signature)) {
+		return errWebhookSignature
+	}
+	return nil
+}
+
+// Deliver post the payload of data to URL
+func (w *Webhook) Deliver(envl *Envelope, data []byte) error {
+	body, err := json.Marshal(w.Payload(envl, data))
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(body)
+		if err == nil || !retry || attempt >= w.Retries {
+			return err
+		}
+		time.Sleep(time.Duration(attempt+1) * durationOr(w.RetryDelay, defaultWebhookRetryDelay))
+	}
+}
+
+// post send body once and report whether a failure can be retried
+func (w *Webhook) post(body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), durationOr(w.Timeout, defaultWebhookTimeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.Secret) > 0 {
+		req.Header.Set(WebhookSignatureHeader, signWebhook(w.Secret, time.Now(), body))
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusNotAcceptable:
+		return false, webhookRejectErr
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook: %s replied %s", w.URL, resp.Status)
+}
@@ -0,0 +1,103 @@
+package session
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const webhookMessage = "Message-ID: <1@client.com>\r\nSubject: hello\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+	"--b\r\nContent-Type: multipart/alternative; boundary=c\r\n\r\n" +
+	"--c\r\nContent-Type: text/plain\r\n\r\nhi\r\n" +
+	"--c\r\nContent-Type: text/html\r\n\r\n<p>hi</p>\r\n--c--\r\n" +
+	"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=a.pdf\r\n" +
+	"Content-Transfer-Encoding: base64\r\n\r\nJVBERg==\r\n--b--\r\n"
+
+// TestWebhookPayload make sure that parsed payload have text, HTML
+// and attachments
+func TestWebhookPayload(t *testing.T) {
+	envl := &Envelope{OriginatorAddress: "a@client.com"}
+	p := (&Webhook{Parse: true}).Payload(envl, []byte(webhookMessage))
+	if p.MessageID != "<1@client.com>" || p.Subject != "hello" || p.Text != "hi" || p.HTML != "<p>hi</p>" || p.Raw != nil {
+		t.Errorf("got %+v", p)
+	}
+	if len(p.Attachments) != 1 || p.Attachments[0].Filename != "a.pdf" || string(p.Attachments[0].Data) != "%PDF" {
+		t.Errorf("got attachments %+v", p.Attachments)
+	}
+
+	p = (&Webhook{}).Payload(envl, []byte(webhookMessage))
+	if string(p.Raw) != webhookMessage || p.Text != "" || p.Subject != "hello" {
+		t.Errorf("got %+v", p)
+	}
+}
+
+// TestWebhookDeliver make sure that requests are signed, retried and
+// replies of the endpoint are converted to SMTP replies
+func TestWebhookDeliver(t *testing.T) {
+	secret := []byte("secret")
+	cases := []struct {
+		statuses []int
+		reply    string
+		requests int32
+	}{
+		{[]int{200}, "250 2.0.0 OK: queued as ", 1},
+		{[]int{503, 429, 204}, "250 2.0.0 OK: queued as ", 3},
+		{[]int{500, 500, 500}, "451 4.3.0", 3},
+		{[]int{406}, "550 5.7.1", 1},
+		{[]int{400}, "451 4.3.0", 1},
+	}
+
+	for _, input := range cases {
+		var requests int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&requests, 1)
+			body, _ := io.ReadAll(r.Body)
+			if err := VerifyWebhook(secret, r.Header.Get(WebhookSignatureHeader), body, time.Minute); err != nil {
+				t.Errorf("%v: %v", input.statuses, err)
+			}
+			var p WebhookPayload
+			if err := json.Unmarshal(body, &p); err != nil || p.Envelope.OriginatorAddress != "a@client.com" {
+				t.Errorf("%v: got payload %s %v", input.statuses, body, err)
+			}
+			w.WriteHeader(input.statuses[n-1])
+		}))
+		config := &Config{Backend: &Webhook{URL: srv.URL, Secret: secret, Retries: 2, RetryDelay: time.Millisecond}}
+		out := runSession(t, config, "EHLO client.com\r\nMAIL FROM:<a@client.com>\r\nRCPT TO:<b@example.com>\r\n"+
+			"DATA\r\nSubject: hello\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+		srv.Close()
+		if !strings.Contains(out, input.reply) || requests != input.requests {
+			t.Errorf("%v: got %q after %d requests, expected %q after %d", input.statuses, out, requests, input.reply, input.requests)
+		}
+	}
+}
+
+// TestVerifyWebhook make sure that modified, expired and malformed
+// signatures are rejected
+func TestVerifyWebhook(t *testing.T) {
+	secret, body := []byte("secret"), []byte(`{"a":1}`)
+	now := time.Now()
+	cases := []struct {
+		secret    []byte
+		signature string
+		body      string
+		ok        bool
+	}{
+		{secret, signWebhook(secret, now, body), `{"a":1}`, true},
+		{secret, signWebhook(secret, now, body), `{"a":2}`, false},
+		{[]byte("other"), signWebhook(secret, now, body), `{"a":1}`, false},
+		{secret, signWebhook(secret, now.Add(-time.Hour), body), `{"a":1}`, false},
+		{secret, "v1=00", `{"a":1}`, false},
+	}
+	for i, input := range cases {
+		err := VerifyWebhook(input.secret, input.signature, []byte(input.body), time.Minute)
+		if (err == nil) != input.ok {
+			t.Errorf("%d: got %v, expected ok %v", i, err, input.ok)
+		}
+	}
+}
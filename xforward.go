@@ -0,0 +1,142 @@
+package session
+
+import (
+	"net"
+	"strings"
+)
+
+// xforward replies
+var (
+	xforwardAuthErr = NewSMTPError(550, [3]int{5, 7, 0}, "Insufficient XFORWARD authorization")
+	xforwardAttrErr = NewSMTPError(501, [3]int{5, 5, 4}, "Bad XFORWARD attribute")
+)
+
+// xforwardAttrs is advertised on EHLO to authorized clients
+const xforwardAttrs = "XFORWARD NAME ADDR PORT PROTO HELO IDENT SOURCE"
+
+// XForward is the original client of a message relayed by an
+// upstream MTA with XFORWARD command (Postfix XFORWARD_README).
+// unavailable attributes are empty
+type XForward struct {
+	Name   string
+	Addr   string
+	Port   string
+	Proto  string
+	Helo   string
+	Ident  string
+	Source string
+}
+
+func init() {
+	RegisterCommand(Command{
+		Verb:     "XFORWARD",
+		States:   []State{StateHelloed},
+		Validate: validXForward,
+		Handle:   (*Session).cmdXForward,
+	})
+}
+
+// xforwardAllowed report whether the client may send XFORWARD
+func (s *Session) xforwardAllowed() bool {
+	return s.Config.XForwardClients.MatchIP(s.RemoteIP())
+}
+
+// XForward return the original client sent with XFORWARD for the
+// current mail transaction, nil when the client didn't send it
+func (s *Session) XForward() *XForward {
+	return s.xforward
+}
+
+// parseXForward set attributes of "NAME=value ..." into xf. values
+// are xtext, [UNAVAILABLE] and [TEMPUNAVAIL] are empty
+func parseXForward(arg string, xf *XForward) error {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return xforwardAttrErr
+	}
+	for _, f := range fields {
+		name, value, ok := strings.Cut(f, "=")
+		if !ok {
+			return xforwardAttrErr
+		}
+		value, err := decodeXtext(value)
+		if err != nil {
+			return xforwardAttrErr
+		}
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			value = ""
+		}
+		switch strings.ToUpper(name) {
+		case "NAME":
+			xf.Name = value
+		case "ADDR":
+			// IPv6 address may have IPV6: prefix
+			addr := value
+			if len(addr) > 5 && strings.EqualFold(addr[:5], "IPV6:") {
+				addr = addr[5:]
+			}
+			if addr != "" && net.ParseIP(addr) == nil {
+				return xforwardAttrErr
+			}
+			xf.Addr = addr
+		case "PORT":
+			xf.Port = value
+		case "PROTO":
+			xf.Proto = value
+		case "HELO":
+			xf.Helo = value
+		case "IDENT":
+			xf.Ident = value
+		case "SOURCE":
+			xf.Source = value
+		default:
+			return xforwardAttrErr
+		}
+	}
+	return nil
+}
+
+// validXForward check that the client is authorized and attributes
+// are valid
+func validXForward(s *Session, req *CommandRequest) error {
+	if !s.xforwardAllowed() {
+		return xforwardAuthErr
+	}
+	return parseXForward(req.Arg, &XForward{})
+}
+
+// cmdXForward merge attributes into the original client, they are
+// kept until the end of the mail transaction
+func (s *Session) cmdXForward(req *CommandRequest) error {
+	if s.xforward == nil {
+		s.xforward = &XForward{}
+	}
+	parseXForward(req.Arg, s.xforward)
+	s.logf(LevelDebug, "XFORWARD %s", req.Arg)
+	return s.Reply.Transmit(REPLY_250)
+}
+
+// client return HELO name, host name, address and protocol of the
+// client for Received header, the original client when forwarded
+func (s *Session) client() (helo, name, addr, proto string) {
+	helo, name, proto = s.HeloName, s.remoteName(), s.protocol()
+	if ip := s.RemoteIP(); ip != nil {
+		addr = ip.String()
+	}
+	if xf := s.xforward; xf != nil {
+		if xf.Helo != "" {
+			helo = xf.Helo
+		}
+		if xf.Addr != "" {
+			addr = xf.Addr
+		}
+		if xf.Proto != "" {
+			proto = xf.Proto
+		}
+		// our PTR name is the name of the upstream MTA
+		if xf.Addr != "" || xf.Name != "" {
+			name = xf.Name
+		}
+	}
+	return helo, name, addr, proto
+}
@@ -0,0 +1,82 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestParseXForward make sure that XFORWARD attributes are decoded
+func TestParseXForward(t *testing.T) {
+	cases := []struct {
+		arg      string
+		expected XForward
+		err      error
+	}{
+		{"NAME=client.org ADDR=203.0.113.9", XForward{Name: "client.org", Addr: "203.0.113.9"}, nil},
+		{"name=[UNAVAILABLE] addr=IPV6:2001:db8::9 PROTO=ESMTP", XForward{Addr: "2001:db8::9", Proto: "ESMTP"}, nil},
+		{"HELO=mail+20client SOURCE=REMOTE", XForward{Helo: "mail client", Source: "REMOTE"}, nil},
+		{"", XForward{}, xforwardAttrErr},
+		{"ADDR=host", XForward{}, xforwardAttrErr},
+		{"COLOR=red", XForward{}, xforwardAttrErr},
+		{"NAME", XForward{}, xforwardAttrErr},
+	}
+
+	for _, input := range cases {
+		var got XForward
+		err := parseXForward(input.arg, &got)
+		if err != input.err || (err == nil && got != input.expected) {
+			t.Errorf("%q: got %+v, %v, expected %+v, %v", input.arg, got, err, input.expected, input.err)
+		}
+	}
+}
+
+// TestSessionXForward make sure that only authorized upstream MTAs can
+// send XFORWARD and Received header name the original client
+func TestSessionXForward(t *testing.T) {
+	upstream, err := ParseAccessList([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		remote   string
+		input    string
+		expected string
+		received string
+	}{
+		{"192.0.2.1:2525", "XFORWARD NAME=client.org ADDR=203.0.113.9\r\nXFORWARD HELO=mail.client.org PROTO=ESMTP\r\n",
+			"XFORWARD NAME ADDR", "from mail.client.org (client.org [203.0.113.9])\r\n\tby localhost with ESMTP\r\n"},
+		{"198.51.100.1:2525", "XFORWARD ADDR=203.0.113.9\r\n",
+			"550 5.7.0", "from relay.example.net ([198.51.100.1])\r\n\tby localhost with ESMTP\r\n"},
+		{"192.0.2.1:2525", "XFORWARD ADDR=host\r\n",
+			"501 5.5.4", "from relay.example.net ([192.0.2.1])"},
+	}
+
+	for _, input := range cases {
+		var data []string
+		config := &Config{XForwardClients: upstream, AddReceived: true, Backend: BackendFunc(func(envl *Envelope, d []byte) error {
+			data = append(data, string(d))
+			return nil
+		})}
+		out := runSessionFrom(t, config, input.remote, "EHLO relay.example.net\r\n"+input.input+
+			"MAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nXFORWARD ADDR=203.0.113.10\r\nDATA\r\nSubject: a\r\n\r\n.\r\n"+
+			"MAIL FROM:<some@example.com>\r\nRCPT TO:<some@domain.com>\r\nDATA\r\nSubject: a\r\n\r\n.\r\nQUIT\r\n")
+		if !strings.Contains(out, input.expected) {
+			t.Errorf("%s: got %q, expected %q", input.remote, out, input.expected)
+		}
+		if !strings.Contains(out, "503 5.5.1") {
+			t.Errorf("%s: got %q, expected XFORWARD in transaction to be rejected", input.remote, out)
+		}
+		if len(data) != 2 {
+			t.Errorf("%s: got %d messages, expected 2", input.remote, len(data))
+			continue
+		}
+		if !strings.Contains(data[0], input.received) {
+			t.Errorf("%s: got %q, expected Received header with %q", input.remote, data[0], input.received)
+		}
+		// the second transaction is not forwarded anymore
+		if !strings.Contains(data[1], "[192.0.2.1]") && !strings.Contains(data[1], "[198.51.100.1]") {
+			t.Errorf("%s: got %q, expected attributes reset after the transaction", input.remote, data[1])
+		}
+	}
+}